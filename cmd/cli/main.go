@@ -1,13 +1,53 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
+	"localhost-magic/internal/apiauth"
+	"localhost-magic/internal/config"
+	"localhost-magic/internal/credentials"
+	"localhost-magic/internal/discover"
+	"localhost-magic/internal/docker"
+	"localhost-magic/internal/exclude"
+	"localhost-magic/internal/export"
+	"localhost-magic/internal/health"
+	"localhost-magic/internal/hooks"
+	"localhost-magic/internal/lan"
+	"localhost-magic/internal/listing"
+	"localhost-magic/internal/naming"
+	"localhost-magic/internal/output"
+	"localhost-magic/internal/procmap"
+	"localhost-magic/internal/proxy"
+	"localhost-magic/internal/qr"
+	"localhost-magic/internal/registry"
+	"localhost-magic/internal/scan"
+	"localhost-magic/internal/share"
 	"localhost-magic/internal/storage"
+	"localhost-magic/internal/tls/ca"
+	"localhost-magic/internal/tls/issuer"
+	"localhost-magic/internal/tls/policy"
+	"localhost-magic/internal/tls/trust"
+	"localhost-magic/probe"
 )
 
 func main() {
@@ -37,7 +77,9 @@ func main() {
 
 	switch command {
 	case "list", "ls":
-		cmdList(store)
+		cmdList(store, os.Args[2:])
+	case "watch":
+		cmdWatch(store, os.Args[2:])
 	case "rename", "mv":
 		if len(os.Args) < 4 {
 			fmt.Fprintf(os.Stderr, "Usage: localhost-magic rename <old-name> <new-name>\n")
@@ -84,6 +126,28 @@ func main() {
 			}
 		}
 		cmdAdd(store, os.Args[2], port, targetHost)
+	case "qr":
+		cmdQR(store, os.Args[2:])
+	case "share":
+		cmdShare(os.Args[2:])
+	case "unshare":
+		cmdUnshare(os.Args[2:])
+	case "prune":
+		cmdPrune(os.Args[2:])
+	case "export":
+		cmdExport(os.Args[2:])
+	case "bench":
+		cmdBench(store, os.Args[2:])
+	case "probe":
+		cmdProbe(os.Args[2:])
+	case "history":
+		cmdHistory(store, os.Args[2:])
+	case "sockets":
+		cmdSockets(os.Args[2:])
+	case "tls", "cert":
+		cmdTLS(os.Args[2:])
+	case "config":
+		cmdConfig(os.Args[2:])
 	case "help", "-h", "--help":
 		printUsage()
 	default:
@@ -97,12 +161,37 @@ func printUsage() {
 	fmt.Println("localhost-magic - Manage local service DNS names")
 	fmt.Println()
 	fmt.Println("Usage:")
-	fmt.Println("  localhost-magic list                          List all registered services")
+	fmt.Println("  localhost-magic list [--all] [--json] [--expand] [--ports 3000-9000] [--quic] [--quic-ports 443]")
+	fmt.Println("                                                Scan for local services and list them")
+	fmt.Println("  localhost-magic list --registered             List the services registered with the daemon")
+	fmt.Println("  localhost-magic list --include-stale          Also list remembered services that are down")
+	fmt.Println("  localhost-magic watch [--all] [--text] [--ports 3000-9000] [--interval 5s]")
+	fmt.Println("                                                Print services as they appear, change and go away")
 	fmt.Println("  localhost-magic rename <old> <new>            Rename a service")
 	fmt.Println("  localhost-magic keep <name> [true|false]      Toggle keep status (default: true)")
 	fmt.Println("  localhost-magic blacklist <type> <value>      Add to blacklist")
 	fmt.Println("  localhost-magic add <name> [host:]<port>       Add manual service entry")
+	fmt.Println("  localhost-magic qr <name|port> [--png file]  Show a QR code to open a service on another device")
+	fmt.Println("  localhost-magic share <name> [--token] [--auth user:pass] [--idle 30m]")
+	fmt.Println("                                                Make a service reachable from the LAN through the daemon")
+	fmt.Println("  localhost-magic share --list                  List shared services")
+	fmt.Println("  localhost-magic unshare <name>                Stop sharing a service")
+	fmt.Println("  localhost-magic prune [--dry-run] [--days 14]  Forget services not seen for a while")
+	fmt.Println("  localhost-magic export --format hosts|env|caddy|json [--apply]")
+	fmt.Println("                                                Print the registered services for other tools")
+	fmt.Println("  localhost-magic bench <name|port> [-n 50] [-c 4] [--path /health]")
+	fmt.Println("                                                Check a service's latency over a few dozen requests")
+	fmt.Println("  localhost-magic probe [host:]<port> [--deep] [--timeout 2s] [--path /] [--host-header name]")
+	fmt.Println("                                                Probe one port in depth and report what answers (exit 1 if nothing listens)")
+	fmt.Println("  localhost-magic history <name> [-n 20]        Show a service's recent probes and when its state changed")
+	fmt.Println("  localhost-magic sockets [path...]             Probe Unix sockets (default: common locations)")
+	fmt.Println("  localhost-magic tls init [--trust]            Create the local CA (and trust it)")
+	fmt.Println("  localhost-magic tls trust|untrust             Add or remove the CA in the OS trust store")
+	fmt.Println("  localhost-magic tls ensure <name>             Issue a certificate and print its paths")
+	fmt.Println("  localhost-magic cert renew <name>             Have the daemon serve a service over HTTPS with a fresh certificate")
+	fmt.Println("  localhost-magic config check [path]           Validate the daemon's config file")
 	fmt.Println("  localhost-magic --config <path>               Use custom config path")
+	fmt.Println("  Most commands take --output json for a versioned JSON document; watch writes one per event")
 	fmt.Println()
 	fmt.Println("Arguments:")
 	fmt.Println("  <type> for blacklist: pid, path, or pattern")
@@ -110,6 +199,14 @@ func printUsage() {
 	fmt.Println()
 	fmt.Println("Examples:")
 	fmt.Println("  localhost-magic list")
+	fmt.Println("  localhost-magic list --all --ports 1-10000")
+	fmt.Println("  localhost-magic list --json | jq '.[].finding.port'")
+	fmt.Println("  localhost-magic prune --dry-run --output json | jq -r '.data.services[].name'")
+	fmt.Println("  localhost-magic watch --output json | jq -c 'select(.data.type == \"added\")'")
+	fmt.Println("  localhost-magic list --quic --quic-ports 4433")
+	fmt.Println("  localhost-magic watch --text --ports 3000-9000")
+	fmt.Println("  localhost-magic watch --on added --exec 'open \"$LM_URL\"'")
+	fmt.Println("  localhost-magic watch --webhook https://hooks.slack.com/services/...")
 	fmt.Println("  localhost-magic rename myapp.localhost api.localhost")
 	fmt.Println("  localhost-magic keep myapp.localhost")
 	fmt.Println("  localhost-magic keep myapp.localhost false")
@@ -118,10 +215,832 @@ func printUsage() {
 	fmt.Println("  localhost-magic blacklist pattern '^localhost-magic'")
 	fmt.Println("  localhost-magic add myapp.localhost 3000")
 	fmt.Println("  localhost-magic add myapp.localhost 192.168.0.1:3000")
+	fmt.Println("  localhost-magic qr storefront")
+	fmt.Println("  localhost-magic qr 5173 --png storefront.png")
+	fmt.Println("  localhost-magic share web --token --idle 1h")
+	fmt.Println("  localhost-magic prune --dry-run --days 3")
+	fmt.Println("  localhost-magic export --format env > .env.local")
+	fmt.Println("  sudo localhost-magic export --format hosts --apply")
+	fmt.Println("  localhost-magic bench api -n 200 --path /healthz")
+	fmt.Println("  localhost-magic probe 5173 --deep")
+	fmt.Println("  localhost-magic probe 127.0.0.1:8443 --host-header api.localhost --insecure")
+	fmt.Println("  localhost-magic history api -n 30")
+	fmt.Println("  localhost-magic sockets /var/run/docker.sock")
+	fmt.Println("  sudo localhost-magic tls init --trust")
+	fmt.Println("  localhost-magic tls ensure '*.myapp.localhost'")
+	fmt.Println("  localhost-magic cert renew myapp")
+	fmt.Println("  localhost-magic config check && pkill -HUP -f localhost-magic-daemon")
 }
 
-func cmdList(store *storage.Store) {
+// cmdConfig handles "config check": validate the daemon's config file,
+// with the environment overrides the daemon would apply
+func cmdConfig(args []string) {
+	if len(args) == 0 || args[0] != "check" {
+		fmt.Fprintf(os.Stderr, "Usage: localhost-magic config check [path]\n")
+		os.Exit(1)
+	}
+	flags := flag.NewFlagSet("config check", flag.ExitOnError)
+	format := outputFlag(flags)
+	flags.Parse(args[1:])
+	path := config.DefaultPath()
+	if flags.NArg() > 0 {
+		path = flags.Arg(0)
+		flags.Parse(flags.Args()[1:]) // Flags may follow the path too
+	}
+	if flags.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Usage: localhost-magic config check [path]\n")
+		os.Exit(1)
+	}
+	machine := jsonOutput(*format)
+
+	cfg, err := config.Load(path)
+	if err == nil {
+		err = cfg.ApplyEnv(os.Environ())
+	}
+	check := output.ConfigCheck{Path: path, Valid: err == nil}
+	if err != nil {
+		check.Error = err.Error()
+	}
+	switch {
+	case machine:
+		writeOutput(output.KindConfig, check)
+	case check.Valid:
+		fmt.Printf("%s is valid\n", check.Path)
+	default:
+		fmt.Fprintln(os.Stderr, check.Error)
+	}
+	if !check.Valid {
+		os.Exit(1)
+	}
+}
+
+func cmdList(store *storage.Store, args []string) {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	all := flags.Bool("all", false, "include open ports that aren't HTTP")
+	asJSON := flags.Bool("json", false, "print JSON instead of a table")
+	ports := flags.String("ports", "1-65535", "port or range to scan, e.g. 3000-9000")
+	registered := flags.Bool("registered", false, "list the daemon's registered services instead of scanning")
+	quic := flags.Bool("quic", false, "try QUIC on the UDP ports HTTPS services advertise HTTP/3 on")
+	quicPorts := flags.String("quic-ports", "", "comma-separated UDP ports to try a QUIC handshake on, e.g. 443,8443")
+	expand := flags.Bool("expand", false, "list auxiliary endpoints such as HMR ports on rows of their own under their dev server")
+	apiSpec := flags.Bool("api-spec", false, "look for OpenAPI/Swagger documents and GraphQL endpoints at well-known paths (a dozen requests per service)")
+	versions := flags.Bool("versions", false, "check which HTTP versions services support and whether they keep connections alive (an extra request per service)")
+	headers := headerFlag(flags)
+	paths := pathFlag(flags)
+	clientCert := flags.String("client-cert", "", "PEM certificate to present to services that require a client certificate (with --client-key)")
+	clientKey := flags.String("client-key", "", "PEM private key of --client-cert")
+	includeStale := flags.Bool("include-stale", false, "also list the registered services that are down, with when they were last seen")
+	slow := flags.Duration("slow", 0, "time to first byte from which a service is flagged slow (default 1s, or slow_threshold under [scan])")
+	excludeRules := excludeFlag(flags)
+	showExcluded := flags.Bool("show-excluded", false, "print what the exclusion rules left out, and the rule that matched, on stderr (excluded ports are probed so they can be shown)")
+	format := outputFlag(flags)
+	flags.Parse(args)
+	machine := jsonOutput(*format)
+
+	if *registered {
+		cmdListRegistered(store, machine)
+		return
+	}
+
+	from, to, err := parsePortRange(*ports)
+	if err != nil {
+		log.Fatalf("Invalid --ports: %v", err)
+	}
+	cfg := loadConfig()
+	filter := newExclusions(cfg, *excludeRules, *showExcluded)
+	opts := scan.ScanOptions{
+		Exclude:       filter.skipPorts(),
+		Probe:         probe.ProbeOptions{DetectQUIC: *quic, DetectAPISpec: *apiSpec, DetectVersions: *versions, Headers: headers, Paths: *paths},
+		PriorityPorts: cfg.PriorityPorts(),
+		ExtraAddrs:    cfg.Scan.ExtraAddrs,
+		DiscoverAddrs: cfg.Scan.DiscoverAddrs,
+		SlowThreshold: cfg.Scan.SlowThreshold,
+	}
+	if *slow > 0 {
+		opts.SlowThreshold = *slow
+	}
+	// A slow service is given time to answer, rather than being taken for
+	// one that stays silent
+	threshold := opts.SlowThreshold
+	if threshold <= 0 {
+		threshold = scan.DefaultSlowThreshold
+	}
+	opts.Probe.ReadTimeout = threshold + probe.DefaultReadTimeout
+	if *quicPorts != "" {
+		if opts.QUICPorts, err = parsePortList(*quicPorts); err != nil {
+			log.Fatalf("Invalid --quic-ports: %v", err)
+		}
+	}
+	if *clientCert != "" || *clientKey != "" {
+		cert, err := tls.LoadX509KeyPair(*clientCert, *clientKey)
+		if err != nil {
+			log.Fatalf("Failed to load --client-cert and --client-key: %v", err)
+		}
+		opts.Probe.ClientCert = &cert
+	}
+
+	ctx := context.Background()
+	reg := openRegistry(cfg)
+	opts.Probe.CredentialsFor = probeCredentials(cfg, reg)
+	opts.Probe.Roots = localRoots()
+	apps := probe.NewRouteFinder(cfg.RouteOptions(opts.Probe))
+	width := listing.TerminalWidth(os.Stdout)
+	// On a terminal the priority ports' services are shown as soon as they
+	// are probed, and the rest once the whole range is done
+	quick := false
+	if !*asJSON && !machine && isTerminal(os.Stdout) && hasOtherPorts(from, to, opts.PriorityPorts) {
+		opts.OnTier = func(tier scan.Tier, findings []scan.Finding) {
+			if tier != scan.TierPriority {
+				return
+			}
+			services := listServices(ctx, store, reg, findings, *all, filter, apps)
+			if len(services) == 0 {
+				return
+			}
+			listing.Render(os.Stdout, services, width, *expand)
+			fmt.Fprintln(os.Stderr, "Scanning the other ports...")
+			quick = true
+		}
+	}
+	findings, err := scan.ScanRange(ctx, "localhost", from, to, opts)
+	if err != nil {
+		log.Fatalf("Scan failed: %v", err)
+	}
+	services := listServices(ctx, store, reg, findings, *all, filter, apps)
+	var stale []listing.Service
+	if *includeStale {
+		stale = staleServices(reg, findings, from, to)
+	}
+	if quick {
+		var rest []listing.Service
+		for _, s := range services {
+			if s.Finding.Tier != scan.TierPriority {
+				rest = append(rest, s)
+			}
+		}
+		rest = append(rest, stale...)
+		if len(rest) > 0 {
+			fmt.Println()
+			listing.Render(os.Stdout, rest, width, *expand)
+		}
+		return
+	}
+
+	services = append(services, stale...)
+	if machine {
+		if services == nil {
+			services = []listing.Service{}
+		}
+		writeOutput(output.KindServices, services)
+		return
+	}
+	if *asJSON {
+		if err := listing.WriteJSON(os.Stdout, services); err != nil {
+			log.Fatalf("Failed to write JSON: %v", err)
+		}
+		return
+	}
+	if len(services) == 0 {
+		fmt.Println("No services found.")
+		if !*all {
+			fmt.Println("Use --all to include ports that aren't HTTP.")
+		}
+		return
+	}
+	listing.Render(os.Stdout, services, width, *expand)
+}
+
+// listServices looks up the owners of findings and returns the services
+// worth listing among them, named and grouped with the apps behind the
+// reverse proxies apps finds, leaving out those filter excludes
+func listServices(ctx context.Context, store *storage.Store, reg *registry.Registry, findings []scan.Finding, all bool, filter *exclusions, apps *probe.RouteFinder) []listing.Service {
+	if err := scan.AttachProcesses(findings); err != nil {
+		log.Printf("Warning: failed to look up processes: %v", err)
+	}
+	if err := scan.AttachContainers(ctx, findings, docker.New("")); err != nil {
+		log.Printf("Warning: failed to look up Docker containers: %v", err)
+	}
+	findings = filter.rules.Filter(findings, filter.report)
+	scan.LinkAuxiliary(findings)
+
+	var shown []scan.Finding
+	for _, f := range findings {
+		if f.State == scan.StateOpen && (f.IsHTTP || f.Protocol == probe.ProtocolGRPC || f.Kind == probe.ServiceQUIC || all) {
+			shown = append(shown, f)
+		}
+	}
+	services := nameServices(store, reg, shown)
+	attachApps(ctx, reg, services, apps)
+	return listing.Group(services)
+}
+
+// attachApps lists the apps each reverse proxy among services serves with
+// it, registering them in reg, if any, under the proxy's entry so they
+// keep their names
+func attachApps(ctx context.Context, reg *registry.Registry, services []listing.Service, apps *probe.RouteFinder) {
+	for i := range services {
+		s := &services[i]
+		f := s.Finding
+		if f.Parent != 0 || f.Auxiliary != probe.AuxiliaryNone {
+			continue
+		}
+		host := f.Address
+		if host == "" {
+			host = "localhost"
+		}
+		var routes []probe.Route
+		if s.Proxy, routes = apps.Find(ctx, host, f.Port, f.ProbeResult); len(routes) == 0 {
+			continue
+		}
+		if reg == nil {
+			for _, r := range routes {
+				if name := naming.AppName(s.Name, r.Host, r.Path); name != "" {
+					s.Apps = append(s.Apps, listing.App{Name: name, Route: r})
+				}
+			}
+			continue
+		}
+		entries, err := reg.ObserveRoutes(f, routes)
+		if err != nil {
+			log.Printf("Warning: failed to register the apps behind %s: %v", s.Name, err)
+			continue
+		}
+		for _, e := range entries {
+			s.Apps = append(s.Apps, listing.App{Name: e.Name, Route: *e.Route})
+		}
+	}
+}
+
+// exclusions are the rules a scan leaves findings out by, from the config
+// and --exclude
+type exclusions struct {
+	rules exclude.Rules
+	show  bool            // --show-excluded
+	seen  map[string]bool // Findings reported, with their rule
+}
+
+// newExclusions returns the config's exclusion rules followed by extra
+func newExclusions(cfg *config.Config, extra exclude.Rules, show bool) *exclusions {
+	return &exclusions{rules: append(cfg.Exclusions(), extra...), show: show, seen: make(map[string]bool)}
+}
+
+// skipPorts returns the excluded ports, for the scan not to dial them.
+// With --show-excluded they are scanned, so what they hold can be shown.
+func (e *exclusions) skipPorts() []int {
+	if e.show {
+		return nil
+	}
+	return e.rules.Ports()
+}
+
+// report prints an excluded finding with --show-excluded, the first time
+// it is left out by that rule
+func (e *exclusions) report(f scan.Finding, r exclude.Rule) {
+	if !e.show || f.State != scan.StateOpen {
+		return
+	}
+	key := f.Identity() + " " + r.String()
+	if e.seen[key] {
+		return
+	}
+	e.seen[key] = true
+	what := "port " + strconv.Itoa(f.Port)
+	if f.Address != "" && !procmap.IsDefaultLoopback(f.Address) {
+		what += " on " + f.Address
+	}
+	switch {
+	case f.Container != nil:
+		what += " (" + f.Container.String() + ")"
+	case f.Process != nil:
+		what += " (" + f.Process.String() + ")"
+	}
+	fmt.Fprintf(os.Stderr, "Excluded %s by rule %s\n", what, r)
+}
+
+// excludeFlag adds the repeatable --exclude flag to flags, returning the
+// rules it collects
+func excludeFlag(flags *flag.FlagSet) *exclude.Rules {
+	rules := new(exclude.Rules)
+	flags.Func("exclude", "leave out a port, a range, process:PATTERN or label:KEY[=VALUE], e.g. 4381 or 'process:Spotify*' (repeatable)", func(s string) error {
+		r, err := exclude.Parse(s)
+		if err != nil {
+			return err
+		}
+		*rules = append(*rules, r)
+		return nil
+	})
+	return rules
+}
+
+// staleServices returns the entries of reg, if any, last seen on a port in
+// from..to that none of the open findings of a scan of it is, as services
+// that are down
+func staleServices(reg *registry.Registry, findings []scan.Finding, from, to int) []listing.Service {
+	if reg == nil {
+		return nil
+	}
+	up := make(map[string]bool, len(findings))
+	for _, f := range findings {
+		if f.State == scan.StateOpen {
+			up[f.Identity()] = true
+		}
+	}
+	var stale []listing.Service
+	for _, e := range reg.List() {
+		if up[e.ID] || e.Parent != "" || e.Port < from || e.Port > to {
+			continue
+		}
+		f := scan.Finding{State: scan.StateClosed}
+		if e.LastProbe != nil {
+			f.ProbeResult = *e.LastProbe
+		}
+		f.Port, f.Address = e.Port, e.Address
+		lastSeen := e.LastSeen
+		stale = append(stale, listing.Service{Name: e.Name, Finding: f, LastSeen: &lastSeen})
+	}
+	return stale
+}
+
+// cmdPrune forgets the registered services not seen for the retention
+// period, apart from those named by the user or pinned in the config
+func cmdPrune(args []string) {
+	flags := flag.NewFlagSet("prune", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "list what would be pruned without removing it")
+	days := flags.Int("days", 0, "prune services not seen for this many days (default: the config's retention_days, or 14)")
+	format := outputFlag(flags)
+	flags.Parse(args)
+	machine := jsonOutput(*format)
+
+	cfg := loadConfig()
+	maxAge := cfg.Registry.Retention
+	if *days > 0 {
+		maxAge = time.Duration(*days) * 24 * time.Hour
+	} else if *days < 0 {
+		log.Fatalf("Invalid --days: %d", *days)
+	}
+	if maxAge == 0 {
+		maxAge = registry.DefaultRetention
+	}
+	reg, err := registry.Open(registry.DefaultPath())
+	if err != nil {
+		log.Fatalf("Failed to open registry: %v", err)
+	}
+	pruned, err := reg.Prune(maxAge, *dryRun)
+	if err != nil {
+		log.Fatalf("Failed to prune registry: %v", err)
+	}
+	doc := output.NewPrune(pruned, maxAge, *dryRun)
+	if machine {
+		writeOutput(output.KindPrune, doc)
+		return
+	}
+	period := count(doc.Days, "day")
+	if len(doc.Services) == 0 {
+		fmt.Printf("No services unseen for %s.\n", period)
+		return
+	}
+	verb := "Pruned"
+	if doc.DryRun {
+		verb = "Would prune"
+	}
+	fmt.Printf("%s %s unseen for %s:\n", verb, count(len(doc.Services), "service"), period)
+	for _, e := range doc.Services {
+		fmt.Printf("  %s (port %d, last seen %s)\n", e.Name, e.Port, e.LastSeen.Local().Format("2006-01-02 15:04"))
+	}
+}
+
+// cmdExport prints the registry's services in another tool's format, or
+// with --apply splices the hosts block into the hosts file
+func cmdExport(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", "json", "output format: "+strings.Join(export.FormatNames(), ", "))
+	apply := flags.Bool("apply", false, "with --format hosts, write the block into the hosts file in place of the previous one, leaving the rest alone")
+	hostsFile := flags.String("hosts-file", export.DefaultHostsFile, "hosts file --apply writes to")
+	outFormat := outputFlag(flags)
+	flags.Parse(args)
+	machine := jsonOutput(*outFormat)
+
+	exporter, ok := export.Formats[*format]
+	if !ok {
+		log.Fatalf("Unknown --format %q, expected one of %s", *format, strings.Join(export.FormatNames(), ", "))
+	}
+	if *apply && *format != "hosts" {
+		log.Fatalf("--apply only works with --format hosts")
+	}
+	if machine && !*apply && *format != "json" {
+		log.Fatalf("--output json prints the services as JSON; leave out --format %s", *format)
+	}
+	reg, err := registry.Open(registry.DefaultPath())
+	if err != nil {
+		log.Fatalf("Failed to open registry: %v", err)
+	}
+	services := export.FromEntries(reg.List())
+	if !*apply && machine {
+		writeOutput(output.KindExport, services)
+		return
+	}
+	if !*apply {
+		if err := exporter.Export(os.Stdout, services); err != nil {
+			log.Fatalf("Failed to export: %v", err)
+		}
+		return
+	}
+	changed, err := export.ApplyHosts(*hostsFile, services)
+	if err != nil {
+		if errors.Is(err, fs.ErrPermission) {
+			log.Fatalf("%v (try sudo)", err)
+		}
+		log.Fatalf("%v", err)
+	}
+	update := output.HostsUpdate{File: *hostsFile, Changed: changed, Services: services}
+	if machine {
+		writeOutput(output.KindHosts, update)
+		return
+	}
+	if !update.Changed {
+		fmt.Printf("%s is up to date.\n", update.File)
+		return
+	}
+	fmt.Printf("Wrote %s to %s.\n", count(len(update.Services), "service"), update.File)
+}
+
+// outputFlag adds --output to flags: text, or json for a document with a
+// schema_version that scripts can rely on (see package output)
+func outputFlag(flags *flag.FlagSet) *string {
+	return flags.String("output", "text", "output format: text, or json for a versioned document (see schema_version)")
+}
+
+// jsonOutput reports whether --output asks for JSON, exiting on a format
+// that isn't known
+func jsonOutput(format string) bool {
+	if err := output.ValidateFormat(format); err != nil {
+		log.Fatalf("Invalid --output: %v", err)
+	}
+	return format == "json"
+}
+
+// writeOutput prints data as the JSON document of kind
+func writeOutput(kind output.Kind, data any) {
+	if err := output.Write(os.Stdout, kind, data); err != nil {
+		log.Fatalf("Failed to write JSON: %v", err)
+	}
+}
+
+// count returns n with noun, plural unless n is 1, e.g. "3 days"
+func count(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+// hasOtherPorts reports whether from..to holds ports beyond the priority
+// ones, nil meaning scan.DefaultPriorityPorts
+func hasOtherPorts(from, to int, priority []int) bool {
+	if priority == nil {
+		priority = scan.DefaultPriorityPorts
+	}
+	inRange := make(map[int]bool)
+	for _, port := range priority {
+		if port >= from && port <= to {
+			inRange[port] = true
+		}
+	}
+	return len(inRange) < to-from+1
+}
+
+// isTerminal reports whether f is a terminal rather than a pipe or file
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func cmdWatch(store *storage.Store, args []string) {
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	all := flags.Bool("all", false, "include open ports that aren't HTTP")
+	text := flags.Bool("text", false, "print one line per event instead of JSON")
+	ports := flags.String("ports", "1-65535", "port or range to scan, e.g. 3000-9000")
+	interval := flags.Duration("interval", discover.DefaultInterval, "time between scans")
+	grace := flags.Duration("grace", discover.DefaultGrace, "how long a service that went away has to come back and be reported restarted rather than removed (negative to report removals at once)")
+	var hookList []hooks.Hook
+	on := flags.String("on", "", "comma-separated event types the hooks run for: added, removed, changed, restarted, moved, healthy, degraded, down (default all)")
+	flags.Func("exec", "shell command to run for each event, with the event on stdin and LM_* variables (repeatable)", func(s string) error {
+		hookList = append(hookList, hooks.Hook{Command: []string{"/bin/sh", "-c", s}})
+		return nil
+	})
+	flags.Func("webhook", "URL to POST each event to as JSON (repeatable)", func(s string) error {
+		hookList = append(hookList, hooks.Hook{URL: s})
+		return nil
+	})
+	headers := headerFlag(flags)
+	paths := pathFlag(flags)
+	excludeRules := excludeFlag(flags)
+	showExcluded := flags.Bool("show-excluded", false, "print what the exclusion rules left out, and the rule that matched, on stderr (excluded ports are probed so they can be shown)")
+	format := flags.String("output", "", "event format: json for newline-delimited versioned documents (see schema_version), text for --text (default: unversioned JSON lines)")
+	flags.Parse(args)
+	if *format != "" {
+		jsonOutput(*format)
+	}
+	if *text && *format == "json" {
+		log.Fatalf("--text and --output json ask for different formats")
+	}
+	if *text {
+		*format = "text"
+	}
+
+	from, to, err := parsePortRange(*ports)
+	if err != nil {
+		log.Fatalf("Invalid --ports: %v", err)
+	}
+
+	cfg := loadConfig()
+	filter := newExclusions(cfg, *excludeRules, *showExcluded)
+	reg := openRegistry(cfg)
+	thresholds := cfg.HealthThresholds()
+	d := discover.New(discover.Options{
+		From:     from,
+		To:       to,
+		Interval: *interval,
+		Grace:    *grace,
+		All:      *all,
+		Health:   &thresholds,
+		Exclude:  filter.rules,
+		Excluded: filter.report,
+		Scan: scan.ScanOptions{
+			Exclude:       filter.skipPorts(),
+			Probe:         probe.ProbeOptions{Headers: headers, Paths: *paths, CredentialsFor: probeCredentials(cfg, reg), Roots: localRoots()},
+			PriorityPorts: cfg.PriorityPorts(),
+			ExtraAddrs:    cfg.Scan.ExtraAddrs,
+			DiscoverAddrs: cfg.Scan.DiscoverAddrs,
+			SlowThreshold: cfg.Scan.SlowThreshold,
+		},
+		Name: func(f scan.Finding) string {
+			return nameServices(store, reg, []scan.Finding{f})[0].Name
+		},
+	})
+	if reg != nil {
+		// Both services of a contested name are reported as changed
+		reg.OnConflict(func(holder, claimant registry.Entry) {
+			d.Changed(holder.ID, fmt.Sprintf("name conflict: port %d also wanted %s, named %s", claimant.Port, holder.Name, claimant.Name))
+			d.Changed(claimant.ID, fmt.Sprintf("name conflict: %s is taken by port %d", holder.Name, holder.Port))
+		})
+	}
+	if reg != nil {
+		// Services that are still there stay fresh in the registry, and
+		// every probe goes to their history
+		d.OnScan(func(findings []scan.Finding) {
+			if err := reg.Touch(findings...); err != nil {
+				log.Printf("Warning: failed to update registry: %v", err)
+			}
+			if err := reg.RecordProbes(findings...); err != nil {
+				log.Printf("Warning: failed to save probe history: %v", err)
+			}
+		})
+		d.OnHealth(func(scores map[string]health.Score) {
+			if err := reg.SetHealth(scores); err != nil {
+				log.Printf("Warning: failed to update registry: %v", err)
+			}
+		})
+	}
+	enc := json.NewEncoder(os.Stdout)
+	stream := output.NewStream(os.Stdout)
+	d.OnEvent(func(e discover.Event) {
+		switch *format {
+		case "text":
+			fmt.Println(e)
+		case "json":
+			stream.Write(output.KindEvent, e)
+		default:
+			enc.Encode(e)
+		}
+	})
+	var runner *hooks.Runner
+	if len(hookList) > 0 {
+		var types []discover.EventType
+		if *on != "" {
+			for _, t := range strings.Split(*on, ",") {
+				types = append(types, discover.EventType(strings.TrimSpace(t)))
+			}
+		}
+		for i := range hookList {
+			hookList[i].Events = types
+		}
+		runner = hooks.NewRunner(hookList, hooks.Options{})
+		d.OnEvent(runner.Handle)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err = d.Run(ctx)
+	if runner != nil {
+		runner.Close() // Let hooks for the last events finish
+	}
+	if reg != nil {
+		if err := reg.FlushHistory(); err != nil {
+			log.Printf("Warning: failed to save probe history: %v", err)
+		}
+	}
+	if err != nil && !errors.Is(err, context.Canceled) {
+		log.Fatalf("Scan failed: %v", err)
+	}
+}
+
+// loadConfig reads the config file and the environment overrides. Without
+// a file the defaults apply; a broken one is warned about and ignored.
+func loadConfig() *config.Config {
+	cfg, err := config.Load(config.DefaultPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		cfg, err = &config.Config{}, nil
+	}
+	if err == nil {
+		err = cfg.ApplyEnv(os.Environ())
+	}
+	if err != nil {
+		log.Printf("Warning: failed to load config, using the defaults: %v", err)
+		return &config.Config{}
+	}
+	return cfg
+}
+
+// openRegistry opens the scan registry with the names cfg pins. It
+// returns nil, after a warning, if the registry can't be read.
+func openRegistry(cfg *config.Config) *registry.Registry {
+	reg, err := registry.Open(registry.DefaultPath())
+	if err != nil {
+		log.Printf("Warning: failed to open registry: %v", err)
+		return nil
+	}
+	reg.SetPins(cfg.Names)
+	reg.SetHistorySize(cfg.Registry.History)
+	return reg
+}
+
+// probeCredentials returns what the [auth] rules of the config have each
+// port probed with, matching name rules against the name the registry
+// last saw on the port or the one pinned to it; nil without rules
+func probeCredentials(cfg *config.Config, reg *registry.Registry) func(port int) *probe.Credentials {
+	if len(cfg.Auth) == 0 {
+		return nil
+	}
+	names := make(map[int]string)
+	for name, port := range cfg.Names {
+		names[port] = name
+	}
+	if reg != nil {
+		seen := make(map[int]time.Time)
+		for _, e := range reg.List() {
+			if e.Parent == "" && e.LastSeen.After(seen[e.Port]) {
+				names[e.Port], seen[e.Port] = e.Name, e.LastSeen
+			}
+		}
+	}
+	jar := credentials.NewJar(credentials.DefaultJarDir())
+	return func(port int) *probe.Credentials {
+		return cfg.Auth.Credentials(jar, names[port], port)
+	}
+}
+
+// localRoots holds the root of the local CA, for the certificates it
+// issued to count as trusted even before it is in the system trust store;
+// nil if there is no CA yet
+func localRoots() *x509.CertPool {
+	root, err := ca.LoadRoot(ca.DefaultDir())
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Warning: %v", err)
+		}
+		return nil
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	return roots
+}
+
+// nameServices names findings after their entries in the registry reg,
+// which names the daemon's services too. Without a registry, they are
+// named after the daemon's active service on the same port and loopback
+// address.
+func nameServices(store *storage.Store, reg *registry.Registry, findings []scan.Finding) []listing.Service {
+	daemonNames := make(map[string]string)
+	for _, r := range store.List() {
+		if ip := net.ParseIP(r.EffectiveTargetHost()); r.IsActive && ip != nil && ip.IsLoopback() {
+			daemonNames[listenerKey(r.EffectiveTargetHost(), r.Port)] = r.Name
+		}
+	}
+
+	var entries []registry.Entry
+	if reg != nil {
+		var err error
+		if entries, err = reg.Observe(findings...); err != nil {
+			log.Printf("Warning: failed to update registry: %v", err)
+		}
+	}
+	registryNames := make(map[string]string, len(entries))
+	healthStates := make(map[string]health.State)
+	for _, e := range entries {
+		registryNames[listenerKey(e.Address, e.Port)] = e.Name
+		// Only a watcher still running keeps the health current
+		if e.Health != nil && time.Since(e.Health.Checked) < healthFresh {
+			healthStates[listenerKey(e.Address, e.Port)] = e.Health.State
+		}
+	}
+
+	services := make([]listing.Service, 0, len(findings))
+	for _, f := range findings {
+		key := listenerKey(f.Address, f.Port)
+		name, ok := registryNames[key]
+		if !ok {
+			name = daemonNames[key]
+		}
+		f.CheckCert(name)
+		services = append(services, listing.Service{Name: name, Finding: f, Health: healthStates[key]})
+	}
+	return services
+}
+
+// healthFresh is how recently a watcher must have scored a service for
+// its health to be shown
+const healthFresh = 2 * time.Minute
+
+// listenerKey identifies a local listener by its port, and its address
+// too unless that is 127.0.0.1 or ::1
+func listenerKey(addr string, port int) string {
+	if addr == "" || procmap.IsDefaultLoopback(addr) {
+		return strconv.Itoa(port)
+	}
+	return net.JoinHostPort(addr, strconv.Itoa(port))
+}
+
+// parsePortRange parses "3000" or "3000-9000"
+func parsePortRange(s string) (from, to int, err error) {
+	lo, hi, isRange := strings.Cut(s, "-")
+	if from, err = strconv.Atoi(strings.TrimSpace(lo)); err != nil {
+		return 0, 0, fmt.Errorf("bad port %q", lo)
+	}
+	to = from
+	if isRange {
+		if to, err = strconv.Atoi(strings.TrimSpace(hi)); err != nil {
+			return 0, 0, fmt.Errorf("bad port %q", hi)
+		}
+	}
+	if from < 1 || to > 65535 || from > to {
+		return 0, 0, fmt.Errorf("port range %s is outside 1-65535", s)
+	}
+	return from, to, nil
+}
+
+// parsePortList parses "443,8443"
+func parsePortList(s string) ([]int, error) {
+	var ports []int
+	for _, field := range strings.Split(s, ",") {
+		port, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("bad port %q", field)
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// headerFlag adds a repeatable --header "Name: value" flag to flags and
+// returns the headers it collects
+func headerFlag(flags *flag.FlagSet) map[string]string {
+	headers := make(map[string]string)
+	flags.Func("header", "header to send with every probe request, as \"Name: value\" (repeatable)", func(s string) error {
+		name, value, err := probe.ParseHeader(s)
+		if err != nil {
+			return err
+		}
+		headers[name] = value
+		return nil
+	})
+	return headers
+}
+
+// pathFlag adds a repeatable --path flag to flags and returns the
+// candidate probe paths it collects, in order
+func pathFlag(flags *flag.FlagSet) *[]string {
+	paths := new([]string)
+	flags.Func("path", "path to probe instead of /, e.g. /health; repeat it to try several and keep the best answer", func(s string) error {
+		if err := probe.ValidatePaths([]string{s}); err != nil {
+			return err
+		}
+		*paths = append(*paths, s)
+		return nil
+	})
+	return paths
+}
+
+// cmdListRegistered prints the services in the daemon's store
+func cmdListRegistered(store *storage.Store, machine bool) {
 	records := store.List()
+	if machine {
+		if records == nil {
+			records = []*storage.ServiceRecord{}
+		}
+		writeOutput(output.KindRegistered, records)
+		return
+	}
 
 	if len(records) == 0 {
 		fmt.Println("No services registered.")
@@ -171,18 +1090,26 @@ func cmdRename(store *storage.Store, oldName, newName string) {
 		newName = newName + ".localhost"
 	}
 
-	// Find the service
-	record, ok := store.GetByName(oldName)
-	if !ok {
-		log.Fatalf("Service not found: %s", oldName)
-	}
-
 	// Check if new name is available
-	if _, exists := store.GetByName(newName); exists {
+	record, inStore := store.GetByName(oldName)
+	if other, exists := store.GetByName(newName); exists && (!inStore || other.ID != record.ID) {
 		log.Fatalf("Name already in use: %s", newName)
 	}
 
-	// Perform rename
+	// The registry names discovered services, and the daemon picks up its
+	// renames on its next scan; manual entries are only in the store
+	if reg := openRegistry(loadConfig()); reg != nil {
+		if _, ok := reg.Get(oldName); ok {
+			if err := reg.Rename(oldName, newName); err != nil {
+				log.Fatalf("Failed to rename: %v", err)
+			}
+			fmt.Printf("Renamed %s -> %s\n", oldName, newName)
+			return
+		}
+	}
+	if !inStore {
+		log.Fatalf("Service not found: %s", oldName)
+	}
 	if err := store.UpdateName(record.ID, newName); err != nil {
 		log.Fatalf("Failed to rename: %v", err)
 	}
@@ -245,3 +1172,1002 @@ func cmdAdd(store *storage.Store, name string, port int, targetHost string) {
 	fmt.Println("Note: This service will be kept even when not running.")
 	fmt.Println("      Restart the daemon to activate the proxy.")
 }
+
+// cmdQR shows a QR code for the URL other devices on the LAN reach a
+// service at, or writes it to a PNG
+func cmdQR(store *storage.Store, args []string) {
+	flags := flag.NewFlagSet("qr", flag.ExitOnError)
+	pngPath := flags.String("png", "", "write the QR code to this PNG file instead of the terminal")
+	flags.Parse(args)
+	if flags.NArg() < 1 {
+		fmt.Fprintf(os.Stderr, "Usage: localhost-magic qr <name|port> [--png file]\n")
+		os.Exit(1)
+	}
+	target := flags.Arg(0)
+	flags.Parse(flags.Args()[1:]) // Flags may follow the service too
+
+	name, port := resolveService(store, target)
+	proc, err := procmap.Lookup(port)
+	switch {
+	case errors.Is(err, procmap.ErrNotFound):
+		log.Fatalf("Nothing is listening on port %d", port)
+	case err != nil:
+		log.Fatalf("Failed to look up port %d: %v", port, err)
+	}
+	var link string
+	host, err := lan.Host(proc.Scope, proc.Addrs)
+	switch {
+	case errors.Is(err, lan.ErrLoopbackOnly):
+		// Other devices can still get in through the daemon's share
+		link, err = shareLink(name)
+		if err != nil {
+			hint := "localhost-magic share " + name
+			if strings.HasPrefix(name, "port ") {
+				hint = "localhost-magic share <name>, once the daemon proxies it"
+			}
+			log.Fatalf("%s only listens on loopback (%s), so other devices can't reach it directly, and there is no share to go through (%v).\n"+
+				"Share it with: %s\n"+
+				"Or have it listen on all interfaces, e.g. with --host 0.0.0.0", name, strings.Join(proc.Addrs, ", "), err, hint)
+		}
+	case err != nil:
+		log.Fatalf("Failed to find a LAN address for %s: %v", name, err)
+	default:
+		scheme := "http"
+		if result := probe.ProbeContext(context.Background(), host, port); result.IsTLS {
+			scheme = "https"
+		}
+		link = lan.URL(scheme, host, port)
+	}
+	code, err := qr.Encode(link)
+	if err != nil {
+		log.Fatalf("Failed to encode %s: %v", link, err)
+	}
+
+	if *pngPath != "" {
+		f, err := os.Create(*pngPath)
+		if err != nil {
+			log.Fatalf("Failed to create %s: %v", *pngPath, err)
+		}
+		err = code.WritePNG(f, 8)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			log.Fatalf("Failed to write %s: %v", *pngPath, err)
+		}
+		fmt.Printf("Wrote a QR code for %s to %s\n", link, *pngPath)
+		return
+	}
+	if err := code.WriteTerminal(os.Stdout); err != nil {
+		log.Fatalf("Failed to draw QR code: %v", err)
+	}
+	fmt.Println(link)
+}
+
+// cmdShare shares a service on the LAN through the daemon, or with --list
+// lists the shares
+func cmdShare(args []string) {
+	flags := flag.NewFlagSet("share", flag.ExitOnError)
+	list := flags.Bool("list", false, "list the shared services")
+	token := flags.Bool("token", false, "make the link one-time: it lets one browser in, then is spent")
+	auth := flags.String("auth", "", "ask for HTTP basic auth credentials, as user:password")
+	idle := flags.Duration("idle", share.DefaultIdle, "revoke the share after this long without requests (negative for never)")
+	format := outputFlag(flags)
+	flags.Parse(args)
+	machine := jsonOutput(*format)
+	if *list {
+		cmdListShares(machine)
+		return
+	}
+	if flags.NArg() < 1 {
+		fmt.Fprintf(os.Stderr, "Usage: localhost-magic share <name> [--token] [--auth user:pass] [--idle 30m]\n")
+		os.Exit(1)
+	}
+	name := flags.Arg(0)
+	flags.Parse(flags.Args()[1:]) // Flags may follow the service too
+	machine = jsonOutput(*format)
+
+	req := map[string]any{"name": name, "token": *token, "idle": idle.String()}
+	if *auth != "" {
+		user, password, ok := strings.Cut(*auth, ":")
+		if !ok || user == "" || password == "" {
+			log.Fatalf("Invalid --auth %q: use user:password", *auth)
+		}
+		req["user"], req["password"] = user, password
+	}
+	var resp output.ShareLink
+	if err := daemonRequest(http.MethodPost, "/api/shares", req, output.KindShare, &resp); err != nil {
+		log.Fatalf("Failed to share %s: %v", name, err)
+	}
+	if machine {
+		writeOutput(output.KindShare, resp)
+		return
+	}
+
+	fmt.Printf("Sharing %s on the LAN at:\n\n  %s\n\n", resp.Share.Name, resp.URL)
+	if *token {
+		fmt.Println("The link works once. Run localhost-magic qr for a fresh one.")
+	}
+	if resp.Share.Expires != nil {
+		fmt.Printf("Revoked after %s without requests, or with: localhost-magic unshare %s\n", *idle, resp.Share.Name)
+	} else {
+		fmt.Printf("Stop sharing with: localhost-magic unshare %s\n", resp.Share.Name)
+	}
+}
+
+// cmdListShares prints the daemon's shares
+func cmdListShares(machine bool) {
+	shares := []output.Share{}
+	if err := daemonRequest(http.MethodGet, "/api/shares", nil, output.KindShares, &shares); err != nil {
+		log.Fatalf("Failed to list shares: %v", err)
+	}
+	if machine {
+		writeOutput(output.KindShares, shares)
+		return
+	}
+	if len(shares) == 0 {
+		fmt.Println("No services shared.")
+		return
+	}
+	fmt.Printf("%-30s %-20s %-20s %s\n", "NAME", "ACCESS", "LAST USED", "EXPIRES")
+	for _, sh := range shares {
+		var access []string
+		if sh.Token {
+			access = append(access, "one-time links")
+		}
+		if sh.User != "" {
+			access = append(access, "user "+sh.User)
+		}
+		if len(access) == 0 {
+			access = append(access, "open")
+		}
+		expires := "never"
+		if sh.Expires != nil {
+			expires = sh.Expires.Local().Format("15:04:05")
+		}
+		fmt.Printf("%-30s %-20s %-20s %s\n", sh.Name, strings.Join(access, ", "), sh.LastUsed.Local().Format("15:04:05"), expires)
+	}
+}
+
+// cmdUnshare revokes the share of a service
+func cmdUnshare(args []string) {
+	flags := flag.NewFlagSet("unshare", flag.ExitOnError)
+	format := outputFlag(flags)
+	flags.Parse(args)
+	if flags.NArg() < 1 {
+		fmt.Fprintf(os.Stderr, "Usage: localhost-magic unshare <name>\n")
+		os.Exit(1)
+	}
+	name := flags.Arg(0)
+	flags.Parse(flags.Args()[1:]) // Flags may follow the service too
+	machine := jsonOutput(*format)
+
+	if !strings.HasSuffix(name, ".localhost") {
+		name += ".localhost"
+	}
+	if err := daemonRequest(http.MethodDelete, "/api/shares/"+url.PathEscape(name), nil, output.KindUnshare, nil); err != nil {
+		log.Fatalf("Failed to stop sharing %s: %v", name, err)
+	}
+	if machine {
+		writeOutput(output.KindUnshare, output.Unshare{Name: name})
+		return
+	}
+	fmt.Printf("Stopped sharing %s\n", name)
+}
+
+// shareLink asks the daemon for a new link into the share of name
+func shareLink(name string) (string, error) {
+	var resp output.ShareLink
+	err := daemonRequest(http.MethodPost, "/api/shares/"+url.PathEscape(name)+"/link", nil, output.KindShare, &resp)
+	return resp.URL, err
+}
+
+// daemonEnv overrides where the CLI finds the daemon's API, e.g.
+// LOCALHOST_MAGIC_DAEMON=http://127.0.0.1:4280
+const daemonEnv = config.EnvPrefix + "DAEMON"
+
+// daemonRequest calls the daemon's API, decoding the data of the document
+// of kind it answers with into out if it isn't nil. The daemon is looked
+// for on the proxy's addresses, with the API token if there is one.
+func daemonRequest(method, path string, body any, kind output.Kind, out any) error {
+	bases := []string{"http://127.0.0.1" + proxy.DefaultAddr, "http://127.0.0.1" + proxy.FallbackAddr}
+	if base := os.Getenv(daemonEnv); base != "" {
+		bases = []string{strings.TrimSuffix(base, "/")}
+	}
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	token, _ := os.ReadFile(apiauth.DefaultTokenPath())
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	var resp *http.Response
+	var err error
+	for _, base := range bases {
+		req, reqErr := http.NewRequest(method, base+path, bytes.NewReader(payload))
+		if reqErr != nil {
+			return reqErr
+		}
+		if method != http.MethodGet {
+			req.Header.Set("Content-Type", "application/json") // Required by the API to change state
+		}
+		if t := strings.TrimSpace(string(token)); t != "" {
+			req.Header.Set("Authorization", "Bearer "+t)
+		}
+		if resp, err = client.Do(req); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("is the daemon running? %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return errors.New(strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return output.Read(resp.Body, kind, out)
+}
+
+// resolveService returns the name and port of the service target names,
+// by port number or by name in the daemon's store or the scan registry. A
+// port the daemon doesn't proxy is named "port N".
+func resolveService(store *storage.Store, target string) (name string, port int) {
+	if port, err := strconv.Atoi(target); err == nil {
+		if port < 1 || port > 65535 {
+			log.Fatalf("Invalid port number: %s", target)
+		}
+		// Prefer the name the daemon proxies the port under
+		for _, record := range store.List() {
+			if record.IsActive && record.Port == port && procmap.IsDefaultLoopback(record.EffectiveTargetHost()) {
+				return record.Name, port
+			}
+		}
+		return fmt.Sprintf("port %d", port), port
+	}
+	name = target
+	if !strings.HasSuffix(name, ".localhost") {
+		name += ".localhost"
+	}
+	if record, ok := store.GetByName(name); ok && procmap.IsDefaultLoopback(record.EffectiveTargetHost()) {
+		return record.Name, record.Port
+	}
+	if reg := openRegistry(loadConfig()); reg != nil {
+		if entry, ok := reg.Get(name); ok {
+			return entry.Name, entry.Port
+		}
+	}
+	log.Fatalf("Service not found: %s", name)
+	return "", 0
+}
+
+// cmdBench sends a burst of requests to a service and sums up their
+// latency, errors and whether connections were kept alive
+func cmdBench(store *storage.Store, args []string) {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	requests := flags.Int("n", probe.DefaultBenchRequests, "number of requests")
+	concurrency := flags.Int("c", probe.DefaultBenchConcurrency, "requests in flight at once")
+	path := flags.String("path", "/", "path to request, e.g. a health check")
+	timeout := flags.Duration("timeout", 5*time.Second, "time each request has to be answered")
+	force := flags.Bool("force", false, "run against a service that isn't on this machine")
+	asJSON := flags.Bool("json", false, "print the result as JSON")
+	headers := headerFlag(flags)
+	format := outputFlag(flags)
+	flags.Parse(args)
+	if flags.NArg() < 1 {
+		fmt.Fprintf(os.Stderr, "Usage: localhost-magic bench <name|port|host:port> [-n 50] [-c 4] [--path /] [--force]\n")
+		os.Exit(1)
+	}
+	target := flags.Arg(0)
+	flags.Parse(flags.Args()[1:]) // Flags may follow the service too
+	machine := jsonOutput(*format)
+	if *requests < 1 || *concurrency < 1 {
+		log.Fatalf("-n and -c must be at least 1")
+	}
+
+	name, host, port := benchTarget(store, target)
+	ctx := context.Background()
+	if !*force {
+		if err := probe.CheckLoopback(ctx, host); err != nil {
+			log.Fatalf("Refusing to bench %s (%v): this is a check for local dev servers, not a load tester. Use --force to run it anyway.", name, err)
+		}
+	}
+	cfg := loadConfig()
+	opts := probe.ProbeOptions{ReadTimeout: *timeout, Headers: headers, Credentials: cfg.Auth.Credentials(credentials.NewJar(credentials.DefaultJarDir()), name, port)}
+	first := probe.ProbeContextWithOptions(ctx, host, port, opts)
+	if !first.IsHTTP {
+		log.Fatalf("%s doesn't answer HTTP on port %d", name, port)
+	}
+	if host == "localhost" && first.Address != "" {
+		host = first.Address // Rather than trying both address families on every dial
+	}
+	bench := probe.BenchOptions{Requests: *requests, Concurrency: *concurrency, Path: *path, TLS: first.IsTLS, Probe: opts, AllowRemote: *force}
+	if !*asJSON && !machine {
+		fmt.Fprintf(os.Stderr, "Sending %d requests to %s, %d at a time...\n", *requests, name, min(*concurrency, *requests))
+	}
+	result, err := probe.Bench(ctx, host, port, bench)
+	if err != nil {
+		log.Fatalf("Bench failed: %v", err)
+	}
+	if machine {
+		writeOutput(output.KindBench, result)
+		return
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(result)
+		return
+	}
+	printBench(result)
+}
+
+// benchTarget resolves the service bench was given to its name, host and
+// port. Unlike resolveService it takes host:port, and services the daemon
+// proxies to other machines, which the loopback check then turns away.
+func benchTarget(store *storage.Store, target string) (name, host string, port int) {
+	if h, p, err := net.SplitHostPort(target); err == nil {
+		port, err := strconv.Atoi(p)
+		if err != nil || port < 1 || port > 65535 {
+			log.Fatalf("Invalid port in %s", target)
+		}
+		return target, h, port
+	}
+	if _, err := strconv.Atoi(target); err != nil {
+		full := target
+		if !strings.HasSuffix(full, ".localhost") {
+			full += ".localhost"
+		}
+		if record, ok := store.GetByName(full); ok && !procmap.IsDefaultLoopback(record.EffectiveTargetHost()) {
+			return record.Name, record.EffectiveTargetHost(), record.Port
+		}
+	}
+	name, port = resolveService(store, target)
+	return name, "localhost", port
+}
+
+// printBench writes a bench result for people
+func printBench(r probe.BenchResult) {
+	round := func(d time.Duration) time.Duration { return d.Round(10 * time.Microsecond) }
+	fmt.Printf("%s\n", r.URL)
+	if len(r.Statuses) > 0 {
+		fmt.Printf("  latency     p50 %v  p90 %v  p99 %v  (min %v, mean %v, max %v)\n",
+			round(r.P50), round(r.P90), round(r.P99), round(r.Min), round(r.Mean), round(r.Max))
+	}
+	fmt.Printf("  errors      %d of %d (%.1f%%)\n", r.Errors, r.Requests, 100*r.ErrorRate())
+	if r.Err != nil {
+		fmt.Printf("              first: %v\n", r.Err)
+	}
+	codes := make([]int, 0, len(r.Statuses))
+	for code := range r.Statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	var statuses []string
+	for _, code := range codes {
+		statuses = append(statuses, fmt.Sprintf("%d x%d", code, r.Statuses[code]))
+	}
+	if len(statuses) > 0 {
+		fmt.Printf("  statuses    %s\n", strings.Join(statuses, ", "))
+	}
+	keepAlive := "no"
+	if r.KeepAlive {
+		keepAlive = "yes"
+	}
+	fmt.Printf("  keep-alive  %s (%s for %s)\n", keepAlive, count(r.Connections, "connection"), count(r.Requests, "request"))
+	fmt.Printf("  took        %v\n", round(r.Duration))
+}
+
+// cmdProbe probes a single port with the whole pipeline and prints what it
+// learned, for a closer look at one service than list gives. It exits 0
+// when something listens there, 1 when nothing does and 2 on usage errors.
+func cmdProbe(args []string) {
+	flags := flag.NewFlagSet("probe", flag.ExitOnError)
+	timeout := flags.Duration("timeout", 2*time.Second, "time allowed to connect, and for each answer")
+	paths := pathFlag(flags)
+	hostHeader := flags.String("host-header", "", "Host header to send, and TLS server name, for services routed by virtual host")
+	insecure := flags.Bool("insecure", false, "leave out what a browser would object to in the TLS certificate (the probe never verifies it)")
+	retries := flags.Int("retries", 0, "times to try again while the service looks like it is still starting up")
+	deep := flags.Bool("deep", false, "also follow redirects, check methods, CORS, WebSocket, HTTP versions and QUIC, and look for a favicon, framework paths and API specs (a few dozen requests)")
+	headers := headerFlag(flags)
+	format := outputFlag(flags)
+	usage := func(msg string) {
+		if msg != "" {
+			fmt.Fprintln(os.Stderr, msg)
+		}
+		fmt.Fprintf(os.Stderr, "Usage: localhost-magic probe [host:]<port> [--deep] [--timeout 2s] [--path /] [--host-header name] [--insecure] [--retries 0]\n")
+		os.Exit(2)
+	}
+	flags.Parse(args)
+	if flags.NArg() < 1 {
+		usage("")
+	}
+	target := flags.Arg(0)
+	flags.Parse(flags.Args()[1:]) // Flags may follow the target too
+	if flags.NArg() > 0 {
+		usage("Unexpected argument: " + flags.Arg(0))
+	}
+	if err := output.ValidateFormat(*format); err != nil {
+		usage(err.Error())
+	}
+	host, port, err := probeTarget(target)
+	if err != nil {
+		usage(err.Error())
+	}
+	if *timeout <= 0 || *retries < 0 {
+		usage("--timeout must be positive and --retries at least 0")
+	}
+
+	opts := probe.ProbeOptions{
+		DialTimeout:  *timeout,
+		ReadTimeout:  *timeout,
+		WriteTimeout: *timeout,
+		Host:         *hostHeader,
+		Headers:      headers,
+		Paths:        *paths,
+		Retry:        probe.RetryPolicy{Attempts: *retries + 1},
+		Roots:        localRoots(),
+	}
+	if *deep {
+		opts.FollowRedirects, opts.FrameworkPaths, opts.DetectFavicon = true, true, true
+		opts.DetectMethods, opts.DetectCORS, opts.DetectWebSocket = true, true, true
+		opts.DetectVersions, opts.DetectQUIC, opts.DetectAPISpec = true, true, true
+	}
+	ctx := context.Background()
+	result := probe.ProbeContextWithOptions(ctx, host, port, opts)
+	// Protocols such as Redis or memcached stay silent until sent their own
+	// handshake, which only ProbeService tries
+	if (result.State == probe.StateOpenSilent || result.State == probe.StateOpenNonHTTP) && result.Kind == probe.ServiceUnknown && result.Banner == "" {
+		dialHost := host
+		if result.Address != "" {
+			dialHost = result.Address
+		}
+		if service := probe.ProbeServiceContext(ctx, dialHost, port, opts); service.Kind != probe.ServiceUnknown {
+			result.State, result.Kind, result.Banner, result.Hint = probe.StateOpenNonHTTP, service.Kind, service.Banner, ""
+		}
+	}
+
+	report := output.NewProbe(net.JoinHostPort(host, strconv.Itoa(port)), result, *timeout)
+	if result.Cert != nil && !*insecure {
+		name := host
+		if *hostHeader != "" {
+			name = hostOnlyHeader(*hostHeader)
+		}
+		report.CertIssues = result.Cert.Issues(name, time.Now())
+	}
+	if *format == "json" {
+		writeOutput(output.KindProbe, report)
+	} else {
+		printProbe(report)
+	}
+	if !report.Listening {
+		os.Exit(1)
+	}
+}
+
+// probeTarget splits the [host:]port probe was given, the host defaulting
+// to 127.0.0.1
+func probeTarget(target string) (host string, port int, err error) {
+	host, p, err := net.SplitHostPort(target)
+	if err != nil {
+		host, p = "", target // A bare port
+	}
+	port, err = strconv.Atoi(p)
+	if err != nil || port < 1 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid port in %s", target)
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	return host, port, nil
+}
+
+// hostOnlyHeader returns the name of a Host header, without its port
+func hostOnlyHeader(header string) string {
+	if host, _, err := net.SplitHostPort(header); err == nil {
+		return host
+	}
+	return header
+}
+
+// probeHeaders are the response headers printProbe shows, when present
+var probeHeaders = []string{
+	"Server", "X-Powered-By", "Content-Type", "Location", "WWW-Authenticate",
+	"Alt-Svc", "Strict-Transport-Security", "Cache-Control",
+}
+
+// printProbe writes the report of probe for people
+func printProbe(p output.Probe) {
+	r := p.Result
+	round := func(d time.Duration) time.Duration { return d.Round(10 * time.Microsecond) }
+	line := func(label, value string) { fmt.Printf("  %-12s%s\n", label, value) }
+	lines := func(label string, values []string) {
+		for i, value := range values {
+			if i > 0 {
+				label = ""
+			}
+			line(label, value)
+		}
+	}
+
+	fmt.Println(p.Target)
+	state := string(r.State)
+	if r.State == probe.StateUnknown {
+		state = "unknown"
+	}
+	if host, _, _ := net.SplitHostPort(p.Target); r.Address != "" && r.Address != host {
+		state += " (on " + r.Address + ")"
+	}
+	line("state", state)
+	protocol := string(r.Protocol)
+	if r.IsTLS {
+		protocol = strings.TrimSpace(protocol + " over " + r.TLSVersion)
+		if r.NegotiatedProtocol != "" {
+			protocol += ", ALPN " + r.NegotiatedProtocol
+		}
+	}
+	if protocol != "" {
+		line("protocol", protocol)
+	}
+	if r.Kind != probe.ServiceUnknown && r.Kind != probe.ServiceHTTP {
+		line("service", string(r.Kind))
+	}
+	if r.Banner != "" {
+		line("banner", r.Banner)
+	}
+	switch {
+	case r.IsHTTP:
+		line("status", r.Response)
+	case r.Response != "" && r.Banner == "":
+		line("response", r.Response)
+	}
+	if len(r.PathResults) > 1 {
+		line("path", r.Path)
+	}
+	if r.Title != "" {
+		line("title", r.Title)
+	}
+	if r.ContentClass != "" && r.ContentClass != probe.ContentUnknown {
+		line("content", string(r.ContentClass))
+	}
+	if r.Framework != "" {
+		line("framework", fmt.Sprintf("%s (%s confidence)", r.Framework, r.FrameworkConfidence))
+	}
+	switch {
+	case r.RequiresAuth && r.AuthScheme != "":
+		line("auth", "required ("+r.AuthScheme+")")
+	case r.RequiresAuth:
+		line("auth", "required")
+	case r.LoginRedirect:
+		line("auth", "redirects to a login page")
+	}
+	var headers []string
+	for _, name := range probeHeaders {
+		for _, value := range r.Headers.Values(name) {
+			headers = append(headers, name+": "+value)
+		}
+	}
+	lines("headers", headers)
+	lines("redirects", r.Redirects)
+	if len(r.AllowedMethods) > 0 {
+		line("methods", strings.Join(r.AllowedMethods, ", "))
+	}
+	if len(r.SupportedVersions) > 0 {
+		keepAlive := "no keep-alive"
+		if r.KeepAlive {
+			keepAlive = "keep-alive"
+		}
+		line("versions", strings.Join(r.SupportedVersions, ", ")+", "+keepAlive)
+	}
+	if r.SupportsWebSocket {
+		line("websocket", "yes")
+	}
+	if r.CORS != nil {
+		line("cors", string(r.CORS.Policy))
+	}
+	if r.QUIC != nil {
+		line("quic", fmt.Sprintf("UDP %d, %s", r.QUIC.Port, r.QUIC.State))
+	}
+	if r.APISpec != nil {
+		line("api spec", strings.TrimSpace(fmt.Sprintf("%s %s at %s", r.APISpec.Title, r.APISpec.SpecVersion, r.APISpec.Path)))
+	}
+	if r.GraphQL {
+		line("graphql", r.GraphQLPath)
+	}
+	if len(r.GRPCServices) > 0 {
+		line("grpc", strings.Join(r.GRPCServices, ", "))
+	}
+	if c := r.Cert; c != nil {
+		trust := "untrusted"
+		if c.Trusted {
+			trust = "trusted"
+		}
+		cert := []string{fmt.Sprintf("%s, issued by %s (%s)", c.Subject, c.Issuer, trust)}
+		if names := append(append([]string{}, c.DNSNames...), c.IPAddresses...); len(names) > 0 {
+			cert = append(cert, "for "+strings.Join(names, ", "))
+		}
+		cert = append(cert, fmt.Sprintf("valid %s to %s, %s %d, %s",
+			c.NotBefore.Format("2006-01-02"), c.NotAfter.Format("2006-01-02"), c.KeyType, c.KeyBits, c.SignatureAlgorithm))
+		if c.ClientCertRequested {
+			cert = append(cert, "asks for a client certificate")
+		}
+		lines("cert", cert)
+		lines("cert issues", p.CertIssues)
+	}
+	if r.Hint != "" {
+		line("hint", r.Hint)
+	}
+	var timings []string
+	if r.ConnectTime > 0 {
+		timings = append(timings, fmt.Sprintf("connect %v", round(r.ConnectTime)))
+	}
+	if r.TTFB > 0 {
+		timings = append(timings, fmt.Sprintf("first byte %v", round(r.TTFB)))
+	}
+	timings = append(timings, fmt.Sprintf("total %v", round(r.Duration)))
+	if r.Attempts > 1 {
+		timings = append(timings, count(r.Attempts, "attempt"))
+	}
+	line("timings", strings.Join(timings, ", "))
+	if p.Problem != "" {
+		line("problem", p.Problem)
+	}
+}
+
+// cmdHistory prints the recent probes of a service, as the daemon or a
+// watch recorded them, for a closer look at one that keeps flapping
+func cmdHistory(store *storage.Store, args []string) {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	limit := flags.Int("n", 0, "show only the latest n probes (default all that are kept)")
+	format := outputFlag(flags)
+	flags.Parse(args)
+	if flags.NArg() < 1 {
+		fmt.Fprintf(os.Stderr, "Usage: localhost-magic history <name> [-n 20] [--output json]\n")
+		os.Exit(1)
+	}
+	name := flags.Arg(0)
+	flags.Parse(flags.Args()[1:]) // Flags may follow the service too
+	machine := jsonOutput(*format)
+
+	h, err := serviceHistory(store, name)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if *limit > 0 && len(h.Samples) > *limit {
+		h.Samples = h.Samples[len(h.Samples)-*limit:]
+	}
+	if machine {
+		writeOutput(output.KindHistory, h)
+		return
+	}
+	printHistory(h)
+}
+
+// serviceHistory returns the probes the daemon recorded of the service
+// named name or, when it has none, those a watch recorded in the scan
+// registry
+func serviceHistory(store *storage.Store, name string) (output.History, error) {
+	if !strings.HasSuffix(name, ".localhost") {
+		name += ".localhost"
+	}
+	h := output.History{Name: name, Samples: []registry.Sample{}}
+	daemonErr := daemonRequest(http.MethodGet, "/api/services/"+url.PathEscape(name)+"/history", nil, output.KindHistory, &h)
+	if daemonErr == nil && len(h.Samples) > 0 {
+		return h, nil
+	}
+	if reg := openRegistry(loadConfig()); reg != nil {
+		entry, samples, err := reg.History(registryName(store, reg, name))
+		switch {
+		case err == nil && (len(samples) > 0 || daemonErr != nil):
+			h.Name = entry.Name
+			if samples != nil {
+				h.Samples = samples
+			}
+			return h, nil
+		case err != nil && !errors.Is(err, registry.ErrNotFound):
+			return h, err
+		}
+	}
+	if daemonErr != nil {
+		return h, fmt.Errorf("no history of %s: %w", name, daemonErr)
+	}
+	return h, nil
+}
+
+// registryName returns the name the scan registry knows the service named
+// name by. list shows the daemon's names, which the registry may not have:
+// those are looked up by the port the daemon last saw them on.
+func registryName(store *storage.Store, reg *registry.Registry, name string) string {
+	if _, ok := reg.Get(name); ok {
+		return name
+	}
+	record, ok := store.GetByName(name)
+	if !ok {
+		return name
+	}
+	var found registry.Entry
+	for _, e := range reg.List() {
+		if e.Parent == "" && listenerKey(e.Address, e.Port) == listenerKey(record.EffectiveTargetHost(), record.Port) && e.LastSeen.After(found.LastSeen) {
+			found = e
+		}
+	}
+	if found.Name == "" {
+		return name
+	}
+	return found.Name
+}
+
+// sparks are the steps of a sparkline, lowest first
+var sparks = []rune("▁▂▃▄▅▆▇█")
+
+// printHistory writes the probes of a service for people: its latency as
+// a sparkline, when its state changed, then each probe with a bar of its
+// latency
+func printHistory(h output.History) {
+	if len(h.Samples) == 0 {
+		fmt.Printf("No probes of %s recorded yet.\n", h.Name)
+		fmt.Println("The daemon records them as it scans, and so does watch.")
+		return
+	}
+	first, last := h.Samples[0].Time, h.Samples[len(h.Samples)-1].Time
+	layout := "15:04:05"
+	if first.Format("2006-01-02") != last.Format("2006-01-02") {
+		layout = "Jan 2 15:04:05"
+	}
+	var longest time.Duration
+	for _, s := range h.Samples {
+		longest = max(longest, sampleLatency(s))
+	}
+	spark := make([]rune, 0, len(h.Samples))
+	for _, s := range h.Samples {
+		latency := sampleLatency(s)
+		if latency == 0 {
+			spark = append(spark, ' ')
+			continue
+		}
+		spark = append(spark, sparks[int(latency*time.Duration(len(sparks)-1)/longest)])
+	}
+
+	fmt.Printf("%s: %s over %v\n", h.Name, count(len(h.Samples), "probe"), last.Sub(first).Round(time.Second))
+	if longest > 0 {
+		fmt.Printf("  latency  %s  (up to %v)\n", string(spark), longest.Round(10*time.Microsecond))
+	}
+	var transitions []string
+	for i := 1; i < len(h.Samples); i++ {
+		if prev, cur := sampleState(h.Samples[i-1]), sampleState(h.Samples[i]); prev != cur {
+			transitions = append(transitions, fmt.Sprintf("%s  %s -> %s", h.Samples[i].Time.Format(layout), prev, cur))
+		}
+	}
+	if len(transitions) == 0 {
+		fmt.Printf("  no transitions, %s throughout\n", sampleState(h.Samples[0]))
+	} else {
+		fmt.Printf("  %s:\n", count(len(transitions), "transition"))
+		for _, t := range transitions {
+			fmt.Println("    " + t)
+		}
+	}
+	fmt.Println()
+
+	fmt.Printf("%-*s  %-9s %-30s %10s\n", len(layout), "TIME", "STATE", "STATUS", "LATENCY")
+	for _, s := range h.Samples {
+		status := sampleStatus(s)
+		if len(status) > 30 {
+			status = status[:27] + "..."
+		}
+		latency, bar := "-", ""
+		if d := sampleLatency(s); d > 0 {
+			latency = d.Round(10 * time.Microsecond).String()
+			bar = strings.Repeat("█", max(1, int(d*20/longest)))
+		}
+		line := fmt.Sprintf("%-*s  %-9s %-30s %10s  %s", len(layout), s.Time.Format(layout), sampleState(s), status, latency, bar)
+		fmt.Println(strings.TrimRight(line, " "))
+	}
+}
+
+// sampleState is what a probe says of a service, coarsely enough that
+// only real changes show as transitions: up, erroring for 5xx answers,
+// gone when the scan didn't find it, or the port's state when it didn't
+// answer HTTP
+func sampleState(s registry.Sample) string {
+	switch {
+	case s.Gone:
+		return "gone"
+	case s.Result.IsHTTP && s.Result.StatusCode >= 500:
+		return "erroring"
+	case s.Result.IsHTTP:
+		return "up"
+	case s.Result.State == probe.StateUnknown:
+		return "unknown"
+	}
+	return string(s.Result.State)
+}
+
+// sampleStatus is the answer a probe got, e.g. "200 OK", or why it got
+// none
+func sampleStatus(s registry.Sample) string {
+	switch {
+	case s.Gone:
+		return fmt.Sprintf("not found on port %d", s.Result.Port)
+	case s.Result.IsHTTP && s.Result.StatusCode > 0:
+		return strings.TrimSpace(fmt.Sprintf("%d %s", s.Result.StatusCode, s.Result.StatusText))
+	case s.Result.IsHTTP:
+		return s.Result.Response
+	case s.Result.Err != nil:
+		return s.Result.Err.Error()
+	}
+	return ""
+}
+
+// sampleLatency is the time a probe took to be answered, 0 if it wasn't
+func sampleLatency(s registry.Sample) time.Duration {
+	switch {
+	case s.Gone:
+		return 0
+	case s.Result.TTFB > 0:
+		return s.Result.TTFB
+	case s.Result.IsHTTP:
+		return s.Result.Duration
+	}
+	return 0
+}
+
+func cmdSockets(args []string) {
+	flags := flag.NewFlagSet("sockets", flag.ExitOnError)
+	format := outputFlag(flags)
+	flags.Parse(args)
+	var paths []string
+	for flags.NArg() > 0 {
+		paths = append(paths, flags.Arg(0))
+		flags.Parse(flags.Args()[1:]) // Flags may follow the paths too
+	}
+	machine := jsonOutput(*format)
+	if len(paths) == 0 {
+		paths = probe.FindUnixSockets()
+	}
+
+	sockets := make([]output.Socket, 0, len(paths))
+	for _, path := range paths {
+		result := probe.ProbeUnix(context.Background(), path, probe.ProbeOptions{})
+		sockets = append(sockets, output.Socket{Path: path, Status: socketStatus(result), Probe: result})
+	}
+	if machine {
+		writeOutput(output.KindSockets, sockets)
+		return
+	}
+	if len(sockets) == 0 {
+		fmt.Println("No Unix sockets found.")
+		return
+	}
+
+	fmt.Printf("%-50s %s\n", "SOCKET", "STATUS")
+	fmt.Println(strings.Repeat("-", 80))
+	for _, socket := range sockets {
+		fmt.Printf("%-50s %s\n", socket.Path, socket.Status)
+	}
+}
+
+// socketStatus sums up the probe of a Unix socket, e.g. "HTTP/1.1 200 OK"
+// or "permission denied"
+func socketStatus(result probe.ProbeResult) string {
+	switch {
+	case result.IsHTTP:
+		return result.Response
+	case errors.Is(result.Err, fs.ErrPermission):
+		return "permission denied"
+	case errors.Is(result.Err, probe.ErrStaleSocket):
+		return "stale (nothing listening)"
+	case errors.Is(result.Err, probe.ErrNotSocket):
+		return "not a socket"
+	case result.Kind != probe.ServiceUnknown:
+		return string(result.Kind)
+	case result.Err != nil:
+		return result.Err.Error()
+	}
+	return "not HTTP"
+}
+
+func cmdTLS(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "Usage: localhost-magic tls <init [--trust]|trust|untrust|ensure <name>|renew <name>>\n")
+		os.Exit(1)
+	}
+	// ensure and renew name a certificate, and may be asked for JSON
+	var name string
+	machine := false
+	if args[0] == "ensure" || args[0] == "renew" {
+		flags := flag.NewFlagSet("tls "+args[0], flag.ExitOnError)
+		format := outputFlag(flags)
+		flags.Parse(args[1:])
+		if flags.NArg() < 1 {
+			fmt.Fprintf(os.Stderr, "Usage: localhost-magic tls %s <name>\n", args[0])
+			os.Exit(1)
+		}
+		name = flags.Arg(0)
+		flags.Parse(flags.Args()[1:]) // Flags may follow the name too
+		machine = jsonOutput(*format)
+	}
+	// The daemon renews with its own CA, which may not be the default one
+	if args[0] == "renew" {
+		tlsRenew(name, machine)
+		return
+	}
+
+	authority, created, err := ca.LoadOrCreate(ca.DefaultDir())
+	if err != nil {
+		log.Fatalf("Failed to open local CA: %v", err)
+	}
+	if created {
+		fmt.Printf("Created local CA in %s\n", authority.Dir())
+	}
+
+	switch args[0] {
+	case "init":
+		if len(args) > 1 && args[1] == "--trust" {
+			tlsTrust(authority)
+			return
+		}
+		if trust.IsTrusted(authority.Root()) {
+			fmt.Println("The local CA is trusted by the system.")
+			return
+		}
+		fmt.Print(trust.Instructions(authority.RootPath()))
+		fmt.Println("\nOr run: sudo localhost-magic tls trust")
+	case "trust":
+		tlsTrust(authority)
+	case "untrust":
+		if err := trust.Uninstall(authority.Root()); err != nil {
+			log.Fatalf("Failed to remove the local CA from the trust store: %v", err)
+		}
+		fmt.Println("Removed the local CA from the system trust store.")
+	case "ensure":
+		cert, err := issuer.New(authority).Ensure(name)
+		if err != nil {
+			log.Fatalf("Failed to issue certificate: %v", err)
+		}
+		if machine {
+			writeOutput(output.KindCert, output.Cert{Name: policy.Normalize(name), Serial: cert.Serial, NotAfter: cert.NotAfter, CertPath: cert.CertPath, KeyPath: cert.KeyPath})
+			return
+		}
+		fmt.Printf("CERT=%s\n", cert.CertPath)
+		fmt.Printf("KEY=%s\n", cert.KeyPath)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown tls command: %s\n", args[0])
+		os.Exit(1)
+	}
+}
+
+// tlsRenew has the daemon mint a fresh certificate for name and serve the
+// service over HTTPS with it, in front of whatever certificate the service
+// has of its own
+func tlsRenew(name string, machine bool) {
+	if !strings.HasSuffix(name, ".localhost") {
+		name += ".localhost"
+	}
+	var resp output.Cert
+	if err := daemonRequest(http.MethodPost, "/api/services/"+url.PathEscape(name)+"/cert", nil, output.KindCert, &resp); err != nil {
+		log.Fatalf("Failed to renew the certificate of %s: %v", name, err)
+	}
+	if machine {
+		writeOutput(output.KindCert, resp)
+		return
+	}
+	fmt.Printf("Serving %s with a fresh certificate, valid until %s\n", resp.URL, resp.NotAfter.Local().Format("2006-01-02 15:04"))
+	fmt.Printf("CERT=%s\n", resp.CertPath)
+	fmt.Printf("KEY=%s\n", resp.KeyPath)
+}
+
+// tlsTrust installs the root certificate into the system trust store
+func tlsTrust(authority *ca.CA) {
+	if err := trust.Install(authority.Root(), authority.RootPath()); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to trust the local CA: %v\n\n", err)
+		fmt.Fprint(os.Stderr, trust.Instructions(authority.RootPath()))
+		os.Exit(1)
+	}
+	fmt.Println("The local CA is trusted. Restart your browser to pick it up.")
+}
@@ -1,22 +1,62 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"html/template"
+	"io"
+	"io/fs"
 	"log"
+	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"localhost-magic/internal/accesslog"
+	"localhost-magic/internal/apiauth"
+	"localhost-magic/internal/config"
+	"localhost-magic/internal/credentials"
+	"localhost-magic/internal/dashboard"
+	"localhost-magic/internal/discover"
+	"localhost-magic/internal/docker"
+	"localhost-magic/internal/handoff"
+	"localhost-magic/internal/health"
+	"localhost-magic/internal/lan"
+	"localhost-magic/internal/listing"
+	"localhost-magic/internal/mdns"
+	"localhost-magic/internal/metrics"
 	"localhost-magic/internal/naming"
+	"localhost-magic/internal/notify"
+	"localhost-magic/internal/output"
 	"localhost-magic/internal/portscan"
-	"localhost-magic/internal/probe"
+	"localhost-magic/internal/procmap"
+	"localhost-magic/internal/proxy"
+	"localhost-magic/internal/qr"
+	"localhost-magic/internal/registry"
+	"localhost-magic/internal/resolver"
+	"localhost-magic/internal/rewrite"
+	"localhost-magic/internal/scan"
+	"localhost-magic/internal/share"
 	"localhost-magic/internal/storage"
+	"localhost-magic/internal/tls/ca"
+	"localhost-magic/internal/tls/issuer"
+	"localhost-magic/internal/tls/policy"
+	"localhost-magic/internal/tls/trust"
+	"localhost-magic/probe"
 )
 
 // Service represents a discovered HTTP service
@@ -29,42 +69,254 @@ type Service struct {
 	ExePath    string
 	Cwd        string
 	Args       []string
-	Proxy      *httputil.ReverseProxy
+	Addrs      []string      `json:",omitempty"` // Addresses the port is bound to
+	Scope      procmap.Scope `json:",omitempty"` // Who can reach the port directly
+
+	LastProbe *probe.ProbeResult `json:"-"` // Nil until probed by this daemon
+	// Health is scored from the probes of successive scans
+	Health *health.Score `json:"health,omitempty"`
+
+	// Auxiliary lists the endpoints that only serve this one, such as its
+	// dev server's HMR port
+	Auxiliary []AuxiliaryEndpoint `json:"auxiliary,omitempty"`
+
+	// Proxy is set for a reverse proxy, and Apps are the apps it serves
+	// on the port, which the daemon's proxy reaches through it
+	Proxy probe.ReverseProxy `json:"proxy,omitempty"`
+	Apps  []App              `json:"apps,omitempty"`
+}
+
+// App is an app a reverse proxy among the services serves, reached through
+// the proxy with the Host or path prefix it is routed by
+type App struct {
+	Name  string      `json:"name"`
+	Route probe.Route `json:"route"`
+}
+
+// AuxiliaryEndpoint is a port that belongs to a service without being one,
+// like the separate hot-module-reload port of a Vite dev server
+type AuxiliaryEndpoint struct {
+	Port      int             `json:"port"`
+	Kind      probe.Auxiliary `json:"kind"`
+	Framework string          `json:"framework,omitempty"`
+}
+
+// auxiliaryListener is a listener whose probe found an auxiliary endpoint
+type auxiliaryListener struct {
+	listener portscan.Listener
+	result   probe.ProbeResult
 }
 
 // Server manages the discovery and proxying of local services
 type Server struct {
 	store        *storage.Store
-	generator    *naming.Generator
-	services     map[string]*Service // key = name
+	registry     *registry.Registry // Names the services, as it does for the CLI
+	docker       *docker.Client
+	services     map[string]*Service      // key = name
+	others       map[int]*output.Listener // key = port
 	mu           sync.RWMutex
 	pollInterval time.Duration
+
+	dashboard  *http.ServeMux
+	proxyPort  int
+	mdns       *mdns.Responder   // nil unless -mdns is set
+	advertised map[string]string // mDNS name -> service name
+	metrics    metrics.Recorder  // No-op unless -metrics is set
+	events     *dashboard.Hub    // Tells open dashboards to refresh
+	access     *accesslog.Ring   // Latest requests through the proxy
+	shares     *share.Manager    // Services reachable from the LAN
+	hidden     map[int]bool      // Ports hidden from the dashboard, not probed
+	reprobe    chan struct{}     // Asks the discovery loop for a scan now
+	probePool  *probe.ConnPool   // Connections kept alive between scans
+	jar        *credentials.Jar  // Session cookies services set through the proxy
+	history    *registry.History // Latest probes of each service, by ID
+
+	cfg        *config.Config   // Replaced, never modified, on SIGHUP
+	clientCert *tls.Certificate // Loaded from cfg.Probe, nil if not set
+	roots      *x509.CertPool   // The local CA's root, trusted by probes; nil if there is no CA
+	configPath string
+	flags      listenAddrs     // The listen flags, as given
+	explicit   map[string]bool // Flags given on the command line
+	proxy      *proxy.Server
+	tls        *proxy.Server  // nil unless -tls is set
+	issuer     *issuer.Issuer // Mints the certificates tls serves, nil unless -tls is set
+	paths      *proxy.Server  // nil unless -paths is set
+	dns        *resolver.Server
+	dnsAddr    string // What dns was asked to listen on
+
+	// dashboardServer serves the dashboard on -dashboard-listen, nil if
+	// that isn't set
+	dashboardServer *proxy.Server
+
+	shareMu   sync.Mutex
+	shareAddr string        // Where the LAN listener binds; empty disables sharing
+	lan       *proxy.Server // The LAN listener, nil until the first share
+
+	draining atomic.Bool // Set once stopping; no more scans
+
+	// notifier shows desktop notifications, nil unless [notify] enables
+	// them; notifyBackend is the backend it was made for. Both under mu.
+	notifier      *notify.Notifier
+	notifyBackend string
+
+	benchMu sync.Mutex                   // Held while a bench runs; one at a time
+	benches map[string]probe.BenchResult // Latest bench of each service, under mu
+
+	appsFound time.Time // When attachApps last looked, only used by discover
+}
+
+// listenAddrs are where the daemon's servers listen
+type listenAddrs struct {
+	proxy, proxyFallback string
+	tls, tlsFallback     string
+	paths                string
+	dns                  string
 }
 
 func main() {
+	advertise := flag.Bool("mdns", false, "advertise services on the LAN over mDNS as name.local")
+	mdnsInterfaces := flag.String("mdns-interfaces", "", "comma-separated interfaces to advertise on (default: all except loopback and point-to-point)")
+	dnsAddr := flag.String("dns", "", "serve DNS for *.localhost on this address, e.g. "+resolver.DefaultAddr)
+	listenAddr := flag.String("listen", proxy.DefaultAddr, "proxy listen address")
+	fallbackAddr := flag.String("fallback-listen", proxy.FallbackAddr, "listen address to use when -listen needs root (empty to fail instead)")
+	enableTLS := flag.Bool("tls", false, "also serve HTTPS with certificates from the local CA")
+	tlsAddr := flag.String("tls-listen", proxy.DefaultTLSAddr, "HTTPS listen address")
+	tlsFallbackAddr := flag.String("tls-fallback-listen", proxy.FallbackTLSAddr, "HTTPS listen address to use when -tls-listen needs root")
+	tlsDir := flag.String("tls-dir", ca.DefaultDir(), "local CA directory")
+	enablePaths := flag.Bool("paths", false, "also serve every service under one origin, at a path prefix: /web/ for web.localhost")
+	pathAddr := flag.String("path-listen", proxy.DefaultPathAddr, "listen address for -paths")
+	enableMetrics := flag.Bool("metrics", false, "serve Prometheus metrics at /metrics on the dashboard")
+	dashboardAddr := flag.String("dashboard-listen", "", "also serve the dashboard on its own address, e.g. :4280")
+	apiAuth := flag.Bool("api-auth", false, "require the bearer token from -api-token-file on API requests")
+	apiTokenFile := flag.String("api-token-file", apiauth.DefaultTokenPath(), "API token file, generated on first run")
+	apiRemote := flag.Bool("api-remote", false, "serve the API to clients that aren't on loopback")
+	configPath := flag.String("config", config.DefaultPath(), "config file, re-read on SIGHUP")
+	accessLog := flag.String("access-log", "", "log every proxied request to this file, rotated by size, or - for stdout")
+	accessLogMaxSize := flag.Int("access-log-max-size", 10, "size in MB at which the access log file is rotated, keeping 3 old ones")
+	logFormat := flag.String("log-format", string(accesslog.FormatText), "access log format: text or json")
+	shareAddr := flag.String("share-listen", share.DefaultAddr, "listen address for services shared on the LAN, opened by the first share (empty to disable sharing)")
+	drainTimeout := flag.Duration("drain-timeout", proxy.DrainTimeout, "how long requests in flight get to finish when the daemon stops or is upgraded")
+	reusePort := flag.Bool("reuse-port", false, "bind with SO_REUSEPORT, so a replacement started separately can listen before this daemon exits")
+	flag.Parse()
+	handoff.ReusePort = *reusePort
+
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	cfg, err := loadConfig(*configPath, explicit["config"])
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	clientCert, err := loadClientCert(cfg)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
 	// Get storage path
 	storePath := storage.DefaultStorePath()
-	if len(os.Args) > 1 {
-		storePath = os.Args[1]
+	if flag.NArg() > 0 {
+		storePath = flag.Arg(0)
 	}
 
-	// Initialize store
+	// Initialize store, and the registry next to it
 	store, err := storage.NewStore(storePath)
 	if err != nil {
 		log.Fatalf("Failed to initialize store: %v", err)
 	}
+	reg, err := registry.Open(filepath.Join(filepath.Dir(storePath), filepath.Base(registry.DefaultPath())))
+	if err != nil {
+		log.Fatalf("Failed to open registry: %v", err)
+	}
+	reg.SetPins(cfg.Names)
+	pruneRegistry(cfg, reg, store)
 
 	// Create server
 	srv := &Server{
 		store:        store,
-		generator:    naming.NewGenerator(),
+		registry:     reg,
+		docker:       docker.New(""),
 		services:     make(map[string]*Service),
+		others:       make(map[int]*output.Listener),
 		pollInterval: 2 * time.Second,
+		advertised:   make(map[string]string),
+		metrics:      metrics.Nop(),
+		events:       dashboard.NewHub(),
+		access:       accesslog.NewRing(accesslog.DefaultRingSize),
+		hidden:       make(map[int]bool),
+		reprobe:      make(chan struct{}, 1),
+		probePool:    probe.NewConnPool(probe.DefaultPoolSize, probe.DefaultPoolIdle),
+		jar:          credentials.NewJar(credentials.DefaultJarDir()),
+		history:      registry.NewHistory(registry.HistoryPath(storePath)),
+		benches:      make(map[string]probe.BenchResult),
+		cfg:          cfg,
+		clientCert:   clientCert,
+		roots:        localRoots(*tlsDir),
+		configPath:   *configPath,
+		explicit:     explicit,
+		shareAddr:    *shareAddr,
+		flags: listenAddrs{
+			proxy: *listenAddr, proxyFallback: *fallbackAddr,
+			tls: *tlsAddr, tlsFallback: *tlsFallbackAddr,
+			paths: *pathAddr, dns: *dnsAddr,
+		},
+	}
+	srv.history.SetSize(cfg.Registry.History)
+	reg.OnConflict(srv.nameConflict)
+	addrs := srv.listenAddrs(cfg)
+	var promMetrics *metrics.Metrics
+	if *enableMetrics {
+		promMetrics = metrics.New()
+		srv.metrics = promMetrics
+	}
+
+	if *advertise {
+		var ifaces []string
+		if *mdnsInterfaces != "" {
+			ifaces = strings.Split(*mdnsInterfaces, ",")
+		}
+		responder, err := mdns.NewResponder(mdns.Options{Interfaces: ifaces})
+		if err != nil {
+			log.Fatalf("Failed to start mDNS responder: %v", err)
+		}
+		srv.mdns = responder
+		log.Printf("mDNS: advertising on %s", strings.Join(responder.Interfaces(), ", "))
 	}
 
-	// Load existing services into generator to avoid name collisions
+	if err := srv.startDNS(addrs.dns); err != nil {
+		log.Fatalf("Failed to start DNS resolver: %v", err)
+	}
+	srv.configureNotifier(cfg)
+
+	// Re-read the config on SIGHUP, hand the sockets to a replacement on
+	// SIGUSR2, and let requests and DNS queries finish before exiting
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+		handoff.NotifyUpgrade(sig)
+		upgraded := srv.waitForStop(sig)
+		// The replacement advertises the same names; a goodbye would
+		// withdraw them
+		if srv.mdns != nil && !upgraded {
+			srv.mdns.Close()
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+		srv.shutdown(ctx)
+		cancel()
+		os.Exit(0)
+	}()
+
+	// Load the services known from earlier runs, under the names the
+	// registry has for them now
+	registered := make(map[string]registry.Entry)
+	for _, e := range reg.List() {
+		registered[e.ID] = e
+	}
 	for _, record := range store.List() {
-		srv.generator.GenerateName(record.ExePath, "", record.Args) // Mark name as used
+		if e, ok := registered[record.ID]; ok && e.Name != record.Name {
+			record.Name = e.Name
+			if err := store.Save(record); err != nil {
+				log.Printf("Failed to update service %s: %v", record.Name, err)
+			}
+		}
 		srv.services[record.Name] = &Service{
 			ID:         record.ID,
 			Name:       record.Name,
@@ -74,42 +326,522 @@ func main() {
 			ExePath:    record.ExePath,
 			Cwd:        "",
 			Args:       record.Args,
-			Proxy:      nil, // Will be created on first use
 		}
 	}
 
+	// The token is created even when not required, so tools can be set up
+	// to send it before -api-auth is turned on
+	token, created, err := apiauth.LoadOrCreateToken(*apiTokenFile)
+	if err != nil {
+		log.Fatalf("Failed to load API token: %v", err)
+	}
+	if created {
+		log.Printf("API: generated a token in %s", *apiTokenFile)
+	}
+	apiOpts := apiauth.Options{AllowRemote: *apiRemote}
+	if hostname, err := os.Hostname(); err == nil && *apiRemote {
+		// Remote clients may address the machine by name
+		apiOpts.Hosts = []string{hostname, hostname + ".local"}
+	}
+	if *apiAuth {
+		apiOpts.Token = token
+	}
+
+	// Setup HTTP handlers. Service hostnames are proxied on every path;
+	// the dashboard and API answer for any other host.
+	srv.routeDashboard(apiOpts, promMetrics)
+	handler := proxy.New(srv, srv.dashboard)
+	handler.OnAccess(srv.access.Add)
+	handler.OnCookies(srv.keepCookies)
+	srv.shares = share.New(srv, handler)
+	go srv.shares.Run(context.Background())
+	if *accessLog != "" {
+		format, err := accesslog.ParseFormat(*logFormat)
+		if err != nil {
+			log.Fatalf("Invalid -log-format: %v", err)
+		}
+		w := io.Writer(os.Stdout)
+		if *accessLog != "-" {
+			file, err := accesslog.OpenRotating(*accessLog, int64(*accessLogMaxSize)<<20, 3)
+			if err != nil {
+				log.Fatalf("Failed to open access log: %v", err)
+			}
+			w = file
+		}
+		handler.OnAccess(accesslog.New(w, format).Log)
+	}
+
+	// Listen before discovery so the port to advertise is known
+	srv.proxy = proxy.NewServer(handler, nil)
+	if err := srv.proxy.Listen(addrs.proxy, addrs.proxyFallback); err != nil {
+		log.Fatalf("Failed to listen: %v", err)
+	}
+	srv.proxyPort = srv.proxy.Addr().(*net.TCPAddr).Port
+
 	// Start discovery loop
 	go srv.discoveryLoop()
 
-	// Setup HTTP handler
-	http.HandleFunc("/", srv.handleRequest)
-	http.HandleFunc("/api/services", srv.handleAPIServices)
-	http.HandleFunc("/api/rename", srv.handleAPIRename)
-	http.HandleFunc("/api/blacklist", srv.handleAPIBlacklist)
-	http.HandleFunc("/api/keep", srv.handleAPIKeep)
-
 	log.Println("localhost-magic daemon starting...")
 	log.Printf("Storage: %s", storePath)
-	log.Println("Listening on :80 (requires root)")
-	log.Println("Dashboard: http://localhost/ (when no hostname matches)")
-	log.Fatal(http.ListenAndServe(":80", nil))
+	log.Printf("Listening on %s", srv.proxy.Addr())
+	log.Println("Dashboard: http://magic.localhost/ (or any hostname that isn't a service)")
+	if *dashboardAddr != "" {
+		srv.serveDashboard(*dashboardAddr)
+	}
+	if *enableTLS {
+		srv.serveTLS(handler, *tlsDir, addrs.tls, addrs.tlsFallback)
+	}
+	if *enablePaths {
+		srv.servePaths(handler, addrs.paths)
+	}
+	if err := handoff.Ready(); err != nil {
+		log.Printf("Upgrade: %v", err)
+	}
+	log.Fatal(srv.proxy.Wait())
 }
 
-// discoveryLoop continuously scans for new services
-func (s *Server) discoveryLoop() {
-	ticker := time.NewTicker(s.pollInterval)
-	defer ticker.Stop()
+// routeDashboard sets up the dashboard, the API and, if m is set, the
+// metrics. The API and metrics are both behind opts: either tells whoever
+// reads it which services run here.
+func (s *Server) routeDashboard(opts apiauth.Options, m *metrics.Metrics) {
+	s.dashboard = http.NewServeMux()
+	s.dashboard.Handle("/", dashboard.Handler())
+	api := func(path string, h http.Handler) {
+		s.dashboard.Handle(path, apiauth.Protect(h, opts))
+	}
+	api("/api/services", http.HandlerFunc(s.handleAPIServices))
+	api("/api/services/", http.HandlerFunc(s.handleAPIService))
+	api("/api/rename", http.HandlerFunc(s.handleAPIRename))
+	api("/api/blacklist", http.HandlerFunc(s.handleAPIBlacklist))
+	api("/api/keep", http.HandlerFunc(s.handleAPIKeep))
+	api("/api/listeners", http.HandlerFunc(s.handleAPIListeners))
+	api("/api/hide", http.HandlerFunc(s.handleAPIHide))
+	api("/api/hidden", http.HandlerFunc(s.handleAPIHidden))
+	api("/api/probe", http.HandlerFunc(s.handleAPIProbe))
+	api("/api/events", s.events)
+	api("/api/access", http.HandlerFunc(s.handleAPIAccess))
+	api("/api/shares", http.HandlerFunc(s.handleAPIShares))
+	api("/api/shares/", http.HandlerFunc(s.handleAPIShare))
+	if m != nil {
+		api("/metrics", m)
+	}
+}
 
-	// Run immediately on start
-	s.discover()
+// serveDashboard also serves the dashboard and API on addr
+func (s *Server) serveDashboard(addr string) {
+	s.dashboardServer = proxy.NewServer(s.dashboard, nil)
+	if err := s.dashboardServer.Listen(addr, ""); err != nil {
+		log.Fatalf("Failed to listen for the dashboard: %v", err)
+	}
+	log.Printf("Dashboard also on %s", s.dashboardServer.Addr())
+	go func() { log.Fatal(s.dashboardServer.Wait()) }()
+}
+
+// waitForStop handles signals until one stops the daemon: SIGHUP reloads
+// the config, and an upgrade signal starts a replacement with the
+// listening sockets, stopping this daemon once it serves. It reports
+// whether that is why it stopped.
+func (s *Server) waitForStop(sig <-chan os.Signal) bool {
+	for received := range sig {
+		switch {
+		case received == syscall.SIGHUP:
+			s.reloadConfig()
+		case handoff.IsUpgrade(received):
+			log.Printf("Upgrade: starting a replacement")
+			if err := handoff.Upgrade(handoff.DefaultUpgradeTimeout); err != nil {
+				log.Printf("Upgrade: still serving: %v", err)
+				continue
+			}
+			log.Printf("Upgrade: the replacement is serving, stopping")
+			return true
+		default:
+			log.Printf("Stopping on %s", received)
+			return false
+		}
+	}
+	return false
+}
+
+// shutdown stops scanning and closes every listener, letting the requests
+// and DNS queries in flight finish until ctx expires. The sockets passed
+// to a replacement stay open in it.
+func (s *Server) shutdown(ctx context.Context) {
+	s.draining.Store(true)
+	s.shareMu.Lock()
+	servers := []*proxy.Server{s.proxy, s.tls, s.paths, s.dashboardServer, s.lan}
+	s.shareMu.Unlock()
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		if server == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(server *proxy.Server) {
+			defer wg.Done()
+			server.Shutdown(ctx)
+		}(server)
+	}
+	if dns := s.resolver(); dns != nil {
+		dns.Shutdown(ctx)
+	}
+	wg.Wait()
+	if err := s.history.Flush(); err != nil {
+		log.Printf("History: %v", err)
+	}
+}
+
+// servePaths serves every service under one origin, at the path prefix
+// its name gives, alongside the hostname routing
+func (s *Server) servePaths(handler *proxy.Handler, addr string) {
+	s.paths = proxy.NewServer(proxy.NewPathHandler(handler, s.keepPrefix), nil)
+	if err := s.paths.Listen(addr, ""); err != nil {
+		log.Fatalf("Failed to listen for path routing: %v", err)
+	}
+	log.Printf("Path routing on http://%s/ (e.g. /web/ for web.localhost)", s.paths.Addr())
+	go func() { log.Fatal(s.paths.Wait()) }()
+}
+
+// keepPrefix reports whether the config has the backend of name see its
+// path prefix, rather than have path routing strip it
+func (s *Server) keepPrefix(name string) bool {
+	for _, keep := range s.config().Proxy.KeepPrefix {
+		if keep == name || keep+".localhost" == name || proxy.PathPrefix(name) == keep {
+			return true
+		}
+	}
+	return false
+}
+
+// serveTLS serves handler over HTTPS, minting a certificate for each
+// hostname from the local CA on its first request
+func (s *Server) serveTLS(handler http.Handler, dir, addr, fallback string) {
+	authority, created, err := ca.LoadOrCreate(dir)
+	if err != nil {
+		log.Fatalf("Failed to load local CA: %v", err)
+	}
+	if created || !trust.IsTrusted(authority.Root()) {
+		log.Printf("TLS: the local CA in %s is not trusted yet; run: sudo localhost-magic tls trust", dir)
+	}
+
+	certs := issuer.New(authority)
+	roots := x509.NewCertPool()
+	roots.AddCert(authority.Root())
+	s.mu.Lock()
+	s.issuer, s.roots = certs, roots
+	s.mu.Unlock()
+	s.tls = proxy.NewServer(handler, &tls.Config{GetCertificate: certs.GetCertificate})
+	if err := s.tls.Listen(addr, fallback); err != nil {
+		log.Fatalf("Failed to listen for HTTPS: %v", err)
+	}
+	log.Printf("Listening for HTTPS on %s", s.tls.Addr())
+	go func() { log.Fatal(s.tls.Wait()) }()
+}
+
+// loadConfig reads the config file and the environment overrides. A
+// missing file is only an error if the user named it.
+func loadConfig(path string, required bool) (*config.Config, error) {
+	cfg, err := config.Load(path)
+	if errors.Is(err, fs.ErrNotExist) && !required {
+		cfg, err = &config.Config{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.ApplyEnv(os.Environ()); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// pruneRegistry forgets the services that haven't been seen for the
+// retention period, along with their records in store unless they are
+// kept. Failing to is only worth a warning.
+func pruneRegistry(cfg *config.Config, reg *registry.Registry, store *storage.Store) {
+	pruned, err := reg.Prune(cfg.Registry.Retention, false)
+	if err != nil {
+		log.Printf("Warning: failed to prune registry: %v", err)
+		return
+	}
+	for _, e := range pruned {
+		log.Printf("Registry: pruned %s (port %d), last seen %s", e.Name, e.Port, e.LastSeen.Format(time.RFC3339))
+		if record, ok := store.Get(e.ID); ok && !record.Keep && !record.UserDefined {
+			if err := store.Delete(e.ID); err != nil {
+				log.Printf("Warning: failed to forget %s: %v", e.Name, err)
+			}
+		}
+	}
+}
+
+// loadClientCert loads the client certificate the probes present to mTLS
+// services, nil if the config names none
+func loadClientCert(cfg *config.Config) (*tls.Certificate, error) {
+	certFile, keyFile := cfg.Probe.ClientCert, cfg.Probe.ClientKey
+	switch {
+	case certFile == "" && keyFile == "":
+		return nil, nil
+	case certFile == "" || keyFile == "":
+		return nil, errors.New("probe client_cert and client_key must be set together")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load probe client certificate: %w", err)
+	}
+	return &cert, nil
+}
+
+// probeClientCert returns the client certificate probes present, if any
+func (s *Server) probeClientCert() *tls.Certificate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.clientCert
+}
+
+// probeRoots returns the roots probes trust besides the system's
+func (s *Server) probeRoots() *x509.CertPool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.roots
+}
+
+// localRoots holds the root of the local CA in dir, nil if there is none
+// yet
+func localRoots(dir string) *x509.CertPool {
+	root, err := ca.LoadRoot(dir)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("TLS: %v", err)
+		}
+		return nil
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	return roots
+}
+
+// listenAddrs resolves the listen addresses: flags given on the command
+// line win, then the config file, then the flag defaults
+func (s *Server) listenAddrs(cfg *config.Config) listenAddrs {
+	pick := func(flagName, flagValue, configValue string) string {
+		if s.explicit[flagName] || configValue == "" {
+			return flagValue
+		}
+		return configValue
+	}
+	return listenAddrs{
+		proxy:         pick("listen", s.flags.proxy, cfg.Proxy.Listen),
+		proxyFallback: pick("fallback-listen", s.flags.proxyFallback, cfg.Proxy.FallbackListen),
+		tls:           pick("tls-listen", s.flags.tls, cfg.Proxy.TLSListen),
+		tlsFallback:   pick("tls-fallback-listen", s.flags.tlsFallback, cfg.Proxy.TLSFallbackListen),
+		paths:         pick("path-listen", s.flags.paths, cfg.Proxy.PathListen),
+		dns:           pick("dns", s.flags.dns, cfg.DNS.Listen),
+	}
+}
+
+// config returns the settings in effect
+func (s *Server) config() *config.Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cfg
+}
+
+// reloadConfig re-reads the config file and applies it. Listeners whose
+// address changed move without dropping requests in flight; if anything
+// is wrong with the file the old settings stay.
+func (s *Server) reloadConfig() {
+	cfg, err := loadConfig(s.configPath, s.explicit["config"])
+	var clientCert *tls.Certificate
+	if err == nil {
+		clientCert, err = loadClientCert(cfg)
+	}
+	if err != nil {
+		log.Printf("Config: not reloaded: %v", err)
+		return
+	}
+	s.mu.Lock()
+	s.cfg = cfg
+	s.clientCert = clientCert
+	s.mu.Unlock()
+	s.history.SetSize(cfg.Registry.History)
+	s.registry.SetPins(cfg.Names)
+	s.configureNotifier(cfg)
+
+	addrs := s.listenAddrs(cfg)
+	if err := s.proxy.Listen(addrs.proxy, addrs.proxyFallback); err != nil {
+		log.Printf("Config: proxy stays on %s: %v", s.proxy.Addr(), err)
+	}
+	s.mu.Lock()
+	s.proxyPort = s.proxy.Addr().(*net.TCPAddr).Port
+	s.mu.Unlock()
+	if s.tls != nil {
+		if err := s.tls.Listen(addrs.tls, addrs.tlsFallback); err != nil {
+			log.Printf("Config: HTTPS stays on %s: %v", s.tls.Addr(), err)
+		}
+	}
+	if s.paths != nil {
+		if err := s.paths.Listen(addrs.paths, ""); err != nil {
+			log.Printf("Config: path routing stays on %s: %v", s.paths.Addr(), err)
+		}
+	}
+	if err := s.startDNS(addrs.dns); err != nil {
+		log.Printf("Config: DNS resolver unchanged: %v", err)
+	}
+
+	log.Printf("Config: reloaded %s", s.configPath)
+	s.requestScan()
+}
+
+// configureNotifier starts, reconfigures or stops desktop notifications
+// as [notify] asks. A backend that can't be opened leaves them off.
+func (s *Server) configureNotifier(cfg *config.Config) {
+	s.mu.Lock()
+	current, backend := s.notifier, s.notifyBackend
+	if current != nil && cfg.Notify.Enabled && cfg.Notify.Backend == backend {
+		current.SetOptions(cfg.NotifyOptions())
+		s.mu.Unlock()
+		return
+	}
+	s.notifier = nil
+	s.mu.Unlock()
+	if current != nil {
+		current.Close()
+	}
+	if !cfg.Notify.Enabled {
+		return
+	}
+
+	b, err := notify.NewBackend(cfg.Notify.Backend)
+	if err != nil {
+		log.Printf("Notify: notifications off: %v", err)
+		return
+	}
+	s.mu.Lock()
+	s.notifier, s.notifyBackend = notify.New(b, cfg.NotifyOptions()), cfg.Notify.Backend
+	s.mu.Unlock()
+}
+
+// notifyLoop shows the desktop notifications for the service events
+// published to the dashboards
+func (s *Server) notifyLoop() {
+	events, cancel := s.events.Subscribe(64)
+	defer cancel()
+	for e := range events {
+		s.mu.RLock()
+		notifier := s.notifier
+		s.mu.RUnlock()
+		if notifier == nil {
+			continue
+		}
+		n := notify.Event{Service: e.Name}
+		switch {
+		case e.Type == "added":
+			n.Type, n.URL = discover.ServiceAdded, s.notifyURL(e.Name)
+		case e.Type == "removed":
+			n.Type, n.Reason = discover.ServiceRemoved, "port closed"
+		case e.Type == "health" && e.Health != nil:
+			n.Reason = e.Health.Reason
+			switch e.Health.State {
+			case health.StateHealthy:
+				n.Type, n.URL, n.Reason = discover.ServiceHealthy, s.notifyURL(e.Name), ""
+			case health.StateDegraded:
+				n.Type, n.URL = discover.ServiceDegraded, s.notifyURL(e.Name)
+			case health.StateDown:
+				n.Type = discover.ServiceDown
+			}
+		}
+		if n.Type != "" {
+			notifier.Handle(n)
+		}
+	}
+}
+
+// notifyURL is the address a notification opens a service at: over HTTPS
+// when the daemon serves it
+func (s *Server) notifyURL(name string) string {
+	if s.tls != nil {
+		return s.httpsURL(name)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.serviceURL(name)
+}
+
+// httpsURL is the address a service is reached at through the HTTPS
+// listener, which must be running
+func (s *Server) httpsURL(name string) string {
+	if port := s.tls.Addr().(*net.TCPAddr).Port; port != 443 {
+		return fmt.Sprintf("https://%s:%d/", name, port)
+	}
+	return fmt.Sprintf("https://%s/", name)
+}
+
+// resolver returns the running DNS resolver, nil if there is none
+func (s *Server) resolver() *resolver.Server {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.dns
+}
+
+// startDNS serves DNS on addr, replacing a resolver on another address
+// once the new one is up. An empty addr stops it.
+func (s *Server) startDNS(addr string) error {
+	s.mu.RLock()
+	old, current := s.dns, s.dnsAddr
+	s.mu.RUnlock()
+	if addr == current {
+		return nil
+	}
+	var dns *resolver.Server
+	if addr != "" {
+		dns = resolver.New(resolver.Options{Addr: addr, Services: s.servicePort})
+		if err := dns.Start(); err != nil {
+			return err
+		}
+		log.Printf("DNS: answering *.localhost on %s", dns.Addr())
+	}
+	s.mu.Lock()
+	s.dns = dns
+	s.dnsAddr = addr
+	s.mu.Unlock()
+	if old != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		old.Shutdown(ctx)
+		cancel()
+	}
+	return nil
+}
 
-	for range ticker.C {
+// discoveryLoop continuously scans for new services, and scans at once
+// when a re-probe is requested
+func (s *Server) discoveryLoop() {
+	// Run immediately on start. The services found then aren't news.
+	s.discover()
+	go s.notifyLoop()
+
+	for {
+		timer := time.NewTimer(s.scanInterval())
+		select {
+		case <-timer.C:
+		case <-s.reprobe:
+			timer.Stop()
+		}
+		if s.draining.Load() {
+			return
+		}
 		s.discover()
 	}
 }
 
+// scanInterval is the time between scans, from the config or the default
+func (s *Server) scanInterval() time.Duration {
+	if interval := s.config().Scan.Interval; interval > 0 {
+		return interval
+	}
+	return s.pollInterval
+}
+
 // discover scans for listening ports and updates services
 func (s *Server) discover() {
+	start := time.Now()
 	listeners, err := portscan.Scan()
 	if err != nil {
 		log.Printf("Port scan failed: %v", err)
@@ -117,37 +849,110 @@ func (s *Server) discover() {
 	}
 
 	now := time.Now()
+	up := make(map[string]int) // Services up by protocol, for metrics
+	cfg := s.config()
+	exclusions := cfg.Exclusions()
+	thresholds := cfg.HealthThresholds()
+	probeOpts := probe.ProbeOptions{DialTimeout: cfg.Probe.DialTimeout, ReadTimeout: cfg.Probe.ReadTimeout, DetectAPISpec: cfg.Probe.APISpec, DetectVersions: true, Headers: cfg.Probe.Headers, Paths: cfg.Probe.Paths, ClientCert: s.probeClientCert(), Roots: s.probeRoots(), Hooks: s.metrics.ProbeHooks()}
 
 	// Track which services we've seen this scan
-	seenIDs := make(map[string]bool)
 	seenNames := make(map[string]bool)
+	seenOthers := make(map[int]bool)
+	var auxiliary []auxiliaryListener
+	var found []discovered
+
+	// The registry tells services apart by their process or container
+	findings := make([]scan.Finding, len(listeners))
+	for i, listener := range listeners {
+		findings[i] = listenerFinding(listener)
+	}
+	if err := scan.AttachContainers(context.Background(), findings, s.docker); err != nil {
+		log.Printf("Failed to look up Docker containers: %v", err)
+	}
 
-	for _, listener := range listeners {
-		// Skip ourselves (port 80)
-		if listener.Port == 80 {
+	for i, listener := range listeners {
+		f := findings[i]
+		// Skip ourselves: port 80 and whatever else this process listens on
+		if listener.Port == 80 || listener.PID == os.Getpid() {
 			continue
 		}
 
-		// Skip blacklisted services
+		// Skip blacklisted services, what the config ignores or excludes
+		// and ports hidden from the dashboard
 		if naming.IsBlacklisted(listener.ExePath, listener.Args) {
 			continue
 		}
+		if _, excluded := exclusions.Match(f); !cfg.ScanPort(listener.Port) || excluded {
+			continue
+		}
+		s.mu.RLock()
+		hidden := s.hidden[listener.Port]
+		s.mu.RUnlock()
+		if hidden {
+			continue
+		}
+
+		// Non-HTTP services aren't proxied, but open ones are listed
+		// separately so they don't go unnoticed. A listener bound to
+		// another loopback address, e.g. 127.0.0.2, is probed and proxied
+		// there.
+		host := procmap.DialAddr(listener.Addrs, listener.Scope)
+		listenerOpts := probeOpts
+		listenerOpts.Credentials = s.probeCredentials(cfg, f)
+		result := s.probeListener(host, listener, listenerOpts)
+		if !result.IsHTTP {
+			s.metrics.ObserveProbe("", result)
+			if result.State == probe.StateOpenSilent || result.State == probe.StateOpenNonHTTP || result.Protocol != probe.ProtocolUnknown || result.ClientCertRequired {
+				seenOthers[listener.Port] = true
+				s.recordOther(listener, result)
+				up[protocolLabel(result)]++
+			}
+			continue
+		}
+		up[protocolLabel(result)]++
 
-		// Skip non-HTTP services (check if actually HTTP)
-		if !probe.IsHTTP("127.0.0.1", listener.Port) {
+		// Auxiliary endpoints are attached to their service once every
+		// listener has been seen; registered on their own, they would take
+		// the identity of the process that runs both
+		if result.Auxiliary != probe.AuxiliaryNone {
+			auxiliary = append(auxiliary, auxiliaryListener{listener: listener, result: result})
 			continue
 		}
+		f.ProbeResult = result
+		found = append(found, discovered{listener: listener, host: host, finding: f})
+	}
 
-		// Compute identity hash
-		id := naming.ComputeIdentityHash(listener.ExePath, listener.Args)
-		seenIDs[id] = true
+	// Name the services as the registry does, registering the new ones
+	entries := s.registerServices(found)
+	proxies := make(map[string]scan.Finding) // By name, for attachApps
+	for _, d := range found {
+		listener, host, result := d.listener, d.host, d.finding.ProbeResult
+		id := d.finding.Identity()
+		entry, ok := entries[id]
+		if !ok {
+			continue // The registry couldn't be updated, which was logged
+		}
+		s.history.Record(id, result, now)
 
 		// Check if we already know this service
-		if existing, ok := s.store.Get(id); ok {
-			seenNames[existing.Name] = true
+		if existing, ok := s.serviceRecord(listener, &entry); ok {
+			name := entry.Name
+			seenNames[name] = true
+			proxies[name] = d.finding
+			s.metrics.ObserveProbe(name, result)
 
-			// Update if port, PID, or active status changed
+			// Update if name, port, PID, or active status changed
 			needsSave := false
+			reactivated := !existing.IsActive
+			if existing.Name != name {
+				s.mu.Lock()
+				s.moveService(existing.Name, name)
+				s.mu.Unlock()
+				log.Printf("Renamed %s -> %s", existing.Name, name)
+				s.events.Publish(dashboard.Event{Type: "renamed", Name: name, Port: listener.Port})
+				existing.Name = name
+				needsSave = true
+			}
 			if existing.Port != listener.Port {
 				existing.Port = listener.Port
 				needsSave = true
@@ -156,6 +961,10 @@ func (s *Server) discover() {
 				existing.PID = listener.PID
 				needsSave = true
 			}
+			if existing.EffectiveTargetHost() != host {
+				existing.TargetHost = recordedHost(host)
+				needsSave = true
+			}
 			if !existing.IsActive {
 				existing.IsActive = true
 				needsSave = true
@@ -172,23 +981,43 @@ func (s *Server) discover() {
 
 			// Update runtime service
 			s.mu.Lock()
+			var changed bool
+			var scored *health.Score // Set when the health state changed
 			if svc, exists := s.services[existing.Name]; exists {
+				changed = svc.LastProbe != nil && probeChanged(*svc.LastProbe, result) || svc.Port != listener.Port || svc.TargetHost != host
+				if svc.Health, scored = observeHealth(svc.Health, result, thresholds, now, reactivated); scored != nil {
+					log.Printf("Service %s is %s", existing.Name, scored.State)
+				}
 				svc.Port = listener.Port
+				svc.TargetHost = host
 				svc.PID = listener.PID
 				svc.Cwd = listener.Cwd
+				svc.Addrs = listener.Addrs
+				svc.Scope = listener.Scope
+				svc.LastProbe = &result
 			}
 			s.mu.Unlock()
+			switch {
+			case reactivated:
+				s.events.Publish(dashboard.Event{Type: "added", Name: existing.Name, Port: listener.Port, Probe: &result})
+			case changed:
+				s.events.Publish(dashboard.Event{Type: "changed", Name: existing.Name, Port: listener.Port, Probe: &result})
+			}
+			if scored != nil {
+				s.events.Publish(dashboard.Event{Type: "health", Name: existing.Name, Port: listener.Port, Health: scored})
+			}
 			continue
 		}
 
-		// Generate name for new service
-		name := s.generator.GenerateName(listener.ExePath, listener.Cwd, listener.Args)
+		name := entry.Name
+		s.metrics.ObserveProbe(name, result)
 
 		// Create record
 		record := &storage.ServiceRecord{
 			ID:          id,
 			Name:        name,
 			Port:        listener.Port,
+			TargetHost:  recordedHost(host),
 			PID:         listener.PID,
 			ExePath:     listener.ExePath,
 			Args:        listener.Args,
@@ -210,17 +1039,35 @@ func (s *Server) discover() {
 			ID:         id,
 			Name:       name,
 			Port:       listener.Port,
-			TargetHost: "127.0.0.1",
+			TargetHost: host,
 			PID:        listener.PID,
 			ExePath:    listener.ExePath,
 			Cwd:        listener.Cwd,
 			Args:       listener.Args,
+			Addrs:      listener.Addrs,
+			Scope:      listener.Scope,
+			LastProbe:  &result,
 		}
+		s.services[name].Health, _ = observeHealth(nil, result, thresholds, now, true)
 		s.mu.Unlock()
 
 		seenNames[name] = true
-		log.Printf("New service: %s -> 127.0.0.1:%d (%s)", name, listener.Port, listener.ExePath)
+		proxies[name] = d.finding
+		log.Printf("New service: %s -> %s (%s)", name, net.JoinHostPort(host, strconv.Itoa(listener.Port)), listener.ExePath)
+		s.events.Publish(dashboard.Event{Type: "added", Name: name, Port: listener.Port, Probe: &result})
+	}
+
+	s.attachAuxiliary(auxiliary, seenNames, seenOthers)
+	s.attachApps(cfg, probeOpts, proxies)
+
+	// Forget non-HTTP listeners that went away
+	s.mu.Lock()
+	for port := range s.others {
+		if !seenOthers[port] {
+			delete(s.others, port)
+		}
 	}
+	s.mu.Unlock()
 
 	// Mark services as inactive if not seen
 	s.mu.Lock()
@@ -230,149 +1077,990 @@ func (s *Server) discover() {
 				record.IsActive = false
 				record.LastSeen = now
 				s.store.Save(record)
+				s.history.RecordGone(svc.ID, svc.Port, now)
 				log.Printf("Service inactive: %s", name)
+				s.events.Publish(dashboard.Event{Type: "removed", Name: name, Port: svc.Port})
 			}
 		}
 	}
 	s.mu.Unlock()
-}
 
-// handleRequest routes HTTP requests to the appropriate service or dashboard
-func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
-	// Extract host without port
-	host := r.Host
-	if i := strings.LastIndex(host, ":"); i != -1 {
-		host = host[:i]
+	if err := s.history.FlushDue(); err != nil {
+		log.Printf("History: %v", err)
 	}
+	s.metrics.ObserveScan(time.Since(start), up, len(s.store.List()))
+	s.advertise()
+}
 
-	// If accessing by IP or localhost without specific subdomain, show dashboard
-	if host == "localhost" || host == "127.0.0.1" || host == "" {
-		s.serveDashboard(w, r)
-		return
+// recordedHost is the target host to store for a discovered service: empty
+// for 127.0.0.1, the default, so records stay as they were before other
+// loopback addresses were scanned
+func recordedHost(host string) string {
+	if host == "127.0.0.1" {
+		return ""
 	}
+	return host
+}
 
-	s.mu.RLock()
-	service, ok := s.services[host]
-	s.mu.RUnlock()
+// discovered is an HTTP service found by a scan, to be named by the
+// registry
+type discovered struct {
+	listener portscan.Listener
+	host     string // Where it was probed
+	finding  scan.Finding
+}
 
-	if !ok {
-		// No service found - show dashboard with message
-		s.serveDashboardWithError(w, r, fmt.Sprintf("No service found for %s", host))
-		return
+// listenerFinding is the scan finding of a listener, not probed yet, with
+// its process as AttachProcesses would set it
+func listenerFinding(listener portscan.Listener) scan.Finding {
+	f := scan.Finding{State: scan.StateOpen, Scope: listener.Scope}
+	f.Port = listener.Port
+	f.Process = &procmap.Process{
+		Port: listener.Port, PID: listener.PID, Name: filepath.Base(listener.ExePath),
+		Exe: listener.ExePath, Args: listener.Args, Cwd: listener.Cwd, UID: -1,
+		Addrs: listener.Addrs, Scope: listener.Scope,
 	}
+	return f
+}
 
-	// Create proxy on first use
-	if service.Proxy == nil {
-		targetURL := fmt.Sprintf("http://%s:%d", service.TargetHost, service.Port)
-		target, err := url.Parse(targetURL)
-		if err != nil {
-			http.Error(w, "Invalid target URL", http.StatusInternalServerError)
-			return
+// registerServices returns the registry entries of the services found, by
+// ID, registering those it doesn't have on the port they are on now. When
+// nothing moved, their entries are only touched, so the registry file
+// isn't rewritten on every scan; its names are re-read all the same, for
+// renames made with the CLI.
+func (s *Server) registerServices(found []discovered) map[string]registry.Entry {
+	if err := s.registry.Reload(); err != nil {
+		log.Printf("Registry: %v", err)
+	}
+	entries := make(map[string]registry.Entry)
+	for _, e := range s.registry.List() {
+		entries[e.ID] = e
+	}
+	// Manual services, and those the registry doesn't know yet, keep
+	// their names from the new ones
+	var reserved []string
+	for _, record := range s.store.List() {
+		if _, ok := entries[record.ID]; !ok {
+			reserved = append(reserved, record.Name)
 		}
-
-		service.Proxy = httputil.NewSingleHostReverseProxy(target)
-		// Custom error handler
-		service.Proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-			log.Printf("Proxy error for %s: %v", host, err)
-			http.Error(w, fmt.Sprintf("Service %s unavailable", host), http.StatusBadGateway)
+	}
+	s.registry.SetReserved(reserved)
+	findings := make([]scan.Finding, 0, len(found))
+	changed := false
+	for _, d := range found {
+		findings = append(findings, d.finding)
+		e, ok := entries[d.finding.Identity()]
+		changed = changed || !ok || e.Port != d.finding.Port || e.Address != d.finding.Address
+	}
+	if !changed {
+		if err := s.registry.Touch(findings...); err != nil {
+			log.Printf("Registry: %v", err)
 		}
+		return entries
+	}
+	observed, err := s.registry.Observe(findings...)
+	if err != nil {
+		log.Printf("Registry: failed to register services: %v", err)
+	}
+	for _, e := range observed {
+		entries[e.ID] = e
 	}
+	return entries
+}
 
-	// Update Host header to match the backend
-	r.Header.Set("X-Forwarded-Host", r.Host)
-	r.Host = fmt.Sprintf("%s:%d", service.TargetHost, service.Port)
+// serviceRecord returns the store's record of the service entry is for:
+// under its registry ID, or under an ID it had before, in which case it is
+// filed under the registry ID from now on. A service the registry has only
+// just registered takes the name its record has, so names don't change
+// when the registry first sees the services the daemon knew, or sees again
+// one it pruned while the store kept it.
+func (s *Server) serviceRecord(listener portscan.Listener, entry *registry.Entry) (*storage.ServiceRecord, bool) {
+	record, ok := s.store.Get(entry.ID)
+	if !ok {
+		if record, ok = s.previousRecord(listener, *entry); !ok {
+			return nil, false
+		}
+		previous := record.ID
+		if err := s.store.Delete(previous); err != nil {
+			log.Printf("Failed to update service %s: %v", record.Name, err)
+		}
+		record.ID, record.Args = entry.ID, listener.Args
+		if err := s.store.Save(record); err != nil {
+			log.Printf("Failed to update service %s: %v", record.Name, err)
+		}
+		if err := s.history.Move(previous, entry.ID); err != nil {
+			log.Printf("History: %v", err)
+		}
+		s.mu.Lock()
+		if svc, ok := s.services[record.Name]; ok {
+			svc.ID = entry.ID
+		}
+		s.mu.Unlock()
+	}
+	if entry.FirstSeen.Equal(entry.LastSeen) && record.Name != entry.Name {
+		adopted, err := s.registry.Adopt(entry.Name, record.Name, record.UserDefined)
+		if err != nil {
+			log.Printf("Registry: %s stays %s: %v", record.Name, entry.Name, err)
+		} else {
+			*entry = adopted
+		}
+	}
+	return record, true
+}
 
-	service.Proxy.ServeHTTP(w, r)
+// previousRecord returns the record of the service entry is for under an
+// ID it no longer has: the hash of its executable and arguments the daemon
+// filed it under before it named services by the registry, or the ID of
+// the entry the registry matched it to by fingerprint, e.g. after it was
+// restarted with other arguments. That entry kept its name, which the
+// record still has.
+func (s *Server) previousRecord(listener portscan.Listener, entry registry.Entry) (*storage.ServiceRecord, bool) {
+	if record, ok := s.store.Get(naming.ComputeIdentityHash(listener.ExePath, listener.Args)); ok {
+		return record, true
+	}
+	record, ok := s.store.GetByName(entry.Name)
+	if !ok || record.ExePath != listener.ExePath {
+		return nil, false
+	}
+	log.Printf("Service %s is back as another process, on port %d", entry.Name, listener.Port)
+	return record, true
 }
 
-// serveDashboard renders the admin dashboard HTML
-func (s *Server) serveDashboard(w http.ResponseWriter, r *http.Request) {
-	s.serveDashboardWithError(w, r, "")
+// nameConflict reports two services that wanted the same name: holder
+// keeps it and claimant was named otherwise. Open dashboards refresh both.
+func (s *Server) nameConflict(holder, claimant registry.Entry) {
+	log.Printf("Name conflict: %s stays with port %d, port %d is %s", holder.Name, holder.Port, claimant.Port, claimant.Name)
+	s.events.Publish(dashboard.Event{Type: "changed", Name: holder.Name, Port: holder.Port})
+	s.events.Publish(dashboard.Event{Type: "changed", Name: claimant.Name, Port: claimant.Port})
 }
 
-// serveDashboardWithError renders the admin dashboard with an optional error message
-func (s *Server) serveDashboardWithError(w http.ResponseWriter, r *http.Request, errorMsg string) {
+// moveService files the runtime service named oldName under newName. The
+// caller holds s.mu.
+func (s *Server) moveService(oldName, newName string) {
+	service, ok := s.services[oldName]
+	if !ok {
+		return
+	}
+	delete(s.services, oldName)
+	if result, ok := s.benches[oldName]; ok {
+		delete(s.benches, oldName)
+		s.benches[newName] = result
+	}
+	service.Name = newName
+	s.services[newName] = service
+}
+
+// attachAuxiliary lists each auxiliary endpoint under the service run by
+// the same process, or failing that from the same directory. One without
+// such a service is shown with the other listeners.
+func (s *Server) attachAuxiliary(found []auxiliaryListener, seenNames map[string]bool, seenOthers map[int]bool) {
+	attached := make(map[string][]AuxiliaryEndpoint)
+	for _, a := range found {
+		name := s.auxiliaryParent(a.listener, seenNames)
+		if name == "" {
+			seenOthers[a.listener.Port] = true
+			s.recordOther(a.listener, a.result)
+			continue
+		}
+		attached[name] = append(attached[name], AuxiliaryEndpoint{
+			Port:      a.listener.Port,
+			Kind:      a.result.Auxiliary,
+			Framework: a.result.Framework,
+		})
+	}
+
+	var changed []Service
+	s.mu.Lock()
+	for name, svc := range s.services {
+		if !slices.Equal(svc.Auxiliary, attached[name]) {
+			svc.Auxiliary = attached[name]
+			changed = append(changed, *svc)
+		}
+	}
+	s.mu.Unlock()
+	for _, svc := range changed {
+		s.events.Publish(dashboard.Event{Type: "changed", Name: svc.Name, Port: svc.Port, Probe: svc.LastProbe})
+	}
+}
+
+// auxiliaryParent returns the name of the service seen this scan that an
+// auxiliary listener belongs to, or ""
+func (s *Server) auxiliaryParent(listener portscan.Listener, seenNames map[string]bool) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sameDir := ""
+	for name, svc := range s.services {
+		if !seenNames[name] {
+			continue
+		}
+		if svc.PID == listener.PID {
+			return name
+		}
+		if svc.Cwd != "" && svc.Cwd == listener.Cwd && (sameDir == "" || name < sameDir) {
+			sameDir = name
+		}
+	}
+	return sameDir
+}
+
+// appsInterval is how often attachApps looks again, as it reads the admin
+// APIs of reverse proxies and probes their virtual hosts
+const appsInterval = 30 * time.Second
+
+// attachApps lists under each reverse proxy among the services seen this
+// scan, found is their findings by name, the apps it serves, every
+// appsInterval. The registry names them as it does for list: an app keeps
+// its name while its proxy serves it, and a new one is named after its
+// Host or path prefix (see registry.ObserveRoutes).
+func (s *Server) attachApps(cfg *config.Config, opts probe.ProbeOptions, found map[string]scan.Finding) {
+	if time.Since(s.appsFound) < appsInterval {
+		return
+	}
+	s.appsFound = time.Now()
+
+	type proxied struct {
+		name, host string
+		port       int
+		result     probe.ProbeResult
+		apps       []App
+	}
+	var candidates []proxied
 	s.mu.RLock()
-	services := make([]*Service, 0, len(s.services))
+	for name, svc := range s.services {
+		if _, ok := found[name]; ok && svc.LastProbe != nil {
+			candidates = append(candidates, proxied{name, svc.TargetHost, svc.Port, *svc.LastProbe, svc.Apps})
+		}
+	}
+	s.mu.RUnlock()
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].name < candidates[j].name })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	finder := probe.NewRouteFinder(cfg.RouteOptions(opts))
+	proxies := make(map[string]probe.ReverseProxy)
+	apps := make(map[string][]App)
+	for _, c := range candidates {
+		var routes []probe.Route
+		if proxies[c.name], routes = finder.Find(ctx, c.host, c.port, c.result); len(routes) == 0 {
+			continue
+		}
+		entries, err := s.registry.ObserveRoutes(found[c.name], routes)
+		if err != nil {
+			log.Printf("Registry: failed to register the apps behind %s: %v", c.name, err)
+			apps[c.name] = c.apps
+			continue
+		}
+		known := make(map[string]bool)
+		for _, app := range c.apps {
+			known[app.Name] = true
+		}
+		for _, e := range entries {
+			if !known[e.Name] {
+				log.Printf("New app behind %s: %s -> %s", c.name, e.Name, *e.Route)
+			}
+			apps[c.name] = append(apps[c.name], App{Name: e.Name, Route: *e.Route})
+		}
+	}
+
+	s.mu.Lock()
+	var changed []Service
+	for _, c := range candidates {
+		svc, ok := s.services[c.name]
+		if ok && (svc.Proxy != proxies[c.name] || !slices.Equal(svc.Apps, apps[c.name])) {
+			svc.Proxy, svc.Apps = proxies[c.name], apps[c.name]
+			changed = append(changed, *svc)
+		}
+	}
+	s.mu.Unlock()
+	for _, svc := range changed {
+		s.events.Publish(dashboard.Event{Type: "changed", Name: svc.Name, Port: svc.Port, Probe: svc.LastProbe})
+	}
+}
+
+// app returns the app named name and the reverse proxy service it is
+// behind. The caller holds s.mu.
+func (s *Server) app(name string) (*Service, App, bool) {
 	for _, svc := range s.services {
-		services = append(services, svc)
+		for _, app := range svc.Apps {
+			if app.Name == name {
+				return svc, app, true
+			}
+		}
+	}
+	return nil, App{}, false
+}
+
+// probeChanged reports whether a service answers differently enough for
+// open dashboards to refresh
+func probeChanged(old, cur probe.ProbeResult) bool {
+	return old.StatusCode != cur.StatusCode || old.Title != cur.Title || old.Framework != cur.Framework
+}
+
+// protocolLabel names the protocol of a probed listener for metrics:
+// "https", "h2c" or "http/1" for web services, the fingerprinted kind or
+// "unknown" for the rest
+func protocolLabel(result probe.ProbeResult) string {
+	switch {
+	case result.IsTLS && result.IsHTTP:
+		return "https"
+	case result.Protocol != probe.ProtocolUnknown:
+		return string(result.Protocol)
+	case result.IsHTTP:
+		return string(probe.ProtocolHTTP1)
+	case result.Kind != probe.ServiceUnknown:
+		return string(result.Kind)
+	}
+	return "unknown"
+}
+
+// servicePort returns the port of an active service, for DNS TXT and SRV
+// answers
+func (s *Server) servicePort(name string) (int, bool) {
+	s.mu.RLock()
+	svc, ok := s.services[name]
+	if !ok {
+		// An app answers on the port of its reverse proxy
+		svc, _, ok = s.app(name)
 	}
+	pinnedPort, pinned := s.cfg.Names[name]
 	s.mu.RUnlock()
+	if !ok {
+		return pinnedPort, pinned
+	}
+	if record, ok := s.store.Get(svc.ID); !ok || !record.IsActive {
+		return 0, false
+	}
+	return svc.Port, true
+}
+
+// advertise keeps the mDNS registrations in step with the active services
+func (s *Server) advertise() {
+	if s.mdns == nil {
+		return
+	}
+
+	active := make(map[string]string)
+	s.mu.RLock()
+	port := s.proxyPort
+	for name, svc := range s.services {
+		if record, ok := s.store.Get(svc.ID); ok && record.IsActive {
+			active[strings.TrimSuffix(name, ".localhost")] = name
+			for _, app := range svc.Apps {
+				active[strings.TrimSuffix(app.Name, ".localhost")] = app.Name
+			}
+		}
+	}
+	s.mu.RUnlock()
+
+	for mdnsName := range active {
+		// Remote clients reach services through this daemon's proxy
+		s.mdns.Register(mdns.Service{Name: mdnsName, Port: port, Text: []string{"path=/"}})
+	}
+	s.mu.Lock()
+	for mdnsName := range s.advertised {
+		if _, ok := active[mdnsName]; !ok {
+			s.mdns.Unregister(mdnsName)
+		}
+	}
+	s.advertised = active
+	s.mu.Unlock()
+}
+
+// Lookup implements proxy.Routes over the discovered services
+func (s *Server) Lookup(host string) (proxy.Route, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	// name.local comes from mDNS, possibly renamed after a conflict
+	if s.mdns != nil && strings.HasSuffix(host, ".local") {
+		if mdnsName, ok := s.mdns.Lookup(host); ok {
+			host = s.advertised[mdnsName]
+		}
+	}
+	service, ok := s.services[host]
+	if !ok {
+		if service, app, ok := s.app(host); ok {
+			return s.appRoute(service, app), true
+		}
+		// A name pinned in the config routes to its port even before a
+		// service there has been discovered
+		if port, pinned := s.cfg.Names[host]; pinned {
+			return proxy.Route{Name: host, Port: port, Rewrite: s.cfg.Rewrite.For(host)}, true
+		}
+		return proxy.Route{}, false
+	}
+	route := serviceRoute(service)
+	route.Rewrite = s.cfg.Rewrite.For(route.Name)
+	return route, true
+}
+
+// serviceRoute is the route to a service, talking to it the way its last
+// probe found it supports
+func serviceRoute(service *Service) proxy.Route {
+	route := proxy.Route{Name: service.Name, TargetHost: service.TargetHost, Port: service.Port}
+	if last := service.LastProbe; last != nil {
+		route.TLS = last.IsTLS
+		route.HTTP2 = last.IsTLS && slices.Contains(last.SupportedVersions, probe.VersionH2)
+		// Only a probe that went looking can tell keep-alive is refused
+		route.NoKeepAlive = len(last.SupportedVersions) > 0 && !last.KeepAlive
+	}
+	return route
+}
 
-	data := struct {
-		Services []*Service
-		ErrorMsg string
-		Hostname string
-	}{
-		Services: services,
-		ErrorMsg: errorMsg,
-		Hostname: r.Host,
+// appRoute is the route to an app: to its reverse proxy, sending the Host
+// and path prefix the proxy routes it by, then rewriting by the app's
+// [rewrite] rules. The caller holds s.mu.
+func (s *Server) appRoute(service *Service, app App) proxy.Route {
+	route := serviceRoute(service)
+	route.Name = app.Name
+	var via []string
+	if app.Route.Host != "" {
+		via = append(via, "host "+app.Route.Host)
+	}
+	if app.Route.Path != "" {
+		via = append(via, "prefix / "+app.Route.Path+"/")
+	}
+	for _, spec := range via {
+		action, err := rewrite.ParseAction(spec)
+		if err != nil {
+			log.Printf("Route to %s: %v", app.Name, err)
+			continue
+		}
+		route.Rewrite = append(route.Rewrite, action)
 	}
+	route.Rewrite = append(route.Rewrite, s.cfg.Rewrite.For(app.Name)...)
+	return route
+}
 
-	tmpl := template.Must(template.New("dashboard").Parse(dashboardHTML))
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	if err := tmpl.Execute(w, data); err != nil {
-		log.Printf("Template error: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+// List implements proxy.Routes
+func (s *Server) List() []proxy.Route {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	routes := make([]proxy.Route, 0, len(s.services))
+	for _, service := range s.services {
+		routes = append(routes, serviceRoute(service))
+		for _, app := range service.Apps {
+			routes = append(routes, s.appRoute(service, app))
+		}
+	}
+	for name, port := range s.cfg.Names {
+		if _, ok := s.services[name]; !ok {
+			routes = append(routes, proxy.Route{Name: name, Port: port})
+		}
 	}
+	return routes
 }
 
-// handleAPIServices returns JSON list of services with health status
+// observeHealth scores one more probe of a service, from scratch when it
+// was just (re)activated. changed is the new score when its state moved.
+func observeHealth(previous *health.Score, result probe.ProbeResult, t health.Thresholds, now time.Time, restart bool) (score, changed *health.Score) {
+	var s health.Score
+	if previous != nil && !restart {
+		s = *previous
+	}
+	next := s.Observe(result, t, now)
+	if next.State != s.State && s.State != health.StateUnknown {
+		changed = &next
+	}
+	return &next, changed
+}
+
+// serviceStatus builds the API view of svc. The caller holds s.mu.
+func (s *Server) serviceStatus(svc *Service) output.Service {
+	status := output.Service{
+		Service: s.listed(svc),
+		ID:      svc.ID,
+		Hidden:  s.hidden[svc.Port],
+		URL:     s.serviceURL(svc.Name),
+		Score:   svc.Health,
+	}
+	var lastSeen time.Time
+	if record, ok := s.store.Get(svc.ID); ok {
+		status.Active = record.IsActive
+		status.Keep = record.Keep
+		lastSeen = record.LastSeen
+	}
+	if status.Active {
+		status.LANURL, _ = s.lanURL(svc)
+	} else {
+		// As list shows a service that is down
+		status.Finding.State = scan.StateClosed
+		status.LastSeen = &lastSeen
+	}
+	_, status.Shared = s.shares.Get(svc.Name)
+	if actions := s.cfg.Rewrite.For(svc.Name); len(actions) > 0 {
+		status.Rewrites = actions.Strings()
+	}
+	if status.Active && svc.LastProbe != nil {
+		last := svc.LastProbe
+		status.Healthy = last.StatusCode >= 200 && last.StatusCode < 400
+		status.Protocol = protocolLabel(*last)
+		status.CertRenewable = len(status.Finding.CertIssues) > 0 && s.issuer != nil && policy.Check(svc.Name) == nil
+	}
+	return status
+}
+
+// listed is svc as list shows a service: a finding made from its last
+// probe, or only its port before one, with the process it was found with
+// and its auxiliary endpoints and apps. The caller holds s.mu.
+func (s *Server) listed(svc *Service) listing.Service {
+	f := listenerFinding(portscan.Listener{
+		Port: svc.Port, PID: svc.PID, ExePath: svc.ExePath, Args: svc.Args, Cwd: svc.Cwd,
+		Addrs: svc.Addrs, Scope: svc.Scope,
+	})
+	if svc.ExePath == "" {
+		f.Process = nil
+	}
+	if svc.LastProbe != nil {
+		f.ProbeResult = *svc.LastProbe
+		if f.IsTLS && f.Cert != nil {
+			f.CertIssues = f.Cert.Issues(svc.Name, time.Now())
+		}
+		if f.DirListing != nil {
+			f.ServedPath = (procmap.Process{Args: svc.Args, Cwd: svc.Cwd}).ServedDir()
+		}
+	}
+	f.Port = svc.Port
+	if f.Address == "" {
+		f.Address = svc.TargetHost
+	}
+	listed := listing.Service{Name: svc.Name, Finding: f, Proxy: svc.Proxy}
+	if svc.Health != nil {
+		listed.Health = svc.Health.State
+	}
+	for _, aux := range svc.Auxiliary {
+		a := scan.Finding{State: scan.StateOpen, Parent: svc.Port}
+		a.Port, a.Auxiliary, a.Framework = aux.Port, aux.Kind, aux.Framework
+		listed.Auxiliary = append(listed.Auxiliary, listing.Service{Finding: a})
+	}
+	for _, app := range svc.Apps {
+		listed.Apps = append(listed.Apps, listing.App{Name: app.Name, Route: app.Route, URL: s.serviceURL(app.Name)})
+	}
+	return listed
+}
+
+// handleAPIServices returns the services, each with the finding of its
+// last probe, as a services document. Query parameters filter it: name (substring), active,
+// healthy, port, protocol and framework.
 func (s *Server) handleAPIServices(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
+	filter, err := parseServiceFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	s.mu.RLock()
-	services := make([]*Service, 0, len(s.services))
+	result := make([]output.Service, 0, len(s.services))
 	for _, svc := range s.services {
-		services = append(services, svc)
+		if status := s.serviceStatus(svc); filter.match(status) {
+			result = append(result, status)
+		}
 	}
 	s.mu.RUnlock()
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+
+	writeDocument(w, output.KindServices, result)
+}
 
-	// Check health of each service
-	type ServiceWithHealth struct {
-		*Service
-		Healthy    bool   `json:"healthy"`
-		StatusCode int    `json:"status_code"`
-		StatusText string `json:"status_text"`
+// serviceFilter selects services in GET /api/services; zero fields match
+// anything
+type serviceFilter struct {
+	name      string
+	active    *bool
+	healthy   *bool
+	port      int
+	protocol  string
+	framework string
+}
+
+// parseServiceFilter reads a serviceFilter from query parameters
+func parseServiceFilter(query url.Values) (serviceFilter, error) {
+	filter := serviceFilter{
+		name:      strings.ToLower(query.Get("name")),
+		protocol:  strings.ToLower(query.Get("protocol")),
+		framework: strings.ToLower(query.Get("framework")),
+	}
+	for key, dst := range map[string]**bool{"active": &filter.active, "healthy": &filter.healthy} {
+		if v := query.Get(key); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return filter, fmt.Errorf("invalid %s: %q", key, v)
+			}
+			*dst = &b
+		}
 	}
+	if v := query.Get("port"); v != "" {
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid port: %q", v)
+		}
+		filter.port = port
+	}
+	return filter, nil
+}
 
-	result := make([]ServiceWithHealth, 0, len(services))
-	for _, svc := range services {
-		swh := ServiceWithHealth{
-			Service:    svc,
-			Healthy:    false,
-			StatusCode: 0,
-			StatusText: "unknown",
+// match reports whether status passes the filter
+func (f serviceFilter) match(status output.Service) bool {
+	switch {
+	case f.name != "" && !strings.Contains(status.Name, f.name),
+		f.active != nil && status.Active != *f.active,
+		f.healthy != nil && status.Healthy != *f.healthy,
+		f.port != 0 && status.Finding.Port != f.port,
+		f.protocol != "" && status.Protocol != f.protocol,
+		f.framework != "" && strings.ToLower(status.Finding.Framework) != f.framework:
+		return false
+	}
+	return true
+}
+
+// handleAPIService serves /api/services/{name}: GET returns the service
+// with its last probe, PATCH renames, hides or keeps it. Its QR code is
+// at /api/services/{name}/qr, its latency check at
+// /api/services/{name}/bench, the renewal of its certificate at
+// /api/services/{name}/cert and its recent probes at
+// /api/services/{name}/history.
+func (s *Server) handleAPIService(w http.ResponseWriter, r *http.Request) {
+	if path, ok := strings.CutSuffix(r.URL.Path, "/qr"); ok {
+		s.handleAPIServiceQR(w, r, serviceName(strings.TrimPrefix(path, "/api/services/")))
+		return
+	}
+	if path, ok := strings.CutSuffix(r.URL.Path, "/bench"); ok {
+		s.handleAPIServiceBench(w, r, serviceName(strings.TrimPrefix(path, "/api/services/")))
+		return
+	}
+	if path, ok := strings.CutSuffix(r.URL.Path, "/cert"); ok {
+		s.handleAPIServiceCert(w, r, serviceName(strings.TrimPrefix(path, "/api/services/")))
+		return
+	}
+	if path, ok := strings.CutSuffix(r.URL.Path, "/history"); ok {
+		s.handleAPIServiceHistory(w, r, serviceName(strings.TrimPrefix(path, "/api/services/")))
+		return
+	}
+	name := serviceName(strings.TrimPrefix(r.URL.Path, "/api/services/"))
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPatch:
+		var req struct {
+			Name   *string `json:"name"`
+			Keep   *bool   `json:"keep"`
+			Hidden *bool   `json:"hidden"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if req.Name != nil && serviceName(*req.Name) != name {
+			newName, err := s.renameService(name, *req.Name)
+			if err != nil {
+				writeServiceError(w, err)
+				return
+			}
+			name = newName
 		}
+		if req.Keep != nil {
+			if err := s.setKeep(name, *req.Keep); err != nil {
+				writeServiceError(w, err)
+				return
+			}
+		}
+		if req.Hidden != nil {
+			s.mu.RLock()
+			svc, ok := s.services[name]
+			s.mu.RUnlock()
+			if !ok {
+				writeServiceError(w, errServiceNotFound)
+				return
+			}
+			s.setHidden(svc.Port, *req.Hidden)
+		}
+	default:
+		w.Header().Set("Allow", "GET, PATCH")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.writeService(w, name)
+}
 
-		// Quick health check
-		client := &http.Client{Timeout: 2 * time.Second}
-		targetHost := svc.TargetHost
-		if targetHost == "" {
-			targetHost = "127.0.0.1"
+// writeService answers with the service named name
+func (s *Server) writeService(w http.ResponseWriter, name string) {
+	s.mu.RLock()
+	svc, ok := s.services[name]
+	var status output.Service
+	if ok {
+		status = s.serviceStatus(svc)
+	}
+	s.mu.RUnlock()
+	if !ok {
+		writeServiceError(w, errServiceNotFound)
+		return
+	}
+	writeDocument(w, output.KindService, status)
+}
+
+// handleAPIServiceHistory serves /api/services/{name}/history: GET returns
+// the service's recent probes, oldest first
+func (s *Server) handleAPIServiceHistory(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.mu.RLock()
+	svc, ok := s.services[name]
+	var id string
+	if ok {
+		id = svc.ID
+	}
+	s.mu.RUnlock()
+	if !ok {
+		writeServiceError(w, errServiceNotFound)
+		return
+	}
+	samples, err := s.history.Samples(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if samples == nil {
+		samples = []registry.Sample{}
+	}
+	writeDocument(w, output.KindHistory, output.History{Name: name, Samples: samples})
+}
+
+// Bounds on the benches API clients may ask for, so the dashboard's button
+// stays a quick check
+const (
+	maxBenchRequests    = 1000
+	maxBenchConcurrency = 16
+)
+
+// handleAPIServiceBench serves /api/services/{name}/bench: POST sends the
+// service a burst of requests, {"requests": 50, "concurrency": 4, "path":
+// "/"} or fewer fields, and returns the result, which GET then returns
+// until the next one. Only one bench runs at a time.
+func (s *Server) handleAPIServiceBench(w http.ResponseWriter, r *http.Request, name string) {
+	switch r.Method {
+	case http.MethodGet:
+		s.mu.RLock()
+		result, ok := s.benches[name]
+		s.mu.RUnlock()
+		if !ok {
+			http.Error(w, "No bench of "+name+" yet", http.StatusNotFound)
+			return
 		}
-		resp, err := client.Get(fmt.Sprintf("http://%s:%d", targetHost, svc.Port))
-		if err != nil {
-			swh.StatusText = "offline"
-		} else {
-			resp.Body.Close()
-			swh.StatusCode = resp.StatusCode
-			swh.StatusText = resp.Status
-			// Consider healthy if status is 2xx or 3xx
-			swh.Healthy = resp.StatusCode >= 200 && resp.StatusCode < 400
+		writeDocument(w, output.KindBench, result)
+		return
+	case http.MethodPost:
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Requests    int    `json:"requests"`
+		Concurrency int    `json:"concurrency"`
+		Path        string `json:"path"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
 		}
+	}
+	if req.Requests < 0 || req.Requests > maxBenchRequests || req.Concurrency < 0 || req.Concurrency > maxBenchConcurrency {
+		http.Error(w, fmt.Sprintf("requests must be at most %d and concurrency at most %d", maxBenchRequests, maxBenchConcurrency), http.StatusBadRequest)
+		return
+	}
+	if req.Path != "" && !strings.HasPrefix(req.Path, "/") {
+		http.Error(w, "path must start with /", http.StatusBadRequest)
+		return
+	}
 
-		result = append(result, swh)
+	s.mu.RLock()
+	svc, ok := s.services[name]
+	var host string
+	var port int
+	var isTLS bool
+	if ok {
+		host, port = svc.TargetHost, svc.Port
+		isTLS = svc.LastProbe != nil && svc.LastProbe.IsTLS
 	}
+	s.mu.RUnlock()
+	if !ok {
+		writeServiceError(w, errServiceNotFound)
+		return
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	if !s.benchMu.TryLock() {
+		http.Error(w, "Another bench is running", http.StatusConflict)
+		return
+	}
+	defer s.benchMu.Unlock()
+
+	cfg := s.config()
+	result, err := probe.Bench(r.Context(), host, port, probe.BenchOptions{
+		Requests: req.Requests, Concurrency: req.Concurrency, Path: req.Path, TLS: isTLS,
+		Probe: probe.ProbeOptions{DialTimeout: cfg.Probe.DialTimeout, ReadTimeout: 5 * time.Second, Headers: cfg.Probe.Headers, Credentials: cfg.Auth.Credentials(s.jar, name, port), ClientCert: s.probeClientCert()},
+	})
+	if errors.Is(err, probe.ErrNotLoopback) {
+		http.Error(w, "Only services on this machine can be benched: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	s.benches[name] = result
+	s.mu.Unlock()
+	writeDocument(w, output.KindBench, result)
+}
 
+// handleAPIServiceCert serves /api/services/{name}/cert: POST mints the
+// service a fresh certificate from the local CA, which the HTTPS listener
+// serves it with from then on, in front of a backend whose own certificate
+// browsers refuse. The backend may use the files too.
+func (s *Server) handleAPIServiceCert(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.mu.RLock()
+	_, ok := s.services[name]
+	certs := s.issuer
+	s.mu.RUnlock()
+	if !ok {
+		writeServiceError(w, errServiceNotFound)
+		return
+	}
+	if certs == nil {
+		http.Error(w, "HTTPS is off: start the daemon with -tls", http.StatusConflict)
+		return
+	}
+	cert, err := certs.Issue(issuer.IssueRequest{DNSNames: []string{name}})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("TLS: renewed the certificate of %s, valid until %s", name, cert.NotAfter.Format(time.RFC3339))
+	writeDocument(w, output.KindCert, output.Cert{
+		Name:     name,
+		URL:      s.httpsURL(name),
+		Serial:   cert.Serial,
+		NotAfter: cert.NotAfter,
+		CertPath: cert.CertPath,
+		KeyPath:  cert.KeyPath,
+	})
+}
+
+// handleAPIServiceQR answers with a PNG QR code of the URL other devices
+// on the LAN open the service at, directly or through its share, for the
+// dashboard's "open on phone"; or 409 Conflict if they can't reach it
+func (s *Server) handleAPIServiceQR(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.mu.RLock()
+	svc, ok := s.services[name]
+	var link string
+	var err error
+	if ok {
+		link, err = s.lanURL(svc)
+	}
+	s.mu.RUnlock()
+	if _, shared := s.shares.Get(name); errors.Is(err, lan.ErrLoopbackOnly) && shared {
+		link, err = s.shareURL(name)
+	}
+	switch {
+	case !ok:
+		writeServiceError(w, errServiceNotFound)
+		return
+	case errors.Is(err, lan.ErrLoopbackOnly):
+		http.Error(w, name+" only listens on loopback and isn't shared, so other devices can't reach it", http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, "No LAN address for "+name+": "+err.Error(), http.StatusConflict)
+		return
+	}
+
+	code, err := qr.Encode(link)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-cache")
+	code.WritePNG(w, 8)
+}
+
+// lanURL is where other devices on the LAN reach svc directly, not
+// through the proxy. The caller holds s.mu.
+func (s *Server) lanURL(svc *Service) (string, error) {
+	host, err := lan.Host(svc.Scope, svc.Addrs)
+	if err != nil {
+		return "", err
+	}
+	scheme := "http"
+	if svc.LastProbe != nil && svc.LastProbe.IsTLS {
+		scheme = "https"
+	}
+	return lan.URL(scheme, host, svc.Port), nil
+}
+
+// writeDocument answers with data as a document of kind, as the CLI prints
+// it with --output json
+func writeDocument(w http.ResponseWriter, kind output.Kind, data any) {
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(result)
+	if err := output.Write(w, kind, data); err != nil {
+		log.Printf("Failed to write %s document: %v", kind, err)
+	}
+}
+
+// errServiceNotFound is returned for a name no service has
+var errServiceNotFound = errors.New("service not found")
+
+// writeServiceError answers with the status matching err
+func writeServiceError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errServiceNotFound):
+		http.Error(w, "Service not found", http.StatusNotFound)
+	case errors.Is(err, registry.ErrNameTaken):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// serviceName completes a name given without the .localhost suffix
+func serviceName(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".localhost") {
+		name += ".localhost"
+	}
+	return name
+}
+
+// serviceURL is the address a service is reached at through the proxy
+func (s *Server) serviceURL(name string) string {
+	if s.proxyPort == 80 {
+		return fmt.Sprintf("http://%s/", name)
+	}
+	return fmt.Sprintf("http://%s:%d/", name, s.proxyPort)
 }
 
-// handleAPIRename handles rename requests
+// handleAPIRename handles rename requests, answering with the renamed
+// service
 func (s *Server) handleAPIRename(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -389,43 +2077,165 @@ func (s *Server) handleAPIRename(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	name, err := s.renameService(req.OldName, req.NewName)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	s.writeService(w, name)
+}
+
+// renameService gives a service a new name, adding the .localhost suffix
+// if it is missing, and returns the name it now has
+func (s *Server) renameService(oldName, newName string) (string, error) {
 	// Ensure .localhost suffix
-	if !strings.HasSuffix(req.NewName, ".localhost") {
-		req.NewName = req.NewName + ".localhost"
+	if !strings.HasSuffix(newName, ".localhost") {
+		newName = newName + ".localhost"
 	}
 
 	// Find service by old name
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	var service *Service
+	service, ok := s.services[oldName]
+	if !ok {
+		return "", errServiceNotFound
+	}
+
+	// The registry names discovered services; manual ones are only in
+	// the store
+	if other, taken := s.store.GetByName(newName); taken && other.ID != service.ID {
+		return "", fmt.Errorf("%w: %s", registry.ErrNameTaken, newName)
+	}
+	if _, ok := s.registry.Get(oldName); ok {
+		if err := s.registry.Rename(oldName, newName); err != nil {
+			return "", err
+		}
+	}
+	if err := s.store.UpdateName(service.ID, newName); err != nil {
+		return "", err
+	}
+	s.moveService(oldName, newName)
+
+	log.Printf("Renamed %s -> %s", oldName, newName)
+	s.events.Publish(dashboard.Event{Type: "renamed", Name: newName, Port: service.Port})
+	return newName, nil
+}
+
+// probeListener probes a listener at host. The service already known to
+// run there is rechecked over a connection kept alive since the last scan,
+// when it allows one.
+func (s *Server) probeListener(host string, listener portscan.Listener, opts probe.ProbeOptions) probe.ProbeResult {
+	var last *probe.ProbeResult
+	s.mu.RLock()
 	for _, svc := range s.services {
-		if svc.Name == req.OldName {
-			service = svc
+		if svc.Port == listener.Port && svc.PID == listener.PID && svc.TargetHost == host && svc.LastProbe != nil {
+			last = svc.LastProbe
 			break
 		}
 	}
+	s.mu.RUnlock()
+	if last == nil {
+		return probe.ProbeWithOptions(host, listener.Port, opts)
+	}
+	return probe.Recheck(context.Background(), host, listener.Port, *last, s.probePool, opts)
+}
 
-	if service == nil {
-		http.Error(w, "Service not found", http.StatusNotFound)
+// probeCredentials returns what the [auth] rules of the config have the
+// service of f, a listener's finding, probed with, matched by the name it
+// is registered under or pinned to and by its port. A service seen for the
+// first time has no name yet, so only port rules apply to its first probe.
+func (s *Server) probeCredentials(cfg *config.Config, f scan.Finding) *probe.Credentials {
+	if len(cfg.Auth) == 0 {
+		return nil
+	}
+	name, _ := cfg.PinnedName(f.Port)
+	if record, ok := s.store.Get(f.Identity()); ok {
+		name = record.Name
+	}
+	return cfg.Auth.Credentials(s.jar, name, f.Port)
+}
+
+// keepCookies saves the cookies a service set in an answer through the
+// proxy to the jar, when the [auth] rules have it probed with them. The
+// values are never logged.
+func (s *Server) keepCookies(route proxy.Route, cookies []*http.Cookie) {
+	rule, ok := s.config().Auth.Find(route.Name, route.Port)
+	if !ok || !rule.Cookies {
+		return
+	}
+	had := len(s.jar.Cookies(route.Name))
+	kept, err := s.jar.Update(route.Name, cookies)
+	if err != nil {
+		log.Printf("Failed to keep the cookies of %s: %v", route.Name, err)
 		return
 	}
+	if had == 0 && kept > 0 {
+		log.Printf("Keeping the session cookies of %s for probing", route.Name)
+	}
+}
 
-	// Update in store
-	if err := s.store.UpdateName(service.ID, req.NewName); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+// recordOther tracks a listener that isn't HTTP, logging it the first time
+// it is seen on a port
+func (s *Server) recordOther(listener portscan.Listener, result probe.ProbeResult) {
+	other := &output.Listener{
+		Port:    listener.Port,
+		PID:     listener.PID,
+		ExePath: listener.ExePath,
+		Scope:   listener.Scope,
+		State:   result.State,
+		Hint:    result.Hint,
+
+		GRPCServices: result.GRPCServices,
+	}
+	if result.Cert != nil {
+		other.AcceptableCAs = result.Cert.AcceptableCAs
+	}
+	switch {
+	case result.ClientCertRequired:
+		other.Kind = "TLS (client cert required)"
+	case result.Auxiliary != probe.AuxiliaryNone:
+		other.Kind = string(result.Auxiliary)
+	case result.Kind != probe.ServiceUnknown:
+		other.Kind = string(result.Kind)
+	case result.Protocol != probe.ProtocolUnknown:
+		other.Kind = string(result.Protocol)
+	}
+
+	s.mu.Lock()
+	_, known := s.others[listener.Port]
+	s.others[listener.Port] = other
+	s.mu.Unlock()
+	if known {
 		return
 	}
 
-	// Update in memory
-	delete(s.services, service.Name)
-	service.Name = req.NewName
-	s.services[service.Name] = service
+	what := "it isn't HTTP"
+	switch {
+	case other.Kind != "":
+		what = "it speaks " + other.Kind
+	case other.Hint != "":
+		what = "it isn't HTTP — possibly " + other.Hint
+	}
+	log.Printf("Something is listening on %d (%s) but %s", listener.Port, listener.ExePath, what)
+}
 
-	log.Printf("Renamed %s -> %s", req.OldName, req.NewName)
+// handleAPIListeners returns the listening ports that aren't HTTP services
+func (s *Server) handleAPIListeners(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	s.mu.RLock()
+	others := make([]*output.Listener, 0, len(s.others))
+	for _, other := range s.others {
+		others = append(others, other)
+	}
+	s.mu.RUnlock()
+	sort.Slice(others, func(i, j int) bool { return others[i].Port < others[j].Port })
+
+	writeDocument(w, output.KindListeners, others)
 }
 
 // handleAPIBlacklist handles blacklist requests
@@ -449,14 +2259,10 @@ func (s *Server) handleAPIBlacklist(w http.ResponseWriter, r *http.Request) {
 	// For now, just log and return success
 	log.Printf("Blacklist request: %s = %s", req.Type, req.Value)
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{
-		"status":  "ok",
-		"message": fmt.Sprintf("Blacklisted %s: %s", req.Type, req.Value),
-	})
+	writeDocument(w, output.KindBlacklist, output.Blacklist{Type: req.Type, Value: req.Value})
 }
 
-// handleAPIKeep handles keep status updates
+// handleAPIKeep handles keep status updates, answering with the service
 func (s *Server) handleAPIKeep(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -473,553 +2279,416 @@ func (s *Server) handleAPIKeep(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Find the service
-	s.mu.Lock()
-	var service *Service
-	for _, svc := range s.services {
-		if svc.Name == req.Name {
-			service = svc
-			break
+	if err := s.setKeep(req.Name, req.Keep); err != nil {
+		if errors.Is(err, errServiceNotFound) {
+			writeServiceError(w, err)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
+		return
 	}
-	s.mu.Unlock()
+	s.writeService(w, req.Name)
+}
 
-	if service == nil {
-		http.Error(w, "Service not found", http.StatusNotFound)
-		return
+// setKeep sets whether a service stays listed while it isn't running
+func (s *Server) setKeep(name string, keep bool) error {
+	s.mu.RLock()
+	service, ok := s.services[name]
+	s.mu.RUnlock()
+	if !ok {
+		return errServiceNotFound
 	}
 
 	// Update in store
 	if record, ok := s.store.Get(service.ID); ok {
-		record.Keep = req.Keep
+		record.Keep = keep
 		if err := s.store.Save(record); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return fmt.Errorf("failed to save service: %w", err)
+		}
+	}
+
+	log.Printf("Updated keep status for %s: %v", name, keep)
+	return nil
+}
+
+// handleAPIHide hides a port from the dashboard, or shows it again, and
+// answers with the hidden ports. Hidden ports aren't probed or proxied
+// until the daemon restarts.
+func (s *Server) handleAPIHide(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Port   int  `json:"port"`
+		Hidden bool `json:"hidden"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Port < 1 || req.Port > 65535 {
+		http.Error(w, "Invalid port", http.StatusBadRequest)
+		return
+	}
+
+	s.setHidden(req.Port, req.Hidden)
+	writeDocument(w, output.KindHidden, s.hiddenPorts())
+}
+
+// setHidden hides a port from the dashboard, or shows it again, and scans
+// at once so the change shows
+func (s *Server) setHidden(port int, hidden bool) {
+	s.mu.Lock()
+	if hidden {
+		s.hidden[port] = true
+		delete(s.others, port)
+	} else {
+		delete(s.hidden, port)
+	}
+	s.mu.Unlock()
+
+	log.Printf("Updated hidden status for port %d: %v", port, hidden)
+	s.events.Publish(dashboard.Event{Type: "hidden", Port: port})
+	s.requestScan()
+}
+
+// handleAPIHidden returns the hidden ports
+func (s *Server) handleAPIHidden(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeDocument(w, output.KindHidden, s.hiddenPorts())
+}
+
+// hiddenPorts returns the hidden ports in order
+func (s *Server) hiddenPorts() []int {
+	s.mu.RLock()
+	ports := make([]int, 0, len(s.hidden))
+	for port := range s.hidden {
+		ports = append(ports, port)
+	}
+	s.mu.RUnlock()
+	sort.Ints(ports)
+	return ports
+}
+
+// handleAPIAccess returns the latest requests through the proxy, newest
+// first: ?service=api for one service's, ?limit=N for at most N (default
+// 100, 0 for all kept)
+func (s *Server) handleAPIAccess(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	service := r.URL.Query().Get("service")
+	if service != "" {
+		service = serviceName(service)
+	}
+
+	writeDocument(w, output.KindAccess, s.access.Recent(service, limit))
+}
+
+// errSharingDisabled is returned for shares when -share-listen is empty
+var errSharingDisabled = errors.New("LAN sharing is disabled (-share-listen is empty)")
+
+// shareRequest is the body of POST /api/shares
+type shareRequest struct {
+	Name     string `json:"name"`
+	Token    bool   `json:"token"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+	Idle     string `json:"idle"` // A duration such as "30m", "0" or "" for the default, negative for never
+}
+
+// handleAPIShares serves /api/shares: GET lists the shares, POST shares a
+// service and returns a link to it
+func (s *Server) handleAPIShares(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeDocument(w, output.KindShares, output.NewShares(s.shares.List()))
+		return
+	case http.MethodPost:
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req shareRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	opts := share.Options{Token: req.Token, User: req.User, Password: req.Password}
+	if req.Idle != "" {
+		idle, err := time.ParseDuration(req.Idle)
+		if err != nil {
+			http.Error(w, "Invalid idle duration: "+req.Idle, http.StatusBadRequest)
 			return
 		}
+		opts.Idle = idle
+	}
+	if (opts.User == "") != (opts.Password == "") {
+		http.Error(w, "Basic auth needs both a user and a password", http.StatusBadRequest)
+		return
+	}
+	name := serviceName(req.Name)
+	// The scanner updates the service under s.mu, so only what is read
+	// here, while holding it, is used after
+	s.mu.RLock()
+	svc, ok := s.services[name]
+	onLAN := ok && svc.Scope == procmap.ScopeAllInterfaces
+	var direct string
+	if onLAN {
+		direct, _ = s.lanURL(svc)
+	}
+	s.mu.RUnlock()
+	if !ok {
+		writeServiceError(w, errServiceNotFound)
+		return
+	}
+	// Sharing one that is bound to every interface would expose it twice,
+	// the second time looking like it was only reachable through the share
+	if onLAN {
+		msg := name + " is already reachable from the LAN, as it listens on all interfaces"
+		if direct != "" {
+			msg += ", at " + direct
+		}
+		http.Error(w, msg+"; bind it to 127.0.0.1 to share it with a token or password", http.StatusConflict)
+		return
+	}
+	if err := s.startLAN(); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
 	}
 
-	log.Printf("Updated keep status for %s: %v", req.Name, req.Keep)
-
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
-}
-
-// dashboardHTML is the admin dashboard template
-const dashboardHTML = `<!DOCTYPE html>
-<html lang="en">
-<head>
-    <meta charset="UTF-8">
-    <meta name="viewport" content="width=device-width, initial-scale=1.0">
-    <title>localhost-magic</title>
-    <style>
-        * { box-sizing: border-box; margin: 0; padding: 0; }
-        body {
-            font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, 'Helvetica Neue', Arial, sans-serif;
-            background: #fff;
-            color: #333;
-            line-height: 1.5;
-            padding: 40px 20px;
-        }
-        .container {
-            max-width: 1200px;
-            margin: 0 auto;
-        }
-        header {
-            text-align: center;
-            margin-bottom: 40px;
-        }
-        header h1 {
-            font-size: 2em;
-            font-weight: 600;
-            color: #1a1a1a;
-            margin-bottom: 8px;
-        }
-        header p {
-            color: #666;
-            font-size: 0.95em;
-        }
-        .card {
-            background: #fff;
-            border: 1px solid #e0e0e0;
-            box-shadow: 0 1px 3px rgba(0,0,0,0.05);
-        }
-        .card-header {
-            padding: 20px 24px;
-            border-bottom: 1px solid #e0e0e0;
-            background: #fafafa;
-        }
-        .card-header h2 {
-            font-size: 1.1em;
-            font-weight: 600;
-            color: #1a1a1a;
-        }
-        table {
-            width: 100%;
-            border-collapse: collapse;
-            font-size: 0.9em;
-        }
-        th {
-            text-align: left;
-            padding: 12px 24px;
-            font-weight: 600;
-            color: #555;
-            font-size: 0.75em;
-            text-transform: uppercase;
-            letter-spacing: 0.5px;
-            border-bottom: 1px solid #e0e0e0;
-            background: #fafafa;
-        }
-        td {
-            padding: 14px 24px;
-            border-bottom: 1px solid #f0f0f0;
-            vertical-align: middle;
-        }
-        tr:hover {
-            background: #fafafa;
-        }
-        tr.inactive {
-            opacity: 0.5;
-        }
-        .name-cell {
-            display: flex;
-            align-items: center;
-            gap: 10px;
-        }
-        .status-dot {
-            width: 10px;
-            height: 10px;
-            border-radius: 50%;
-            flex-shrink: 0;
-        }
-        .status-dot.ok { background: #4caf50; }
-        .status-dot.warning { background: #ff9800; }
-        .status-dot.error { background: #f44336; }
-        .status-dot.offline { background: #9e9e9e; }
-        .service-link {
-            color: #2196f3;
-            text-decoration: none;
-            font-weight: 500;
-        }
-        .service-link:hover {
-            text-decoration: underline;
-        }
-        .service-link.inactive {
-            color: #999;
-        }
-        .btn-icon {
-            background: none;
-            border: none;
-            cursor: pointer;
-            padding: 2px 4px;
-            font-size: 0.85em;
-            opacity: 0.5;
-            transition: opacity 0.2s;
-        }
-        .btn-icon:hover {
-            opacity: 1;
-        }
-        .status-badge {
-            display: inline-block;
-            padding: 4px 10px;
-            font-size: 0.8em;
-            font-weight: 500;
-            border-radius: 3px;
-        }
-        .status-badge.ok {
-            background: #e8f5e9;
-            color: #2e7d32;
-        }
-        .status-badge.warning {
-            background: #fff3e0;
-            color: #ef6c00;
-        }
-        .status-badge.error {
-            background: #ffebee;
-            color: #c62828;
-        }
-        .status-badge.offline {
-            background: #f5f5f5;
-            color: #616161;
-        }
-        .command {
-            font-family: 'Monaco', 'Menlo', 'Courier New', monospace;
-            font-size: 0.8em;
-            color: #555;
-            background: #f5f5f5;
-            padding: 4px 8px;
-            border-radius: 3px;
-            max-width: 400px;
-            overflow: hidden;
-            text-overflow: ellipsis;
-            white-space: nowrap;
-        }
-        .keep-checkbox {
-            display: flex;
-            align-items: center;
-            gap: 6px;
-            cursor: pointer;
-            font-size: 0.85em;
-            color: #666;
-        }
-        .keep-checkbox input {
-            cursor: pointer;
-        }
-        .btn {
-            padding: 6px 14px;
-            border: 1px solid #ddd;
-            background: #fff;
-            cursor: pointer;
-            font-size: 0.8em;
-            font-weight: 500;
-            color: #555;
-            transition: all 0.2s;
-        }
-        .btn:hover {
-            background: #f5f5f5;
-            border-color: #ccc;
-        }
-        .btn-danger {
-            background: #f44336;
-            color: #fff;
-            border-color: #f44336;
-        }
-        .btn-danger:hover {
-            background: #d32f2f;
-            border-color: #d32f2f;
-        }
-        .empty-state {
-            text-align: center;
-            padding: 60px 20px;
-            color: #999;
-        }
-        .modal {
-            display: none;
-            position: fixed;
-            top: 0;
-            left: 0;
-            width: 100%;
-            height: 100%;
-            background: rgba(0,0,0,0.5);
-            z-index: 1000;
-            justify-content: center;
-            align-items: center;
-        }
-        .modal.active {
-            display: flex;
-        }
-        .modal-content {
-            background: white;
-            padding: 24px;
-            width: 90%;
-            max-width: 400px;
-            border: 1px solid #e0e0e0;
-            box-shadow: 0 4px 20px rgba(0,0,0,0.15);
-        }
-        .modal-content h3 {
-            margin-bottom: 20px;
-            font-size: 1.1em;
-        }
-        .form-group {
-            margin-bottom: 16px;
-        }
-        .form-group label {
-            display: block;
-            margin-bottom: 6px;
-            font-size: 0.85em;
-            font-weight: 500;
-            color: #555;
-        }
-        .form-group input, .form-group select {
-            width: 100%;
-            padding: 8px 12px;
-            border: 1px solid #ddd;
-            font-size: 0.9em;
-        }
-        .form-group input:focus, .form-group select:focus {
-            outline: none;
-            border-color: #2196f3;
-        }
-        .modal-actions {
-            display: flex;
-            gap: 10px;
-            justify-content: flex-end;
-            margin-top: 20px;
-        }
-    </style>
-</head>
-<body>
-    <div class="container">
-
-
-        <div class="card">
-            <div class="card-header">
-                <h2>Discovered HTTP Servers</h2>
-            </div>
-            {{if .Services}}
-            <table>
-                <thead>
-                    <tr>
-                        <th>Name</th>
-                        <th>Status</th>
-                        <th>Port</th>
-                        <th>PID</th>
-                        <th>Command</th>
-                        <th>Keep</th>
-                        <th>Actions</th>
-                    </tr>
-                </thead>
-                <tbody>
-                    {{range .Services}}
-                    <tr data-name="{{.Name}}" id="row-{{.Name}}">
-                        <td>
-                            <div class="name-cell">
-                                <span class="status-dot ok" title="Checking..."></span>
-                                http://<a href="http://{{.Name}}" class="service-link" target="_blank" id="link-{{.Name}}">{{.Name}}</a>
-                                <button class="btn-icon" onclick="openRenameModal('{{.Name}}')" title="Rename">Edit</button>
-                            </div>
-                        </td>
-                        <td>
-                            <span class="status-badge ok" data-name="{{.Name}}">HTTP</span>
-                        </td>
-                        <td>{{.Port}}</td>
-                        <td>{{.PID}}</td>
-                        <td><pre class="command">{{.ExePath}}</pre></td>
-                        <td>
-                            <label class="keep-checkbox">
-                                <input type="checkbox" id="keep-{{.Name}}" onchange="toggleKeep('{{.Name}}')">
-                                <span>Keep</span>
-                            </label>
-                        </td>
-                        <td>
-                            <button class="btn btn-danger" onclick="openBlacklistModal('{{.Name}}', {{.PID}}, '{{.ExePath}}')">Blacklist</button>
-                        </td>
-                    </tr>
-                    {{end}}
-                </tbody>
-            </table>
-            {{else}}
-            <div class="empty-state">
-                <p>No services found. Start a local HTTP server to see it here.</p>
-            </div>
-            {{end}}
-        </div>
-    </div>
-
-    <!-- Rename Modal -->
-    <div id="renameModal" class="modal">
-        <div class="modal-content">
-            <h3>Rename Service</h3>
-            <div class="form-group">
-                <label>Current Name</label>
-                <input type="text" id="currentName" readonly>
-            </div>
-            <div class="form-group">
-                <label>New Name</label>
-                <input type="text" id="newName" placeholder="myapp.localhost">
-            </div>
-            <div class="modal-actions">
-                <button class="btn" onclick="closeModal('renameModal')">Cancel</button>
-                <button class="btn" onclick="confirmRename()" style="background:#2196f3;color:#fff;border-color:#2196f3;">Rename</button>
-            </div>
-        </div>
-    </div>
-
-    <!-- Blacklist Modal -->
-    <div id="blacklistModal" class="modal">
-        <div class="modal-content">
-            <h3>Blacklist Service</h3>
-            <div class="form-group">
-                <label>Blacklist Type</label>
-                <select id="blacklistType"></select>
-            </div>
-            <div class="form-group">
-                <label>Value</label>
-                <input type="text" id="blacklistValue" readonly>
-            </div>
-            <div class="modal-actions">
-                <button class="btn" onclick="closeModal('blacklistModal')">Cancel</button>
-                <button class="btn btn-danger" onclick="confirmBlacklist()">Blacklist</button>
-            </div>
-        </div>
-    </div>
-
-    <script>
-        let currentService = {};
-        const keptServices = JSON.parse(localStorage.getItem('keptServices') || '[]');
-
-        document.addEventListener('DOMContentLoaded', () => {
-            keptServices.forEach(name => {
-                const checkbox = document.getElementById('keep-' + name);
-                if (checkbox) checkbox.checked = true;
-            });
-            fetchStatus();
-        });
-
-        function openRenameModal(name) {
-            currentService.oldName = name;
-            document.getElementById('currentName').value = name;
-            document.getElementById('newName').value = '';
-            document.getElementById('renameModal').classList.add('active');
-        }
-
-        function openBlacklistModal(name, pid, exePath) {
-            currentService = { name, pid, exePath };
-            document.getElementById('blacklistValue').value = pid;
-            
-            const typeSelect = document.getElementById('blacklistType');
-            typeSelect.innerHTML = '';
-            
-            const options = [
-                { value: 'pid', text: 'By PID (' + pid + ')' },
-                { value: 'path', text: 'By Path (' + exePath.substring(0, 50) + '...)' },
-                { value: 'pattern', text: 'By Pattern (regex)' }
-            ];
-            
-            options.forEach(opt => {
-                const option = document.createElement('option');
-                option.value = opt.value;
-                option.textContent = opt.text;
-                typeSelect.appendChild(option);
-            });
-            
-            typeSelect.onchange = function() {
-                const val = typeSelect.value;
-                if (val === 'pid') document.getElementById('blacklistValue').value = pid;
-                if (val === 'path') document.getElementById('blacklistValue').value = exePath;
-                if (val === 'pattern') document.getElementById('blacklistValue').value = '';
-                document.getElementById('blacklistValue').readOnly = (val !== 'pattern');
-            };
-            
-            document.getElementById('blacklistModal').classList.add('active');
-        }
-
-        function closeModal(modalId) {
-            document.getElementById(modalId).classList.remove('active');
-        }
-
-        function toggleKeep(name) {
-            const checkbox = document.getElementById('keep-' + name);
-            const index = keptServices.indexOf(name);
-            
-            if (checkbox.checked) {
-                if (index === -1) keptServices.push(name);
-            } else {
-                if (index > -1) keptServices.splice(index, 1);
-            }
-            
-            localStorage.setItem('keptServices', JSON.stringify(keptServices));
-        }
-
-        async function confirmRename() {
-            const newName = document.getElementById('newName').value;
-            if (!newName) return;
-
-            try {
-                const response = await fetch('/api/rename', {
-                    method: 'POST',
-                    headers: { 'Content-Type': 'application/json' },
-                    body: JSON.stringify({
-                        oldName: currentService.oldName,
-                        newName: newName
-                    })
-                });
-
-                if (response.ok) {
-                    location.reload();
-                } else {
-                    alert('Failed to rename: ' + await response.text());
-                }
-            } catch (err) {
-                alert('Error: ' + err.message);
-            }
-        }
-
-        async function confirmBlacklist() {
-            const type = document.getElementById('blacklistType').value;
-            const value = document.getElementById('blacklistValue').value;
-
-            try {
-                const response = await fetch('/api/blacklist', {
-                    method: 'POST',
-                    headers: { 'Content-Type': 'application/json' },
-                    body: JSON.stringify({ type, value })
-                });
-
-                if (response.ok) {
-                    location.reload();
-                } else {
-                    alert('Failed to blacklist: ' + await response.text());
-                }
-            } catch (err) {
-                alert('Error: ' + err.message);
-            }
-        }
-
-        document.querySelectorAll('.modal').forEach(modal => {
-            modal.addEventListener('click', (e) => {
-                if (e.target === modal) closeModal(modal.id);
-            });
-        });
-
-        async function fetchStatus() {
-            try {
-                const response = await fetch('/api/services');
-                const services = await response.json();
-                updateServiceStatuses(services);
-            } catch (err) {
-                console.error('Failed to fetch service status:', err);
-            }
-        }
-
-        setInterval(fetchStatus, 3000);
-
-        function updateServiceStatuses(services) {
-            const activeServices = new Map(services.map(s => [s.Name, s]));
-            
-            document.querySelectorAll('tr[data-name]').forEach(row => {
-                const name = row.getAttribute('data-name');
-                const service = activeServices.get(name);
-                const isKept = keptServices.includes(name);
-                
-                if (!service) {
-                    if (isKept) {
-                        row.classList.add('inactive');
-                        const link = document.getElementById('link-' + name);
-                        if (link) link.classList.add('inactive');
-                        updateStatus(row, 'offline', 'INACTIVE');
-                    } else {
-                        row.style.display = 'none';
-                    }
-                    return;
-                }
-                
-                const code = service.status_code || 0;
-                
-                if (code >= 200 && code < 400) {
-                    updateStatus(row, 'ok', code);
-                } else if (code >= 400 && code < 500) {
-                    updateStatus(row, 'warning', code);
-                } else if (code >= 500) {
-                    updateStatus(row, 'error', code);
-                } else {
-                    updateStatus(row, 'offline', 'OFFLINE');
-                }
-            });
-        }
-        
-        function updateStatus(row, statusClass, text) {
-            const dot = row.querySelector('.status-dot');
-            const badge = row.querySelector('.status-badge');
-            
-            if (dot) {
-                dot.className = 'status-dot ' + statusClass;
-            }
-            if (badge) {
-                badge.className = 'status-badge ' + statusClass;
-                badge.textContent = text;
-            }
-        }
-    </script>
-</body>
-</html>
-`
+	shared := s.shares.Add(name, opts)
+	link, err := s.shareURL(name)
+	if err != nil {
+		s.shares.Remove(name)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	log.Printf("Share: %s shared at %s", name, strings.SplitN(link, "?", 2)[0])
+	s.events.Publish(dashboard.Event{Type: "changed", Name: name})
+	writeDocument(w, output.KindShare, output.ShareLink{Share: output.NewShare(shared), URL: link})
+}
+
+// handleAPIShare serves /api/shares/{name}: GET returns the share, DELETE
+// revokes it, and POST /api/shares/{name}/link returns a new link to it
+func (s *Server) handleAPIShare(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/shares/")
+	path, wantLink := strings.CutSuffix(path, "/link")
+	name := serviceName(path)
+
+	switch {
+	case wantLink && r.Method == http.MethodPost:
+		if _, ok := s.shares.Get(name); !ok {
+			http.Error(w, "Service not shared", http.StatusNotFound)
+			return
+		}
+		link, err := s.shareURL(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		shared, _ := s.shares.Get(name)
+		writeDocument(w, output.KindShare, output.ShareLink{Share: output.NewShare(shared), URL: link})
+	case !wantLink && r.Method == http.MethodGet:
+		shared, ok := s.shares.Get(name)
+		if !ok {
+			http.Error(w, "Service not shared", http.StatusNotFound)
+			return
+		}
+		writeDocument(w, output.KindShare, output.ShareLink{Share: output.NewShare(shared)})
+	case !wantLink && r.Method == http.MethodDelete:
+		if !s.shares.Remove(name) {
+			http.Error(w, "Service not shared", http.StatusNotFound)
+			return
+		}
+		log.Printf("Share: %s no longer shared", name)
+		s.events.Publish(dashboard.Event{Type: "changed", Name: name})
+		writeDocument(w, output.KindUnshare, output.Unshare{Name: name})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// startLAN opens the LAN listener for shares, unless it is open already
+func (s *Server) startLAN() error {
+	s.shareMu.Lock()
+	defer s.shareMu.Unlock()
+	if s.shareAddr == "" {
+		return errSharingDisabled
+	}
+	if s.lan != nil {
+		return nil
+	}
+	server := proxy.NewServer(s.shares, nil)
+	if err := server.Listen(s.shareAddr, ""); err != nil {
+		return fmt.Errorf("failed to listen for shares: %w", err)
+	}
+	log.Printf("Share: listening on %s for shared services", server.Addr())
+	go func() { log.Fatal(server.Wait()) }()
+	s.lan = server
+	return nil
+}
+
+// shareURL returns a new link into the share of name, at this machine's
+// LAN address
+func (s *Server) shareURL(name string) (string, error) {
+	s.shareMu.Lock()
+	server := s.lan
+	s.shareMu.Unlock()
+	if server == nil {
+		return "", errSharingDisabled
+	}
+	ips, err := lan.Addrs()
+	if err != nil {
+		return "", err
+	}
+	if len(ips) == 0 {
+		return "", lan.ErrNoAddress
+	}
+	query, err := s.shares.Link(name)
+	if err != nil {
+		return "", err
+	}
+	return lan.URL("http", ips[0].String(), server.Addr().(*net.TCPAddr).Port) + query, nil
+}
+
+// probeRequestOptions are the probe options a client may set through the
+// API
+type probeRequestOptions struct {
+	Path            string            `json:"path"`
+	Paths           []string          `json:"paths"`
+	HostHeader      string            `json:"host_header"`
+	Method          string            `json:"method"`
+	TimeoutMS       int               `json:"timeout_ms"` // Applies to dial, write and read
+	FollowRedirects bool              `json:"follow_redirects"`
+	FrameworkPaths  bool              `json:"framework_paths"`
+	DetectFavicon   bool              `json:"favicon"`
+	DetectMethods   bool              `json:"methods"`
+	DetectCORS      bool              `json:"cors"`
+	DetectVersions  bool              `json:"versions"`
+	DetectWebSocket bool              `json:"websocket"`
+	DetectAPISpec   bool              `json:"api_spec"`
+	Headers         map[string]string `json:"headers"`
+}
+
+// probeOptions converts the request to probe.ProbeOptions
+func (o probeRequestOptions) probeOptions() probe.ProbeOptions {
+	timeout := time.Duration(o.TimeoutMS) * time.Millisecond
+	return probe.ProbeOptions{
+		DialTimeout:     timeout,
+		ReadTimeout:     timeout,
+		WriteTimeout:    timeout,
+		Path:            o.Path,
+		Paths:           o.Paths,
+		Host:            o.HostHeader,
+		Method:          o.Method,
+		FollowRedirects: o.FollowRedirects,
+		FrameworkPaths:  o.FrameworkPaths,
+		DetectFavicon:   o.DetectFavicon,
+		DetectMethods:   o.DetectMethods,
+		DetectCORS:      o.DetectCORS,
+		DetectVersions:  o.DetectVersions,
+		DetectAPISpec:   o.DetectAPISpec,
+		DetectWebSocket: o.DetectWebSocket,
+		Headers:         o.Headers,
+	}
+}
+
+// handleAPIProbe probes a port and returns its report, as probe prints it
+// with --output json, with the full ProbeResult. The
+// target is either a known service, by name, or a loopback host and port.
+// Probing a service also has the discovery loop rescan at once.
+func (s *Server) handleAPIProbe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Name    string              `json:"name"`
+		Host    string              `json:"host"`
+		Port    int                 `json:"port"`
+		Options probeRequestOptions `json:"options"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Name != "" {
+		s.mu.RLock()
+		svc, ok := s.services[serviceName(req.Name)]
+		s.mu.RUnlock()
+		if !ok {
+			http.Error(w, "Service not found", http.StatusNotFound)
+			return
+		}
+		req.Host, req.Port = svc.TargetHost, svc.Port
+		defer s.requestScan()
+	}
+	if req.Host == "" {
+		req.Host = "localhost"
+	}
+	if req.Port < 1 || req.Port > 65535 {
+		http.Error(w, "Invalid port", http.StatusBadRequest)
+		return
+	}
+	// The daemon only looks at this machine; anything else would let API
+	// clients use it to reach other hosts
+	if ip := net.ParseIP(req.Host); req.Host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		http.Error(w, "Only loopback hosts can be probed", http.StatusBadRequest)
+		return
+	}
+	if err := probe.ValidateHeaders(req.Options.Headers); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	opts := req.Options.probeOptions()
+	opts.ClientCert = s.probeClientCert()
+	if req.Name != "" {
+		opts.Credentials = s.config().Auth.Credentials(s.jar, serviceName(req.Name), req.Port)
+	}
+	result := probe.ProbeContextWithOptions(r.Context(), req.Host, req.Port, opts)
+	timeout := opts.ReadTimeout
+	if timeout == 0 {
+		timeout = probe.DefaultReadTimeout
+	}
+	report := output.NewProbe(net.JoinHostPort(req.Host, strconv.Itoa(req.Port)), result, timeout)
+	if result.Cert != nil {
+		name := req.Host
+		if req.Name != "" {
+			name = serviceName(req.Name)
+		}
+		report.CertIssues = result.Cert.Issues(name, time.Now())
+	}
+	writeDocument(w, output.KindProbe, report)
+}
+
+// requestScan wakes the discovery loop; requests made while a scan is
+// already pending are merged into it
+func (s *Server) requestScan() {
+	select {
+	case s.reprobe <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"localhost-magic/internal/accesslog"
+	"localhost-magic/internal/apiauth"
+	"localhost-magic/internal/config"
+	"localhost-magic/internal/dashboard"
+	"localhost-magic/internal/health"
+	"localhost-magic/internal/metrics"
+	"localhost-magic/internal/output"
+	"localhost-magic/internal/procmap"
+	"localhost-magic/internal/proxy"
+	"localhost-magic/internal/scan"
+	"localhost-magic/internal/share"
+	"localhost-magic/internal/storage"
+	"localhost-magic/probe"
+)
+
+// testServer is a daemon knowing services, each with a record in a store
+// of its own, active unless its ID starts with "down:"
+func testServer(t *testing.T, services ...*Service) *Server {
+	t.Helper()
+	store, err := storage.NewStore(filepath.Join(t.TempDir(), "services.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		store:     store,
+		services:  make(map[string]*Service),
+		others:    make(map[int]*output.Listener),
+		hidden:    make(map[int]bool),
+		events:    dashboard.NewHub(),
+		access:    accesslog.NewRing(accesslog.DefaultRingSize),
+		cfg:       &config.Config{},
+		proxyPort: 80,
+	}
+	s.shares = share.New(s, nil)
+	for _, svc := range services {
+		s.services[svc.Name] = svc
+		record := &storage.ServiceRecord{ID: svc.ID, Name: svc.Name, Port: svc.Port, IsActive: !strings.HasPrefix(svc.ID, "down:"), LastSeen: seen}
+		if err := store.Save(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+// seen is when the test services were last seen
+var seen = time.Date(2026, 3, 14, 9, 30, 0, 0, time.UTC)
+
+// get sends a GET for path to the dashboard from remoteAddr, with token as
+// a bearer token if set
+func get(s *Server, remoteAddr, path, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "http://localhost"+path, nil)
+	r.RemoteAddr = remoteAddr
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.dashboard.ServeHTTP(w, r)
+	return w
+}
+
+func TestMetricsBehindAPIAuth(t *testing.T) {
+	s := &Server{}
+	s.routeDashboard(apiauth.Options{Token: "secret"}, metrics.New())
+	tests := []struct {
+		name   string
+		remote string
+		token  string
+		want   int
+	}{
+		{"LAN client", "192.168.1.20:51000", "secret", http.StatusForbidden},
+		{"no token", "127.0.0.1:51000", "", http.StatusUnauthorized},
+		{"wrong token", "127.0.0.1:51000", "guess", http.StatusUnauthorized},
+		{"token", "127.0.0.1:51000", "secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := get(s, tt.remote, "/metrics", tt.token)
+			if w.Code != tt.want {
+				t.Fatalf("GET /metrics: %d, want %d", w.Code, tt.want)
+			}
+			if leaked := strings.Contains(w.Body.String(), "# HELP"); leaked != (tt.want == http.StatusOK) {
+				t.Errorf("body %q", w.Body.String())
+			}
+		})
+	}
+
+	// Without -api-auth, local clients are served as by the API
+	s = &Server{}
+	s.routeDashboard(apiauth.Options{}, metrics.New())
+	if w := get(s, "[::1]:51000", "/metrics", ""); w.Code != http.StatusOK {
+		t.Errorf("local GET /metrics without auth: %d, want 200", w.Code)
+	}
+	if w := get(s, "10.0.0.7:51000", "/metrics", ""); w.Code != http.StatusForbidden {
+		t.Errorf("LAN GET /metrics without auth: %d, want 403", w.Code)
+	}
+}
+
+func TestShareWhileScanning(t *testing.T) {
+	svc := &Service{Name: "web.localhost", Port: 5173, Scope: procmap.ScopeAllInterfaces, Addrs: []string{"0.0.0.0"}}
+	s := &Server{services: map[string]*Service{svc.Name: svc}}
+
+	// The scanner rebinding the service while shares are asked for
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			s.mu.Lock()
+			svc.Scope = []procmap.Scope{procmap.ScopeLoopback, procmap.ScopeAllInterfaces}[i%2]
+			s.mu.Unlock()
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		r := httptest.NewRequest("POST", "/api/shares", strings.NewReader(`{"name": "web"}`))
+		w := httptest.NewRecorder()
+		s.handleAPIShares(w, r)
+		// Either refused as already on the LAN, or as sharing is disabled
+		if w.Code != http.StatusConflict {
+			t.Fatalf("POST /api/shares: %d %s, want 409", w.Code, w.Body.String())
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestAPIServiceIsItsFinding(t *testing.T) {
+	last := &probe.ProbeResult{
+		Port: 5173, State: probe.StateHTTP, Address: "127.0.0.1", IsHTTP: true,
+		StatusCode: 200, StatusText: "OK", Protocol: probe.ProtocolHTTP1,
+		SupportedVersions: []string{probe.VersionHTTP11, probe.VersionH2},
+		Framework:         "vite", FaviconHash: -1234, TTFB: 12 * time.Millisecond,
+	}
+	up := &Service{
+		ID: "process:web", Name: "web.localhost", Port: 5173, PID: 4242, ExePath: "/usr/bin/node",
+		Args: []string{"node", "vite"}, Scope: procmap.ScopeLoopback, LastProbe: last,
+		Auxiliary: []AuxiliaryEndpoint{{Port: 24678, Kind: probe.AuxiliaryHMR, Framework: "vite"}},
+	}
+	down := &Service{ID: "down:api", Name: "api.localhost", Port: 8000, LastProbe: last}
+	s := testServer(t, up, down)
+
+	tests := []struct {
+		name  string
+		check func(t *testing.T, got output.Service)
+	}{
+		{"web", func(t *testing.T, got output.Service) {
+			// Every field of the probe reaches clients, not only those
+			// the API once copied
+			f := got.Finding
+			if f.State != scan.StateOpen || f.FaviconHash != -1234 || !slices.Equal(f.SupportedVersions, last.SupportedVersions) || f.TTFB != last.TTFB {
+				t.Errorf("finding %+v, want the last probe", f)
+			}
+			if f.Process == nil || f.Process.PID != 4242 || f.Process.Name != "node" {
+				t.Errorf("process %+v", f.Process)
+			}
+			if len(got.Auxiliary) != 1 || got.Auxiliary[0].Finding.Port != 24678 || got.Auxiliary[0].Finding.Auxiliary != probe.AuxiliaryHMR {
+				t.Errorf("auxiliary %+v", got.Auxiliary)
+			}
+			if !got.Active || !got.Healthy || got.URL != "http://web.localhost/" || got.LastSeen != nil {
+				t.Errorf("got %+v", got)
+			}
+		}},
+		{"api", func(t *testing.T, got output.Service) {
+			// Listed as list lists a service that is down
+			if got.Active || got.Healthy || got.Finding.State != scan.StateClosed || got.Finding.StatusCode != 0 {
+				t.Errorf("got %+v, want it down without its probe", got)
+			}
+			if got.LastSeen == nil || !got.LastSeen.Equal(seen) {
+				t.Errorf("last seen %v, want %v", got.LastSeen, seen)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.handleAPIService(w, httptest.NewRequest("GET", "/api/services/"+tt.name, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("GET: %d %s", w.Code, w.Body.String())
+			}
+			var got output.Service
+			if err := output.Read(w.Body, output.KindService, &got); err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, got)
+		})
+	}
+}
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// golden compares got to testdata/name.golden, or rewrites it with -update
+func golden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v; run go test -update to create it", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("answer differs from %s; if the change is meant, run go test -update:\n%s", path, got)
+	}
+}
+
+// request sends the dashboard a request for path from a local client, as
+// JSON when there is a body
+func request(s *Server, method, path, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "http://localhost"+path, strings.NewReader(body))
+	r.RemoteAddr = "127.0.0.1:51000"
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	w := httptest.NewRecorder()
+	s.dashboard.ServeHTTP(w, r)
+	return w
+}
+
+func TestAPIAnswersDocuments(t *testing.T) {
+	web := &Service{
+		ID: "process:web", Name: "web.localhost", Port: 5173, PID: 4242, ExePath: "/usr/bin/node",
+		Args: []string{"node", "vite"}, Cwd: "/home/dev/web", Addrs: []string{"127.0.0.1"}, Scope: procmap.ScopeLoopback,
+		LastProbe: &probe.ProbeResult{
+			Port: 5173, State: probe.StateHTTP, Address: "127.0.0.1", IsHTTP: true, HTTPVersion: "HTTP/1.1",
+			StatusCode: 200, StatusText: "OK", Protocol: probe.ProtocolHTTP1, Kind: probe.ServiceHTTP,
+			Title: "Web", Framework: "vite", FrameworkConfidence: probe.ConfidenceHigh, TTFB: 12 * time.Millisecond, Attempts: 1,
+		},
+		Health:    &health.Score{State: health.StateHealthy, Since: seen, Checked: seen, Good: 3},
+		Auxiliary: []AuxiliaryEndpoint{{Port: 24678, Kind: probe.AuxiliaryHMR, Framework: "vite"}},
+	}
+	api := &Service{ID: "down:api", Name: "api.localhost", Port: 8000, ExePath: "/usr/bin/python3", Args: []string{"python3", "app.py"}}
+	s := testServer(t, web, api)
+	s.others[9229] = &output.Listener{Port: 9229, PID: 4243, ExePath: "/usr/bin/node", Scope: procmap.ScopeLoopback, State: probe.StateOpenSilent, Hint: "node inspector"}
+	s.access.Add(proxy.Access{Time: seen, Client: "127.0.0.1:51001", Host: "web.localhost", Method: "GET", Path: "/", Service: "web.localhost", Port: 5173, Status: 200, Bytes: 512, Duration: 3 * time.Millisecond})
+	s.routeDashboard(apiauth.Options{}, nil)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		kind   output.Kind
+	}{
+		{"services", "GET", "/api/services", "", output.KindServices},
+		{"services-filtered", "GET", "/api/services?active=false", "", output.KindServices},
+		{"service", "GET", "/api/services/web", "", output.KindService},
+		{"keep", "POST", "/api/keep", `{"name": "api.localhost", "keep": true}`, output.KindService},
+		{"listeners", "GET", "/api/listeners", "", output.KindListeners},
+		{"hide", "POST", "/api/hide", `{"port": 9229, "hidden": true}`, output.KindHidden},
+		{"hidden", "GET", "/api/hidden", "", output.KindHidden},
+		{"shares", "GET", "/api/shares", "", output.KindShares},
+		{"access", "GET", "/api/access", "", output.KindAccess},
+		{"blacklist", "POST", "/api/blacklist", `{"type": "pid", "value": "4243"}`, output.KindBlacklist},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := request(s, tt.method, tt.path, tt.body)
+			if w.Code != http.StatusOK {
+				t.Fatalf("%s %s: %d %s", tt.method, tt.path, w.Code, w.Body.String())
+			}
+			golden(t, "api-"+tt.name, w.Body.Bytes())
+			// What the CLI reads back
+			var data any
+			if err := output.Read(bytes.NewReader(w.Body.Bytes()), tt.kind, &data); err != nil {
+				t.Errorf("%s %s: %v", tt.method, tt.path, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+// Package accesslog records the requests going through the proxy: as log
+// lines, in text or JSON, to stdout or a file rotated by size, and in a
+// ring of the latest ones for the API to serve.
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"localhost-magic/internal/proxy"
+)
+
+// Format is how a Logger writes lines
+type Format string
+
+const (
+	FormatText Format = "text"
+	FormatJSON Format = "json"
+)
+
+// ParseFormat returns the format called s
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(s); f {
+	case FormatText, FormatJSON:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown log format %q: use text or json", s)
+}
+
+// Logger writes one line per access to w. It is safe for concurrent use.
+type Logger struct {
+	format Format
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// New returns a logger writing to w in format
+func New(w io.Writer, format Format) *Logger {
+	return &Logger{w: w, format: format}
+}
+
+// Log writes a. Write errors are dropped: a full disk shouldn't stop the
+// proxy.
+func (l *Logger) Log(a proxy.Access) {
+	var line []byte
+	if l.format == FormatJSON {
+		line, _ = json.Marshal(a)
+		line = append(line, '\n')
+	} else {
+		line = []byte(textLine(a))
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(line)
+}
+
+// textLine formats a as e.g.
+//
+//	2024-05-01T10:00:00.000Z 127.0.0.1:51234 GET api.localhost /users -> api.localhost:8080 200 1532B 12ms
+//
+// with "websocket start" or "sse end" after the backend for streams
+func textLine(a proxy.Access) string {
+	s := fmt.Sprintf("%s %s %s %s %s -> %s:%d",
+		a.Time.UTC().Format("2006-01-02T15:04:05.000Z"), a.Client, a.Method, a.Host, a.Path, a.Service, a.Port)
+	if a.Stream != proxy.StreamNone {
+		s += fmt.Sprintf(" %s %s", a.Stream, a.Phase)
+	}
+	if a.Status != 0 {
+		s += " " + strconv.Itoa(a.Status)
+	}
+	if a.Phase != proxy.PhaseStart {
+		s += fmt.Sprintf(" %dB %s", a.Bytes, roundDuration(a.Duration))
+	}
+	return s + "\n"
+}
+
+// roundDuration keeps three significant digits or so, e.g. 12ms or 1.53s
+func roundDuration(d time.Duration) time.Duration {
+	switch {
+	case d < time.Millisecond:
+		return d.Round(time.Microsecond)
+	case d < time.Second:
+		return d.Round(time.Millisecond)
+	}
+	return d.Round(10 * time.Millisecond)
+}
+
+// DefaultRingSize is how many accesses a Ring keeps when asked for none
+const DefaultRingSize = 1000
+
+// Ring keeps the latest accesses. Stream starts aren't kept, as their end
+// says the same and more. It is safe for concurrent use.
+type Ring struct {
+	mu      sync.Mutex
+	entries []proxy.Access
+	next    int // Where the next entry goes once the ring is full
+}
+
+// NewRing returns a ring holding up to size accesses (DefaultRingSize if
+// size isn't positive)
+func NewRing(size int) *Ring {
+	if size <= 0 {
+		size = DefaultRingSize
+	}
+	return &Ring{entries: make([]proxy.Access, 0, size)}
+}
+
+// Add records a
+func (r *Ring) Add(a proxy.Access) {
+	if a.Phase == proxy.PhaseStart {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.entries) < cap(r.entries) {
+		r.entries = append(r.entries, a)
+		return
+	}
+	r.entries[r.next] = a
+	r.next = (r.next + 1) % len(r.entries)
+}
+
+// Recent returns up to limit accesses, newest first, to service or, if it
+// is empty, to any. A limit below one returns all that match.
+func (r *Ring) Recent(service string, limit int) []proxy.Access {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := []proxy.Access{}
+	for i := 0; i < len(r.entries) && (limit < 1 || len(out) < limit); i++ {
+		// Walk back from the newest entry, just before next
+		a := r.entries[(r.next-1-i+2*len(r.entries))%len(r.entries)]
+		if service == "" || a.Service == service {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// RotatingFile is a log file that is moved aside to path.1, path.2 and so
+// on, up to backups of them, once it grows past maxSize bytes. It is safe
+// for concurrent use.
+type RotatingFile struct {
+	path    string
+	maxSize int64
+	backups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// OpenRotating opens path for appending, creating it if needed
+func OpenRotating(path string, maxSize int64, backups int) (*RotatingFile, error) {
+	f := &RotatingFile{path: path, maxSize: maxSize, backups: backups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open opens the file at f.path. Must hold f.mu, or be called before the
+// file is shared.
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open access log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open access log: %w", err)
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// Write appends p, rotating the file first if p would take it past
+// maxSize
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file aside and starts a new one. Must hold f.mu.
+func (f *RotatingFile) rotate() error {
+	f.file.Close()
+	f.file = nil
+	if f.backups < 1 {
+		os.Remove(f.path)
+	} else {
+		for i := f.backups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+		}
+		if err := os.Rename(f.path, f.path+".1"); err != nil {
+			f.open() // Keep logging to the file as it is
+			return fmt.Errorf("failed to rotate access log: %w", err)
+		}
+	}
+	return f.open()
+}
+
+// Close closes the file
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -0,0 +1,186 @@
+// Package apiauth guards the daemon's API. By default only clients on the
+// loopback interface are served; with a token set, every request must
+// also carry it as a bearer token, so local tools that can read the
+// config directory can use the API and other processes can't.
+//
+// Requests must also be addressed to a localhost name or an IP address,
+// so a site whose name resolves to 127.0.0.1 (DNS rebinding) can't read
+// the API, and those that change state must send JSON and come from the
+// API's own origin: pages open in the user's browser can reach loopback
+// too, and could otherwise post forms to it.
+package apiauth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultTokenPath returns the default token file, next to the service
+// store
+func DefaultTokenPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = "."
+	}
+	return filepath.Join(home, ".config", "localhost-magic", "api-token")
+}
+
+// LoadOrCreateToken reads the token at path, generating one readable only
+// by the current user if the file doesn't exist. created reports whether
+// it was generated.
+func LoadOrCreateToken(path string) (token string, created bool, err error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		token = strings.TrimSpace(string(data))
+		if token == "" {
+			return "", false, fmt.Errorf("token file %s is empty", path)
+		}
+		return token, false, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return "", false, fmt.Errorf("failed to read API token: %w", err)
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", false, fmt.Errorf("failed to generate API token: %w", err)
+	}
+	token = hex.EncodeToString(raw)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", false, fmt.Errorf("failed to create config directory: %w", err)
+	}
+	// O_EXCL so two daemons starting at once don't hand out different tokens
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, fs.ErrExist) {
+		return LoadOrCreateToken(path)
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("failed to write API token: %w", err)
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintln(f, token); err != nil {
+		return "", false, fmt.Errorf("failed to write API token: %w", err)
+	}
+	return token, true, nil
+}
+
+// Options configures Protect
+type Options struct {
+	// Token, if set, must be sent as "Authorization: Bearer <token>", or as
+	// the access_token query parameter by clients such as EventSource that
+	// can't set headers
+	Token string
+	// AllowRemote serves clients that aren't on the loopback interface
+	AllowRemote bool
+	// Hosts are the names the API answers for besides localhost, those
+	// under .localhost and IP addresses, e.g. the machine's own name for
+	// remote clients
+	Hosts []string
+}
+
+// Protect returns a handler that serves next only for requests opts allows
+func Protect(next http.Handler, opts Options) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !opts.AllowRemote && !isLoopback(r.RemoteAddr) {
+			http.Error(w, "The API only accepts local clients", http.StatusForbidden)
+			return
+		}
+		if !allowedHost(r.Host, opts.Hosts) {
+			http.Error(w, "The API only answers for localhost names", http.StatusMisdirectedRequest)
+			return
+		}
+		if opts.Token != "" && !validToken(r, opts.Token) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="localhost-magic"`)
+			http.Error(w, "Missing or invalid API token", http.StatusUnauthorized)
+			return
+		}
+		if changesState(r.Method) {
+			if !sameOrigin(r) {
+				http.Error(w, "The API doesn't accept requests from other sites", http.StatusForbidden)
+				return
+			}
+			if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+				http.Error(w, "Requests that change state must be sent as application/json", http.StatusUnsupportedMediaType)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// changesState reports whether a request with method may change state
+func changesState(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// sameOrigin reports whether a request wasn't sent by a page of another
+// origin, going by what browsers add to the requests they send. Tools
+// such as the CLI send neither header.
+func sameOrigin(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		return false // cross-site, or same-site: another service's page
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && strings.EqualFold(u.Host, r.Host)
+}
+
+// isLoopback reports whether a request's remote address is on loopback
+func isLoopback(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// allowedHost reports whether a request's Host is one the API answers for
+func allowedHost(host string, hosts []string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(strings.Trim(host, "[]")), ".")
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") || net.ParseIP(host) != nil {
+		return true
+	}
+	for _, h := range hosts {
+		if strings.EqualFold(strings.TrimSuffix(h, "."), host) {
+			return true
+		}
+	}
+	return false
+}
+
+// validToken reports whether the request carries token
+func validToken(r *http.Request, token string) bool {
+	got := r.URL.Query().Get("access_token")
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		scheme, value, ok := strings.Cut(auth, " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") {
+			return false
+		}
+		got = strings.TrimSpace(value)
+	}
+	return got != "" && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
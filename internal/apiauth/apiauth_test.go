@@ -0,0 +1,77 @@
+package apiauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProtect(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		name    string
+		method  string
+		host    string
+		remote  string
+		headers map[string]string
+		opts    Options
+		want    int
+	}{
+		{name: "local read", method: "GET", want: http.StatusOK},
+		{name: "remote read", method: "GET", remote: "192.168.1.20:5000", want: http.StatusForbidden},
+		{name: "remote allowed", method: "GET", remote: "192.168.1.20:5000", opts: Options{AllowRemote: true}, want: http.StatusOK},
+		{name: "missing token", method: "GET", opts: Options{Token: "secret"}, want: http.StatusUnauthorized},
+		{name: "bearer token", method: "GET", headers: map[string]string{"Authorization": "Bearer secret"}, opts: Options{Token: "secret"}, want: http.StatusOK},
+		{name: "wrong token", method: "GET", headers: map[string]string{"Authorization": "Bearer guess"}, opts: Options{Token: "secret"}, want: http.StatusUnauthorized},
+
+		{name: "JSON post", method: "POST", headers: map[string]string{"Content-Type": "application/json"}, want: http.StatusOK},
+		{name: "JSON with charset", method: "PATCH", headers: map[string]string{"Content-Type": "application/json; charset=utf-8"}, want: http.StatusOK},
+		{name: "text post", method: "POST", headers: map[string]string{"Content-Type": "text/plain"}, want: http.StatusUnsupportedMediaType},
+		{name: "form post", method: "POST", headers: map[string]string{"Content-Type": "application/x-www-form-urlencoded"}, want: http.StatusUnsupportedMediaType},
+		{name: "no content type", method: "DELETE", want: http.StatusUnsupportedMediaType},
+		{name: "same origin", method: "POST", headers: map[string]string{
+			"Content-Type": "application/json", "Origin": "http://magic.localhost", "Sec-Fetch-Site": "same-origin",
+		}, want: http.StatusOK},
+		{name: "cross-site origin", method: "POST", headers: map[string]string{
+			"Content-Type": "application/json", "Origin": "https://evil.example",
+		}, want: http.StatusForbidden},
+		{name: "another service's page", method: "POST", headers: map[string]string{
+			"Content-Type": "application/json", "Origin": "http://shop.localhost", "Sec-Fetch-Site": "same-site",
+		}, want: http.StatusForbidden},
+		{name: "cross-site fetch", method: "POST", headers: map[string]string{
+			"Content-Type": "application/json", "Sec-Fetch-Site": "cross-site",
+		}, want: http.StatusForbidden},
+		{name: "opaque origin", method: "POST", headers: map[string]string{
+			"Content-Type": "application/json", "Origin": "null",
+		}, want: http.StatusForbidden},
+		{name: "rebound name", method: "GET", host: "evil.example", want: http.StatusMisdirectedRequest},
+		{name: "rebound name with port", method: "GET", host: "evil.example:80", want: http.StatusMisdirectedRequest},
+		{name: "localhost", method: "GET", host: "localhost:8080", want: http.StatusOK},
+		{name: "loopback address", method: "GET", host: "127.0.0.1:4280", want: http.StatusOK},
+		{name: "IPv6 loopback", method: "GET", host: "[::1]:4280", want: http.StatusOK},
+		{name: "service name", method: "GET", host: "shop.localhost", want: http.StatusOK},
+		{name: "machine name", method: "GET", host: "mybox.local", opts: Options{Hosts: []string{"mybox.local"}}, want: http.StatusOK},
+		{name: "cross-site read", method: "GET", headers: map[string]string{"Origin": "https://evil.example"}, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "http://magic.localhost/api/shares", strings.NewReader("{}"))
+			r.RemoteAddr = "127.0.0.1:40000"
+			if tt.host != "" {
+				r.Host = tt.host
+			}
+			if tt.remote != "" {
+				r.RemoteAddr = tt.remote
+			}
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			Protect(ok, tt.opts).ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("got %d, want %d: %s", w.Code, tt.want, strings.TrimSpace(w.Body.String()))
+			}
+		})
+	}
+}
@@ -0,0 +1,586 @@
+// Package config loads the user's settings from
+// ~/.config/localhost-magic/config.toml: which ports to scan and ignore,
+// names pinned to ports, probe timeouts and listen addresses. Every
+// setting is optional; a zero field means the built-in default applies.
+//
+//	[scan]
+//	ports = ["3000-9999", 443]
+//	ignore_ports = ["63342", "6942-6991"]     # IDE helper ports
+//	ignore_processes = ["idea", "/opt/JetBrains/"]
+//	exclude = [4381, "process:Spotify*", "label:com.example.dev=ignore"]
+//	interval = "2s"
+//	priority_ports = [3000, "5173-5174", 8080]  # scanned first by lm list
+//	extra_addresses = ["127.0.0.2"]  # Scanned besides 127.0.0.1 and ::1
+//	discover_addresses = true        # Also those listeners are bound to
+//	slow_threshold = "1s"  # Time to first byte from which lm list flags a service
+//
+//	[probe]
+//	dial_timeout = "300ms"
+//	read_timeout = "1s"
+//	headers = ["X-Forwarded-Proto: https"]
+//	paths = ["/", "/health", "/api"]  # Tried in order, the best answer wins
+//	client_cert = "~/certs/dev-client.pem"  # For mTLS services
+//	client_key = "~/certs/dev-client-key.pem"
+//	vhosts = ["shop.test", "blog.test"]  # Tried on reverse proxies without an admin API
+//	traefik_api = "127.0.0.1:8080"       # Where the proxies' admin APIs are read
+//	caddy_api = "127.0.0.1:2019"
+//
+//	[proxy]
+//	listen = ":80"
+//	fallback_listen = ":8080"
+//
+//	[dns]
+//	listen = "127.0.0.1:5354"
+//
+//	[registry]
+//	retention_days = 14  # Unseen services are pruned after this
+//	history = 100        # Probes kept per service for the history command
+//
+//	[health]
+//	slow = "2s"          # Answers slower than this count against a service
+//	degraded_after = 2   # Bad checks in a row before healthy turns degraded
+//	down_after = 3       # Failed checks in a row before it is down
+//	recover_after = 2    # Good checks in a row before it is healthy again
+//
+//	[notify]
+//	enabled = true       # Desktop notifications from the daemon
+//	events = ["added", "removed", "down"]
+//	services = ["web", "api*"]
+//	interval = "30s"     # At most one notification per service in this
+//
+//	[auth]
+//	api = "bearer dev-token-123"  # By service name pattern, port or range
+//	8443 = "basic admin:hunter2"
+//	"web*" = "cookies"  # Reuse the session of a login through the proxy
+//
+//	[rewrite]
+//	api = ["prefix /api/ /api/v1/", "request set X-Tenant: dev"]
+//	"web*" = "response remove Server"  # By service name pattern, in order
+//
+//	[names]
+//	api = 8080
+//
+// The daemon also takes overrides from LOCALHOST_MAGIC_<TABLE>_<KEY>
+// variables, e.g. LOCALHOST_MAGIC_SCAN_PORTS="3000-3999,8080" or
+// LOCALHOST_MAGIC_NAMES_API=8080.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"localhost-magic/internal/credentials"
+	"localhost-magic/internal/discover"
+	"localhost-magic/internal/exclude"
+	"localhost-magic/internal/health"
+	"localhost-magic/internal/notify"
+	"localhost-magic/internal/rewrite"
+	"localhost-magic/probe"
+)
+
+// EnvPrefix starts the name of every override variable
+const EnvPrefix = "LOCALHOST_MAGIC_"
+
+// Config is the user's settings
+type Config struct {
+	Scan     ScanConfig
+	Probe    ProbeConfig
+	Proxy    ProxyConfig
+	DNS      DNSConfig
+	Registry RegistryConfig
+	Health   HealthConfig
+	Notify   NotifyConfig
+	// Auth are the credentials services are probed with, by name or
+	// port, in the order given
+	Auth credentials.Rules
+	// Rewrite changes the requests the proxy passes to services, and their
+	// answers, by name pattern in the order given
+	Rewrite rewrite.Rules
+	// Names pins hostnames to ports, e.g. "api.localhost" -> 8080
+	Names map[string]int
+}
+
+// ScanConfig says which listeners are looked at
+type ScanConfig struct {
+	Ports           []PortRange // Empty means every port
+	IgnorePorts     []PortRange
+	IgnoreProcesses []string // Executable names or path patterns
+	// Exclude are rules for ports, processes and containers to leave out,
+	// besides IgnorePorts and IgnoreProcesses
+	Exclude  exclude.Rules
+	Interval time.Duration
+	// PriorityPorts are swept first by lm list and watch; nil means the
+	// built-in list, empty means no priority pass
+	PriorityPorts []PortRange
+	// ExtraAddrs are loopback addresses scanned besides 127.0.0.1 and
+	// ::1, and DiscoverAddrs adds the ones local listeners are bound to
+	ExtraAddrs    []string
+	DiscoverAddrs bool
+	// SlowThreshold is the time to first byte that flags a service slow
+	SlowThreshold time.Duration
+}
+
+// ProbeConfig sets the probe timeouts and optional checks
+type ProbeConfig struct {
+	DialTimeout time.Duration
+	ReadTimeout time.Duration
+	APISpec     bool // Look for OpenAPI/Swagger documents
+	// Headers are sent with every probe request, e.g. an API key a local
+	// gateway wants
+	Headers map[string]string
+	// Paths are the candidate paths each service is probed on, default "/"
+	Paths []string
+	// ClientCert and ClientKey are PEM files of a certificate presented to
+	// services that require one (mTLS)
+	ClientCert string
+	ClientKey  string
+	// VHosts are the names tried as virtual hosts of reverse proxies that
+	// have no admin API to list the apps they serve
+	VHosts []string
+	// TraefikAPI and CaddyAPI are where the admin APIs listing those apps
+	// are, default probe.DefaultTraefikAPI and probe.DefaultCaddyAPI
+	TraefikAPI string
+	CaddyAPI   string
+}
+
+// ProxyConfig sets the proxy's listen addresses
+type ProxyConfig struct {
+	Listen            string
+	FallbackListen    string
+	TLSListen         string
+	TLSFallbackListen string
+	// PathListen is where path routing listens, with -paths; KeepPrefix
+	// names the services whose backends get their path prefix
+	PathListen string
+	KeepPrefix []string
+}
+
+// DNSConfig sets the resolver's listen address
+type DNSConfig struct {
+	Listen string
+}
+
+// RegistryConfig sets how long the scan registry remembers services, and
+// how many of their probes
+type RegistryConfig struct {
+	// Retention is how long an entry may go unseen before it is pruned
+	Retention time.Duration
+	// History is how many probes of each service are kept, default
+	// registry.DefaultHistorySize
+	History int
+}
+
+// HealthConfig sets when the watcher calls a service degraded or down;
+// see health.Thresholds
+type HealthConfig struct {
+	Slow          time.Duration
+	DegradedAfter int
+	DownAfter     int
+	RecoverAfter  int
+}
+
+// NotifyConfig sets which service events the daemon shows as desktop
+// notifications, and how; see notify.Options
+type NotifyConfig struct {
+	Enabled  bool
+	Backend  string // One of notify.Backends, default "auto"
+	Events   []discover.EventType
+	Services []string // Name patterns
+	Interval time.Duration
+	Grace    time.Duration
+}
+
+// PortRange is an inclusive range of ports
+type PortRange struct {
+	From, To int
+}
+
+// String returns "3000" or "3000-3999"
+func (r PortRange) String() string {
+	if r.From == r.To {
+		return strconv.Itoa(r.From)
+	}
+	return fmt.Sprintf("%d-%d", r.From, r.To)
+}
+
+// Contains reports whether port is in the range
+func (r PortRange) Contains(port int) bool {
+	return port >= r.From && port <= r.To
+}
+
+// Error is a problem with one setting. Line is set for a file and Env for
+// an environment variable.
+type Error struct {
+	Path string
+	Line int
+	Env  string
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	if e.Env != "" {
+		return e.Env + ": " + e.Msg
+	}
+	return fmt.Sprintf("%s:%d: %s", e.Path, e.Line, e.Msg)
+}
+
+// itemError is a problem with one item of an array, reported at the item's
+// line rather than the key's
+type itemError struct {
+	line int
+	err  error
+}
+
+func (e *itemError) Error() string { return e.err.Error() }
+
+// DefaultPath returns the default config file, next to the service store
+func DefaultPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = "."
+	}
+	return filepath.Join(home, ".config", "localhost-magic", "config.toml")
+}
+
+// Load reads and validates the config file at path. A missing file is
+// reported with an error matching fs.ErrNotExist; problems in the file
+// are returned together, each an *Error with its line.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	return Parse(path, string(data))
+}
+
+// Parse reads and validates config file contents; path is only used in
+// error messages
+func Parse(path, src string) (*Config, error) {
+	entries, errs := parse(path, src)
+	c := &Config{}
+	for _, e := range entries {
+		if err := c.set(e.table, e.key, e.value); err != nil {
+			line := e.value.line
+			var item *itemError
+			if errors.As(err, &item) && item.line > 0 {
+				line = item.line
+			}
+			errs = append(errs, &Error{Path: path, Line: line, Msg: err.Error()})
+		}
+	}
+	if len(errs) > 0 {
+		sort.SliceStable(errs, func(i, j int) bool { return errs[i].(*Error).Line < errs[j].(*Error).Line })
+		return nil, errors.Join(errs...)
+	}
+	return c, nil
+}
+
+// ApplyEnv overrides settings from LOCALHOST_MAGIC_* variables in environ,
+// given as "KEY=value" like os.Environ. List settings take comma-separated
+// values. Unknown variables are errors, so a typo doesn't go unnoticed.
+func (c *Config) ApplyEnv(environ []string) error {
+	var errs []error
+	for _, kv := range environ {
+		name, raw, _ := strings.Cut(kv, "=")
+		rest, ok := strings.CutPrefix(name, EnvPrefix)
+		if !ok {
+			continue
+		}
+		table, key, _ := strings.Cut(strings.ToLower(rest), "_")
+		if err := c.set(table, key, value{v: raw, env: true}); err != nil {
+			errs = append(errs, &Error{Env: name, Msg: err.Error()})
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// setters holds the fields that can be set, by table and key
+var setters = map[string]map[string]func(c *Config, v value) error{
+	"scan": {
+		"ports":              func(c *Config, v value) (err error) { c.Scan.Ports, err = v.portRanges(); return },
+		"ignore_ports":       func(c *Config, v value) (err error) { c.Scan.IgnorePorts, err = v.portRanges(); return },
+		"ignore_processes":   func(c *Config, v value) (err error) { c.Scan.IgnoreProcesses, err = v.strings(); return },
+		"exclude":            func(c *Config, v value) (err error) { c.Scan.Exclude, err = v.exclusions(); return },
+		"interval":           func(c *Config, v value) (err error) { c.Scan.Interval, err = v.duration(); return },
+		"priority_ports":     func(c *Config, v value) (err error) { c.Scan.PriorityPorts, err = v.portRanges(); return },
+		"extra_addresses":    func(c *Config, v value) (err error) { c.Scan.ExtraAddrs, err = v.loopbackAddrs(); return },
+		"discover_addresses": func(c *Config, v value) (err error) { c.Scan.DiscoverAddrs, err = v.boolean(); return },
+		"slow_threshold":     func(c *Config, v value) (err error) { c.Scan.SlowThreshold, err = v.duration(); return },
+	},
+	"probe": {
+		"dial_timeout": func(c *Config, v value) (err error) { c.Probe.DialTimeout, err = v.duration(); return },
+		"read_timeout": func(c *Config, v value) (err error) { c.Probe.ReadTimeout, err = v.duration(); return },
+		"api_spec":     func(c *Config, v value) (err error) { c.Probe.APISpec, err = v.boolean(); return },
+		"headers":      func(c *Config, v value) (err error) { c.Probe.Headers, err = v.headers(); return },
+		"paths":        func(c *Config, v value) (err error) { c.Probe.Paths, err = v.requestPaths(); return },
+		"client_cert":  func(c *Config, v value) (err error) { c.Probe.ClientCert, err = v.path(); return },
+		"client_key":   func(c *Config, v value) (err error) { c.Probe.ClientKey, err = v.path(); return },
+		"vhosts":       func(c *Config, v value) (err error) { c.Probe.VHosts, err = v.hostnames(); return },
+		"traefik_api":  func(c *Config, v value) (err error) { c.Probe.TraefikAPI, err = v.addr(); return },
+		"caddy_api":    func(c *Config, v value) (err error) { c.Probe.CaddyAPI, err = v.addr(); return },
+	},
+	"proxy": {
+		"listen":              func(c *Config, v value) (err error) { c.Proxy.Listen, err = v.addr(); return },
+		"fallback_listen":     func(c *Config, v value) (err error) { c.Proxy.FallbackListen, err = v.addr(); return },
+		"tls_listen":          func(c *Config, v value) (err error) { c.Proxy.TLSListen, err = v.addr(); return },
+		"tls_fallback_listen": func(c *Config, v value) (err error) { c.Proxy.TLSFallbackListen, err = v.addr(); return },
+		"path_listen":         func(c *Config, v value) (err error) { c.Proxy.PathListen, err = v.addr(); return },
+		"keep_prefix":         func(c *Config, v value) (err error) { c.Proxy.KeepPrefix, err = v.strings(); return },
+	},
+	"dns": {
+		"listen": func(c *Config, v value) (err error) { c.DNS.Listen, err = v.addr(); return },
+	},
+	"registry": {
+		"retention_days": func(c *Config, v value) (err error) { c.Registry.Retention, err = v.days(); return },
+		"history":        func(c *Config, v value) (err error) { c.Registry.History, err = v.count(); return },
+	},
+	"health": {
+		"slow":           func(c *Config, v value) (err error) { c.Health.Slow, err = v.duration(); return },
+		"degraded_after": func(c *Config, v value) (err error) { c.Health.DegradedAfter, err = v.count(); return },
+		"down_after":     func(c *Config, v value) (err error) { c.Health.DownAfter, err = v.count(); return },
+		"recover_after":  func(c *Config, v value) (err error) { c.Health.RecoverAfter, err = v.count(); return },
+	},
+	"notify": {
+		"enabled":  func(c *Config, v value) (err error) { c.Notify.Enabled, err = v.boolean(); return },
+		"backend":  func(c *Config, v value) (err error) { c.Notify.Backend, err = v.notifyBackend(); return },
+		"events":   func(c *Config, v value) (err error) { c.Notify.Events, err = v.notifyEvents(); return },
+		"services": func(c *Config, v value) (err error) { c.Notify.Services, err = v.namePatterns(); return },
+		"interval": func(c *Config, v value) (err error) { c.Notify.Interval, err = v.duration(); return },
+		"grace":    func(c *Config, v value) (err error) { c.Notify.Grace, err = v.duration(); return },
+	},
+}
+
+// set applies one setting
+func (c *Config) set(table, key string, v value) error {
+	switch table {
+	case "names":
+		return c.pin(key, v)
+	case "auth":
+		return c.addAuth(key, v)
+	case "rewrite":
+		return c.addRewrite(key, v)
+	}
+	if table == "" {
+		return fmt.Errorf("%s must be in a table such as [scan]", key)
+	}
+	fields, ok := setters[table]
+	if !ok {
+		return fmt.Errorf("unknown table [%s]", table)
+	}
+	set, ok := fields[key]
+	if !ok {
+		return fmt.Errorf("unknown setting %s in [%s]", key, table)
+	}
+	return set(c, v)
+}
+
+// pin records a name -> port pin
+func (c *Config) pin(name string, v value) error {
+	host := strings.ToLower(name)
+	if !strings.HasSuffix(host, ".localhost") {
+		host += ".localhost"
+	}
+	label := strings.TrimSuffix(host, ".localhost")
+	if !validName(label) {
+		return fmt.Errorf("invalid name %q: use letters, digits, '-' and '.'", name)
+	}
+	port, err := v.port()
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	for other, p := range c.Names {
+		if p == port && other != host {
+			return fmt.Errorf("%s and %s can't both be pinned to port %d", other, host, port)
+		}
+	}
+	if c.Names == nil {
+		c.Names = make(map[string]int)
+	}
+	c.Names[host] = port
+	return nil
+}
+
+// addAuth records the credentials of the services key matches, given as
+// one spec or an array of them
+func (c *Config) addAuth(key string, v value) error {
+	specs, err := v.authSpecs()
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	rule, err := credentials.ParseRule(key, specs)
+	if err != nil {
+		return err
+	}
+	for i, other := range c.Auth {
+		if other.Match() == rule.Match() {
+			// An environment variable overrides the file
+			c.Auth[i] = rule
+			return nil
+		}
+	}
+	c.Auth = append(c.Auth, rule)
+	return nil
+}
+
+// addRewrite records the rewrite actions of the services key matches,
+// given as one action or an array of them. A bad action is reported at
+// its own line.
+func (c *Config) addRewrite(key string, v value) error {
+	pattern, err := rewrite.ParsePattern(key)
+	if err != nil {
+		return err
+	}
+	items := []value{v}
+	if _, ok := v.v.(string); !ok || v.env {
+		if items, err = v.list(); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	if len(items) == 0 {
+		return fmt.Errorf("%w for %s: no actions given", rewrite.ErrInvalidAction, key)
+	}
+	rule := rewrite.Rule{Pattern: pattern}
+	for _, item := range items {
+		spec, err := item.str()
+		var action rewrite.Action
+		if err == nil {
+			action, err = rewrite.ParseAction(spec)
+		}
+		if err != nil {
+			return &itemError{line: item.line, err: fmt.Errorf("%s: %w", key, err)}
+		}
+		rule.Actions = append(rule.Actions, action)
+	}
+	for i, other := range c.Rewrite {
+		if other.Pattern == rule.Pattern {
+			// An environment variable overrides the file
+			c.Rewrite[i] = rule
+			return nil
+		}
+	}
+	c.Rewrite = append(c.Rewrite, rule)
+	return nil
+}
+
+// validName reports whether s is usable in front of .localhost
+func validName(s string) bool {
+	if s == "" || strings.HasPrefix(s, "-") || strings.HasSuffix(s, "-") || strings.Contains(s, "..") {
+		return false
+	}
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// ScanPort reports whether listeners on port should be looked at
+func (c *Config) ScanPort(port int) bool {
+	if len(c.Scan.Ports) > 0 && !inRanges(c.Scan.Ports, port) {
+		return false
+	}
+	return !inRanges(c.Scan.IgnorePorts, port)
+}
+
+// PriorityPorts returns the ports of Scan.PriorityPorts, nil if it isn't
+// set
+func (c *Config) PriorityPorts() []int {
+	if c.Scan.PriorityPorts == nil {
+		return nil
+	}
+	ports := []int{}
+	for _, r := range c.Scan.PriorityPorts {
+		for port := r.From; port <= r.To; port++ {
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
+
+// IgnoreProcess reports whether a listener owned by the executable should
+// be left alone. A pattern without a slash matches the executable's name,
+// one with a slash its whole path, using filepath.Match syntax; a pattern
+// ending in a slash matches everything under that directory.
+func (c *Config) IgnoreProcess(exePath string) bool {
+	for _, pattern := range c.Scan.IgnoreProcesses {
+		if exclude.MatchProcess(pattern, exePath) {
+			return true
+		}
+	}
+	return false
+}
+
+// Exclusions returns every exclusion rule of the scan settings: the
+// ignored ports and processes as rules, then Scan.Exclude
+func (c *Config) Exclusions() exclude.Rules {
+	var rules exclude.Rules
+	for _, r := range c.Scan.IgnorePorts {
+		rules = append(rules, exclude.Rule{Kind: exclude.KindPort, From: r.From, To: r.To})
+	}
+	for _, pattern := range c.Scan.IgnoreProcesses {
+		rules = append(rules, exclude.Rule{Kind: exclude.KindProcess, Pattern: pattern})
+	}
+	return append(rules, c.Scan.Exclude...)
+}
+
+// PinnedName returns the name pinned to port, if any
+func (c *Config) PinnedName(port int) (string, bool) {
+	for name, p := range c.Names {
+		if p == port {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// HealthThresholds returns the health settings as thresholds, zero fields
+// left to the defaults
+func (c *Config) HealthThresholds() health.Thresholds {
+	return health.Thresholds{
+		Slow:          c.Health.Slow,
+		DegradedAfter: c.Health.DegradedAfter,
+		DownAfter:     c.Health.DownAfter,
+		RecoverAfter:  c.Health.RecoverAfter,
+	}
+}
+
+// RouteOptions returns the [probe] settings for finding the apps reverse
+// proxies serve, probing them with opts
+func (c *Config) RouteOptions(opts probe.ProbeOptions) probe.RouteOptions {
+	return probe.RouteOptions{
+		TraefikAPI: c.Probe.TraefikAPI,
+		CaddyAPI:   c.Probe.CaddyAPI,
+		Candidates: c.Probe.VHosts,
+		Probe:      opts,
+	}
+}
+
+// NotifyOptions returns the [notify] settings as notifier options
+func (c *Config) NotifyOptions() notify.Options {
+	return notify.Options{
+		Events:   c.Notify.Events,
+		Services: c.Notify.Services,
+		Interval: c.Notify.Interval,
+		Grace:    c.Notify.Grace,
+	}
+}
+
+func inRanges(ranges []PortRange, port int) bool {
+	for _, r := range ranges {
+		if r.Contains(port) {
+			return true
+		}
+	}
+	return false
+}
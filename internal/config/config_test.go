@@ -0,0 +1,286 @@
+package config
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"localhost-magic/internal/discover"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want Config
+	}{
+		{"empty", "", Config{}},
+		{"comments and blank lines", "# settings\n\n[scan] # the scanner\n  # nothing yet\n", Config{}},
+		{
+			"scan",
+			`[scan]
+ports = ["3000-9999", 443]
+ignore_ports = ["63342", "6942-6991"]
+ignore_processes = ['idea', "/opt/JetBrains/"]
+interval = "2s"
+priority_ports = []
+extra_addresses = ["127.0.0.2"]
+discover_addresses = true
+`,
+			Config{Scan: ScanConfig{
+				Ports:           []PortRange{{3000, 9999}, {443, 443}},
+				IgnorePorts:     []PortRange{{63342, 63342}, {6942, 6991}},
+				IgnoreProcesses: []string{"idea", "/opt/JetBrains/"},
+				Interval:        2 * time.Second,
+				PriorityPorts:   []PortRange{},
+				ExtraAddrs:      []string{"127.0.0.2"},
+				DiscoverAddrs:   true,
+			}},
+		},
+		{
+			"arrays across lines with a trailing comma",
+			"[probe]\npaths = [\n  \"/\",   # the root first\n  \"/health\",\n]\n",
+			Config{Probe: ProbeConfig{Paths: []string{"/", "/health"}}},
+		},
+		{
+			"escapes and literal strings",
+			`[probe]
+headers = ["X-Note: a\tb \"q\" \u00e9", 'X-Path: C:\dev']
+`,
+			Config{Probe: ProbeConfig{Headers: map[string]string{"X-Note": "a\tb \"q\" é", "X-Path": `C:\dev`}}},
+		},
+		{
+			"integers",
+			"[registry]\nretention_days = 1_0\nhistory = 0x10\n\n[health]\ndown_after = 5\n",
+			Config{Registry: RegistryConfig{Retention: 10 * 24 * time.Hour, History: 16}, Health: HealthConfig{DownAfter: 5}},
+		},
+		{
+			"CRLF line endings",
+			"[dns]\r\nlisten = \"127.0.0.1:5354\"\r\n",
+			Config{DNS: DNSConfig{Listen: "127.0.0.1:5354"}},
+		},
+		{
+			"quoted keys and names",
+			"[names]\n\"api\" = 8080\n'shop.localhost' = 3000\n\n[notify]\nenabled = false\nevents = [\"down\"]\n",
+			Config{
+				Names:  map[string]int{"api.localhost": 8080, "shop.localhost": 3000},
+				Notify: NotifyConfig{Events: []discover.EventType{"down"}},
+			},
+		},
+		{
+			"no newline at the end",
+			"[proxy]\nlisten = \":80\"",
+			Config{Proxy: ProxyConfig{Listen: ":80"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := Parse("config.toml", tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*c, tt.want) {
+				t.Errorf("got %+v\nwant %+v", *c, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseAuthAndRewrite(t *testing.T) {
+	c, err := Parse("config.toml", `[auth]
+api = "bearer dev-token-123"
+8443 = ["basic admin:hunter2"]
+
+[rewrite]
+api = ["prefix /api/ /api/v1/", "request set X-Tenant: dev"]
+"web*" = "response remove Server"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Auth) != 2 || c.Auth[0].Match() != "api" || c.Auth[1].Match() != "8443" {
+		t.Errorf("Auth = %+v, want api then 8443", c.Auth)
+	}
+	if len(c.Rewrite) != 2 || len(c.Rewrite[0].Actions) != 2 || len(c.Rewrite[1].Actions) != 1 {
+		t.Errorf("Rewrite = %+v, want api with 2 actions then web* with 1", c.Rewrite)
+	}
+}
+
+// Every problem in a file comes back, in line order, until a syntax
+// error, past which the file isn't read
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []string
+	}{
+		{
+			"unknown keys and tables",
+			"[scan]\nport = [3000]\n\n[scanner]\nports = [3000]\n",
+			[]string{
+				"config.toml:2: unknown setting port in [scan]",
+				"config.toml:5: unknown table [scanner]",
+			},
+		},
+		{
+			"top-level key",
+			"interval = \"2s\"\n",
+			[]string{"config.toml:1: interval must be in a table such as [scan]"},
+		},
+		{
+			"bad types",
+			`[scan]
+interval = 2
+discover_addresses = "yes"
+ports = "3000"
+
+[registry]
+history = "100"
+
+[probe]
+dial_timeout = "fast"
+`,
+			[]string{
+				`config.toml:2: expected a duration such as "500ms", got an integer`,
+				"config.toml:3: expected true or false, got a string",
+				"config.toml:4: expected an array, got a string",
+				"config.toml:7: expected a number, got a string",
+				`config.toml:10: invalid duration "fast"`,
+			},
+		},
+		{
+			"out of range",
+			"[scan]\nports = [70000, \"9000-8000\"]\n\n[health]\ndown_after = 0\n",
+			[]string{
+				"config.toml:2: port 70000 out of range 1-65535",
+				"config.toml:5: 0 out of range 1-100",
+			},
+		},
+		{
+			"duplicate tables and keys",
+			"[scan]\ninterval = \"1s\"\ninterval = \"2s\"\n\n[probe]\n\n[scan]\n",
+			[]string{
+				"config.toml:3: scan.interval already set on line 2",
+				"config.toml:7: table [scan] already defined on line 1",
+			},
+		},
+		{
+			"a bad array item at its own line",
+			"[rewrite]\napi = [\n  \"prefix /api/ /v1/\",\n  \"explode\",\n]\n",
+			[]string{`config.toml:4: api: invalid rewrite: unknown action "explode", expected prefix, path, host, request or response`},
+		},
+		{
+			"unquoted string",
+			"[proxy]\nlisten = :80\n[dns]\nlisten = 1\n",
+			[]string{`config.toml:2: invalid value ":80" (strings must be quoted)`},
+		},
+		{
+			"unterminated string",
+			"[scan]\n\ninterval = \"2s\n",
+			[]string{"config.toml:3: unterminated string"},
+		},
+		{
+			"unterminated array",
+			"[scan]\nports = [3000,\n  4000\n",
+			[]string{"config.toml:2: unterminated array"},
+		},
+		{
+			"trailing garbage",
+			"[scan] extra\n",
+			[]string{`config.toml:1: unexpected "extra" after value`},
+		},
+		{
+			"unsupported syntax",
+			"[scan]\ninterval = \"2s\"\nscan.ports = [1]\n",
+			[]string{"config.toml:3: dotted keys are not supported; use a [table]"},
+		},
+		{
+			"inline table",
+			"[names]\napi = { port = 8080 }\n",
+			[]string{"config.toml:2: inline tables are not supported"},
+		},
+		{
+			"array of tables",
+			"\n[[scan]]\n",
+			[]string{"config.toml:2: arrays of tables are not supported"},
+		},
+		{
+			"bad escape",
+			"[probe]\nheaders = [\"X-A: \\q\"]\n",
+			[]string{`config.toml:2: invalid escape \q`},
+		},
+		{
+			"semantic errors before a syntax error",
+			"[scan]\ninterval = 2\n\n[probe]\nread_timeout = \n",
+			[]string{
+				`config.toml:2: expected a duration such as "500ms", got an integer`,
+				"config.toml:5: expected a value",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := Parse("config.toml", tt.src)
+			if err == nil {
+				t.Fatalf("no error, parsed %+v", *c)
+			}
+			if got := strings.Split(err.Error(), "\n"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("errors:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+			for _, e := range splitErrors(err) {
+				var ce *Error
+				if !errors.As(e, &ce) || ce.Path != "config.toml" || ce.Line == 0 {
+					t.Errorf("%v is not an *Error with a path and line", e)
+				}
+			}
+		})
+	}
+}
+
+// splitErrors returns the errors joined in err
+func splitErrors(err error) []error {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return joined.Unwrap()
+	}
+	return []error{err}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := Load(filepath.Join(dir, "missing.toml")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("missing file: %v, want fs.ErrNotExist", err)
+	}
+	path := filepath.Join(dir, "config.toml")
+	if err := os.WriteFile(path, []byte("[dns]\nlisten = 53\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := Load(path)
+	if want := path + ":2: expected a string, got an integer"; err == nil || err.Error() != want {
+		t.Errorf("Load = %v, want %s", err, want)
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	c := &Config{Scan: ScanConfig{Interval: time.Second}}
+	err := c.ApplyEnv([]string{
+		"HOME=/home/dev",
+		"LOCALHOST_MAGIC_SCAN_PORTS=3000-3999, 8080",
+		"LOCALHOST_MAGIC_SCAN_INTERVAL=5s",
+		"LOCALHOST_MAGIC_NAMES_API=8080",
+		"LOCALHOST_MAGIC_SCAN_PORT=1",
+		"LOCALHOST_MAGIC_HEALTH_DOWN_AFTER=many",
+	})
+	want := "LOCALHOST_MAGIC_SCAN_PORT: unknown setting port in [scan]\n" +
+		`LOCALHOST_MAGIC_HEALTH_DOWN_AFTER: invalid number "many"`
+	if err == nil || err.Error() != want {
+		t.Errorf("ApplyEnv = %v, want %s", err, want)
+	}
+	if !reflect.DeepEqual(c.Scan.Ports, []PortRange{{3000, 3999}, {8080, 8080}}) || c.Scan.Interval != 5*time.Second || c.Names["api.localhost"] != 8080 {
+		t.Errorf("after ApplyEnv: %+v", c)
+	}
+}
@@ -0,0 +1,361 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The file format is the part of TOML the settings need: [tables],
+// key = value pairs, basic and literal strings, integers, booleans and
+// arrays, which may span lines. Dotted keys, inline tables, floats and
+// dates are rejected.
+
+// entry is one key = value pair with where it was found
+type entry struct {
+	table string // "" at the top level
+	key   string
+	value value
+}
+
+// value is a parsed TOML value: string, int64, bool or []value
+type value struct {
+	v    any
+	line int
+	env  bool // From an environment variable, so every value is a string
+}
+
+// parser reads a file up to its first syntax error, after which the rest
+// can't be trusted to mean anything
+type parser struct {
+	src  string
+	pos  int
+	line int
+	errs []error
+	path string
+}
+
+// parse returns the entries of a config file
+func parse(path, src string) ([]entry, []error) {
+	p := &parser{src: src, line: 1, path: path}
+	var entries []entry
+	table := ""
+	seen := make(map[string]int) // "table.key" -> line
+	tables := make(map[string]int)
+
+	for {
+		p.skipBlank()
+		if p.eof() {
+			break
+		}
+		start := p.line
+		if p.peek() == '[' {
+			name, err := p.tableHeader()
+			if err == nil {
+				err = p.endOfLine()
+			}
+			if err != nil {
+				p.errs = append(p.errs, err)
+				break
+			}
+			if first, dup := tables[name]; dup {
+				p.errs = append(p.errs, p.errorAt(start, "table [%s] already defined on line %d", name, first))
+			}
+			tables[name] = start
+			table = name
+			continue
+		}
+
+		key, err := p.key()
+		if err == nil {
+			err = p.expect('=')
+		}
+		var v value
+		if err == nil {
+			v, err = p.value()
+		}
+		if err == nil {
+			err = p.endOfLine()
+		}
+		if err != nil {
+			p.errs = append(p.errs, err)
+			break
+		}
+		full := key
+		if table != "" {
+			full = table + "." + key
+		}
+		if first, dup := seen[full]; dup {
+			p.errs = append(p.errs, p.errorAt(start, "%s already set on line %d", full, first))
+			continue
+		}
+		seen[full] = start
+		entries = append(entries, entry{table: table, key: key, value: v})
+	}
+	return entries, p.errs
+}
+
+func (p *parser) errorAt(line int, format string, args ...any) *Error {
+	return &Error{Path: p.path, Line: line, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) errorf(format string, args ...any) *Error {
+	return p.errorAt(p.line, format, args...)
+}
+
+func (p *parser) eof() bool { return p.pos >= len(p.src) }
+
+func (p *parser) peek() byte { return p.src[p.pos] }
+
+// skipSpace skips spaces and tabs on the current line
+func (p *parser) skipSpace() {
+	for !p.eof() && (p.peek() == ' ' || p.peek() == '\t') {
+		p.pos++
+	}
+}
+
+// skipComment skips a comment running to the end of the line
+func (p *parser) skipComment() {
+	if !p.eof() && p.peek() == '#' {
+		for !p.eof() && p.peek() != '\n' {
+			p.pos++
+		}
+	}
+}
+
+// skipBlank skips whitespace, newlines and comments
+func (p *parser) skipBlank() {
+	for !p.eof() {
+		switch p.peek() {
+		case ' ', '\t', '\r':
+			p.pos++
+		case '\n':
+			p.pos++
+			p.line++
+		case '#':
+			p.skipComment()
+		default:
+			return
+		}
+	}
+}
+
+// endOfLine accepts trailing space and a comment before the newline
+func (p *parser) endOfLine() error {
+	p.skipSpace()
+	p.skipComment()
+	if p.eof() {
+		return nil
+	}
+	switch p.peek() {
+	case '\n':
+		return nil
+	case '\r':
+		if p.pos+1 < len(p.src) && p.src[p.pos+1] == '\n' {
+			return nil
+		}
+	}
+	return p.errorf("unexpected %q after value", p.rest())
+}
+
+// rest returns what is left of the line, for error messages
+func (p *parser) rest() string {
+	end := strings.IndexByte(p.src[p.pos:], '\n')
+	if end < 0 {
+		end = len(p.src) - p.pos
+	}
+	return strings.TrimSpace(p.src[p.pos : p.pos+end])
+}
+
+func (p *parser) expect(c byte) error {
+	p.skipSpace()
+	if p.eof() || p.peek() != c {
+		return p.errorf("expected %q", c)
+	}
+	p.pos++
+	return nil
+}
+
+// tableHeader parses [name]
+func (p *parser) tableHeader() (string, error) {
+	p.pos++ // [
+	p.skipSpace()
+	if !p.eof() && p.peek() == '[' {
+		return "", p.errorf("arrays of tables are not supported")
+	}
+	name, err := p.key()
+	if err != nil {
+		return "", err
+	}
+	if err := p.expect(']'); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// key parses a bare or quoted key
+func (p *parser) key() (string, error) {
+	p.skipSpace()
+	if p.eof() {
+		return "", p.errorf("expected a key")
+	}
+	switch p.peek() {
+	case '"':
+		return p.basicString()
+	case '\'':
+		return p.literalString()
+	}
+	start := p.pos
+	for !p.eof() && isBareKeyChar(p.peek()) {
+		p.pos++
+	}
+	if p.pos == start {
+		return "", p.errorf("expected a key, found %q", p.rest())
+	}
+	if !p.eof() && p.peek() == '.' {
+		return "", p.errorf("dotted keys are not supported; use a [table]")
+	}
+	return p.src[start:p.pos], nil
+}
+
+func isBareKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+// value parses a string, integer, boolean or array
+func (p *parser) value() (value, error) {
+	p.skipSpace()
+	line := p.line
+	if p.eof() || p.peek() == '\n' || p.peek() == '#' {
+		return value{}, p.errorf("expected a value")
+	}
+	switch c := p.peek(); {
+	case c == '"':
+		s, err := p.basicString()
+		return value{v: s, line: line}, err
+	case c == '\'':
+		s, err := p.literalString()
+		return value{v: s, line: line}, err
+	case c == '[':
+		return p.array()
+	case c == '{':
+		return value{}, p.errorf("inline tables are not supported")
+	}
+
+	start := p.pos
+	for !p.eof() && !strings.ContainsRune(" \t\r\n#,]", rune(p.peek())) {
+		p.pos++
+	}
+	word := p.src[start:p.pos]
+	switch word {
+	case "true":
+		return value{v: true, line: line}, nil
+	case "false":
+		return value{v: false, line: line}, nil
+	}
+	n, err := strconv.ParseInt(strings.ReplaceAll(word, "_", ""), 0, 64)
+	if err != nil {
+		return value{}, p.errorAt(line, "invalid value %q (strings must be quoted)", word)
+	}
+	return value{v: n, line: line}, nil
+}
+
+// array parses [v, v, ...], which may span lines and end with a comma
+func (p *parser) array() (value, error) {
+	line := p.line
+	p.pos++ // [
+	var items []value
+	for {
+		p.skipBlank()
+		if p.eof() {
+			return value{}, p.errorAt(line, "unterminated array")
+		}
+		if p.peek() == ']' {
+			p.pos++
+			return value{v: items, line: line}, nil
+		}
+		item, err := p.value()
+		if err != nil {
+			return value{}, err
+		}
+		items = append(items, item)
+		p.skipBlank()
+		if p.eof() {
+			return value{}, p.errorAt(line, "unterminated array")
+		}
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case ']':
+		default:
+			return value{}, p.errorf("expected ',' or ']' in array")
+		}
+	}
+}
+
+// basicString parses "..." with TOML escapes
+func (p *parser) basicString() (string, error) {
+	if strings.HasPrefix(p.src[p.pos:], `"""`) {
+		return "", p.errorf("multi-line strings are not supported")
+	}
+	p.pos++ // "
+	var b strings.Builder
+	for {
+		if p.eof() || p.peek() == '\n' {
+			return "", p.errorf("unterminated string")
+		}
+		c := p.peek()
+		p.pos++
+		switch c {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			if p.eof() {
+				return "", p.errorf("unterminated string")
+			}
+			esc := p.peek()
+			p.pos++
+			switch esc {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case '"', '\\':
+				b.WriteByte(esc)
+			case 'u', 'U':
+				size := 4
+				if esc == 'U' {
+					size = 8
+				}
+				if p.pos+size > len(p.src) {
+					return "", p.errorf("invalid \\%c escape", esc)
+				}
+				code, err := strconv.ParseUint(p.src[p.pos:p.pos+size], 16, 32)
+				if err != nil || !utf8.ValidRune(rune(code)) {
+					return "", p.errorf("invalid \\%c escape", esc)
+				}
+				b.WriteRune(rune(code))
+				p.pos += size
+			default:
+				return "", p.errorf("invalid escape \\%c", esc)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+}
+
+// literalString parses '...', which has no escapes
+func (p *parser) literalString() (string, error) {
+	p.pos++ // '
+	end := strings.IndexAny(p.src[p.pos:], "'\n")
+	if end < 0 || p.src[p.pos+end] == '\n' {
+		return "", p.errorf("unterminated string")
+	}
+	s := p.src[p.pos : p.pos+end]
+	p.pos += end + 1
+	return s, nil
+}
@@ -0,0 +1,408 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"localhost-magic/internal/discover"
+	"localhost-magic/internal/exclude"
+	"localhost-magic/internal/notify"
+	"localhost-magic/probe"
+)
+
+// The accessors convert a value to what a setting needs. Values from the
+// environment are always strings; those of list settings are split on
+// commas, and their numbers parsed.
+
+// str returns a string value
+func (v value) str() (string, error) {
+	s, ok := v.v.(string)
+	if !ok {
+		return "", fmt.Errorf("expected a string, got %s", v.kind())
+	}
+	return s, nil
+}
+
+// port returns an integer in 1-65535
+func (v value) port() (int, error) {
+	var n int64
+	switch x := v.v.(type) {
+	case int64:
+		n = x
+	case string:
+		if !v.env {
+			return 0, fmt.Errorf("expected a port number, got a string")
+		}
+		var err error
+		if n, err = strconv.ParseInt(strings.TrimSpace(x), 10, 64); err != nil {
+			return 0, fmt.Errorf("invalid port %q", x)
+		}
+	default:
+		return 0, fmt.Errorf("expected a port number, got %s", v.kind())
+	}
+	if n < 1 || n > 65535 {
+		return 0, fmt.Errorf("port %d out of range 1-65535", n)
+	}
+	return int(n), nil
+}
+
+// boolean returns true or false, spelled that way in the environment too
+func (v value) boolean() (bool, error) {
+	switch x := v.v.(type) {
+	case bool:
+		return x, nil
+	case string:
+		if !v.env {
+			return false, fmt.Errorf("expected true or false, got a string")
+		}
+		b, err := strconv.ParseBool(strings.TrimSpace(x))
+		if err != nil {
+			return false, fmt.Errorf("invalid boolean %q", x)
+		}
+		return b, nil
+	}
+	return false, fmt.Errorf("expected true or false, got %s", v.kind())
+}
+
+// duration returns a string such as "500ms" parsed as a duration
+func (v value) duration() (time.Duration, error) {
+	s, err := v.str()
+	if err != nil {
+		return 0, fmt.Errorf("expected a duration such as \"500ms\", got %s", v.kind())
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
+
+// days returns a whole number of days, at least one, as a duration
+func (v value) days() (time.Duration, error) {
+	var n int64
+	switch x := v.v.(type) {
+	case int64:
+		n = x
+	case string:
+		if !v.env {
+			return 0, fmt.Errorf("expected a number of days, got a string")
+		}
+		var err error
+		if n, err = strconv.ParseInt(strings.TrimSpace(x), 10, 64); err != nil {
+			return 0, fmt.Errorf("invalid number of days %q", x)
+		}
+	default:
+		return 0, fmt.Errorf("expected a number of days, got %s", v.kind())
+	}
+	if n < 1 || n > 36500 {
+		return 0, fmt.Errorf("%d days out of range 1-36500", n)
+	}
+	return time.Duration(n) * 24 * time.Hour, nil
+}
+
+// count returns a number of times, in 1-100
+func (v value) count() (int, error) {
+	var n int64
+	switch x := v.v.(type) {
+	case int64:
+		n = x
+	case string:
+		if !v.env {
+			return 0, fmt.Errorf("expected a number, got a string")
+		}
+		var err error
+		if n, err = strconv.ParseInt(strings.TrimSpace(x), 10, 64); err != nil {
+			return 0, fmt.Errorf("invalid number %q", x)
+		}
+	default:
+		return 0, fmt.Errorf("expected a number, got %s", v.kind())
+	}
+	if n < 1 || n > 100 {
+		return 0, fmt.Errorf("%d out of range 1-100", n)
+	}
+	return int(n), nil
+}
+
+// addr returns a listen address such as ":80" or "127.0.0.1:5354"
+func (v value) addr() (string, error) {
+	s, err := v.str()
+	if err != nil {
+		return "", err
+	}
+	if _, port, err := net.SplitHostPort(s); err != nil {
+		return "", fmt.Errorf("invalid address %q: %v", s, err)
+	} else if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return "", fmt.Errorf("invalid port in address %q", s)
+	}
+	return s, nil
+}
+
+// path returns a file path, with a leading "~/" standing for the home
+// directory
+func (v value) path() (string, error) {
+	s, err := v.str()
+	if err != nil {
+		return "", err
+	}
+	if rest, ok := strings.CutPrefix(s, "~/"); ok {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("can't expand %q: %v", s, err)
+		}
+		s = filepath.Join(home, rest)
+	}
+	if s == "" {
+		return "", fmt.Errorf("expected a file path, got an empty string")
+	}
+	return s, nil
+}
+
+// list returns the items of an array, or of a comma-separated
+// environment value
+func (v value) list() ([]value, error) {
+	switch x := v.v.(type) {
+	case []value:
+		return x, nil
+	case string:
+		if v.env {
+			var items []value
+			for _, part := range strings.Split(x, ",") {
+				if part = strings.TrimSpace(part); part != "" {
+					items = append(items, value{v: part, env: true})
+				}
+			}
+			return items, nil
+		}
+	}
+	return nil, fmt.Errorf("expected an array, got %s", v.kind())
+}
+
+// strings returns an array of strings
+func (v value) strings() ([]string, error) {
+	items, err := v.list()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, 0, len(items))
+	for _, item := range items {
+		s, err := item.str()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+// loopbackAddrs returns an array of loopback IP addresses, e.g.
+// "127.0.0.2"
+func (v value) loopbackAddrs() ([]string, error) {
+	items, err := v.strings()
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		if ip := net.ParseIP(item); ip == nil || !ip.IsLoopback() {
+			return nil, fmt.Errorf("invalid address %q: expected a loopback IP address such as 127.0.0.2", item)
+		}
+	}
+	return items, nil
+}
+
+// exclusions returns an array of exclusion rules, such as 4381,
+// "6942-6991" or "process:Spotify*"; a port may be given as a number
+func (v value) exclusions() (exclude.Rules, error) {
+	items, err := v.list()
+	if err != nil {
+		return nil, err
+	}
+	specs := make([]string, 0, len(items))
+	for _, item := range items {
+		if n, ok := item.v.(int64); ok {
+			specs = append(specs, strconv.FormatInt(n, 10))
+			continue
+		}
+		s, err := item.str()
+		if err != nil {
+			return nil, fmt.Errorf("expected a port or a rule string, got %s", item.kind())
+		}
+		specs = append(specs, s)
+	}
+	rules, err := exclude.ParseAll(specs)
+	if err != nil {
+		// One message per setting, however many rules are malformed
+		return nil, errors.New(strings.ReplaceAll(err.Error(), "\n", "; "))
+	}
+	return rules, nil
+}
+
+// headers returns an array of "Name: value" request headers
+func (v value) headers() (map[string]string, error) {
+	items, err := v.strings()
+	if err != nil {
+		return nil, err
+	}
+	headers := make(map[string]string, len(items))
+	for _, item := range items {
+		name, value, err := probe.ParseHeader(item)
+		if err != nil {
+			return nil, err
+		}
+		for other := range headers {
+			if strings.EqualFold(other, name) {
+				return nil, fmt.Errorf("header %s given twice", name)
+			}
+		}
+		headers[name] = value
+	}
+	return headers, nil
+}
+
+// authSpecs returns the credential specs of an [auth] entry, a string or
+// an array of strings such as "bearer TOKEN"
+func (v value) authSpecs() ([]string, error) {
+	if s, ok := v.v.(string); ok && !v.env {
+		return []string{s}, nil
+	}
+	return v.strings()
+}
+
+// requestPaths returns an array of request paths, e.g. "/health"
+func (v value) requestPaths() ([]string, error) {
+	items, err := v.strings()
+	if err != nil {
+		return nil, err
+	}
+	if err := probe.ValidatePaths(items); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// hostnames returns an array of hostnames, e.g. "shop.test"
+func (v value) hostnames() ([]string, error) {
+	items, err := v.strings()
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		if item == "" || strings.ContainsAny(item, ":/?#@* \t") {
+			return nil, fmt.Errorf("invalid hostname %q", item)
+		}
+	}
+	return items, nil
+}
+
+// notifyBackend returns the name of a notification backend
+func (v value) notifyBackend() (string, error) {
+	s, err := v.str()
+	if err != nil {
+		return "", err
+	}
+	for _, name := range notify.Backends {
+		if s == name {
+			return s, nil
+		}
+	}
+	return "", fmt.Errorf("unknown backend %q, expected one of %s", s, strings.Join(notify.Backends, ", "))
+}
+
+// notifyEvents returns an array of the event types notify.Events lists
+func (v value) notifyEvents() ([]discover.EventType, error) {
+	items, err := v.strings()
+	if err != nil {
+		return nil, err
+	}
+	events := make([]discover.EventType, 0, len(items))
+	for _, item := range items {
+		if !slices.Contains(notify.Events, discover.EventType(item)) {
+			names := make([]string, len(notify.Events))
+			for i, e := range notify.Events {
+				names[i] = string(e)
+			}
+			return nil, fmt.Errorf("unknown event %q, expected one of %s", item, strings.Join(names, ", "))
+		}
+		events = append(events, discover.EventType(item))
+	}
+	return events, nil
+}
+
+// namePatterns returns an array of service name patterns, e.g. "api*"
+func (v value) namePatterns() ([]string, error) {
+	items, err := v.strings()
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		if _, err := filepath.Match(item, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", item, err)
+		}
+	}
+	return items, nil
+}
+
+// portRanges returns an array of ports and "from-to" ranges
+func (v value) portRanges() ([]PortRange, error) {
+	items, err := v.list()
+	if err != nil {
+		return nil, err
+	}
+	ranges := make([]PortRange, 0, len(items))
+	for _, item := range items {
+		r, err := item.portRange()
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// portRange returns a port number, or a string "3000" or "3000-3999"
+func (v value) portRange() (PortRange, error) {
+	if _, ok := v.v.(int64); ok {
+		port, err := v.port()
+		return PortRange{port, port}, err
+	}
+	s, err := v.str()
+	if err != nil {
+		return PortRange{}, fmt.Errorf("expected a port or range, got %s", v.kind())
+	}
+	fromStr, toStr, isRange := strings.Cut(s, "-")
+	from, err := value{v: fromStr, env: true}.port()
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port range %q: %w", s, err)
+	}
+	to := from
+	if isRange {
+		if to, err = (value{v: toStr, env: true}).port(); err != nil {
+			return PortRange{}, fmt.Errorf("invalid port range %q: %w", s, err)
+		}
+	}
+	if from > to {
+		return PortRange{}, fmt.Errorf("invalid port range %q: start is after end", s)
+	}
+	return PortRange{from, to}, nil
+}
+
+// kind names the value's type for error messages
+func (v value) kind() string {
+	switch v.v.(type) {
+	case string:
+		return "a string"
+	case int64:
+		return "an integer"
+	case bool:
+		return "a boolean"
+	case []value:
+		return "an array"
+	}
+	return "nothing"
+}
@@ -0,0 +1,196 @@
+// Package credentials holds what the probe authenticates with to local services
+// that bounce anonymous requests to a login page. Rules from the [auth]
+// table of the config give services, by name pattern or port, a bearer
+// token, basic auth, or the cookies their Jar keeps:
+//
+//	[auth]
+//	api = "bearer dev-token-123"
+//	admin = "basic admin:hunter2"
+//	8443 = "bearer 2f6c09e1"
+//	"3000-3099" = "cookies"
+//	"web*" = ["basic dev:dev", "cookies"]
+//
+// A Jar keeps the cookies those services set in answers that go through
+// the proxy, so after one login in the browser the probe reuses the
+// session. Neither rules nor jars print their secrets.
+package credentials
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"localhost-magic/probe"
+)
+
+// ErrInvalidRule is wrapped by the errors of ParseRule
+var ErrInvalidRule = errors.New("invalid auth rule")
+
+// Rule gives the services it matches credentials to probe them with
+type Rule struct {
+	// Pattern matches service names without .localhost, in
+	// filepath.Match syntax; when it is empty the rule matches the
+	// ports From to To instead
+	Pattern  string
+	From, To int
+
+	BearerToken string
+	Username    string // Basic auth, when set
+	Password    string
+	Cookies     bool // Send the cookies kept in the Jar for the service
+}
+
+// ParseRule reads the rule for match, a name pattern such as "api*", a
+// port or a range such as "3000-3099", from its specs: "bearer TOKEN",
+// "basic USER:PASSWORD" and "cookies"
+func ParseRule(match string, specs []string) (Rule, error) {
+	rule, err := parseMatch(match)
+	if err != nil {
+		return Rule{}, err
+	}
+	if len(specs) == 0 {
+		return Rule{}, fmt.Errorf("%w for %s: no credentials given", ErrInvalidRule, match)
+	}
+	for _, spec := range specs {
+		kind, rest, _ := strings.Cut(strings.TrimSpace(spec), " ")
+		rest = strings.TrimSpace(rest)
+		switch strings.ToLower(kind) {
+		case "bearer":
+			if rest == "" {
+				return Rule{}, fmt.Errorf("%w for %s: bearer without a token", ErrInvalidRule, match)
+			}
+			rule.BearerToken = rest
+		case "basic":
+			user, password, ok := strings.Cut(rest, ":")
+			if !ok || user == "" {
+				return Rule{}, fmt.Errorf("%w for %s: expected basic USER:PASSWORD", ErrInvalidRule, match)
+			}
+			rule.Username, rule.Password = user, password
+		case "cookies":
+			if rest != "" {
+				return Rule{}, fmt.Errorf("%w for %s: cookies takes no value", ErrInvalidRule, match)
+			}
+			rule.Cookies = true
+		default:
+			// Not even the kind is quoted, in case it is a bare secret
+			return Rule{}, fmt.Errorf("%w for %s: expected bearer TOKEN, basic USER:PASSWORD or cookies", ErrInvalidRule, match)
+		}
+	}
+	creds := probe.Credentials{BearerToken: rule.BearerToken, Username: rule.Username, Password: rule.Password}
+	if err := creds.Validate(); err != nil {
+		return Rule{}, fmt.Errorf("%w for %s: %v", ErrInvalidRule, match, err)
+	}
+	return rule, nil
+}
+
+// parseMatch reads the ports or name pattern a rule applies to
+func parseMatch(match string) (Rule, error) {
+	match = strings.ToLower(strings.TrimSpace(match))
+	if match == "" {
+		return Rule{}, fmt.Errorf("%w: empty service name or port", ErrInvalidRule)
+	}
+	if match[0] >= '0' && match[0] <= '9' {
+		fromStr, toStr, isRange := strings.Cut(match, "-")
+		from, err := strconv.Atoi(fromStr)
+		to := from
+		if err == nil && isRange {
+			to, err = strconv.Atoi(toStr)
+		}
+		if err != nil || from < 1 || to > 65535 || from > to {
+			return Rule{}, fmt.Errorf("%w: %q is not a port or range of ports", ErrInvalidRule, match)
+		}
+		return Rule{From: from, To: to}, nil
+	}
+	pattern := strings.TrimSuffix(match, ".localhost")
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return Rule{}, fmt.Errorf("%w: bad pattern %q: %v", ErrInvalidRule, match, err)
+	}
+	return Rule{Pattern: pattern}, nil
+}
+
+// Match returns the name pattern or ports the rule applies to, as
+// ParseRule takes them
+func (r Rule) Match() string {
+	switch {
+	case r.Pattern != "":
+		return r.Pattern
+	case r.From == r.To:
+		return strconv.Itoa(r.From)
+	}
+	return fmt.Sprintf("%d-%d", r.From, r.To)
+}
+
+// String returns what the rule matches and the kinds of credentials it
+// gives, e.g. "api*: basic dev, cookies", without the secrets
+func (r Rule) String() string {
+	var kinds []string
+	if r.BearerToken != "" {
+		kinds = append(kinds, "bearer")
+	}
+	if r.Username != "" {
+		kinds = append(kinds, "basic "+r.Username)
+	}
+	if r.Cookies {
+		kinds = append(kinds, "cookies")
+	}
+	return r.Match() + ": " + strings.Join(kinds, ", ")
+}
+
+// GoString is String, so %#v doesn't print the secrets either
+func (r Rule) GoString() string {
+	return r.String()
+}
+
+// Matches reports whether the rule applies to the service called name, as
+// "api.localhost" or "api", listening on port. A name rule never matches
+// a service whose name isn't known yet.
+func (r Rule) Matches(name string, port int) bool {
+	if r.Pattern == "" {
+		return port >= r.From && port <= r.To
+	}
+	if name == "" {
+		return false
+	}
+	ok, _ := filepath.Match(r.Pattern, strings.TrimSuffix(strings.ToLower(name), ".localhost"))
+	return ok
+}
+
+// Credentials returns the probe credentials of the rule for the service
+// called name, with the cookies jar keeps for it when the rule asks for
+// them. It returns nil when there is nothing to send.
+func (r Rule) Credentials(jar *Jar, name string) *probe.Credentials {
+	creds := &probe.Credentials{BearerToken: r.BearerToken, Username: r.Username, Password: r.Password}
+	if r.Cookies && jar != nil && name != "" {
+		creds.Cookies = jar.Cookies(name)
+	}
+	if creds.IsZero() {
+		return nil
+	}
+	return creds
+}
+
+// Rules are the rules of a config, in the order they were given
+type Rules []Rule
+
+// Find returns the first rule that applies to the service called name on
+// port
+func (rs Rules) Find(name string, port int) (Rule, bool) {
+	for _, r := range rs {
+		if r.Matches(name, port) {
+			return r, true
+		}
+	}
+	return Rule{}, false
+}
+
+// Credentials returns the credentials to probe the service called name on
+// port with, or nil if no rule gives it any
+func (rs Rules) Credentials(jar *Jar, name string, port int) *probe.Credentials {
+	r, ok := rs.Find(name, port)
+	if !ok {
+		return nil
+	}
+	return r.Credentials(jar, name)
+}
@@ -0,0 +1,190 @@
+package credentials
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Jar keeps the session cookies of services, one JSON file per service in
+// a directory only the user can read. Each call reads or rewrites the
+// file, so the daemon and the CLI share what it holds. Cookies are kept
+// by name alone: the probe sends them all, whatever their path.
+type Jar struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// cookieJSON is a cookie as a jar file stores it
+type cookieJSON struct {
+	Name    string    `json:"name"`
+	Value   string    `json:"value"`
+	Expires time.Time `json:"expires"` // Zero for a session cookie
+}
+
+// DefaultJarDir returns the default directory of the jar, next to the
+// config
+func DefaultJarDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = "."
+	}
+	return filepath.Join(home, ".config", "localhost-magic", "cookies")
+}
+
+// NewJar returns the jar kept in dir, which is created on the first save
+func NewJar(dir string) *Jar {
+	return &Jar{dir: dir}
+}
+
+// Cookies returns the unexpired cookies kept for the service called name,
+// sorted by name; none if the file is missing or unreadable
+func (j *Jar) Cookies(name string) []*http.Cookie {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	stored, err := j.load(name)
+	if err != nil {
+		return nil
+	}
+	now := time.Now()
+	var cookies []*http.Cookie
+	for _, c := range stored {
+		if c.Expires.IsZero() || c.Expires.After(now) {
+			cookies = append(cookies, &http.Cookie{Name: c.Name, Value: c.Value, Expires: c.Expires})
+		}
+	}
+	return cookies
+}
+
+// Update merges the cookies a service called name set into what the jar
+// keeps for it: a cookie replaces the one of the same name, and an
+// expired or emptied one removes it. It returns how many cookies the jar
+// then keeps for the service.
+func (j *Jar) Update(name string, set []*http.Cookie) (int, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	stored, err := j.load(name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return 0, err
+	}
+	byName := make(map[string]cookieJSON, len(stored))
+	now := time.Now()
+	for _, c := range stored {
+		if c.Expires.IsZero() || c.Expires.After(now) {
+			byName[c.Name] = c
+		}
+	}
+	for _, c := range set {
+		if c.Name == "" {
+			continue
+		}
+		expires := c.Expires
+		if c.MaxAge > 0 {
+			expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+		}
+		if c.MaxAge < 0 || c.Value == "" || !expires.IsZero() && !expires.After(now) {
+			delete(byName, c.Name)
+			continue
+		}
+		byName[c.Name] = cookieJSON{Name: c.Name, Value: c.Value, Expires: expires}
+	}
+
+	kept := make([]cookieJSON, 0, len(byName))
+	for _, c := range byName {
+		kept = append(kept, c)
+	}
+	sort.Slice(kept, func(a, b int) bool { return kept[a].Name < kept[b].Name })
+	if err := j.save(name, kept); err != nil {
+		return 0, err
+	}
+	return len(kept), nil
+}
+
+// Forget drops every cookie kept for the service called name
+func (j *Jar) Forget(name string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	path, err := j.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove cookies: %w", err)
+	}
+	return nil
+}
+
+// path is the file of the service called name
+func (j *Jar) path(name string) (string, error) {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".localhost") {
+		name += ".localhost"
+	}
+	if strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid service name %q", name)
+	}
+	return filepath.Join(j.dir, name+".json"), nil
+}
+
+// load reads the file of the service called name. The caller holds mu.
+func (j *Jar) load(name string) ([]cookieJSON, error) {
+	path, err := j.path(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var stored []cookieJSON
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return stored, nil
+}
+
+// save writes the file of the service called name, readable by the user
+// alone, or removes it when no cookies are left. The caller holds mu.
+func (j *Jar) save(name string, cookies []cookieJSON) error {
+	path, err := j.path(name)
+	if err != nil {
+		return err
+	}
+	if len(cookies) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove cookies: %w", err)
+		}
+		return nil
+	}
+	if err := os.MkdirAll(j.dir, 0700); err != nil {
+		return fmt.Errorf("failed to create cookie directory: %w", err)
+	}
+	data, err := json.MarshalIndent(cookies, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode cookies: %w", err)
+	}
+	tmp, err := os.CreateTemp(j.dir, ".cookies-*")
+	if err != nil {
+		return fmt.Errorf("failed to save cookies: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save cookies: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save cookies: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to save cookies: %w", err)
+	}
+	return nil
+}
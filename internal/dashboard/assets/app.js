@@ -0,0 +1,448 @@
+// Dashboard for localhost-magic. Everything shown comes from the REST API;
+// the event stream only says when to fetch it again.
+
+// Hosts the dashboard is meant to be opened on; any other name reaching it
+// is a service that doesn't exist
+const dashboardHosts = ['localhost', '127.0.0.1', '[::1]', 'magic.localhost'];
+
+let currentService = {};
+
+// The API token, when the daemon runs with -api-auth. It can be passed
+// once as #token=... and is remembered after that.
+const tokenMatch = location.hash.match(/token=([0-9a-f]+)/);
+if (tokenMatch) {
+    localStorage.setItem('apiToken', tokenMatch[1]);
+    history.replaceState(null, '', location.pathname);
+}
+let apiToken = localStorage.getItem('apiToken') || '';
+
+// api calls a JSON endpoint and returns the data of the document it answers
+// with, or throws with the server's message on failure
+async function api(path, body) {
+    const headers = {};
+    if (apiToken) headers['Authorization'] = 'Bearer ' + apiToken;
+    const options = { headers };
+    if (body !== undefined) {
+        options.method = 'POST';
+        headers['Content-Type'] = 'application/json';
+        options.body = JSON.stringify(body);
+    }
+    const response = await fetch(path, options);
+    if (response.status === 401) {
+        const token = prompt('This daemon requires its API token (see api-token in the config directory):');
+        if (token) {
+            apiToken = token.trim();
+            localStorage.setItem('apiToken', apiToken);
+            return api(path, body);
+        }
+    }
+    if (!response.ok) {
+        throw new Error((await response.text()).trim() || response.statusText);
+    }
+    return (await response.json()).data;
+}
+
+// el builds an element with text content and attributes
+function el(tag, attrs = {}, ...children) {
+    const node = document.createElement(tag);
+    for (const [key, value] of Object.entries(attrs)) {
+        if (key === 'class') node.className = value;
+        else if (key.startsWith('on')) node.addEventListener(key.slice(2), value);
+        else node.setAttribute(key, value);
+    }
+    for (const child of children) {
+        if (child !== null && child !== undefined) {
+            node.append(child instanceof Node ? child : String(child));
+        }
+    }
+    return node;
+}
+
+// lastProbe is what the service's last probe found, as its finding has it
+function lastProbe(service) {
+    return service.finding.probe || {};
+}
+
+// processLabel names the service's process, e.g. "node pid 4242"
+function processLabel(service) {
+    const process = service.finding.process;
+    if (!process) return '';
+    const name = process.name || process.exe || '';
+    return process.pid ? name + ' pid ' + process.pid : name;
+}
+
+function statusClass(service) {
+    const code = lastProbe(service).status_code || 0;
+    if (!service.active) return 'offline';
+    if (code === 0 || code >= 500) return 'error';
+    if (code < 400) return 'ok';
+    return 'warning';
+}
+
+// frameworkIcon is a coloured initial, stable for each framework name
+function frameworkIcon(name) {
+    if (!name) return el('span', { class: 'framework-icon', title: 'Unknown framework' }, '?');
+    let hash = 0;
+    for (const c of name) hash = (hash * 31 + c.charCodeAt(0)) >>> 0;
+    const icon = el('span', { class: 'framework-icon', title: name }, name[0].toUpperCase());
+    icon.style.background = 'hsl(' + (hash % 360) + ', 55%, 45%)';
+    return icon;
+}
+
+function formatLatency(ms) {
+    if (!ms) return '';
+    return ms < 1 ? ms.toFixed(2) + ' ms' : Math.round(ms) + ' ms';
+}
+
+// Whether auxiliary endpoints (HMR ports) get rows of their own rather
+// than a note on their service's row
+const expandToggle = document.getElementById('expandAuxiliary');
+expandToggle.checked = localStorage.getItem('expandAuxiliary') === 'true';
+expandToggle.addEventListener('change', () => {
+    localStorage.setItem('expandAuxiliary', expandToggle.checked);
+    refresh();
+});
+
+// apiSpecLink opens the service's OpenAPI document through the proxy
+function apiSpecLink(service) {
+    const spec = lastProbe(service).api_spec;
+    const title = [spec.title, spec.version].filter(Boolean).join(' ') || 'API document';
+    return el('a', { href: service.url.replace(/\/$/, '') + (spec.ui_path || spec.path), class: 'api-link', target: '_blank', title: title + ' (' + spec.path + ')' }, 'API');
+}
+
+// graphQLLink opens the service's GraphQL endpoint through the proxy,
+// where servers usually offer an explorer to browsers
+function graphQLLink(service) {
+    const path = lastProbe(service).graphql_path;
+    return el('a', { href: service.url.replace(/\/$/, '') + path, class: 'api-link', target: '_blank', title: 'GraphQL endpoint ' + path }, 'GraphQL');
+}
+
+// auxiliaryEndpoint is the port, kind and dev server of an auxiliary
+// endpoint, from its finding
+function auxiliaryEndpoint(aux) {
+    const probe = aux.finding.probe || {};
+    return { port: aux.finding.port, kind: probe.auxiliary, framework: probe.framework };
+}
+
+function auxiliaryLabel(aux) {
+    return '+' + aux.kind + ' :' + aux.port;
+}
+
+// auxiliaryRow is an expanded auxiliary endpoint under its service
+function auxiliaryRow(service, aux) {
+    return el('tr', { class: 'auxiliary' + (service.active ? '' : ' inactive') },
+        el('td', {}, el('div', { class: 'name-cell' }, el('span', { class: 'aux-branch' }, '└'), aux.kind)),
+        el('td', {}),
+        el('td', {}, el('div', { class: 'name-cell' },
+            frameworkIcon(aux.framework),
+            el('span', { class: 'title' }, aux.framework ? aux.framework + ' ' + aux.kind : aux.kind))),
+        el('td', {}, aux.port),
+        el('td', {}),
+        el('td', {}),
+        el('td', {}),
+        el('td', {}, el('div', { class: 'actions' },
+            el('button', { class: 'btn', title: 'Stop listing port ' + aux.port, onclick: () => setHidden(aux.port, true) }, 'Hide'))));
+}
+
+// appRow is an app a reverse proxy serves, under the proxy, with the Host
+// or path it is routed by and where the proxy sends it
+function appRow(service, app) {
+    const route = app.route;
+    const via = (route.host || '') + (route.path || '');
+    return el('tr', { class: 'auxiliary' + (service.active ? '' : ' inactive') },
+        el('td', {}, el('div', { class: 'name-cell' },
+            el('span', { class: 'aux-branch' }, '└'),
+            el('a', { href: app.url, class: 'service-link' + (service.active ? '' : ' inactive'), target: '_blank' }, app.name))),
+        el('td', {}, el('span', { class: 'status-badge', title: 'Served by ' + service.name }, 'ROUTED')),
+        el('td', {}, el('span', { class: 'title', title: route.router ? route.router + ' (' + route.source + ')' : route.source },
+            route.backend ? via + ' → ' + route.backend : via)),
+        el('td', {}, service.finding.port),
+        el('td', {}),
+        el('td', {}),
+        el('td', {}),
+        el('td', {}));
+}
+
+// healthClasses map health states to the status badge colors
+const healthClasses = { healthy: 'ok', degraded: 'warning', down: 'error' };
+
+function healthBadge(health) {
+    const title = health.state + ' since ' + new Date(health.since).toLocaleTimeString() + (health.reason ? ': ' + health.reason : '');
+    return el('span', { class: 'status-badge health ' + (healthClasses[health.state] || ''), title }, health.state.toUpperCase());
+}
+
+// authBadge marks a service probed with credentials, whose status is what
+// a logged-in user gets
+function authBadge() {
+    return el('span', { class: 'status-badge auth', title: 'Probed with credentials from [auth] in the config' }, 'AUTH');
+}
+
+// certBadge warns of a certificate browsers would refuse, listing why on
+// hover
+function certBadge(issues) {
+    return el('span', { class: 'status-badge cert warning', title: issues.join('\n') }, 'CERT');
+}
+
+// rewriteBadge marks a service whose requests the proxy rewrites, listing
+// the [rewrite] actions in order on hover
+function rewriteBadge(rewrites) {
+    return el('span', { class: 'status-badge rewrite', title: 'Rewritten by the proxy:\n' + rewrites.join('\n') }, 'REWRITE');
+}
+
+// serviceTitle is the page title, or for a file server the directory it
+// serves, with the first entries of its listing on hover
+function serviceTitle(service) {
+    const probe = lastProbe(service);
+    const listing = probe.dir_listing;
+    if (!listing) return el('span', { class: 'title' }, probe.title || probe.framework || service.proxy || '');
+    const served = service.finding.served_path;
+    const label = served ? 'file server for ' + served : 'file server';
+    const entries = (listing.entries || []).join('\n') + (listing.more ? '\n…' : '');
+    return el('span', { class: 'title', title: entries }, label);
+}
+
+function renderServices(services) {
+    services.sort((a, b) => a.name.localeCompare(b.name));
+    const expand = expandToggle.checked;
+    const tbody = document.querySelector('#services tbody');
+    tbody.replaceChildren(...services.flatMap(service => {
+        const auxiliary = (service.auxiliary || []).map(auxiliaryEndpoint);
+        const probe = lastProbe(service);
+        const process = service.finding.process || {};
+        const port = service.finding.port;
+        const status = statusClass(service);
+        const badge = service.active ? (probe.status_code || 'OFFLINE') : 'INACTIVE';
+        const statusText = service.active ? ((probe.status_code || '') + ' ' + (probe.status_text || '')).trim() : 'offline';
+        const row = el('tr', { class: service.active ? '' : 'inactive' },
+            el('td', {}, el('div', { class: 'name-cell' },
+                el('span', { class: 'status-dot ' + status, title: statusText }),
+                el('a', { href: service.url, class: 'service-link' + (service.active ? '' : ' inactive'), target: '_blank' }, service.name),
+                el('button', { class: 'btn-icon', title: 'Rename', onclick: () => openRenameModal(service.name) }, 'Edit'))),
+            el('td', {}, el('span', { class: 'status-badge ' + status, title: statusText }, badge),
+                ...(service.active && service.score ? [healthBadge(service.score)] : []),
+                ...(service.active && probe.authenticated ? [authBadge()] : []),
+                ...(service.active && service.finding.cert_issues ? [certBadge(service.finding.cert_issues)] : []),
+                ...(service.rewrites ? [rewriteBadge(service.rewrites)] : [])),
+            el('td', {}, el('div', { class: 'name-cell' },
+                frameworkIcon(probe.framework),
+                serviceTitle(service),
+                ...(probe.api_spec ? [apiSpecLink(service)] : []),
+                ...(probe.graphql_path ? [graphQLLink(service)] : []),
+                ...(expand ? [] : auxiliary.map(aux => el('span', { class: 'aux-chip', title: (aux.framework || '') + ' ' + aux.kind + ' endpoint on port ' + aux.port }, auxiliaryLabel(aux)))))),
+            el('td', {}, port),
+            el('td', { class: 'latency' }, formatLatency(probe.ttfb_ms)),
+            el('td', {}, el('pre', { class: 'command', title: (process.args || []).join(' ') }, processLabel(service))),
+            el('td', {}, el('label', { class: 'keep-checkbox' },
+                el('input', { type: 'checkbox', onchange: e => toggleKeep(service.name, e.target.checked), ...(service.keep ? { checked: '' } : {}) }),
+                el('span', {}, 'Keep'))),
+            el('td', {}, el('div', { class: 'actions' },
+                el('button', { class: 'btn', title: 'Probe again now', onclick: () => reprobe(service.name) }, 'Re-probe'),
+                ...(service.lan_url ? [el('button', { class: 'btn', title: 'Show a QR code for ' + service.lan_url, onclick: () => openQRModal(service) }, 'Open on phone')] : []),
+                ...(service.cert_renewable ? [el('button', { class: 'btn', title: 'Serve it over HTTPS with a fresh certificate from the local CA', onclick: () => renewCert(service.name) }, 'Renew cert')] : []),
+                ...(service.active ? [el('button', { class: 'btn', title: 'Send a burst of requests and show their latency', onclick: () => openBenchModal(service.name) }, 'Check performance')] : []),
+                el('button', { class: 'btn', title: 'Stop listing port ' + port, onclick: () => setHidden(port, true) }, 'Hide'),
+                el('button', { class: 'btn btn-danger', onclick: () => openBlacklistModal(service.name, process.pid, process.exe || '') }, 'Blacklist'))));
+        return [row, ...(service.apps || []).map(app => appRow(service, app)), ...(expand ? auxiliary.map(aux => auxiliaryRow(service, aux)) : [])];
+    }));
+    document.getElementById('services').hidden = services.length === 0;
+    document.getElementById('empty').hidden = services.length > 0;
+}
+
+// otherKind says what a listener speaks, with the services a gRPC server
+// lists
+function otherKind(other) {
+    if (other.grpc_services) {
+        return other.kind + ': ' + other.grpc_services.join(', ');
+    }
+    return other.kind || (other.hint ? other.state + ' (possibly ' + other.hint + ')' : other.state);
+}
+
+function renderOthers(others) {
+    const tbody = document.querySelector('#others tbody');
+    tbody.replaceChildren(...others.map(other => el('tr', {},
+        el('td', {}, other.port),
+        el('td', {}, otherKind(other)),
+        el('td', {}, el('pre', { class: 'command' }, other.exe_path + (other.pid ? ' [' + other.pid + ']' : ''))),
+        el('td', {}, el('button', { class: 'btn', onclick: () => setHidden(other.port, true) }, 'Hide')))));
+    document.getElementById('others-card').hidden = others.length === 0;
+}
+
+function renderHidden(ports) {
+    const tbody = document.querySelector('#hidden tbody');
+    tbody.replaceChildren(...ports.map(port => el('tr', {},
+        el('td', {}, 'Port ' + port),
+        el('td', {}, el('button', { class: 'btn', onclick: () => setHidden(port, false) }, 'Show again')))));
+    document.getElementById('hidden-card').hidden = ports.length === 0;
+}
+
+async function refresh() {
+    try {
+        const [services, others, hidden] = await Promise.all([
+            api('/api/services'), api('/api/listeners'), api('/api/hidden')
+        ]);
+        renderServices(services);
+        renderOthers(others);
+        renderHidden(hidden);
+    } catch (err) {
+        console.error('Failed to refresh:', err);
+    }
+}
+
+// Refresh on every event, coalescing bursts into one fetch
+let refreshTimer = null;
+function scheduleRefresh() {
+    if (refreshTimer === null) {
+        refreshTimer = setTimeout(() => { refreshTimer = null; refresh(); }, 100);
+    }
+}
+
+function connectEvents() {
+    const live = document.getElementById('live');
+    const events = new EventSource('/api/events' + (apiToken ? '?access_token=' + encodeURIComponent(apiToken) : ''));
+    events.onopen = () => {
+        live.textContent = 'live';
+        live.className = 'live connected';
+        scheduleRefresh(); // Catch up on anything missed while disconnected
+    };
+    events.onerror = () => {
+        live.textContent = 'reconnecting…';
+        live.className = 'live';
+    };
+    for (const type of ['added', 'removed', 'changed', 'renamed', 'hidden', 'health']) {
+        events.addEventListener(type, scheduleRefresh);
+    }
+}
+
+async function act(action) {
+    try {
+        await action();
+    } catch (err) {
+        alert(err.message);
+    }
+    scheduleRefresh();
+}
+
+function reprobe(name) {
+    act(() => api('/api/probe', { name }));
+}
+
+// renewCert mints a service a fresh certificate, which the daemon's HTTPS
+// listener serves it with
+function renewCert(name) {
+    act(async () => {
+        const cert = await api('/api/services/' + encodeURIComponent(name) + '/cert', {});
+        alert('Serving ' + cert.url + ' with a fresh certificate, valid until ' + new Date(cert.not_after).toLocaleString());
+    });
+}
+
+function setHidden(port, hidden) {
+    act(() => api('/api/hide', { port, hidden }));
+}
+
+function toggleKeep(name, keep) {
+    act(() => api('/api/keep', { name, keep }));
+}
+
+function openRenameModal(name) {
+    currentService.oldName = name;
+    document.getElementById('currentName').value = name;
+    document.getElementById('newName').value = '';
+    document.getElementById('renameModal').classList.add('active');
+}
+
+function openBlacklistModal(name, pid, exePath) {
+    currentService = { name, pid, exePath };
+    const value = document.getElementById('blacklistValue');
+    value.value = pid;
+    value.readOnly = true;
+
+    const typeSelect = document.getElementById('blacklistType');
+    typeSelect.replaceChildren(
+        el('option', { value: 'pid' }, 'By PID (' + pid + ')'),
+        el('option', { value: 'path' }, 'By Path (' + exePath.substring(0, 50) + '...)'),
+        el('option', { value: 'pattern' }, 'By Pattern (regex)'));
+    typeSelect.onchange = () => {
+        const type = typeSelect.value;
+        value.value = type === 'pid' ? pid : type === 'path' ? exePath : '';
+        value.readOnly = type !== 'pattern';
+    };
+
+    document.getElementById('blacklistModal').classList.add('active');
+}
+
+// openQRModal shows the QR code of the address other devices on the LAN
+// reach service at
+function openQRModal(service) {
+    const path = '/api/services/' + encodeURIComponent(service.name) + '/qr';
+    document.getElementById('qrImage').src = path + (apiToken ? '?access_token=' + encodeURIComponent(apiToken) : '');
+    const link = document.getElementById('qrURL');
+    link.href = service.lan_url;
+    link.textContent = service.lan_url;
+    document.getElementById('qrModal').classList.add('active');
+}
+
+// openBenchModal runs a quick latency check of a service through the API
+// and shows what it found
+async function openBenchModal(name) {
+    const result = document.getElementById('benchResult');
+    document.getElementById('benchName').textContent = name;
+    result.replaceChildren(el('p', {}, 'Sending requests…'));
+    document.getElementById('benchModal').classList.add('active');
+    let bench;
+    try {
+        bench = await api('/api/services/' + encodeURIComponent(name) + '/bench', {});
+    } catch (err) {
+        result.replaceChildren(el('p', { class: 'error' }, err.message));
+        return;
+    }
+    const statuses = Object.entries(bench.statuses || {}).map(([code, n]) => code + ' ×' + n).join(', ');
+    const row = (label, value) => el('tr', {}, el('th', {}, label), el('td', {}, value));
+    result.replaceChildren(el('table', { class: 'bench' },
+        row('p50 / p90 / p99', [bench.p50_ms, bench.p90_ms, bench.p99_ms].map(formatBenchMS).join(' / ')),
+        row('min / mean / max', [bench.min_ms, bench.mean_ms, bench.max_ms].map(formatBenchMS).join(' / ')),
+        row('Errors', bench.errors + ' of ' + bench.requests + ' (' + (100 * bench.error_rate).toFixed(1) + '%)'),
+        row('Statuses', statuses || '-'),
+        row('Keep-alive', (bench.keep_alive ? 'yes' : 'no') + ' (' + bench.connections + ' connections)'),
+        ...(bench.error ? [row('First error', bench.error)] : [])));
+}
+
+// formatBenchMS shows a latency with enough digits for fast local services
+function formatBenchMS(ms) {
+    return ms < 10 ? ms.toFixed(2) + ' ms' : Math.round(ms) + ' ms';
+}
+
+function closeModal(modalId) {
+    document.getElementById(modalId).classList.remove('active');
+}
+
+document.getElementById('confirmRename').addEventListener('click', () => {
+    const newName = document.getElementById('newName').value;
+    if (!newName) return;
+    closeModal('renameModal');
+    act(() => api('/api/rename', { oldName: currentService.oldName, newName }));
+});
+
+document.getElementById('confirmBlacklist').addEventListener('click', () => {
+    const type = document.getElementById('blacklistType').value;
+    const value = document.getElementById('blacklistValue').value;
+    closeModal('blacklistModal');
+    act(() => api('/api/blacklist', { type, value }));
+});
+
+document.querySelectorAll('[data-close]').forEach(button => {
+    button.addEventListener('click', () => closeModal(button.dataset.close));
+});
+document.querySelectorAll('.modal').forEach(modal => {
+    modal.addEventListener('click', e => {
+        if (e.target === modal) closeModal(modal.id);
+    });
+});
+
+if (!dashboardHosts.includes(location.hostname)) {
+    const banner = document.getElementById('banner');
+    banner.textContent = 'No service found for ' + location.hostname;
+    banner.hidden = false;
+}
+
+// Connect after the first fetch, which asks for the token if one is needed
+refresh().then(connectEvents);
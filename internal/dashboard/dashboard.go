@@ -0,0 +1,140 @@
+// Package dashboard is the daemon's web UI. The page and its script are
+// embedded in the binary; the script renders the service list from the
+// daemon's REST API and refreshes it whenever the event stream says
+// something changed.
+package dashboard
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"localhost-magic/internal/health"
+	"localhost-magic/probe"
+)
+
+//go:embed assets
+var assets embed.FS
+
+// Handler serves the dashboard page at / and its files under /assets/
+func Handler() http.Handler {
+	static, err := fs.Sub(assets, "assets")
+	if err != nil {
+		panic(err) // The embedded directory always exists
+	}
+	index, err := fs.ReadFile(static, "index.html")
+	if err != nil {
+		panic(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/assets/", http.StripPrefix("/assets/", http.FileServer(http.FS(static))))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write(index)
+	})
+	return mux
+}
+
+// Event tells dashboards and other API clients that a service changed.
+// Probe is the probe that found it, for added and changed.
+type Event struct {
+	Type  string             `json:"type"` // added, removed, changed, renamed, hidden, health
+	Name  string             `json:"name,omitempty"`
+	Port  int                `json:"port,omitempty"`
+	Time  time.Time          `json:"time"`
+	Probe *probe.ProbeResult `json:"probe,omitempty"`
+	// Health is set on health events, to the service's new score
+	Health *health.Score `json:"health,omitempty"`
+}
+
+// heartbeatInterval keeps idle event streams from being closed by proxies
+const heartbeatInterval = 15 * time.Second
+
+// Hub fans events out to the connected dashboards over Server-Sent Events
+type Hub struct {
+	mu      sync.Mutex
+	clients map[chan Event]bool
+}
+
+// NewHub returns a hub with no clients
+func NewHub() *Hub {
+	return &Hub{clients: make(map[chan Event]bool)}
+}
+
+// Publish sends e to every connected dashboard without waiting, stamping
+// it with the current time if it has none. A client too slow to keep up
+// misses the event; the next one makes it refresh.
+func (h *Hub) Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		select {
+		case c <- e:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel receiving the events published from now on,
+// buffering up to size of them, and a function to stop. Like a dashboard,
+// a subscriber that falls behind misses events.
+func (h *Hub) Subscribe(size int) (<-chan Event, func()) {
+	c := make(chan Event, size)
+	h.mu.Lock()
+	h.clients[c] = true
+	h.mu.Unlock()
+	return c, func() {
+		h.mu.Lock()
+		delete(h.clients, c)
+		h.mu.Unlock()
+	}
+}
+
+// ServeHTTP streams events to one dashboard until it disconnects
+func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	c, cancel := h.Subscribe(16)
+	defer cancel()
+
+	fmt.Fprint(w, "retry: 2000\n\n")
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case e := <-c:
+			data, err := json.Marshal(e)
+			if err != nil {
+				log.Printf("Failed to encode dashboard event: %v", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+		}
+		flusher.Flush()
+	}
+}
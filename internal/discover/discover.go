@@ -0,0 +1,613 @@
+// Package discover watches the local machine for services coming, going
+// and changing. A Discoverer rescans on an interval, diffs each scan
+// against the last one by service identity and reports the differences
+// as events.
+package discover
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"localhost-magic/internal/docker"
+	"localhost-magic/internal/exclude"
+	"localhost-magic/internal/health"
+	"localhost-magic/internal/scan"
+)
+
+// EventType says what happened to a service
+type EventType string
+
+const (
+	ServiceAdded   EventType = "added"
+	ServiceRemoved EventType = "removed"
+	ServiceChanged EventType = "changed"
+	// ServiceRestarted is a service that went away and came back within
+	// Options.Grace, with Previous as it was before
+	ServiceRestarted EventType = "restarted"
+	// ServiceMoved is a service found on another port, with the same
+	// identity or a matching fingerprint (see scan.Fingerprint), rather
+	// than one removed and another added. PreviousPort is where it was.
+	ServiceMoved EventType = "moved"
+	// ServiceHealthy, ServiceDegraded and ServiceDown report a service
+	// whose health changed to that state, with the change in Changes,
+	// when Options.Health is set
+	ServiceHealthy  EventType = "healthy"
+	ServiceDegraded EventType = "degraded"
+	ServiceDown     EventType = "down"
+)
+
+// Default settings used when the Options field is zero
+const (
+	DefaultInterval     = 5 * time.Second
+	DefaultConfirmDelay = time.Second
+	DefaultGrace        = 5 * time.Second
+)
+
+// Event is a change in the set of services. Finding is the service as
+// now seen, or as last seen for ServiceRemoved; Previous is set for
+// ServiceChanged, ServiceRestarted and ServiceMoved, with Changes
+// describing what differs.
+type Event struct {
+	Type     EventType     `json:"type"`
+	ID       string        `json:"id"`
+	Name     string        `json:"name,omitempty"`
+	Port     int           `json:"port"`
+	Time     time.Time     `json:"time"`
+	Changes  []string      `json:"changes,omitempty"` // e.g. "status 502 -> 200"
+	Finding  scan.Finding  `json:"finding"`
+	Previous *scan.Finding `json:"previous,omitempty"`
+	// PreviousPort and PreviousID are set for ServiceMoved: where the
+	// service was, and its ID there if it changed
+	PreviousPort int    `json:"previous_port,omitempty"`
+	PreviousID   string `json:"previous_id,omitempty"`
+	// Health is the service's health score, when Options.Health is set
+	Health *health.Score `json:"health,omitempty"`
+}
+
+// String returns a one-line summary of the event
+func (e Event) String() string {
+	name := e.Name
+	if name == "" {
+		name = fmt.Sprintf("port %d", e.Port)
+	}
+	s := fmt.Sprintf("%s %s: %s", e.Time.Format("15:04:05"), e.Type, name)
+	for i, c := range e.Changes {
+		if i == 0 {
+			s += " ("
+		} else {
+			s += ", "
+		}
+		s += c
+	}
+	if len(e.Changes) > 0 {
+		s += ")"
+	}
+	return s
+}
+
+// Options configures a Discoverer
+type Options struct {
+	Host     string // Default: localhost
+	From, To int    // Port range, default 1-65535
+	Interval time.Duration
+	// ConfirmDelay is how long to wait before re-checking the ports a scan
+	// found changes on; only changes the second look agrees with are
+	// reported, so a dev server restarting on save doesn't show up as a
+	// removed/added pair. 0 uses DefaultConfirmDelay, capped at Interval;
+	// a negative value reports changes unconfirmed.
+	ConfirmDelay time.Duration
+	All          bool // Track open ports that aren't HTTP too
+	Scan         scan.ScanOptions
+	Docker       *docker.Client // Nil checks the default Docker socket
+	// Name, if set, gives each event's service its display name
+	Name func(scan.Finding) string
+	// Grace is how long a service that went away has to come back, with
+	// the same identity or from the same working directory, before it is
+	// reported removed; one that does is reported restarted instead, so
+	// nodemon or cargo-watch restarts don't show up as a removal and an
+	// addition. Removals are reported at the first scan after the window.
+	// 0 uses DefaultGrace; a negative value reports them at once.
+	Grace time.Duration
+	// Exclude drops the findings its rules match from every scan, before
+	// they are diffed or handed to OnScan. Excluded, if set, is called
+	// with each of them and the rule that matched, on every scan.
+	Exclude  exclude.Rules
+	Excluded func(scan.Finding, exclude.Rule)
+	// Health, if set, scores each service's health at every scan with these
+	// thresholds and reports the changes. A known service that stops
+	// answering HTTP while its port is still open is then kept, to be
+	// scored Down, rather than reported removed.
+	Health *health.Thresholds
+}
+
+// Discoverer rescans for services and reports changes to its callbacks
+type Discoverer struct {
+	opts Options
+
+	mu        sync.Mutex
+	callbacks []func(Event)
+	onScan    []func([]scan.Finding)
+	onHealth  []func(map[string]health.Score)
+
+	// Only touched by the goroutine running Run
+	known   map[string]scan.Finding
+	pending []Event                 // Queued by Changed
+	gone    map[string]gone         // Went away within Grace, by ID
+	health  map[string]health.Score // With Options.Health, by ID
+}
+
+// gone is a service that went away and may be restarting
+type gone struct {
+	finding scan.Finding
+	since   time.Time
+}
+
+// New returns a discoverer. Register callbacks with OnEvent, then Run it.
+func New(opts Options) *Discoverer {
+	if opts.Host == "" {
+		opts.Host = "localhost"
+	}
+	if opts.From == 0 && opts.To == 0 {
+		opts.From, opts.To = 1, 65535
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultInterval
+	}
+	if opts.ConfirmDelay == 0 {
+		opts.ConfirmDelay = min(DefaultConfirmDelay, opts.Interval)
+	}
+	if opts.Grace == 0 {
+		opts.Grace = DefaultGrace
+	}
+	if opts.Docker == nil {
+		opts.Docker = docker.New("")
+	}
+	return &Discoverer{opts: opts, gone: make(map[string]gone), health: make(map[string]health.Score)}
+}
+
+// OnEvent registers fn to be called for every event, in order, from the
+// goroutine running Run
+func (d *Discoverer) OnEvent(fn func(Event)) {
+	d.mu.Lock()
+	d.callbacks = append(d.callbacks, fn)
+	d.mu.Unlock()
+}
+
+// OnScan registers fn to be called after every scan that succeeded with
+// the services it found, changed or not, from the goroutine running Run
+func (d *Discoverer) OnScan(fn func([]scan.Finding)) {
+	d.mu.Lock()
+	d.onScan = append(d.onScan, fn)
+	d.mu.Unlock()
+}
+
+// OnHealth registers fn to be called after every scan, with Options.Health
+// set, with the health of the services it found keyed by their
+// scan.Finding.Identity, from the goroutine running Run
+func (d *Discoverer) OnHealth(fn func(map[string]health.Score)) {
+	d.mu.Lock()
+	d.onHealth = append(d.onHealth, fn)
+	d.mu.Unlock()
+}
+
+// Run scans until ctx is cancelled. Every service found by the first scan
+// is reported as added. It returns ctx.Err(), or the error of a first
+// scan that failed; later failed scans are skipped.
+func (d *Discoverer) Run(ctx context.Context) error {
+	known, err := d.scanAll(ctx)
+	if err != nil {
+		return err
+	}
+	d.known = known
+	d.score(known, time.Now())
+	d.scanned(known)
+	d.emit(diff(nil, known))
+
+	ticker := time.NewTicker(d.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		current, err := d.scanAll(ctx)
+		if err != nil {
+			continue
+		}
+		transitions := d.score(current, time.Now())
+		d.scanned(current)
+		events := diff(known, current)
+		if len(events) > 0 && d.opts.ConfirmDelay > 0 {
+			events = d.confirm(ctx, known, events)
+		}
+		for _, e := range events {
+			if e.Type == ServiceRemoved {
+				delete(known, e.ID)
+			} else {
+				delete(known, e.PreviousID)
+				known[e.ID] = e.Finding
+			}
+		}
+		d.emit(append(d.settle(events, time.Now()), transitions...))
+	}
+}
+
+// score updates the health of the services a scan found and returns the
+// events for those whose state changed. Services it didn't find start
+// over when they come back. It does nothing without Options.Health.
+func (d *Discoverer) score(services map[string]scan.Finding, now time.Time) []Event {
+	if d.opts.Health == nil {
+		return nil
+	}
+	var events []Event
+	scores := make(map[string]health.Score, len(services))
+	for id, f := range services {
+		prev, seen := d.health[id]
+		next := prev.Observe(f.ProbeResult, *d.opts.Health, now)
+		d.health[id] = next
+		scores[f.Identity()] = next
+		if !seen || next.State == prev.State {
+			continue
+		}
+		change := fmt.Sprintf("%s -> %s", prev.State, next.State)
+		if next.Reason != "" {
+			change += ": " + next.Reason
+		}
+		events = append(events, Event{Type: healthEvents[next.State], ID: id, Port: f.Port, Changes: []string{change}, Finding: f})
+	}
+	for id := range d.health {
+		if _, ok := services[id]; !ok {
+			delete(d.health, id)
+		}
+	}
+	d.mu.Lock()
+	callbacks := d.onHealth
+	d.mu.Unlock()
+	for _, fn := range callbacks {
+		fn(scores)
+	}
+	sortEvents(events)
+	return events
+}
+
+// healthEvents are the event types of the health states
+var healthEvents = map[health.State]EventType{
+	health.StateHealthy:  ServiceHealthy,
+	health.StateDegraded: ServiceDegraded,
+	health.StateDown:     ServiceDown,
+}
+
+// Changed reports a change to a known service that scans can't see, such
+// as its name being contested, as a ServiceChanged event with changes.
+// Call it from the Name function or an event callback; the event follows
+// the one being handled.
+func (d *Discoverer) Changed(id string, changes ...string) {
+	f, ok := d.known[id]
+	if !ok {
+		return
+	}
+	prev := f
+	d.pending = append(d.pending, Event{Type: ServiceChanged, ID: id, Port: f.Port, Changes: changes, Finding: f, Previous: &prev})
+}
+
+// confirm re-scans the ports involved in events after ConfirmDelay and
+// keeps the events the second scan agrees with, updated to what it saw.
+// The known services' ports are re-scanned too, so a service on two ports
+// gets the same IDs as in a full scan.
+func (d *Discoverer) confirm(ctx context.Context, known map[string]scan.Finding, events []Event) []Event {
+	timer := time.NewTimer(d.opts.ConfirmDelay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-timer.C:
+	}
+
+	portSet := make(map[int]bool)
+	for _, f := range known {
+		portSet[f.Port] = true
+	}
+	for _, e := range events {
+		portSet[e.Port] = true
+		if e.Previous != nil {
+			portSet[e.Previous.Port] = true
+		}
+	}
+	ports := make([]int, 0, len(portSet))
+	for port := range portSet {
+		ports = append(ports, port)
+	}
+	again, err := d.scan(ctx, ports)
+	if err != nil {
+		return nil
+	}
+
+	var confirmed []Event
+	for _, e := range events {
+		now, present := again[e.ID]
+		switch e.Type {
+		case ServiceAdded:
+			if present {
+				e.Finding = now
+				confirmed = append(confirmed, e)
+			}
+		case ServiceRemoved:
+			if !present {
+				confirmed = append(confirmed, e)
+			}
+		case ServiceChanged:
+			if !present {
+				continue
+			}
+			if changes := compare(known[e.ID], now); len(changes) > 0 {
+				e.Finding, e.Changes = now, changes
+				confirmed = append(confirmed, e)
+			}
+		case ServiceMoved:
+			if _, stayed := again[e.PreviousID]; !present || stayed || now.Port == e.PreviousPort {
+				continue
+			}
+			e.Finding, e.Changes = now, compare(*e.Previous, now)
+			confirmed = append(confirmed, e)
+		}
+	}
+	return confirmed
+}
+
+// settle holds back the removals among events for Grace, reports the
+// services that came back in time as restarted, or moved if they came
+// back on another port, and adds the removals whose window has passed
+func (d *Discoverer) settle(events []Event, now time.Time) []Event {
+	if d.opts.Grace < 0 {
+		return events
+	}
+	var out []Event
+	for _, e := range events {
+		switch e.Type {
+		case ServiceRemoved:
+			d.gone[e.ID] = gone{finding: e.Finding, since: now}
+			continue
+		case ServiceAdded:
+			if id, ok := d.returning(e.ID, e.Finding); ok {
+				prev := d.gone[id].finding
+				delete(d.gone, id)
+				e.Type, e.Previous, e.Changes = ServiceRestarted, &prev, compare(prev, e.Finding)
+				if prev.Port != e.Finding.Port {
+					e.Type, e.PreviousPort = ServiceMoved, prev.Port
+					if id != e.ID {
+						e.PreviousID = id
+					}
+				}
+			}
+		}
+		out = append(out, e)
+	}
+	for id, g := range d.gone {
+		if now.Sub(g.since) >= d.opts.Grace {
+			out = append(out, Event{Type: ServiceRemoved, ID: id, Port: g.finding.Port, Finding: g.finding})
+			delete(d.gone, id)
+		}
+	}
+	sortEvents(out)
+	return out
+}
+
+// returning finds the service that went away which f, newly seen as id,
+// is back from: the one with the same ID, else the one whose fingerprint
+// matches f's, among those on the same port first
+func (d *Discoverer) returning(id string, f scan.Finding) (string, bool) {
+	if _, ok := d.gone[id]; ok {
+		return id, true
+	}
+	var samePort, all []string
+	for goneID, g := range d.gone {
+		if g.finding.Port == f.Port {
+			samePort = append(samePort, goneID)
+		}
+		all = append(all, goneID)
+	}
+	finding := func(id string) scan.Finding { return d.gone[id].finding }
+	for _, ids := range [][]string{samePort, all} {
+		if goneID, ok := matchFingerprint(f, ids, finding); ok {
+			return goneID, true
+		}
+	}
+	return "", false
+}
+
+// matchFingerprint returns the one of ids whose finding f is the same
+// service as by fingerprint, if there is a single one
+func matchFingerprint(f scan.Finding, ids []string, finding func(id string) scan.Finding) (string, bool) {
+	sort.Strings(ids) // So the pick doesn't depend on map order
+	fingerprints := make([]scan.Fingerprint, len(ids))
+	for i, id := range ids {
+		fingerprints[i] = finding(id).Fingerprint()
+	}
+	i, ok := scan.BestMatch(f.Fingerprint(), fingerprints)
+	if !ok {
+		return "", false
+	}
+	return ids[i], true
+}
+
+// scanAll scans the whole configured range
+func (d *Discoverer) scanAll(ctx context.Context) (map[string]scan.Finding, error) {
+	ports := make([]int, 0, d.opts.To-d.opts.From+1)
+	for port := d.opts.From; port <= d.opts.To; port++ {
+		ports = append(ports, port)
+	}
+	return d.scan(ctx, ports)
+}
+
+// scan probes ports and returns the services found, keyed by identity
+func (d *Discoverer) scan(ctx context.Context, ports []int) (map[string]scan.Finding, error) {
+	findings, err := scan.ScanPorts(ctx, d.opts.Host, ports, d.opts.Scan)
+	if err != nil {
+		return nil, err
+	}
+	scan.AttachProcesses(findings)
+	scan.AttachContainers(ctx, findings, d.opts.Docker)
+	findings = d.opts.Exclude.Filter(findings, d.opts.Excluded)
+
+	services := make(map[string]scan.Finding)
+	for _, f := range findings {
+		if f.State != scan.StateOpen || !(f.IsHTTP || d.opts.All || d.tracking(f)) {
+			continue
+		}
+		id := f.Identity()
+		if _, dup := services[id]; dup {
+			// Same service on two ports, e.g. an app and its debug port,
+			// or on two loopback addresses
+			id = fmt.Sprintf("%s#%d", id, f.Port)
+			if _, dup := services[id]; dup {
+				id = fmt.Sprintf("%s#%s", id, f.Address)
+			}
+		}
+		services[id] = f
+	}
+	return services, nil
+}
+
+// tracking reports whether f is a known service that stopped answering
+// HTTP, kept while its port is open when health is scored
+func (d *Discoverer) tracking(f scan.Finding) bool {
+	if d.opts.Health == nil {
+		return false
+	}
+	known, ok := d.known[f.Identity()]
+	return ok && known.Port == f.Port
+}
+
+// scanned hands the services a scan found to the OnScan callbacks
+func (d *Discoverer) scanned(services map[string]scan.Finding) {
+	d.mu.Lock()
+	callbacks := d.onScan
+	d.mu.Unlock()
+	if len(callbacks) == 0 {
+		return
+	}
+	findings := make([]scan.Finding, 0, len(services))
+	for _, f := range services {
+		findings = append(findings, f)
+	}
+	sort.Slice(findings, func(i, j int) bool { return findings[i].Port < findings[j].Port })
+	for _, fn := range callbacks {
+		fn(findings)
+	}
+}
+
+// emit stamps and names events and hands them to the callbacks
+func (d *Discoverer) emit(events []Event) {
+	d.mu.Lock()
+	callbacks := d.callbacks
+	d.mu.Unlock()
+
+	now := time.Now()
+	for len(events) > 0 {
+		e := events[0]
+		e.Time = now
+		e.Port = e.Finding.Port
+		if d.opts.Name != nil {
+			e.Name = d.opts.Name(e.Finding)
+		}
+		if score, ok := d.health[e.ID]; ok {
+			e.Health = &score
+		}
+		for _, fn := range callbacks {
+			fn(e)
+		}
+		events = append(d.pending, events[1:]...)
+		d.pending = nil
+	}
+}
+
+// diff returns the events that turn old into current, sorted by port. A
+// service on another port than before is reported moved, whether it kept
+// its ID or, restarted with other arguments say, only its fingerprint.
+func diff(old, current map[string]scan.Finding) []Event {
+	var events []Event
+	var added, removed []string
+	for id, f := range current {
+		prev, ok := old[id]
+		switch {
+		case !ok:
+			added = append(added, id)
+		case prev.Port != f.Port:
+			events = append(events, Event{Type: ServiceMoved, ID: id, Port: f.Port, PreviousPort: prev.Port, Changes: compare(prev, f), Finding: f, Previous: &prev})
+		default:
+			if changes := compare(prev, f); len(changes) > 0 {
+				prevCopy := prev
+				events = append(events, Event{Type: ServiceChanged, ID: id, Port: f.Port, Changes: changes, Finding: f, Previous: &prevCopy})
+			}
+		}
+	}
+	for id := range old {
+		if _, ok := current[id]; !ok {
+			removed = append(removed, id)
+		}
+	}
+
+	sort.Strings(added)
+	finding := func(id string) scan.Finding { return old[id] }
+	for _, id := range added {
+		f := current[id]
+		var elsewhere []string
+		for _, goneID := range removed {
+			if old[goneID].Port != f.Port {
+				elsewhere = append(elsewhere, goneID)
+			}
+		}
+		if goneID, ok := matchFingerprint(f, elsewhere, finding); ok {
+			prev := old[goneID]
+			removed = slices.DeleteFunc(removed, func(r string) bool { return r == goneID })
+			events = append(events, Event{Type: ServiceMoved, ID: id, Port: f.Port, PreviousPort: prev.Port, PreviousID: goneID, Changes: compare(prev, f), Finding: f, Previous: &prev})
+			continue
+		}
+		events = append(events, Event{Type: ServiceAdded, ID: id, Port: f.Port, Finding: f})
+	}
+	for _, id := range removed {
+		events = append(events, Event{Type: ServiceRemoved, ID: id, Port: old[id].Port, Finding: old[id]})
+	}
+	sortEvents(events)
+	return events
+}
+
+// sortEvents sorts events by port, then type
+func sortEvents(events []Event) {
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].Port != events[j].Port {
+			return events[i].Port < events[j].Port
+		}
+		return events[i].Type < events[j].Type
+	})
+}
+
+// compare lists the differences between two sightings of a service that
+// are worth telling the user about
+func compare(old, cur scan.Finding) []string {
+	var changes []string
+	if old.Port != cur.Port {
+		changes = append(changes, fmt.Sprintf("port %d -> %d", old.Port, cur.Port))
+	}
+	if old.StatusCode != cur.StatusCode {
+		changes = append(changes, fmt.Sprintf("status %d -> %d", old.StatusCode, cur.StatusCode))
+	} else if old.ProbeResult.State != cur.ProbeResult.State {
+		changes = append(changes, fmt.Sprintf("state %s -> %s", old.ProbeResult.State, cur.ProbeResult.State))
+	}
+	if old.Title != cur.Title {
+		changes = append(changes, fmt.Sprintf("title %q -> %q", old.Title, cur.Title))
+	}
+	if old.Framework != cur.Framework {
+		changes = append(changes, fmt.Sprintf("framework %q -> %q", old.Framework, cur.Framework))
+	}
+	if old.Process != nil && cur.Process != nil && old.Process.PID != cur.Process.PID {
+		changes = append(changes, fmt.Sprintf("restarted, pid %d -> %d", old.Process.PID, cur.Process.PID))
+	}
+	return changes
+}
@@ -0,0 +1,284 @@
+// Package dnsmsg encodes and decodes the subset of the DNS wire format
+// (RFC 1035) used by the mDNS responder and the .localhost resolver
+package dnsmsg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// Record types
+const (
+	TypeA    uint16 = 1
+	TypePTR  uint16 = 12
+	TypeTXT  uint16 = 16
+	TypeAAAA uint16 = 28
+	TypeSRV  uint16 = 33
+	TypeOPT  uint16 = 41
+	TypeANY  uint16 = 255
+)
+
+const (
+	ClassIN uint16 = 1
+	// ClassTopBit is the high bit of the class field, which mDNS uses as
+	// the cache-flush bit on records and the unicast-response ("QU") bit on
+	// questions (RFC 6762 sections 10.2 and 5.4)
+	ClassTopBit uint16 = 0x8000
+)
+
+// Header flags
+const (
+	FlagResponse         uint16 = 0x8000
+	FlagAuthoritative    uint16 = 0x0400
+	FlagTruncated        uint16 = 0x0200
+	FlagRecursionDesired uint16 = 0x0100
+)
+
+// Response codes, carried in the low four bits of the flags
+const (
+	RcodeSuccess  uint16 = 0
+	RcodeFormErr  uint16 = 1
+	RcodeNXDomain uint16 = 3
+	RcodeNotImp   uint16 = 4
+)
+
+// ErrMalformed is returned by Parse for truncated or invalid messages
+var ErrMalformed = errors.New("malformed DNS message")
+
+// Question is one entry of the question section
+type Question struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// Record is a resource record. Data is the RDATA with any embedded names
+// uncompressed, so records from the wire compare equal to locally built ones.
+type Record struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte
+}
+
+// Message is a DNS message
+type Message struct {
+	ID         uint16
+	Flags      uint16
+	Questions  []Question
+	Answers    []Record
+	Authority  []Record
+	Additional []Record
+}
+
+// IsResponse reports whether the QR bit is set
+func (m *Message) IsResponse() bool {
+	return m.Flags&FlagResponse != 0
+}
+
+// Opcode returns the kind of query; zero is a standard query
+func (m *Message) Opcode() int {
+	return int(m.Flags>>11) & 0xF
+}
+
+// Pack encodes the message without name compression
+func (m *Message) Pack() []byte {
+	var b bytes.Buffer
+	header := [6]uint16{m.ID, m.Flags, uint16(len(m.Questions)), uint16(len(m.Answers)),
+		uint16(len(m.Authority)), uint16(len(m.Additional))}
+	for _, v := range header {
+		binary.Write(&b, binary.BigEndian, v)
+	}
+	for _, q := range m.Questions {
+		writeName(&b, q.Name)
+		binary.Write(&b, binary.BigEndian, q.Type)
+		binary.Write(&b, binary.BigEndian, q.Class)
+	}
+	for _, section := range [][]Record{m.Answers, m.Authority, m.Additional} {
+		for _, rr := range section {
+			writeName(&b, rr.Name)
+			binary.Write(&b, binary.BigEndian, rr.Type)
+			binary.Write(&b, binary.BigEndian, rr.Class)
+			binary.Write(&b, binary.BigEndian, rr.TTL)
+			binary.Write(&b, binary.BigEndian, uint16(len(rr.Data)))
+			b.Write(rr.Data)
+		}
+	}
+	return b.Bytes()
+}
+
+// Parse decodes a DNS message, expanding compressed names. Names are
+// returned in lower case with a trailing dot.
+func Parse(buf []byte) (*Message, error) {
+	if len(buf) < 12 {
+		return nil, ErrMalformed
+	}
+	m := &Message{
+		ID:    binary.BigEndian.Uint16(buf[0:]),
+		Flags: binary.BigEndian.Uint16(buf[2:]),
+	}
+	qd := int(binary.BigEndian.Uint16(buf[4:]))
+	counts := [3]int{
+		int(binary.BigEndian.Uint16(buf[6:])),
+		int(binary.BigEndian.Uint16(buf[8:])),
+		int(binary.BigEndian.Uint16(buf[10:])),
+	}
+
+	off := 12
+	for i := 0; i < qd; i++ {
+		name, next, err := readName(buf, off)
+		if err != nil {
+			return nil, err
+		}
+		if next+4 > len(buf) {
+			return nil, ErrMalformed
+		}
+		m.Questions = append(m.Questions, Question{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(buf[next:]),
+			Class: binary.BigEndian.Uint16(buf[next+2:]),
+		})
+		off = next + 4
+	}
+
+	sections := [3]*[]Record{&m.Answers, &m.Authority, &m.Additional}
+	for s, count := range counts {
+		for i := 0; i < count; i++ {
+			rr, next, err := readRecord(buf, off)
+			if err != nil {
+				return nil, err
+			}
+			*sections[s] = append(*sections[s], rr)
+			off = next
+		}
+	}
+	return m, nil
+}
+
+// readRecord decodes the resource record at off
+func readRecord(buf []byte, off int) (Record, int, error) {
+	name, off, err := readName(buf, off)
+	if err != nil {
+		return Record{}, 0, err
+	}
+	if off+10 > len(buf) {
+		return Record{}, 0, ErrMalformed
+	}
+	rr := Record{
+		Name:  name,
+		Type:  binary.BigEndian.Uint16(buf[off:]),
+		Class: binary.BigEndian.Uint16(buf[off+2:]),
+		TTL:   binary.BigEndian.Uint32(buf[off+4:]),
+	}
+	length := int(binary.BigEndian.Uint16(buf[off+8:]))
+	start := off + 10
+	end := start + length
+	if end > len(buf) {
+		return Record{}, 0, ErrMalformed
+	}
+
+	// Names inside PTR and SRV data may point elsewhere in the message
+	switch rr.Type {
+	case TypePTR:
+		target, _, err := readName(buf, start)
+		if err != nil {
+			return Record{}, 0, err
+		}
+		rr.Data = NameData(target)
+	case TypeSRV:
+		if length < 7 {
+			return Record{}, 0, ErrMalformed
+		}
+		target, _, err := readName(buf, start+6)
+		if err != nil {
+			return Record{}, 0, err
+		}
+		rr.Data = append(append([]byte(nil), buf[start:start+6]...), NameData(target)...)
+	default:
+		rr.Data = append([]byte(nil), buf[start:end]...)
+	}
+	return rr, end, nil
+}
+
+// readName decodes a possibly compressed name at off and returns it in
+// lower case with a trailing dot, along with the offset just past it
+func readName(buf []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(buf) {
+			return "", 0, ErrMalformed
+		}
+		length := int(buf[off])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.ToLower(strings.Join(labels, ".")) + ".", next, nil
+		case length&0xC0 == 0xC0:
+			if off+1 >= len(buf) || jumps > 16 {
+				return "", 0, ErrMalformed
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(buf[off:]) & 0x3FFF)
+			jumps++
+		case length&0xC0 != 0:
+			return "", 0, ErrMalformed
+		default:
+			if off+1+length > len(buf) {
+				return "", 0, ErrMalformed
+			}
+			labels = append(labels, string(buf[off+1:off+1+length]))
+			off += 1 + length
+		}
+	}
+}
+
+// writeName encodes name as uncompressed labels
+func writeName(b *bytes.Buffer, name string) {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		b.WriteByte(byte(len(label)))
+		b.WriteString(label)
+	}
+	b.WriteByte(0)
+}
+
+// NameData returns name encoded for use as RDATA
+func NameData(name string) []byte {
+	var b bytes.Buffer
+	writeName(&b, strings.ToLower(name))
+	return b.Bytes()
+}
+
+// SRVData encodes SRV RDATA with zero priority and weight
+func SRVData(port int, target string) []byte {
+	data := make([]byte, 6, 6+len(target)+2)
+	binary.BigEndian.PutUint16(data[4:], uint16(port))
+	return append(data, NameData(target)...)
+}
+
+// TXTData encodes TXT RDATA; an empty set is a single empty string as
+// RFC 6763 section 6.1 requires
+func TXTData(text []string) []byte {
+	if len(text) == 0 {
+		return []byte{0}
+	}
+	var b bytes.Buffer
+	for _, s := range text {
+		if len(s) > 255 {
+			s = s[:255]
+		}
+		b.WriteByte(byte(len(s)))
+		b.WriteString(s)
+	}
+	return b.Bytes()
+}
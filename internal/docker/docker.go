@@ -0,0 +1,167 @@
+// Package docker asks the Docker Engine API which containers publish
+// ports on this machine. On Docker Desktop and with docker-proxy the
+// process owning a published port says nothing about the container, so
+// the container is looked up here instead.
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultSocket is where the Docker Engine API listens on Linux
+const DefaultSocket = "/var/run/docker.sock"
+
+// Compose labels identifying a container's project and service
+const (
+	LabelComposeProject = "com.docker.compose.project"
+	LabelComposeService = "com.docker.compose.service"
+)
+
+// ErrUnavailable is returned when Docker isn't installed, isn't running or
+// its socket can't be opened. Callers treat it as "no containers".
+var ErrUnavailable = errors.New("docker is not available")
+
+// Container is a running container publishing a port
+type Container struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Image       string `json:"image"`
+	Project     string `json:"project,omitempty"` // Compose project
+	Service     string `json:"service,omitempty"` // Compose service
+	PrivatePort int    `json:"private_port"`      // Port inside the container
+	// Labels are the container's labels, for exclusion rules; too many
+	// to be worth listing
+	Labels map[string]string `json:"-"`
+}
+
+// String returns a short description such as "web (nginx:latest)"
+func (c Container) String() string {
+	name := c.Name
+	if c.Project != "" && c.Service != "" {
+		name = c.Project + "/" + c.Service
+	}
+	return fmt.Sprintf("%s (%s)", name, c.Image)
+}
+
+// Client talks to the Docker Engine API over its unix socket
+type Client struct {
+	socket string
+	http   *http.Client
+}
+
+// New returns a client for the socket at path. An empty path uses
+// DOCKER_HOST when it names a unix socket, then the first of the usual
+// locations that exists.
+func New(path string) *Client {
+	if path == "" {
+		path = findSocket()
+	}
+	dialer := &net.Dialer{Timeout: time.Second}
+	return &Client{
+		socket: path,
+		http: &http.Client{
+			Timeout: 3 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", path)
+				},
+			},
+		},
+	}
+}
+
+// findSocket returns the Docker socket path for this machine
+func findSocket() string {
+	if host, ok := strings.CutPrefix(os.Getenv("DOCKER_HOST"), "unix://"); ok {
+		return host
+	}
+	candidates := []string{DefaultSocket}
+	if home, err := os.UserHomeDir(); err == nil {
+		// Docker Desktop and colima keep the socket in the home directory
+		candidates = append(candidates,
+			filepath.Join(home, ".docker", "run", "docker.sock"),
+			filepath.Join(home, ".colima", "default", "docker.sock"))
+	}
+	for _, path := range candidates {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return DefaultSocket
+}
+
+// apiContainer is the part of a /containers/json entry we use
+type apiContainer struct {
+	ID     string            `json:"Id"`
+	Names  []string          `json:"Names"`
+	Image  string            `json:"Image"`
+	Labels map[string]string `json:"Labels"`
+	Ports  []struct {
+		PrivatePort int    `json:"PrivatePort"`
+		PublicPort  int    `json:"PublicPort"`
+		Type        string `json:"Type"`
+	} `json:"Ports"`
+}
+
+// Published returns the running containers keyed by the host TCP port
+// they publish. One call covers every port, so a scan makes a single
+// request however many ports it finds.
+func (c *Client) Published(ctx context.Context) (map[int]Container, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://docker/containers/json", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+		}
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to list containers: %s", resp.Status)
+	}
+
+	var list []apiContainer
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("failed to decode container list: %w", err)
+	}
+
+	published := make(map[int]Container)
+	for _, ac := range list {
+		for _, p := range ac.Ports {
+			if p.PublicPort == 0 || p.Type != "tcp" {
+				continue
+			}
+			published[p.PublicPort] = Container{
+				ID:          ac.ID,
+				Name:        containerName(ac.Names),
+				Image:       ac.Image,
+				Project:     ac.Labels[LabelComposeProject],
+				Service:     ac.Labels[LabelComposeService],
+				PrivatePort: p.PrivatePort,
+				Labels:      ac.Labels,
+			}
+		}
+	}
+	return published, nil
+}
+
+// containerName returns the primary name without its leading slash
+func containerName(names []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	return strings.TrimPrefix(names[0], "/")
+}
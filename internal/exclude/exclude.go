@@ -0,0 +1,255 @@
+// Package exclude holds the rules that keep noise out of scans: the
+// IDE's debug ports, Dropbox, a music player's local helper. A rule is
+// written as one of
+//
+//	4381                            a port
+//	6942-6991                       a range of ports
+//	process:Spotify*                a process, by executable name or path
+//	label:com.example.dev=ignore    a Docker container label and value
+//	label:com.example.internal      a label, whatever its value
+//
+// and a bare pattern that isn't a port, such as "Spotify*", is taken for a
+// process.
+package exclude
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"localhost-magic/internal/scan"
+)
+
+// Kind says what a rule matches
+type Kind string
+
+const (
+	KindPort    Kind = "port"    // A port or range of ports
+	KindProcess Kind = "process" // The process owning the port
+	KindLabel   Kind = "label"   // A label of the container publishing it
+)
+
+// ErrInvalidRule is wrapped by the errors of Parse
+var ErrInvalidRule = errors.New("invalid exclusion rule")
+
+// Rule is one exclusion rule
+type Rule struct {
+	Kind     Kind
+	From, To int    // KindPort, inclusive
+	Pattern  string // KindProcess, see MatchProcess
+	Label    string // KindLabel
+	Value    string // KindLabel, when HasValue
+	HasValue bool
+}
+
+// String returns the rule as Parse takes it
+func (r Rule) String() string {
+	switch r.Kind {
+	case KindPort:
+		if r.From == r.To {
+			return strconv.Itoa(r.From)
+		}
+		return fmt.Sprintf("%d-%d", r.From, r.To)
+	case KindProcess:
+		return "process:" + r.Pattern
+	case KindLabel:
+		if r.HasValue {
+			return "label:" + r.Label + "=" + r.Value
+		}
+		return "label:" + r.Label
+	}
+	return ""
+}
+
+// Parse reads a rule, e.g. "4381", "6942-6991", "process:Spotify*" or
+// "label:com.example.dev=ignore"
+func Parse(s string) (Rule, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return Rule{}, fmt.Errorf("%w: empty rule", ErrInvalidRule)
+	}
+	kind, rest, typed := strings.Cut(s, ":")
+	if !typed || strings.Contains(kind, "/") {
+		// A path pattern may contain a colon, e.g. on Windows
+		kind, rest = "", s
+	}
+	rest = strings.TrimSpace(rest)
+	switch kind {
+	case "port":
+		return parsePorts(s, rest)
+	case "process":
+		return parseProcess(s, rest)
+	case "label":
+		return parseLabel(s, rest)
+	case "":
+		if rest == "" {
+			return Rule{}, fmt.Errorf("%w %q: missing port, process or label", ErrInvalidRule, s)
+		}
+		if rest[0] >= '0' && rest[0] <= '9' {
+			return parsePorts(s, rest)
+		}
+		return parseProcess(s, rest)
+	}
+	return Rule{}, fmt.Errorf("%w %q: unknown kind %q, expected a port, a range such as 6942-6991, process:NAME or label:KEY[=VALUE]", ErrInvalidRule, s, kind)
+}
+
+// parsePorts reads "4381" or "6942-6991"
+func parsePorts(s, spec string) (Rule, error) {
+	fromStr, toStr, isRange := strings.Cut(spec, "-")
+	from, err := parsePort(fromStr)
+	if err != nil {
+		return Rule{}, fmt.Errorf("%w %q: %v", ErrInvalidRule, s, err)
+	}
+	to := from
+	if isRange {
+		if to, err = parsePort(toStr); err != nil {
+			return Rule{}, fmt.Errorf("%w %q: end of range: %v", ErrInvalidRule, s, err)
+		}
+		if from > to {
+			return Rule{}, fmt.Errorf("%w %q: range starts at %d, after its end %d", ErrInvalidRule, s, from, to)
+		}
+	}
+	return Rule{Kind: KindPort, From: from, To: to}, nil
+}
+
+// parsePort reads a port number in 1-65535
+func parsePort(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, errors.New("missing port number")
+	}
+	port, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a port number", s)
+	}
+	if port < 1 || port > 65535 {
+		return 0, fmt.Errorf("port %d out of range 1-65535", port)
+	}
+	return port, nil
+}
+
+// parseProcess reads a process pattern
+func parseProcess(s, pattern string) (Rule, error) {
+	if pattern == "" {
+		return Rule{}, fmt.Errorf("%w %q: missing process name or pattern", ErrInvalidRule, s)
+	}
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return Rule{}, fmt.Errorf("%w %q: bad pattern: %v", ErrInvalidRule, s, err)
+	}
+	return Rule{Kind: KindProcess, Pattern: pattern}, nil
+}
+
+// parseLabel reads "key=value" or "key"
+func parseLabel(s, selector string) (Rule, error) {
+	label, value, hasValue := strings.Cut(selector, "=")
+	label = strings.TrimSpace(label)
+	if label == "" {
+		return Rule{}, fmt.Errorf("%w %q: missing label name", ErrInvalidRule, s)
+	}
+	return Rule{Kind: KindLabel, Label: label, Value: strings.TrimSpace(value), HasValue: hasValue}, nil
+}
+
+// Match reports whether the rule excludes f. Process rules need
+// scan.AttachProcesses and label rules scan.AttachContainers to have run.
+func (r Rule) Match(f scan.Finding) bool {
+	switch r.Kind {
+	case KindPort:
+		return f.Port >= r.From && f.Port <= r.To
+	case KindProcess:
+		if f.Process == nil {
+			return false
+		}
+		if f.Process.Exe != "" {
+			return MatchProcess(r.Pattern, f.Process.Exe)
+		}
+		// Without the executable, the name is all a pattern can be held to
+		return f.Process.Name != "" && !strings.Contains(r.Pattern, "/") && MatchProcess(r.Pattern, f.Process.Name)
+	case KindLabel:
+		if f.Container == nil {
+			return false
+		}
+		value, ok := f.Container.Labels[r.Label]
+		return ok && (!r.HasValue || value == r.Value)
+	}
+	return false
+}
+
+// MatchProcess reports whether pattern matches the executable at exePath.
+// A pattern without a slash matches the executable's name, one with a
+// slash its whole path, using filepath.Match syntax; a pattern ending in a
+// slash matches everything under that directory.
+func MatchProcess(pattern, exePath string) bool {
+	if strings.HasSuffix(pattern, "/") {
+		return strings.HasPrefix(exePath, pattern)
+	}
+	subject := filepath.Base(exePath)
+	if strings.Contains(pattern, "/") {
+		subject = exePath
+	}
+	ok, _ := filepath.Match(pattern, subject)
+	return ok
+}
+
+// Rules is a set of exclusion rules; a finding any of them matches is
+// excluded
+type Rules []Rule
+
+// ParseAll reads rules, reporting every malformed one
+func ParseAll(specs []string) (Rules, error) {
+	var rules Rules
+	var errs []error
+	for _, spec := range specs {
+		r, err := Parse(spec)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		rules = append(rules, r)
+	}
+	return rules, errors.Join(errs...)
+}
+
+// Match returns the first rule that excludes f
+func (rs Rules) Match(f scan.Finding) (Rule, bool) {
+	for _, r := range rs {
+		if r.Match(f) {
+			return r, true
+		}
+	}
+	return Rule{}, false
+}
+
+// Ports returns the ports the port rules exclude, for
+// scan.ScanOptions.Exclude to skip them without dialing
+func (rs Rules) Ports() []int {
+	var ports []int
+	for _, r := range rs {
+		if r.Kind == KindPort {
+			for port := r.From; port <= r.To; port++ {
+				ports = append(ports, port)
+			}
+		}
+	}
+	return ports
+}
+
+// Filter returns the findings no rule excludes, calling excluded, if set,
+// for each of the others with the rule that matched it
+func (rs Rules) Filter(findings []scan.Finding, excluded func(scan.Finding, Rule)) []scan.Finding {
+	if len(rs) == 0 {
+		return findings
+	}
+	kept := make([]scan.Finding, 0, len(findings))
+	for _, f := range findings {
+		if r, ok := rs.Match(f); ok {
+			if excluded != nil {
+				excluded(f, r)
+			}
+			continue
+		}
+		kept = append(kept, f)
+	}
+	return kept
+}
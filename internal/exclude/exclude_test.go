@@ -0,0 +1,86 @@
+package exclude
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		spec string
+		want Rule
+	}{
+		{"4381", Rule{Kind: KindPort, From: 4381, To: 4381}},
+		{" 6942-6991 ", Rule{Kind: KindPort, From: 6942, To: 6991}},
+		{"port:8080", Rule{Kind: KindPort, From: 8080, To: 8080}},
+		{"port: 63342", Rule{Kind: KindPort, From: 63342, To: 63342}},
+		{"process:Spotify*", Rule{Kind: KindProcess, Pattern: "Spotify*"}},
+		{"Spotify*", Rule{Kind: KindProcess, Pattern: "Spotify*"}},
+		{"/opt/JetBrains/", Rule{Kind: KindProcess, Pattern: "/opt/JetBrains/"}},
+		{"label:com.example.dev=ignore", Rule{Kind: KindLabel, Label: "com.example.dev", Value: "ignore", HasValue: true}},
+		{"label:com.example.internal", Rule{Kind: KindLabel, Label: "com.example.internal"}},
+		{"label:com.example.dev=", Rule{Kind: KindLabel, Label: "com.example.dev", HasValue: true}},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.spec)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.spec, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Parse(%q) = %+v, want %+v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"   ",
+		":",
+		": ",
+		" : ",
+		"0",
+		"65536",
+		"80-",
+		"9000-8000",
+		"port:",
+		"port:http",
+		"process:",
+		"process: ",
+		"process:[",
+		"label:",
+		"label:=value",
+		"pid:1234",
+	} {
+		rule, err := Parse(spec)
+		if !errors.Is(err, ErrInvalidRule) {
+			t.Errorf("Parse(%q) = %+v, %v; want ErrInvalidRule", spec, rule, err)
+		}
+	}
+}
+
+func TestRuleStringRoundTrip(t *testing.T) {
+	for _, spec := range []string{"4381", "6942-6991", "process:Spotify*", "label:com.example.dev=ignore", "label:com.example.internal"} {
+		rule, err := Parse(spec)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", spec, err)
+		}
+		if got := rule.String(); got != spec {
+			t.Errorf("Parse(%q).String() = %q", spec, got)
+		}
+	}
+}
+
+func TestParseAllReportsEveryError(t *testing.T) {
+	rules, err := ParseAll([]string{"4381", ":", "process:", "label:x"})
+	if len(rules) != 2 {
+		t.Errorf("kept %d rules, want 2", len(rules))
+	}
+	if !errors.Is(err, ErrInvalidRule) {
+		t.Errorf("ParseAll error %v, want ErrInvalidRule", err)
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); !ok || len(joined.Unwrap()) != 2 {
+		t.Errorf("ParseAll error %v, want both bad rules", err)
+	}
+}
@@ -0,0 +1,162 @@
+// Package export renders the registry's services for other tools: a hosts
+// file block, environment variables, a Caddyfile or JSON. Each format is
+// an Exporter; a new one only needs adding to Formats.
+package export
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"localhost-magic/internal/registry"
+)
+
+// Exporter writes services in one format
+type Exporter interface {
+	Export(w io.Writer, services []Service) error
+}
+
+// Formats are the exporters by the name --format takes
+var Formats = map[string]Exporter{
+	"hosts": Hosts{},
+	"env":   Env{},
+	"caddy": Caddy{},
+	"json":  JSON{},
+}
+
+// FormatNames returns the names of Formats, sorted
+func FormatNames() []string {
+	names := make([]string, 0, len(Formats))
+	for name := range Formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Service is what the exporters know of a registry entry
+type Service struct {
+	Name    string `json:"name"`    // e.g. "storefront.localhost"
+	Address string `json:"address"` // Loopback address it listens on
+	Port    int    `json:"port"`
+	TLS     bool   `json:"tls,omitempty"`
+}
+
+// FromEntries returns the services of registry entries, sorted by name.
+// An entry without an address listens on 127.0.0.1. The apps behind a
+// reverse proxy are left out: their address is the proxy's, which only
+// serves them to requests with their own Host header.
+func FromEntries(entries []registry.Entry) []Service {
+	services := make([]Service, 0, len(entries))
+	for _, e := range entries {
+		if e.Parent != "" {
+			continue
+		}
+		s := Service{Name: e.Name, Address: e.Address, Port: e.Port}
+		if s.Address == "" {
+			s.Address = "127.0.0.1"
+		}
+		s.TLS = e.LastProbe != nil && e.LastProbe.IsTLS
+		services = append(services, s)
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+	return services
+}
+
+// HostPort is the service's address and port, e.g. "127.0.0.1:3000"
+func (s Service) HostPort() string {
+	return net.JoinHostPort(s.Address, strconv.Itoa(s.Port))
+}
+
+// URL is where the service answers directly, e.g. "http://127.0.0.1:3000"
+func (s Service) URL() string {
+	if s.TLS {
+		return "https://" + s.HostPort()
+	}
+	return "http://" + s.HostPort()
+}
+
+// Env writes a NAME_URL variable per service, e.g.
+// STOREFRONT_URL=http://127.0.0.1:3000, for a .env file or eval
+type Env struct{}
+
+// Export implements Exporter
+func (Env) Export(w io.Writer, services []Service) error {
+	for _, s := range services {
+		if _, err := fmt.Fprintf(w, "%s_URL=%s\n", EnvName(s.Name), s.URL()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EnvName turns a service name into a variable name: "my-app.localhost"
+// becomes "MY_APP", and one starting with a digit gets a leading
+// underscore
+func EnvName(name string) string {
+	name = strings.TrimSuffix(name, ".localhost")
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z':
+			b.WriteRune(r - 'a' + 'A')
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	s := b.String()
+	if s == "" || s[0] >= '0' && s[0] <= '9' {
+		s = "_" + s
+	}
+	return s
+}
+
+// Caddy writes a Caddyfile site block per service, proxying its name to
+// its port. HTTPS backends are proxied without verifying their
+// certificate, as dev servers' are usually self-signed.
+type Caddy struct{}
+
+// Export implements Exporter
+func (Caddy) Export(w io.Writer, services []Service) error {
+	for i, s := range services {
+		if i > 0 {
+			if _, err := io.WriteString(w, "\n"); err != nil {
+				return err
+			}
+		}
+		var err error
+		if s.TLS {
+			_, err = fmt.Fprintf(w, "%s {\n\treverse_proxy %s {\n\t\ttransport http {\n\t\t\ttls_insecure_skip_verify\n\t\t}\n\t}\n}\n", s.Name, s.URL())
+		} else {
+			_, err = fmt.Fprintf(w, "%s {\n\treverse_proxy %s\n}\n", s.Name, s.HostPort())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// JSON writes the services as an indented JSON array, with their URL
+type JSON struct{}
+
+// Export implements Exporter
+func (JSON) Export(w io.Writer, services []Service) error {
+	type serviceJSON struct {
+		Service
+		URL string `json:"url"`
+	}
+	out := make([]serviceJSON, 0, len(services))
+	for _, s := range services {
+		out = append(out, serviceJSON{Service: s, URL: s.URL()})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
@@ -0,0 +1,105 @@
+package export
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Sentinel comments around the block Hosts writes, so it can be replaced
+// later without touching the rest of the file
+const (
+	HostsBegin = "# BEGIN localhost-magic"
+	HostsEnd   = "# END localhost-magic"
+)
+
+// DefaultHostsFile is the system hosts file
+const DefaultHostsFile = "/etc/hosts"
+
+// ErrUnterminatedBlock is returned by Splice for a hosts file with a begin
+// sentinel and no end, whose block it can't tell from what follows
+var ErrUnterminatedBlock = errors.New("hosts file has " + HostsBegin + " without " + HostsEnd)
+
+// Hosts writes an "address name" line per service between the sentinel
+// comments, a block Splice can put in a hosts file
+type Hosts struct{}
+
+// Export implements Exporter
+func (Hosts) Export(w io.Writer, services []Service) error {
+	_, err := w.Write(hostsBlock(services))
+	return err
+}
+
+// hostsBlock is the block for services, sentinels included
+func hostsBlock(services []Service) []byte {
+	var b bytes.Buffer
+	b.WriteString(HostsBegin + "\n")
+	for _, s := range services {
+		fmt.Fprintf(&b, "%s %s\n", s.Address, s.Name)
+	}
+	b.WriteString(HostsEnd + "\n")
+	return b.Bytes()
+}
+
+// Splice returns the hosts file contents with the block for services in
+// place of the one a previous splice left, or appended when there is
+// none. Everything outside the sentinels is kept as it is, and every
+// earlier block is removed, so splicing again never duplicates it.
+func Splice(contents []byte, services []Service) ([]byte, error) {
+	lines := strings.SplitAfter(string(contents), "\n")
+	var out strings.Builder
+	inBlock, placed := false, false
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case !inBlock && trimmed == HostsBegin:
+			inBlock = true
+		case inBlock && trimmed == HostsEnd:
+			inBlock = false
+			if !placed {
+				out.Write(hostsBlock(services))
+				placed = true
+			}
+		case !inBlock:
+			out.WriteString(line)
+		}
+	}
+	if inBlock {
+		return nil, ErrUnterminatedBlock
+	}
+	if !placed {
+		if s := out.String(); s != "" && !strings.HasSuffix(s, "\n") {
+			out.WriteString("\n")
+		}
+		out.Write(hostsBlock(services))
+	}
+	return []byte(out.String()), nil
+}
+
+// ApplyHosts splices the block for services into the hosts file at path,
+// writing it in place so its owner and mode stay. It reports whether the
+// file changed.
+func ApplyHosts(path string, services []Service) (bool, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	spliced, err := Splice(contents, services)
+	if err != nil {
+		return false, fmt.Errorf("failed to update %s: %w", path, err)
+	}
+	if bytes.Equal(spliced, contents) {
+		return false, nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if err := os.WriteFile(path, spliced, info.Mode().Perm()); err != nil {
+		return false, fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,123 @@
+package export
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// systemHosts is a hosts file as a distribution ships it, edited by hand
+const systemHosts = `127.0.0.1	localhost
+::1	localhost ip6-localhost ip6-loopback
+
+# Added by hand
+10.0.0.5	nas.lan
+`
+
+var (
+	shop = Service{Name: "shop.localhost", Address: "127.0.0.1", Port: 5173}
+	api  = Service{Name: "api.localhost", Address: "127.0.0.2", Port: 3000}
+)
+
+func splice(t *testing.T, contents string, services ...Service) string {
+	t.Helper()
+	out, err := Splice([]byte(contents), services)
+	if err != nil {
+		t.Fatalf("Splice: %v", err)
+	}
+	return string(out)
+}
+
+func TestSpliceAppends(t *testing.T) {
+	got := splice(t, systemHosts, api, shop)
+	want := systemHosts + HostsBegin + "\n127.0.0.2 api.localhost\n127.0.0.1 shop.localhost\n" + HostsEnd + "\n"
+	if got != want {
+		t.Errorf("spliced:\n%s\nwant:\n%s", got, want)
+	}
+
+	// A file without a final newline gets one before the block
+	got = splice(t, "127.0.0.1 localhost", shop)
+	if !strings.HasPrefix(got, "127.0.0.1 localhost\n"+HostsBegin+"\n") {
+		t.Errorf("spliced %q, want the block on a line of its own", got)
+	}
+	if got := splice(t, "", shop); got != HostsBegin+"\n127.0.0.1 shop.localhost\n"+HostsEnd+"\n" {
+		t.Errorf("spliced into an empty file %q, want only the block", got)
+	}
+}
+
+func TestSpliceRoundTrip(t *testing.T) {
+	once := splice(t, systemHosts, api, shop)
+	if again := splice(t, once, api, shop); again != once {
+		t.Errorf("splicing again changed the file:\n%s\nwant:\n%s", again, once)
+	}
+
+	// Services change, a user adds a line after the block: one block
+	// stays, in its place, and every user line is kept
+	edited := once + "192.168.1.20	printer.lan\n"
+	got := splice(t, edited, shop)
+	if n := strings.Count(got, HostsBegin); n != 1 {
+		t.Errorf("%d managed blocks, want 1:\n%s", n, got)
+	}
+	if strings.Contains(got, "api.localhost") || !strings.Contains(got, "127.0.0.1 shop.localhost\n") {
+		t.Errorf("block not replaced:\n%s", got)
+	}
+	for _, line := range []string{"10.0.0.5\tnas.lan\n", "# Added by hand\n", "192.168.1.20\tprinter.lan\n"} {
+		if !strings.Contains(got, line) {
+			t.Errorf("user line %q removed:\n%s", line, got)
+		}
+	}
+	if !strings.HasSuffix(got, HostsEnd+"\n192.168.1.20\tprinter.lan\n") {
+		t.Errorf("block moved:\n%s", got)
+	}
+
+	// No services leaves an empty block to splice into next time
+	empty := splice(t, got)
+	if splice(t, empty, shop) != got {
+		t.Errorf("splicing into the emptied block didn't restore the file:\n%s", empty)
+	}
+}
+
+func TestSpliceMergesDuplicateBlocks(t *testing.T) {
+	block := HostsBegin + "\n127.0.0.1 old.localhost\n" + HostsEnd + "\n"
+	// Left over from two copies of the file pasted together
+	contents := systemHosts + block + "10.0.0.6\tnas2.lan\n" + "  " + block
+	got := splice(t, contents, shop)
+	want := systemHosts + HostsBegin + "\n127.0.0.1 shop.localhost\n" + HostsEnd + "\n10.0.0.6\tnas2.lan\n"
+	if got != want {
+		t.Errorf("spliced:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestSpliceUnterminatedBlock(t *testing.T) {
+	contents := systemHosts + HostsBegin + "\n127.0.0.1 shop.localhost\n10.0.0.7\tbackup.lan\n"
+	if out, err := Splice([]byte(contents), []Service{shop}); !errors.Is(err, ErrUnterminatedBlock) || out != nil {
+		t.Errorf("Splice = %q, %v; want ErrUnterminatedBlock", out, err)
+	}
+}
+
+func TestApplyHosts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(path, []byte(systemHosts), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	changed, err := ApplyHosts(path, []Service{shop})
+	if err != nil || !changed {
+		t.Fatalf("ApplyHosts = %v, %v; want the file changed", changed, err)
+	}
+	if changed, err := ApplyHosts(path, []Service{shop}); err != nil || changed {
+		t.Errorf("applying again = %v, %v; want nothing to change", changed, err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o640 {
+		t.Errorf("mode %v, want the file's own 0640", info.Mode().Perm())
+	}
+	contents, _ := os.ReadFile(path)
+	if string(contents) != splice(t, systemHosts, shop) {
+		t.Errorf("file contents:\n%s", contents)
+	}
+}
@@ -0,0 +1,297 @@
+// Package handoff lets the daemon be replaced without unbinding its ports.
+// Listening sockets are opened through Listen and ListenUDP, which first
+// look among the sockets the process inherited, the way systemd socket
+// activation passes them (LISTEN_FDS, from file descriptor 3). Upgrade
+// starts a replacement process handing it the open sockets the same way,
+// and returns once it is serving, so connections keep being accepted while
+// the old process drains. Inherited sockets are matched to what the
+// process asks for by network and address; their names don't matter.
+package handoff
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Environment of a process started with sockets, as systemd sets it, and
+// the pipe an upgrade's replacement reports it is serving on
+const (
+	envFDs     = "LISTEN_FDS"
+	envFDNames = "LISTEN_FDNAMES"
+	envPID     = "LISTEN_PID"
+	envReady   = "LISTEN_READY_FD"
+)
+
+// firstFD is the file descriptor of the first inherited socket
+const firstFD = 3
+
+// DefaultUpgradeTimeout bounds how long Upgrade waits for the replacement
+// to serve
+const DefaultUpgradeTimeout = 30 * time.Second
+
+// ReusePort binds the sockets Listen and ListenUDP open themselves with
+// SO_REUSEPORT, so a replacement started without the sockets, e.g. by a
+// package upgrade, can bind the same ports before this process exits.
+// Only on Linux and macOS; set it before the first Listen.
+var ReusePort bool
+
+var (
+	mu        sync.Mutex
+	loaded    bool
+	listeners []net.Listener   // Inherited and not claimed yet
+	packets   []net.PacketConn // Likewise
+	ready     *os.File         // Written to once serving, nil if not upgraded
+	open      []socket         // What Listen and ListenUDP returned
+)
+
+// socket is a socket handed out, to be passed on by Upgrade
+type socket struct {
+	network string
+	file    func() (*os.File, error) // A duplicate of its descriptor
+}
+
+// inherit takes the sockets from the environment, the first time it is
+// called, and clears the environment so they aren't passed on to other
+// programs. The caller holds mu.
+func inherit() {
+	if loaded {
+		return
+	}
+	loaded = true
+	count, countErr := strconv.Atoi(os.Getenv(envFDs))
+	pid := os.Getenv(envPID)
+	readyFD, readyErr := strconv.Atoi(os.Getenv(envReady))
+	for _, key := range []string{envFDs, envFDNames, envPID, envReady} {
+		os.Unsetenv(key)
+	}
+	if readyErr == nil && readyFD >= firstFD {
+		ready = os.NewFile(uintptr(readyFD), "ready")
+	}
+	// systemd names the process the sockets are meant for
+	if countErr != nil || count <= 0 || pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	for fd := firstFD; fd < firstFD+count; fd++ {
+		if fd == readyFD {
+			continue
+		}
+		f := os.NewFile(uintptr(fd), "inherited")
+		if ln, err := net.FileListener(f); err == nil {
+			listeners = append(listeners, ln)
+		} else if pc, err := net.FilePacketConn(f); err == nil {
+			packets = append(packets, pc)
+		} else {
+			log.Printf("Handoff: ignoring inherited descriptor %d: %v", fd, err)
+		}
+		f.Close()
+	}
+}
+
+// Listen returns a TCP listener on addr: an inherited one bound there, or
+// a new one
+func Listen(network, addr string) (net.Listener, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	inherit()
+	for i, ln := range listeners {
+		if sameAddr(ln.Addr(), network, addr) {
+			listeners = append(listeners[:i], listeners[i+1:]...)
+			track(network, ln)
+			return ln, nil
+		}
+	}
+	lc := listenConfig()
+	ln, err := lc.Listen(context.Background(), network, addr)
+	if err != nil {
+		return nil, err
+	}
+	track(network, ln)
+	return ln, nil
+}
+
+// ListenUDP returns a UDP socket on addr: an inherited one bound there, or
+// a new one
+func ListenUDP(network string, addr *net.UDPAddr) (*net.UDPConn, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	inherit()
+	for i, pc := range packets {
+		if conn, ok := pc.(*net.UDPConn); ok && sameAddr(conn.LocalAddr(), network, addr.String()) {
+			packets = append(packets[:i], packets[i+1:]...)
+			track(network, conn)
+			return conn, nil
+		}
+	}
+	lc := listenConfig()
+	pc, err := lc.ListenPacket(context.Background(), network, addr.String())
+	if err != nil {
+		return nil, err
+	}
+	conn := pc.(*net.UDPConn)
+	track(network, conn)
+	return conn, nil
+}
+
+// track records a socket handed out, if it can be passed on. The caller
+// holds mu.
+func track(network string, s any) {
+	if f, ok := s.(interface{ File() (*os.File, error) }); ok {
+		open = append(open, socket{network: network, file: f.File})
+	}
+}
+
+// sameAddr reports whether a socket bound to bound is what listening on
+// network and addr asks for. A wildcard host matches any unspecified
+// address, and port 0 never matches, as it asks for a new port.
+func sameAddr(bound net.Addr, network, addr string) bool {
+	if strings.HasPrefix(bound.Network(), "udp") != strings.HasPrefix(network, "udp") {
+		return false
+	}
+	want, err := resolve(network, addr)
+	if err != nil || want.Port == 0 {
+		return false
+	}
+	got, err := resolve(bound.Network(), bound.String())
+	if err != nil || got.Port != want.Port {
+		return false
+	}
+	if unspecified(want.IP) || unspecified(got.IP) {
+		return unspecified(want.IP) && unspecified(got.IP)
+	}
+	return want.IP.Equal(got.IP)
+}
+
+// resolve parses a TCP or UDP address into its IP and port
+func resolve(network, addr string) (*net.TCPAddr, error) {
+	if strings.HasPrefix(network, "udp") {
+		udp, err := net.ResolveUDPAddr(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &net.TCPAddr{IP: udp.IP, Port: udp.Port, Zone: udp.Zone}, nil
+	}
+	return net.ResolveTCPAddr(network, addr)
+}
+
+// unspecified reports whether ip is the wildcard address or missing
+func unspecified(ip net.IP) bool {
+	return ip == nil || ip.IsUnspecified()
+}
+
+// Ready tells the process that started this one through Upgrade that it
+// is serving, and closes the inherited sockets nothing claimed. Call it
+// once every listener is open.
+func Ready() error {
+	mu.Lock()
+	defer mu.Unlock()
+	inherit()
+	for _, ln := range listeners {
+		log.Printf("Handoff: closing unused inherited socket %s", ln.Addr())
+		ln.Close()
+	}
+	for _, pc := range packets {
+		log.Printf("Handoff: closing unused inherited socket %s", pc.LocalAddr())
+		pc.Close()
+	}
+	listeners, packets = nil, nil
+	if ready == nil {
+		return nil
+	}
+	_, err := ready.Write([]byte{1})
+	ready.Close()
+	ready = nil
+	if err != nil {
+		return fmt.Errorf("failed to report ready: %w", err)
+	}
+	return nil
+}
+
+// Upgrade starts the executable again with the same arguments, handing it
+// the sockets Listen and ListenUDP returned that are still open, and waits
+// up to timeout for it to call Ready. On success the caller should stop
+// accepting, let its requests finish and exit; on error the replacement,
+// if it started, is killed and the caller keeps serving.
+func Upgrade(timeout time.Duration) error {
+	if !supported {
+		return fmt.Errorf("failed to upgrade: %w", errors.ErrUnsupported)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find the executable: %w", err)
+	}
+	files, names := openFiles()
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to create the ready pipe: %w", err)
+	}
+	defer r.Close()
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, w)
+	cmd.Env = append(os.Environ(),
+		envFDs+"="+strconv.Itoa(len(files)),
+		envFDNames+"="+strings.Join(names, ":"),
+		envReady+"="+strconv.Itoa(firstFD+len(files)),
+	)
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return fmt.Errorf("failed to start %s: %w", exe, err)
+	}
+	go cmd.Wait()
+
+	// The pipe reads EOF if the replacement exits without calling Ready
+	done := make(chan error, 1)
+	go func() {
+		_, err := r.Read(make([]byte, 1))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("replacement pid %d exited before serving", cmd.Process.Pid)
+		}
+		return nil
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		return fmt.Errorf("replacement pid %d not serving after %s", cmd.Process.Pid, timeout)
+	}
+}
+
+// openFiles duplicates the descriptors of the sockets handed out that are
+// still open, forgetting the closed ones, and returns them with their
+// networks as names
+func openFiles() ([]*os.File, []string) {
+	mu.Lock()
+	defer mu.Unlock()
+	inherit() // Clears the environment passed on
+	var files []*os.File
+	var names []string
+	kept := open[:0]
+	for _, s := range open {
+		f, err := s.file()
+		if err != nil {
+			continue // Closed since
+		}
+		files = append(files, f)
+		names = append(names, s.network)
+		kept = append(kept, s)
+	}
+	open = kept
+	return files, names
+}
@@ -0,0 +1,5 @@
+package handoff
+
+import "syscall"
+
+const soReusePort = syscall.SO_REUSEPORT
@@ -0,0 +1,20 @@
+//go:build !linux && !darwin
+
+package handoff
+
+import (
+	"net"
+	"os"
+)
+
+const supported = false
+
+func NotifyUpgrade(c chan<- os.Signal) {}
+
+func IsUpgrade(sig os.Signal) bool {
+	return false
+}
+
+func listenConfig() net.ListenConfig {
+	return net.ListenConfig{}
+}
@@ -0,0 +1,158 @@
+//go:build linux || darwin
+
+package handoff_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"localhost-magic/internal/handoff"
+	"localhost-magic/internal/proxy"
+)
+
+// envChild tells the test binary, started again by Upgrade, to serve as
+// the replacement on the address it names rather than run the tests
+const envChild = "HANDOFF_TEST_ADDR"
+
+func TestMain(m *testing.M) {
+	if addr := os.Getenv(envChild); addr != "" {
+		serveReplacement(addr)
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// serveReplacement answers "new" on addr, on the socket it inherited, until
+// asked for /stop
+func serveReplacement(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "new")
+	})
+	mux.HandleFunc("/stop", func(w http.ResponseWriter, r *http.Request) {
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			os.Exit(0)
+		}()
+	})
+	server := proxy.NewServer(mux, nil)
+	if err := server.Listen(addr, ""); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := handoff.Ready(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	// Don't outlive a test that failed before stopping it
+	time.AfterFunc(time.Minute, func() { os.Exit(1) })
+	server.Wait()
+}
+
+// freeAddr returns a loopback address nothing listens on
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// get fetches path on addr over a connection of its own
+func get(client *http.Client, addr, path string) (string, error) {
+	resp, err := client.Get("http://" + addr + path)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+// TestUpgradeMidRequest restarts the server while a slow request is in
+// flight and others keep arriving: the slow one is answered by the old
+// process, and no client sees an error while the replacement takes over
+func TestUpgradeMidRequest(t *testing.T) {
+	addr := freeAddr(t)
+	started := make(chan struct{}, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "old")
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		time.Sleep(500 * time.Millisecond)
+		io.WriteString(w, "old")
+	})
+	server := proxy.NewServer(mux, nil)
+	if err := server.Listen(addr, ""); err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: 10 * time.Second}
+	t.Cleanup(func() { get(client, addr, "/stop") })
+
+	slow := make(chan error, 1)
+	go func() {
+		body, err := get(client, addr, "/slow")
+		if err == nil && body != "old" {
+			err = fmt.Errorf("answered %q by the replacement", body)
+		}
+		slow <- err
+	}()
+	<-started
+
+	// Keep requests coming until the replacement alone serves
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if _, err := get(client, addr, "/"); err != nil {
+					mu.Lock()
+					errs = append(errs, err)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	t.Setenv(envChild, addr)
+	if err := handoff.Upgrade(10 * time.Second); err != nil {
+		t.Fatalf("Upgrade: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	if err := <-slow; err != nil {
+		t.Errorf("request in flight during the upgrade: %v", err)
+	}
+	body, err := get(client, addr, "/")
+	close(stop)
+	wg.Wait()
+	if err != nil || body != "new" {
+		t.Errorf("after the upgrade got %q, %v; want the replacement's answer", body, err)
+	}
+	for _, err := range errs {
+		t.Errorf("request during the upgrade: %v", err)
+	}
+}
@@ -0,0 +1,42 @@
+//go:build linux || darwin
+
+package handoff
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// supported is whether sockets can be passed to a replacement
+const supported = true
+
+// NotifyUpgrade relays SIGUSR2, which asks for an upgrade, to c
+func NotifyUpgrade(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR2)
+}
+
+// IsUpgrade reports whether sig asks for an upgrade
+func IsUpgrade(sig os.Signal) bool {
+	return sig == syscall.SIGUSR2
+}
+
+// listenConfig sets SO_REUSEPORT on new sockets when ReusePort is set
+func listenConfig() net.ListenConfig {
+	if !ReusePort {
+		return net.ListenConfig{}
+	}
+	return net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+}
@@ -0,0 +1,142 @@
+// Package health scores services from their successive checks. Up or down
+// isn't enough: a service answering 500 on every request, or taking five
+// seconds to, is up but broken. A Score moves a service between Healthy,
+// Degraded and Down only once enough checks in a row agree, so a single
+// slow response doesn't flip it.
+package health
+
+import (
+	"strconv"
+	"time"
+
+	"localhost-magic/probe"
+)
+
+// State is how well a service is doing
+type State string
+
+const (
+	StateUnknown  State = ""         // Not checked yet
+	StateHealthy  State = "healthy"  // Answering in time, without server errors
+	StateDegraded State = "degraded" // Slow, or failing some of the time
+	StateDown     State = "down"     // Failing every check
+)
+
+// Defaults used when the Thresholds field is zero
+const (
+	DefaultSlow          = 2 * time.Second
+	DefaultDegradedAfter = 2
+	DefaultDownAfter     = 3
+	DefaultRecoverAfter  = 2
+)
+
+// Thresholds say when checks move a service to another state
+type Thresholds struct {
+	// Slow is the time to first byte from which an answer counts as slow
+	Slow time.Duration
+	// DegradedAfter is the number of slow or failed checks in a row that
+	// make a healthy service Degraded, or of slow ones a Down service, and
+	// DownAfter the number of failed ones that make any service Down
+	DegradedAfter int
+	DownAfter     int
+	// RecoverAfter is the number of good checks in a row that make a
+	// Degraded or Down service Healthy again
+	RecoverAfter int
+}
+
+// withDefaults returns a copy of the thresholds with zero fields filled in
+func (t Thresholds) withDefaults() Thresholds {
+	if t.Slow <= 0 {
+		t.Slow = DefaultSlow
+	}
+	if t.DegradedAfter <= 0 {
+		t.DegradedAfter = DefaultDegradedAfter
+	}
+	if t.DownAfter <= 0 {
+		t.DownAfter = DefaultDownAfter
+	}
+	if t.RecoverAfter <= 0 {
+		t.RecoverAfter = DefaultRecoverAfter
+	}
+	return t
+}
+
+// Check is the verdict on one probe of a service
+type Check string
+
+const (
+	CheckOK     Check = "ok"
+	CheckSlow   Check = "slow"   // Answered without a server error, past Thresholds.Slow
+	CheckFailed Check = "failed" // A 5xx, or no HTTP answer at all
+)
+
+// Classify judges one probe result, returning why it isn't CheckOK
+func (t Thresholds) Classify(r probe.ProbeResult) (Check, string) {
+	t = t.withDefaults()
+	switch {
+	case !r.IsHTTP && r.Protocol == probe.ProtocolUnknown:
+		if r.Err != nil {
+			return CheckFailed, "no answer: " + r.Err.Error()
+		}
+		return CheckFailed, "no HTTP answer"
+	case r.StatusCode >= 500:
+		return CheckFailed, "status " + strconv.Itoa(r.StatusCode)
+	case r.TTFB > t.Slow:
+		return CheckSlow, "answered in " + r.TTFB.Round(time.Millisecond).String()
+	}
+	return CheckOK, ""
+}
+
+// Score is a service's health, with the run of checks that led to it
+type Score struct {
+	State   State     `json:"state"`
+	Since   time.Time `json:"since"`            // When it entered State
+	Checked time.Time `json:"checked"`          // The last check
+	Reason  string    `json:"reason,omitempty"` // Why the last check wasn't OK
+	// The checks in a row that were failed, slow, slow or failed, and OK
+	Failed int `json:"failed,omitempty"`
+	Slow   int `json:"slow,omitempty"`
+	Bad    int `json:"bad,omitempty"`
+	Good   int `json:"good,omitempty"`
+}
+
+// Observe returns the score after one more check of the service. The first
+// check sets the state directly, Down only for a service not answering
+// HTTP; after that it changes only once the thresholds are reached.
+func (s Score) Observe(r probe.ProbeResult, t Thresholds, now time.Time) Score {
+	t = t.withDefaults()
+	check, reason := t.Classify(r)
+	s.Checked, s.Reason = now, reason
+	switch check {
+	case CheckOK:
+		s.Failed, s.Slow, s.Bad, s.Good = 0, 0, 0, s.Good+1
+	case CheckSlow:
+		s.Failed, s.Slow, s.Bad, s.Good = 0, s.Slow+1, s.Bad+1, 0
+	case CheckFailed:
+		s.Failed, s.Slow, s.Bad, s.Good = s.Failed+1, 0, s.Bad+1, 0
+	}
+
+	next := s.State
+	switch {
+	case s.State == StateUnknown && check == CheckOK:
+		next = StateHealthy
+	case s.State == StateUnknown && check == CheckFailed && !r.IsHTTP:
+		next = StateDown
+	case s.State == StateUnknown:
+		next = StateDegraded
+	case s.Failed >= t.DownAfter:
+		next = StateDown
+	case s.State == StateHealthy && s.Bad >= t.DegradedAfter:
+		next = StateDegraded
+	case s.State == StateDown && s.Slow >= t.DegradedAfter:
+		// Answering again, but slowly. The failures that made it Down
+		// count towards Bad, so they mustn't count here.
+		next = StateDegraded
+	case s.State != StateHealthy && s.Good >= t.RecoverAfter:
+		next = StateHealthy
+	}
+	if next != s.State {
+		s.State, s.Since = next, now
+	}
+	return s
+}
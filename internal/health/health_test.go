@@ -0,0 +1,112 @@
+package health
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"localhost-magic/probe"
+)
+
+var (
+	ok     = probe.ProbeResult{IsHTTP: true, Protocol: probe.ProtocolHTTP1, StatusCode: 200, TTFB: 20 * time.Millisecond}
+	slow   = probe.ProbeResult{IsHTTP: true, Protocol: probe.ProtocolHTTP1, StatusCode: 200, TTFB: 3 * time.Second}
+	broken = probe.ProbeResult{IsHTTP: true, Protocol: probe.ProtocolHTTP1, StatusCode: 502, TTFB: 20 * time.Millisecond}
+	gone   = probe.ProbeResult{Err: errors.New("connection refused")}
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name   string
+		result probe.ProbeResult
+		check  Check
+		reason string
+	}{
+		{"ok", ok, CheckOK, ""},
+		{"slow", slow, CheckSlow, "answered in 3s"},
+		{"server error", broken, CheckFailed, "status 502"},
+		{"refused", gone, CheckFailed, "no answer: connection refused"},
+		{"not HTTP", probe.ProbeResult{}, CheckFailed, "no HTTP answer"},
+		{"gRPC", probe.ProbeResult{Protocol: probe.ProtocolGRPC}, CheckOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			check, reason := Thresholds{}.Classify(tt.result)
+			if check != tt.check || reason != tt.reason {
+				t.Errorf("Classify = %q, %q; want %q, %q", check, reason, tt.check, tt.reason)
+			}
+		})
+	}
+}
+
+func TestObserve(t *testing.T) {
+	tests := []struct {
+		name   string
+		checks []probe.ProbeResult
+		want   []State // After each check
+	}{
+		{"healthy", []probe.ProbeResult{ok, ok},
+			[]State{StateHealthy, StateHealthy}},
+		{"first check slow", []probe.ProbeResult{slow},
+			[]State{StateDegraded}},
+		{"first check refused", []probe.ProbeResult{gone},
+			[]State{StateDown}},
+		{"first check a server error", []probe.ProbeResult{broken},
+			[]State{StateDegraded}},
+		{"one slow answer doesn't flip it", []probe.ProbeResult{ok, slow, ok, slow},
+			[]State{StateHealthy, StateHealthy, StateHealthy, StateHealthy}},
+		{"slow in a row degrades", []probe.ProbeResult{ok, slow, slow},
+			[]State{StateHealthy, StateHealthy, StateDegraded}},
+		{"slow and failing degrade", []probe.ProbeResult{ok, slow, broken},
+			[]State{StateHealthy, StateHealthy, StateDegraded}},
+		{"failing in a row goes down", []probe.ProbeResult{ok, broken, broken, broken},
+			[]State{StateHealthy, StateHealthy, StateDegraded, StateDown}},
+		{"recovers after good checks", []probe.ProbeResult{gone, ok, ok},
+			[]State{StateDown, StateDown, StateHealthy}},
+		{"a good check between doesn't recover", []probe.ProbeResult{slow, ok, slow, ok, ok},
+			[]State{StateDegraded, StateDegraded, StateDegraded, StateDegraded, StateHealthy}},
+		// The failures that made it Down don't count as slow answers
+		{"one slow answer keeps it down", []probe.ProbeResult{ok, gone, gone, gone, slow},
+			[]State{StateHealthy, StateHealthy, StateDegraded, StateDown, StateDown}},
+		{"slow answers in a row lift it to degraded", []probe.ProbeResult{gone, gone, slow, slow},
+			[]State{StateDown, StateDown, StateDown, StateDegraded}},
+		{"a failure between slow answers keeps it down", []probe.ProbeResult{gone, slow, gone, slow},
+			[]State{StateDown, StateDown, StateDown, StateDown}},
+	}
+	start := time.Date(2026, 3, 14, 9, 30, 0, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s Score
+			for i, r := range tt.checks {
+				now := start.Add(time.Duration(i) * time.Minute)
+				before := s.State
+				s = s.Observe(r, Thresholds{}, now)
+				if s.State != tt.want[i] {
+					t.Fatalf("after check %d: %s, want %s (%+v)", i+1, s.State, tt.want[i], s)
+				}
+				if s.Checked != now || (s.State != before) != (s.Since == now) {
+					t.Errorf("after check %d: Checked %v, Since %v", i+1, s.Checked, s.Since)
+				}
+			}
+		})
+	}
+}
+
+func TestObserveThresholds(t *testing.T) {
+	th := Thresholds{Slow: time.Second, DegradedAfter: 1, DownAfter: 2, RecoverAfter: 3}
+	s := Score{}.Observe(ok, th, time.Now())
+	if s = s.Observe(probe.ProbeResult{IsHTTP: true, StatusCode: 200, TTFB: 1500 * time.Millisecond}, th, time.Now()); s.State != StateDegraded {
+		t.Fatalf("one answer past a 1s Slow with DegradedAfter 1: %s, want degraded", s.State)
+	}
+	if s = s.Observe(broken, th, time.Now()).Observe(broken, th, time.Now()); s.State != StateDown {
+		t.Fatalf("two failures with DownAfter 2: %s, want down", s.State)
+	}
+	for i := 0; i < 2; i++ {
+		if s = s.Observe(ok, th, time.Now()); s.State != StateDown {
+			t.Fatalf("%d good checks with RecoverAfter 3: %s, want down", i+1, s.State)
+		}
+	}
+	if s = s.Observe(ok, th, time.Now()); s.State != StateHealthy {
+		t.Errorf("3 good checks with RecoverAfter 3: %s, want healthy", s.State)
+	}
+}
@@ -0,0 +1,264 @@
+// Package hooks runs user commands and webhooks on discovery events: open
+// a browser tab when a service appears, post to a chat webhook, refresh a
+// status bar. Hooks run on a pool of workers so a slow hook never holds up
+// the scan that produced the event.
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"localhost-magic/internal/discover"
+)
+
+// Default settings used when the Options field is zero
+const (
+	DefaultConcurrency = 4
+	DefaultTimeout     = 10 * time.Second
+	DefaultRetries     = 3
+	queueSize          = 100
+)
+
+// Hook is a command or webhook to run for events. Exactly one of Command
+// and URL is set.
+type Hook struct {
+	// Command is exec'd with the event as JSON on stdin and LM_* variables
+	// in its environment, see Env
+	Command []string
+	// URL receives the event JSON in a POST
+	URL string
+	// Events limits the hook to these event types; empty means all
+	Events []discover.EventType
+}
+
+// String names the hook in log messages
+func (h Hook) String() string {
+	if h.URL != "" {
+		return "webhook " + h.URL
+	}
+	return fmt.Sprintf("hook %q", h.Command)
+}
+
+// wants reports whether the hook runs for events of type t
+func (h Hook) wants(t discover.EventType) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Options configures a Runner
+type Options struct {
+	Concurrency int           // Hooks running at once
+	Timeout     time.Duration // Per command run or webhook attempt
+	Retries     int           // Extra webhook attempts after a failure; negative for none
+}
+
+// Runner dispatches events to hooks
+type Runner struct {
+	hooks  []Hook
+	opts   Options
+	client *http.Client
+
+	jobs chan job
+	wg   sync.WaitGroup
+	once sync.Once
+}
+
+// job is one hook to run for one event
+type job struct {
+	hook    Hook
+	event   discover.Event
+	payload []byte
+}
+
+// Payload is the JSON a hook receives: the event plus a one-line summary
+// under "text", which chat webhooks such as Slack's display as the message
+type Payload struct {
+	Text string `json:"text"`
+	discover.Event
+}
+
+// NewRunner starts the workers for hooks. Call Close to wait for queued
+// hooks when done.
+func NewRunner(hooks []Hook, opts Options) *Runner {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = DefaultConcurrency
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.Retries == 0 {
+		opts.Retries = DefaultRetries
+	}
+	r := &Runner{
+		hooks:  hooks,
+		opts:   opts,
+		client: &http.Client{Timeout: opts.Timeout},
+		jobs:   make(chan job, queueSize),
+	}
+	for i := 0; i < opts.Concurrency; i++ {
+		r.wg.Add(1)
+		go r.work()
+	}
+	return r
+}
+
+// Handle queues the hooks for e and returns at once, so it can be passed
+// to Discoverer.OnEvent. If the queue is full the event is dropped for
+// that hook, with a log message.
+func (r *Runner) Handle(e discover.Event) {
+	payload, err := json.Marshal(Payload{Text: e.String(), Event: e})
+	if err != nil {
+		log.Printf("Failed to encode event for hooks: %v", err)
+		return
+	}
+	for _, h := range r.hooks {
+		if !h.wants(e.Type) {
+			continue
+		}
+		select {
+		case r.jobs <- job{hook: h, event: e, payload: payload}:
+		default:
+			log.Printf("Hook queue full, skipping %s for %s", h, e)
+		}
+	}
+}
+
+// Close stops accepting events and waits for queued hooks to finish
+func (r *Runner) Close() {
+	r.once.Do(func() { close(r.jobs) })
+	r.wg.Wait()
+}
+
+// work runs queued hooks until the queue is closed
+func (r *Runner) work() {
+	defer r.wg.Done()
+	for j := range r.jobs {
+		var err error
+		if j.hook.URL != "" {
+			err = r.post(j)
+		} else {
+			err = r.exec(j)
+		}
+		if err != nil {
+			log.Printf("%s failed for %s: %v", j.hook, j.event, err)
+		}
+	}
+}
+
+// exec runs a command hook
+func (r *Runner) exec(j job) error {
+	if len(j.hook.Command) == 0 {
+		return errors.New("empty command")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), r.opts.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, j.hook.Command[0], j.hook.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(j.payload)
+	cmd.Env = append(os.Environ(), Env(j.event)...)
+	output, err := cmd.CombinedOutput()
+
+	var exitErr *exec.ExitError
+	switch {
+	case ctx.Err() != nil:
+		return fmt.Errorf("timed out after %s", r.opts.Timeout)
+	case errors.As(err, &exitErr) && len(bytes.TrimSpace(output)) > 0:
+		return fmt.Errorf("exit code %d: %s", exitErr.ExitCode(), lastLine(output))
+	case errors.As(err, &exitErr):
+		return fmt.Errorf("exit code %d", exitErr.ExitCode())
+	}
+	return err
+}
+
+// post delivers a webhook, retrying network errors and 5xx/429 answers
+// with exponential backoff
+func (r *Runner) post(j job) error {
+	backoff := time.Second
+	var err error
+	for attempt := 0; attempt <= max(r.opts.Retries, 0); attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		var retry bool
+		if retry, err = r.postOnce(j); err == nil || !retry {
+			return err
+		}
+	}
+	return err
+}
+
+// postOnce makes one webhook attempt, reporting whether a failure is worth
+// retrying
+func (r *Runner) postOnce(j job) (retry bool, err error) {
+	resp, err := r.client.Post(j.hook.URL, "application/json", bytes.NewReader(j.payload))
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("HTTP %s", resp.Status)
+}
+
+// Env returns the variables a command hook gets for e: LM_EVENT, LM_ID,
+// LM_NAME, LM_PORT, LM_URL, and LM_TITLE, LM_CHANGES, LM_PREVIOUS_PORT
+// and LM_HEALTH when known
+func Env(e discover.Event) []string {
+	env := []string{
+		"LM_EVENT=" + string(e.Type),
+		"LM_ID=" + e.ID,
+		"LM_NAME=" + e.Name,
+		"LM_PORT=" + strconv.Itoa(e.Port),
+		"LM_URL=" + URL(e),
+	}
+	if e.Finding.Title != "" {
+		env = append(env, "LM_TITLE="+e.Finding.Title)
+	}
+	if len(e.Changes) > 0 {
+		changes, _ := json.Marshal(e.Changes)
+		env = append(env, "LM_CHANGES="+string(changes))
+	}
+	if e.PreviousPort != 0 {
+		env = append(env, "LM_PREVIOUS_PORT="+strconv.Itoa(e.PreviousPort))
+	}
+	if e.Health != nil && e.Health.State != "" {
+		env = append(env, "LM_HEALTH="+string(e.Health.State))
+	}
+	return env
+}
+
+// URL is where the event's service can be opened directly. The name is
+// left out: it only resolves to the service while the daemon proxies it.
+func URL(e discover.Event) string {
+	scheme := "http"
+	if e.Finding.IsTLS {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://localhost:%d/", scheme, e.Port)
+}
+
+// lastLine returns the last non-empty line of output, for error messages
+func lastLine(output []byte) string {
+	lines := bytes.Split(bytes.TrimSpace(output), []byte("\n"))
+	return string(lines[len(lines)-1])
+}
@@ -0,0 +1,133 @@
+// Package lan works out where other devices on the local network, a phone
+// on the same Wi-Fi say, reach a service listening on this machine
+package lan
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"localhost-magic/internal/procmap"
+)
+
+var (
+	// ErrLoopbackOnly is returned for a listener only this machine can
+	// connect to
+	ErrLoopbackOnly = errors.New("only listening on loopback")
+	// ErrUnknownScope is returned when the addresses a listener is bound
+	// to couldn't be read, e.g. for another user's process
+	ErrUnknownScope = errors.New("can't tell which addresses it listens on")
+	// ErrNoAddress is returned when no interface has an address another
+	// device could use
+	ErrNoAddress = errors.New("no network interface with a LAN address")
+)
+
+// virtualPrefixes name interfaces of bridges and tunnels to containers
+// and VMs, which other devices on the LAN can't reach
+var virtualPrefixes = []string{"docker", "br-", "veth", "virbr", "vmnet", "vboxnet", "cni", "podman"}
+
+// Addrs returns the addresses of this machine's interfaces that are up,
+// leaving out loopback, link-local and point-to-point ones. IPv4 comes
+// first, and virtual interfaces last.
+func Addrs() ([]net.IP, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list interfaces: %w", err)
+	}
+	type candidate struct {
+		ip      net.IP
+		virtual bool
+	}
+	var found []candidate
+	for _, ifi := range interfaces {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&(net.FlagLoopback|net.FlagPointToPoint) != 0 {
+			continue
+		}
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || !usable(ipnet.IP) {
+				continue
+			}
+			found = append(found, candidate{ip: ipnet.IP, virtual: isVirtual(ifi.Name)})
+		}
+	}
+	sort.SliceStable(found, func(i, j int) bool {
+		a, b := found[i], found[j]
+		if v4a, v4b := a.ip.To4() != nil, b.ip.To4() != nil; v4a != v4b {
+			return v4a
+		}
+		return !a.virtual && b.virtual
+	})
+	ips := make([]net.IP, len(found))
+	for i, c := range found {
+		ips[i] = c.ip
+	}
+	return ips, nil
+}
+
+// usable reports whether another device could connect to ip
+func usable(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsLinkLocalUnicast() && !ip.IsUnspecified() && !ip.IsMulticast()
+}
+
+func isVirtual(name string) bool {
+	for _, prefix := range virtualPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Host returns the address other devices reach a listener at, from the
+// addresses it is bound to and the scope they add up to, as procmap
+// reports them
+func Host(scope procmap.Scope, bound []string) (string, error) {
+	switch scope {
+	case procmap.ScopeLoopback:
+		return "", ErrLoopbackOnly
+	case procmap.ScopeUnknown:
+		return "", ErrUnknownScope
+	case procmap.ScopeSpecificInterface:
+		// The listener picked its interface; prefer IPv4 among them
+		var v6 string
+		for _, addr := range bound {
+			ip := net.ParseIP(addr)
+			switch {
+			case ip == nil || !usable(ip):
+			case ip.To4() != nil:
+				return ip.String(), nil
+			case v6 == "":
+				v6 = ip.String()
+			}
+		}
+		if v6 != "" {
+			return v6, nil
+		}
+		return "", ErrNoAddress
+	}
+
+	ips, err := Addrs()
+	if err != nil {
+		return "", err
+	}
+	for _, ip := range ips {
+		if scope == procmap.ScopeIPv6Only && ip.To4() != nil {
+			continue
+		}
+		return ip.String(), nil
+	}
+	return "", ErrNoAddress
+}
+
+// URL returns the root URL of a service at host and port
+func URL(scheme, host string, port int) string {
+	return scheme + "://" + net.JoinHostPort(host, strconv.Itoa(port)) + "/"
+}
@@ -0,0 +1,480 @@
+// Package listing formats scan results for people and for scripts: an
+// aligned table that fits the terminal, or JSON carrying every field
+package listing
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"localhost-magic/internal/health"
+	"localhost-magic/internal/procmap"
+	"localhost-magic/internal/scan"
+	"localhost-magic/internal/tls/policy"
+	"localhost-magic/probe"
+)
+
+// Service is a scan finding with the name it is known by. Auxiliary holds
+// the endpoints that only serve it, after Group.
+type Service struct {
+	Name      string       `json:"name,omitempty"`
+	Finding   scan.Finding `json:"finding"`
+	Auxiliary []Service    `json:"auxiliary,omitempty"`
+	// Proxy is set for a reverse proxy, with the apps it serves on the
+	// port
+	Proxy probe.ReverseProxy `json:"proxy,omitempty"`
+	Apps  []App              `json:"apps,omitempty"`
+	// LastSeen is set for a service that is down but still registered,
+	// whose Finding is how it was last seen
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+	// Health is the state a running watcher scored the service in, if any
+	Health health.State `json:"health,omitempty"`
+}
+
+// App is an app a reverse proxy serves, with the name it is known by
+type App struct {
+	Name  string      `json:"name"`
+	Route probe.Route `json:"route"`
+	URL   string      `json:"url,omitempty"` // Where the daemon's proxy serves it, in its API's answers
+}
+
+// Group moves each service whose finding has a Parent (see
+// scan.LinkAuxiliary) into the Auxiliary list of the TCP service on that
+// port. Services whose parent isn't in the list stay where they are.
+func Group(services []Service) []Service {
+	isParent := func(s Service) bool { return s.Finding.Parent == 0 && s.Finding.Transport == "" }
+	ports := make(map[int]bool, len(services))
+	for _, s := range services {
+		if isParent(s) {
+			ports[s.Finding.Port] = true
+		}
+	}
+	isChild := func(s Service) bool { return s.Finding.Parent != 0 && ports[s.Finding.Parent] }
+
+	children := make(map[int][]Service)
+	for _, s := range services {
+		if isChild(s) {
+			children[s.Finding.Parent] = append(children[s.Finding.Parent], s)
+		}
+	}
+	grouped := make([]Service, 0, len(services))
+	for _, s := range services {
+		if isChild(s) {
+			continue
+		}
+		if isParent(s) {
+			s.Auxiliary = children[s.Finding.Port]
+		}
+		grouped = append(grouped, s)
+	}
+	return grouped
+}
+
+// columns of the service table
+var columns = []Column{
+	{Header: "NAME", Flex: true, Min: 12},
+	{Header: "PORT", Right: true},
+	{Header: "PROTOCOL"},
+	{Header: "STATUS", Flex: true, Min: 6},
+	{Header: "TITLE/FRAMEWORK", Flex: true, Min: 10},
+	{Header: "PROCESS", Flex: true, Min: 10},
+	{Header: "LATENCY", Right: true},
+}
+
+// Render writes services as a table fitted to width (0 for no limit).
+// Auxiliary endpoints are summed up on their service's row, or with
+// expand listed on rows of their own beneath it, and the apps a reverse
+// proxy serves always are, with the Host or path they are routed by and
+// where to. Ports bound to all
+// interfaces are marked "*:", slow services' latency "⚠" and the status
+// of services probed with credentials "†", all explained below the
+// table, and the status of those with certificate problems "‼", listed
+// below it with how to renew the certificate of a name the local CA can
+// issue for. Services that are down are shown with when they were last
+// seen, faint on a terminal, and a service's health, when known, follows
+// its status in color.
+func Render(w io.Writer, services []Service, width int, expand bool) error {
+	t := NewTable(columns...)
+	t.Color = colorTerminal(w)
+	exposed, slow, authenticated := false, false, false
+	var certNotes []string
+	now := time.Now()
+	for _, s := range services {
+		f := s.Finding
+		if s.LastSeen != nil {
+			t.AddDimRow(
+				s.Name,
+				port(f.ProbeResult),
+				protocol(f.ProbeResult),
+				down(*s.LastSeen, now),
+				description(f),
+			)
+			continue
+		}
+		exposed = exposed || f.Scope == procmap.ScopeAllInterfaces
+		authenticated = authenticated || f.Authenticated
+		certNotes = append(certNotes, certNote(s.Name, f)...)
+		for _, aux := range s.Auxiliary {
+			certNotes = append(certNotes, certNote(aux.Name, aux.Finding)...)
+		}
+		desc := description(f)
+		if s.Proxy != probe.ProxyNone && f.Framework == "" {
+			desc = strings.TrimSpace(desc + " " + string(s.Proxy))
+		}
+		if !expand {
+			desc = strings.TrimSpace(desc + " " + auxiliarySummary(s.Auxiliary))
+		}
+		t.AddRow(
+			s.Name,
+			exposedPort(f),
+			protocol(f.ProbeResult),
+			withHealth(status(f), s.Health),
+			desc,
+			owner(f),
+			latency(f),
+		)
+		if sgr, ok := healthColors[s.Health]; ok {
+			t.Style(statusColumn, sgr)
+		}
+		if f.Slow {
+			t.Style(latencyColumn, slowColor)
+			slow = true
+		}
+		for _, app := range s.Apps {
+			t.AddRow(
+				"  └ "+app.Name,
+				exposedPort(f),
+				protocol(f.ProbeResult),
+				"routed",
+				routeDescription(app.Route),
+				app.Route.Router,
+				"",
+			)
+		}
+		if !expand {
+			continue
+		}
+		for _, aux := range s.Auxiliary {
+			a := aux.Finding
+			t.AddRow(
+				"  └ "+string(a.Auxiliary),
+				exposedPort(a),
+				protocol(a.ProbeResult),
+				status(a),
+				description(a),
+				owner(a),
+				latency(a),
+			)
+			if a.Slow {
+				t.Style(latencyColumn, slowColor)
+				slow = true
+			}
+			exposed = exposed || a.Scope == procmap.ScopeAllInterfaces
+		}
+	}
+	if err := t.Render(w, width); err != nil {
+		return err
+	}
+	var notes []string
+	if exposed {
+		notes = append(notes, "*: listening on all interfaces, reachable from other machines")
+	}
+	if slow {
+		notes = append(notes, slowMarker+": slow to send the first byte of its answer")
+	}
+	if authenticated {
+		notes = append(notes, authMarker+": probed with credentials from [auth] in the config")
+	}
+	notes = append(notes, certNotes...)
+	if len(notes) > 0 {
+		_, err := fmt.Fprintln(w, "\n"+strings.Join(notes, "\n"))
+		return err
+	}
+	return nil
+}
+
+// Indexes of STATUS and LATENCY in columns
+const (
+	statusColumn  = 3
+	latencyColumn = 6
+)
+
+// slowMarker flags the latency of a slow service, drawn in slowColor
+const (
+	slowMarker = "⚠"
+	slowColor  = "33"
+)
+
+// authMarker flags the status of a service answering authenticated probes
+const authMarker = "†"
+
+// certMarker flags the status of a service whose certificate a browser
+// would refuse
+const certMarker = "‼"
+
+// certNote lists the certificate problems of a service, e.g. "‼
+// myapp.localhost: cert expired 12 days ago", with the command giving it a
+// fresh certificate from the local CA when its name is one it issues for
+func certNote(name string, f scan.Finding) []string {
+	if len(f.CertIssues) == 0 {
+		return nil
+	}
+	who := name
+	if who == "" {
+		who = "port " + strconv.Itoa(f.Port)
+	}
+	notes := []string{certMarker + " " + who + ": " + strings.Join(f.CertIssues, ", ")}
+	if name != "" && policy.Check(name) == nil {
+		notes = append(notes, "  renew with: localhost-magic cert renew "+strings.TrimSuffix(name, ".localhost"))
+	}
+	return notes
+}
+
+// healthColors are the SGR colors of the health states: green, yellow, red
+var healthColors = map[health.State]string{
+	health.StateHealthy:  "32",
+	health.StateDegraded: "33",
+	health.StateDown:     "31",
+}
+
+// withHealth is a status followed by the health badge, e.g.
+// "500 Internal Server Error ● degraded"
+func withHealth(status string, state health.State) string {
+	if state == health.StateUnknown {
+		return status
+	}
+	return status + " ● " + string(state)
+}
+
+// down is the status of a service that is down, last seen at t
+func down(t, now time.Time) string {
+	if t.IsZero() {
+		return "down"
+	}
+	return "down, seen " + ago(t, now)
+}
+
+// ago says how long before now t was, e.g. "3h ago"
+func ago(t, now time.Time) string {
+	d := now.Sub(t)
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d.Hours()))
+	}
+	return fmt.Sprintf("%dd ago", int(d.Hours()/24))
+}
+
+// colorTerminal reports whether w is a terminal styles may be used on,
+// which $NO_COLOR turns off
+func colorTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok || os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// routeDescription is what an app is routed by and where to, e.g.
+// "shop.test/api → 127.0.0.1:3000"
+func routeDescription(r probe.Route) string {
+	if r.Backend == "" {
+		return r.String()
+	}
+	return r.String() + " → " + r.Backend
+}
+
+// auxiliarySummary lists auxiliary endpoints as e.g. "+hmr:24678"
+func auxiliarySummary(aux []Service) string {
+	parts := make([]string, 0, len(aux))
+	for _, a := range aux {
+		parts = append(parts, fmt.Sprintf("+%s:%d", a.Finding.Auxiliary, a.Finding.Port))
+	}
+	return strings.Join(parts, " ")
+}
+
+// WriteJSON writes services as an indented JSON array, one object per
+// service with the full finding under "finding"
+func WriteJSON(w io.Writer, services []Service) error {
+	if services == nil {
+		services = []Service{} // [] rather than null
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(services)
+}
+
+// port is the port number, marked /udp for UDP services
+func port(r probe.ProbeResult) string {
+	if r.Transport != "" {
+		return strconv.Itoa(r.Port) + "/" + r.Transport
+	}
+	return strconv.Itoa(r.Port)
+}
+
+// exposedPort is port, prefixed "*:" when the listener is bound to all
+// interfaces, or with the address for loopback ones other than 127.0.0.1
+// and ::1, e.g. "127.0.0.2:8080"
+func exposedPort(f scan.Finding) string {
+	switch {
+	case f.Scope == procmap.ScopeAllInterfaces:
+		return "*:" + port(f.ProbeResult)
+	case f.Address != "" && !procmap.IsDefaultLoopback(f.Address):
+		return f.Address + ":" + port(f.ProbeResult)
+	}
+	return port(f.ProbeResult)
+}
+
+// protocol names what the port speaks, e.g. "https", "h2c" or "redis",
+// with "+h2" when an HTTPS service negotiates HTTP/2 too and "+h3" when
+// the HTTP/3 endpoint it advertised answered a QUIC probe
+func protocol(r probe.ProbeResult) string {
+	name := transportProtocol(r)
+	if r.IsHTTP && slices.Contains(r.SupportedVersions, probe.VersionH2) {
+		name += "+h2"
+	}
+	if r.QUIC != nil && r.QUIC.Protocol == probe.ProtocolH3 {
+		name += "+h3"
+	}
+	return name
+}
+
+// transportProtocol is protocol without the QUIC suffix
+func transportProtocol(r probe.ProbeResult) string {
+	switch {
+	case r.Kind == probe.ServiceQUIC && r.Protocol != probe.ProtocolUnknown:
+		return string(r.Protocol)
+	case r.Kind == probe.ServiceQUIC:
+		return "quic"
+	case r.IsTLS && r.IsHTTP:
+		return "https"
+	case r.IsTLS:
+		return "tls"
+	case r.Protocol != probe.ProtocolUnknown && r.Protocol != probe.ProtocolHTTP1:
+		return string(r.Protocol)
+	case r.IsHTTP:
+		return "http"
+	case r.Kind != probe.ServiceUnknown:
+		return string(r.Kind)
+	}
+	return "-"
+}
+
+// status is the HTTP status for web services and the probe state
+// otherwise, marked when the certificate has problems
+func status(f scan.Finding) string {
+	r := f.ProbeResult
+	status := string(f.State)
+	switch {
+	case r.StatusCode != 0 && r.Authenticated:
+		status = fmt.Sprintf("%d %s %s", r.StatusCode, r.StatusText, authMarker)
+	case r.StatusCode != 0:
+		status = fmt.Sprintf("%d %s", r.StatusCode, r.StatusText)
+	case r.ClientCertRequired:
+		status = "TLS (client cert required)"
+	case r.State != probe.StateUnknown:
+		status = string(r.State)
+	}
+	if len(f.CertIssues) > 0 {
+		status += " " + certMarker
+	}
+	return status
+}
+
+// description is the page title and framework, or a port hint for
+// services that didn't identify themselves, followed by the URL of any
+// API document, the GraphQL endpoint and the CAs an mTLS service accepts
+// client certificates from. A file server's listing title gives way to
+// the directory it serves. An answer from a candidate path other than the
+// root names the path.
+func description(f scan.Finding) string {
+	r := f.ProbeResult
+	if r.Title == "" && r.APISpec != nil {
+		r.Title = r.APISpec.Title
+	}
+	if r.DirListing != nil {
+		r.Title = "file server"
+		if f.ServedPath != "" {
+			r.Title += " for " + procmap.ShortPath(f.ServedPath)
+		}
+	}
+	desc := summary(r)
+	if r.Path != "" && r.Path != "/" {
+		desc = strings.TrimSpace(desc + " at " + r.Path)
+	}
+	if r.SSE {
+		desc = strings.TrimSpace(desc + " event stream")
+	}
+	if r.APISpec != nil {
+		desc = strings.TrimSpace(desc + " spec: " + r.APISpec.URL)
+	}
+	if r.GraphQL {
+		desc = strings.TrimSpace(desc + " graphql: " + r.GraphQLPath)
+	}
+	if len(r.GRPCServices) > 0 {
+		desc = strings.TrimSpace(desc + " " + strings.Join(r.GRPCServices, ", "))
+	}
+	if r.ClientCertRequired && r.Cert != nil && len(r.Cert.AcceptableCAs) > 0 {
+		desc = strings.TrimSpace(desc + " CAs: " + strings.Join(r.Cert.AcceptableCAs, "; "))
+	}
+	return desc
+}
+
+// summary is description without the API document
+func summary(r probe.ProbeResult) string {
+	switch {
+	case r.Title != "" && r.Framework != "":
+		return r.Title + " (" + r.Framework + ")"
+	case r.Title != "":
+		return r.Title
+	case r.Framework != "":
+		return r.Framework
+	case r.Hint != "":
+		return r.Hint + "?"
+	}
+	return ""
+}
+
+// owner is the publishing container, else the owning process
+func owner(f scan.Finding) string {
+	switch {
+	case f.Container != nil:
+		return "container " + f.Container.String()
+	case f.Process != nil:
+		return f.Process.String()
+	}
+	return ""
+}
+
+// latency is the time to first byte, or the whole probe for services that
+// never answered, marked for a slow service
+func latency(f scan.Finding) string {
+	if f.Slow {
+		return slowMarker + " " + duration(f.TTFB)
+	}
+	d := f.TTFB
+	if d == 0 {
+		d = f.Duration
+	}
+	return duration(d)
+}
+
+// duration formats a latency, to the microsecond below a millisecond
+func duration(d time.Duration) string {
+	switch {
+	case d == 0:
+		return ""
+	case d < time.Millisecond:
+		return d.Round(time.Microsecond).String()
+	}
+	return d.Round(time.Millisecond).String()
+}
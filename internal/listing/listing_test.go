@@ -0,0 +1,149 @@
+package listing
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"localhost-magic/internal/scan"
+	"localhost-magic/probe"
+)
+
+// web is an HTTP service on port
+func web(name string, port int) Service {
+	return Service{Name: name, Finding: scan.Finding{State: scan.StateOpen, ProbeResult: probe.ProbeResult{
+		Port: port, State: probe.StateHTTP, IsHTTP: true, StatusCode: 200, StatusText: "OK",
+	}}}
+}
+
+// aux is an auxiliary endpoint of the service on parent, 0 for none found
+func aux(kind probe.Auxiliary, port, parent int) Service {
+	return Service{Finding: scan.Finding{State: scan.StateOpen, Parent: parent, ProbeResult: probe.ProbeResult{
+		Port: port, State: probe.StateOpenNonHTTP, Auxiliary: kind,
+	}}}
+}
+
+// udp is s on its port's UDP side
+func udp(s Service) Service {
+	s.Finding.Transport = "udp"
+	return s
+}
+
+// layout is the ports of services with those of their auxiliary
+// endpoints in brackets, e.g. "5173[24678] 8080"
+func layout(services []Service) string {
+	var parts []string
+	for _, s := range services {
+		part := port(s.Finding.ProbeResult)
+		if len(s.Auxiliary) > 0 {
+			var children []string
+			for _, a := range s.Auxiliary {
+				children = append(children, port(a.Finding.ProbeResult))
+			}
+			part += "[" + strings.Join(children, " ") + "]"
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestGroup(t *testing.T) {
+	tests := []struct {
+		name     string
+		services []Service
+		want     string
+	}{
+		{"no auxiliaries", []Service{web("a", 3000), web("b", 8080)}, "3000 8080"},
+		{
+			"each under its parent, in their order",
+			[]Service{web("vite", 5173), aux(probe.AuxiliaryHMR, 24678, 5173), web("api", 8080),
+				aux(probe.AuxiliaryHMR, 9229, 8080), aux(probe.AuxiliaryHMR, 24679, 5173)},
+			"5173[24678 24679] 8080[9229]",
+		},
+		{
+			"before their parent",
+			[]Service{aux(probe.AuxiliaryHMR, 3001, 8080), web("api", 8080)},
+			"8080[3001]",
+		},
+		{
+			"without a parent",
+			[]Service{aux(probe.AuxiliaryHMR, 9229, 0), web("api", 8080)},
+			"9229 8080",
+		},
+		{
+			"parent not listed",
+			[]Service{web("api", 8080), aux(probe.AuxiliaryHMR, 24678, 5173)},
+			"8080 24678",
+		},
+		{
+			"parent is itself auxiliary",
+			[]Service{web("vite", 5173), aux(probe.AuxiliaryHMR, 24678, 5173), aux(probe.AuxiliaryHMR, 9229, 24678)},
+			"5173[24678] 9229",
+		},
+		{
+			"parent's port has a UDP service too",
+			[]Service{web("app", 4433), udp(web("app", 4433)), aux(probe.AuxiliaryHMR, 24678, 4433)},
+			"4433[24678] 4433/udp",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := layout(Group(tt.services)); got != tt.want {
+				t.Errorf("Group() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGroupLeavesInputAlone(t *testing.T) {
+	services := []Service{web("vite", 5173), aux(probe.AuxiliaryHMR, 24678, 5173)}
+	before := append([]Service(nil), services...)
+	Group(services)
+	if !reflect.DeepEqual(services, before) {
+		t.Errorf("Group changed its argument to %+v", services)
+	}
+}
+
+// names is the NAME cell of each row of a rendered table
+func names(out string) []string {
+	var names []string
+	for _, line := range strings.Split(out, "\n")[1:] {
+		if line == "" {
+			break
+		}
+		name, _, _ := strings.Cut(strings.TrimLeft(line, " "), "  ")
+		names = append(names, strings.TrimSpace(name))
+	}
+	return names
+}
+
+func TestRenderNesting(t *testing.T) {
+	proxy := web("caddy", 443)
+	proxy.Proxy = probe.ProxyCaddy
+	proxy.Apps = []App{{Name: "shop.localhost", Route: probe.Route{Host: "shop.test", Backend: "127.0.0.1:3000"}}}
+	proxy.Auxiliary = []Service{aux(probe.AuxiliaryHMR, 2019, 443)}
+	services := []Service{proxy, web("vite", 5173)}
+	services[1].Auxiliary = []Service{aux(probe.AuxiliaryHMR, 24678, 5173), aux(probe.AuxiliaryHMR, 9229, 5173)}
+
+	tests := []struct {
+		expand bool
+		want   []string
+	}{
+		{false, []string{"caddy", "└ shop.localhost", "vite"}},
+		{true, []string{"caddy", "└ shop.localhost", "└ hmr", "vite", "└ hmr", "└ hmr"}},
+	}
+	for _, tt := range tests {
+		var b bytes.Buffer
+		if err := Render(&b, services, 0, tt.expand); err != nil {
+			t.Fatal(err)
+		}
+		if got := names(b.String()); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("expand %v: rows %q, want %q\n%s", tt.expand, got, tt.want, b.String())
+		}
+		summed := strings.Contains(b.String(), "+hmr:24678 +hmr:9229")
+		if summed == tt.expand {
+			t.Errorf("expand %v: auxiliary summary shown %v\n%s", tt.expand, summed, b.String())
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package listing
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// columnGap separates adjacent columns
+const columnGap = "  "
+
+// Column describes one table column
+type Column struct {
+	Header string
+	Right  bool // Align right, for numbers
+	// Flex columns give up width, down to Min, when the table is wider
+	// than the terminal. Other columns are never cut.
+	Flex bool
+	Min  int
+}
+
+// Table lays out rows of text in aligned columns
+type Table struct {
+	columns []Column
+	rows    [][]string
+	dim     map[int]bool       // Rows drawn faint, by index
+	styles  map[cellKey]string // SGR parameters of single cells
+	// Color allows ANSI styles, for a terminal
+	Color bool
+}
+
+// NewTable returns an empty table with the given columns
+func NewTable(columns ...Column) *Table {
+	return &Table{columns: columns}
+}
+
+// AddRow appends a row; missing cells are left blank and extra ones dropped
+func (t *Table) AddRow(cells ...string) {
+	row := make([]string, len(t.columns))
+	copy(row, cells)
+	t.rows = append(t.rows, row)
+}
+
+// AddDimRow appends a row that is drawn faint when Color is set, for
+// entries that matter less than the rest
+func (t *Table) AddDimRow(cells ...string) {
+	t.AddRow(cells...)
+	if t.dim == nil {
+		t.dim = make(map[int]bool)
+	}
+	t.dim[len(t.rows)-1] = true
+}
+
+// cellKey is a row and column index
+type cellKey struct{ row, col int }
+
+// Style sets the ANSI style of column col of the last row added, as SGR
+// parameters such as "31" for red, drawn when Color is set
+func (t *Table) Style(col int, sgr string) {
+	if len(t.rows) == 0 || col < 0 || col >= len(t.columns) {
+		return
+	}
+	if t.styles == nil {
+		t.styles = make(map[cellKey]string)
+	}
+	t.styles[cellKey{len(t.rows) - 1, col}] = sgr
+}
+
+// Len returns the number of rows
+func (t *Table) Len() int {
+	return len(t.rows)
+}
+
+// Render writes the table, fitted to width characters by narrowing flex
+// columns and truncating their cells with "…". A width of 0 or less
+// means no limit, as when the output isn't a terminal.
+func (t *Table) Render(w io.Writer, width int) error {
+	widths := t.fit(width)
+	var b strings.Builder
+	t.writeRow(&b, widths, -1, t.headers())
+	b.WriteString("\n")
+	for i, row := range t.rows {
+		if t.Color && t.dim[i] {
+			b.WriteString("\x1b[2m")
+			t.writeRow(&b, widths, i, row)
+			b.WriteString("\x1b[0m\n")
+			continue
+		}
+		t.writeRow(&b, widths, i, row)
+		b.WriteString("\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// headers returns the header row
+func (t *Table) headers() []string {
+	headers := make([]string, len(t.columns))
+	for i, c := range t.columns {
+		headers[i] = c.Header
+	}
+	return headers
+}
+
+// fit returns the width of each column: its widest cell, with flex
+// columns narrowed, widest first, until the table fits in width
+func (t *Table) fit(width int) []int {
+	widths := make([]int, len(t.columns))
+	for i, c := range t.columns {
+		widths[i] = utf8.RuneCountInString(c.Header)
+		for _, row := range t.rows {
+			widths[i] = max(widths[i], utf8.RuneCountInString(row[i]))
+		}
+	}
+	if width <= 0 {
+		return widths
+	}
+
+	total := len(columnGap) * (len(widths) - 1)
+	for _, w := range widths {
+		total += w
+	}
+	for total > width {
+		widest := -1
+		for i, c := range t.columns {
+			if c.Flex && widths[i] > t.minWidth(i) && (widest < 0 || widths[i] > widths[widest]) {
+				widest = i
+			}
+		}
+		if widest < 0 {
+			break // Nothing left to narrow; let the terminal wrap
+		}
+		widths[widest]--
+		total--
+	}
+	return widths
+}
+
+// minWidth is the narrowest a flex column may become
+func (t *Table) minWidth(i int) int {
+	if c := t.columns[i]; c.Min > 0 {
+		return c.Min
+	}
+	return max(utf8.RuneCountInString(t.columns[i].Header), 3)
+}
+
+// writeRow writes row index of the table, or the headers for -1, padded
+// and without the newline. The last column isn't padded so lines don't end
+// in spaces.
+func (t *Table) writeRow(b *strings.Builder, widths []int, index int, cells []string) {
+	for i, cell := range cells {
+		cell = truncate(cell, widths[i])
+		pad := strings.Repeat(" ", widths[i]-utf8.RuneCountInString(cell))
+		if sgr, ok := t.styles[cellKey{index, i}]; ok && t.Color && cell != "" {
+			// The padding stays outside the style, so no escape is cut
+			cell = "\x1b[" + sgr + "m" + cell + "\x1b[0m"
+		}
+		switch {
+		case t.columns[i].Right:
+			b.WriteString(pad + cell)
+		case i == len(cells)-1:
+			b.WriteString(cell)
+		default:
+			b.WriteString(cell + pad)
+		}
+		if i < len(cells)-1 {
+			b.WriteString(columnGap)
+		}
+	}
+}
+
+// truncate shortens s to n runes, ending it with "…" if cut
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	if n <= 1 {
+		return string([]rune(s)[:n])
+	}
+	return fmt.Sprintf("%s…", string([]rune(s)[:n-1]))
+}
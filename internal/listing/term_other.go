@@ -0,0 +1,16 @@
+//go:build !linux && !darwin
+
+package listing
+
+import (
+	"os"
+	"strconv"
+)
+
+// TerminalWidth returns $COLUMNS, or 0 (no limit) if it isn't set
+func TerminalWidth(f *os.File) int {
+	if n, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && n > 0 {
+		return n
+	}
+	return 0
+}
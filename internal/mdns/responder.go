@@ -0,0 +1,756 @@
+// Package mdns advertises services on the local network over Multicast DNS
+// (RFC 6762) with DNS-SD records (RFC 6763), so that a phone or another
+// laptop can browse for them and open name.local. Only IPv4 is supported.
+package mdns
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"localhost-magic/internal/dnsmsg"
+)
+
+const port = 5353
+
+var groupIPv4 = net.IPv4(224, 0, 0, 251)
+
+const (
+	// Record TTLs recommended by RFC 6762 section 10
+	hostTTL  = 120  // Records that carry or point at an address
+	otherTTL = 4500 // Everything else
+	// legacyTTL caps TTLs in replies to one-shot (non-5353) queriers
+	legacyTTL = 10
+
+	probeInterval    = 250 * time.Millisecond
+	probeCount       = 3
+	announceInterval = time.Second
+	// After this many conflicts in a row, probing slows down (section 8.1)
+	maxConflicts    = 15
+	conflictBackoff = 5 * time.Second
+	// lostTiebreakDelay is how long to defer after losing a simultaneous
+	// probe (section 8.2)
+	lostTiebreakDelay = time.Second
+)
+
+const servicesName = "_services._dns-sd._udp.local."
+
+// flushClass marks unique records so caches replace rather than add them
+const flushClass = dnsmsg.ClassIN | dnsmsg.ClassTopBit
+
+// Options configures a Responder
+type Options struct {
+	// Interfaces restricts advertisement to the named interfaces. Empty
+	// uses every interface that is up and multicast-capable, except
+	// loopback and point-to-point links such as VPN tunnels.
+	Interfaces []string
+}
+
+// Service is one advertised service
+type Service struct {
+	// Name is both the instance name and the host label: "myapp" is
+	// browsable as myapp._http._tcp.local and resolves as myapp.local
+	Name string
+	Port int
+	// TLS advertises the service as _https._tcp instead of _http._tcp
+	TLS bool
+	// Text is the DNS-SD TXT record, e.g. "path=/"
+	Text []string
+}
+
+// Responder answers mDNS queries for registered services
+type Responder struct {
+	conn   *net.UDPConn
+	ifaces []net.Interface
+
+	sendMu sync.Mutex // Guards IP_MULTICAST_IF plus the write that follows
+
+	mu      sync.Mutex
+	entries map[string]*entry // key = Service.Name
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+// entry is the state of one registered service
+type entry struct {
+	svc       Service
+	label     string // Advertised label, Name with a suffix after conflicts
+	announced bool
+	events    chan probeEvent
+	done      chan struct{}
+}
+
+// probeEvent is something the read loop tells a service's goroutine
+type probeEvent int
+
+const (
+	eventConflict probeEvent = iota + 1 // Another host owns the name
+	eventLost                           // Lost a simultaneous-probe tiebreak
+	eventDone                           // Service unregistered
+)
+
+// NewResponder joins the mDNS group on the selected interfaces and starts
+// answering queries. Call Close to send goodbye packets and stop.
+func NewResponder(opts Options) (*Responder, error) {
+	ifaces, err := selectInterfaces(opts.Interfaces)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := listen()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Responder{conn: conn, entries: make(map[string]*entry)}
+	for _, ifi := range ifaces {
+		addr := interfaceIPv4(ifi)
+		if addr == nil {
+			continue
+		}
+		if err := joinGroup(conn, addr.IP); err != nil {
+			log.Printf("mDNS: failed to join group on %s: %v", ifi.Name, err)
+			continue
+		}
+		r.ifaces = append(r.ifaces, ifi)
+	}
+	if len(r.ifaces) == 0 {
+		conn.Close()
+		return nil, errors.New("no usable interfaces for mDNS")
+	}
+
+	r.wg.Add(1)
+	go r.readLoop()
+	return r, nil
+}
+
+// Interfaces returns the names of the interfaces being advertised on
+func (r *Responder) Interfaces() []string {
+	names := make([]string, len(r.ifaces))
+	for i, ifi := range r.ifaces {
+		names[i] = ifi.Name
+	}
+	return names
+}
+
+// Register starts advertising svc. The name is probed for first and, if
+// another host already uses it, a numeric suffix is added ("myapp-2").
+// Registering a name again with different details replaces it.
+func (r *Responder) Register(svc Service) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	if e, ok := r.entries[svc.Name]; ok {
+		if sameService(e.svc, svc) {
+			return
+		}
+		r.remove(e)
+	}
+
+	e := &entry{
+		svc:    svc,
+		label:  sanitizeLabel(svc.Name),
+		events: make(chan probeEvent, 1),
+		done:   make(chan struct{}),
+	}
+	r.entries[svc.Name] = e
+	r.wg.Add(1)
+	go r.run(e)
+}
+
+// Unregister stops advertising the named service, sending goodbye packets
+// if it had been announced
+func (r *Responder) Unregister(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.entries[name]; ok {
+		r.remove(e)
+	}
+}
+
+// Lookup returns the registered name advertised as host ("myapp-2.local")
+func (r *Responder) Lookup(host string) (string, bool) {
+	label := strings.TrimSuffix(strings.TrimSuffix(strings.ToLower(host), "."), ".local")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, e := range r.entries {
+		if e.announced && e.label == label {
+			return e.svc.Name, true
+		}
+	}
+	return "", false
+}
+
+// Close sends goodbye packets for every announced service and stops the
+// responder
+func (r *Responder) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	for _, e := range r.entries {
+		r.remove(e)
+	}
+	r.mu.Unlock()
+
+	err := r.conn.Close()
+	r.wg.Wait()
+	return err
+}
+
+// remove stops e and says goodbye for it. r.mu must be held.
+func (r *Responder) remove(e *entry) {
+	delete(r.entries, e.svc.Name)
+	close(e.done)
+	if e.announced {
+		e.announced = false
+		svc, label := e.svc, e.label
+		r.sendAll(func(ip net.IP) *dnsmsg.Message {
+			rs := buildRecords(svc, label, ip)
+			answers := []dnsmsg.Record{rs.ptr, rs.srv, rs.txt, rs.a}
+			for i := range answers {
+				answers[i].TTL = 0
+			}
+			return &dnsmsg.Message{Flags: dnsmsg.FlagResponse | dnsmsg.FlagAuthoritative, Answers: answers}
+		})
+	}
+}
+
+// run probes for e's name, renaming on conflict, then announces it and
+// watches for later conflicts until the service is unregistered
+func (r *Responder) run(e *entry) {
+	defer r.wg.Done()
+
+	// Stagger the first probe so services registered together don't
+	// probe in lockstep
+	if !r.wait(e, time.Duration(rand.Int63n(int64(probeInterval)))) {
+		return
+	}
+
+	conflicts := 0
+	for {
+		switch r.probe(e) {
+		case eventDone:
+			return
+		case eventLost:
+			if !r.wait(e, lostTiebreakDelay) {
+				return
+			}
+			continue
+		case eventConflict:
+			conflicts++
+			r.rename(e, conflicts)
+			if conflicts >= maxConflicts && !r.wait(e, conflictBackoff) {
+				return
+			}
+			continue
+		}
+		conflicts = 0
+
+		if !r.announce(e) {
+			return
+		}
+
+		// A conflict after announcing means another host started using
+		// the name; probe again (section 9)
+		for event := eventLost; event == eventLost; {
+			select {
+			case event = <-e.events:
+			case <-e.done:
+				return
+			}
+		}
+		r.mu.Lock()
+		e.announced = false
+		r.mu.Unlock()
+	}
+}
+
+// probe asks whether anyone else uses e's names, returning zero if nobody
+// objected
+func (r *Responder) probe(e *entry) probeEvent {
+	drain(e.events)
+	for i := 0; i < probeCount; i++ {
+		svc, label := r.snapshot(e)
+		// The first probe asks for unicast replies (section 8.1)
+		class := dnsmsg.ClassIN
+		if i == 0 {
+			class |= dnsmsg.ClassTopBit
+		}
+		r.sendAll(func(ip net.IP) *dnsmsg.Message {
+			rs := buildRecords(svc, label, ip)
+			return &dnsmsg.Message{
+				Questions: []dnsmsg.Question{
+					{Name: rs.a.Name, Type: dnsmsg.TypeANY, Class: class},
+					{Name: rs.srv.Name, Type: dnsmsg.TypeANY, Class: class},
+				},
+				Authority: []dnsmsg.Record{rs.srv, rs.txt, rs.a},
+			}
+		})
+
+		timer := time.NewTimer(probeInterval)
+		select {
+		case event := <-e.events:
+			timer.Stop()
+			return event
+		case <-e.done:
+			timer.Stop()
+			return eventDone
+		case <-timer.C:
+		}
+	}
+	return 0
+}
+
+// announce sends the service's records twice, a second apart, and marks
+// it announced. It returns false if the service was unregistered.
+func (r *Responder) announce(e *entry) bool {
+	r.mu.Lock()
+	select {
+	case <-e.done:
+		r.mu.Unlock()
+		return false
+	default:
+	}
+	e.announced = true
+	svc, label := e.svc, e.label
+	r.mu.Unlock()
+
+	if label != sanitizeLabel(svc.Name) {
+		log.Printf("mDNS: %s is advertised as %s.local (name in use on the network)", svc.Name, label)
+	}
+	for i := 0; i < 2; i++ {
+		if i > 0 && !r.wait(e, announceInterval) {
+			return false
+		}
+		r.sendAll(func(ip net.IP) *dnsmsg.Message {
+			rs := buildRecords(svc, label, ip)
+			return &dnsmsg.Message{
+				Flags:   dnsmsg.FlagResponse | dnsmsg.FlagAuthoritative,
+				Answers: []dnsmsg.Record{rs.ptr, rs.enum, rs.srv, rs.txt, rs.a},
+			}
+		})
+	}
+	return true
+}
+
+// rename picks the next candidate label after a conflict
+func (r *Responder) rename(e *entry, conflicts int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old := e.label
+	e.label = sanitizeLabel(e.svc.Name) + "-" + strconv.Itoa(conflicts+1)
+	log.Printf("mDNS: %s.local is taken, trying %s.local", old, e.label)
+}
+
+// snapshot returns e's service and current label
+func (r *Responder) snapshot(e *entry) (Service, string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return e.svc, e.label
+}
+
+// wait sleeps for d, returning false if e is unregistered meanwhile
+func (r *Responder) wait(e *entry, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-e.done:
+		return false
+	}
+}
+
+// readLoop handles incoming queries and responses until the socket closes
+func (r *Responder) readLoop() {
+	defer r.wg.Done()
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("mDNS: read failed: %v", err)
+			continue
+		}
+		msg, err := dnsmsg.Parse(buf[:n])
+		if err != nil {
+			continue
+		}
+		ifi, ip, ok := r.interfaceFor(src.IP)
+		if !ok {
+			// Not from a network we advertise on
+			continue
+		}
+		if msg.IsResponse() {
+			r.handleResponse(msg, ip)
+		} else {
+			r.handleQuery(msg, src, ifi, ip)
+		}
+	}
+}
+
+// handleResponse looks for records that conflict with our unique ones
+func (r *Responder) handleResponse(msg *dnsmsg.Message, ip net.IP) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, e := range r.entries {
+		rs := buildRecords(e.svc, e.label, ip)
+		for _, theirs := range append(msg.Answers, msg.Additional...) {
+			if theirs.TTL == 0 {
+				continue
+			}
+			for _, ours := range []dnsmsg.Record{rs.srv, rs.txt, rs.a} {
+				if theirs.Name == ours.Name && theirs.Type == ours.Type && !bytes.Equal(theirs.Data, ours.Data) {
+					signal(e, eventConflict)
+				}
+			}
+		}
+	}
+}
+
+// handleQuery settles simultaneous probes and answers questions about
+// announced services
+func (r *Responder) handleQuery(msg *dnsmsg.Message, src *net.UDPAddr, ifi net.Interface, ip net.IP) {
+	r.mu.Lock()
+	var answers, additional []dnsmsg.Record
+	for _, e := range r.entries {
+		rs := buildRecords(e.svc, e.label, ip)
+		if !e.announced {
+			if len(msg.Authority) > 0 && lostTiebreak(rs, msg.Authority) {
+				signal(e, eventLost)
+			}
+			continue
+		}
+		for _, q := range msg.Questions {
+			for _, rr := range rs.all() {
+				if rr.Name != q.Name || (q.Type != dnsmsg.TypeANY && q.Type != rr.Type) || knownAnswer(msg.Answers, rr) {
+					continue
+				}
+				answers = appendUnique(answers, rr)
+				switch rr.Type {
+				case dnsmsg.TypePTR:
+					if rr.Name != servicesName {
+						additional = append(additional, rs.srv, rs.txt, rs.a)
+					}
+				case dnsmsg.TypeSRV:
+					additional = append(additional, rs.a)
+				}
+			}
+		}
+	}
+	r.mu.Unlock()
+	if len(answers) == 0 {
+		return
+	}
+
+	resp := &dnsmsg.Message{Flags: dnsmsg.FlagResponse | dnsmsg.FlagAuthoritative, Answers: answers}
+	for _, rr := range additional {
+		if !containsRecord(answers, rr) {
+			resp.Additional = appendUnique(resp.Additional, rr)
+		}
+	}
+
+	// One-shot queriers not using port 5353 get a conventional DNS reply
+	// (section 6.7)
+	if src.Port != port {
+		resp.ID = msg.ID
+		resp.Questions = msg.Questions
+		for _, section := range [][]dnsmsg.Record{resp.Answers, resp.Additional} {
+			for i := range section {
+				section[i].TTL = min(section[i].TTL, legacyTTL)
+				section[i].Class = dnsmsg.ClassIN
+			}
+		}
+		r.sendUnicast(resp, src)
+		return
+	}
+
+	unicast := true
+	for _, q := range msg.Questions {
+		unicast = unicast && q.Class&dnsmsg.ClassTopBit != 0
+	}
+	if unicast {
+		r.sendUnicast(resp, src)
+		return
+	}
+
+	// Shared records are answered after a short random delay so several
+	// responders don't collide (section 6)
+	for _, rr := range answers {
+		if rr.Type == dnsmsg.TypePTR {
+			delay := 20*time.Millisecond + time.Duration(rand.Int63n(int64(100*time.Millisecond)))
+			time.AfterFunc(delay, func() { r.sendMulticast(resp, ifi, ip) })
+			return
+		}
+	}
+	r.sendMulticast(resp, ifi, ip)
+}
+
+// sendAll multicasts the message built for each interface's address
+func (r *Responder) sendAll(build func(ip net.IP) *dnsmsg.Message) {
+	for _, ifi := range r.ifaces {
+		addr := interfaceIPv4(ifi)
+		if addr == nil {
+			continue
+		}
+		r.sendMulticast(build(addr.IP), ifi, addr.IP)
+	}
+}
+
+// sendMulticast sends msg to the mDNS group through ifi
+func (r *Responder) sendMulticast(msg *dnsmsg.Message, ifi net.Interface, ip net.IP) {
+	r.sendMu.Lock()
+	defer r.sendMu.Unlock()
+	if err := setMulticastInterface(r.conn, ip); err != nil {
+		if !errors.Is(err, net.ErrClosed) {
+			log.Printf("mDNS: failed to select interface %s: %v", ifi.Name, err)
+		}
+		return
+	}
+	if _, err := r.conn.WriteToUDP(msg.Pack(), &net.UDPAddr{IP: groupIPv4, Port: port}); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("mDNS: send on %s failed: %v", ifi.Name, err)
+	}
+}
+
+// sendUnicast replies directly to the querier
+func (r *Responder) sendUnicast(msg *dnsmsg.Message, dst *net.UDPAddr) {
+	if _, err := r.conn.WriteToUDP(msg.Pack(), dst); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("mDNS: reply to %s failed: %v", dst, err)
+	}
+}
+
+// interfaceFor finds the advertised interface a packet from src arrived
+// on: the one owning src (our own looped-back packets), else the one whose
+// subnet contains it
+func (r *Responder) interfaceFor(src net.IP) (net.Interface, net.IP, bool) {
+	var match *net.Interface
+	var matchIP net.IP
+	for i, ifi := range r.ifaces {
+		addr := interfaceIPv4(ifi)
+		if addr == nil {
+			continue
+		}
+		if addr.IP.Equal(src) {
+			return ifi, addr.IP, true
+		}
+		if match == nil && addr.Contains(src) {
+			match, matchIP = &r.ifaces[i], addr.IP
+		}
+	}
+	if match == nil {
+		return net.Interface{}, nil, false
+	}
+	return *match, matchIP, true
+}
+
+// recordSet is everything advertised for one service on one interface
+type recordSet struct {
+	ptr  dnsmsg.Record // _http._tcp.local -> instance
+	enum dnsmsg.Record // _services._dns-sd._udp.local -> _http._tcp.local
+	srv  dnsmsg.Record
+	txt  dnsmsg.Record
+	a    dnsmsg.Record
+}
+
+// all returns the records in answer order
+func (rs recordSet) all() []dnsmsg.Record {
+	return []dnsmsg.Record{rs.ptr, rs.enum, rs.srv, rs.txt, rs.a}
+}
+
+// buildRecords returns the records for svc advertised as label, with ip
+// as the host address
+func buildRecords(svc Service, label string, ip net.IP) recordSet {
+	serviceType := "_http._tcp.local."
+	if svc.TLS {
+		serviceType = "_https._tcp.local."
+	}
+	instance := label + "." + serviceType
+	host := label + ".local."
+	return recordSet{
+		ptr:  dnsmsg.Record{Name: serviceType, Type: dnsmsg.TypePTR, Class: dnsmsg.ClassIN, TTL: otherTTL, Data: dnsmsg.NameData(instance)},
+		enum: dnsmsg.Record{Name: servicesName, Type: dnsmsg.TypePTR, Class: dnsmsg.ClassIN, TTL: otherTTL, Data: dnsmsg.NameData(serviceType)},
+		srv:  dnsmsg.Record{Name: instance, Type: dnsmsg.TypeSRV, Class: flushClass, TTL: hostTTL, Data: dnsmsg.SRVData(svc.Port, host)},
+		txt:  dnsmsg.Record{Name: instance, Type: dnsmsg.TypeTXT, Class: flushClass, TTL: otherTTL, Data: dnsmsg.TXTData(svc.Text)},
+		a:    dnsmsg.Record{Name: host, Type: dnsmsg.TypeA, Class: flushClass, TTL: hostTTL, Data: append([]byte(nil), ip.To4()...)},
+	}
+}
+
+// lostTiebreak compares the authority records of someone else's probe
+// with ours for the same names. Records are sorted and compared by type
+// and then data; the lexicographically later set wins (section 8.2).
+// Identical sets are our own probe looped back.
+func lostTiebreak(rs recordSet, authority []dnsmsg.Record) bool {
+	for _, name := range []string{rs.a.Name, rs.srv.Name} {
+		var ours, theirs []dnsmsg.Record
+		for _, rr := range []dnsmsg.Record{rs.srv, rs.txt, rs.a} {
+			if rr.Name == name {
+				ours = append(ours, rr)
+			}
+		}
+		for _, rr := range authority {
+			if rr.Name == name {
+				theirs = append(theirs, rr)
+			}
+		}
+		if len(theirs) > 0 && compareRecords(theirs, ours) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// compareRecords orders two record sets as RFC 6762 section 8.2 describes
+func compareRecords(a, b []dnsmsg.Record) int {
+	less := func(s []dnsmsg.Record) func(i, j int) bool {
+		return func(i, j int) bool {
+			if s[i].Type != s[j].Type {
+				return s[i].Type < s[j].Type
+			}
+			return bytes.Compare(s[i].Data, s[j].Data) < 0
+		}
+	}
+	sort.Slice(a, less(a))
+	sort.Slice(b, less(b))
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i].Type != b[i].Type {
+			if a[i].Type < b[i].Type {
+				return -1
+			}
+			return 1
+		}
+		if c := bytes.Compare(a[i].Data, b[i].Data); c != 0 {
+			return c
+		}
+	}
+	return len(a) - len(b)
+}
+
+// knownAnswer reports whether the querier already has rr with at least
+// half its TTL left (section 7.1)
+func knownAnswer(known []dnsmsg.Record, rr dnsmsg.Record) bool {
+	for _, k := range known {
+		if k.Name == rr.Name && k.Type == rr.Type && bytes.Equal(k.Data, rr.Data) && k.TTL >= rr.TTL/2 {
+			return true
+		}
+	}
+	return false
+}
+
+// containsRecord reports whether records holds rr's name, type and data
+func containsRecord(records []dnsmsg.Record, rr dnsmsg.Record) bool {
+	for _, other := range records {
+		if other.Name == rr.Name && other.Type == rr.Type && bytes.Equal(other.Data, rr.Data) {
+			return true
+		}
+	}
+	return false
+}
+
+// appendUnique appends rr unless records already holds it
+func appendUnique(records []dnsmsg.Record, rr dnsmsg.Record) []dnsmsg.Record {
+	if containsRecord(records, rr) {
+		return records
+	}
+	return append(records, rr)
+}
+
+// signal delivers event without blocking; a pending event is enough
+func signal(e *entry, event probeEvent) {
+	select {
+	case e.events <- event:
+	default:
+	}
+}
+
+// drain discards a pending event
+func drain(events chan probeEvent) {
+	select {
+	case <-events:
+	default:
+	}
+}
+
+// sameService reports whether two registrations advertise the same thing
+func sameService(a, b Service) bool {
+	return a.Port == b.Port && a.TLS == b.TLS && strings.Join(a.Text, "\x00") == strings.Join(b.Text, "\x00")
+}
+
+// sanitizeLabel turns a name into a DNS label: lower case letters, digits
+// and hyphens, at most 63 bytes
+func sanitizeLabel(name string) string {
+	var b strings.Builder
+	for _, c := range strings.ToLower(name) {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' {
+			b.WriteRune(c)
+		} else {
+			b.WriteByte('-')
+		}
+	}
+	label := strings.Trim(b.String(), "-")
+	if len(label) > 60 {
+		// Leave room for a conflict suffix
+		label = strings.TrimRight(label[:60], "-")
+	}
+	if label == "" {
+		label = "service"
+	}
+	return label
+}
+
+// selectInterfaces resolves Options.Interfaces, or picks the default set
+func selectInterfaces(names []string) ([]net.Interface, error) {
+	if len(names) > 0 {
+		selected := make([]net.Interface, 0, len(names))
+		for _, name := range names {
+			ifi, err := net.InterfaceByName(name)
+			if err != nil {
+				return nil, fmt.Errorf("unknown interface %q: %w", name, err)
+			}
+			selected = append(selected, *ifi)
+		}
+		return selected, nil
+	}
+
+	all, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list interfaces: %w", err)
+	}
+	var selected []net.Interface
+	for _, ifi := range all {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagMulticast == 0 ||
+			ifi.Flags&(net.FlagLoopback|net.FlagPointToPoint) != 0 {
+			continue
+		}
+		selected = append(selected, ifi)
+	}
+	return selected, nil
+}
+
+// interfaceIPv4 returns the interface's first IPv4 address and subnet
+func interfaceIPv4(ifi net.Interface) *net.IPNet {
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return ipnet
+		}
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package mdns
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"localhost-magic/internal/dnsmsg"
+)
+
+// Names of the fixtures, as labels on the wire
+const (
+	wireHTTP     = "055f68747470 045f746370 056c6f63616c 00"              // _http._tcp.local.
+	wireInstance = "056d79617070 055f68747470 045f746370 056c6f63616c 00" // myapp._http._tcp.local.
+	wireHost     = "056d79617070 056c6f63616c 00"                         // myapp.local.
+)
+
+// ourIP is the address of the interface the fixtures arrive on
+var ourIP = net.IPv4(192, 168, 1, 20)
+
+// fromHex decodes a fixture, ignoring the spaces it is laid out with
+func fromHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// testResponder is a responder for myapp on port 8080 whose socket is on
+// the loopback interface, so its replies can be read
+func testResponder(t *testing.T, announced bool) (*Responder, *entry) {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	e := &entry{
+		svc:       Service{Name: "myapp", Port: 8080, Text: []string{"path=/"}},
+		label:     "myapp",
+		announced: announced,
+		events:    make(chan probeEvent, 1),
+		done:      make(chan struct{}),
+	}
+	return &Responder{conn: conn, entries: map[string]*entry{"myapp": e}}, e
+}
+
+// query hands the packet to the responder as if a one-shot querier had
+// sent it, and returns the reply, nil if none came
+func query(t *testing.T, r *Responder, packet []byte) []byte {
+	t.Helper()
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	msg, err := dnsmsg.Parse(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.handleQuery(msg, client.LocalAddr().(*net.UDPAddr), net.Interface{Name: "en0"}, ourIP)
+
+	client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	buf := make([]byte, 1500)
+	n, _, err := client.ReadFromUDP(buf)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+// One-shot queriers get a conventional reply: their ID and question
+// echoed, TTLs capped at 10s and no cache-flush bit (RFC 6762 6.7)
+func TestLegacyQueryReplies(t *testing.T) {
+	srv := "0021 0001 0000000a 0013 0000 0000 1f90 " + wireHost // Port 8080
+	txt := "0010 0001 0000000a 0007 06 706174683d2f"            // "path=/"
+	a := "0001 0001 0000000a 0004 c0a80114"                     // 192.168.1.20
+	tests := []struct {
+		name  string
+		query string
+		reply string
+	}{
+		{
+			"browse",
+			"1234 0000 0001 0000 0000 0000 " + wireHTTP + " 000c 0001",
+			"1234 8400 0001 0001 0000 0003 " + wireHTTP + " 000c 0001" +
+				wireHTTP + " 000c 0001 0000000a 0018 " + wireInstance +
+				wireInstance + srv + wireInstance + txt + wireHost + a,
+		},
+		{
+			"resolve the instance",
+			"0042 0000 0001 0000 0000 0000 " + wireInstance + " 0021 0001",
+			"0042 8400 0001 0001 0000 0001 " + wireInstance + " 0021 0001" +
+				wireInstance + srv + wireHost + a,
+		},
+		{
+			"address, asked for any type and with the QU bit",
+			"0007 0000 0001 0000 0000 0000 " + wireHost + " 00ff 8001",
+			"0007 8400 0001 0001 0000 0000 " + wireHost + " 00ff 8001" + wireHost + a,
+		},
+		{
+			"known answer with half its TTL left",
+			"0001 0000 0001 0001 0000 0000 " + wireHTTP + " 000c 0001" +
+				wireHTTP + " 000c 0001 000008ca 0018 " + wireInstance, // 2250s of 4500
+			"",
+		},
+		{
+			"known answer about to expire",
+			"0001 0000 0001 0001 0000 0000 " + wireHTTP + " 000c 0001" +
+				wireHTTP + " 000c 0001 000008c9 0018 " + wireInstance,
+			"0001 8400 0001 0001 0000 0003 " + wireHTTP + " 000c 0001" +
+				wireHTTP + " 000c 0001 0000000a 0018 " + wireInstance +
+				wireInstance + srv + wireInstance + txt + wireHost + a,
+		},
+		{
+			"someone else's name",
+			"0001 0000 0001 0000 0000 0000 056f74686572 056c6f63616c 00 0001 0001",
+			"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := testResponder(t, true)
+			got := query(t, r, fromHex(t, tt.query))
+			if want := fromHex(t, tt.reply); !bytes.Equal(got, want) {
+				t.Errorf("reply\n got %x\nwant %x", got, want)
+			}
+		})
+	}
+}
+
+func TestUnannouncedIsSilent(t *testing.T) {
+	r, _ := testResponder(t, false)
+	if got := query(t, r, fromHex(t, "1234 0000 0001 0000 0000 0000 "+wireHTTP+" 000c 0001")); got != nil {
+		t.Errorf("reply %x before the name is announced", got)
+	}
+}
+
+// Responses from other hosts conflict when they give one of our unique
+// records other data
+func TestResponseConflicts(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		conflict bool
+	}{
+		{"our address", "0000 8400 0000 0001 0000 0000 " + wireHost + " 0001 8001 00000078 0004 c0a80114", false},
+		{"another address", "0000 8400 0000 0001 0000 0000 " + wireHost + " 0001 8001 00000078 0004 c0a80163", true},
+		{"goodbye", "0000 8400 0000 0001 0000 0000 " + wireHost + " 0001 8001 00000000 0004 c0a80163", false},
+		{"another name", "0000 8400 0000 0001 0000 0000 056f74686572 056c6f63616c 00 0001 8001 00000078 0004 c0a80163", false},
+		{
+			// The instance's name ends in a pointer to "local" in the
+			// first answer, and its target is a pointer to that answer
+			"another port, compressed",
+			"0000 8400 0000 0002 0000 0000 " + wireHost + " 0001 8001 00000078 0004 c0a80114" +
+				"056d79617070 055f68747470 045f746370 c012 0021 8001 00000078 0008 0000 0000 2382 c00c",
+			true,
+		},
+		{"in the additional section", "0000 8400 0000 0000 0000 0001 " + wireHost + " 0001 8001 00000078 0004 0a000001", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, e := testResponder(t, true)
+			msg, err := dnsmsg.Parse(fromHex(t, tt.response))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.handleResponse(msg, ourIP)
+			select {
+			case event := <-e.events:
+				if !tt.conflict || event != eventConflict {
+					t.Errorf("event %d, want none", event)
+				}
+			default:
+				if tt.conflict {
+					t.Error("no conflict")
+				}
+			}
+		})
+	}
+}
+
+// A simultaneous probe for our names is settled by comparing the records
+// in the probes' authority sections (RFC 6762 8.2)
+func TestProbeTiebreak(t *testing.T) {
+	probe := func(ip string) string {
+		return "0000 0000 0001 0000 0001 0000 " + wireHost + " 00ff 8001" + wireHost + " 0001 0001 00000078 0004 " + ip
+	}
+	tests := []struct {
+		name  string
+		query string
+		lost  bool
+	}{
+		{"they win", probe("c0a80163"), true}, // 192.168.1.99
+		{"we win", probe("c0a80105"), false},  // 192.168.1.5
+		{"our own looped back", probe("c0a80114"), false},
+		{"a query without authority", "0000 0000 0001 0000 0000 0000 " + wireHost + " 00ff 0001", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, e := testResponder(t, false)
+			if got := query(t, r, fromHex(t, tt.query)); got != nil {
+				t.Errorf("reply %x to a probe", got)
+			}
+			select {
+			case event := <-e.events:
+				if !tt.lost || event != eventLost {
+					t.Errorf("event %d, want none", event)
+				}
+			default:
+				if tt.lost {
+					t.Error("didn't defer to the other probe")
+				}
+			}
+		})
+	}
+}
+
+func TestSanitizeLabel(t *testing.T) {
+	tests := map[string]string{
+		"MyApp":                 "myapp",
+		"my_app.v2":             "my-app-v2",
+		"--x--":                 "x",
+		"":                      "service",
+		"ü":                     "service",
+		strings.Repeat("a", 70): strings.Repeat("a", 60),
+	}
+	for name, want := range tests {
+		if got := sanitizeLabel(name); got != want {
+			t.Errorf("sanitizeLabel(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+//go:build linux || darwin
+
+package mdns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// listen opens the shared mDNS socket on port 5353. The port is usually
+// also held by the system responder (avahi, mDNSResponder), so the socket
+// is bound with address and port reuse.
+func listen() (*net.UDPConn, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				if sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); sockErr != nil {
+					return
+				}
+				if sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1); sockErr != nil {
+					return
+				}
+				// RFC 6762 section 11: mDNS packets are sent with TTL 255
+				sockErr = syscall.SetsockoptByte(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, 255)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	pc, err := lc.ListenPacket(context.Background(), "udp4", fmt.Sprintf("0.0.0.0:%d", port))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on mDNS port: %w", err)
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+// joinGroup subscribes the socket to the mDNS group on the interface
+// owning ip
+func joinGroup(conn *net.UDPConn, ip net.IP) error {
+	mreq := &syscall.IPMreq{}
+	copy(mreq.Multiaddr[:], groupIPv4.To4())
+	copy(mreq.Interface[:], ip.To4())
+	return setsockopt(conn, func(fd int) error {
+		return syscall.SetsockoptIPMreq(fd, syscall.IPPROTO_IP, syscall.IP_ADD_MEMBERSHIP, mreq)
+	})
+}
+
+// setMulticastInterface makes multicast writes leave through the interface
+// owning ip
+func setMulticastInterface(conn *net.UDPConn, ip net.IP) error {
+	var addr [4]byte
+	copy(addr[:], ip.To4())
+	return setsockopt(conn, func(fd int) error {
+		return syscall.SetsockoptInet4Addr(fd, syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, addr)
+	})
+}
+
+// setsockopt runs fn against the socket's file descriptor
+func setsockopt(conn *net.UDPConn, fn func(fd int) error) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) { sockErr = fn(int(fd)) }); err != nil {
+		return err
+	}
+	return sockErr
+}
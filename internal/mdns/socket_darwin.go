@@ -0,0 +1,5 @@
+package mdns
+
+import "syscall"
+
+const soReusePort = syscall.SO_REUSEPORT
@@ -0,0 +1,5 @@
+package mdns
+
+// soReusePort is SO_REUSEPORT, which the syscall package doesn't define
+// on Linux
+const soReusePort = 0xf
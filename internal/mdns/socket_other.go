@@ -0,0 +1,20 @@
+//go:build !linux && !darwin
+
+package mdns
+
+import (
+	"errors"
+	"net"
+)
+
+func listen() (*net.UDPConn, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func joinGroup(conn *net.UDPConn, ip net.IP) error {
+	return errors.ErrUnsupported
+}
+
+func setMulticastInterface(conn *net.UDPConn, ip net.IP) error {
+	return errors.ErrUnsupported
+}
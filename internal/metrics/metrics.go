@@ -0,0 +1,185 @@
+// Package metrics exposes daemon statistics in the Prometheus text format,
+// with the Prometheus client's metric types. The daemon talks to them
+// through Recorder, which is a no-op unless metrics are switched on.
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"localhost-magic/probe"
+)
+
+// Recorder receives the daemon's measurements
+type Recorder interface {
+	// ObserveProbe records one probe. service is the service's stable name,
+	// or empty for listeners without one, which only count towards errors.
+	ObserveProbe(service string, result probe.ProbeResult)
+	// ObserveScan records a finished scan: how long it took, the services
+	// up by protocol and the number of registered services. Per-service
+	// series for services not probed since the previous scan are removed.
+	ObserveScan(duration time.Duration, upByProtocol map[string]int, registered int)
+	// ProbeHooks returns the hooks to set on the daemon's probe options,
+	// which count dials, requests and results
+	ProbeHooks() probe.Hooks
+}
+
+// Nop returns a Recorder that discards everything
+func Nop() Recorder {
+	return nop{}
+}
+
+type nop struct{}
+
+func (nop) ObserveProbe(string, probe.ProbeResult)         {}
+func (nop) ObserveScan(time.Duration, map[string]int, int) {}
+func (nop) ProbeHooks() probe.Hooks                        { return probe.Hooks{} }
+
+// Bucket boundaries in seconds
+var (
+	probeBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+	scanBuckets  = []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+)
+
+// Metrics is a Recorder that serves what it records at /metrics
+type Metrics struct {
+	registry      *prometheus.Registry
+	handler       http.Handler
+	servicesUp    *prometheus.GaugeVec
+	probeDuration *prometheus.HistogramVec
+	probeErrors   *prometheus.CounterVec
+	scanDuration  prometheus.Histogram
+	registered    prometheus.Gauge
+	probes        probe.Stats // Counted through ProbeHooks
+
+	mu      sync.Mutex
+	probed  map[string]bool // Services probed since the last scan
+	tracked map[string]bool // Services with a probe duration series
+}
+
+// New returns an empty set of daemon metrics
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		servicesUp: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "localhost_magic_services_up", Help: "Services currently up, by protocol.",
+		}, []string{"protocol"}),
+		probeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "localhost_magic_probe_duration_seconds", Help: "Probe latency per service.", Buckets: probeBuckets,
+		}, []string{"service"}),
+		probeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "localhost_magic_probe_errors_total", Help: "Failed probes by failure class.",
+		}, []string{"class"}),
+		scanDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name: "localhost_magic_scan_duration_seconds", Help: "Duration of a discovery scan.", Buckets: scanBuckets,
+		}),
+		registered: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "localhost_magic_registry_services", Help: "Services in the registry, active or not.",
+		}),
+		probed:  make(map[string]bool),
+		tracked: make(map[string]bool),
+	}
+	m.registry.MustRegister(m.servicesUp, m.probeDuration, m.probeErrors, m.scanDuration, m.registered, probeStats{&m.probes})
+	m.handler = promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+	return m
+}
+
+// ObserveProbe implements Recorder
+func (m *Metrics) ObserveProbe(service string, result probe.ProbeResult) {
+	if class := errorClass(result.Err); class != "" {
+		m.probeErrors.WithLabelValues(class).Inc()
+	}
+	if service == "" {
+		return
+	}
+	m.probeDuration.WithLabelValues(service).Observe(result.Duration.Seconds())
+	m.mu.Lock()
+	m.probed[service] = true
+	m.tracked[service] = true
+	m.mu.Unlock()
+}
+
+// ObserveScan implements Recorder
+func (m *Metrics) ObserveScan(duration time.Duration, upByProtocol map[string]int, registered int) {
+	m.scanDuration.Observe(duration.Seconds())
+	m.servicesUp.Reset()
+	for protocol, n := range upByProtocol {
+		m.servicesUp.WithLabelValues(protocol).Set(float64(n))
+	}
+	m.registered.Set(float64(registered))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for service := range m.tracked {
+		if !m.probed[service] {
+			m.probeDuration.DeleteLabelValues(service)
+			delete(m.tracked, service)
+		}
+	}
+	m.probed = make(map[string]bool)
+}
+
+// ProbeHooks implements Recorder
+func (m *Metrics) ProbeHooks() probe.Hooks {
+	return m.probes.Hooks()
+}
+
+// ServeHTTP writes every metric in the Prometheus text format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.handler.ServeHTTP(w, r)
+}
+
+// Descriptions of what the probe hooks count
+var (
+	dialsDesc     = prometheus.NewDesc("localhost_magic_probe_dials_total", "Connections dialed by probes, by outcome.", []string{"outcome"}, nil)
+	dialTimeDesc  = prometheus.NewDesc("localhost_magic_probe_dial_seconds_total", "Time spent dialing by probes.", nil, nil)
+	requestsDesc  = prometheus.NewDesc("localhost_magic_probe_requests_total", "HTTP requests written by probes.", nil, nil)
+	firstByteDesc = prometheus.NewDesc("localhost_magic_probe_first_byte_seconds_total", "Time from request to first byte, summed over the answers.", nil, nil)
+	resultsDesc   = prometheus.NewDesc("localhost_magic_probe_results_total", "Probe results by state.", []string{"state"}, nil)
+)
+
+// probeStats collects what the probe hooks counted as counters
+type probeStats struct{ stats *probe.Stats }
+
+// Describe implements prometheus.Collector
+func (c probeStats) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{dialsDesc, dialTimeDesc, requestsDesc, firstByteDesc, resultsDesc} {
+		ch <- desc
+	}
+}
+
+// Collect implements prometheus.Collector
+func (c probeStats) Collect(ch chan<- prometheus.Metric) {
+	snap := c.stats.Snapshot()
+	counter := func(desc *prometheus.Desc, value float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, value, labels...)
+	}
+	counter(dialsDesc, float64(snap.Dials-snap.DialErrors), "ok")
+	counter(dialsDesc, float64(snap.DialErrors), "error")
+	counter(dialTimeDesc, snap.DialTime.Seconds())
+	counter(requestsDesc, float64(snap.Requests))
+	counter(firstByteDesc, snap.FirstByteTime.Seconds())
+	for state, n := range snap.ByState {
+		counter(resultsDesc, float64(n), string(state))
+	}
+}
+
+// errorClass names the failure class of a probe error, or "" for success
+func errorClass(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, probe.ErrRefused):
+		return "refused"
+	case errors.Is(err, probe.ErrTimeout):
+		return "timeout"
+	case errors.Is(err, probe.ErrReset):
+		return "reset"
+	}
+	return "other"
+}
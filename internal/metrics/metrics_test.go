@@ -0,0 +1,70 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"localhost-magic/probe"
+)
+
+// scrape returns what /metrics serves
+func scrape(t *testing.T, m *Metrics) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type %q, want the text format", ct)
+	}
+	body, _ := io.ReadAll(w.Body)
+	return string(body)
+}
+
+func TestExposition(t *testing.T) {
+	m := New()
+	hooks := m.ProbeHooks()
+	hooks.OnDialStart("tcp", "127.0.0.1:3000")
+	hooks.OnDialDone("tcp", "127.0.0.1:3000", nil, 2*time.Millisecond)
+	hooks.OnDialStart("tcp", "127.0.0.1:3001")
+	hooks.OnDialDone("tcp", "127.0.0.1:3001", probe.ErrRefused, time.Millisecond)
+	hooks.OnRequestWritten("127.0.0.1:3000", "GET", "/")
+	hooks.OnFirstByte("127.0.0.1:3000", 5*time.Millisecond)
+	hooks.OnResult(probe.ProbeResult{State: probe.StateHTTP})
+	hooks.OnResult(probe.ProbeResult{State: probe.StateClosed, Err: probe.ErrRefused})
+
+	m.ObserveProbe(`shop "eu".localhost`, probe.ProbeResult{Duration: 3 * time.Millisecond})
+	m.ObserveProbe("", probe.ProbeResult{Err: fmt.Errorf("dial: %w", probe.ErrRefused)})
+	m.ObserveProbe("", probe.ProbeResult{Err: probe.ErrTimeout})
+	m.ObserveScan(200*time.Millisecond, map[string]int{"http/1": 2, "h2c": 1}, 4)
+	want, err := os.ReadFile("testdata/exposition.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := scrape(t, m); got != string(want) {
+		t.Errorf("exposition differs from testdata/exposition.txt:\n%s", got)
+	}
+}
+
+func TestScanDropsServicesGone(t *testing.T) {
+	m := New()
+	m.ObserveProbe("shop.localhost", probe.ProbeResult{Duration: time.Millisecond})
+	m.ObserveProbe("blog.localhost", probe.ProbeResult{Duration: time.Millisecond})
+	m.ObserveScan(time.Second, map[string]int{"http/1": 2}, 2)
+	m.ObserveProbe("shop.localhost", probe.ProbeResult{Duration: time.Millisecond})
+	m.ObserveScan(time.Second, map[string]int{"http/1": 1}, 2)
+
+	got := scrape(t, m)
+	if !strings.Contains(got, `localhost_magic_probe_duration_seconds_count{service="shop.localhost"} 2`) {
+		t.Errorf("shop.localhost's series is missing:\n%s", got)
+	}
+	if strings.Contains(got, "blog.localhost") {
+		t.Errorf("blog.localhost's series outlived it:\n%s", got)
+	}
+	if !strings.Contains(got, `localhost_magic_services_up{protocol="http/1"} 1`) {
+		t.Errorf("services up not replaced by the last scan's:\n%s", got)
+	}
+}
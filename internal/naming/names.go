@@ -4,6 +4,7 @@ package naming
 import (
 	"crypto/sha256"
 	"fmt"
+	"net"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -324,6 +325,30 @@ func SanitizeName(name string) string {
 	return name
 }
 
+// AppName names an app a reverse proxy serves after the Host it is routed
+// by, with its path prefix if it has one: shop.localhost for shop.test,
+// or for shop.localhost itself, and shop-api.localhost for shop.test/api.
+// An app routed by path alone is named under its proxy, e.g.
+// gateway-api.localhost for /api behind gateway.localhost. It returns ""
+// for a route that is the proxy itself, with neither.
+func AppName(proxy, host, path string) string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	var base string
+	switch {
+	case host == "" || host == "localhost" || host == proxy || net.ParseIP(host) != nil:
+		if path == "" {
+			return ""
+		}
+		base = strings.TrimSuffix(proxy, ".localhost")
+	case strings.HasSuffix(host, ".localhost"):
+		base = strings.TrimSuffix(host, ".localhost")
+	default:
+		// shop.test and www.shop.test are both shop
+		base, _, _ = strings.Cut(strings.TrimPrefix(host, "www."), ".")
+	}
+	return SanitizeName(base+"-"+path) + ".localhost"
+}
+
 // computeHash creates a stable hash of the executable path
 func computeHash(exePath string) string {
 	h := sha256.New()
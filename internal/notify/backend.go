@@ -0,0 +1,54 @@
+package notify
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Notification is what a Backend shows
+type Notification struct {
+	Title string
+	Body  string
+	URL   string // Opened when the notification is clicked, where supported
+}
+
+// Backend shows notifications through a platform's notification service
+type Backend interface {
+	Show(n Notification) error
+}
+
+// Discard is the backend that shows nothing
+type Discard struct{}
+
+// Show implements Backend
+func (Discard) Show(Notification) error { return nil }
+
+// Backends names the backends NewBackend knows, on any platform: "auto"
+// picks the platform's, "none" is Discard
+var Backends = []string{"auto", "none", "dbus", "osascript", "terminal-notifier"}
+
+// ErrUnsupported is returned by NewBackend for a backend this platform
+// doesn't have
+var ErrUnsupported = errors.New("not supported on this platform")
+
+// NewBackend returns the named backend: "auto" or "" for the platform's
+// own (D-Bus on Linux, terminal-notifier on macOS when installed and
+// osascript otherwise), "none", or one of the others in Backends
+func NewBackend(name string) (Backend, error) {
+	switch name {
+	case "", "auto":
+		return autoBackend()
+	case "none":
+		return Discard{}, nil
+	}
+	if open, ok := platformBackends[name]; ok {
+		return open()
+	}
+	for _, known := range Backends {
+		if name == known {
+			return nil, fmt.Errorf("notification backend %s: %w", name, ErrUnsupported)
+		}
+	}
+	return nil, fmt.Errorf("unknown notification backend %q, expected one of %s", name, strings.Join(Backends, ", "))
+}
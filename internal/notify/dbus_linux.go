@@ -0,0 +1,717 @@
+//go:build linux
+
+package notify
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// D-Bus message types
+const (
+	dbusMethodCall   = 1
+	dbusMethodReturn = 2
+	dbusError        = 3
+	dbusSignal       = 4
+)
+
+// D-Bus header fields
+const (
+	fieldPath        = 1
+	fieldInterface   = 2
+	fieldMember      = 3
+	fieldErrorName   = 4
+	fieldReplySerial = 5
+	fieldDestination = 6
+	fieldSender      = 7
+	fieldSignature   = 8
+)
+
+// dbusCallTimeout bounds how long a method call waits for its reply
+const dbusCallTimeout = 5 * time.Second
+
+// dbusVariant is a value of type "v", with the signature of its type
+type dbusVariant struct {
+	sig   string
+	value any
+}
+
+// dbusMessage is a decoded D-Bus message
+type dbusMessage struct {
+	kind        byte
+	serial      uint32
+	replySerial uint32
+	path        string
+	iface       string
+	member      string
+	errorName   string
+	body        []any
+}
+
+// dbusConn is a connection to the session bus speaking just enough of the
+// D-Bus protocol to call the notification service and hear its signals
+type dbusConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	signal func(dbusMessage) // Called on the read loop for each signal
+
+	mu     sync.Mutex
+	serial uint32
+	calls  map[uint32]chan dbusMessage
+	err    error // Set once the connection failed
+}
+
+// sessionBusAddrs returns the addresses to try for the session bus: the
+// standard environment variable, else the per-user socket, which under
+// sudo is the invoking user's
+func sessionBusAddrs() []string {
+	if addr := os.Getenv("DBUS_SESSION_BUS_ADDRESS"); addr != "" {
+		return strings.Split(addr, ";")
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return []string{"unix:path=" + dir + "/bus"}
+	}
+	if uid := os.Getenv("SUDO_UID"); uid != "" {
+		return []string{"unix:path=/run/user/" + uid + "/bus"}
+	}
+	return []string{"unix:path=/run/user/" + strconv.Itoa(os.Getuid()) + "/bus"}
+}
+
+// dialSessionBus connects and authenticates to the session bus and says
+// Hello, after which signals are passed to signal
+func dialSessionBus(signal func(dbusMessage)) (*dbusConn, error) {
+	var errs []error
+	for _, addr := range sessionBusAddrs() {
+		socket, ok := unixSocket(addr)
+		if !ok {
+			continue
+		}
+		uid, gid, sudo := sudoUser()
+		var conn net.Conn
+		var err error
+		if sudo {
+			conn, err = dialAs(socket, uid, gid)
+		} else {
+			conn, err = net.DialTimeout("unix", socket, dbusCallTimeout)
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		c := &dbusConn{conn: conn, reader: bufio.NewReader(conn), signal: signal, calls: make(map[uint32]chan dbusMessage)}
+		if err := c.auth(uid); err != nil {
+			conn.Close()
+			errs = append(errs, err)
+			continue
+		}
+		go c.readLoop()
+		if _, err := c.call("org.freedesktop.DBus", "/org/freedesktop/DBus", "org.freedesktop.DBus", "Hello", ""); err != nil {
+			c.Close()
+			errs = append(errs, err)
+			continue
+		}
+		return c, nil
+	}
+	if len(errs) == 0 {
+		return nil, errors.New("failed to find the session bus")
+	}
+	return nil, fmt.Errorf("failed to connect to the session bus: %w", errors.Join(errs...))
+}
+
+// sudoUser returns the user to connect to the session bus as: the one
+// who ran sudo, when the daemon runs as root under it, else this process's
+func sudoUser() (uid, gid int, sudo bool) {
+	if os.Getuid() == 0 {
+		uid, uidErr := strconv.Atoi(os.Getenv("SUDO_UID"))
+		gid, gidErr := strconv.Atoi(os.Getenv("SUDO_GID"))
+		if uidErr == nil && gidErr == nil && uid != 0 {
+			return uid, gid, true
+		}
+	}
+	return os.Getuid(), os.Getgid(), false
+}
+
+// dialAs connects to a unix socket as another user, since a session bus
+// only lets its own user in. Linux keeps credentials per thread, so they
+// are switched on a locked thread that is thrown away after the connect.
+func dialAs(socket string, uid, gid int) (net.Conn, error) {
+	type dialed struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan dialed, 1)
+	go func() {
+		// Never unlocked, so the thread exits with the goroutine
+		runtime.LockOSThread()
+		keep := ^uintptr(0) // -1 leaves the real and saved IDs alone
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_SETRESGID, keep, uintptr(gid), keep); errno != 0 {
+			done <- dialed{err: fmt.Errorf("failed to switch to group %d: %w", gid, errno)}
+			return
+		}
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_SETRESUID, keep, uintptr(uid), keep); errno != 0 {
+			done <- dialed{err: fmt.Errorf("failed to switch to user %d: %w", uid, errno)}
+			return
+		}
+		conn, err := net.DialTimeout("unix", socket, dbusCallTimeout)
+		done <- dialed{conn, err}
+	}()
+	d := <-done
+	return d.conn, d.err
+}
+
+// unixSocket returns the socket a "unix:path=..." or "unix:abstract=..."
+// bus address names
+func unixSocket(addr string) (string, bool) {
+	params, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return "", false
+	}
+	for _, param := range strings.Split(params, ",") {
+		key, value, _ := strings.Cut(param, "=")
+		switch key {
+		case "path":
+			return value, true
+		case "abstract":
+			return "@" + value, true
+		}
+	}
+	return "", false
+}
+
+// auth authenticates as the user who connected with the EXTERNAL
+// mechanism
+func (c *dbusConn) auth(uid int) error {
+	c.conn.SetDeadline(time.Now().Add(dbusCallTimeout))
+	defer c.conn.SetDeadline(time.Time{})
+	id := hex.EncodeToString([]byte(strconv.Itoa(uid)))
+	if _, err := io.WriteString(c.conn, "\x00AUTH EXTERNAL "+id+"\r\n"); err != nil {
+		return fmt.Errorf("failed to authenticate: %w", err)
+	}
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("failed to authenticate: %w", err)
+	}
+	if !strings.HasPrefix(line, "OK ") {
+		return fmt.Errorf("failed to authenticate: bus answered %q", strings.TrimSpace(line))
+	}
+	if _, err := io.WriteString(c.conn, "BEGIN\r\n"); err != nil {
+		return fmt.Errorf("failed to authenticate: %w", err)
+	}
+	return nil
+}
+
+// Close closes the connection, failing the calls waiting for a reply
+func (c *dbusConn) Close() error {
+	return c.conn.Close()
+}
+
+// Err returns the error the connection failed with, nil while it works
+func (c *dbusConn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// call invokes a method and returns the body of its reply
+func (c *dbusConn) call(dest, path, iface, member, sig string, args ...any) ([]any, error) {
+	reply := make(chan dbusMessage, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	c.serial++
+	serial := c.serial
+	c.calls[serial] = reply
+	msg, err := encodeCall(serial, dest, path, iface, member, sig, args)
+	if err == nil {
+		c.conn.SetWriteDeadline(time.Now().Add(dbusCallTimeout))
+		_, err = c.conn.Write(msg)
+	}
+	if err != nil {
+		delete(c.calls, serial)
+		c.mu.Unlock()
+		return nil, fmt.Errorf("failed to call %s: %w", member, err)
+	}
+	c.mu.Unlock()
+
+	timer := time.NewTimer(dbusCallTimeout)
+	defer timer.Stop()
+	select {
+	case m, ok := <-reply:
+		if !ok {
+			return nil, fmt.Errorf("failed to call %s: %w", member, c.Err())
+		}
+		if m.kind == dbusError {
+			detail := ""
+			if len(m.body) > 0 {
+				detail, _ = m.body[0].(string)
+			}
+			return nil, fmt.Errorf("failed to call %s: %s: %s", member, m.errorName, detail)
+		}
+		return m.body, nil
+	case <-timer.C:
+		c.mu.Lock()
+		delete(c.calls, serial)
+		c.mu.Unlock()
+		return nil, fmt.Errorf("failed to call %s: no reply after %s", member, dbusCallTimeout)
+	}
+}
+
+// readLoop hands replies to the calls waiting for them and signals to
+// c.signal, until the connection fails
+func (c *dbusConn) readLoop() {
+	for {
+		m, err := readMessage(c.reader)
+		if err != nil {
+			c.mu.Lock()
+			c.err = fmt.Errorf("session bus connection lost: %w", err)
+			for serial, reply := range c.calls {
+				close(reply)
+				delete(c.calls, serial)
+			}
+			c.mu.Unlock()
+			c.conn.Close()
+			return
+		}
+		switch m.kind {
+		case dbusMethodReturn, dbusError:
+			c.mu.Lock()
+			reply, ok := c.calls[m.replySerial]
+			delete(c.calls, m.replySerial)
+			c.mu.Unlock()
+			if ok {
+				reply <- m
+			}
+		case dbusSignal:
+			if c.signal != nil {
+				c.signal(m)
+			}
+		}
+	}
+}
+
+// encodeCall builds a method call message
+func encodeCall(serial uint32, dest, path, iface, member, sig string, args []any) ([]byte, error) {
+	var body dbusEncoder
+	rest := sig
+	for _, arg := range args {
+		t, next, err := nextType(rest)
+		if err != nil {
+			return nil, err
+		}
+		if err := body.value(t, arg); err != nil {
+			return nil, err
+		}
+		rest = next
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("missing arguments for signature %q", sig)
+	}
+
+	fields := []any{
+		[]any{byte(fieldPath), dbusVariant{"o", path}},
+		[]any{byte(fieldDestination), dbusVariant{"s", dest}},
+		[]any{byte(fieldInterface), dbusVariant{"s", iface}},
+		[]any{byte(fieldMember), dbusVariant{"s", member}},
+	}
+	if sig != "" {
+		fields = append(fields, []any{byte(fieldSignature), dbusVariant{"g", sig}})
+	}
+	var header dbusEncoder
+	header.b = append(header.b, 'l', dbusMethodCall, 0, 1)
+	header.uint32(uint32(len(body.b)))
+	header.uint32(serial)
+	if err := header.value("a(yv)", fields); err != nil {
+		return nil, err
+	}
+	header.align(8)
+	return append(header.b, body.b...), nil
+}
+
+// readMessage reads and decodes one message
+func readMessage(r io.Reader) (dbusMessage, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return dbusMessage{}, err
+	}
+	var order binary.ByteOrder
+	switch fixed[0] {
+	case 'l':
+		order = binary.LittleEndian
+	case 'B':
+		order = binary.BigEndian
+	default:
+		return dbusMessage{}, fmt.Errorf("invalid byte order %q", fixed[0])
+	}
+	bodyLen := order.Uint32(fixed[4:])
+	fieldsLen := order.Uint32(fixed[12:])
+	if bodyLen > 1<<26 || fieldsLen > 1<<26 {
+		return dbusMessage{}, errors.New("message too large")
+	}
+	headerLen := 16 + int(fieldsLen)
+	headerLen += (8 - headerLen%8) % 8
+	data := make([]byte, headerLen+int(bodyLen))
+	copy(data, fixed)
+	if _, err := io.ReadFull(r, data[16:]); err != nil {
+		return dbusMessage{}, err
+	}
+
+	m := dbusMessage{kind: fixed[1], serial: order.Uint32(fixed[8:])}
+	d := &dbusDecoder{b: data[:headerLen], pos: 12, order: order}
+	fields, err := d.value("a(yv)")
+	if err != nil {
+		return dbusMessage{}, fmt.Errorf("invalid header: %w", err)
+	}
+	sig := ""
+	for _, f := range fields.([]any) {
+		field := f.([]any)
+		v := field[1].(dbusVariant).value
+		switch field[0].(byte) {
+		case fieldPath:
+			m.path, _ = v.(string)
+		case fieldInterface:
+			m.iface, _ = v.(string)
+		case fieldMember:
+			m.member, _ = v.(string)
+		case fieldErrorName:
+			m.errorName, _ = v.(string)
+		case fieldReplySerial:
+			m.replySerial, _ = v.(uint32)
+		case fieldSignature:
+			sig, _ = v.(string)
+		}
+	}
+
+	d = &dbusDecoder{b: data[headerLen:], order: order}
+	for sig != "" {
+		var t string
+		if t, sig, err = nextType(sig); err != nil {
+			return dbusMessage{}, err
+		}
+		v, err := d.value(t)
+		if err != nil {
+			return dbusMessage{}, fmt.Errorf("invalid body: %w", err)
+		}
+		m.body = append(m.body, v)
+	}
+	return m, nil
+}
+
+// nextType splits the first complete type off a signature
+func nextType(sig string) (string, string, error) {
+	if sig == "" {
+		return "", "", errors.New("signature ended early")
+	}
+	switch sig[0] {
+	case 'a':
+		elem, rest, err := nextType(sig[1:])
+		return "a" + elem, rest, err
+	case '(', '{':
+		closing := map[byte]byte{'(': ')', '{': '}'}[sig[0]]
+		inner := sig[1:]
+		for inner != "" && inner[0] != closing {
+			var err error
+			if _, inner, err = nextType(inner); err != nil {
+				return "", "", err
+			}
+		}
+		if inner == "" {
+			return "", "", fmt.Errorf("unterminated %q in signature", sig[0])
+		}
+		n := len(sig) - len(inner) + 1
+		return sig[:n], sig[n:], nil
+	}
+	return sig[:1], sig[1:], nil
+}
+
+// alignment is the boundary values of type t start on
+func alignment(t string) int {
+	switch t[0] {
+	case 'y', 'g', 'v':
+		return 1
+	case 'n', 'q':
+		return 2
+	case 'x', 't', 'd', '(', '{':
+		return 8
+	}
+	return 4
+}
+
+// memberTypes returns the types of a struct or dict entry's fields
+func memberTypes(t string) ([]string, error) {
+	var types []string
+	inner := t[1 : len(t)-1]
+	for inner != "" {
+		field, rest, err := nextType(inner)
+		if err != nil {
+			return nil, err
+		}
+		types = append(types, field)
+		inner = rest
+	}
+	return types, nil
+}
+
+// dbusEncoder marshals values in little-endian order. Arrays, structs
+// and dict entries are given as []any; a variant as dbusVariant.
+type dbusEncoder struct {
+	b []byte
+}
+
+func (e *dbusEncoder) align(n int) {
+	for len(e.b)%n != 0 {
+		e.b = append(e.b, 0)
+	}
+}
+
+func (e *dbusEncoder) uint32(v uint32) {
+	e.align(4)
+	e.b = binary.LittleEndian.AppendUint32(e.b, v)
+}
+
+func (e *dbusEncoder) value(t string, v any) error {
+	mismatch := fmt.Errorf("cannot encode %T as %q", v, t)
+	switch t[0] {
+	case 'y':
+		x, ok := v.(byte)
+		if !ok {
+			return mismatch
+		}
+		e.b = append(e.b, x)
+	case 'b':
+		x, ok := v.(bool)
+		if !ok {
+			return mismatch
+		}
+		n := uint32(0)
+		if x {
+			n = 1
+		}
+		e.uint32(n)
+	case 'i':
+		x, ok := v.(int32)
+		if !ok {
+			return mismatch
+		}
+		e.uint32(uint32(x))
+	case 'u':
+		x, ok := v.(uint32)
+		if !ok {
+			return mismatch
+		}
+		e.uint32(x)
+	case 's', 'o':
+		x, ok := v.(string)
+		if !ok {
+			return mismatch
+		}
+		e.uint32(uint32(len(x)))
+		e.b = append(append(e.b, x...), 0)
+	case 'g':
+		x, ok := v.(string)
+		if !ok {
+			return mismatch
+		}
+		e.b = append(append(append(e.b, byte(len(x))), x...), 0)
+	case 'v':
+		x, ok := v.(dbusVariant)
+		if !ok {
+			return mismatch
+		}
+		e.value("g", x.sig)
+		return e.value(x.sig, x.value)
+	case 'a':
+		items, ok := v.([]any)
+		if !ok {
+			return mismatch
+		}
+		e.uint32(0)
+		lenAt := len(e.b) - 4
+		e.align(alignment(t[1:]))
+		start := len(e.b)
+		for _, item := range items {
+			if err := e.value(t[1:], item); err != nil {
+				return err
+			}
+		}
+		binary.LittleEndian.PutUint32(e.b[lenAt:], uint32(len(e.b)-start))
+	case '(', '{':
+		items, ok := v.([]any)
+		types, err := memberTypes(t)
+		if err != nil {
+			return err
+		}
+		if !ok || len(items) != len(types) {
+			return mismatch
+		}
+		e.align(8)
+		for i, item := range items {
+			if err := e.value(types[i], item); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported type %q", t)
+	}
+	return nil
+}
+
+// dbusDecoder unmarshals values; arrays, structs and dict entries come
+// out as []any, a variant as dbusVariant
+type dbusDecoder struct {
+	b     []byte
+	pos   int
+	order binary.ByteOrder
+}
+
+func (d *dbusDecoder) align(n int) error {
+	for d.pos%n != 0 {
+		d.pos++
+	}
+	if d.pos > len(d.b) {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+func (d *dbusDecoder) take(n int) ([]byte, error) {
+	if n < 0 || len(d.b)-d.pos < n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := d.b[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *dbusDecoder) fixed(n int) (uint64, error) {
+	if err := d.align(n); err != nil {
+		return 0, err
+	}
+	b, err := d.take(n)
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(d.order.Uint16(b)), nil
+	case 4:
+		return uint64(d.order.Uint32(b)), nil
+	}
+	return d.order.Uint64(b), nil
+}
+
+func (d *dbusDecoder) value(t string) (any, error) {
+	switch t[0] {
+	case 'y':
+		n, err := d.fixed(1)
+		return byte(n), err
+	case 'b':
+		n, err := d.fixed(4)
+		return n != 0, err
+	case 'n':
+		n, err := d.fixed(2)
+		return int16(n), err
+	case 'q':
+		n, err := d.fixed(2)
+		return uint16(n), err
+	case 'i', 'h':
+		n, err := d.fixed(4)
+		return int32(n), err
+	case 'u':
+		n, err := d.fixed(4)
+		return uint32(n), err
+	case 'x':
+		n, err := d.fixed(8)
+		return int64(n), err
+	case 't', 'd':
+		return d.fixed(8)
+	case 's', 'o':
+		n, err := d.fixed(4)
+		if err != nil {
+			return nil, err
+		}
+		b, err := d.take(int(n) + 1)
+		if err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+	case 'g':
+		n, err := d.fixed(1)
+		if err != nil {
+			return nil, err
+		}
+		b, err := d.take(int(n) + 1)
+		if err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+	case 'v':
+		sig, err := d.value("g")
+		if err != nil {
+			return nil, err
+		}
+		inner, rest, err := nextType(sig.(string))
+		if err != nil || rest != "" {
+			return nil, fmt.Errorf("invalid variant signature %q", sig)
+		}
+		v, err := d.value(inner)
+		return dbusVariant{inner, v}, err
+	case 'a':
+		n, err := d.fixed(4)
+		if err != nil {
+			return nil, err
+		}
+		if err := d.align(alignment(t[1:])); err != nil {
+			return nil, err
+		}
+		end := d.pos + int(n)
+		if end > len(d.b) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		items := []any{}
+		for d.pos < end {
+			item, err := d.value(t[1:])
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		if d.pos != end {
+			return nil, fmt.Errorf("array item overruns its %d bytes", n)
+		}
+		return items, nil
+	case '(', '{':
+		types, err := memberTypes(t)
+		if err != nil {
+			return nil, err
+		}
+		if err := d.align(8); err != nil {
+			return nil, err
+		}
+		items := make([]any, 0, len(types))
+		for _, field := range types {
+			item, err := d.value(field)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unsupported type %q", t)
+}
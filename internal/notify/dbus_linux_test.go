@@ -0,0 +1,385 @@
+//go:build linux
+
+package notify
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fromHex decodes a fixture, ignoring the spaces it is laid out with
+func fromHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// Strings of the fixtures, as hex
+const (
+	hexBusPath    = "2f6f72672f667265656465736b746f702f44427573"                   // /org/freedesktop/DBus
+	hexBusName    = "6f72672e667265656465736b746f702e44427573"                     // org.freedesktop.DBus
+	hexNotifyPath = "2f6f72672f667265656465736b746f702f4e6f74696669636174696f6e73" // /org/freedesktop/Notifications
+	hexNotifyName = "6f72672e667265656465736b746f702e4e6f74696669636174696f6e73"   // org.freedesktop.Notifications
+)
+
+// helloCall is the Hello every connection starts with: no body, and four
+// header fields, each a struct starting on an 8-byte boundary
+var helloCall = "6c 01 00 01 00000000 01000000 6e000000" +
+	"01 01 6f 00 15000000 " + hexBusPath + " 00 0000" + // Path
+	"06 01 73 00 14000000 " + hexBusName + " 00 000000" + // Destination
+	"02 01 73 00 14000000 " + hexBusName + " 00 000000" + // Interface
+	"03 01 73 00 05000000 48656c6c6f 00 0000" // Member "Hello", then the header padded to 8
+
+// notifyCall is Show's call for a notification with a URL
+var notifyCall = "6c 01 00 01 84000000 02000000 9b000000" +
+	"01 01 6f 00 1e000000 " + hexNotifyPath + " 00 00" +
+	"06 01 73 00 1d000000 " + hexNotifyName + " 00 0000" +
+	"02 01 73 00 1d000000 " + hexNotifyName + " 00 0000" +
+	"03 01 73 00 06000000 4e6f74696679 00 00" + // Notify
+	"08 01 67 00 0d 7375737373617361 7b73767d69 00" + // susssasa{sv}i
+	"0000000000" +
+	// Body
+	"0f000000 6c6f63616c686f73742d6d61676963 00" + // localhost-magic
+	"00000000" + // replaces_id
+	"0e000000 6e6574776f726b2d736572766572 00 00" + // network-server
+	"0c000000 77656220697320726561647900 000000" + // "web is ready"
+	"15000000 68747470733a2f2f7765622e6c6f63616c686f7374 00 0000" + // https://web.localhost
+	"15000000 07000000 64656661756c74 00 04000000 4f70656e 00 000000" + // ["default", "Open"]
+	"00000000 00000000" + // No hints, the empty array still padded to its entries' 8
+	"ffffffff" // Expire timeout -1
+
+// notifyReply is the notification service's reply to notifyCall, giving
+// the notification ID 7, as the bus delivers it: with Destination and
+// Sender added among the fields
+var notifyReply = "6c 02 01 01 04000000 0a000000 2d000000" +
+	"05 01 75 00 02000000" + // Reply serial 2
+	"06 01 73 00 04000000 3a312e39 00 000000" + // Destination ":1.9"
+	"08 01 67 00 01 75 00 00" + // Signature "u"
+	"07 01 73 00 04000000 3a312e35 00 000000" + // Sender ":1.5", then padding
+	"07000000"
+
+// actionInvoked is the signal that notification 7 was clicked, from a
+// big-endian service
+var actionInvoked = "42 04 01 01 00000010 00000003 00000070" +
+	"01 01 6f 00 0000001e " + hexNotifyPath + " 00 00" +
+	"02 01 73 00 0000001d " + hexNotifyName + " 00 0000" +
+	"03 01 73 00 0000000d 416374696f6e496e766f6b6564 00 0000" + // ActionInvoked
+	"08 01 67 00 02 7573 00" +
+	"00000007 00000007 64656661756c74 00" // 7, "default"
+
+// serviceUnknown is the bus's error reply to notifyCall when there is no
+// notification service
+var serviceUnknown = "6c 03 01 01 0f000000 05000000 47000000" +
+	"04 01 73 00 29000000 " + hexBusName + "2e4572726f72 2e53657276696365556e6b6e6f776e 00 0000000000 00" + // .Error.ServiceUnknown
+	"05 01 75 00 02000000" +
+	"08 01 67 00 01 73 00 00" +
+	"0a000000 6e6f2073657276696365 00" // "no service"
+
+func TestEncodeCall(t *testing.T) {
+	tests := []struct {
+		name string
+		got  func() ([]byte, error)
+		want string
+	}{
+		{"hello", func() ([]byte, error) {
+			return encodeCall(1, "org.freedesktop.DBus", "/org/freedesktop/DBus", "org.freedesktop.DBus", "Hello", "", nil)
+		}, helloCall},
+		{"notify", func() ([]byte, error) {
+			return encodeCall(2, notifyDest, notifyPath, notifyIface, "Notify", "susssasa{sv}i", []any{
+				"localhost-magic", uint32(0), "network-server", "web is ready", "https://web.localhost",
+				[]any{"default", "Open"}, []any{}, int32(-1),
+			})
+		}, notifyCall},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.got()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := fromHex(t, tt.want); !bytes.Equal(got, want) {
+				t.Errorf("message\n got %x\nwant %x", got, want)
+			}
+		})
+	}
+}
+
+func TestEncodeCallErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		sig  string
+		args []any
+	}{
+		{"missing argument", "su", []any{"x"}},
+		{"extra argument", "s", []any{"x", "y"}},
+		{"wrong type", "u", []any{"x"}},
+		{"int for int32", "i", []any{-1}},
+		{"short struct", "(su)", []any{[]any{"x"}}},
+		{"unsupported type", "d", []any{1.5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := encodeCall(1, notifyDest, notifyPath, notifyIface, "Notify", tt.sig, tt.args); err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		want    dbusMessage
+	}{
+		{
+			"method return",
+			notifyReply,
+			dbusMessage{kind: dbusMethodReturn, serial: 10, replySerial: 2, body: []any{uint32(7)}},
+		},
+		{
+			"big-endian signal",
+			actionInvoked,
+			dbusMessage{kind: dbusSignal, serial: 3, path: notifyPath, iface: notifyIface, member: "ActionInvoked",
+				body: []any{uint32(7), "default"}},
+		},
+		{
+			"error",
+			serviceUnknown,
+			dbusMessage{kind: dbusError, serial: 5, replySerial: 2, errorName: "org.freedesktop.DBus.Error.ServiceUnknown",
+				body: []any{"no service"}},
+		},
+		{
+			"array of dict entries in a variant",
+			"6c 04 01 01 2c000000 01000000 17000000" +
+				"03 01 73 00 01000000 58 00 000000000000" + // Member "X"
+				"08 01 67 00 01 76 00 00" + // Signature "v"
+				"05 617b73757d 00 00 1c000000 00000000" + // Variant of a{su}, padded to the first entry
+				"01000000 61 00 0000 01000000 00000000" + // {"a": 1}
+				"01000000 62 00 0000 02000000", // {"b": 2}
+			dbusMessage{kind: dbusSignal, serial: 1, member: "X", body: []any{
+				dbusVariant{"a{su}", []any{[]any{"a", uint32(1)}, []any{"b", uint32(2)}}},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readMessage(bytes.NewReader(fromHex(t, tt.message)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readMessage() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadMessageErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+	}{
+		{"empty", ""},
+		{"short fixed header", "6c 02 01 01 04000000"},
+		{"byte order", "58 02 01 01 04000000 0a000000 2d000000"},
+		{"huge body", "6c 02 01 01 00000010 0a000000 00000000"},
+		{"truncated body", notifyReply[:len(notifyReply)-2]},
+		{"field past its array", "6c 02 01 01 00000000 0a000000 04000000 05 01 75 00 02000000"},
+		{"string past the body", "6c 02 01 01 04000000 0a000000 08000000 08 01 67 00 01 73 00 00 05000000"},
+		{"variant of two types", "6c 02 01 01 00000000 0a000000 08000000 05 02 7575 00 000000"},
+		{"unterminated struct", "6c 02 01 01 04000000 0a000000 08000000 08 01 67 00 02 2875 00 00 00000000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if m, err := readMessage(bytes.NewReader(fromHex(t, tt.message))); err == nil {
+				t.Errorf("readMessage() = %+v, want an error", m)
+			}
+		})
+	}
+}
+
+func TestNextType(t *testing.T) {
+	tests := []struct {
+		sig, first, rest string
+	}{
+		{"susssasa{sv}i", "s", "usssasa{sv}i"},
+		{"asa{sv}i", "as", "a{sv}i"},
+		{"a{sv}i", "a{sv}", "i"},
+		{"(yv)", "(yv)", ""},
+		{"a(ya{sv})u", "a(ya{sv})", "u"},
+	}
+	for _, tt := range tests {
+		first, rest, err := nextType(tt.sig)
+		if err != nil || first != tt.first || rest != tt.rest {
+			t.Errorf("nextType(%q) = %q, %q, %v, want %q, %q", tt.sig, first, rest, err, tt.first, tt.rest)
+		}
+	}
+	for _, sig := range []string{"", "a", "(su", "a{s"} {
+		if _, _, err := nextType(sig); err == nil {
+			t.Errorf("nextType(%q) didn't fail", sig)
+		}
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	tests := []struct {
+		addr   string
+		socket string
+		ok     bool
+	}{
+		{"unix:path=/run/user/1000/bus", "/run/user/1000/bus", true},
+		{"unix:abstract=/tmp/dbus-XXX,guid=0123", "@/tmp/dbus-XXX", true},
+		{"unix:guid=0123,path=/tmp/bus", "/tmp/bus", true},
+		{"tcp:host=localhost,port=1234", "", false},
+		{"unix:tmpdir=/tmp", "", false},
+	}
+	for _, tt := range tests {
+		socket, ok := unixSocket(tt.addr)
+		if socket != tt.socket || ok != tt.ok {
+			t.Errorf("unixSocket(%q) = %q, %v, want %q, %v", tt.addr, socket, ok, tt.socket, tt.ok)
+		}
+	}
+}
+
+func TestAuth(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply string
+		ok    bool
+	}{
+		{"accepted", "OK 1234deadbeef1234deadbeef1234dead\r\n", true},
+		{"rejected", "REJECTED EXTERNAL\r\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			bus := make(chan []string, 1)
+			go func() {
+				defer server.Close()
+				r := bufio.NewReader(server)
+				var lines []string
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						break
+					}
+					lines = append(lines, line)
+					if len(lines) == 1 {
+						io.WriteString(server, tt.reply)
+					}
+				}
+				bus <- lines
+			}()
+			c := &dbusConn{conn: client, reader: bufio.NewReader(client)}
+			err := c.auth(1000)
+			if (err == nil) != tt.ok {
+				t.Fatalf("auth() = %v", err)
+			}
+			client.Close()
+			want := []string{"\x00AUTH EXTERNAL 31303030\r\n"} // "1000" in hex
+			if tt.ok {
+				want = append(want, "BEGIN\r\n")
+			}
+			if got := <-bus; !reflect.DeepEqual(got, want) {
+				t.Errorf("sent %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// fakeBus is the far end of a connection, answering each call it reads
+// with the given fixtures
+func fakeBus(t *testing.T, answers ...string) (*dbusConn, chan dbusMessage) {
+	t.Helper()
+	client, server := net.Pipe()
+	signals := make(chan dbusMessage, 1)
+	c := &dbusConn{conn: client, reader: bufio.NewReader(client), signal: func(m dbusMessage) { signals <- m },
+		serial: 1, calls: make(map[uint32]chan dbusMessage)}
+	t.Cleanup(func() { c.Close() })
+	go func() {
+		defer server.Close()
+		r := bufio.NewReader(server)
+		if _, err := readMessage(r); err != nil {
+			t.Error(err)
+			return
+		}
+		for _, answer := range answers {
+			server.Write(fromHex(t, answer))
+		}
+	}()
+	go c.readLoop()
+	return c, signals
+}
+
+func TestCall(t *testing.T) {
+	notify := func(c *dbusConn) ([]any, error) {
+		return c.call(notifyDest, notifyPath, notifyIface, "Notify", "susssasa{sv}i",
+			"localhost-magic", uint32(0), "network-server", "web is ready", "https://web.localhost",
+			[]any{"default", "Open"}, []any{}, int32(-1))
+	}
+
+	t.Run("reply after a signal", func(t *testing.T) {
+		c, signals := fakeBus(t, actionInvoked, notifyReply)
+		reply, err := notify(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(reply, []any{uint32(7)}) {
+			t.Errorf("reply %v, want [7]", reply)
+		}
+		select {
+		case m := <-signals:
+			if m.member != "ActionInvoked" {
+				t.Errorf("signal %s, want ActionInvoked", m.member)
+			}
+		case <-time.After(time.Second):
+			t.Error("signal not passed on")
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		c, _ := fakeBus(t, serviceUnknown)
+		_, err := notify(c)
+		want := "failed to call Notify: org.freedesktop.DBus.Error.ServiceUnknown: no service"
+		if err == nil || err.Error() != want {
+			t.Errorf("call() = %v, want %q", err, want)
+		}
+	})
+
+	t.Run("connection lost", func(t *testing.T) {
+		c, _ := fakeBus(t)
+		if _, err := notify(c); err == nil || !strings.Contains(err.Error(), "session bus connection lost") {
+			t.Errorf("call() = %v, want the connection lost", err)
+		}
+		if c.Err() == nil {
+			t.Error("Err() = nil after the connection was lost")
+		}
+		if _, err := notify(c); err == nil {
+			t.Error("call on a lost connection didn't fail")
+		}
+	})
+}
+
+// A closed notification's URL is forgotten; a click on one without a
+// URL opens nothing
+func TestBackendSignal(t *testing.T) {
+	b := &dbusBackend{urls: map[uint32]string{7: "https://web.localhost", 8: "https://api.localhost"}}
+	b.signal(dbusMessage{kind: dbusSignal, member: "NotificationClosed", body: []any{uint32(7), uint32(2)}})
+	b.signal(dbusMessage{kind: dbusSignal, member: "ActionInvoked", body: []any{uint32(9), "default"}})
+	b.signal(dbusMessage{kind: dbusSignal, member: "NotificationClosed", body: []any{uint32(8)}})
+	if want := map[uint32]string{8: "https://api.localhost"}; !reflect.DeepEqual(b.urls, want) {
+		t.Errorf("urls %v, want %v", b.urls, want)
+	}
+}
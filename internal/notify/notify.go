@@ -0,0 +1,256 @@
+// Package notify shows desktop notifications for service events, such as
+// "web is ready on http://web.localhost/" or "api went down (connection
+// refused)". A Notifier filters events by type and service, holds a
+// removal back for a grace period so a restart doesn't show as the service
+// going down and coming back, and shows at most one notification per
+// service per interval: the latest one held back is shown when the
+// interval ends. Backends show them through the freedesktop notification
+// service over D-Bus on Linux, and osascript or terminal-notifier on macOS.
+package notify
+
+import (
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"localhost-magic/internal/discover"
+)
+
+// Default settings used when the Options field is zero
+const (
+	DefaultInterval = 30 * time.Second
+	DefaultGrace    = discover.DefaultGrace
+	queueSize       = 16
+)
+
+// Events are the event types a Notifier can show
+var Events = []discover.EventType{
+	discover.ServiceAdded,
+	discover.ServiceRemoved,
+	discover.ServiceRestarted,
+	discover.ServiceHealthy,
+	discover.ServiceDegraded,
+	discover.ServiceDown,
+}
+
+// DefaultEvents are those shown when Options.Events is empty: a service
+// ready, gone, or failing its health checks
+var DefaultEvents = []discover.EventType{discover.ServiceAdded, discover.ServiceRemoved, discover.ServiceDown}
+
+// Event is something that happened to a service
+type Event struct {
+	Type    discover.EventType
+	Service string // Its name, e.g. "web.localhost"
+	URL     string // Where it is reached, opened when the notification is clicked
+	Reason  string // Why it is down or degraded, e.g. "connection refused"
+}
+
+// Options configures a Notifier
+type Options struct {
+	// Events are the types to show, default DefaultEvents. A restart
+	// only shows as ServiceRestarted, never as removed then added.
+	Events []discover.EventType
+	// Services are the name patterns to show events of, with or without
+	// .localhost and in filepath.Match syntax, e.g. "api*"; empty means
+	// all
+	Services []string
+	// Interval is the least time between two notifications about the same
+	// service, default DefaultInterval
+	Interval time.Duration
+	// Grace is how long a removed service has to come back and be shown
+	// restarted instead, default DefaultGrace; negative shows removals at
+	// once
+	Grace time.Duration
+}
+
+// withDefaults returns a copy of the options with zero fields filled in
+func (o Options) withDefaults() Options {
+	if len(o.Events) == 0 {
+		o.Events = DefaultEvents
+	}
+	if o.Interval <= 0 {
+		o.Interval = DefaultInterval
+	}
+	if o.Grace == 0 {
+		o.Grace = DefaultGrace
+	}
+	return o
+}
+
+// wants reports whether events of type t about service are shown
+func (o Options) wants(t discover.EventType, service string) bool {
+	wanted := false
+	for _, e := range o.Events {
+		wanted = wanted || e == t
+	}
+	if !wanted || len(o.Services) == 0 {
+		return wanted
+	}
+	short := strings.TrimSuffix(service, ".localhost")
+	for _, pattern := range o.Services {
+		pattern = strings.TrimSuffix(strings.ToLower(pattern), ".localhost")
+		if ok, _ := filepath.Match(pattern, short); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Notifier turns service events into notifications shown by a Backend
+type Notifier struct {
+	backend Backend
+	queue   chan Notification
+
+	mu       sync.Mutex
+	opts     Options
+	services map[string]*serviceState
+	closed   bool
+}
+
+// serviceState is what a Notifier remembers of one service
+type serviceState struct {
+	shown   time.Time   // When the last notification about it was shown
+	held    *Event      // Held back until the interval ends
+	waiting *time.Timer // Runs when the interval ends, if held
+	removal *time.Timer // Shows a removal once the grace period is over
+}
+
+// New returns a notifier showing notifications through backend
+func New(backend Backend, opts Options) *Notifier {
+	n := &Notifier{
+		backend:  backend,
+		queue:    make(chan Notification, queueSize),
+		opts:     opts.withDefaults(),
+		services: make(map[string]*serviceState),
+	}
+	go n.work()
+	return n
+}
+
+// SetOptions replaces the notifier's options, keeping what it knows of
+// each service
+func (n *Notifier) SetOptions(opts Options) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.opts = opts.withDefaults()
+}
+
+// Close drops the notifications held back and stops showing any
+func (n *Notifier) Close() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return
+	}
+	n.closed = true
+	for _, s := range n.services {
+		for _, timer := range []*time.Timer{s.waiting, s.removal} {
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+	}
+	close(n.queue)
+}
+
+// Handle shows the notification for e, if the options ask for it, now or
+// once the service's interval or grace period is over. It never blocks.
+func (n *Notifier) Handle(e Event) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	s := n.services[e.Service]
+	if s == nil {
+		s = &serviceState{}
+		n.services[e.Service] = s
+	}
+
+	switch {
+	case e.Type == discover.ServiceRemoved && n.opts.Grace > 0:
+		if s.removal == nil {
+			var timer *time.Timer
+			timer = time.AfterFunc(n.opts.Grace, func() {
+				n.mu.Lock()
+				defer n.mu.Unlock()
+				if s.removal == timer {
+					s.removal = nil
+					n.emit(s, e)
+				}
+			})
+			s.removal = timer
+		}
+		return
+	case e.Type == discover.ServiceAdded && s.removal != nil:
+		s.removal.Stop()
+		s.removal = nil
+		e.Type = discover.ServiceRestarted
+	}
+	n.emit(s, e)
+}
+
+// emit shows e, or holds it until the service's interval is over, in
+// place of any other held there. The caller holds mu.
+func (n *Notifier) emit(s *serviceState, e Event) {
+	if n.closed || !n.opts.wants(e.Type, e.Service) {
+		return
+	}
+	if wait := n.opts.Interval - time.Since(s.shown); wait > 0 {
+		s.held = &e
+		if s.waiting == nil {
+			s.waiting = time.AfterFunc(wait, func() {
+				n.mu.Lock()
+				defer n.mu.Unlock()
+				held := s.held
+				s.held, s.waiting = nil, nil
+				if held != nil {
+					n.emit(s, *held)
+				}
+			})
+		}
+		return
+	}
+	s.shown = time.Now()
+	select {
+	case n.queue <- message(e):
+	default:
+		log.Printf("Notify: queue full, skipping %s of %s", e.Type, e.Service)
+	}
+}
+
+// work shows queued notifications one at a time
+func (n *Notifier) work() {
+	for note := range n.queue {
+		if err := n.backend.Show(note); err != nil {
+			log.Printf("Notify: %v", err)
+		}
+	}
+}
+
+// message is the notification for e, e.g. "web is ready on
+// https://web.localhost". Only a service that is up gets a URL to open.
+func message(e Event) Notification {
+	name := strings.TrimSuffix(e.Service, ".localhost")
+	note := Notification{Title: "localhost-magic", URL: e.URL}
+	switch e.Type {
+	case discover.ServiceAdded:
+		note.Body = name + " is ready"
+	case discover.ServiceRestarted:
+		note.Body = name + " restarted"
+	case discover.ServiceHealthy:
+		note.Body = name + " is healthy again"
+	case discover.ServiceDegraded:
+		note.Body = name + " is degraded"
+	case discover.ServiceRemoved, discover.ServiceDown:
+		note.Body, note.URL = name+" went down", ""
+	default:
+		note.Body = name + " " + string(e.Type)
+	}
+	if note.URL != "" {
+		note.Body += " on " + strings.TrimSuffix(note.URL, "/")
+	}
+	if e.Reason != "" {
+		note.Body += " (" + e.Reason + ")"
+	}
+	return note
+}
@@ -0,0 +1,67 @@
+//go:build darwin
+
+package notify
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+var platformBackends = map[string]func() (Backend, error){
+	"osascript":         func() (Backend, error) { return osascript{}, nil },
+	"terminal-notifier": newTerminalNotifier,
+}
+
+// autoBackend is terminal-notifier when it is installed, whose
+// notifications open their URL when clicked, and osascript otherwise
+func autoBackend() (Backend, error) {
+	if b, err := newTerminalNotifier(); err == nil {
+		return b, nil
+	}
+	return osascript{}, nil
+}
+
+// osascript shows notifications with AppleScript's display notification,
+// which has no actions: clicking one opens Script Editor, not the URL
+type osascript struct{}
+
+// Show implements Backend. The text is passed as arguments rather than
+// written into the script, so it needs no quoting.
+func (osascript) Show(n Notification) error {
+	cmd := exec.Command("osascript",
+		"-e", "on run argv",
+		"-e", "display notification (item 2 of argv) with title (item 1 of argv)",
+		"-e", "end run",
+		n.Title, n.Body)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to run osascript: %w: %s", err, out)
+	}
+	return nil
+}
+
+// terminalNotifier shows notifications with the terminal-notifier helper
+// (brew install terminal-notifier), opening their URL when clicked
+type terminalNotifier struct {
+	path string
+}
+
+// newTerminalNotifier finds terminal-notifier on the PATH
+func newTerminalNotifier() (Backend, error) {
+	path, err := exec.LookPath("terminal-notifier")
+	if err != nil {
+		return nil, fmt.Errorf("failed to find terminal-notifier: %w", err)
+	}
+	return terminalNotifier{path: path}, nil
+}
+
+// Show implements Backend
+func (t terminalNotifier) Show(n Notification) error {
+	args := []string{"-title", n.Title, "-message", n.Body}
+	if n.URL != "" {
+		args = append(args, "-open", n.URL)
+	}
+	if out, err := exec.Command(t.path, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to run terminal-notifier: %w: %s", err, out)
+	}
+	return nil
+}
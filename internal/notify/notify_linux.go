@@ -0,0 +1,134 @@
+//go:build linux
+
+package notify
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"sync"
+	"syscall"
+)
+
+// The freedesktop notification service
+const (
+	notifyDest  = "org.freedesktop.Notifications"
+	notifyPath  = "/org/freedesktop/Notifications"
+	notifyIface = "org.freedesktop.Notifications"
+)
+
+var platformBackends = map[string]func() (Backend, error){
+	"dbus": func() (Backend, error) { return newDBus() },
+}
+
+// autoBackend is the freedesktop notification service
+func autoBackend() (Backend, error) {
+	return newDBus()
+}
+
+// dbusBackend shows notifications through org.freedesktop.Notifications
+// on the session bus, opening a notification's URL when it is clicked
+type dbusBackend struct {
+	dialing sync.Mutex // Held while connecting
+
+	mu   sync.Mutex
+	conn *dbusConn         // Dialed again once it fails
+	urls map[uint32]string // By notification ID, until it is closed
+}
+
+// newDBus connects to the session bus, so a missing one is reported at
+// once; a connection lost later is made again on the next notification
+func newDBus() (Backend, error) {
+	b := &dbusBackend{urls: make(map[uint32]string)}
+	if _, err := b.connect(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// connect returns a working connection, dialing one if there is none.
+// mu isn't held while dialing, as the signals received meanwhile need it.
+func (b *dbusBackend) connect() (*dbusConn, error) {
+	b.dialing.Lock()
+	defer b.dialing.Unlock()
+	b.mu.Lock()
+	conn := b.conn
+	b.mu.Unlock()
+	if conn != nil && conn.Err() == nil {
+		return conn, nil
+	}
+	conn, err := dialSessionBus(b.signal)
+	if err != nil {
+		return nil, err
+	}
+	rule := "type='signal',interface='" + notifyIface + "',path='" + notifyPath + "'"
+	if _, err := conn.call("org.freedesktop.DBus", "/org/freedesktop/DBus", "org.freedesktop.DBus", "AddMatch", "s", rule); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	b.mu.Lock()
+	b.conn = conn
+	b.mu.Unlock()
+	return conn, nil
+}
+
+// Show implements Backend. A notification with a URL gets a default
+// action, which most notification daemons run when it is clicked.
+func (b *dbusBackend) Show(n Notification) error {
+	conn, err := b.connect()
+	if err != nil {
+		return err
+	}
+	actions := []any{}
+	if n.URL != "" {
+		actions = []any{"default", "Open"}
+	}
+	reply, err := conn.call(notifyDest, notifyPath, notifyIface, "Notify", "susssasa{sv}i",
+		"localhost-magic", uint32(0), "network-server", n.Title, n.Body, actions, []any{}, int32(-1))
+	if err != nil {
+		return err
+	}
+	if len(reply) == 0 || n.URL == "" {
+		return nil
+	}
+	if id, ok := reply[0].(uint32); ok {
+		b.mu.Lock()
+		b.urls[id] = n.URL
+		b.mu.Unlock()
+	}
+	return nil
+}
+
+// signal opens the URL of a clicked notification and forgets the closed
+// ones
+func (b *dbusBackend) signal(m dbusMessage) {
+	if m.member != "ActionInvoked" && m.member != "NotificationClosed" || len(m.body) < 2 {
+		return
+	}
+	id, _ := m.body[0].(uint32)
+	b.mu.Lock()
+	url := b.urls[id]
+	if m.member == "NotificationClosed" {
+		delete(b.urls, id)
+	}
+	b.mu.Unlock()
+	if action, _ := m.body[1].(string); m.member == "ActionInvoked" && action == "default" && url != "" {
+		if err := openURL(url); err != nil {
+			log.Printf("Notify: %v", err)
+		}
+	}
+}
+
+// openURL opens url in the desktop's browser with xdg-open, as the user
+// who ran sudo when the daemon runs under it
+func openURL(url string) error {
+	cmd := exec.Command("xdg-open", url)
+	if uid, gid, sudo := sudoUser(); sudo {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}}
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to open %s: %w", url, err)
+	}
+	go cmd.Wait()
+	return nil
+}
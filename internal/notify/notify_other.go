@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+
+package notify
+
+import "fmt"
+
+var platformBackends = map[string]func() (Backend, error){}
+
+// autoBackend fails: there is no notification backend for this platform
+func autoBackend() (Backend, error) {
+	return nil, fmt.Errorf("desktop notifications: %w", ErrUnsupported)
+}
@@ -0,0 +1,332 @@
+// Package output defines the JSON documents the CLI prints with --output
+// json, and those the daemon's API answers with, so the two can't drift
+// apart. The CLI's tables and messages are made from the same
+// values. A document wraps its data with the schema version and its kind:
+//
+//	{"schema_version": 1, "kind": "shares", "data": [...]}
+//
+// SchemaVersion goes up when a field is removed or changes meaning; new
+// fields may appear without it. Streams such as watch write one document
+// per line.
+package output
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"localhost-magic/internal/export"
+	"localhost-magic/internal/health"
+	"localhost-magic/internal/listing"
+	"localhost-magic/internal/procmap"
+	"localhost-magic/internal/registry"
+	"localhost-magic/internal/share"
+	"localhost-magic/probe"
+)
+
+// SchemaVersion is the version of the documents' shape
+const SchemaVersion = 1
+
+// Kind says what a document's data is
+type Kind string
+
+// Document kinds, with the type of their data
+const (
+	KindServices   Kind = "services"   // []listing.Service, from list; []Service, which extends it, from GET /api/services
+	KindService    Kind = "service"    // Service, from GET /api/services/{name}, a rename or a change of keep
+	KindRegistered Kind = "registered" // []*storage.ServiceRecord, from list --registered
+	KindEvent      Kind = "event"      // discover.Event, one per line from watch
+	KindShare      Kind = "share"      // ShareLink, from share
+	KindShares     Kind = "shares"     // []Share, from share --list
+	KindUnshare    Kind = "unshare"    // Unshare, from unshare
+	KindPrune      Kind = "prune"      // Prune, from prune
+	KindExport     Kind = "export"     // []export.Service, from export
+	KindHosts      Kind = "hosts"      // HostsUpdate, from export --apply
+	KindBench      Kind = "bench"      // probe.BenchResult, from bench
+	KindSockets    Kind = "sockets"    // []Socket, from sockets
+	KindCert       Kind = "cert"       // Cert, from tls ensure and cert renew
+	KindConfig     Kind = "config"     // ConfigCheck, from config check
+	KindProbe      Kind = "probe"      // Probe, from probe
+	KindHistory    Kind = "history"    // History, from history
+	KindListeners  Kind = "listeners"  // []Listener, from GET /api/listeners
+	KindHidden     Kind = "hidden"     // []int, the hidden ports, from GET /api/hidden and POST /api/hide
+	KindAccess     Kind = "access"     // []proxy.Access, from GET /api/access
+	KindBlacklist  Kind = "blacklist"  // Blacklist, from POST /api/blacklist
+)
+
+// Document is the envelope of every JSON output
+type Document struct {
+	SchemaVersion int  `json:"schema_version"`
+	Kind          Kind `json:"kind"`
+	Data          any  `json:"data"`
+}
+
+// Formats are the values of --output
+var Formats = []string{"text", "json"}
+
+// ValidateFormat returns an error unless format is one of Formats
+func ValidateFormat(format string) error {
+	for _, f := range Formats {
+		if format == f {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown output format %q, expected text or json", format)
+}
+
+// Write writes data as an indented document of kind
+func Write(w io.Writer, kind Kind, data any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(Document{SchemaVersion: SchemaVersion, Kind: kind, Data: data})
+}
+
+// Read decodes a document of kind from r into data, as the CLI reads the
+// daemon's answers. A document of another kind or of a newer schema is an
+// error.
+func Read(r io.Reader, kind Kind, data any) error {
+	var doc struct {
+		SchemaVersion int             `json:"schema_version"`
+		Kind          Kind            `json:"kind"`
+		Data          json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return fmt.Errorf("failed to read %s document: %w", kind, err)
+	}
+	switch {
+	case doc.SchemaVersion > SchemaVersion:
+		return fmt.Errorf("%s document has schema version %d, newer than %d: upgrade localhost-magic", kind, doc.SchemaVersion, SchemaVersion)
+	case doc.Kind != kind:
+		return fmt.Errorf("got a %q document, expected %s", doc.Kind, kind)
+	}
+	return json.Unmarshal(doc.Data, data)
+}
+
+// Stream writes documents as newline-delimited JSON, one per line
+type Stream struct {
+	enc *json.Encoder
+}
+
+// NewStream returns a stream writing to w
+func NewStream(w io.Writer) *Stream {
+	return &Stream{enc: json.NewEncoder(w)}
+}
+
+// Write writes data as a document of kind on a line of its own
+func (s *Stream) Write(kind Kind, data any) error {
+	return s.enc.Encode(Document{SchemaVersion: SchemaVersion, Kind: kind, Data: data})
+}
+
+// Service is a service as the daemon's API answers: the service as list
+// shows it, its finding made from the last probe, plus what the daemon
+// knows of it besides
+type Service struct {
+	listing.Service
+	ID      string `json:"id"`
+	Active  bool   `json:"active"`
+	Keep    bool   `json:"keep"`
+	Hidden  bool   `json:"hidden"`
+	Healthy bool   `json:"healthy"` // The last probe got a 2xx or 3xx answer
+	URL     string `json:"url"`
+	LANURL  string `json:"lan_url,omitempty"` // Where other devices reach it directly, if they can
+	Shared  bool   `json:"shared,omitempty"`  // Reachable from the LAN through a share
+	// Protocol is what the ?protocol= filter matches, e.g. "https"
+	Protocol string `json:"protocol,omitempty"`
+	// Score is how Health was scored, with since when and why
+	Score *health.Score `json:"score,omitempty"`
+	// CertRenewable is set when the local CA can mint the name a fresh
+	// certificate for the HTTPS listener to serve in front of it, with
+	// POST /api/services/{name}/cert
+	CertRenewable bool `json:"cert_renewable,omitempty"`
+	// Rewrites are the [rewrite] actions the proxy applies to the
+	// service's requests and answers, in order, e.g. "prefix /api/ /api/v1/"
+	Rewrites []string `json:"rewrites,omitempty"`
+}
+
+// Listener is a listening port the daemon probed that isn't HTTP, such as
+// a debugger waiting for a client
+type Listener struct {
+	Port    int           `json:"port"`
+	PID     int           `json:"pid"`
+	ExePath string        `json:"exe_path"`
+	Scope   procmap.Scope `json:"scope,omitempty"`
+	State   probe.State   `json:"state"`
+	Kind    string        `json:"kind,omitempty"`
+	Hint    string        `json:"hint,omitempty"`
+	// GRPCServices are what a gRPC server lists through reflection
+	GRPCServices []string `json:"grpc_services,omitempty"`
+	// AcceptableCAs are the CAs a server that requires a client
+	// certificate accepts them from
+	AcceptableCAs []string `json:"acceptable_cas,omitempty"`
+}
+
+// Blacklist is what POST /api/blacklist was asked to leave out
+type Blacklist struct {
+	Type  string `json:"type"` // "pid", "path" or "pattern"
+	Value string `json:"value"`
+}
+
+// Share is a service shared on the LAN, as the API answers and share
+// --list prints it; the password stays out of it
+type Share struct {
+	Name     string     `json:"name"`
+	Token    bool       `json:"token"`
+	User     string     `json:"user,omitempty"`
+	Idle     string     `json:"idle"` // e.g. "30m0s", or "never"
+	Created  time.Time  `json:"created"`
+	LastUsed time.Time  `json:"last_used"`
+	Expires  *time.Time `json:"expires,omitempty"`
+}
+
+// NewShare returns the document of s
+func NewShare(s share.Share) Share {
+	out := Share{
+		Name: s.Name, Token: s.Options.Token, User: s.Options.User,
+		Idle: s.Options.Idle.String(), Created: s.Created, LastUsed: s.LastUsed,
+	}
+	if expires := s.Expires(); expires.IsZero() {
+		out.Idle = "never"
+	} else {
+		out.Expires = &expires
+	}
+	return out
+}
+
+// NewShares returns the documents of shares, [] rather than null when
+// there are none
+func NewShares(shares []share.Share) []Share {
+	out := make([]Share, 0, len(shares))
+	for _, s := range shares {
+		out = append(out, NewShare(s))
+	}
+	return out
+}
+
+// ShareLink is a share with a link into it, as the API answers a new
+// share or a request for another link. URL is left out when the share is
+// only looked up, as links with a token work once.
+type ShareLink struct {
+	Share Share  `json:"share"`
+	URL   string `json:"url,omitempty"`
+}
+
+// Unshare is the service a share was revoked for
+type Unshare struct {
+	Name string `json:"name"`
+}
+
+// Prune is what prune removed from the registry, or would have with DryRun
+type Prune struct {
+	DryRun   bool            `json:"dry_run"`
+	Days     int             `json:"days"` // Unseen for this long
+	Services []PrunedService `json:"services"`
+}
+
+// PrunedService is a registry entry prune removed
+type PrunedService struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Port     int       `json:"port"`
+	Address  string    `json:"address,omitempty"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// NewPrune returns the document of a prune of entries unseen for maxAge
+func NewPrune(entries []registry.Entry, maxAge time.Duration, dryRun bool) Prune {
+	out := Prune{DryRun: dryRun, Days: int(maxAge.Hours() / 24), Services: make([]PrunedService, 0, len(entries))}
+	for _, e := range entries {
+		out.Services = append(out.Services, PrunedService{ID: e.ID, Name: e.Name, Port: e.Port, Address: e.Address, LastSeen: e.LastSeen})
+	}
+	return out
+}
+
+// HostsUpdate is what export --apply wrote to the hosts file
+type HostsUpdate struct {
+	File     string           `json:"file"`
+	Changed  bool             `json:"changed"` // False if the file already had the block
+	Services []export.Service `json:"services"`
+}
+
+// Socket is a Unix socket probed by sockets, with Status summing up the
+// probe as the table shows it, e.g. "HTTP/1.1 200 OK" or "permission
+// denied"
+type Socket struct {
+	Path   string            `json:"path"`
+	Status string            `json:"status"`
+	Probe  probe.ProbeResult `json:"probe"`
+}
+
+// Cert is a certificate issued by the local CA, as the API answers POST
+// /api/services/{name}/cert and tls ensure prints it. URL is where the
+// daemon's HTTPS listener serves the service with it, when it does.
+type Cert struct {
+	Name     string    `json:"name"`
+	URL      string    `json:"url,omitempty"`
+	Serial   string    `json:"serial"`
+	NotAfter time.Time `json:"not_after"`
+	CertPath string    `json:"cert_path"`
+	KeyPath  string    `json:"key_path"`
+}
+
+// ConfigCheck is the verdict of config check on a config file
+type ConfigCheck struct {
+	Path  string `json:"path"`
+	Valid bool   `json:"valid"`
+	Error string `json:"error,omitempty"`
+}
+
+// Probe is the report of probe on one port. Problem says why nothing, or
+// nothing useful, answered, e.g. "connection refused: nothing is listening";
+// CertIssues are what a browser would object to in its certificate.
+type Probe struct {
+	Target     string            `json:"target"` // host:port
+	Listening  bool              `json:"listening"`
+	Problem    string            `json:"problem,omitempty"`
+	CertIssues []string          `json:"cert_issues,omitempty"`
+	Result     probe.ProbeResult `json:"result"`
+}
+
+// NewProbe returns the report of a probe of target, host:port, that waited
+// up to timeout for answers
+func NewProbe(target string, result probe.ProbeResult, timeout time.Duration) Probe {
+	return Probe{Target: target, Listening: listening(result.State), Problem: problem(result, timeout), Result: result}
+}
+
+// listening reports whether a probe in state found something listening
+func listening(state probe.State) bool {
+	switch state {
+	case probe.StateOpenSilent, probe.StateOpenNonHTTP, probe.StateHTTP, probe.StateTLS:
+		return true
+	}
+	return false
+}
+
+// problem says why a probe got no answer, or none it could make sense
+// of, e.g. "connection refused: nothing is listening" or "connected, no
+// response within 2s"; it is empty when the service answered
+func problem(result probe.ProbeResult, timeout time.Duration) string {
+	switch {
+	case result.State == probe.StateClosed:
+		return "connection refused: nothing is listening"
+	case result.State == probe.StateFiltered && errors.Is(result.Err, probe.ErrTimeout):
+		return fmt.Sprintf("no answer to the connection within %v: filtered by a firewall, or the host is down", timeout)
+	case result.ClientCertRequired:
+		return "the TLS server requires a client certificate"
+	case result.State == probe.StateOpenSilent:
+		return fmt.Sprintf("connected, no response within %v", timeout)
+	case result.State == probe.StateOpenNonHTTP && result.Kind == probe.ServiceUnknown && result.Response == "" && errors.Is(result.Err, probe.ErrReset):
+		return "connected, but reset before any answer"
+	case result.Err != nil && !result.IsHTTP && result.Kind == probe.ServiceUnknown:
+		return result.Err.Error()
+	}
+	return ""
+}
+
+// History is the recorded probes of a service, oldest first, as the API
+// answers GET /api/services/{name}/history
+type History struct {
+	Name    string            `json:"name"`
+	Samples []registry.Sample `json:"samples"`
+}
@@ -0,0 +1,273 @@
+package output_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"localhost-magic/internal/config"
+	"localhost-magic/internal/discover"
+	"localhost-magic/internal/export"
+	"localhost-magic/internal/health"
+	"localhost-magic/internal/listing"
+	"localhost-magic/internal/output"
+	"localhost-magic/internal/procmap"
+	"localhost-magic/internal/proxy"
+	"localhost-magic/internal/registry"
+	"localhost-magic/internal/scan"
+	"localhost-magic/internal/share"
+	"localhost-magic/internal/storage"
+	"localhost-magic/probe"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+var (
+	seen    = time.Date(2026, 3, 14, 9, 26, 53, 0, time.UTC)
+	expires = seen.Add(30 * time.Minute)
+)
+
+// page is a finding for a dev server that answered
+func page() scan.Finding {
+	return scan.Finding{
+		State: scan.StateOpen,
+		ProbeResult: probe.ProbeResult{
+			Port: 5173, Address: "127.0.0.1", State: probe.StateHTTP, IsHTTP: true,
+			StatusCode: 200, StatusText: "OK", HTTPVersion: "HTTP/1.1", Protocol: probe.ProtocolHTTP1,
+			Kind: probe.ServiceHTTP, Title: "Shop", Framework: "vite", FrameworkConfidence: probe.ConfidenceHigh,
+			ConnectTime: 150 * time.Microsecond, TTFB: 12 * time.Millisecond, Duration: 20 * time.Millisecond, Attempts: 1,
+		},
+		Process: &procmap.Process{Port: 5173, PID: 4242, Exe: "/usr/bin/node", Cwd: "/home/dev/shop", Args: []string{"node", "vite"}},
+		Scope:   procmap.ScopeLoopback,
+		Tier:    scan.TierPriority,
+	}
+}
+
+var shop = share.Share{Name: "shop.localhost", Options: share.Options{Token: true, User: "demo", Password: "hunter2", Idle: 30 * time.Minute}, Created: seen, LastUsed: seen}
+
+// documents are a sample of each kind of document, by the golden file
+// that pins its shape
+var documents = []struct {
+	kind output.Kind
+	data any
+}{
+	{output.KindServices, []listing.Service{{
+		Name: "shop.localhost", Finding: page(), Health: health.StateHealthy,
+		Auxiliary: []listing.Service{{Finding: scan.Finding{State: scan.StateOpen, Parent: 5173, ProbeResult: probe.ProbeResult{Port: 24678, Address: "127.0.0.1", State: probe.StateOpenNonHTTP}}}},
+	}}},
+	{output.KindService, output.Service{
+		Service: listing.Service{Name: "shop.localhost", Finding: page(), Health: health.StateHealthy},
+		ID:      "a1b2c3", Active: true, Healthy: true, URL: "http://shop.localhost/", Protocol: "http/1",
+		Score:    &health.Score{State: health.StateHealthy, Since: seen, Checked: seen, Good: 3},
+		Rewrites: []string{"prefix /api/ /api/v1/"},
+	}},
+	{output.KindRegistered, []*storage.ServiceRecord{{
+		ID: "a1b2c3", Name: "shop.localhost", Port: 5173, PID: 4242, ExePath: "/usr/bin/node", Args: []string{"node", "vite"},
+		UserDefined: true, IsActive: true, LastSeen: seen,
+	}}},
+	{output.KindEvent, discover.Event{
+		Type: discover.ServiceChanged, ID: "a1b2c3", Name: "shop.localhost", Port: 5173, Time: seen,
+		Changes: []string{"status 502 -> 200"}, Finding: page(),
+		Health: &health.Score{State: health.StateHealthy, Since: seen, Checked: seen, Good: 3},
+	}},
+	{output.KindShare, output.ShareLink{Share: output.NewShare(shop), URL: "http://192.168.1.10:8443/s/tok3n"}},
+	{output.KindShares, output.NewShares([]share.Share{shop})},
+	{output.KindUnshare, output.Unshare{Name: "shop.localhost"}},
+	{output.KindPrune, output.NewPrune([]registry.Entry{{ID: "d4e5f6", Name: "old.localhost", Port: 3000, Address: "127.0.0.1", LastSeen: seen}}, 30*24*time.Hour, true)},
+	{output.KindExport, []export.Service{{Name: "shop.localhost", Address: "127.0.0.1", Port: 5173}, {Name: "api.localhost", Address: "127.0.0.2", Port: 8443, TLS: true}}},
+	{output.KindHosts, output.HostsUpdate{File: "/etc/hosts", Changed: true, Services: []export.Service{{Name: "shop.localhost", Address: "127.0.0.1", Port: 5173}}}},
+	{output.KindBench, probe.BenchResult{
+		URL: "http://127.0.0.1:5173/", Requests: 100, Errors: 1, Statuses: map[int]int{200: 99, 502: 1}, Connections: 4, KeepAlive: true,
+		Min: time.Millisecond, Mean: 2 * time.Millisecond, Max: 9 * time.Millisecond,
+		P50: 2 * time.Millisecond, P90: 4 * time.Millisecond, P99: 8 * time.Millisecond, Duration: time.Second,
+		Err: errors.New("502 Bad Gateway"),
+	}},
+	{output.KindSockets, []output.Socket{{Path: "/run/user/1000/app.sock", Status: "HTTP/1.1 200 OK", Probe: probe.ProbeResult{State: probe.StateHTTP, IsHTTP: true, StatusCode: 200, StatusText: "OK"}}}},
+	{output.KindCert, output.Cert{Name: "shop.localhost", URL: "https://shop.localhost:8443", Serial: "1f", NotAfter: seen.AddDate(1, 0, 0), CertPath: "/home/dev/.localhost-magic/certs/shop.localhost.pem", KeyPath: "/home/dev/.localhost-magic/certs/shop.localhost-key.pem"}},
+	{output.KindConfig, configCheck("testdata/typo.toml")},
+	{output.KindProbe, output.Probe{Target: "127.0.0.1:3000", Problem: "connection refused: nothing is listening", Result: probe.ProbeResult{Port: 3000, State: probe.StateClosed, Err: probe.ErrRefused}}},
+	{output.KindHistory, output.History{Name: "shop.localhost", Samples: []registry.Sample{
+		{Time: seen, Result: probe.ProbeResult{Port: 5173, State: probe.StateHTTP, IsHTTP: true, StatusCode: 200, Duration: 20 * time.Millisecond}},
+		{Time: expires, Result: probe.ProbeResult{Port: 5173}, Gone: true},
+	}}},
+	{output.KindListeners, []output.Listener{{Port: 9229, PID: 4243, ExePath: "/usr/bin/node", Scope: procmap.ScopeLoopback, State: probe.StateOpenSilent, Hint: "node inspector"}}},
+	{output.KindHidden, []int{9229}},
+	{output.KindAccess, []proxy.Access{{Time: seen, Client: "127.0.0.1:51000", Host: "shop.localhost", Method: "GET", Path: "/", Service: "shop.localhost", Port: 5173, Status: 200, Bytes: 512, Duration: 3 * time.Millisecond}}},
+	{output.KindBlacklist, output.Blacklist{Type: "pid", Value: "4242"}},
+}
+
+// configCheck is what config check reports of the config file at path,
+// with the errors the parser gives
+func configCheck(path string) output.ConfigCheck {
+	_, err := config.Load(path)
+	check := output.ConfigCheck{Path: path, Valid: err == nil}
+	if err != nil {
+		check.Error = err.Error()
+	}
+	return check
+}
+
+// golden compares got to testdata/name.golden, or rewrites it with -update
+func golden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v; run go test -update to create it", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s document differs from %s; if the change is meant, bump SchemaVersion when fields went or changed meaning and run go test -update:\n%s", name, path, got)
+	}
+}
+
+func TestDocumentsMatchGolden(t *testing.T) {
+	kinds := make(map[output.Kind]bool)
+	for _, d := range documents {
+		if kinds[d.kind] {
+			t.Fatalf("two samples of %s", d.kind)
+		}
+		kinds[d.kind] = true
+		t.Run(string(d.kind), func(t *testing.T) {
+			var b bytes.Buffer
+			if err := output.Write(&b, d.kind, d.data); err != nil {
+				t.Fatal(err)
+			}
+			golden(t, string(d.kind), b.Bytes())
+		})
+	}
+	files, err := filepath.Glob(filepath.Join("testdata", "*.golden"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(kinds) {
+		t.Errorf("%d golden files for %d kinds", len(files), len(kinds))
+	}
+}
+
+func TestRead(t *testing.T) {
+	for _, d := range documents {
+		t.Run(string(d.kind), func(t *testing.T) {
+			var b bytes.Buffer
+			output.Write(&b, d.kind, d.data)
+			var data any
+			if err := output.Read(&b, d.kind, &data); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	tests := []struct {
+		name string
+		doc  string
+		want string
+	}{
+		{"other kind", `{"schema_version": 1, "kind": "shares", "data": []}`, `got a "shares" document, expected share`},
+		{"newer schema", `{"schema_version": 2, "kind": "share", "data": {}}`, "share document has schema version 2, newer than 1: upgrade localhost-magic"},
+		{"not a document", `Service not found`, "failed to read share document"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var link output.ShareLink
+			err := output.Read(strings.NewReader(tt.doc), output.KindShare, &link)
+			if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+				t.Errorf("Read(%s): %v, want %q", tt.doc, err, tt.want)
+			}
+		})
+	}
+
+	var link output.ShareLink
+	doc := `{"schema_version": 1, "kind": "share", "data": {"share": {"name": "shop.localhost"}, "url": "http://192.168.1.10:8443/s/tok3n"}}`
+	if err := output.Read(strings.NewReader(doc), output.KindShare, &link); err != nil || link.Share.Name != "shop.localhost" || link.URL != "http://192.168.1.10:8443/s/tok3n" {
+		t.Errorf("Read: %+v, %v", link, err)
+	}
+}
+
+func TestNewProbe(t *testing.T) {
+	tests := []struct {
+		result    probe.ProbeResult
+		listening bool
+		problem   string
+	}{
+		{probe.ProbeResult{State: probe.StateHTTP, IsHTTP: true, StatusCode: 200}, true, ""},
+		{probe.ProbeResult{State: probe.StateClosed, Err: probe.ErrRefused}, false, "connection refused: nothing is listening"},
+		{probe.ProbeResult{State: probe.StateFiltered, Err: probe.ErrTimeout}, false, "no answer to the connection within 2s: filtered by a firewall, or the host is down"},
+		{probe.ProbeResult{State: probe.StateOpenSilent}, true, "connected, no response within 2s"},
+		{probe.ProbeResult{State: probe.StateTLS, ClientCertRequired: true}, true, "the TLS server requires a client certificate"},
+	}
+	for _, tt := range tests {
+		p := output.NewProbe("127.0.0.1:3000", tt.result, 2*time.Second)
+		if p.Target != "127.0.0.1:3000" || p.Listening != tt.listening || p.Problem != tt.problem {
+			t.Errorf("NewProbe(%s): %+v, want listening %v and problem %q", tt.result.State, p, tt.listening, tt.problem)
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	var b bytes.Buffer
+	s := output.NewStream(&b)
+	for _, name := range []string{"shop.localhost", "api.localhost"} {
+		if err := s.Write(output.KindUnshare, output.Unshare{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lines := bytes.Split(bytes.TrimSuffix(b.Bytes(), []byte("\n")), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("wrote %q, want two lines", b.String())
+	}
+	for _, line := range lines {
+		var doc struct {
+			SchemaVersion int             `json:"schema_version"`
+			Kind          output.Kind     `json:"kind"`
+			Data          json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal(line, &doc); err != nil || doc.SchemaVersion != output.SchemaVersion || doc.Kind != output.KindUnshare {
+			t.Errorf("line %s: %+v, %v", line, doc, err)
+		}
+	}
+}
+
+func TestSharesNeverNull(t *testing.T) {
+	var b bytes.Buffer
+	output.Write(&b, output.KindShares, output.NewShares(nil))
+	if !bytes.Contains(b.Bytes(), []byte(`"data": []`)) {
+		t.Errorf("no shares written as %s, want an empty list", b.Bytes())
+	}
+}
+
+func TestShareHidesPassword(t *testing.T) {
+	data, err := json.Marshal(output.NewShare(shop))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("hunter2")) {
+		t.Errorf("share encoded with its password: %s", data)
+	}
+	never := shop
+	never.Options.Idle = -1
+	if s := output.NewShare(never); s.Idle != "never" || s.Expires != nil {
+		t.Errorf("share kept forever: %+v, want Idle never and no expiry", s)
+	}
+}
+
+func TestValidateFormat(t *testing.T) {
+	for _, f := range output.Formats {
+		if err := output.ValidateFormat(f); err != nil {
+			t.Errorf("ValidateFormat(%q): %v", f, err)
+		}
+	}
+	if err := output.ValidateFormat("yaml"); err == nil {
+		t.Error("ValidateFormat accepted yaml")
+	}
+}
@@ -0,0 +1,32 @@
+package portscan
+
+import (
+	"localhost-magic/internal/procmap"
+)
+
+// Scan discovers all listening TCP sockets and their owning processes.
+// Ports whose owner can't be identified are left out, since services are
+// named after their executable.
+func Scan() ([]Listener, error) {
+	procs, err := procmap.All()
+	if err != nil {
+		return nil, err
+	}
+
+	var listeners []Listener
+	for _, p := range procs {
+		if p.PID == 0 || p.Exe == "" {
+			continue
+		}
+		listeners = append(listeners, Listener{
+			Port:    p.Port,
+			PID:     p.PID,
+			ExePath: p.Exe,
+			Cwd:     p.Cwd,
+			Args:    p.Args,
+			Addrs:   p.Addrs,
+			Scope:   p.Scope,
+		})
+	}
+	return listeners, nil
+}
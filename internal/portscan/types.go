@@ -1,6 +1,8 @@
 // Package portscan discovers listening TCP sockets and their owning processes
 package portscan
 
+import "localhost-magic/internal/procmap"
+
 // Listener represents a process listening on a port
 type Listener struct {
 	Port    int
@@ -8,4 +10,6 @@ type Listener struct {
 	ExePath string
 	Cwd     string // Current working directory
 	Args    []string
+	Addrs   []string      // Addresses the port is bound to, e.g. "0.0.0.0"
+	Scope   procmap.Scope // Who can reach the port, from its bind addresses
 }
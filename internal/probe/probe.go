@@ -0,0 +1,43 @@
+// Package probe is the former location of localhost-magic/probe.
+//
+// Deprecated: import localhost-magic/probe instead. This package only
+// forwards to it and will be removed in a future release.
+package probe
+
+import (
+	"context"
+
+	"localhost-magic/probe"
+)
+
+// ProbeResult is an alias for probe.ProbeResult
+type ProbeResult = probe.ProbeResult
+
+// ProbeOptions is an alias for probe.ProbeOptions
+type ProbeOptions = probe.ProbeOptions
+
+// IsHTTP checks if the service on the given host:port speaks HTTP
+func IsHTTP(host string, port int) bool {
+	return probe.IsHTTP(host, port)
+}
+
+// IsHTTPContext is like IsHTTP but aborts the probe when ctx is cancelled
+func IsHTTPContext(ctx context.Context, host string, port int) bool {
+	return probe.IsHTTPContext(ctx, host, port)
+}
+
+// Probe performs a detailed HTTP probe and returns the response status line
+func Probe(host string, port int) ProbeResult {
+	return probe.Probe(host, port)
+}
+
+// ProbeContext performs a detailed HTTP probe that is aborted when ctx is
+// cancelled
+func ProbeContext(ctx context.Context, host string, port int) ProbeResult {
+	return probe.ProbeContext(ctx, host, port)
+}
+
+// ProbeWithOptions performs a detailed HTTP probe using the given options
+func ProbeWithOptions(host string, port int, opts ProbeOptions) ProbeResult {
+	return probe.ProbeWithOptions(host, port, opts)
+}
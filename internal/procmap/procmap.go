@@ -0,0 +1,121 @@
+// Package procmap finds the process that owns a listening TCP port, or a
+// bound UDP one: its PID, executable, command line and working directory.
+// The owner is what a service gets named after, so "node in
+// ~/projects/storefront" rather than "port 3000".
+package procmap
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ErrNotFound is returned by Lookup when no listening socket on the port
+// could be found
+var ErrNotFound = errors.New("no listener found on port")
+
+// Process is what could be learned about the owner of a listening port.
+// Ports held by processes we can't inspect, such as another user's or one
+// inside a container, come back with Partial set and only the fields the
+// OS was willing to reveal.
+type Process struct {
+	Port    int      `json:"port"`
+	PID     int      `json:"pid,omitempty"`
+	Name    string   `json:"name,omitempty"` // Executable name, e.g. "node"
+	Exe     string   `json:"exe,omitempty"`  // Absolute path of the executable
+	Args    []string `json:"args,omitempty"` // Full command line, Args[0] included
+	Cwd     string   `json:"cwd,omitempty"`
+	UID     int      `json:"uid"` // -1 if unknown
+	User    string   `json:"user,omitempty"`
+	Partial bool     `json:"partial,omitempty"` // Some fields couldn't be read
+	// Addrs are the addresses the port's listening sockets are bound to,
+	// e.g. "127.0.0.1" and "::1", and Scope what they add up to
+	Addrs []string `json:"addrs,omitempty"`
+	Scope Scope    `json:"scope,omitempty"`
+}
+
+// Command returns the command line as a single string
+func (p Process) Command() string {
+	return strings.Join(p.Args, " ")
+}
+
+// String returns a short description such as "node pid 4242"
+func (p Process) String() string {
+	name := p.Name
+	if name == "" {
+		name = "unknown process"
+	}
+	if p.PID == 0 {
+		if p.User != "" {
+			return fmt.Sprintf("%s of user %s", name, p.User)
+		}
+		return name
+	}
+	return fmt.Sprintf("%s pid %d", name, p.PID)
+}
+
+// Lookup returns the owner of the TCP listener on port. Missing details
+// are reported through Process.Partial, not as an error; an error means
+// the socket table couldn't be read or, with ErrNotFound, holds nothing
+// for the port.
+func Lookup(port int) (Process, error) {
+	procs, err := listen(tcp, port)
+	if err != nil {
+		return Process{}, err
+	}
+	if len(procs) == 0 {
+		return Process{}, fmt.Errorf("%w %d", ErrNotFound, port)
+	}
+	return procs[0], nil
+}
+
+// All returns the owners of every listening TCP port, one per port and
+// owning process, sorted by port. A port comes back more than once when
+// several processes listen on it on different addresses, e.g. 127.0.0.1
+// and 127.0.0.2.
+func All() ([]Process, error) {
+	return listen(tcp, 0)
+}
+
+// AllUDP is All for UDP. A UDP socket has no listening state, so those
+// bound to a port and not connected to a peer count as listening.
+func AllUDP() ([]Process, error) {
+	return listen(udp, 0)
+}
+
+// network is the transport of the sockets listen reads
+type network string
+
+const (
+	tcp network = "tcp"
+	udp network = "udp"
+)
+
+// listenerKey identifies a listener: one process's sockets on a port
+type listenerKey struct{ port, pid int }
+
+// sortProcesses sorts by port, then by PID
+func sortProcesses(procs []Process) {
+	sort.Slice(procs, func(i, j int) bool {
+		if procs[i].Port != procs[j].Port {
+			return procs[i].Port < procs[j].Port
+		}
+		return procs[i].PID < procs[j].PID
+	})
+}
+
+// complete fills in the name from the executable or command line, and sets
+// Partial if anything is still missing
+func (p *Process) complete() {
+	if p.Name == "" {
+		switch {
+		case p.Exe != "":
+			p.Name = filepath.Base(p.Exe)
+		case len(p.Args) > 0:
+			p.Name = filepath.Base(p.Args[0])
+		}
+	}
+	p.Partial = p.PID == 0 || p.Exe == "" || len(p.Args) == 0 || p.Cwd == ""
+}
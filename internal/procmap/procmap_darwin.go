@@ -0,0 +1,171 @@
+//go:build darwin
+
+package procmap
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// listen asks lsof for listening sockets, or for UDP the unconnected
+// ones, restricted to port unless it is 0. Without root, lsof only sees
+// the current user's processes, so ports held by others are absent rather
+// than partial; the daemon normally runs as root.
+func listen(n network, port int) ([]Process, error) {
+	args := []string{"-nP", "-i" + strings.ToUpper(string(n))}
+	if port != 0 {
+		args[1] += fmt.Sprintf(":%d", port)
+	}
+	if n == tcp {
+		args = append(args, "-sTCP:LISTEN")
+	}
+	// Output is one field per line: p<pid>, c<command>, u<uid>, then
+	// f<fd>, t<type> and n<address> per socket
+	output, err := exec.Command("lsof", append(args, "-F", "pcutn")...).Output()
+	if err != nil {
+		// lsof exits 1 with no output when nothing matches
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || len(output) > 0 {
+			return nil, fmt.Errorf("lsof failed: %w", err)
+		}
+	}
+
+	// One process per port and owner, as on Linux
+	byKey := make(map[listenerKey]*Process)
+	var current Process
+	var family string // "IPv4" or "IPv6", of the current socket
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) < 2 {
+			continue
+		}
+		value := line[1:]
+		switch line[0] {
+		case 'p':
+			pid, _ := strconv.Atoi(value)
+			current = Process{PID: pid, UID: -1}
+		case 'c':
+			current.Name = value
+		case 'u':
+			if uid, err := strconv.Atoi(value); err == nil {
+				current.UID = uid
+			}
+		case 't':
+			family = value
+		case 'n':
+			// "127.0.0.1:3000", "*:3000" or "[::1]:3000", followed by
+			// "->" and the peer for a connected UDP socket
+			if strings.Contains(value, "->") {
+				continue
+			}
+			i := strings.LastIndex(value, ":")
+			p, err := strconv.Atoi(value[i+1:])
+			if i < 0 || err != nil {
+				continue
+			}
+			k := listenerKey{p, current.PID}
+			proc, ok := byKey[k]
+			if !ok {
+				proc = new(Process)
+				*proc = current
+				proc.Port = p
+				byKey[k] = proc
+			}
+			proc.Addrs = append(proc.Addrs, bindAddr(value[:i], family))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to parse lsof output: %w", err)
+	}
+
+	details := make(map[int]Process) // key = PID, shared by its ports
+	users := make(map[int]string)
+	v6only := bindV6Only()
+	procs := make([]Process, 0, len(byKey))
+	for _, p := range byKey {
+		p.Scope = scopeOf(p.Addrs, v6only)
+		d, ok := details[p.PID]
+		if !ok {
+			d = readProcess(p.PID)
+			details[p.PID] = d
+		}
+		p.Exe, p.Cwd, p.Args = d.Exe, d.Cwd, d.Args
+		if p.UID >= 0 {
+			name, ok := users[p.UID]
+			if !ok {
+				if u, err := user.LookupId(strconv.Itoa(p.UID)); err == nil {
+					name = u.Username
+				}
+				users[p.UID] = name
+			}
+			p.User = name
+		}
+		p.complete()
+		procs = append(procs, *p)
+	}
+	sortProcesses(procs)
+	return procs, nil
+}
+
+// bindAddr turns lsof's host part into an address: brackets are dropped
+// and the wildcard "*" becomes 0.0.0.0 or :: depending on the family
+func bindAddr(host, family string) string {
+	switch {
+	case host == "*" && family == "IPv6":
+		return "::"
+	case host == "*":
+		return "0.0.0.0"
+	}
+	return strings.Trim(host, "[]")
+}
+
+// bindV6Only reports whether sockets bound to :: exclude IPv4 unless they
+// ask otherwise; the default is that they don't
+func bindV6Only() bool {
+	output, err := exec.Command("sysctl", "-n", "net.inet6.ip6.v6only").Output()
+	return err == nil && strings.TrimSpace(string(output)) == "1"
+}
+
+// readProcess gets the executable and working directory from lsof and the
+// command line from ps. Failures leave the fields empty.
+func readProcess(pid int) Process {
+	var p Process
+	pidStr := strconv.Itoa(pid)
+
+	// The executable is the first "txt" file; later ones are libraries
+	if output, err := exec.Command("lsof", "-a", "-p", pidStr, "-d", "cwd,txt", "-F", "fn").Output(); err == nil {
+		var fd string
+		scanner := bufio.NewScanner(bytes.NewReader(output))
+		for scanner.Scan() {
+			line := scanner.Text()
+			if len(line) < 2 {
+				continue
+			}
+			switch line[0] {
+			case 'f':
+				fd = line[1:]
+			case 'n':
+				switch {
+				case fd == "cwd":
+					p.Cwd = line[1:]
+				case fd == "txt" && p.Exe == "":
+					p.Exe = line[1:]
+				}
+			}
+		}
+	}
+
+	// ps joins the arguments with spaces, so ones containing spaces are
+	// split apart; good enough for naming
+	if output, err := exec.Command("ps", "-p", pidStr, "-o", "args=").Output(); err == nil {
+		p.Args = strings.Fields(string(output))
+	}
+	return p
+}
@@ -0,0 +1,240 @@
+//go:build linux
+
+package procmap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// socket is a listening socket from /proc/net/tcp* or /proc/net/udp*
+type socket struct {
+	addr  string // Bind address, e.g. "127.0.0.1" or "::"
+	port  int
+	uid   int
+	inode uint64
+}
+
+// listen reads the listening sockets, restricted to port unless it is 0,
+// and resolves their owners through /proc/<pid>/fd. A socket whose owner
+// isn't found (a process of another user, or one in another PID
+// namespace) still yields a Process carrying the socket's UID.
+func listen(n network, port int) ([]Process, error) {
+	path := "/proc/net/" + string(n)
+	sockets, err := readSockets(path, listenState[n], port)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if v6, err := readSockets(path+"6", listenState[n], port); err == nil {
+		sockets = append(sockets, v6...)
+	}
+	if len(sockets) == 0 {
+		return nil, nil
+	}
+
+	wanted := make(map[uint64]bool, len(sockets))
+	for _, s := range sockets {
+		if s.inode != 0 {
+			wanted[s.inode] = true
+		}
+	}
+	owners := socketOwners(wanted)
+
+	// One process per port and owner, so two processes bound to different
+	// addresses on the same port are told apart. Sockets whose owner isn't
+	// known join the first process on their port, IPv4 before IPv6.
+	byKey := make(map[listenerKey]*Process)
+	first := make(map[int]*Process) // key = port
+	for _, s := range sockets {
+		pid := owners[s.inode]
+		if pid == 0 {
+			continue
+		}
+		k := listenerKey{s.port, pid}
+		p, ok := byKey[k]
+		if !ok {
+			p = &Process{Port: s.port, PID: pid, UID: s.uid}
+			byKey[k] = p
+		}
+		if first[s.port] == nil {
+			first[s.port] = p
+		}
+		p.Addrs = append(p.Addrs, s.addr)
+	}
+	for _, s := range sockets {
+		if owners[s.inode] != 0 {
+			continue
+		}
+		p := first[s.port]
+		if p == nil {
+			p = &Process{Port: s.port, UID: s.uid}
+			byKey[listenerKey{s.port, 0}] = p
+			first[s.port] = p
+		}
+		p.Addrs = append(p.Addrs, s.addr)
+	}
+	v6only := bindV6Only()
+
+	users := make(map[int]string)
+	procs := make([]Process, 0, len(byKey))
+	for _, p := range byKey {
+		p.Scope = scopeOf(p.Addrs, v6only)
+		if p.PID != 0 {
+			readProcess(p)
+		}
+		if p.UID >= 0 {
+			name, ok := users[p.UID]
+			if !ok {
+				if u, err := user.LookupId(strconv.Itoa(p.UID)); err == nil {
+					name = u.Username
+				}
+				users[p.UID] = name
+			}
+			p.User = name
+		}
+		p.complete()
+		procs = append(procs, *p)
+	}
+	sortProcesses(procs)
+	return procs, nil
+}
+
+// listenState is the socket state of a listener in /proc/net/*: LISTEN
+// for TCP, and for UDP CLOSE, which is what a socket not connected to a
+// peer is in
+var listenState = map[network]string{tcp: "0A", udp: "07"}
+
+// readSockets parses /proc/net/tcp*, or udp*, for sockets in state
+func readSockets(path, state string, port int) ([]socket, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var sockets []socket
+	scanner := bufio.NewScanner(file)
+	scanner.Scan() // Header line
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[3] != state {
+			continue
+		}
+
+		// Local address: "0100007F:0050" = 127.0.0.1:80
+		addrHex, portHex, ok := strings.Cut(fields[1], ":")
+		if !ok {
+			continue
+		}
+		p, err := strconv.ParseUint(portHex, 16, 16)
+		if err != nil || (port != 0 && int(p) != port) {
+			continue
+		}
+		uid, err := strconv.Atoi(fields[7])
+		if err != nil {
+			uid = -1
+		}
+		inode, _ := strconv.ParseUint(fields[9], 10, 64)
+		sockets = append(sockets, socket{addr: parseAddr(addrHex), port: int(p), uid: uid, inode: inode})
+	}
+	return sockets, scanner.Err()
+}
+
+// parseAddr decodes an address from /proc/net/tcp*: the IP as 32-bit
+// words in host byte order, one word for IPv4 and four for IPv6. It
+// returns "" for anything malformed.
+func parseAddr(s string) string {
+	raw, err := hex.DecodeString(s)
+	if err != nil || (len(raw) != net.IPv4len && len(raw) != net.IPv6len) {
+		return ""
+	}
+	ip := make(net.IP, len(raw))
+	for i := 0; i < len(raw); i += 4 {
+		binary.NativeEndian.PutUint32(ip[i:], binary.BigEndian.Uint32(raw[i:]))
+	}
+	return ip.String()
+}
+
+// bindV6Only reports whether sockets bound to :: exclude IPv4 unless they
+// ask otherwise; the kernel default is that they don't
+func bindV6Only() bool {
+	data, err := os.ReadFile("/proc/sys/net/ipv6/bindv6only")
+	return err == nil && strings.TrimSpace(string(data)) == "1"
+}
+
+// socketOwners scans /proc/<pid>/fd for the socket inodes in wanted and
+// returns inode -> PID. Processes whose fd directory can't be read are
+// skipped, so their sockets stay unowned.
+func socketOwners(wanted map[uint64]bool) map[uint64]int {
+	owners := make(map[uint64]int, len(wanted))
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return owners
+	}
+
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue // Not a PID directory
+		}
+		fdDir := filepath.Join("/proc", entry.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue // Permission denied or exited
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil {
+				continue
+			}
+			// Sockets link to "socket:[12345]"
+			rest, ok := strings.CutPrefix(link, "socket:[")
+			if !ok {
+				continue
+			}
+			inode, err := strconv.ParseUint(strings.TrimSuffix(rest, "]"), 10, 64)
+			if err != nil || !wanted[inode] {
+				continue
+			}
+			if _, seen := owners[inode]; !seen {
+				owners[inode] = pid
+			}
+		}
+	}
+	return owners
+}
+
+// readProcess fills in what /proc/<pid> reveals. exe and cwd need the same
+// user (or root); cmdline and comm are readable by anyone, which is what
+// makes partial results possible.
+func readProcess(p *Process) {
+	dir := filepath.Join("/proc", strconv.Itoa(p.PID))
+
+	if exe, err := os.Readlink(filepath.Join(dir, "exe")); err == nil {
+		p.Exe = strings.TrimSuffix(exe, " (deleted)")
+	}
+	if cwd, err := os.Readlink(filepath.Join(dir, "cwd")); err == nil {
+		p.Cwd = cwd
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "cmdline")); err == nil {
+		args := strings.Split(string(data), "\x00")
+		// Remove the empty element after the final NUL
+		if len(args) > 0 && args[len(args)-1] == "" {
+			args = args[:len(args)-1]
+		}
+		p.Args = args
+	}
+	if p.Exe == "" {
+		if comm, err := os.ReadFile(filepath.Join(dir, "comm")); err == nil {
+			p.Name = strings.TrimSpace(string(comm))
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package procmap
+
+import (
+	"net"
+	"os"
+	"testing"
+)
+
+// ownListener checks that p is this test process, bound to 127.0.0.1
+func ownListener(t *testing.T, p Process, port int) {
+	t.Helper()
+	if p.Port != port || p.PID != os.Getpid() {
+		t.Fatalf("got port %d pid %d, want port %d pid %d", p.Port, p.PID, port, os.Getpid())
+	}
+	if exe, _ := os.Executable(); p.Exe != exe {
+		t.Errorf("Exe = %q, want %q", p.Exe, exe)
+	}
+	if len(p.Args) == 0 || p.Args[0] != os.Args[0] {
+		t.Errorf("Args = %q, want them to start with %q", p.Args, os.Args[0])
+	}
+	if wd, _ := os.Getwd(); p.Cwd != wd {
+		t.Errorf("Cwd = %q, want %q", p.Cwd, wd)
+	}
+	if p.UID != os.Getuid() || p.User == "" {
+		t.Errorf("UID = %d, User = %q, want uid %d and its name", p.UID, p.User, os.Getuid())
+	}
+	if len(p.Addrs) != 1 || p.Addrs[0] != "127.0.0.1" || p.Scope != ScopeLoopback {
+		t.Errorf("Addrs = %q, Scope = %q, want 127.0.0.1 and loopback", p.Addrs, p.Scope)
+	}
+}
+
+func TestLookupOwnListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	p, err := Lookup(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ownListener(t, p, port)
+}
+
+func TestAllUDPOwnSocket(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+
+	procs, err := AllUDP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range procs {
+		if p.Port == port {
+			ownListener(t, p, port)
+			return
+		}
+	}
+	t.Fatalf("no owner of UDP port %d among %d", port, len(procs))
+}
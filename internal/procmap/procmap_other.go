@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !windows
+
+package procmap
+
+import (
+	"errors"
+	"fmt"
+)
+
+// listen is not implemented on this platform
+func listen(n network, port int) ([]Process, error) {
+	return nil, fmt.Errorf("failed to list listening sockets: %w", errors.ErrUnsupported)
+}
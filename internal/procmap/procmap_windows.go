@@ -0,0 +1,340 @@
+//go:build windows
+
+package procmap
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// x/sys/windows has no binding for the socket tables with their owners
+var (
+	iphlpapi = windows.NewLazySystemDLL("iphlpapi.dll")
+
+	procGetExtendedTcpTable = iphlpapi.NewProc("GetExtendedTcpTable")
+	procGetExtendedUdpTable = iphlpapi.NewProc("GetExtendedUdpTable")
+)
+
+// Table classes, TCP_TABLE_CLASS and UDP_TABLE_CLASS
+const (
+	tcpTableOwnerPIDListener = 3 // TCP_TABLE_OWNER_PID_LISTENER
+	udpTableOwnerPID         = 1 // UDP_TABLE_OWNER_PID
+)
+
+// Rows of the socket tables. Addresses and ports are in network byte
+// order, a port in the first two bytes of its field; the rest aren't.
+
+// tcpRow is MIB_TCPROW_OWNER_PID
+type tcpRow struct {
+	State      uint32
+	LocalAddr  [4]byte
+	LocalPort  [4]byte
+	RemoteAddr [4]byte
+	RemotePort [4]byte
+	OwningPID  uint32
+}
+
+// tcp6Row is MIB_TCP6ROW_OWNER_PID
+type tcp6Row struct {
+	LocalAddr     [16]byte
+	LocalScopeID  uint32
+	LocalPort     [4]byte
+	RemoteAddr    [16]byte
+	RemoteScopeID uint32
+	RemotePort    [4]byte
+	State         uint32
+	OwningPID     uint32
+}
+
+// udpRow is MIB_UDPROW_OWNER_PID
+type udpRow struct {
+	LocalAddr [4]byte
+	LocalPort [4]byte
+	OwningPID uint32
+}
+
+// udp6Row is MIB_UDP6ROW_OWNER_PID
+type udp6Row struct {
+	LocalAddr    [16]byte
+	LocalScopeID uint32
+	LocalPort    [4]byte
+	OwningPID    uint32
+}
+
+// socket is a listening socket from the TCP or UDP tables
+type socket struct {
+	addr string // Bind address, e.g. "127.0.0.1" or "::"
+	port int
+	pid  int
+}
+
+// listen reads the listening sockets with their owning PIDs from the TCP
+// tables, or the bound ones from the UDP tables, restricted to port
+// unless it is 0. The owners of system processes and of other users'
+// can't be opened without elevation, and come back with their PID only.
+func listen(n network, port int) ([]Process, error) {
+	sockets, err := readSockets(n, windows.AF_INET, port)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the %s table: %w", strings.ToUpper(string(n)), err)
+	}
+	if v6, err := readSockets(n, windows.AF_INET6, port); err == nil {
+		sockets = append(sockets, v6...)
+	}
+
+	// One process per port and owner, as on Linux
+	byKey := make(map[listenerKey]*Process)
+	for _, s := range sockets {
+		k := listenerKey{s.port, s.pid}
+		p, ok := byKey[k]
+		if !ok {
+			p = &Process{Port: s.port, PID: s.pid, UID: -1}
+			byKey[k] = p
+		}
+		p.Addrs = append(p.Addrs, s.addr)
+	}
+
+	details := make(map[int]Process) // key = PID, shared by its ports
+	v6only := bindV6Only()
+	procs := make([]Process, 0, len(byKey))
+	for _, p := range byKey {
+		p.Scope = scopeOf(p.Addrs, v6only)
+		d, ok := details[p.PID]
+		if !ok {
+			d = readProcess(p.PID)
+			details[p.PID] = d
+		}
+		p.Exe, p.Args, p.Cwd, p.User = d.Exe, d.Args, d.Cwd, d.User
+		p.complete()
+		procs = append(procs, *p)
+	}
+	sortProcesses(procs)
+	return procs, nil
+}
+
+// readSockets returns the sockets of one transport and address family.
+// The UDP tables hold every bound socket, connected or not: they don't
+// have the peer to tell.
+func readSockets(n network, family int, port int) ([]socket, error) {
+	var sockets []socket
+	add := func(addr []byte, p [4]byte, pid uint32) {
+		s := socket{addr: net.IP(addr).String(), port: int(p[0])<<8 | int(p[1]), pid: int(pid)}
+		if port == 0 || s.port == port {
+			sockets = append(sockets, s)
+		}
+	}
+	switch {
+	case n == tcp && family == windows.AF_INET:
+		rows, err := extendedTable[tcpRow](procGetExtendedTcpTable, family, tcpTableOwnerPIDListener)
+		for _, r := range rows {
+			add(r.LocalAddr[:], r.LocalPort, r.OwningPID)
+		}
+		return sockets, err
+	case n == tcp:
+		rows, err := extendedTable[tcp6Row](procGetExtendedTcpTable, family, tcpTableOwnerPIDListener)
+		for _, r := range rows {
+			add(r.LocalAddr[:], r.LocalPort, r.OwningPID)
+		}
+		return sockets, err
+	case family == windows.AF_INET:
+		rows, err := extendedTable[udpRow](procGetExtendedUdpTable, family, udpTableOwnerPID)
+		for _, r := range rows {
+			add(r.LocalAddr[:], r.LocalPort, r.OwningPID)
+		}
+		return sockets, err
+	default:
+		rows, err := extendedTable[udp6Row](procGetExtendedUdpTable, family, udpTableOwnerPID)
+		for _, r := range rows {
+			add(r.LocalAddr[:], r.LocalPort, r.OwningPID)
+		}
+		return sockets, err
+	}
+}
+
+// extendedTable calls GetExtendedTcpTable or GetExtendedUdpTable, which
+// share their signature, growing the buffer until the table fits, and
+// returns its rows: a count, then that many Rows
+func extendedTable[Row any](proc *windows.LazyProc, family int, class uint32) ([]Row, error) {
+	size := uint32(16 << 10)
+	for attempt := 0; attempt < 4; attempt++ {
+		// uint32s, for the alignment of the rows
+		buf := make([]uint32, (size+3)/4)
+		r, _, _ := proc.Call(
+			uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)),
+			0, uintptr(family), uintptr(class), 0)
+		switch windows.Errno(r) {
+		case 0:
+			count := uintptr(buf[0])
+			rows := unsafe.Slice((*Row)(unsafe.Pointer(&buf[1])), count)
+			if 4+count*unsafe.Sizeof(*new(Row)) > uintptr(size) {
+				return nil, fmt.Errorf("table of %d rows overflows its %d bytes", count, size)
+			}
+			return append([]Row(nil), rows...), nil
+		case windows.ERROR_INSUFFICIENT_BUFFER:
+			continue // size now holds what the table needs
+		default:
+			return nil, windows.Errno(r)
+		}
+	}
+	return nil, windows.ERROR_INSUFFICIENT_BUFFER
+}
+
+// bindV6Only reports whether sockets bound to :: exclude IPv4 unless they
+// ask otherwise, read off a new socket; Winsock's default is that they
+// do. Go, Node.js and Python's asyncio open :: listeners as dual-stack
+// all the same, and as the socket tables don't say, those come out as
+// IPv6-only too.
+func bindV6Only() bool {
+	fd, err := windows.Socket(windows.AF_INET6, windows.SOCK_STREAM, windows.IPPROTO_TCP)
+	if err != nil {
+		return true
+	}
+	defer windows.Closesocket(fd)
+	v6only, err := windows.GetsockoptInt(fd, windows.IPPROTO_IPV6, windows.IPV6_V6ONLY)
+	return err != nil || v6only != 0
+}
+
+// readProcess gets the executable, command line and user of a process,
+// and its working directory when the process memory can be read.
+// Failures, such as access denied for system processes, leave the fields
+// empty.
+func readProcess(pid int) Process {
+	var p Process
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return p
+	}
+	defer windows.CloseHandle(h)
+
+	p.Exe = imageName(h)
+	p.Args = commandLine(h)
+	p.User = processUser(h)
+	// Reading the working directory takes more access than the rest
+	if hv, err := windows.OpenProcess(windows.PROCESS_QUERY_INFORMATION|windows.PROCESS_VM_READ, false, uint32(pid)); err == nil {
+		p.Cwd = workingDir(hv)
+		windows.CloseHandle(hv)
+	}
+	return p
+}
+
+// imageName returns the full path of the process's executable
+func imageName(h windows.Handle) string {
+	buf := make([]uint16, windows.MAX_LONG_PATH)
+	size := uint32(len(buf))
+	if err := windows.QueryFullProcessImageName(h, 0, &buf[0], &size); err != nil {
+		return ""
+	}
+	return windows.UTF16ToString(buf[:size])
+}
+
+// commandLine returns the process's command line split into arguments the
+// way the C runtime does. ProcessCommandLineInformation needs Windows 8.1
+// or later.
+func commandLine(h windows.Handle) []string {
+	buf := make([]byte, 4096)
+	for {
+		var needed uint32
+		err := windows.NtQueryInformationProcess(h, windows.ProcessCommandLineInformation,
+			unsafe.Pointer(&buf[0]), uint32(len(buf)), &needed)
+		if err == windows.STATUS_INFO_LENGTH_MISMATCH && int(needed) > len(buf) {
+			buf = make([]byte, needed)
+			continue
+		}
+		if err != nil {
+			return nil
+		}
+		break
+	}
+	// The string's buffer follows the NTUnicodeString in buf
+	us := (*windows.NTUnicodeString)(unsafe.Pointer(&buf[0]))
+	start := uintptr(unsafe.Pointer(us.Buffer)) - uintptr(unsafe.Pointer(&buf[0]))
+	if us.Length == 0 || start > uintptr(len(buf)) || start+uintptr(us.Length) > uintptr(len(buf)) {
+		return nil
+	}
+	line := append(unsafe.Slice(us.Buffer, us.Length/2), 0)
+	return splitCommandLine(line)
+}
+
+// splitCommandLine splits a NUL-terminated command line into arguments
+func splitCommandLine(line []uint16) []string {
+	var argc int32
+	argv, err := windows.CommandLineToArgv(&line[0], &argc)
+	if err != nil {
+		return nil
+	}
+	defer windows.LocalFree(windows.Handle(unsafe.Pointer(argv)))
+	args := make([]string, argc)
+	for i := range args {
+		args[i] = windows.UTF16ToString((*argv[i])[:])
+	}
+	return args
+}
+
+// processUser returns the account the process runs as, "DOMAIN\user"
+func processUser(h windows.Handle) string {
+	var token windows.Token
+	if err := windows.OpenProcessToken(h, windows.TOKEN_QUERY, &token); err != nil {
+		return ""
+	}
+	defer token.Close()
+	tu, err := token.GetTokenUser()
+	if err != nil {
+		return ""
+	}
+	account, domain, _, err := tu.User.Sid.LookupAccount("")
+	if err != nil {
+		return ""
+	}
+	if domain == "" {
+		return account
+	}
+	return domain + `\` + account
+}
+
+// workingDir reads the process's current directory out of its process
+// parameters. The PEB and the parameters are in the process's own memory,
+// so their pointers are only addresses to read there. For a 32-bit
+// process on 64-bit Windows it is the directory the process started in.
+func workingDir(h windows.Handle) string {
+	var info windows.PROCESS_BASIC_INFORMATION
+	err := windows.NtQueryInformationProcess(h, windows.ProcessBasicInformation,
+		unsafe.Pointer(&info), uint32(unsafe.Sizeof(info)), nil)
+	if err != nil || info.PebBaseAddress == nil {
+		return ""
+	}
+	// Only as far as the fields needed, which every version has
+	var peb windows.PEB
+	pebSize := unsafe.Offsetof(peb.ProcessParameters) + unsafe.Sizeof(peb.ProcessParameters)
+	if !readMemory(h, uintptr(unsafe.Pointer(info.PebBaseAddress)), unsafe.Pointer(&peb), pebSize) || peb.ProcessParameters == nil {
+		return ""
+	}
+	var params windows.RTL_USER_PROCESS_PARAMETERS
+	paramsSize := unsafe.Offsetof(params.CurrentDirectory) + unsafe.Sizeof(params.CurrentDirectory)
+	if !readMemory(h, uintptr(unsafe.Pointer(peb.ProcessParameters)), unsafe.Pointer(&params), paramsSize) {
+		return ""
+	}
+	path := params.CurrentDirectory.DosPath
+	if path.Length == 0 || path.Buffer == nil {
+		return ""
+	}
+	dir := make([]uint16, path.Length/2)
+	if !readMemory(h, uintptr(unsafe.Pointer(path.Buffer)), unsafe.Pointer(&dir[0]), uintptr(path.Length)) {
+		return ""
+	}
+	cwd := windows.UTF16ToString(dir)
+	// "C:\projects\app\" but "C:\"
+	if len(cwd) > 3 {
+		cwd = strings.TrimSuffix(cwd, `\`)
+	}
+	return cwd
+}
+
+// readMemory copies size bytes at addr in the process's memory to dst
+func readMemory(h windows.Handle, addr uintptr, dst unsafe.Pointer, size uintptr) bool {
+	var read uintptr
+	err := windows.ReadProcessMemory(h, addr, (*byte)(dst), size, &read)
+	return err == nil && read == size
+}
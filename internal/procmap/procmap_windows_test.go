@@ -0,0 +1,99 @@
+//go:build windows
+
+package procmap
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+// ownListener checks that p is this test process, bound to 127.0.0.1.
+// Paths are compared without case, as Windows does.
+func ownListener(t *testing.T, p Process, port int) {
+	t.Helper()
+	if p.Port != port || p.PID != os.Getpid() {
+		t.Fatalf("got port %d pid %d, want port %d pid %d", p.Port, p.PID, port, os.Getpid())
+	}
+	if exe, _ := os.Executable(); !strings.EqualFold(p.Exe, exe) {
+		t.Errorf("Exe = %q, want %q", p.Exe, exe)
+	}
+	if len(p.Args) == 0 || !strings.EqualFold(p.Args[0], os.Args[0]) {
+		t.Errorf("Args = %q, want them to start with %q", p.Args, os.Args[0])
+	}
+	if wd, _ := os.Getwd(); !strings.EqualFold(p.Cwd, wd) {
+		t.Errorf("Cwd = %q, want %q", p.Cwd, wd)
+	}
+	if p.User == "" || p.Partial {
+		t.Errorf("User = %q, Partial = %v, want this process fully read", p.User, p.Partial)
+	}
+	if len(p.Addrs) != 1 || p.Addrs[0] != "127.0.0.1" || p.Scope != ScopeLoopback {
+		t.Errorf("Addrs = %q, Scope = %q, want 127.0.0.1 and loopback", p.Addrs, p.Scope)
+	}
+}
+
+func TestLookupOwnListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	p, err := Lookup(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ownListener(t, p, port)
+}
+
+func TestLookupOwnIPv6Listener(t *testing.T) {
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("no IPv6 loopback:", err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	p, err := Lookup(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.PID != os.Getpid() || len(p.Addrs) != 1 || p.Addrs[0] != "::1" {
+		t.Errorf("got pid %d bound to %q, want pid %d bound to ::1", p.PID, p.Addrs, os.Getpid())
+	}
+}
+
+func TestAllUDPOwnSocket(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:0", "[::1]:0"} {
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			t.Logf("skipping %s: %v", addr, err)
+			continue
+		}
+		port := conn.LocalAddr().(*net.UDPAddr).Port
+		procs, err := AllUDP()
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		host, _, _ := net.SplitHostPort(addr)
+		found := false
+		for _, p := range procs {
+			if p.Port == port && p.PID == os.Getpid() && len(p.Addrs) == 1 && p.Addrs[0] == host {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("no owner of UDP %s port %d among %d", host, port, len(procs))
+		}
+	}
+}
+
+func TestBindV6Only(t *testing.T) {
+	// Winsock's default, which nothing in a test run changes
+	if !bindV6Only() {
+		t.Error("bindV6Only() = false, want Winsock's default of true")
+	}
+}
@@ -0,0 +1,124 @@
+package procmap
+
+import (
+	"bytes"
+	"net"
+	"sort"
+)
+
+// Scope says who can reach a listening port, judged from the addresses
+// its sockets are bound to
+type Scope string
+
+const (
+	ScopeUnknown           Scope = ""
+	ScopeLoopback          Scope = "loopback"           // Only this machine, e.g. 127.0.0.1 or ::1
+	ScopeAllInterfaces     Scope = "all-interfaces"     // Bound to 0.0.0.0, or to :: accepting IPv4 too
+	ScopeSpecificInterface Scope = "specific-interface" // Bound to a non-loopback address, e.g. a LAN IP
+	ScopeIPv6Only          Scope = "ipv6-only"          // Bound to :: with IPv4 excluded
+)
+
+// Exposed reports whether the port can be reached from other machines
+func (s Scope) Exposed() bool {
+	return s == ScopeAllInterfaces || s == ScopeSpecificInterface || s == ScopeIPv6Only
+}
+
+// scopeOf is the widest scope among the bind addresses of a port's
+// sockets. v6only is whether a socket bound to :: excludes IPv4; the
+// socket tables don't say per socket, so it is the system default.
+func scopeOf(addrs []string, v6only bool) Scope {
+	scope := ScopeUnknown
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		switch {
+		case ip == nil:
+			continue
+		case ip.Equal(net.IPv4zero), ip.Equal(net.IPv6unspecified) && !v6only:
+			return ScopeAllInterfaces
+		case ip.Equal(net.IPv6unspecified):
+			scope = ScopeIPv6Only
+		case !ip.IsLoopback() && scope != ScopeIPv6Only:
+			scope = ScopeSpecificInterface
+		case scope == ScopeUnknown:
+			scope = ScopeLoopback
+		}
+	}
+	return scope
+}
+
+// Accepts reports whether a connection to ip on the port would reach one of
+// p's sockets, from the addresses they are bound to
+func (p Process) Accepts(ip string) bool {
+	return accepts(p.Addrs, p.Scope, net.ParseIP(ip))
+}
+
+func accepts(addrs []string, scope Scope, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, addr := range addrs {
+		bound := net.ParseIP(addr)
+		switch {
+		case bound == nil:
+		case bound.Equal(ip):
+			return true
+		case bound.Equal(net.IPv4zero):
+			if ip.To4() != nil {
+				return true
+			}
+		case bound.Equal(net.IPv6unspecified):
+			if ip.To4() == nil || scope != ScopeIPv6Only {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// DialAddr returns the address to connect to a listener bound to addrs,
+// with the scope they add up to: 127.0.0.1 if it accepts connections
+// there, else ::1, else the first loopback address it is bound to, e.g.
+// 127.0.0.2. It is "127.0.0.1" when the addresses are unknown or none of
+// them is loopback.
+func DialAddr(addrs []string, scope Scope) string {
+	if accepts(addrs, scope, net.IPv4(127, 0, 0, 1)) {
+		return "127.0.0.1"
+	}
+	if accepts(addrs, scope, net.IPv6loopback) {
+		return "::1"
+	}
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil && ip.IsLoopback() {
+			return ip.String()
+		}
+	}
+	return "127.0.0.1"
+}
+
+// LoopbackAddrs returns the loopback addresses other than 127.0.0.1 and
+// ::1 that procs are bound to specifically, such as 127.0.0.53, sorted
+func LoopbackAddrs(procs []Process) []string {
+	seen := make(map[string]bool)
+	var found []string
+	for _, p := range procs {
+		for _, addr := range p.Addrs {
+			ip := net.ParseIP(addr)
+			if ip == nil || !ip.IsLoopback() || IsDefaultLoopback(addr) || seen[ip.String()] {
+				continue
+			}
+			seen[ip.String()] = true
+			found = append(found, ip.String())
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return bytes.Compare(net.ParseIP(found[i]).To16(), net.ParseIP(found[j]).To16()) < 0
+	})
+	return found
+}
+
+// IsDefaultLoopback reports whether addr is 127.0.0.1 or ::1, the
+// loopback addresses every scan covers
+func IsDefaultLoopback(addr string) bool {
+	ip := net.ParseIP(addr)
+	return ip != nil && (ip.Equal(net.IPv4(127, 0, 0, 1)) || ip.Equal(net.IPv6loopback))
+}
@@ -0,0 +1,80 @@
+package procmap
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// dirFlags are the flags static file servers take their root from:
+// python -m http.server -d, php -S -t, caddy file-server --root
+var dirFlags = []string{"-d", "--directory", "-t", "--docroot", "--root"}
+
+// positionalDirScripts are file servers whose root is a bare argument,
+// e.g. "npx serve dist" or "http-server ./public"
+var positionalDirScripts = map[string]bool{"serve": true, "http-server": true, "httpd": true}
+
+// ServedDir returns the directory a static file server process serves:
+// the one named on its command line, resolved against its working
+// directory, or the working directory itself. It is "" when neither is
+// known. It says nothing of whether the process is a file server.
+func (p Process) ServedDir() string {
+	if dir := servedArg(p.Args, p.Cwd); dir != "" {
+		return resolve(dir, p.Cwd)
+	}
+	return p.Cwd
+}
+
+// resolve makes dir absolute against cwd, or returns "" if it can't
+func resolve(dir, cwd string) string {
+	switch {
+	case filepath.IsAbs(dir):
+		return filepath.Clean(dir)
+	case cwd == "":
+		return ""
+	}
+	return filepath.Join(cwd, dir)
+}
+
+// servedArg finds the root directory argument in a file server's command
+// line. A bare argument only counts after a known script's name and when
+// it is a directory, as it may as well be a port.
+func servedArg(args []string, cwd string) string {
+	script := false
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		for _, flag := range dirFlags {
+			if arg == flag && i+1 < len(args) {
+				return args[i+1]
+			}
+			if value, ok := strings.CutPrefix(arg, flag+"="); ok && strings.HasPrefix(flag, "--") {
+				return value
+			}
+		}
+		switch {
+		case positionalDirScripts[filepath.Base(arg)]:
+			script = true
+		case script && !strings.HasPrefix(arg, "-"):
+			if info, err := os.Stat(resolve(arg, cwd)); err == nil && info.IsDir() {
+				return arg
+			}
+		}
+	}
+	return ""
+}
+
+// ShortPath writes path with a leading "~" for the home directory, e.g.
+// "~/Downloads", the way a served directory is shown
+func ShortPath(path string) string {
+	home, err := os.UserHomeDir()
+	if err != nil || home == "" || home == "/" {
+		return path
+	}
+	if path == home {
+		return "~"
+	}
+	if rest, ok := strings.CutPrefix(path, home+string(filepath.Separator)); ok {
+		return "~" + string(filepath.Separator) + rest
+	}
+	return path
+}
@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Stream is the kind of long-lived exchange an Access belongs to
+type Stream string
+
+const (
+	StreamNone      Stream = ""
+	StreamWebSocket Stream = "websocket"
+	StreamSSE       Stream = "sse" // A Server-Sent Events response
+)
+
+// Phase says which end of a stream an Access reports
+type Phase string
+
+const (
+	PhaseNone  Phase = ""      // An ordinary request, reported once done
+	PhaseStart Phase = "start" // The stream was set up
+	PhaseEnd   Phase = "end"   // The stream closed; Bytes and Duration are totals
+)
+
+// Access is a request the proxy routed to a service. WebSockets and event
+// streams are reported twice, when they start and when they end.
+type Access struct {
+	Time     time.Time // When the request arrived, or the stream closed
+	Client   string    // Remote address
+	Host     string    // As requested, e.g. "api.localhost:8080"
+	Method   string
+	Path     string // With the query
+	Service  string // Route name
+	Port     int
+	Status   int
+	Bytes    int64 // Body bytes sent to the client; for a WebSocket, relayed both ways
+	Duration time.Duration
+	Stream   Stream
+	Phase    Phase
+}
+
+// accessJSON is the wire form of an Access
+type accessJSON struct {
+	Time       time.Time `json:"time"`
+	Client     string    `json:"client"`
+	Host       string    `json:"host"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Service    string    `json:"service"`
+	Port       int       `json:"port"`
+	Status     int       `json:"status,omitempty"`
+	Bytes      int64     `json:"bytes"`
+	DurationMS float64   `json:"duration_ms"`
+	Stream     Stream    `json:"stream,omitempty"`
+	Phase      Phase     `json:"phase,omitempty"`
+}
+
+// MarshalJSON encodes the access with its duration in milliseconds
+func (a Access) MarshalJSON() ([]byte, error) {
+	return json.Marshal(accessJSON{
+		Time: a.Time, Client: a.Client, Host: a.Host, Method: a.Method, Path: a.Path,
+		Service: a.Service, Port: a.Port, Status: a.Status, Bytes: a.Bytes,
+		DurationMS: float64(a.Duration.Microseconds()) / 1000,
+		Stream:     a.Stream, Phase: a.Phase,
+	})
+}
+
+// UnmarshalJSON decodes the format written by MarshalJSON
+func (a *Access) UnmarshalJSON(data []byte) error {
+	var in accessJSON
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	*a = Access{
+		Time: in.Time, Client: in.Client, Host: in.Host, Method: in.Method, Path: in.Path,
+		Service: in.Service, Port: in.Port, Status: in.Status, Bytes: in.Bytes,
+		Duration: time.Duration(in.DurationMS * float64(time.Millisecond)),
+		Stream:   in.Stream, Phase: in.Phase,
+	}
+	return nil
+}
+
+// OnAccess registers fn to be called for every routed request, from the
+// goroutine serving it. Register callbacks before serving.
+func (h *Handler) OnAccess(fn func(Access)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.onAccess = append(h.onAccess, fn)
+}
+
+// report hands a to the OnAccess callbacks
+func (h *Handler) report(a Access) {
+	h.mu.Lock()
+	callbacks := h.onAccess
+	h.mu.Unlock()
+	for _, fn := range callbacks {
+		fn(a)
+	}
+}
+
+// recorder is the ResponseWriter of a routed request. It counts what is
+// written and reports the request when it is done, or when it turns out
+// to be a stream, when that starts too.
+type recorder struct {
+	http.ResponseWriter
+	h      *Handler
+	access Access
+	start  time.Time
+}
+
+// newRecorder starts recording r, routed to route
+func (h *Handler) newRecorder(w http.ResponseWriter, r *http.Request, route Route) *recorder {
+	start := time.Now()
+	uri := r.URL.RequestURI()
+	if pr, ok := r.Context().Value(pathRouteKey{}).(*pathRoute); ok {
+		uri = pr.uri // As asked for, with the prefix
+	}
+	return &recorder{
+		ResponseWriter: w,
+		h:              h,
+		start:          start,
+		access: Access{
+			Time:    start,
+			Client:  r.RemoteAddr,
+			Host:    r.Host,
+			Method:  r.Method,
+			Path:    uri,
+			Service: route.Name,
+			Port:    route.Port,
+		},
+	}
+}
+
+func (rec *recorder) WriteHeader(code int) {
+	// Informational answers such as 103 Early Hints precede the real one
+	if rec.access.Status == 0 && code >= 200 {
+		rec.access.Status = code
+		if isEventStream(rec.Header()) {
+			rec.startStream(StreamSSE)
+		}
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *recorder) Write(b []byte) (int, error) {
+	if rec.access.Status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.access.Bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController flush and hijack the connection
+func (rec *recorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// startStream reports the start of a stream of kind
+func (rec *recorder) startStream(kind Stream) {
+	rec.access.Stream = kind
+	start := rec.access
+	start.Phase = PhaseStart
+	start.Duration = time.Since(rec.start)
+	rec.h.report(start)
+}
+
+// finish reports the request, or the end of its stream
+func (rec *recorder) finish() {
+	a := rec.access
+	a.Duration = time.Since(rec.start)
+	if a.Stream != StreamNone {
+		a.Time, a.Phase = time.Now(), PhaseEnd
+	}
+	rec.h.report(a)
+}
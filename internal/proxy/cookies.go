@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+)
+
+// routeKey is the context key of the route a request was passed to
+type routeKey struct{}
+
+// OnCookies registers fn to be called with the cookies a routed service
+// sets in a response, such as the session cookie of a login, from the
+// goroutine serving the request. Register callbacks before serving.
+func (h *Handler) OnCookies(fn func(route Route, cookies []*http.Cookie)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.onCookies = append(h.onCookies, fn)
+}
+
+// withRoute returns r carrying the route it is passed to, for the
+// response to be reported under
+func withRoute(r *http.Request, route Route) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), routeKey{}, route))
+}
+
+// reportCookies hands the cookies resp sets to the OnCookies callbacks
+func (h *Handler) reportCookies(resp *http.Response) {
+	h.mu.Lock()
+	callbacks := h.onCookies
+	h.mu.Unlock()
+	route, ok := resp.Request.Context().Value(routeKey{}).(Route)
+	if len(callbacks) == 0 || !ok {
+		return
+	}
+	cookies := resp.Cookies()
+	if len(cookies) == 0 {
+		return
+	}
+	for _, fn := range callbacks {
+		fn(route, cookies)
+	}
+}
@@ -0,0 +1,306 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultPathAddr is where path routing listens when it is turned on
+const DefaultPathAddr = "127.0.0.1:4280"
+
+// maxRewriteBody bounds the HTML documents PathHandler rewrites; bigger
+// ones are passed through as they are
+const maxRewriteBody = 8 << 20
+
+// PathHandler serves every route under one origin, each at a path prefix
+// named after it, for browsers and tools that can't resolve name.localhost:
+//
+//	http://localhost:4280/web/...  ->  web.localhost
+//	http://localhost:4280/api/...  ->  api.localhost
+//
+// The prefix is stripped before the request reaches the backend unless
+// the route keeps it. For stripped routes, redirects and root-relative
+// links in HTML are rewritten to go back under the prefix, and requests
+// for root paths the rewriting missed, e.g. a JavaScript import, are sent
+// to the service their Referer is under. Backends that keep the prefix are
+// expected to generate prefixed URLs themselves; only redirects to their
+// own address are rewritten.
+type PathHandler struct {
+	proxy *Handler
+	keep  func(name string) bool
+}
+
+// NewPathHandler routes by path prefix through proxy, along its routes.
+// keepPrefix says which routes' backends get the prefix; nil strips it
+// from all of them.
+func NewPathHandler(proxy *Handler, keepPrefix func(name string) bool) *PathHandler {
+	if keepPrefix == nil {
+		keepPrefix = func(string) bool { return false }
+	}
+	return &PathHandler{proxy: proxy, keep: keepPrefix}
+}
+
+// PathPrefix returns the path prefix of a route, e.g. "/web" for
+// "web.localhost"
+func PathPrefix(name string) string {
+	return "/" + strings.TrimSuffix(name, ".localhost")
+}
+
+// pathRoute is how a request was routed by path, kept in its context for
+// the response to be rewritten
+type pathRoute struct {
+	prefix string // e.g. "/web"
+	strip  bool   // Whether the backend sees paths without the prefix
+	route  Route
+	uri    string // The request URI as the client sent it
+}
+
+type pathRouteKey struct{}
+
+// ServeHTTP implements http.Handler. Like Handler, it only serves clients
+// on this machine.
+func (p *PathHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !isLoopback(r.RemoteAddr) {
+		refuseRemote(w, r)
+		return
+	}
+	segment, rest := splitPrefix(r.URL.Path)
+	route, ok := p.lookup(segment)
+	if !ok {
+		// A root path the page's rewriting missed, such as a module
+		// import, belongs to the service the page came from
+		if route, ok = p.refererRoute(r); ok {
+			p.serve(w, r, route, false)
+			return
+		}
+		p.serveIndex(w, r)
+		return
+	}
+	if rest == "" {
+		// Without the slash, the page's relative URLs would resolve
+		// outside the prefix
+		target := *r.URL
+		target.Path += "/"
+		http.Redirect(w, r, target.RequestURI(), http.StatusPermanentRedirect)
+		return
+	}
+	p.serve(w, r, route, !p.keep(route.Name))
+}
+
+// serve passes r to route's backend, without the first segment of its
+// path if trim is set
+func (p *PathHandler) serve(w http.ResponseWriter, r *http.Request, route Route, trim bool) {
+	pr := &pathRoute{prefix: PathPrefix(route.Name), strip: !p.keep(route.Name), route: route, uri: r.URL.RequestURI()}
+	out := r.Clone(context.WithValue(r.Context(), pathRouteKey{}, pr))
+	if trim {
+		_, out.URL.Path = splitPrefix(r.URL.Path)
+		if r.URL.RawPath != "" {
+			_, out.URL.RawPath = splitPrefix(r.URL.RawPath)
+		}
+	}
+	out.Header.Set("X-Forwarded-Prefix", pr.prefix)
+	if pr.strip {
+		// Compressed HTML couldn't be rewritten
+		out.Header.Del("Accept-Encoding")
+	}
+	p.proxy.ServeRoute(w, out, route)
+}
+
+// lookup returns the route a path prefix segment names
+func (p *PathHandler) lookup(segment string) (Route, bool) {
+	if segment == "" {
+		return Route{}, false
+	}
+	return p.proxy.routes.Lookup(Hostname(segment) + ".localhost")
+}
+
+// refererRoute returns the route of the page that made r, if it is one of
+// this origin's and under a prefix whose backend doesn't see it
+func (p *PathHandler) refererRoute(r *http.Request) (Route, bool) {
+	ref, err := url.Parse(r.Header.Get("Referer"))
+	if err != nil || ref.Host != r.Host {
+		return Route{}, false
+	}
+	segment, _ := splitPrefix(ref.Path)
+	route, ok := p.lookup(segment)
+	if !ok || p.keep(route.Name) {
+		return Route{}, false
+	}
+	return route, true
+}
+
+// splitPrefix splits "/web/app.js" into "web" and "/app.js", and "/web"
+// into "web" and ""
+func splitPrefix(path string) (segment, rest string) {
+	path = strings.TrimPrefix(path, "/")
+	segment, rest, found := strings.Cut(path, "/")
+	if found {
+		rest = "/" + rest
+	}
+	return segment, rest
+}
+
+// rewritePathResponse makes a response from a path-routed backend point
+// back under its prefix
+func rewritePathResponse(resp *http.Response) error {
+	pr, ok := resp.Request.Context().Value(pathRouteKey{}).(*pathRoute)
+	if !ok {
+		return nil
+	}
+	if location := resp.Header.Get("Location"); location != "" {
+		resp.Header.Set("Location", pr.location(location))
+	}
+	if !pr.strip || !isHTML(resp.Header) || resp.Header.Get("Content-Encoding") != "" || !hasBody(resp) {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRewriteBody+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > maxRewriteBody {
+		// Too big to hold: pass it on untouched
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return nil
+	}
+	resp.Body.Close()
+	body = pr.rewriteHTML(body)
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// hasBody reports whether resp carries a body that may be rewritten
+func hasBody(resp *http.Response) bool {
+	switch {
+	case resp.Body == nil || resp.Body == http.NoBody, resp.Request.Method == http.MethodHead:
+		return false
+	case resp.StatusCode == http.StatusNoContent, resp.StatusCode == http.StatusNotModified:
+		return false
+	}
+	return true
+}
+
+// location rewrites a redirect target: the backend's own address becomes
+// the path-routing origin, and root paths of a stripped route go under
+// its prefix
+func (pr *pathRoute) location(location string) string {
+	u, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+	if u.IsAbs() {
+		if !pr.isBackend(u.Host) {
+			return location
+		}
+		u.Scheme, u.Host, u.User = "", "", nil
+	}
+	if u.Host == "" && strings.HasPrefix(u.Path, "/") && !strings.HasPrefix(u.Path, "//") && pr.strip && !pr.prefixed(u.Path) {
+		u.Path = pr.prefix + u.Path
+		u.RawPath = ""
+	}
+	return u.String()
+}
+
+// isBackend reports whether host, from a URL, is the route's backend
+func (pr *pathRoute) isBackend(host string) bool {
+	h, port, err := net.SplitHostPort(host)
+	if err != nil {
+		h, port = host, "80"
+	}
+	if port != strconv.Itoa(pr.route.Port) {
+		return false
+	}
+	ip := net.ParseIP(h)
+	return h == pr.route.TargetHost || h == "localhost" || (ip != nil && ip.IsLoopback())
+}
+
+// prefixed reports whether path is already under the prefix
+func (pr *pathRoute) prefixed(path string) bool {
+	return path == pr.prefix || strings.HasPrefix(path, pr.prefix+"/")
+}
+
+// prefixedURL reports whether the URL at the start of b, up to where an
+// attribute value may end, is already under the prefix
+func (pr *pathRoute) prefixedURL(b []byte) bool {
+	if !bytes.HasPrefix(b, []byte(pr.prefix)) {
+		return false
+	}
+	rest := b[len(pr.prefix):]
+	return len(rest) == 0 || bytes.IndexByte([]byte("/?#\"' >"), rest[0]) >= 0
+}
+
+// rootURLAttr matches the start of an HTML attribute holding a
+// root-relative URL, up to the slash
+var rootURLAttr = regexp.MustCompile(`(?i)\s(?:href|src|action|formaction|poster|data)\s*=\s*["']?/`)
+
+// rewriteHTML puts the root-relative URLs in HTML attributes under the
+// prefix. Protocol-relative URLs ("//cdn...") and ones already under it
+// are left alone. URLs built by scripts, in CSS or in srcset aren't seen.
+func (pr *pathRoute) rewriteHTML(body []byte) []byte {
+	var out bytes.Buffer
+	last := 0
+	for _, m := range rootURLAttr.FindAllIndex(body, -1) {
+		slash := m[1] - 1
+		rest := body[slash:]
+		if bytes.HasPrefix(rest, []byte("//")) || pr.prefixedURL(rest) {
+			continue
+		}
+		out.Write(body[last:slash])
+		out.WriteString(pr.prefix)
+		last = slash
+	}
+	if last == 0 {
+		return body
+	}
+	out.Write(body[last:])
+	return out.Bytes()
+}
+
+// isHTML reports whether a response is an HTML document
+func isHTML(h http.Header) bool {
+	return strings.HasPrefix(strings.ToLower(h.Get("Content-Type")), "text/html")
+}
+
+var pathIndexTemplate = template.Must(template.New("paths").Parse(`<!DOCTYPE html>
+<html>
+<head><title>localhost-magic</title></head>
+<body>
+<h1>No service at {{.Path}}</h1>
+{{if .Routes}}<p>Known services:</p>
+<ul>
+{{range .Routes}}<li><a href="{{.Prefix}}/">{{.Prefix}}/</a> &rarr; {{.Target}}</li>
+{{end}}</ul>
+{{else}}<p>No services discovered yet.</p>
+{{end}}</body>
+</html>
+`))
+
+// serveIndex lists the prefixes, for paths that name no service
+func (p *PathHandler) serveIndex(w http.ResponseWriter, r *http.Request) {
+	type entry struct{ Prefix, Target string }
+	var entries []entry
+	for _, route := range p.proxy.routes.List() {
+		entries = append(entries, entry{PathPrefix(route.Name), route.Target()})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Prefix < entries[j].Prefix })
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusNotFound)
+	pathIndexTemplate.Execute(w, struct {
+		Path   string
+		Routes []entry
+	}{r.URL.Path, entries})
+}
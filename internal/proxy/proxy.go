@@ -0,0 +1,371 @@
+// Package proxy routes requests for name.localhost hostnames to the local
+// ports serving them, or with PathHandler requests for /name/ paths under
+// one origin. The routing table sits behind the Routes interface and is
+// consulted on every request, so changes apply without a restart.
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"localhost-magic/internal/handoff"
+	"localhost-magic/internal/rewrite"
+)
+
+// DefaultAddr is the preferred listen address; FallbackAddr is used when
+// binding it needs privileges the process doesn't have. The TLS pair is
+// the same for HTTPS.
+const (
+	DefaultAddr     = ":80"
+	FallbackAddr    = ":8080"
+	DefaultTLSAddr  = ":443"
+	FallbackTLSAddr = ":8443"
+)
+
+// A backend that refuses connections may be restarting, e.g. under
+// nodemon; dialBackend keeps trying for restartWait before giving up
+const (
+	restartWait  = 5 * time.Second
+	restartRetry = 100 * time.Millisecond // First pause between tries
+)
+
+// Route is where requests for one hostname go
+type Route struct {
+	Name       string // Hostname, e.g. "api.localhost"
+	TargetHost string // Default: 127.0.0.1
+	Port       int
+
+	// How to talk to the backend, from what its probe found: over HTTPS
+	// with its certificate unchecked, with HTTP/2 when it negotiates h2,
+	// and without reusing connections when it closes them after each
+	// response. The zero value is HTTP/1.1 with keep-alive.
+	TLS         bool
+	HTTP2       bool
+	NoKeepAlive bool
+
+	// Rewrite changes the requests passed to the backend and its answers,
+	// after the X-Forwarded headers are set and before path routing puts
+	// redirects back under its prefix
+	Rewrite rewrite.Actions
+}
+
+// Target returns the backend address
+func (r Route) Target() string {
+	host := r.TargetHost
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(r.Port))
+}
+
+// Routes is the routing table
+type Routes interface {
+	// Lookup returns the route for a hostname, given in lower case without
+	// a port or trailing dot
+	Lookup(host string) (Route, bool)
+	// List returns every route, for the catch-all page
+	List() []Route
+}
+
+// Handler is the reverse proxy
+type Handler struct {
+	routes   Routes
+	fallback http.Handler
+
+	mu        sync.Mutex
+	proxies   map[proxyKey]*httputil.ReverseProxy
+	onAccess  []func(Access)
+	onCookies []func(Route, []*http.Cookie)
+}
+
+// New returns a proxy for routes. Requests for unknown hostnames go to
+// fallback, or to a page listing the known services if it is nil.
+func New(routes Routes, fallback http.Handler) *Handler {
+	h := &Handler{routes: routes, fallback: fallback, proxies: make(map[proxyKey]*httputil.ReverseProxy)}
+	if h.fallback == nil {
+		h.fallback = http.HandlerFunc(h.serveIndex)
+	}
+	return h
+}
+
+// ServeHTTP routes the request by its Host header. Only clients on this
+// machine are served, whatever address the listener is on: other devices
+// reach a service through internal/share, or on its own port.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !isLoopback(r.RemoteAddr) {
+		refuseRemote(w, r)
+		return
+	}
+	route, ok := h.routes.Lookup(Hostname(r.Host))
+	if !ok {
+		h.fallback.ServeHTTP(w, r)
+		return
+	}
+	h.ServeRoute(w, r, route)
+}
+
+// ServeRoute passes the request to route's backend whatever its Host,
+// for callers that route by other means
+func (h *Handler) ServeRoute(w http.ResponseWriter, r *http.Request, route Route) {
+	rec := h.newRecorder(w, r, route)
+	defer rec.finish()
+	if isWebSocketUpgrade(r) {
+		h.serveWebSocket(rec, r, route)
+		return
+	}
+	h.proxyFor(route).ServeHTTP(rec, withRoute(r, route))
+}
+
+// proxyKey identifies a reverse proxy: a backend address and the way to
+// talk to it
+type proxyKey struct {
+	target    string
+	transport transportKey
+}
+
+// proxyFor returns the reverse proxy for route's backend, creating it on
+// first use. Proxies are keyed by address rather than name so a service
+// that moves to another port gets a fresh one.
+func (h *Handler) proxyFor(route Route) *httputil.ReverseProxy {
+	key := proxyKey{route.Target(), transportKey{route.TLS, route.HTTP2, !route.NoKeepAlive}}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if p, ok := h.proxies[key]; ok {
+		return p
+	}
+
+	backend := &url.URL{Scheme: "http", Host: key.target}
+	if route.TLS {
+		backend.Scheme = "https"
+	}
+	p := &httputil.ReverseProxy{
+		Transport: transportFor(key.transport),
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(backend)
+			pr.SetXForwarded()
+			if route, ok := pr.In.Context().Value(routeKey{}).(Route); ok {
+				route.Rewrite.Request(pr.Out)
+			}
+		},
+		// Flush every write so event streams and long polls aren't buffered
+		FlushInterval: -1,
+		ModifyResponse: func(resp *http.Response) error {
+			if isEventStream(resp.Header) {
+				// Nor by a proxy such as nginx in front of this one
+				resp.Header.Set("X-Accel-Buffering", "no")
+			}
+			// As the service set them, before path routing rewrites them
+			h.reportCookies(resp)
+			rewriteResponse(resp)
+			return rewritePathResponse(resp)
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			// r is the outgoing request, so the name is in X-Forwarded-Host
+			unavailable(w, Hostname(r.Header.Get("X-Forwarded-Host")), err)
+		},
+	}
+	h.proxies[key] = p
+	return p
+}
+
+// transportKey says how to talk to a backend
+type transportKey struct {
+	tls, http2, keepAlive bool
+}
+
+// transports are shared by every backend talked to the same way, so idle
+// connections are pooled across them
+var (
+	transportsMu sync.Mutex
+	transports   = make(map[transportKey]*http.Transport)
+)
+
+// transportFor returns the transport for key: http.DefaultTransport with
+// dialBackend, accepting any backend certificate, and offering h2 over TLS
+// only to backends known to negotiate it
+func transportFor(key transportKey) *http.Transport {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	if t, ok := transports[key]; ok {
+		return t
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = dialBackend
+	t.DisableKeepAlives = !key.keepAlive
+	t.TLSClientConfig = backendTLSConfig()
+	// A custom TLSClientConfig turns HTTP/2 off unless forced
+	t.ForceAttemptHTTP2 = key.http2
+	if key.http2 {
+		t.TLSClientConfig.NextProtos = []string{"h2", "http/1.1"}
+	}
+	transports[key] = t
+	return t
+}
+
+// backendTLSConfig is the TLS configuration for HTTPS backends: local dev
+// servers mostly present self-signed certificates
+func backendTLSConfig() *tls.Config {
+	return &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"http/1.1"}}
+}
+
+// dialBackend connects to a backend, retrying refused connections for up
+// to restartWait so a request arriving while a dev server restarts waits
+// for it instead of failing at once. Nothing has been sent on a refused
+// connection, so any request can wait this way.
+func dialBackend(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: backendDialTimeout}
+	deadline := time.Now().Add(restartWait)
+	pause := restartRetry
+	for {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err == nil || !errors.Is(err, syscall.ECONNREFUSED) || time.Now().Add(pause).After(deadline) {
+			return conn, err
+		}
+		timer := time.NewTimer(pause)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+		pause = min(2*pause, time.Second)
+	}
+}
+
+// isEventStream reports whether a response is a Server-Sent Events stream
+func isEventStream(h http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	return err == nil && mediaType == "text/event-stream"
+}
+
+// isLoopback reports whether a request's remote address is on loopback
+func isLoopback(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// refuseRemote answers 403 Forbidden to a client on another machine
+func refuseRemote(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Refused %s from %s: not a local client", r.Host, r.RemoteAddr)
+	http.Error(w, "localhost-magic only serves this machine; share the service to reach it from another device", http.StatusForbidden)
+}
+
+// unavailable logs a failure to reach the backend for host and answers
+// 502 Bad Gateway
+func unavailable(w http.ResponseWriter, host string, err error) {
+	log.Printf("Proxy error for %s: %v", host, err)
+	http.Error(w, fmt.Sprintf("Service %s unavailable", host), http.StatusBadGateway)
+}
+
+// Hostname normalises a Host header for Routes.Lookup: lower case, without
+// the port or a trailing dot
+func Hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head><title>localhost-magic</title></head>
+<body>
+<h1>No service for {{.Host}}</h1>
+{{if .Routes}}<p>Known services:</p>
+<ul>
+{{range .Routes}}<li><a href="http://{{.Name}}/">{{.Name}}</a> &rarr; {{.Target}}</li>
+{{end}}</ul>
+{{else}}<p>No services discovered yet.</p>
+{{end}}</body>
+</html>
+`))
+
+// serveIndex is the default catch-all page
+func (h *Handler) serveIndex(w http.ResponseWriter, r *http.Request) {
+	routes := h.routes.List()
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Name < routes[j].Name })
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusNotFound)
+	indexTemplate.Execute(w, struct {
+		Host   string
+		Routes []Route
+	}{Hostname(r.Host), routes})
+}
+
+// Listen binds addr, or fallback if addr needs privileges the process
+// lacks (ports below 1024 without root). The returned listener's address
+// says which one was used. A socket the process inherited on either
+// address is used rather than a new one (see handoff).
+func Listen(addr, fallback string) (net.Listener, error) {
+	ln, err := handoff.Listen("tcp", addr)
+	if err == nil || fallback == "" || !errors.Is(err, syscall.EACCES) {
+		return ln, err
+	}
+	log.Printf("Cannot bind %s without privileges, using %s", addr, fallback)
+	return handoff.Listen("tcp", fallback)
+}
+
+// Table is a Routes implementation safe for concurrent use, for callers
+// that don't keep a registry of their own
+type Table struct {
+	mu     sync.RWMutex
+	routes map[string]Route
+}
+
+// NewTable returns an empty table
+func NewTable() *Table {
+	return &Table{routes: make(map[string]Route)}
+}
+
+// Set adds or replaces the route for route.Name
+func (t *Table) Set(route Route) {
+	route.Name = Hostname(route.Name)
+	t.mu.Lock()
+	t.routes[route.Name] = route
+	t.mu.Unlock()
+}
+
+// Delete removes the route for name
+func (t *Table) Delete(name string) {
+	t.mu.Lock()
+	delete(t.routes, Hostname(name))
+	t.mu.Unlock()
+}
+
+// Lookup implements Routes
+func (t *Table) Lookup(host string) (Route, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	route, ok := t.routes[host]
+	return route, ok
+}
+
+// List implements Routes
+func (t *Table) List() []Route {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	routes := make([]Route, 0, len(t.routes))
+	for _, route := range t.routes {
+		routes = append(routes, route)
+	}
+	return routes
+}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// countingBackend answers every request and counts them
+func countingBackend(t *testing.T) (int, *atomic.Int32) {
+	t.Helper()
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Write([]byte("backend"))
+	}))
+	t.Cleanup(srv.Close)
+	return srv.Listener.Addr().(*net.TCPAddr).Port, &hits
+}
+
+// from sends a request for host from the client at remoteAddr
+func from(h http.Handler, remoteAddr, host, path string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "http://"+host+path, nil)
+	r.RemoteAddr = remoteAddr
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestLANClientsRefused(t *testing.T) {
+	port, hits := countingBackend(t)
+	routes := NewTable()
+	routes.Set(Route{Name: "shop.localhost", Port: port})
+	h := New(routes, nil)
+	paths := NewPathHandler(h, nil)
+
+	for _, remote := range []string{"192.168.1.20:51000", "10.0.0.7:40000", "[fe80::1]:40000", "[2001:db8::5]:40000"} {
+		if w := from(h, remote, "shop.localhost", "/"); w.Code != http.StatusForbidden {
+			t.Errorf("request from %s: %d, want 403", remote, w.Code)
+		}
+		if w := from(h, remote, "unknown.localhost", "/"); w.Code != http.StatusForbidden {
+			t.Errorf("index from %s: %d, want 403", remote, w.Code)
+		}
+		if w := from(paths, remote, "localhost", "/shop/"); w.Code != http.StatusForbidden {
+			t.Errorf("path request from %s: %d, want 403", remote, w.Code)
+		}
+	}
+	if n := hits.Load(); n != 0 {
+		t.Fatalf("backend reached %d times from the LAN", n)
+	}
+
+	for _, remote := range []string{"127.0.0.1:51000", "127.0.0.53:51000", "[::1]:51000"} {
+		if w := from(h, remote, "shop.localhost", "/"); w.Code != http.StatusOK || w.Body.String() != "backend" {
+			t.Errorf("request from %s: %d %q, want the backend's answer", remote, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestServeRouteServesSharedClients(t *testing.T) {
+	port, hits := countingBackend(t)
+	h := New(NewTable(), nil)
+	// Shares route LAN clients themselves, after checking their session
+	r := httptest.NewRequest("GET", "http://192.168.1.10:7080/", nil)
+	r.RemoteAddr = "192.168.1.20:51000"
+	w := httptest.NewRecorder()
+	h.ServeRoute(w, r, Route{Name: "shop.localhost", Port: port})
+	if w.Code != http.StatusOK || hits.Load() != 1 {
+		t.Errorf("ServeRoute answered %d with %d backend hits, want the backend's answer", w.Code, hits.Load())
+	}
+}
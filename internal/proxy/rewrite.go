@@ -0,0 +1,17 @@
+package proxy
+
+import "net/http"
+
+// rewriteResponse applies the rewrite actions of the route resp answers for
+// to its headers and redirect. The client's Host is in X-Forwarded-Host,
+// as resp.Request is the outgoing request.
+func rewriteResponse(resp *http.Response) {
+	route, ok := resp.Request.Context().Value(routeKey{}).(Route)
+	if !ok || len(route.Rewrite) == 0 {
+		return
+	}
+	route.Rewrite.Response(resp.Header)
+	if location := resp.Header.Get("Location"); location != "" {
+		resp.Header.Set("Location", route.Rewrite.Location(location, resp.Request.Header.Get("X-Forwarded-Host")))
+	}
+}
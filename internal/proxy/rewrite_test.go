@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"localhost-magic/internal/rewrite"
+)
+
+// actions parses specs as a route's rewrite actions
+func actions(t *testing.T, specs ...string) rewrite.Actions {
+	t.Helper()
+	var as rewrite.Actions
+	for _, spec := range specs {
+		a, err := rewrite.ParseAction(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		as = append(as, a)
+	}
+	return as
+}
+
+// redirector redirects every request to /v2/socket/login, as an absolute
+// URL on the Host it was sent when the query has absolute set
+func redirector(t *testing.T) (int, <-chan *http.Request) {
+	t.Helper()
+	requests := make(chan *http.Request, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+		w.Header().Set("Server", "legacy/1.0")
+		if r.URL.Query().Get("absolute") != "" {
+			http.Redirect(w, r, "http://"+r.Host+"/v2/socket/login", http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, "/v2/socket/login", http.StatusFound)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.Listener.Addr().(*net.TCPAddr).Port, requests
+}
+
+func TestRewriteWebSocketUpgrade(t *testing.T) {
+	port, handshakes := wsBackend(t, echo)
+	addr, _ := wsProxy(t, Route{Name: "chat.localhost", Port: port, Rewrite: actions(t,
+		"prefix /socket /v2/socket",
+		"host realtime.internal",
+		"request set X-Tenant: dev",
+		"response set X-Proxied: 1",
+	)})
+
+	conn, r, resp := dialUpgrade(t, addr, "chat.localhost", "")
+	if resp.Header.Get("X-Proxied") != "1" || resp.Header.Get("Sec-WebSocket-Accept") == "" {
+		t.Errorf("101 answered with %v, want the response action applied to the backend's headers", resp.Header)
+	}
+	req := <-handshakes
+	if req.URL.RequestURI() != "/v2/socket?room=1" || req.Host != "realtime.internal" || req.Header.Get("X-Tenant") != "dev" {
+		t.Errorf("backend got %s %s with %v, want the request rewritten", req.Host, req.URL.RequestURI(), req.Header)
+	}
+	if req.Header.Get("Upgrade") != "websocket" || req.Header.Get("X-Forwarded-Host") != "chat.localhost" {
+		t.Errorf("backend got %v, want the upgrade and the client's host kept", req.Header)
+	}
+	io.WriteString(conn, "ping")
+	if got := readN(t, r, 4); got != "ping" {
+		t.Errorf("echoed %q through the rewritten route", got)
+	}
+}
+
+func TestRewriteRefusedUpgradeLocation(t *testing.T) {
+	port, _ := redirector(t)
+	addr, _ := wsProxy(t, Route{Name: "chat.localhost", Port: port, Rewrite: actions(t,
+		"prefix /socket /v2/socket",
+		"host realtime.internal",
+		"response remove Server",
+	)})
+	for query, want := range map[string]string{
+		"room=1":            "/socket/login",
+		"room=1&absolute=1": "http://chat.localhost/socket/login",
+	} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "GET /socket?%s HTTP/1.1\r\nHost: chat.localhost\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n", query)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != want {
+			t.Errorf("refused upgrade with %s: %s to %q, want %q", query, resp.Status, resp.Header.Get("Location"), want)
+		}
+		if resp.Header.Get("Server") != "" {
+			t.Errorf("Server %q passed on, want it removed", resp.Header.Get("Server"))
+		}
+	}
+}
+
+func TestRewriteRedirect(t *testing.T) {
+	port, requests := redirector(t)
+	routes := NewTable()
+	routes.Set(Route{Name: "chat.localhost", Port: port, Rewrite: actions(t,
+		"prefix /socket /v2/socket",
+		"host realtime.internal",
+		"response remove Server",
+	)})
+	srv := httptest.NewServer(New(routes, nil))
+	defer srv.Close()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	for query, want := range map[string]string{
+		"":            "/socket/login",
+		"?absolute=1": "http://chat.localhost/socket/login",
+	} {
+		req, _ := http.NewRequest("GET", srv.URL+"/socket/history"+query, nil)
+		req.Host = "chat.localhost"
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := resp.Header.Get("Location"); resp.StatusCode != http.StatusFound || got != want {
+			t.Errorf("redirect%s: %s to %q, want %q", query, resp.Status, got, want)
+		}
+		if resp.Header.Get("Server") != "" {
+			t.Errorf("Server %q passed on, want it removed", resp.Header.Get("Server"))
+		}
+		if sent := <-requests; sent.URL.Path != "/v2/socket/history" || sent.Host != "realtime.internal" {
+			t.Errorf("backend got %s %s, want the request rewritten", sent.Host, sent.URL.Path)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DrainTimeout bounds how long a replaced listener's requests get to finish
+const DrainTimeout = 30 * time.Second
+
+// requestGrace is how long a connection accepted just before a drain has
+// to send its request. http.Server.Shutdown hangs up on connections that
+// haven't, which their clients see as an empty reply.
+const requestGrace = time.Second
+
+// Server serves a handler on one address at a time. Moving it to another
+// address starts serving there before the old listener is closed, and the
+// requests already in flight on the old one are allowed to finish.
+type Server struct {
+	handler   http.Handler
+	tlsConfig *tls.Config
+
+	mu       sync.Mutex
+	addr     string // As requested, before any fallback
+	fallback string
+	current  *serving
+
+	errs chan error
+}
+
+// serving is a listener and the HTTP server on it
+type serving struct {
+	server  *http.Server
+	ln      net.Listener
+	cancel  context.CancelFunc // Ends the requests still open on server
+	stopped atomic.Bool        // Set once drain closed ln
+
+	mu    sync.Mutex
+	fresh map[net.Conn]bool // Accepted, no request read yet
+}
+
+// NewServer returns a server for handler, serving HTTPS if tlsConfig is
+// set. Call Listen to start it.
+func NewServer(handler http.Handler, tlsConfig *tls.Config) *Server {
+	return &Server{handler: handler, tlsConfig: tlsConfig, errs: make(chan error, 1)}
+}
+
+// Listen starts serving on addr, or on fallback as with the package-level
+// Listen. If the server is already on another address it moves; asking
+// for the addresses it already uses does nothing. On error the server
+// keeps serving where it was.
+func (s *Server) Listen(addr, fallback string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current != nil && addr == s.addr && fallback == s.fallback {
+		return nil
+	}
+
+	ln, err := Listen(addr, fallback)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	sv := &serving{ln: ln, cancel: cancel, fresh: make(map[net.Conn]bool)}
+	sv.server = &http.Server{
+		Handler:     s.handler,
+		TLSConfig:   s.tlsConfig,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+		ConnState:   sv.track,
+	}
+	go s.serve(sv)
+
+	if old := s.current; old != nil {
+		log.Printf("Moved from %s to %s", old.ln.Addr(), ln.Addr())
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), DrainTimeout)
+			defer cancel()
+			old.drain(ctx)
+		}()
+	}
+	s.addr, s.fallback, s.current = addr, fallback, sv
+	return nil
+}
+
+// track keeps the set of connections that haven't sent a request yet
+func (sv *serving) track(conn net.Conn, state http.ConnState) {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	if state == http.StateNew {
+		sv.fresh[conn] = true
+	} else {
+		delete(sv.fresh, conn)
+	}
+}
+
+// waiting returns the number of connections that haven't sent a request
+func (sv *serving) waiting() int {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	return len(sv.fresh)
+}
+
+// drain stops accepting, gives the connections already accepted up to
+// requestGrace to send their request, and shuts the server down, waiting
+// for the requests in flight until ctx expires. Shutdown doesn't wait for
+// hijacked connections such as WebSockets; cancelling their requests'
+// context closes them once the others are done.
+func (sv *serving) drain(ctx context.Context) error {
+	defer sv.cancel()
+	sv.stopped.Store(true)
+	sv.ln.Close()
+	deadline := time.Now().Add(requestGrace)
+	for sv.waiting() > 0 && time.Now().Before(deadline) && ctx.Err() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return sv.server.Shutdown(ctx)
+}
+
+// serve runs until the server is shut down, reporting any other failure
+// to Wait
+func (s *Server) serve(sv *serving) {
+	var err error
+	if s.tlsConfig != nil {
+		err = sv.server.ServeTLS(sv.ln, "", "")
+	} else {
+		err = sv.server.Serve(sv.ln)
+	}
+	if errors.Is(err, http.ErrServerClosed) || sv.stopped.Load() {
+		return
+	}
+	select {
+	case s.errs <- fmt.Errorf("failed to serve on %s: %w", sv.ln.Addr(), err):
+	default:
+	}
+}
+
+// Addr returns the address being served, nil before Listen
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current == nil {
+		return nil
+	}
+	return s.current.ln.Addr()
+}
+
+// Shutdown stops accepting connections and waits for the requests in
+// flight to finish, or ctx to expire, then closes hijacked connections
+// such as WebSockets, for their clients to reconnect to whatever serves
+// the address next. Wait keeps blocking.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	sv := s.current
+	s.mu.Unlock()
+	if sv == nil {
+		return nil
+	}
+	return sv.drain(ctx)
+}
+
+// Wait blocks until serving fails and returns the error
+func (s *Server) Wait() error {
+	return <-s.errs
+}
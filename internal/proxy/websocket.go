@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"localhost-magic/internal/rewrite"
+)
+
+// backendDialTimeout bounds each attempt to connect to a backend
+const backendDialTimeout = 10 * time.Second
+
+// hopHeaders only apply to one connection and aren't forwarded; Upgrade
+// and Connection are set again on the way out
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// isWebSocketUpgrade reports whether r asks to switch to a WebSocket
+func isWebSocketUpgrade(r *http.Request) bool {
+	return r.Method == http.MethodGet &&
+		headerHasToken(r.Header, "Connection", "upgrade") &&
+		strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// headerHasToken reports whether a comma-separated header such as
+// Connection lists token
+func headerHasToken(h http.Header, key, token string) bool {
+	for _, v := range h.Values(key) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serveWebSocket passes a WebSocket upgrade through to target. The
+// handshake is replayed on a connection of its own to the backend; if the
+// backend agrees, the client connection is hijacked and bytes are copied
+// both ways until both sides have closed. A side that finishes sending
+// only half-closes the other, so the rest of the conversation still
+// arrives. Shutting the server down cancels r's context and closes both.
+func (h *Handler) serveWebSocket(w *recorder, r *http.Request, route Route) {
+	ctx := r.Context()
+	host := Hostname(r.Host)
+
+	backend, err := dialBackend(ctx, "tcp", route.Target())
+	if err != nil {
+		unavailable(w, host, err)
+		return
+	}
+	if route.TLS {
+		// The upgrade is an HTTP/1.1 request, whatever else the backend speaks
+		tlsConn := tls.Client(backend, backendTLSConfig())
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			backend.Close()
+			unavailable(w, host, err)
+			return
+		}
+		backend = tlsConn
+	}
+	defer backend.Close()
+	stop := context.AfterFunc(ctx, func() { backend.Close() })
+	defer stop()
+
+	if _, err := backend.Write(upgradeRequest(r, route.Rewrite)); err != nil {
+		unavailable(w, host, err)
+		return
+	}
+	backendReader := bufio.NewReader(backend)
+	resp, err := http.ReadResponse(backendReader, r)
+	if err != nil {
+		unavailable(w, host, err)
+		return
+	}
+	route.Rewrite.Response(resp.Header)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// Refused: pass the answer on as an ordinary response
+		defer resp.Body.Close()
+		if location := resp.Header.Get("Location"); location != "" {
+			resp.Header.Set("Location", route.Rewrite.Location(location, r.Host))
+		}
+		for key, values := range resp.Header {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	client, clientBuf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		log.Printf("Proxy error for %s: failed to take over the connection: %v", host, err)
+		http.Error(w, "WebSocket upgrade unsupported", http.StatusInternalServerError)
+		return
+	}
+	defer client.Close()
+	stopClient := context.AfterFunc(ctx, func() { client.Close() })
+	defer stopClient()
+
+	var head strings.Builder
+	fmt.Fprintf(&head, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(&head)
+	head.WriteString("\r\n")
+	if _, err := clientBuf.WriteString(head.String()); err != nil {
+		return
+	}
+	if err := clientBuf.Flush(); err != nil {
+		return
+	}
+	w.access.Status = resp.StatusCode
+	w.startStream(StreamWebSocket)
+
+	// Either side may already have sent frames that sit in a buffer. Only
+	// what the client's holds is read through it: reading further would go
+	// through the HTTP server, which cancels ctx when the client half-closes.
+	fromClient := io.MultiReader(io.LimitReader(clientBuf.Reader, int64(clientBuf.Reader.Buffered())), client)
+	var wg sync.WaitGroup
+	var sent, received int64
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		sent = pipe(backend, fromClient, client)
+	}()
+	go func() {
+		defer wg.Done()
+		received = pipe(client, backendReader, backend)
+	}()
+	wg.Wait()
+	w.access.Bytes = sent + received
+}
+
+// pipe copies src to dst until src is done. A clean end half-closes dst so
+// the other direction keeps going; a failure closes both connections,
+// srcConn being src's underlying connection. It returns the bytes copied.
+func pipe(dst net.Conn, src io.Reader, srcConn net.Conn) int64 {
+	n, err := io.Copy(dst, src)
+	if err == nil || errors.Is(err, io.EOF) {
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok && cw.CloseWrite() == nil {
+			return n
+		}
+	}
+	dst.Close()
+	srcConn.Close()
+	return n
+}
+
+// upgradeRequest serializes the handshake for the backend: the original
+// Host, the client's headers without the hop-by-hop ones, and the
+// X-Forwarded headers the reverse proxy sets on other requests, then
+// rewritten by actions as other requests are
+func upgradeRequest(r *http.Request, actions rewrite.Actions) []byte {
+	header := r.Header.Clone()
+	for _, key := range header.Values("Connection") {
+		for _, name := range strings.Split(key, ",") {
+			header.Del(textproto.TrimString(name))
+		}
+	}
+	for _, key := range hopHeaders {
+		header.Del(key)
+	}
+	header.Set("Connection", "Upgrade")
+	header.Set("Upgrade", r.Header.Get("Upgrade"))
+
+	if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := r.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			clientIP = strings.Join(prior, ", ") + ", " + clientIP
+		}
+		header.Set("X-Forwarded-For", clientIP)
+	}
+	header.Set("X-Forwarded-Host", r.Host)
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	header.Set("X-Forwarded-Proto", proto)
+
+	out := &http.Request{Method: r.Method, URL: new(url.URL), Host: r.Host, Header: header}
+	*out.URL = *r.URL
+	actions.Request(out)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "GET %s HTTP/1.1\r\nHost: %s\r\n", out.URL.RequestURI(), out.Host)
+	out.Header.Write(&b)
+	b.WriteString("\r\n")
+	return []byte(b.String())
+}
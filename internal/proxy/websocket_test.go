@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// upgrade is a client's WebSocket handshake for host
+const upgrade = "GET /socket?room=1 HTTP/1.1\r\n" +
+	"Host: %s\r\n" +
+	"Connection: keep-alive, Upgrade\r\n" +
+	"Upgrade: websocket\r\n" +
+	"Proxy-Connection: keep-alive\r\n" +
+	"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+	"Sec-WebSocket-Version: 13\r\n\r\n"
+
+// wsBackend accepts WebSocket upgrades on a loopback port, sends each
+// handshake it gets on the returned channel and hands the connection to
+// talk once it has switched protocols
+func wsBackend(t *testing.T, talk func(conn *net.TCPConn, r *bufio.Reader)) (int, <-chan *http.Request) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	handshakes := make(chan *http.Request, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				req, err := http.ReadRequest(r)
+				if err != nil {
+					return
+				}
+				handshakes <- req
+				io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n\r\n")
+				talk(conn.(*net.TCPConn), r)
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port, handshakes
+}
+
+// echo sends back everything it reads, then "bye" once the client has
+// finished sending
+func echo(conn *net.TCPConn, r *bufio.Reader) {
+	io.Copy(conn, r)
+	io.WriteString(conn, "bye")
+}
+
+// wsProxy serves the proxy with route, and reports what it routed on the
+// returned channel
+func wsProxy(t *testing.T, route Route) (string, <-chan Access) {
+	t.Helper()
+	routes := NewTable()
+	routes.Set(route)
+	h := New(routes, nil)
+	accesses := make(chan Access, 4)
+	h.OnAccess(func(a Access) { accesses <- a })
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return srv.Listener.Addr().String(), accesses
+}
+
+// dialUpgrade connects to the proxy at addr, sends the handshake for host
+// followed by early, and returns the connection once it has switched, with
+// the proxy's answer
+func dialUpgrade(t *testing.T, addr, host, early string) (*net.TCPConn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// Frames sent with the handshake must not be lost in the proxy's buffer
+	if _, err := io.WriteString(conn, fmt.Sprintf(upgrade, host)+early); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
+		t.Fatalf("handshake answered %s %v, want 101 to websocket", resp.Status, resp.Header)
+	}
+	return conn.(*net.TCPConn), r, resp
+}
+
+func readN(t *testing.T, r io.Reader, n int) string {
+	t.Helper()
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatalf("read %q: %v", buf, err)
+	}
+	return string(buf)
+}
+
+func TestWebSocketEcho(t *testing.T) {
+	port, handshakes := wsBackend(t, echo)
+	addr, accesses := wsProxy(t, Route{Name: "chat.localhost", Port: port})
+
+	conn, r, _ := dialUpgrade(t, addr, "chat.localhost", "early")
+	if got := readN(t, r, 5); got != "early" {
+		t.Errorf("echoed %q, want the frame sent with the handshake", got)
+	}
+	io.WriteString(conn, "hello")
+	if got := readN(t, r, 5); got != "hello" {
+		t.Errorf("echoed %q, want hello", got)
+	}
+
+	req := <-handshakes
+	if req.Host != "chat.localhost" || req.URL.RequestURI() != "/socket?room=1" {
+		t.Errorf("backend got %s %s, want the client's host and URI", req.Host, req.URL.RequestURI())
+	}
+	if req.Header.Get("Connection") != "Upgrade" || req.Header.Get("Upgrade") != "websocket" {
+		t.Errorf("backend got Connection %q, Upgrade %q", req.Header.Get("Connection"), req.Header.Get("Upgrade"))
+	}
+	if req.Header.Get("Proxy-Connection") != "" || req.Header.Get("Keep-Alive") != "" {
+		t.Errorf("hop-by-hop headers forwarded: %v", req.Header)
+	}
+	if req.Header.Get("Sec-WebSocket-Key") != "dGhlIHNhbXBsZSBub25jZQ==" {
+		t.Errorf("Sec-WebSocket-Key %q, want the client's", req.Header.Get("Sec-WebSocket-Key"))
+	}
+	if req.Header.Get("X-Forwarded-Host") != "chat.localhost" || req.Header.Get("X-Forwarded-Proto") != "http" || req.Header.Get("X-Forwarded-For") != "127.0.0.1" {
+		t.Errorf("X-Forwarded headers %v", req.Header)
+	}
+
+	start := <-accesses
+	if start.Stream != StreamWebSocket || start.Phase != PhaseStart || start.Status != http.StatusSwitchingProtocols {
+		t.Errorf("first access %+v, want the stream's start", start)
+	}
+}
+
+func TestWebSocketClientHalfClose(t *testing.T) {
+	port, _ := wsBackend(t, echo)
+	addr, accesses := wsProxy(t, Route{Name: "chat.localhost", Port: port})
+
+	conn, r, _ := dialUpgrade(t, addr, "chat.localhost", "")
+	io.WriteString(conn, "last words")
+	if err := conn.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	// The backend sees the end of the client's side and still gets to answer
+	rest, err := io.ReadAll(r)
+	if err != nil || string(rest) != "last wordsbye" {
+		t.Errorf("read %q, %v after half-closing; want the echo, bye and EOF", rest, err)
+	}
+
+	<-accesses
+	select {
+	case end := <-accesses:
+		if end.Phase != PhaseEnd || end.Bytes != int64(len("last words")*2+len("bye")) {
+			t.Errorf("last access %+v, want the stream's end with the bytes relayed both ways", end)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stream's end was never reported")
+	}
+}
+
+func TestWebSocketBackendHalfClose(t *testing.T) {
+	var mu sync.Mutex
+	var heard string
+	done := make(chan struct{})
+	port, _ := wsBackend(t, func(conn *net.TCPConn, r *bufio.Reader) {
+		defer close(done)
+		io.WriteString(conn, "going away")
+		conn.CloseWrite()
+		b, _ := io.ReadAll(r)
+		mu.Lock()
+		heard = string(b)
+		mu.Unlock()
+	})
+	addr, _ := wsProxy(t, Route{Name: "chat.localhost", Port: port})
+
+	conn, r, _ := dialUpgrade(t, addr, "chat.localhost", "")
+	if rest, err := io.ReadAll(r); err != nil || string(rest) != "going away" {
+		t.Fatalf("read %q, %v; want the backend's message, then EOF", rest, err)
+	}
+	// The client can still send after the backend is done sending
+	io.WriteString(conn, "ack")
+	conn.CloseWrite()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the backend never saw the client finish")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if heard != "ack" {
+		t.Errorf("backend heard %q after half-closing, want ack", heard)
+	}
+}
+
+func TestWebSocketRefused(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no sockets here", http.StatusForbidden)
+	}))
+	defer backend.Close()
+	addr, _ := wsProxy(t, Route{Name: "chat.localhost", Port: backend.Listener.Addr().(*net.TCPAddr).Port})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, fmt.Sprintf(upgrade, "chat.localhost"))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusForbidden || strings.TrimSpace(string(body)) != "no sockets here" {
+		t.Errorf("got %s %q, want the backend's refusal passed on", resp.Status, body)
+	}
+}
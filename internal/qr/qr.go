@@ -0,0 +1,504 @@
+// Package qr encodes text as a QR code (ISO/IEC 18004) and draws it for a
+// terminal or as a PNG. It covers what a URL needs: byte mode at error
+// correction level M, which survives a glare on the screen, in any of the
+// 40 versions, with the mask chosen by the standard's penalty rules as
+// ZXing applies them.
+package qr
+
+import "errors"
+
+// ErrTooLong is returned for text that doesn't fit in the largest code
+var ErrTooLong = errors.New("text too long for a QR code")
+
+// Code is an encoded QR code: a square of dark and light modules, without
+// the quiet zone around it
+type Code struct {
+	size    int
+	modules []bool // Row by row; true is dark
+	fixed   []bool // Modules of the function patterns, which masks skip
+}
+
+// Size returns the number of modules on a side
+func (c *Code) Size() int {
+	return c.size
+}
+
+// Dark reports whether the module in column x of row y is dark. Modules
+// outside the code, in its quiet zone, are light.
+func (c *Code) Dark(x, y int) bool {
+	if x < 0 || y < 0 || x >= c.size || y >= c.size {
+		return false
+	}
+	return c.modules[y*c.size+x]
+}
+
+// Level M blocks per version, from the standard's table 9: how many error
+// correction codewords each block carries, and how many blocks the data
+// is split into. Index 0 is unused.
+var (
+	eccPerBlock = [41]int{0,
+		10, 16, 26, 18, 24, 16, 18, 22, 22, 26,
+		30, 22, 22, 24, 24, 28, 28, 26, 26, 26,
+		26, 28, 28, 28, 28, 28, 28, 28, 28, 28,
+		28, 28, 28, 28, 28, 28, 28, 28, 28, 28}
+	eccBlocks = [41]int{0,
+		1, 1, 1, 2, 2, 4, 4, 4, 5, 5,
+		5, 8, 9, 9, 10, 10, 11, 13, 14, 16,
+		17, 17, 18, 20, 21, 23, 25, 26, 28, 29,
+		31, 33, 35, 37, 38, 40, 43, 45, 47, 49}
+)
+
+// levelM is level M's format information bits
+const levelM = 0b00
+
+// Encode returns the smallest code holding text
+func Encode(text string) (*Code, error) {
+	data := []byte(text)
+	version := 1
+	for ; version <= 40; version++ {
+		if 4+countBits(version)+8*len(data) <= 8*dataCodewords(version) {
+			break
+		}
+	}
+	if version > 40 {
+		return nil, ErrTooLong
+	}
+
+	c := newCode(version)
+	c.placeData(c.codewords(version, data))
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		c.applyMask(mask)
+		c.drawFormat(mask)
+		if p := c.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		c.applyMask(mask) // Masks are XORs: applying one again undoes it
+	}
+	c.applyMask(best)
+	c.drawFormat(best)
+	return c, nil
+}
+
+// countBits is the length of the character count in byte mode
+func countBits(version int) int {
+	if version <= 9 {
+		return 8
+	}
+	return 16
+}
+
+// rawCodewords is how many codewords a version has room for once the
+// function patterns are drawn, data and error correction together
+func rawCodewords(version int) int {
+	bits := (16*version+128)*version + 64
+	if version >= 2 {
+		alignments := version/7 + 2
+		bits -= (25*alignments-10)*alignments - 55
+		if version >= 7 {
+			bits -= 36 // Version information
+		}
+	}
+	return bits / 8
+}
+
+// dataCodewords is how many codewords of a version carry data
+func dataCodewords(version int) int {
+	return rawCodewords(version) - eccPerBlock[version]*eccBlocks[version]
+}
+
+// codewords encodes data in byte mode, pads it to the version's capacity,
+// and returns its blocks interleaved, each followed by its error correction
+func (c *Code) codewords(version int, data []byte) []byte {
+	var b bitBuffer
+	b.append(0b0100, 4) // Byte mode
+	b.append(len(data), countBits(version))
+	for _, d := range data {
+		b.append(int(d), 8)
+	}
+	capacity := 8 * dataCodewords(version)
+	b.append(0, min(4, capacity-b.len())) // Terminator
+	b.append(0, (8-b.len()%8)%8)
+	for pad := 0xEC; b.len() < capacity; pad ^= 0xEC ^ 0x11 {
+		b.append(pad, 8)
+	}
+	padded := b.bytes()
+
+	// The first blocks are a codeword shorter than the last ones when the
+	// data doesn't split evenly
+	numBlocks := eccBlocks[version]
+	ecc := eccPerBlock[version]
+	raw := rawCodewords(version)
+	shortBlocks := numBlocks - raw%numBlocks
+	shortLen := raw/numBlocks - ecc
+	divisor := rsDivisor(ecc)
+	blocks := make([][]byte, numBlocks)
+	for i, k := 0, 0; i < numBlocks; i++ {
+		n := shortLen
+		if i >= shortBlocks {
+			n++
+		}
+		blocks[i] = padded[k : k+n]
+		k += n
+	}
+
+	out := make([]byte, 0, raw)
+	for i := 0; i <= shortLen; i++ {
+		for j, block := range blocks {
+			// Short blocks have nothing at the last index
+			if i < shortLen || j >= shortBlocks {
+				out = append(out, block[i])
+			}
+		}
+	}
+	eccs := make([][]byte, numBlocks)
+	for i, block := range blocks {
+		eccs[i] = rsRemainder(block, divisor)
+	}
+	for i := 0; i < ecc; i++ {
+		for _, e := range eccs {
+			out = append(out, e[i])
+		}
+	}
+	return out
+}
+
+// newCode returns a blank code of version with its function patterns
+// drawn, and the format area reserved
+func newCode(version int) *Code {
+	size := 4*version + 17
+	c := &Code{size: size, modules: make([]bool, size*size), fixed: make([]bool, size*size)}
+
+	for i := 0; i < size; i++ {
+		c.setFixed(6, i, i%2 == 0) // Timing patterns
+		c.setFixed(i, 6, i%2 == 0)
+	}
+	c.drawFinder(3, 3)
+	c.drawFinder(size-4, 3)
+	c.drawFinder(3, size-4)
+
+	positions := alignmentPositions(version)
+	last := len(positions) - 1
+	for i, x := range positions {
+		for j, y := range positions {
+			// Not over the finders
+			if i == 0 && j == 0 || i == 0 && j == last || i == last && j == 0 {
+				continue
+			}
+			c.drawAlignment(x, y)
+		}
+	}
+
+	c.drawFormat(0) // Reserves the area; the real mask is drawn later
+	if version >= 7 {
+		c.drawVersion(version)
+	}
+	return c
+}
+
+// setFixed sets a function module
+func (c *Code) setFixed(x, y int, dark bool) {
+	c.modules[y*c.size+x] = dark
+	c.fixed[y*c.size+x] = true
+}
+
+// drawFinder draws a finder pattern centred on x, y with its separator
+func (c *Code) drawFinder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || yy < 0 || xx >= c.size || yy >= c.size {
+				continue
+			}
+			d := max(abs(dx), abs(dy))
+			c.setFixed(xx, yy, d != 2 && d != 4)
+		}
+	}
+}
+
+// drawAlignment draws an alignment pattern centred on x, y
+func (c *Code) drawAlignment(x, y int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			c.setFixed(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+		}
+	}
+}
+
+// alignmentPositions returns the rows, and columns, alignment patterns
+// are centred on
+func alignmentPositions(version int) []int {
+	if version == 1 {
+		return nil
+	}
+	n := version/7 + 2
+	step := (version*8 + n*3 + 5) / (n*4 - 4) * 2
+	positions := make([]int, n)
+	positions[0] = 6
+	for i, pos := n-1, 4*version+10; i >= 1; i, pos = i-1, pos-step {
+		positions[i] = pos
+	}
+	return positions
+}
+
+// drawFormat draws both copies of the format information for mask
+func (c *Code) drawFormat(mask int) {
+	data := levelM<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>i&1 != 0 }
+
+	for i := 0; i <= 5; i++ {
+		c.setFixed(8, i, bit(i))
+	}
+	c.setFixed(8, 7, bit(6))
+	c.setFixed(8, 8, bit(7))
+	c.setFixed(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		c.setFixed(14-i, 8, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		c.setFixed(c.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		c.setFixed(8, c.size-15+i, bit(i))
+	}
+	c.setFixed(8, c.size-8, true) // The dark module
+}
+
+// drawVersion draws both copies of the version information
+func (c *Code) drawVersion(version int) {
+	rem := version
+	for i := 0; i < 12; i++ {
+		rem = rem<<1 ^ (rem>>11)*0x1F25
+	}
+	bits := version<<12 | rem
+	for i := 0; i < 18; i++ {
+		dark := bits>>i&1 != 0
+		a, b := c.size-11+i%3, i/3
+		c.setFixed(a, b, dark)
+		c.setFixed(b, a, dark)
+	}
+}
+
+// placeData fills the modules outside the function patterns with data, in
+// two-module columns zigzagging up and down from the bottom right
+func (c *Code) placeData(data []byte) {
+	i := 0
+	for right := c.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // Skip the vertical timing pattern
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < c.size; vert++ {
+			y := vert
+			if upward {
+				y = c.size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				x := right - j
+				if c.fixed[y*c.size+x] {
+					continue
+				}
+				// Modules past the data, the remainder bits, stay light
+				if i < 8*len(data) {
+					c.modules[y*c.size+x] = data[i/8]>>(7-i%8)&1 != 0
+					i++
+				}
+			}
+		}
+	}
+}
+
+// applyMask flips the data modules mask selects
+func (c *Code) applyMask(mask int) {
+	for y := 0; y < c.size; y++ {
+		for x := 0; x < c.size; x++ {
+			var flip bool
+			switch mask {
+			case 0:
+				flip = (x+y)%2 == 0
+			case 1:
+				flip = y%2 == 0
+			case 2:
+				flip = x%3 == 0
+			case 3:
+				flip = (x+y)%3 == 0
+			case 4:
+				flip = (x/3+y/2)%2 == 0
+			case 5:
+				flip = x*y%2+x*y%3 == 0
+			case 6:
+				flip = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				flip = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if flip && !c.fixed[y*c.size+x] {
+				c.modules[y*c.size+x] = !c.modules[y*c.size+x]
+			}
+		}
+	}
+}
+
+// Weights of the penalty rules
+const (
+	penaltyRun     = 3  // Five or more modules of a colour in a row, plus one per extra
+	penaltyBox     = 3  // Each 2x2 block of one colour
+	penaltyFinder  = 40 // Each run looking like a finder pattern
+	penaltyBalance = 10 // Each whole 5% the dark share strays from 50%
+)
+
+// finderCore is the 1:1:3:1:1 pattern of a finder
+var finderCore = [7]bool{true, false, true, true, true, false, true}
+
+// lightRun reports whether the four modules from j on line i are light
+func lightRun(at func(i, j int) bool, i, j int) bool {
+	for k := j; k < j+4; k++ {
+		if at(i, k) {
+			return false
+		}
+	}
+	return true
+}
+
+// penalty scores how hard the code is to read as masked: readers lose
+// their way in long runs, blocks and finder lookalikes, and dislike a
+// skew towards dark or light
+func (c *Code) penalty() int {
+	score := 0
+	for _, horizontal := range []bool{true, false} {
+		at := func(i, j int) bool {
+			if horizontal {
+				return c.Dark(j, i)
+			}
+			return c.Dark(i, j)
+		}
+		for i := 0; i < c.size; i++ {
+			run := 0
+			for j := 0; j < c.size; j++ {
+				if j > 0 && at(i, j) == at(i, j-1) {
+					run++
+				} else {
+					run = 1
+				}
+				if run == 5 {
+					score += penaltyRun
+				} else if run > 5 {
+					score++
+				}
+			}
+			// Outside the code counts as light, like the quiet zone. A
+			// lookalike with light on both sides counts once, as in ZXing,
+			// so the codes come out as ZXing encodes them.
+			for j := 0; j+7 <= c.size; j++ {
+				match := true
+				for k, dark := range finderCore {
+					if at(i, j+k) != dark {
+						match = false
+						break
+					}
+				}
+				if match && (lightRun(at, i, j-4) || lightRun(at, i, j+7)) {
+					score += penaltyFinder
+				}
+			}
+		}
+	}
+
+	dark := 0
+	for y := 0; y < c.size; y++ {
+		for x := 0; x < c.size; x++ {
+			d := c.Dark(x, y)
+			if d {
+				dark++
+			}
+			if x+1 < c.size && y+1 < c.size && d == c.Dark(x+1, y) && d == c.Dark(x, y+1) && d == c.Dark(x+1, y+1) {
+				score += penaltyBox
+			}
+		}
+	}
+	total := c.size * c.size
+	// Whole 5% steps of the dark share away from 50%
+	return score + abs(2*dark-total)*10/total*penaltyBalance
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// bitBuffer collects bits most significant first
+type bitBuffer struct {
+	bits []bool
+}
+
+// append adds the n low bits of v
+func (b *bitBuffer) append(v, n int) {
+	for i := n - 1; i >= 0; i-- {
+		b.bits = append(b.bits, v>>i&1 != 0)
+	}
+}
+
+func (b *bitBuffer) len() int {
+	return len(b.bits)
+}
+
+// bytes packs the bits, whose count must be a multiple of 8
+func (b *bitBuffer) bytes() []byte {
+	out := make([]byte, len(b.bits)/8)
+	for i, bit := range b.bits {
+		if bit {
+			out[i/8] |= 1 << (7 - i%8)
+		}
+	}
+	return out
+}
+
+// rsDivisor returns the Reed-Solomon generator polynomial of degree,
+// coefficients from the highest power down, the leading 1 left out
+func rsDivisor(degree int) []byte {
+	divisor := make([]byte, degree)
+	divisor[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		// Multiply by x - root
+		for j := range divisor {
+			divisor[j] = gfMul(divisor[j], root)
+			if j+1 < degree {
+				divisor[j] ^= divisor[j+1]
+			}
+		}
+		root = gfMul(root, 2)
+	}
+	return divisor
+}
+
+// rsRemainder returns the error correction codewords of data
+func rsRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, d := range divisor {
+			result[i] ^= gfMul(d, factor)
+		}
+	}
+	return result
+}
+
+// gfMul multiplies in GF(256) modulo x^8 + x^4 + x^3 + x^2 + 1
+func gfMul(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = z<<1 ^ (z>>7)*0x11D
+		z ^= int(y>>i&1) * int(x)
+	}
+	return byte(z)
+}
@@ -0,0 +1,98 @@
+package qr
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// payload returns a URL-like text of n bytes
+func payload(n int) string {
+	var b strings.Builder
+	b.WriteString("https://shop.localhost/")
+	for b.Len() < n {
+		b.WriteString("abcdefghijklmnopqrstuvwxyz")
+	}
+	return b.String()[:n]
+}
+
+// rows draws the code as lines of '#' for dark and '.' for light modules
+func rows(c *Code) []string {
+	lines := make([]string, c.Size())
+	for y := range lines {
+		var b strings.Builder
+		for x := 0; x < c.Size(); x++ {
+			if c.Dark(x, y) {
+				b.WriteByte('#')
+			} else {
+				b.WriteByte('.')
+			}
+		}
+		lines[y] = b.String()
+	}
+	return lines
+}
+
+// The matrices in testdata are ZXing's for the same text at level M
+func TestEncodeMatchesReference(t *testing.T) {
+	tests := []struct {
+		length  int
+		version int
+	}{
+		{1, 1},
+		{14, 1}, // The most version 1 holds
+		{15, 2},
+		{26, 2},
+		{27, 3},
+		{62, 4},
+		{63, 5},
+		{106, 6}, // The last without version information
+		{107, 7},
+		{122, 7},
+		{123, 8},
+		{180, 9}, // The last with an 8-bit character count
+		{181, 10},
+		{2331, 40}, // The most any code holds
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.length), func(t *testing.T) {
+			data, err := os.ReadFile(fmt.Sprintf("testdata/%d.txt", tt.length))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+
+			c, err := Encode(payload(tt.length))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size := 17 + 4*tt.version; c.Size() != size || len(want) != size {
+				t.Fatalf("size %d, fixture %d, want version %d's %d", c.Size(), len(want), tt.version, size)
+			}
+			for y, row := range rows(c) {
+				if row != want[y] {
+					t.Fatalf("row %d:\n got %s\nwant %s", y, row, want[y])
+				}
+			}
+		})
+	}
+}
+
+func TestEncodeTooLong(t *testing.T) {
+	if _, err := Encode(payload(2332)); !errors.Is(err, ErrTooLong) {
+		t.Errorf("2332 bytes: %v, want ErrTooLong", err)
+	}
+}
+
+func TestDarkOutsideIsLight(t *testing.T) {
+	c, err := Encode("https://shop.localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The top left corner is a finder's, and dark; the quiet zone isn't
+	if !c.Dark(0, 0) || c.Dark(-1, 0) || c.Dark(0, -1) || c.Dark(c.Size(), 0) || c.Dark(0, c.Size()) {
+		t.Error("want the corner dark and the modules around the code light")
+	}
+}
@@ -0,0 +1,68 @@
+package qr
+
+import (
+	"bufio"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+)
+
+// QuietZone is the light margin around a code, in modules, that readers
+// need to find it
+const QuietZone = 4
+
+// Terminal colours: black and bright white, set explicitly so the code
+// reads the same on a dark terminal as on a light one
+const (
+	fgDark, fgLight = "30", "97"
+	bgDark, bgLight = "40", "107"
+)
+
+// WriteTerminal draws the code with its quiet zone as ANSI-coloured half
+// blocks, two rows of modules per line of text, which keeps the modules
+// about square
+func (c *Code) WriteTerminal(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	for y := -QuietZone; y < c.size+QuietZone; y += 2 {
+		fg, bg := "", ""
+		for x := -QuietZone; x < c.size+QuietZone; x++ {
+			// The upper half block is drawn in the foreground colour
+			top, bottom := fgLight, bgLight
+			if c.Dark(x, y) {
+				top = fgDark
+			}
+			if c.Dark(x, y+1) {
+				bottom = bgDark
+			}
+			if top != fg || bottom != bg {
+				fg, bg = top, bottom
+				b.WriteString("\x1b[" + fg + ";" + bg + "m")
+			}
+			b.WriteString("▀")
+		}
+		b.WriteString("\x1b[0m\n")
+	}
+	return b.Flush()
+}
+
+// Image returns the code with its quiet zone, each module scale pixels
+// wide
+func (c *Code) Image(scale int) *image.Paletted {
+	scale = max(scale, 1)
+	side := (c.size + 2*QuietZone) * scale
+	img := image.NewPaletted(image.Rect(0, 0, side, side), color.Palette{color.White, color.Black})
+	for py := 0; py < side; py++ {
+		for px := 0; px < side; px++ {
+			if c.Dark(px/scale-QuietZone, py/scale-QuietZone) {
+				img.Pix[py*img.Stride+px] = 1
+			}
+		}
+	}
+	return img
+}
+
+// WritePNG writes Image(scale) as a PNG
+func (c *Code) WritePNG(w io.Writer, scale int) error {
+	return png.Encode(w, c.Image(scale))
+}
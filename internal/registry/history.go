@@ -0,0 +1,263 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"localhost-magic/probe"
+)
+
+// DefaultHistorySize is how many probes of each service a History keeps,
+// when the config doesn't say
+const DefaultHistorySize = 100
+
+// historyFlushInterval is how old the last flush must be for FlushDue to
+// write the file
+const historyFlushInterval = 30 * time.Second
+
+// Sample is one probe of a service, or the scan it went missing from
+type Sample struct {
+	Time   time.Time         `json:"time"`
+	Result probe.ProbeResult `json:"result"`
+	// Gone is set when the scan didn't find the service; Result then only
+	// has its last port
+	Gone bool `json:"gone,omitempty"`
+}
+
+// History keeps the latest probes of each service, by ID, in a file of its
+// own. Record only appends to a ring buffer in memory, so a watcher can
+// call it for every probe; Flush merges the buffers into the file while
+// holding its lock, keeping what other processes flushed meanwhile.
+type History struct {
+	path string
+
+	mu      sync.Mutex
+	size    int
+	pending map[string]*ring // Recorded since the last flush, by ID
+	flushed time.Time
+}
+
+// ring holds the latest samples of one service, up to a size
+type ring struct {
+	samples []Sample
+	next    int // Where the next sample goes once it is full
+}
+
+// add appends s, overwriting the oldest sample once there are size
+func (r *ring) add(s Sample, size int) {
+	if len(r.samples) < size {
+		r.samples = append(r.samples, s)
+		return
+	}
+	r.samples[r.next] = s
+	r.next = (r.next + 1) % len(r.samples)
+}
+
+// ordered returns the samples oldest first
+func (r *ring) ordered() []Sample {
+	return append(slices.Clone(r.samples[r.next:]), r.samples[:r.next]...)
+}
+
+// HistoryPath returns the history file kept next to the registry file at
+// path, e.g. registry-history.json
+func HistoryPath(path string) string {
+	return strings.TrimSuffix(path, ".json") + "-history.json"
+}
+
+// NewHistory returns the history kept in the file at path, which is only
+// read when needed and needn't exist yet
+func NewHistory(path string) *History {
+	return &History{path: path, size: DefaultHistorySize, pending: make(map[string]*ring), flushed: time.Now()}
+}
+
+// SetSize sets how many samples are kept per service, DefaultHistorySize
+// if n isn't positive. The file is trimmed at the next flush.
+func (h *History) SetSize(n int) {
+	if n <= 0 {
+		n = DefaultHistorySize
+	}
+	h.mu.Lock()
+	h.size = n
+	h.mu.Unlock()
+}
+
+// Record appends the probe result of service id, made at t. It doesn't
+// touch the file.
+func (h *History) Record(id string, result probe.ProbeResult, t time.Time) {
+	h.add(id, Sample{Time: t, Result: result})
+}
+
+// RecordGone records that the scan at t didn't find service id, last seen
+// on port
+func (h *History) RecordGone(id string, port int, t time.Time) {
+	h.add(id, Sample{Time: t, Result: probe.ProbeResult{Port: port}, Gone: true})
+}
+
+// add appends s to the ring buffer of id
+func (h *History) add(id string, s Sample) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ring(id).add(s, h.size)
+}
+
+// ring returns the ring buffer of id, making it if needed. The caller
+// holds mu.
+func (h *History) ring(id string) *ring {
+	r := h.pending[id]
+	if r == nil {
+		r = &ring{}
+		h.pending[id] = r
+	}
+	return r
+}
+
+// Samples returns the samples of service id, oldest first, including
+// those not flushed yet
+func (h *History) Samples(id string) ([]Sample, error) {
+	all, err := h.load()
+	if err != nil {
+		return nil, err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	samples := all[id]
+	if r := h.pending[id]; r != nil {
+		samples = append(samples, r.ordered()...)
+	}
+	return trimSamples(samples, h.size), nil
+}
+
+// FlushDue flushes the recorded samples if the last flush is getting old,
+// so a watcher can call it after every scan without writing the file each
+// time
+func (h *History) FlushDue() error {
+	h.mu.Lock()
+	due := time.Since(h.flushed) >= historyFlushInterval
+	h.mu.Unlock()
+	if !due {
+		return nil
+	}
+	return h.Flush()
+}
+
+// Flush adds the samples recorded since the last flush to the file. Those
+// recorded meanwhile wait for the next one, as do these if it fails.
+func (h *History) Flush() error {
+	h.mu.Lock()
+	pending, size := h.pending, h.size
+	h.pending = make(map[string]*ring)
+	h.flushed = time.Now()
+	h.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	err := h.update(func(all map[string][]Sample) {
+		for id, r := range pending {
+			all[id] = trimSamples(append(all[id], r.ordered()...), size)
+		}
+	})
+	if err != nil {
+		h.mu.Lock()
+		for id, r := range pending {
+			if newer := h.pending[id]; newer != nil {
+				for _, s := range newer.ordered() {
+					r.add(s, h.size)
+				}
+			}
+			h.pending[id] = r
+		}
+		h.mu.Unlock()
+	}
+	return err
+}
+
+// Remove drops the samples of the services ids
+func (h *History) Remove(ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, id := range ids {
+		delete(h.pending, id)
+	}
+	return h.update(func(all map[string][]Sample) {
+		for _, id := range ids {
+			delete(all, id)
+		}
+	})
+}
+
+// Move files the samples of service id under newID, after those newID may
+// have already
+func (h *History) Move(id, newID string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if r := h.pending[id]; r != nil {
+		delete(h.pending, id)
+		into := h.ring(newID)
+		for _, s := range r.ordered() {
+			into.add(s, h.size)
+		}
+	}
+	return h.update(func(all map[string][]Sample) {
+		if samples, ok := all[id]; ok {
+			delete(all, id)
+			all[newID] = trimSamples(append(all[newID], samples...), h.size)
+		}
+	})
+}
+
+// trimSamples returns the last size samples
+func trimSamples(samples []Sample, size int) []Sample {
+	if len(samples) > size {
+		return slices.Clone(samples[len(samples)-size:])
+	}
+	return samples
+}
+
+// update applies change to the file's samples while holding its lock, and
+// writes the result back
+func (h *History) update(change func(map[string][]Sample)) error {
+	unlock, err := lockFile(h.path + ".lock")
+	if err != nil {
+		return fmt.Errorf("failed to lock probe history: %w", err)
+	}
+	defer unlock()
+
+	all, err := h.load()
+	if err != nil {
+		return err
+	}
+	change(all)
+	data, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(h.path, data); err != nil {
+		return fmt.Errorf("failed to write probe history: %w", err)
+	}
+	return nil
+}
+
+// load reads the file's samples, by service ID
+func (h *History) load() (map[string][]Sample, error) {
+	all := make(map[string][]Sample)
+	data, err := os.ReadFile(h.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return all, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read probe history: %w", err)
+	}
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, fmt.Errorf("failed to parse probe history: %w", err)
+	}
+	return all, nil
+}
@@ -0,0 +1,871 @@
+// Package registry keeps a persistent record of the services found by
+// scans, so each one keeps the same name across restarts and port moves.
+// It is where services get their names, for the CLI's listings and the
+// daemon's routes alike. The registry is a JSON file shared by every
+// process that opens it;
+// changes take a file lock and re-read the file first, so concurrent CLI
+// invocations don't overwrite each other's edits. The latest probes of each
+// entry are kept in a History file next to it. A reverse proxy's entry has
+// the apps it serves as entries of their own, on its port (see
+// ObserveRoutes).
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"localhost-magic/internal/health"
+	"localhost-magic/internal/naming"
+	"localhost-magic/internal/scan"
+	"localhost-magic/probe"
+)
+
+// NameSource records where an entry's name came from
+type NameSource string
+
+const (
+	SourceUser    NameSource = "user"    // Set with Rename
+	SourceCwd     NameSource = "cwd"     // Working directory of the owning process
+	SourceCompose NameSource = "compose" // Docker Compose service
+	SourceTitle   NameSource = "title"   // HTML <title> of the front page
+	SourceProcess NameSource = "process" // Executable name
+	SourcePort    NameSource = "port"    // Nothing better was known
+	SourcePin     NameSource = "pin"     // Pinned to the port in the config
+	SourceRoute   NameSource = "route"   // Host or path a reverse proxy routes the app by
+	SourceStore   NameSource = "store"   // Kept from the daemon's service store, see Adopt
+)
+
+// DefaultRetention is how long an entry may go unseen before Prune
+// removes it, when the config doesn't say
+const DefaultRetention = 14 * 24 * time.Hour
+
+// touchInterval is how stale LastSeen must be for Touch to update it
+const touchInterval = time.Minute
+
+var (
+	// ErrNotFound is returned for names that aren't in the registry
+	ErrNotFound = errors.New("service not found")
+	// ErrNameTaken is returned for a rename to a name another entry has,
+	// or that the config pins to another port
+	ErrNameTaken = errors.New("name already in use")
+)
+
+// Conflict records a name two services wanted: Holder has it, Claimant
+// was given another. Holder is the one that registered first, or the one
+// on the port the config pins the name to.
+type Conflict struct {
+	Name     string `json:"name"`
+	Holder   string `json:"holder"` // Entry IDs
+	Claimant string `json:"claimant"`
+}
+
+// Entry is a registered service
+type Entry struct {
+	ID         string             `json:"id"`   // See scan.Finding.Identity
+	Name       string             `json:"name"` // e.g. "storefront.localhost"
+	NameSource NameSource         `json:"name_source"`
+	Port       int                `json:"port"`
+	Address    string             `json:"address,omitempty"` // The loopback address it answered on
+	Protocol   probe.Protocol     `json:"protocol,omitempty"`
+	LastProbe  *probe.ProbeResult `json:"last_probe,omitempty"`
+	FirstSeen  time.Time          `json:"first_seen"`
+	LastSeen   time.Time          `json:"last_seen"`
+	// Conflicts are the names this entry contested with others, recorded
+	// on both entries
+	Conflicts []Conflict `json:"conflicts,omitempty"`
+	// Fingerprint recognises the service when it comes back with another
+	// ID, e.g. restarted with other arguments on another port
+	Fingerprint *scan.Fingerprint `json:"fingerprint,omitempty"`
+	// Health is the service's health as last scored by a watcher
+	Health *health.Score `json:"health,omitempty"`
+	// Parent is the ID of the reverse proxy entry this is an app behind,
+	// on the proxy's port, and Route how the proxy picks its requests
+	Parent string       `json:"parent,omitempty"`
+	Route  *probe.Route `json:"route,omitempty"`
+}
+
+// Registry is the set of known services, indexed by ID and name
+type Registry struct {
+	path string
+
+	mu         sync.RWMutex
+	entries    map[string]*Entry // key = ID
+	names      map[string]string // name -> ID
+	pins       map[string]int    // name -> port
+	reserved   map[string]bool   // Names never derived, see SetReserved
+	onConflict func(holder, claimant Entry)
+	history    *History
+	recorded   map[string]int // Port of each ID RecordProbes last found
+}
+
+// DefaultPath returns the default registry file, next to the daemon's store
+func DefaultPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = "."
+	}
+	return filepath.Join(home, ".config", "localhost-magic", "registry.json")
+}
+
+// Open loads the registry at path, which needn't exist yet
+func Open(path string) (*Registry, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create config directory: %w", err)
+	}
+	r := &Registry{path: path, history: NewHistory(HistoryPath(path))}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload re-reads the file, picking up changes made by other processes
+func (r *Registry) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.load()
+}
+
+// SetPins makes the services found on the given ports take the names
+// pinned to them, e.g. "api.localhost" -> 8080, as the config's [names]
+// table does. A pin wins over any other claim on its name: an entry that
+// already has it is given another.
+func (r *Registry) SetPins(pins map[string]int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pins = make(map[string]int, len(pins))
+	for name, port := range pins {
+		r.pins[normalizeName(name)] = port
+	}
+}
+
+// SetReserved keeps names the registry doesn't know of from being given to
+// new entries, e.g. those of the daemon's manual services, which are only
+// in its store. A new service deriving one of them is named as if another
+// entry had it; Rename and Adopt leave it to the caller to check them.
+func (r *Registry) SetReserved(names []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reserved = make(map[string]bool, len(names))
+	for _, name := range names {
+		r.reserved[normalizeName(name)] = true
+	}
+}
+
+// OnConflict registers fn to be called after a change that left two
+// entries contesting a name, with the entries as they now are
+func (r *Registry) OnConflict(fn func(holder, claimant Entry)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onConflict = fn
+}
+
+// Get returns the entry named name
+func (r *Registry) Get(name string) (Entry, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	id, ok := r.names[normalizeName(name)]
+	if !ok {
+		return Entry{}, false
+	}
+	return *r.entries[id], true
+}
+
+// List returns every entry, sorted by name
+func (r *Registry) List() []Entry {
+	r.mu.RLock()
+	entries := make([]Entry, 0, len(r.entries))
+	for _, e := range r.entries {
+		entries = append(entries, *e)
+	}
+	r.mu.RUnlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries
+}
+
+// Rename gives the entry named oldName a user-chosen name, which later
+// scans keep. A name in use by another entry, or pinned to another port,
+// is refused with ErrNameTaken.
+func (r *Registry) Rename(oldName, newName string) error {
+	_, err := r.rename(oldName, newName, SourceUser)
+	return err
+}
+
+// Adopt gives the entry named name the name the service had before the
+// registry knew it, e.g. in the daemon's store, and returns the entry.
+// Unless user says that name was chosen by the user, it is recorded as
+// SourceStore and pruned like a derived one. Names are refused as by
+// Rename.
+func (r *Registry) Adopt(name, previous string, user bool) (Entry, error) {
+	source := SourceStore
+	if user {
+		source = SourceUser
+	}
+	return r.rename(name, previous, source)
+}
+
+// rename names the entry named oldName newName, from source
+func (r *Registry) rename(oldName, newName string, source NameSource) (Entry, error) {
+	oldName, newName = normalizeName(oldName), normalizeName(newName)
+	if newName == "" {
+		return Entry{}, errors.New("new name is empty")
+	}
+	var renamed Entry
+	err := r.update(func() error {
+		id, ok := r.names[oldName]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrNotFound, oldName)
+		}
+		e := r.entries[id]
+		if other, taken := r.names[newName]; taken && other != id {
+			return fmt.Errorf("%w: %s", ErrNameTaken, newName)
+		}
+		if port, pinned := r.pins[newName]; pinned && port != e.Port {
+			return fmt.Errorf("%w: %s is pinned to port %d", ErrNameTaken, newName, port)
+		}
+		delete(r.names, e.Name)
+		e.Name = newName
+		e.NameSource = source
+		r.names[newName] = id
+		renamed = *e
+		return nil
+	})
+	return renamed, err
+}
+
+// Forget removes the entry named name, its history and the apps behind
+// it. If the service is seen again it is registered afresh, with a derived
+// name.
+func (r *Registry) Forget(name string) error {
+	name = normalizeName(name)
+	var forgotten string
+	err := r.update(func() error {
+		id, ok := r.names[name]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrNotFound, name)
+		}
+		r.remove(id)
+		forgotten = id
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return r.history.Remove(forgotten)
+}
+
+// remove drops the entry id, the apps behind it if it is a reverse proxy,
+// and the conflicts other entries recorded with them. Must hold r.mu.
+func (r *Registry) remove(id string) {
+	e, ok := r.entries[id]
+	if !ok {
+		return
+	}
+	if r.names[e.Name] == id {
+		delete(r.names, e.Name)
+	}
+	delete(r.entries, id)
+	for _, e := range r.entries {
+		e.Conflicts = slices.DeleteFunc(e.Conflicts, func(c Conflict) bool {
+			return c.Holder == id || c.Claimant == id
+		})
+	}
+	for childID, e := range r.entries {
+		if e.Parent == id {
+			r.remove(childID)
+		}
+	}
+}
+
+// rekey moves the entry id to newID, along with its name and the
+// conflicts that refer to it
+func (r *Registry) rekey(id, newID string) {
+	e, ok := r.entries[id]
+	if !ok {
+		return
+	}
+	delete(r.entries, id)
+	e.ID = newID
+	r.entries[newID] = e
+	if r.names[e.Name] == id {
+		r.names[e.Name] = newID
+	}
+	for _, other := range r.entries {
+		if other.Parent == id {
+			other.Parent = newID
+		}
+		for i, c := range other.Conflicts {
+			if c.Holder == id {
+				other.Conflicts[i].Holder = newID
+			}
+			if c.Claimant == id {
+				other.Conflicts[i].Claimant = newID
+			}
+		}
+	}
+}
+
+// moved returns the entry a finding that isn't registered under its ID is
+// the same service as, going by fingerprints: one whose ID none of the
+// findings being observed has. Entries matched before are under one of
+// those IDs by then. An ambiguous match, such as two identical servers
+// the finding could be either of, returns none.
+func (r *Registry) moved(f scan.Finding, observing map[string]bool) (*Entry, bool) {
+	var candidates []*Entry
+	var fingerprints []scan.Fingerprint
+	for id, e := range r.entries {
+		if e.Fingerprint != nil && !observing[id] {
+			candidates = append(candidates, e)
+		}
+	}
+	// In ID order, so the outcome doesn't depend on map order
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].ID < candidates[j].ID })
+	for _, e := range candidates {
+		fingerprints = append(fingerprints, *e.Fingerprint)
+	}
+	i, ok := scan.BestMatch(f.Fingerprint(), fingerprints)
+	if !ok {
+		return nil, false
+	}
+	return candidates[i], true
+}
+
+// ObserveRoutes records the apps a reverse proxy serves on the port of
+// proxy, its finding, as entries of their own under the proxy's, and
+// returns them in the order of routes. Call it once Observe has registered
+// the proxy. An app already registered for the same route on that port
+// keeps its name; a new one is named after its Host or path prefix (see
+// naming.AppName), numbered if another entry has the name. A route that is
+// the proxy itself gets none.
+func (r *Registry) ObserveRoutes(proxy scan.Finding, routes []probe.Route) ([]Entry, error) {
+	parentID := proxy.Identity()
+	var observed []Entry
+	err := r.update(func() error {
+		parent, ok := r.entries[parentID]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrNotFound, parentID)
+		}
+		apps := make(map[string]*Entry)
+		for _, e := range r.entries {
+			if e.Parent == parentID && e.Route != nil && e.Port == proxy.Port {
+				apps[e.Route.Key()] = e
+			}
+		}
+		now := time.Now()
+		for _, route := range routes {
+			e, ok := apps[route.Key()]
+			if !ok {
+				name := naming.AppName(parent.Name, route.Host, route.Path)
+				if name == "" {
+					continue
+				}
+				e = &Entry{ID: fmt.Sprintf("app:%s:%d/%s", parentID, proxy.Port, route.Key()), NameSource: SourceRoute, FirstSeen: now, Parent: parentID}
+				r.entries[e.ID] = e
+				r.setName(e, r.uniqueName(strings.TrimSuffix(name, ".localhost")))
+				apps[route.Key()] = e
+			}
+			route := route
+			e.Route = &route
+			e.Port, e.Address, e.Protocol = proxy.Port, proxy.Address, proxy.Protocol
+			e.LastSeen = now
+			observed = append(observed, *e)
+		}
+		return nil
+	})
+	return observed, err
+}
+
+// Exempt reports whether the entry is kept however long it goes unseen:
+// its name was chosen by the user or pinned in the config
+func (e Entry) Exempt() bool {
+	return e.NameSource == SourceUser || e.NameSource == SourcePin
+}
+
+// Stale reports whether the entry hasn't been seen for maxAge at now
+func (e Entry) Stale(maxAge time.Duration, now time.Time) bool {
+	return e.LastSeen.Before(now.Add(-maxAge))
+}
+
+// Prune removes the entries not seen for maxAge, DefaultRetention if zero,
+// apart from exempt ones, along with their history and the apps behind
+// them, and returns them. With dryRun it only returns them.
+func (r *Registry) Prune(maxAge time.Duration, dryRun bool) ([]Entry, error) {
+	if maxAge <= 0 {
+		maxAge = DefaultRetention
+	}
+	var pruned []Entry
+	var ids []string
+	err := r.update(func() error {
+		now := time.Now()
+		for id, e := range r.entries {
+			if !e.Exempt() && e.Stale(maxAge, now) {
+				pruned = append(pruned, *e)
+				if !dryRun {
+					r.remove(id)
+					ids = append(ids, id)
+				}
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		err = r.history.Remove(ids...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(pruned, func(i, j int) bool { return pruned[i].Name < pruned[j].Name })
+	return pruned, nil
+}
+
+// Touch records that the registered services among findings are still
+// there. It doesn't register new ones, which Observe does. LastSeen only
+// moves once it is touchInterval old, so a watcher calling Touch after
+// every scan doesn't rewrite the file each time.
+func (r *Registry) Touch(findings ...scan.Finding) error {
+	now := time.Now()
+	due := func() bool {
+		for _, f := range findings {
+			if e, ok := r.entries[f.Identity()]; ok && f.State == scan.StateOpen && now.Sub(e.LastSeen) >= touchInterval {
+				return true
+			}
+		}
+		return false
+	}
+	r.mu.RLock()
+	touch := due()
+	r.mu.RUnlock()
+	if !touch {
+		return nil
+	}
+	return r.update(func() error {
+		for _, f := range findings {
+			if e, ok := r.entries[f.Identity()]; ok && f.State == scan.StateOpen {
+				e.LastSeen = now
+			}
+		}
+		return nil
+	})
+}
+
+// SetHealth records the health scores of entries, by ID. Like Touch it
+// only writes the file when a state changed or the recorded score is
+// getting old, so a watcher can call it after every scan.
+func (r *Registry) SetHealth(scores map[string]health.Score) error {
+	due := func() bool {
+		for id, score := range scores {
+			if e, ok := r.entries[id]; ok && (e.Health == nil || e.Health.State != score.State || score.Checked.Sub(e.Health.Checked) >= touchInterval) {
+				return true
+			}
+		}
+		return false
+	}
+	r.mu.RLock()
+	write := due()
+	r.mu.RUnlock()
+	if !write {
+		return nil
+	}
+	return r.update(func() error {
+		for id, score := range scores {
+			if e, ok := r.entries[id]; ok {
+				score := score
+				e.Health = &score
+			}
+		}
+		return nil
+	})
+}
+
+// SetHistorySize sets how many probes of each entry its history keeps,
+// DefaultHistorySize if n isn't positive
+func (r *Registry) SetHistorySize(n int) {
+	r.history.SetSize(n)
+}
+
+// RecordProbes adds the probes of the open findings of a scan to the
+// history of their entries, and records the entries the previous call
+// found but this one didn't as gone. Like Touch it only writes the history
+// file every so often, so a watcher can call it after every scan; call
+// FlushHistory before exiting.
+func (r *Registry) RecordProbes(findings ...scan.Finding) error {
+	now := time.Now()
+	found := make(map[string]int)
+	r.mu.Lock()
+	for _, f := range findings {
+		id := f.Identity()
+		if _, ok := r.entries[id]; ok && f.State == scan.StateOpen {
+			r.history.Record(id, f.ProbeResult, now)
+			found[id] = f.Port
+		}
+	}
+	for id, port := range r.recorded {
+		if _, ok := found[id]; !ok {
+			r.history.RecordGone(id, port, now)
+		}
+	}
+	r.recorded = found
+	r.mu.Unlock()
+	return r.history.FlushDue()
+}
+
+// FlushHistory writes the probes RecordProbes has recorded since the
+// history file was last written
+func (r *Registry) FlushHistory() error {
+	return r.history.Flush()
+}
+
+// History returns the entry named name and its recorded probes, oldest
+// first
+func (r *Registry) History(name string) (Entry, []Sample, error) {
+	e, ok := r.Get(name)
+	if !ok {
+		return Entry{}, nil, fmt.Errorf("%w: %s", ErrNotFound, normalizeName(name))
+	}
+	samples, err := r.history.Samples(e.ID)
+	return e, samples, err
+}
+
+// Observe records the open findings of a scan and returns their entries,
+// in port order. A service already registered under the same identity
+// keeps its name, whatever port it is on now; a new one is named from its
+// process working directory, Compose service or HTML title, in that
+// order. A service on a pinned port takes the pinned name instead. Attach
+// processes and containers to the findings first for stable identities.
+//
+// A finding whose ID isn't registered is matched to an existing entry by
+// fingerprint (see scan.Fingerprint) before being taken for a new service:
+// a dev server restarted on another port with other arguments keeps its
+// entry and name, under its new ID.
+//
+// When a new service derives a name another entry has, the other entry
+// keeps it and the newcomer is named after its parent directory as well,
+// e.g. storefront-api, or failing that numbered, e.g. api-2. Findings are
+// taken in port order, so the outcome doesn't depend on the order they
+// were given in.
+func (r *Registry) Observe(findings ...scan.Finding) ([]Entry, error) {
+	findings = slices.Clone(findings)
+	sort.SliceStable(findings, func(i, j int) bool { return findings[i].Port < findings[j].Port })
+
+	observing := make(map[string]bool, len(findings))
+	for _, f := range findings {
+		if f.State == scan.StateOpen {
+			observing[f.Identity()] = true
+		}
+	}
+
+	var seen []*Entry
+	var observed []Entry
+	var conflicts []Conflict
+	moves := make(map[string]string) // Old ID -> new
+	err := r.update(func() error {
+		now := time.Now()
+		for _, f := range findings {
+			if f.State != scan.StateOpen {
+				continue
+			}
+			id := f.Identity()
+			pin := r.pinnedName(f.Port)
+			e, ok := r.entries[id]
+			if !ok {
+				if e, ok = r.moved(f, observing); ok {
+					moves[e.ID] = id
+					r.rekey(e.ID, id)
+				}
+			}
+			switch {
+			case !ok && pin != "":
+				e = &Entry{ID: id, NameSource: SourcePin, FirstSeen: now}
+				r.entries[id] = e
+				if c, ok := r.claim(e, pin); ok {
+					conflicts = append(conflicts, c)
+				}
+			case !ok:
+				e = &Entry{ID: id, FirstSeen: now}
+				r.entries[id] = e
+				var name string
+				name, e.NameSource = deriveName(f)
+				if c, ok := r.name(e, name, f); ok {
+					conflicts = append(conflicts, c)
+				}
+			case pin != "" && e.Name != pin:
+				e.NameSource = SourcePin
+				if c, ok := r.claim(e, pin); ok {
+					conflicts = append(conflicts, c)
+				}
+			}
+			result := f.ProbeResult
+			e.Port = f.Port
+			e.Address = f.Address
+			e.Protocol = result.Protocol
+			e.LastProbe = &result
+			fingerprint := f.Fingerprint()
+			e.Fingerprint = &fingerprint
+			e.LastSeen = now
+			seen = append(seen, e)
+		}
+		// Copied once every finding is in, since a later one may have
+		// taken an earlier one's name
+		for _, e := range seen {
+			observed = append(observed, *e)
+		}
+		return nil
+	})
+	if err != nil {
+		return observed, err
+	}
+	r.notifyConflicts(conflicts)
+	for id, newID := range moves {
+		if err := r.history.Move(id, newID); err != nil {
+			return observed, err
+		}
+	}
+	return observed, nil
+}
+
+// name gives a new entry base as its name or, if another entry has it, a
+// derived one, reporting the conflict
+func (r *Registry) name(e *Entry, base string, f scan.Finding) (Conflict, bool) {
+	base = naming.SanitizeName(base)
+	wanted := base + ".localhost"
+	holder, taken := r.names[wanted]
+	if !taken && !r.unavailable(wanted, f.Port) {
+		r.setName(e, wanted)
+		return Conflict{}, false
+	}
+
+	name := ""
+	if e.NameSource == SourceCwd {
+		// Two checkouts both called api: qualify with the parent directory
+		parent := filepath.Base(filepath.Dir(filepath.Clean(f.Process.Cwd)))
+		if parent != "/" && parent != "." && !isGenericParent(parent) {
+			candidate := naming.SanitizeName(parent+"-"+base) + ".localhost"
+			if r.names[candidate] == "" && !r.unavailable(candidate, f.Port) {
+				name = candidate
+			}
+		}
+	}
+	if name == "" {
+		name = r.uniqueName(base)
+	}
+	r.setName(e, name)
+	if !taken {
+		return Conflict{}, false // Reserved, e.g. by a pin nothing is on yet
+	}
+	return r.recordConflict(wanted, holder, e.ID), true
+}
+
+// claim gives e a pinned name, moving any other entry that has it to a
+// numbered variant
+func (r *Registry) claim(e *Entry, pin string) (Conflict, bool) {
+	holderID, taken := r.names[pin]
+	if !taken || holderID == e.ID {
+		r.setName(e, pin)
+		return Conflict{}, false
+	}
+	// Free the name first so the displaced entry's variant can't be it
+	displaced := r.entries[holderID]
+	delete(r.names, pin)
+	r.setName(e, pin)
+	r.setName(displaced, r.uniqueName(strings.TrimSuffix(pin, ".localhost")))
+	return r.recordConflict(pin, e.ID, displaced.ID), true
+}
+
+// setName renames e, keeping the name index in step
+func (r *Registry) setName(e *Entry, name string) {
+	if r.names[e.Name] == e.ID {
+		delete(r.names, e.Name)
+	}
+	e.Name = name
+	r.names[name] = e.ID
+}
+
+// recordConflict notes the conflict on both entries, once
+func (r *Registry) recordConflict(name, holder, claimant string) Conflict {
+	c := Conflict{Name: name, Holder: holder, Claimant: claimant}
+	for _, id := range []string{holder, claimant} {
+		if e := r.entries[id]; !slices.Contains(e.Conflicts, c) {
+			e.Conflicts = append(e.Conflicts, c)
+		}
+	}
+	return c
+}
+
+// notifyConflicts hands new conflicts to the OnConflict callback
+func (r *Registry) notifyConflicts(conflicts []Conflict) {
+	r.mu.RLock()
+	fn := r.onConflict
+	var pairs [][2]Entry
+	for _, c := range conflicts {
+		holder, claimant := r.entries[c.Holder], r.entries[c.Claimant]
+		if holder != nil && claimant != nil {
+			pairs = append(pairs, [2]Entry{*holder, *claimant})
+		}
+	}
+	r.mu.RUnlock()
+	if fn == nil {
+		return
+	}
+	for _, pair := range pairs {
+		fn(pair[0], pair[1])
+	}
+}
+
+// pinnedName returns the name pinned to port, or ""
+func (r *Registry) pinnedName(port int) string {
+	for name, p := range r.pins {
+		if p == port {
+			return name
+		}
+	}
+	return ""
+}
+
+// unavailable reports whether name, which no entry has, can't be given to
+// a new entry on port: it is pinned to another port, or reserved
+func (r *Registry) unavailable(name string, port int) bool {
+	p, pinned := r.pins[name]
+	return pinned && p != port || r.reserved[name]
+}
+
+// isGenericParent reports whether a parent directory says nothing about
+// the project, like src in ~/src/api
+func isGenericParent(name string) bool {
+	home, _ := os.UserHomeDir()
+	switch strings.ToLower(name) {
+	case "src", "code", "projects", "repos", "dev", "work", "tmp", strings.ToLower(filepath.Base(home)):
+		return true
+	}
+	return false
+}
+
+// deriveName picks a name for a new service, without the .localhost suffix
+func deriveName(f scan.Finding) (string, NameSource) {
+	if f.Process != nil && f.Process.Cwd != "" {
+		// "/" is where daemons and container proxies run, and the home
+		// directory says nothing about the project
+		home, _ := os.UserHomeDir()
+		if cwd := filepath.Clean(f.Process.Cwd); cwd != "/" && cwd != home {
+			return filepath.Base(cwd), SourceCwd
+		}
+	}
+	if f.Container != nil && f.Container.Service != "" {
+		return f.Container.Service, SourceCompose
+	}
+	if f.Title != "" {
+		return f.Title, SourceTitle
+	}
+	if f.Process != nil && f.Process.Name != "" {
+		return f.Process.Name, SourceProcess
+	}
+	return fmt.Sprintf("port-%d", f.Port), SourcePort
+}
+
+// uniqueName sanitizes base and appends -2, -3, ... until it is neither
+// used, pinned nor reserved
+func (r *Registry) uniqueName(base string) string {
+	base = naming.SanitizeName(base)
+	name := base + ".localhost"
+	for i := 2; r.names[name] != "" || r.pins[name] != 0 || r.reserved[name]; i++ {
+		name = fmt.Sprintf("%s-%d.localhost", base, i)
+	}
+	return name
+}
+
+// normalizeName lowercases name and adds the .localhost suffix if missing
+func normalizeName(name string) string {
+	name = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+	if name != "" && !strings.HasSuffix(name, ".localhost") {
+		name += ".localhost"
+	}
+	return name
+}
+
+// update applies change to the latest version of the file while holding
+// the file lock, and writes the result back
+func (r *Registry) update(change func() error) error {
+	unlock, err := lockFile(r.path + ".lock")
+	if err != nil {
+		return fmt.Errorf("failed to lock registry: %w", err)
+	}
+	defer unlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.load(); err != nil {
+		return err
+	}
+	if err := change(); err != nil {
+		return err
+	}
+	return r.persist()
+}
+
+// load replaces the in-memory index with the file's contents
+func (r *Registry) load() error {
+	r.entries = make(map[string]*Entry)
+	r.names = make(map[string]string)
+
+	data, err := os.ReadFile(r.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read registry: %w", err)
+	}
+	var entries []*Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("failed to parse registry: %w", err)
+	}
+	for _, e := range entries {
+		r.entries[e.ID] = e
+		r.names[e.Name] = e.ID
+	}
+	return nil
+}
+
+// persist writes the registry through a temporary file renamed into
+// place, so readers never see a partial file
+func (r *Registry) persist() error {
+	entries := make([]*Entry, 0, len(r.entries))
+	for _, e := range r.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFile(r.path, data); err != nil {
+		return fmt.Errorf("failed to write registry: %w", err)
+	}
+	return nil
+}
+
+// writeFile writes data to a temporary file and renames it over path
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+strings.TrimSuffix(filepath.Base(path), ".json")+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,278 @@
+package registry
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"localhost-magic/internal/procmap"
+	"localhost-magic/internal/scan"
+	"localhost-magic/probe"
+)
+
+// openTemp opens a registry in a directory of its own
+func openTemp(t *testing.T) *Registry {
+	t.Helper()
+	r, err := Open(filepath.Join(t.TempDir(), "registry.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// devServer is an open HTTP finding for exe run in cwd
+func devServer(port int, exe, cwd string, args ...string) scan.Finding {
+	return scan.Finding{
+		State:       scan.StateOpen,
+		ProbeResult: probe.ProbeResult{Port: port, Address: "127.0.0.1", Protocol: probe.ProtocolHTTP1},
+		Process:     &procmap.Process{Port: port, Exe: exe, Cwd: cwd, Args: append([]string{exe}, args...)},
+	}
+}
+
+// names maps the observed entries' ports to their names
+func names(entries []Entry) map[int]string {
+	m := make(map[int]string, len(entries))
+	for _, e := range entries {
+		m[e.Port] = e.Name
+	}
+	return m
+}
+
+func observe(t *testing.T, r *Registry, findings ...scan.Finding) map[int]string {
+	t.Helper()
+	entries, err := r.Observe(findings...)
+	if err != nil {
+		t.Fatalf("Observe: %v", err)
+	}
+	return names(entries)
+}
+
+func TestObserveQualifiesConflictWithParent(t *testing.T) {
+	r := openTemp(t)
+	var holder, claimant Entry
+	calls := 0
+	r.OnConflict(func(h, c Entry) { holder, claimant, calls = h, c, calls+1 })
+
+	got := observe(t, r,
+		devServer(3001, "/usr/bin/node", "/home/dev/storefront/api"),
+		devServer(3000, "/usr/bin/node", "/home/dev/blog/api"),
+	)
+	// Port order decides, whatever order the findings came in
+	if got[3000] != "api.localhost" || got[3001] != "storefront-api.localhost" {
+		t.Errorf("names %v, want api on 3000 and storefront-api on 3001", got)
+	}
+	if calls != 1 || holder.Port != 3000 || claimant.Port != 3001 {
+		t.Errorf("OnConflict called %d times with %d, %d; want once with 3000, 3001", calls, holder.Port, claimant.Port)
+	}
+	for _, name := range []string{"api.localhost", "storefront-api.localhost"} {
+		e, _ := r.Get(name)
+		if len(e.Conflicts) != 1 || e.Conflicts[0].Name != "api.localhost" {
+			t.Errorf("%s conflicts %+v, want the one over api.localhost", name, e.Conflicts)
+		}
+	}
+}
+
+func TestObserveNumbersConflictUnderGenericParent(t *testing.T) {
+	r := openTemp(t)
+	got := observe(t, r,
+		devServer(3000, "/usr/bin/node", "/home/dev/storefront/api"),
+		devServer(3001, "/usr/bin/node", "/home/dev/src/api"),
+	)
+	if got[3001] != "api-2.localhost" {
+		t.Errorf("port 3001 named %q, want api-2.localhost", got[3001])
+	}
+}
+
+func TestObserveKeepsNamesOfKnownServices(t *testing.T) {
+	r := openTemp(t)
+	storefront := devServer(3001, "/usr/bin/node", "/home/dev/storefront/api")
+	observe(t, r, storefront)
+	// The newcomer on a lower port doesn't take the name from the holder
+	got := observe(t, r, devServer(3000, "/usr/bin/node", "/home/dev/blog/api"), storefront)
+	if got[3001] != "api.localhost" || got[3000] != "blog-api.localhost" {
+		t.Errorf("names %v, want api kept on 3001 and blog-api on 3000", got)
+	}
+}
+
+func TestObserveIsDeterministic(t *testing.T) {
+	findings := []scan.Finding{
+		devServer(5173, "/usr/bin/node", "/home/dev/shop/web"),
+		devServer(5174, "/usr/bin/node", "/home/dev/admin/web"),
+		devServer(5175, "/usr/bin/node", "/home/dev/docs/web"),
+	}
+	want := observe(t, openTemp(t), findings...)
+	reversed := []scan.Finding{findings[2], findings[1], findings[0]}
+	got := observe(t, openTemp(t), reversed...)
+	for port, name := range want {
+		if got[port] != name {
+			t.Errorf("port %d named %q in reverse order, %q in order", port, got[port], name)
+		}
+	}
+}
+
+func TestPinDisplacesHolder(t *testing.T) {
+	r := openTemp(t)
+	observe(t, r, devServer(3000, "/usr/bin/node", "/home/dev/blog/api"))
+	r.SetPins(map[string]int{"api.localhost": 8080})
+	var conflicts int
+	r.OnConflict(func(holder, claimant Entry) { conflicts++ })
+
+	got := observe(t, r,
+		devServer(3000, "/usr/bin/node", "/home/dev/blog/api"),
+		devServer(8080, "/usr/bin/go", "/home/dev/shop/server"),
+	)
+	if got[8080] != "api.localhost" || got[3000] != "api-2.localhost" {
+		t.Errorf("names %v, want the pin on 8080 and api-2 on 3000", got)
+	}
+	if e, _ := r.Get("api.localhost"); e.NameSource != SourcePin {
+		t.Errorf("pinned entry's source %q, want %q", e.NameSource, SourcePin)
+	}
+	if conflicts != 1 {
+		t.Errorf("OnConflict called %d times, want once", conflicts)
+	}
+}
+
+func TestPinReservesNameForItsPort(t *testing.T) {
+	r := openTemp(t)
+	r.SetPins(map[string]int{"api.localhost": 8080})
+	got := observe(t, r, devServer(3000, "/usr/bin/node", "/home/dev/blog/api"))
+	if got[3000] != "blog-api.localhost" {
+		t.Errorf("port 3000 named %q, want blog-api.localhost", got[3000])
+	}
+}
+
+func TestReservedNamesAreSkipped(t *testing.T) {
+	r := openTemp(t)
+	r.SetReserved([]string{"api", "blog-api.localhost"})
+	got := observe(t, r, devServer(3000, "/usr/bin/node", "/home/dev/blog/api"))
+	if got[3000] != "api-2.localhost" {
+		t.Errorf("port 3000 named %q, want api-2.localhost", got[3000])
+	}
+	if e, _ := r.Get("api-2.localhost"); len(e.Conflicts) != 0 {
+		t.Errorf("conflicts %+v recorded with a name no entry has", e.Conflicts)
+	}
+}
+
+func TestRenameRefusesTakenNames(t *testing.T) {
+	r := openTemp(t)
+	r.SetPins(map[string]int{"admin.localhost": 9000})
+	observe(t, r,
+		devServer(3000, "/usr/bin/node", "/home/dev/shop/web"),
+		devServer(3001, "/usr/bin/node", "/home/dev/blog/api"),
+	)
+	for _, name := range []string{"api", "admin.localhost"} {
+		if err := r.Rename("web.localhost", name); !errors.Is(err, ErrNameTaken) {
+			t.Errorf("Rename to %s: %v, want ErrNameTaken", name, err)
+		}
+	}
+	if err := r.Rename("web.localhost", "Storefront"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	e, ok := r.Get("storefront.localhost")
+	if !ok || e.Port != 3000 || e.NameSource != SourceUser {
+		t.Errorf("renamed entry %+v, want port 3000 named by the user", e)
+	}
+	// A user's name survives the next scan
+	got := observe(t, r, devServer(3000, "/usr/bin/node", "/home/dev/shop/web"))
+	if got[3000] != "storefront.localhost" {
+		t.Errorf("port 3000 named %q after a scan, want storefront.localhost", got[3000])
+	}
+}
+
+func TestNamesSurviveReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.json")
+	r, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := observe(t, r,
+		devServer(3000, "/usr/bin/node", "/home/dev/blog/api"),
+		devServer(3001, "/usr/bin/node", "/home/dev/storefront/api"),
+	)
+	r, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for port, name := range want {
+		if e, ok := r.Get(name); !ok || e.Port != port {
+			t.Errorf("after reopening, %s is %+v, want port %d", name, e, port)
+		}
+	}
+}
+
+// viteServer is a Vite dev server on port, run in cwd with args
+func viteServer(port int, cwd string, args ...string) scan.Finding {
+	f := devServer(port, "/usr/bin/node", cwd, append([]string{"node_modules/.bin/vite"}, args...)...)
+	f.Title, f.FaviconHash = "Vite App", 1790006171
+	return f
+}
+
+func TestObserveFollowsMovedService(t *testing.T) {
+	r := openTemp(t)
+	before := viteServer(5173, "/home/dev/shop/web")
+	observe(t, r, before)
+	if err := r.Rename("web.localhost", "shop"); err != nil {
+		t.Fatal(err)
+	}
+	// Restarted with other arguments on another port
+	after := viteServer(5180, "/home/dev/shop/web", "--port", "5180")
+	if after.Identity() == before.Identity() {
+		t.Fatal("restarted server has the same identity")
+	}
+	entries, err := r.Observe(after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].ID != after.Identity() || entries[0].Name != "shop.localhost" || entries[0].Port != 5180 {
+		t.Errorf("observed %+v, want shop.localhost under the new identity on 5180", entries)
+	}
+	if got := len(r.List()); got != 1 {
+		t.Errorf("%d entries after the move, want 1", got)
+	}
+}
+
+func TestObserveDoesNotMoveServicesStillUp(t *testing.T) {
+	r := openTemp(t)
+	first := viteServer(5173, "/home/dev/shop/web")
+	observe(t, r, first)
+	// A second server in the same directory while the first still runs
+	got := observe(t, r, first, viteServer(5174, "/home/dev/shop/web", "--port", "5174"))
+	if got[5173] != "web.localhost" || got[5174] != "shop-web.localhost" {
+		t.Errorf("names %v, want web on 5173 and a name of its own for 5174", got)
+	}
+}
+
+func TestObserveIgnoresAmbiguousMatches(t *testing.T) {
+	r := openTemp(t)
+	observe(t, r, viteServer(5173, "/home/dev/shop/web"), viteServer(5174, "/home/dev/blog/web"))
+	// Two identical Vite servers went away; a third in another directory
+	// is neither of them
+	got := observe(t, r, viteServer(5175, "/home/dev/docs/web"))
+	if got[5175] != "docs-web.localhost" {
+		t.Errorf("port 5175 named %q, want a name of its own", got[5175])
+	}
+	if n := len(r.List()); n != 3 {
+		t.Errorf("%d entries, want 3: neither server was taken over", n)
+	}
+
+	// The same page with no process to go by could be either server
+	page := scan.Finding{State: scan.StateOpen, ProbeResult: probe.ProbeResult{
+		Port: 5176, Address: "127.0.0.1", Protocol: probe.ProtocolHTTP1, Title: "Vite App", FaviconHash: 1790006171,
+	}}
+	entries, err := r.Observe(page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].ID != "port:5176" || entries[0].FirstSeen != entries[0].LastSeen {
+		t.Errorf("observed %+v, want a new entry", entries)
+	}
+}
+
+func TestObserveMatchesTheServiceInItsDirectory(t *testing.T) {
+	r := openTemp(t)
+	observe(t, r, viteServer(5173, "/home/dev/shop/web"), viteServer(5174, "/home/dev/blog/web"))
+	got := observe(t, r, viteServer(5190, "/home/dev/blog/web", "--host", "127.0.0.1"))
+	if got[5190] != "blog-web.localhost" {
+		t.Errorf("port 5190 named %q, want blog-web.localhost, the blog server's", got[5190])
+	}
+}
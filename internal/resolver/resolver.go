@@ -0,0 +1,339 @@
+// Package resolver is a small authoritative DNS server for the .localhost
+// zone. Every name under .localhost resolves to the loopback addresses, so
+// no /etc/hosts entries are needed, and registered services can also be
+// looked up for their port. Anything outside the zone gets NXDOMAIN; the
+// server never recurses.
+package resolver
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"localhost-magic/internal/dnsmsg"
+	"localhost-magic/internal/handoff"
+)
+
+// DefaultAddr is where the resolver listens unless configured otherwise.
+// 5355 is avoided because systemd-resolved binds it for LLMNR.
+const DefaultAddr = "127.0.0.1:5380"
+
+const (
+	// DefaultTTL is short because services come and go
+	DefaultTTL = 5
+
+	zone = "localhost."
+
+	// maxUDPSize is the classic limit for UDP replies without EDNS
+	maxUDPSize = 512
+	// tcpIdleTimeout closes TCP connections that stop sending queries
+	tcpIdleTimeout = 10 * time.Second
+	// maxPortAttempts bounds the free ports tried for both protocols
+	maxPortAttempts = 10
+)
+
+// Options configures a Server
+type Options struct {
+	// Addr is the UDP and TCP listen address. Empty uses DefaultAddr; a
+	// zero port picks a free one, the same for both protocols.
+	Addr string
+
+	// TTL for answers, in seconds. Zero uses DefaultTTL.
+	TTL uint32
+
+	// Services looks up a registered service ("myapp.localhost") and
+	// returns its port, enabling TXT "port=N" answers at the name and SRV
+	// answers at _http._tcp.<name>. Nil disables them.
+	Services func(name string) (port int, ok bool)
+}
+
+// Server answers DNS queries over UDP and TCP
+type Server struct {
+	opts Options
+
+	udp *net.UDPConn
+	tcp net.Listener
+
+	mu       sync.Mutex
+	conns    map[net.Conn]bool
+	shutdown bool
+	wg       sync.WaitGroup
+}
+
+// New returns a server with the given options; call Start to listen
+func New(opts Options) *Server {
+	if opts.Addr == "" {
+		opts.Addr = DefaultAddr
+	}
+	if opts.TTL == 0 {
+		opts.TTL = DefaultTTL
+	}
+	return &Server{opts: opts, conns: make(map[net.Conn]bool)}
+}
+
+// Start binds the UDP and TCP sockets, or takes those the process
+// inherited (see handoff), and serves queries in the background
+func (s *Server) Start() error {
+	udpAddr, err := net.ResolveUDPAddr("udp", s.opts.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", s.opts.Addr, err)
+	}
+	for attempt := 1; ; attempt++ {
+		udp, err := handoff.ListenUDP("udp", udpAddr)
+		if err != nil {
+			return fmt.Errorf("failed to listen on udp %s: %w", s.opts.Addr, err)
+		}
+
+		// Bind TCP to the port UDP got, which matters when it was zero
+		bound := udp.LocalAddr().(*net.UDPAddr)
+		tcp, err := handoff.Listen("tcp", net.JoinHostPort(udpAddr.IP.String(), strconv.Itoa(bound.Port)))
+		if err != nil {
+			udp.Close()
+			// A free UDP port may be taken for TCP; pick another
+			if udpAddr.Port == 0 && errors.Is(err, syscall.EADDRINUSE) && attempt < maxPortAttempts {
+				continue
+			}
+			return fmt.Errorf("failed to listen on tcp %s: %w", s.opts.Addr, err)
+		}
+		s.udp, s.tcp = udp, tcp
+		break
+	}
+	s.wg.Add(2)
+	go s.serveUDP()
+	go s.serveTCP()
+	return nil
+}
+
+// Addr returns the address the server is listening on
+func (s *Server) Addr() string {
+	if s.udp == nil {
+		return s.opts.Addr
+	}
+	return s.udp.LocalAddr().String()
+}
+
+// Shutdown stops accepting queries and waits for in-flight ones to finish
+// or ctx to expire, after which open TCP connections are closed
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if s.shutdown || s.udp == nil {
+		s.mu.Unlock()
+		return nil
+	}
+	s.shutdown = true
+	s.mu.Unlock()
+
+	s.udp.Close()
+	s.tcp.Close()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// serveUDP answers each datagram in its own goroutine
+func (s *Server) serveUDP() {
+	defer s.wg.Done()
+	buf := make([]byte, 65535)
+	for {
+		n, src, err := s.udp.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("DNS: udp read failed: %v", err)
+			continue
+		}
+		query := append([]byte(nil), buf[:n]...)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			reply := s.handle(query, maxUDPSize)
+			if reply != nil {
+				s.udp.WriteToUDP(reply, src)
+			}
+		}()
+	}
+}
+
+// serveTCP accepts connections, each carrying length-prefixed queries
+func (s *Server) serveTCP() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("DNS: tcp accept failed: %v", err)
+			continue
+		}
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn answers queries on one TCP connection until it goes idle
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	var length [2]byte
+	for {
+		conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		reply := s.handle(query, 65535)
+		if reply == nil {
+			return
+		}
+		if _, err := conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(reply)))); err != nil {
+			return
+		}
+		if _, err := conn.Write(reply); err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		closing := s.shutdown
+		s.mu.Unlock()
+		if closing {
+			return
+		}
+	}
+}
+
+// handle builds the reply to a packed query, or nil if it should be
+// dropped. Replies larger than maxSize are truncated.
+func (s *Server) handle(query []byte, maxSize int) []byte {
+	msg, err := dnsmsg.Parse(query)
+	if err != nil {
+		if len(query) < 12 {
+			return nil
+		}
+		// Echo the ID so the client sees the error instead of timing out
+		reply := &dnsmsg.Message{
+			ID:    binary.BigEndian.Uint16(query),
+			Flags: dnsmsg.FlagResponse | dnsmsg.RcodeFormErr,
+		}
+		return reply.Pack()
+	}
+	if msg.IsResponse() {
+		return nil
+	}
+
+	reply := s.answer(msg)
+	packed := reply.Pack()
+	if len(packed) > maxSize {
+		reply.Answers, reply.Additional = nil, nil
+		reply.Flags |= dnsmsg.FlagTruncated
+		packed = reply.Pack()
+	}
+	return packed
+}
+
+// answer resolves the query's question
+func (s *Server) answer(msg *dnsmsg.Message) *dnsmsg.Message {
+	reply := &dnsmsg.Message{
+		ID:        msg.ID,
+		Flags:     dnsmsg.FlagResponse | msg.Flags&dnsmsg.FlagRecursionDesired,
+		Questions: msg.Questions,
+	}
+	switch {
+	case msg.Opcode() != 0:
+		reply.Flags |= dnsmsg.RcodeNotImp
+		return reply
+	case len(msg.Questions) != 1:
+		reply.Flags |= dnsmsg.RcodeFormErr
+		return reply
+	}
+
+	q := msg.Questions[0]
+	if !inZone(q.Name) || q.Class&^dnsmsg.ClassTopBit != dnsmsg.ClassIN {
+		reply.Flags |= dnsmsg.RcodeNXDomain
+		return reply
+	}
+	reply.Flags |= dnsmsg.FlagAuthoritative
+	reply.Answers = s.records(q)
+	return reply
+}
+
+// records returns the answers for a question inside the zone. A name with
+// no records of the asked type gets an empty NOERROR reply.
+func (s *Server) records(q dnsmsg.Question) []dnsmsg.Record {
+	want := func(t uint16) bool { return q.Type == t || q.Type == dnsmsg.TypeANY }
+	rr := func(t uint16, data []byte) dnsmsg.Record {
+		return dnsmsg.Record{Name: q.Name, Type: t, Class: dnsmsg.ClassIN, TTL: s.opts.TTL, Data: data}
+	}
+
+	var answers []dnsmsg.Record
+	if service, ok := strings.CutPrefix(q.Name, "_http._tcp."); ok {
+		// SRV lives at _http._tcp.<name> per RFC 2782
+		if port, ok := s.lookup(service); ok && want(dnsmsg.TypeSRV) {
+			answers = append(answers, rr(dnsmsg.TypeSRV, dnsmsg.SRVData(port, service)))
+		}
+		return answers
+	}
+
+	if want(dnsmsg.TypeA) {
+		answers = append(answers, rr(dnsmsg.TypeA, net.IPv4(127, 0, 0, 1).To4()))
+	}
+	if want(dnsmsg.TypeAAAA) {
+		answers = append(answers, rr(dnsmsg.TypeAAAA, net.IPv6loopback))
+	}
+	if want(dnsmsg.TypeTXT) {
+		if port, ok := s.lookup(q.Name); ok {
+			answers = append(answers, rr(dnsmsg.TypeTXT, dnsmsg.TXTData([]string{"port=" + strconv.Itoa(port)})))
+		}
+	}
+	return answers
+}
+
+// lookup asks Options.Services about a fully qualified name
+func (s *Server) lookup(name string) (int, bool) {
+	if s.opts.Services == nil {
+		return 0, false
+	}
+	return s.opts.Services(strings.TrimSuffix(name, "."))
+}
+
+// inZone reports whether name is localhost or under it
+func inZone(name string) bool {
+	return name == zone || strings.HasSuffix(name, "."+zone)
+}
@@ -0,0 +1,261 @@
+package resolver
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"localhost-magic/internal/dnsmsg"
+)
+
+// start runs a server on a free loopback port that knows the service
+// shop.localhost, and any name starting with x, on port 5173
+func start(t *testing.T) *Server {
+	t.Helper()
+	s := New(Options{Addr: "127.0.0.1:0", Services: func(name string) (int, bool) {
+		if name == "shop.localhost" || strings.HasPrefix(name, "x") {
+			return 5173, true
+		}
+		return 0, false
+	}})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	return s
+}
+
+func query(name string, qtype uint16) []byte {
+	msg := &dnsmsg.Message{ID: 0x1234, Flags: dnsmsg.FlagRecursionDesired, Questions: []dnsmsg.Question{{Name: name, Type: qtype, Class: dnsmsg.ClassIN}}}
+	return msg.Pack()
+}
+
+// exchangeUDP sends packet to s and returns the reply, or nil if none came
+func exchangeUDP(t *testing.T, s *Server, packet []byte) *dnsmsg.Message {
+	t.Helper()
+	conn, err := net.Dial("udp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(packet); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if isTimeout(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n > maxUDPSize {
+		t.Errorf("%d-byte UDP reply, want at most %d", n, maxUDPSize)
+	}
+	return parse(t, buf[:n])
+}
+
+// exchangeTCP sends packets to s on one connection and returns the replies
+func exchangeTCP(t *testing.T, s *Server, packets ...[]byte) []*dnsmsg.Message {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	var replies []*dnsmsg.Message
+	for _, packet := range packets {
+		conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(packet))))
+		conn.Write(packet)
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			t.Fatal(err)
+		}
+		reply := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			t.Fatal(err)
+		}
+		replies = append(replies, parse(t, reply))
+	}
+	return replies
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func parse(t *testing.T, reply []byte) *dnsmsg.Message {
+	t.Helper()
+	msg, err := dnsmsg.Parse(reply)
+	if err != nil {
+		t.Fatalf("reply %x: %v", reply, err)
+	}
+	return msg
+}
+
+func rcode(m *dnsmsg.Message) uint16 { return m.Flags & 0xF }
+
+func TestQueryRoundTrip(t *testing.T) {
+	s := start(t)
+	tests := []struct {
+		name  string
+		qname string
+		qtype uint16
+		rcode uint16
+		want  []dnsmsg.Record
+	}{
+		{"A", "shop.localhost.", dnsmsg.TypeA, dnsmsg.RcodeSuccess, []dnsmsg.Record{{Name: "shop.localhost.", Type: dnsmsg.TypeA, Data: net.IPv4(127, 0, 0, 1).To4()}}},
+		{"AAAA", "shop.localhost.", dnsmsg.TypeAAAA, dnsmsg.RcodeSuccess, []dnsmsg.Record{{Name: "shop.localhost.", Type: dnsmsg.TypeAAAA, Data: net.IPv6loopback}}},
+		{"any name in the zone", "Not.Registered.LOCALHOST.", dnsmsg.TypeA, dnsmsg.RcodeSuccess, []dnsmsg.Record{{Name: "not.registered.localhost.", Type: dnsmsg.TypeA, Data: net.IPv4(127, 0, 0, 1).To4()}}},
+		{"the zone itself", "localhost.", dnsmsg.TypeAAAA, dnsmsg.RcodeSuccess, []dnsmsg.Record{{Name: "localhost.", Type: dnsmsg.TypeAAAA, Data: net.IPv6loopback}}},
+		{"TXT", "shop.localhost.", dnsmsg.TypeTXT, dnsmsg.RcodeSuccess, []dnsmsg.Record{{Name: "shop.localhost.", Type: dnsmsg.TypeTXT, Data: dnsmsg.TXTData([]string{"port=5173"})}}},
+		{"SRV", "_http._tcp.shop.localhost.", dnsmsg.TypeSRV, dnsmsg.RcodeSuccess, []dnsmsg.Record{{Name: "_http._tcp.shop.localhost.", Type: dnsmsg.TypeSRV, Data: dnsmsg.SRVData(5173, "shop.localhost.")}}},
+		{"no such record", "blog.localhost.", dnsmsg.TypeTXT, dnsmsg.RcodeSuccess, nil},
+		{"outside the zone", "example.com.", dnsmsg.TypeA, dnsmsg.RcodeNXDomain, nil},
+		{"zone name as a suffix", "notlocalhost.", dnsmsg.TypeA, dnsmsg.RcodeNXDomain, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for proto, reply := range map[string]*dnsmsg.Message{
+				"udp": exchangeUDP(t, s, query(tt.qname, tt.qtype)),
+				"tcp": exchangeTCP(t, s, query(tt.qname, tt.qtype))[0],
+			} {
+				if reply == nil {
+					t.Fatalf("%s: no reply", proto)
+				}
+				if reply.ID != 0x1234 || !reply.IsResponse() || reply.Flags&dnsmsg.FlagRecursionDesired == 0 {
+					t.Errorf("%s: reply ID %#x, flags %#x; want the query's ID and RD echoed", proto, reply.ID, reply.Flags)
+				}
+				if got := rcode(reply); got != tt.rcode {
+					t.Errorf("%s: rcode %d, want %d", proto, got, tt.rcode)
+				}
+				if (reply.Flags&dnsmsg.FlagAuthoritative != 0) != (tt.rcode == dnsmsg.RcodeSuccess) {
+					t.Errorf("%s: flags %#x, want AA only inside the zone", proto, reply.Flags)
+				}
+				if len(reply.Questions) != 1 {
+					t.Errorf("%s: %d questions echoed, want 1", proto, len(reply.Questions))
+				}
+				if len(reply.Answers) != len(tt.want) {
+					t.Fatalf("%s: answers %+v, want %+v", proto, reply.Answers, tt.want)
+				}
+				for i, rr := range reply.Answers {
+					want := tt.want[i]
+					if rr.Name != want.Name || rr.Type != want.Type || rr.Class != dnsmsg.ClassIN || rr.TTL != DefaultTTL || string(rr.Data) != string(want.Data) {
+						t.Errorf("%s: answer %+v, want %+v", proto, rr, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestQueryANY(t *testing.T) {
+	s := start(t)
+	reply := exchangeUDP(t, s, query("shop.localhost.", dnsmsg.TypeANY))
+	if reply == nil || len(reply.Answers) != 3 {
+		t.Fatalf("reply %+v, want A, AAAA and TXT", reply)
+	}
+	for i, typ := range []uint16{dnsmsg.TypeA, dnsmsg.TypeAAAA, dnsmsg.TypeTXT} {
+		if reply.Answers[i].Type != typ {
+			t.Errorf("answer %d of type %d, want %d", i, reply.Answers[i].Type, typ)
+		}
+	}
+}
+
+func TestLargeReplyTruncatedOverUDP(t *testing.T) {
+	s := start(t)
+	// Three records repeating a 250-byte name don't fit in 512 bytes
+	name := "x" + strings.Repeat(strings.Repeat("a", 59)+".", 4) + "localhost."
+	reply := exchangeUDP(t, s, query(name, dnsmsg.TypeANY))
+	if reply == nil || reply.Flags&dnsmsg.FlagTruncated == 0 || len(reply.Answers) != 0 {
+		t.Fatalf("UDP reply %+v, want TC set and no answers", reply)
+	}
+	if full := exchangeTCP(t, s, query(name, dnsmsg.TypeANY))[0]; full.Flags&dnsmsg.FlagTruncated != 0 || len(full.Answers) != 3 {
+		t.Errorf("TCP reply flags %#x with %d answers, want all 3 untruncated", full.Flags, len(full.Answers))
+	}
+}
+
+func TestMalformedQueries(t *testing.T) {
+	s := start(t)
+	header := func(id, flags, qdcount uint16) []byte {
+		b := make([]byte, 12)
+		binary.BigEndian.PutUint16(b, id)
+		binary.BigEndian.PutUint16(b[2:], flags)
+		binary.BigEndian.PutUint16(b[4:], qdcount)
+		return b
+	}
+	twoQuestions := &dnsmsg.Message{ID: 7, Questions: []dnsmsg.Question{
+		{Name: "a.localhost.", Type: dnsmsg.TypeA, Class: dnsmsg.ClassIN},
+		{Name: "b.localhost.", Type: dnsmsg.TypeA, Class: dnsmsg.ClassIN},
+	}}
+	tests := []struct {
+		name   string
+		packet []byte
+		id     uint16
+		rcode  uint16
+		drop   bool
+	}{
+		{"shorter than a header", []byte{0x12, 0x34, 0x01}, 0, 0, true},
+		{"question missing", header(0xbeef, 0, 1), 0xbeef, dnsmsg.RcodeFormErr, false},
+		{"name runs off the end", append(header(0xcafe, 0, 1), 5, 'a', 'b'), 0xcafe, dnsmsg.RcodeFormErr, false},
+		{"compression loop", append(header(0xf00d, 0, 1), 0xc0, 12, 0, 1, 0, 1), 0xf00d, dnsmsg.RcodeFormErr, false},
+		{"a response", header(9, dnsmsg.FlagResponse, 0), 0, 0, true},
+		{"two questions", twoQuestions.Pack(), 7, dnsmsg.RcodeFormErr, false},
+		{"not a standard query", header(8, 2<<11, 0), 8, dnsmsg.RcodeNotImp, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply := exchangeUDP(t, s, tt.packet)
+			if tt.drop {
+				if reply != nil {
+					t.Errorf("answered %+v, want the packet dropped", reply)
+				}
+				return
+			}
+			if reply == nil {
+				t.Fatal("no reply, want an error the client sees")
+			}
+			if reply.ID != tt.id || !reply.IsResponse() || rcode(reply) != tt.rcode {
+				t.Errorf("reply ID %#x, flags %#x; want ID %#x and rcode %d", reply.ID, reply.Flags, tt.id, tt.rcode)
+			}
+		})
+	}
+
+	// Still answering after all that
+	if reply := exchangeUDP(t, s, query("shop.localhost.", dnsmsg.TypeA)); reply == nil || len(reply.Answers) != 1 {
+		t.Errorf("reply %+v after malformed queries, want the A record", reply)
+	}
+}
+
+func TestTCPConnectionCarriesSeveralQueries(t *testing.T) {
+	s := start(t)
+	replies := exchangeTCP(t, s, query("shop.localhost.", dnsmsg.TypeA), query("example.com.", dnsmsg.TypeA), query("shop.localhost.", dnsmsg.TypeAAAA))
+	if len(replies[0].Answers) != 1 || rcode(replies[1]) != dnsmsg.RcodeNXDomain || len(replies[2].Answers) != 1 {
+		t.Errorf("replies %+v", replies)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	s := start(t)
+	addr := s.Addr()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Error("still accepting TCP connections after Shutdown")
+	}
+	if err := s.Shutdown(ctx); err != nil {
+		t.Errorf("second Shutdown: %v", err)
+	}
+}
@@ -0,0 +1,352 @@
+// Package rewrite changes the requests the proxy passes to a service, and
+// the answers it passes back, by rules from the [rewrite] table of the
+// config. A rule gives the services whose names match its pattern a list
+// of actions, applied in the order written:
+//
+//	[rewrite]
+//	api = [
+//	  "prefix /api/ /api/v1/",            # /api/users reaches the backend as /api/v1/users
+//	  "request set X-Tenant: dev",
+//	  "response remove Server",
+//	]
+//	legacy = ["path ^/old/(.*)$ /new/$1", "host legacy.internal"]
+//	"web*" = "response set Cache-Control: no-store"
+//
+// The actions are:
+//
+//	prefix FROM TO              replace the path prefix FROM with TO
+//	path REGEXP REPLACEMENT     replace what REGEXP matches in the path, $1 for its groups
+//	host NAME                   send NAME as the Host header
+//	request set|add NAME: VALUE, request remove NAME
+//	response set|add NAME: VALUE, response remove NAME
+//
+// Redirects are rewritten back: a Location under a prefix's TO is put
+// under its FROM, so the browser keeps using the paths it knows. What a
+// path action does can't be undone that way.
+package rewrite
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ErrInvalidAction is wrapped by the errors of ParseAction and ParsePattern
+var ErrInvalidAction = errors.New("invalid rewrite")
+
+// Kind is what an action changes
+type Kind string
+
+const (
+	KindPrefix   Kind = "prefix"   // A path prefix
+	KindPath     Kind = "path"     // What a regular expression matches in the path
+	KindHost     Kind = "host"     // The Host header
+	KindRequest  Kind = "request"  // A request header
+	KindResponse Kind = "response" // A response header
+)
+
+// Op is what a header action does
+type Op string
+
+const (
+	OpSet    Op = "set"    // Replace every value of the header
+	OpAdd    Op = "add"    // Add a value, keeping the others
+	OpRemove Op = "remove" // Drop the header
+)
+
+// reservedHeaders are managed by the proxy and the HTTP library, or by the
+// host action; rewriting them would break the connection to the backend
+var reservedHeaders = []string{
+	"Host", "Connection", "Upgrade", "Content-Length", "Transfer-Encoding",
+	"Keep-Alive", "Te", "Trailer", "Proxy-Connection",
+}
+
+// Action is one change to a request or an answer
+type Action struct {
+	Kind Kind
+	// From and To are the prefixes or the regular expression and its
+	// replacement of a path action, To the name of a host action
+	From, To string
+	// Op, Header and Value are those of a header action
+	Op     Op
+	Header string
+	Value  string
+
+	re *regexp.Regexp
+}
+
+// ParseAction reads an action such as "prefix /api/ /api/v1/" or
+// "request set X-Tenant: dev"
+func ParseAction(spec string) (Action, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 {
+		return Action{}, fmt.Errorf("%w: empty", ErrInvalidAction)
+	}
+	kind, args := Kind(strings.ToLower(fields[0])), fields[1:]
+	switch kind {
+	case KindPrefix:
+		if len(args) != 2 {
+			return Action{}, fmt.Errorf("%w: expected prefix FROM TO", ErrInvalidAction)
+		}
+		for _, prefix := range args {
+			if !strings.HasPrefix(prefix, "/") || strings.ContainsAny(prefix, "?#") {
+				return Action{}, fmt.Errorf("%w: prefix %q must be a path starting with /", ErrInvalidAction, prefix)
+			}
+		}
+		return Action{Kind: kind, From: args[0], To: args[1]}, nil
+	case KindPath:
+		if len(args) != 2 {
+			return Action{}, fmt.Errorf("%w: expected path REGEXP REPLACEMENT", ErrInvalidAction)
+		}
+		re, err := regexp.Compile(args[0])
+		if err != nil {
+			return Action{}, fmt.Errorf("%w: bad regular expression %q: %v", ErrInvalidAction, args[0], err)
+		}
+		if !strings.HasPrefix(args[1], "/") && !strings.HasPrefix(args[1], "$") {
+			return Action{}, fmt.Errorf("%w: replacement %q must be a path starting with /", ErrInvalidAction, args[1])
+		}
+		return Action{Kind: kind, From: args[0], To: args[1], re: re}, nil
+	case KindHost:
+		if len(args) != 1 || !validHost(args[0]) {
+			return Action{}, fmt.Errorf("%w: expected host NAME or host NAME:PORT", ErrInvalidAction)
+		}
+		return Action{Kind: kind, To: args[0]}, nil
+	case KindRequest, KindResponse:
+		return parseHeaderAction(kind, spec)
+	}
+	return Action{}, fmt.Errorf("%w: unknown action %q, expected prefix, path, host, request or response", ErrInvalidAction, fields[0])
+}
+
+// parseHeaderAction reads "request set NAME: VALUE" and the like
+func parseHeaderAction(kind Kind, spec string) (Action, error) {
+	_, rest, _ := strings.Cut(strings.TrimSpace(spec), " ")
+	op, header, _ := strings.Cut(strings.TrimSpace(rest), " ")
+	action := Action{Kind: kind, Op: Op(strings.ToLower(op))}
+	header = strings.TrimSpace(header)
+	switch action.Op {
+	case OpSet, OpAdd:
+		name, value, ok := strings.Cut(header, ":")
+		if !ok {
+			return Action{}, fmt.Errorf("%w: expected %s %s NAME: VALUE", ErrInvalidAction, kind, op)
+		}
+		action.Header, action.Value = strings.TrimSpace(name), strings.TrimSpace(value)
+	case OpRemove:
+		action.Header = header
+	default:
+		return Action{}, fmt.Errorf("%w: expected %s set, add or remove", ErrInvalidAction, kind)
+	}
+	if action.Header == "" || strings.IndexFunc(action.Header, func(r rune) bool { return !isTokenChar(r) }) >= 0 {
+		return Action{}, fmt.Errorf("%w: bad header name %q", ErrInvalidAction, action.Header)
+	}
+	for _, reserved := range reservedHeaders {
+		if strings.EqualFold(action.Header, reserved) {
+			return Action{}, fmt.Errorf("%w: %s is managed by the proxy", ErrInvalidAction, reserved)
+		}
+	}
+	if strings.ContainsAny(action.Value, "\r\n\x00") {
+		return Action{}, fmt.Errorf("%w: value of %s contains CR, LF or NUL", ErrInvalidAction, action.Header)
+	}
+	action.Header = http.CanonicalHeaderKey(action.Header)
+	return action, nil
+}
+
+// isTokenChar reports whether r may appear in a header name
+func isTokenChar(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' ||
+		strings.ContainsRune("!#$%&'*+-.^_`|~", r)
+}
+
+// validHost reports whether s is usable as a Host header
+func validHost(s string) bool {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	return s != "" && !strings.ContainsAny(s, "/?#@ \t\r\n")
+}
+
+// String returns the action as ParseAction takes it
+func (a Action) String() string {
+	switch a.Kind {
+	case KindPrefix, KindPath:
+		return fmt.Sprintf("%s %s %s", a.Kind, a.From, a.To)
+	case KindHost:
+		return "host " + a.To
+	case KindRequest, KindResponse:
+		if a.Op == OpRemove {
+			return fmt.Sprintf("%s remove %s", a.Kind, a.Header)
+		}
+		return fmt.Sprintf("%s %s %s: %s", a.Kind, a.Op, a.Header, a.Value)
+	}
+	return string(a.Kind)
+}
+
+// Actions are applied in order, each to what the ones before it left
+type Actions []Action
+
+// Request rewrites the path, Host and headers of r, a request on its way
+// to the backend
+func (as Actions) Request(r *http.Request) {
+	for _, a := range as {
+		switch a.Kind {
+		case KindPrefix:
+			if rest, ok := cutPrefix(r.URL.Path, a.From); ok {
+				r.URL.Path, r.URL.RawPath = joinPrefix(a.To, rest), ""
+			}
+		case KindPath:
+			if a.re.MatchString(r.URL.Path) {
+				r.URL.Path, r.URL.RawPath = a.re.ReplaceAllString(r.URL.Path, a.To), ""
+			}
+		case KindHost:
+			r.Host = a.To
+		case KindRequest:
+			a.apply(r.Header)
+		}
+	}
+}
+
+// Response rewrites the headers of an answer on its way to the client
+func (as Actions) Response(h http.Header) {
+	for _, a := range as {
+		if a.Kind == KindResponse {
+			a.apply(h)
+		}
+	}
+}
+
+// apply carries out a header action on h
+func (a Action) apply(h http.Header) {
+	switch a.Op {
+	case OpSet:
+		h.Set(a.Header, a.Value)
+	case OpAdd:
+		h.Add(a.Header, a.Value)
+	case OpRemove:
+		h.Del(a.Header)
+	}
+}
+
+// Location rewrites a redirect target the backend sent back, undoing the
+// prefix actions from the last to the first. It rewrites root-relative
+// targets, and absolute ones on host, the name the client asked for, or
+// on the name a host action sent instead, which becomes host again.
+func (as Actions) Location(location, host string) string {
+	u, err := url.Parse(location)
+	if err != nil || strings.HasPrefix(location, "//") {
+		return location
+	}
+	if u.IsAbs() {
+		switch {
+		case host != "" && strings.EqualFold(u.Host, host):
+		case as.sentHost() != "" && strings.EqualFold(u.Host, as.sentHost()):
+			if host == "" {
+				return location
+			}
+			u.Host = host
+		default:
+			return location
+		}
+	} else if !strings.HasPrefix(u.Path, "/") {
+		return location
+	}
+	for i := len(as) - 1; i >= 0; i-- {
+		if a := as[i]; a.Kind == KindPrefix {
+			if rest, ok := cutPrefix(u.Path, a.To); ok {
+				u.Path, u.RawPath = joinPrefix(a.From, rest), ""
+			}
+		}
+	}
+	return u.String()
+}
+
+// sentHost returns the Host the actions send the backend, if one changes it
+func (as Actions) sentHost() string {
+	host := ""
+	for _, a := range as {
+		if a.Kind == KindHost {
+			host = a.To
+		}
+	}
+	return host
+}
+
+// Strings returns the actions as ParseAction takes them
+func (as Actions) Strings() []string {
+	out := make([]string, 0, len(as))
+	for _, a := range as {
+		out = append(out, a.String())
+	}
+	return out
+}
+
+// cutPrefix returns what follows prefix in path, when path is prefix or
+// goes on under it: "/api" is a prefix of "/api/users" but not of
+// "/apis", while "/api/" is a prefix of both "/api/" and "/api"
+func cutPrefix(path, prefix string) (string, bool) {
+	if strings.HasSuffix(prefix, "/") && path+"/" == prefix {
+		return "", true
+	}
+	rest, ok := strings.CutPrefix(path, prefix)
+	if !ok || rest != "" && !strings.HasSuffix(prefix, "/") && rest[0] != '/' {
+		return "", false
+	}
+	return rest, true
+}
+
+// joinPrefix puts rest, what followed a prefix, under another one
+func joinPrefix(prefix, rest string) string {
+	if strings.HasSuffix(prefix, "/") && strings.HasPrefix(rest, "/") {
+		return prefix + rest[1:]
+	}
+	if rest != "" && !strings.HasSuffix(prefix, "/") && !strings.HasPrefix(rest, "/") {
+		return prefix + "/" + rest
+	}
+	return prefix + rest
+}
+
+// Rule gives the services it matches a list of actions
+type Rule struct {
+	// Pattern matches service names without .localhost, in filepath.Match
+	// syntax
+	Pattern string
+	Actions Actions
+}
+
+// ParsePattern checks a rule's service name pattern, such as "api" or
+// "web*", and returns it without .localhost
+func ParsePattern(match string) (string, error) {
+	pattern := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(match)), ".localhost")
+	if pattern == "" {
+		return "", fmt.Errorf("%w: empty service name", ErrInvalidAction)
+	}
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return "", fmt.Errorf("%w: bad pattern %q: %v", ErrInvalidAction, match, err)
+	}
+	return pattern, nil
+}
+
+// Matches reports whether the rule applies to the service called name, as
+// "api.localhost" or "api"
+func (r Rule) Matches(name string) bool {
+	ok, _ := filepath.Match(r.Pattern, strings.TrimSuffix(strings.ToLower(name), ".localhost"))
+	return ok
+}
+
+// Rules are the rules of a config, in the order they were given
+type Rules []Rule
+
+// For returns the actions of every rule that applies to the service called
+// name, in the order of the rules, or nil if none does
+func (rs Rules) For(name string) Actions {
+	var actions Actions
+	for _, r := range rs {
+		if r.Matches(name) {
+			actions = append(actions, r.Actions...)
+		}
+	}
+	return actions
+}
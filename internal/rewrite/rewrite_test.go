@@ -0,0 +1,193 @@
+package rewrite
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// parse reads specs as a list of actions
+func parse(t *testing.T, specs ...string) Actions {
+	t.Helper()
+	var as Actions
+	for _, spec := range specs {
+		a, err := ParseAction(spec)
+		if err != nil {
+			t.Fatalf("ParseAction(%q): %v", spec, err)
+		}
+		as = append(as, a)
+	}
+	return as
+}
+
+func TestParseActionRoundTrip(t *testing.T) {
+	for _, spec := range []string{
+		"prefix /api/ /api/v1/",
+		"path ^/old/(.*)$ /new/$1",
+		"host legacy.internal:8080",
+		"request set X-Tenant: dev",
+		"request add Accept-Language: fr",
+		"request remove Cookie",
+		"response remove Server",
+	} {
+		if got := parse(t, spec)[0].String(); got != spec {
+			t.Errorf("ParseAction(%q).String() = %q", spec, got)
+		}
+	}
+	if a := parse(t, "RESPONSE Set cache-control:  no-store ")[0]; a.Header != "Cache-Control" || a.Op != OpSet || a.Value != "no-store" {
+		t.Errorf("parsed %+v, want the canonical header name and trimmed value", a)
+	}
+}
+
+func TestParseActionInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"prefix /api/",
+		"prefix api/ /v1/",
+		"prefix /api?x /v1/",
+		"path ( /x",
+		"path ^/old/(.*)$ new/$1",
+		"host",
+		"host a/b",
+		"request set X-Tenant",
+		"request replace X-Tenant: dev",
+		"request set Bad Header: x",
+		"request set Connection: close",
+		"response remove Upgrade",
+		"rename /a /b",
+	} {
+		if a, err := ParseAction(spec); !errors.Is(err, ErrInvalidAction) {
+			t.Errorf("ParseAction(%q) = %+v, %v; want ErrInvalidAction", spec, a, err)
+		}
+	}
+}
+
+func TestRequest(t *testing.T) {
+	tests := []struct {
+		name      string
+		actions   []string
+		target    string
+		wantPath  string
+		wantQuery string
+		wantHost  string
+	}{
+		{"prefix", []string{"prefix /api/ /api/v1/"}, "/api/users?page=2", "/api/v1/users", "page=2", "shop.localhost"},
+		{"prefix itself", []string{"prefix /api/ /api/v1/"}, "/api", "/api/v1/", "", "shop.localhost"},
+		{"not under the prefix", []string{"prefix /api /v1"}, "/apis", "/apis", "", "shop.localhost"},
+		{"prefix without slashes", []string{"prefix /api /v1"}, "/api/users", "/v1/users", "", "shop.localhost"},
+		{"path", []string{"path ^/old/(.*)$ /new/$1"}, "/old/a/b", "/new/a/b", "", "shop.localhost"},
+		{"host", []string{"host legacy.internal"}, "/", "/", "", "legacy.internal"},
+		{"in order", []string{"prefix /a/ /b/", "prefix /b/ /c/"}, "/a/x", "/c/x", "", "shop.localhost"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://shop.localhost"+tt.target, nil)
+			parse(t, tt.actions...).Request(r)
+			if r.URL.Path != tt.wantPath || r.URL.RawQuery != tt.wantQuery || r.Host != tt.wantHost {
+				t.Errorf("request to %s%s?%s, want %s%s?%s", r.Host, r.URL.Path, r.URL.RawQuery, tt.wantHost, tt.wantPath, tt.wantQuery)
+			}
+		})
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	as := parse(t,
+		"request set X-Tenant: dev",
+		"request add Accept-Language: fr",
+		"request remove Cookie",
+		"response set Cache-Control: no-store",
+		"response remove Server",
+	)
+	r := httptest.NewRequest("GET", "http://shop.localhost/", nil)
+	r.Header.Set("X-Tenant", "prod")
+	r.Header.Set("Accept-Language", "en")
+	r.Header.Set("Cookie", "session=1")
+	as.Request(r)
+	if got := r.Header.Get("X-Tenant"); got != "dev" {
+		t.Errorf("X-Tenant %q, want dev", got)
+	}
+	if got := r.Header.Values("Accept-Language"); len(got) != 2 || got[1] != "fr" {
+		t.Errorf("Accept-Language %q, want en and fr", got)
+	}
+	if r.Header.Get("Cookie") != "" || r.Header.Get("Cache-Control") != "" {
+		t.Errorf("request headers %v, want the cookie gone and no response actions", r.Header)
+	}
+
+	h := http.Header{"Server": {"vite"}, "Cache-Control": {"max-age=60"}, "X-Tenant": {"prod"}}
+	as.Response(h)
+	if h.Get("Server") != "" || h.Get("Cache-Control") != "no-store" || h.Get("X-Tenant") != "prod" {
+		t.Errorf("response headers %v, want only the response actions applied", h)
+	}
+}
+
+func TestWebSocketUpgradeRewritten(t *testing.T) {
+	as := parse(t, "prefix /ws/ /socket/", "host realtime.internal", "request set X-Tenant: dev")
+	r := httptest.NewRequest("GET", "http://chat.localhost/ws/room?id=1", nil)
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	as.Request(r)
+	if r.URL.RequestURI() != "/socket/room?id=1" || r.Host != "realtime.internal" || r.Header.Get("X-Tenant") != "dev" {
+		t.Errorf("upgrade sent as %s %s with %v", r.Host, r.URL.RequestURI(), r.Header)
+	}
+	if r.Header.Get("Connection") != "Upgrade" || r.Header.Get("Upgrade") != "websocket" || r.Header.Get("Sec-WebSocket-Key") == "" {
+		t.Errorf("handshake headers %v, want them untouched", r.Header)
+	}
+}
+
+func TestLocation(t *testing.T) {
+	prefix := parse(t, "prefix /api/ /api/v1/")
+	hosted := parse(t, "prefix /app/ /", "host legacy.internal")
+	tests := []struct {
+		name     string
+		actions  Actions
+		location string
+		host     string
+		want     string
+	}{
+		{"root-relative", prefix, "/api/v1/login?next=%2F", "shop.localhost", "/api/login?next=%2F"},
+		{"the prefix itself", prefix, "/api/v1/", "shop.localhost", "/api/"},
+		{"outside the prefix", prefix, "/login", "shop.localhost", "/login"},
+		{"absolute on the client's host", prefix, "http://shop.localhost/api/v1/login", "shop.localhost", "http://shop.localhost/api/login"},
+		{"host compared without case", prefix, "http://Shop.Localhost/api/v1/", "shop.localhost", "http://Shop.Localhost/api/"},
+		{"another site", prefix, "https://auth.example.com/api/v1/login", "shop.localhost", "https://auth.example.com/api/v1/login"},
+		{"protocol-relative", prefix, "//cdn.example.com/api/v1/x", "shop.localhost", "//cdn.example.com/api/v1/x"},
+		{"relative to the page", prefix, "login", "shop.localhost", "login"},
+		{"the host sent back", hosted, "http://legacy.internal/dashboard", "old.localhost:8080", "http://old.localhost:8080/app/dashboard"},
+		{"the host sent back, no client host", hosted, "http://legacy.internal/dashboard", "", "http://legacy.internal/dashboard"},
+		{"undone last to first", parse(t, "prefix /a/ /b/", "prefix /b/ /c/"), "/c/x", "shop.localhost", "/a/x"},
+		{"path actions stay", parse(t, "path ^/old/(.*)$ /new/$1"), "/new/x", "shop.localhost", "/new/x"},
+		{"unparsable", prefix, "http://[::1/api/v1/", "shop.localhost", "http://[::1/api/v1/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.actions.Location(tt.location, tt.host); got != tt.want {
+				t.Errorf("Location(%q, %q) = %q, want %q", tt.location, tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRules(t *testing.T) {
+	pattern, err := ParsePattern(" Web*.localhost ")
+	if err != nil || pattern != "web*" {
+		t.Fatalf("ParsePattern = %q, %v; want web*", pattern, err)
+	}
+	for _, bad := range []string{"", ".localhost", "[web"} {
+		if _, err := ParsePattern(bad); !errors.Is(err, ErrInvalidAction) {
+			t.Errorf("ParsePattern(%q): %v, want ErrInvalidAction", bad, err)
+		}
+	}
+	rules := Rules{
+		{Pattern: "web*", Actions: parse(t, "response remove Server")},
+		{Pattern: "api", Actions: parse(t, "prefix /api/ /api/v1/")},
+		{Pattern: "*", Actions: parse(t, "request set X-Dev: 1")},
+	}
+	if got := rules.For("WebShop.localhost").Strings(); len(got) != 2 || got[0] != "response remove Server" || got[1] != "request set X-Dev: 1" {
+		t.Errorf("actions for webshop %q, want the web* rule's then the catch-all's", got)
+	}
+	if got := rules.For("api"); len(got) != 2 || got[0].Kind != KindPrefix {
+		t.Errorf("actions for api %v", got.Strings())
+	}
+}
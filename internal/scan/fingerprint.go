@@ -0,0 +1,93 @@
+package scan
+
+// Fingerprint is what stays the same about a service across restarts and
+// port moves, for recognising one seen before when its Identity changed,
+// e.g. after it was restarted with other arguments
+type Fingerprint struct {
+	Compose     string `json:"compose,omitempty"` // "project/service"
+	Exe         string `json:"exe,omitempty"`
+	Cwd         string `json:"cwd,omitempty"`
+	Cert        string `json:"cert,omitempty"` // SHA-256 of the TLS certificate
+	FaviconHash int32  `json:"favicon_hash,omitempty"`
+	Title       string `json:"title,omitempty"`
+}
+
+// Weights of the signals in a fingerprint: how much their agreeing says
+// about two findings being the same service
+const (
+	weightCompose = 4
+	weightProcess = 3 // Executable and working directory together
+	weightCert    = 2
+	weightFavicon = 1
+	weightTitle   = 1
+)
+
+// minEvidence is the weight of the signals two fingerprints must both have
+// to be compared at all; a title alone says too little
+const minEvidence = 2
+
+// MatchThreshold is the Match score from which two fingerprints are taken
+// for the same service
+const MatchThreshold = 0.75
+
+// Fingerprint returns the stable signals of the finding. Attach processes
+// and containers first.
+func (f Finding) Fingerprint() Fingerprint {
+	fp := Fingerprint{FaviconHash: f.FaviconHash, Title: f.Title}
+	if f.Container != nil && f.Container.Project != "" && f.Container.Service != "" {
+		fp.Compose = f.Container.Project + "/" + f.Container.Service
+	}
+	if f.Process != nil {
+		fp.Exe, fp.Cwd = f.Process.Exe, f.Process.Cwd
+	}
+	if f.Cert != nil {
+		fp.Cert = f.Cert.Fingerprint
+	}
+	return fp
+}
+
+// Match scores how likely a and b are the same service, from 0 to 1: the
+// weight of the signals they agree on over the weight of the signals they
+// both have. A signal only one of them has counts neither way, so two
+// Vite servers with the same title in different directories score low.
+func (a Fingerprint) Match(b Fingerprint) float64 {
+	var compared, agreed int
+	signal := func(weight int, present, equal bool) {
+		if present {
+			compared += weight
+			if equal {
+				agreed += weight
+			}
+		}
+	}
+	signal(weightCompose, a.Compose != "" && b.Compose != "", a.Compose == b.Compose)
+	signal(weightProcess, a.Exe != "" && b.Exe != "" && a.Cwd != "" && b.Cwd != "", a.Exe == b.Exe && a.Cwd == b.Cwd)
+	signal(weightCert, a.Cert != "" && b.Cert != "", a.Cert == b.Cert)
+	signal(weightFavicon, a.FaviconHash != 0 && b.FaviconHash != 0, a.FaviconHash == b.FaviconHash)
+	signal(weightTitle, a.Title != "" && b.Title != "", a.Title == b.Title)
+	if compared < minEvidence {
+		return 0
+	}
+	return float64(agreed) / float64(compared)
+}
+
+// BestMatch returns the index of the candidate fp matches best, if it
+// scores at least MatchThreshold. A tie for the best score is ambiguous
+// and matches nothing, rather than picking one of the services at random.
+func BestMatch(fp Fingerprint, candidates []Fingerprint) (int, bool) {
+	best, bestScore, tied := -1, 0.0, false
+	for i, c := range candidates {
+		score := fp.Match(c)
+		switch {
+		case score < MatchThreshold || score < bestScore:
+		case score == bestScore:
+			tied = true
+		default:
+			best, bestScore, tied = i, score, false
+		}
+	}
+	if best < 0 || tied {
+		return -1, false
+	}
+	return best, true
+}
@@ -0,0 +1,62 @@
+package scan
+
+import "testing"
+
+// vite is the fingerprint of a Vite dev server run in cwd
+func vite(cwd string) Fingerprint {
+	return Fingerprint{Exe: "/usr/bin/node", Cwd: cwd, FaviconHash: 1790006171, Title: "Vite App"}
+}
+
+func TestFingerprintMatch(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b Fingerprint
+		want float64
+	}{
+		{"same server", vite("/home/dev/shop"), vite("/home/dev/shop"), 1},
+		{"same page in another directory", vite("/home/dev/shop"), vite("/home/dev/blog"), 2.0 / 5},
+		{"same Compose service", Fingerprint{Compose: "shop/web", Title: "Shop"}, Fingerprint{Compose: "shop/web", Title: "Shop - Cart"}, 4.0 / 5},
+		{"same certificate", Fingerprint{Cert: "ab12"}, Fingerprint{Cert: "ab12"}, 1},
+		{"title alone", Fingerprint{Title: "Vite App"}, Fingerprint{Title: "Vite App"}, 0},
+		{"nothing in common to compare", Fingerprint{Exe: "/usr/bin/node", Cwd: "/home/dev/shop"}, Fingerprint{Cert: "ab12"}, 0},
+		{"missing signals don't count against", vite("/home/dev/shop"), Fingerprint{Exe: "/usr/bin/node", Cwd: "/home/dev/shop"}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.a.Match(tt.b); got != tt.want {
+				t.Errorf("Match = %v, want %v", got, tt.want)
+			}
+			if got := tt.b.Match(tt.a); got != tt.want {
+				t.Errorf("Match reversed = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBestMatch(t *testing.T) {
+	shop, blog := vite("/home/dev/shop"), vite("/home/dev/blog")
+	page := Fingerprint{FaviconHash: 1790006171, Title: "Vite App"} // No process to go by
+	tests := []struct {
+		name       string
+		fp         Fingerprint
+		candidates []Fingerprint
+		want       int
+		wantOK     bool
+	}{
+		{"only candidate", shop, []Fingerprint{shop}, 0, true},
+		{"the one in its directory", shop, []Fingerprint{blog, shop}, 1, true},
+		{"identical servers in other directories", vite("/home/dev/docs"), []Fingerprint{shop, blog}, -1, false},
+		{"same page served from either directory", page, []Fingerprint{shop, blog}, -1, false},
+		{"same page, one candidate", page, []Fingerprint{shop}, 0, true},
+		{"below the threshold", Fingerprint{Cert: "ab12", Title: "Shop"}, []Fingerprint{{Cert: "ab12", Title: "Admin"}}, -1, false},
+		{"no candidates", shop, nil, -1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := BestMatch(tt.fp, tt.candidates)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("BestMatch = %d, %v; want %d, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,725 @@
+// Package scan sweeps port ranges and probes the ports that turn out to be open
+package scan
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"localhost-magic/internal/docker"
+	"localhost-magic/internal/naming"
+	"localhost-magic/internal/procmap"
+	"localhost-magic/probe"
+)
+
+// PortState is the outcome of the connect sweep for a single port
+type PortState string
+
+const (
+	StateOpen     PortState = "open"     // TCP handshake completed
+	StateClosed   PortState = "closed"   // Connection refused
+	StateFiltered PortState = "filtered" // No answer before the dial timeout
+)
+
+// Tier is the pass of a scan that found a port
+type Tier string
+
+const (
+	TierPriority Tier = "priority" // The well-known dev server ports, scanned first
+	TierRest     Tier = "rest"     // Every other port asked for
+)
+
+// DefaultPriorityPorts are the ports dev servers and their tools usually
+// pick, scanned before the rest unless ScanOptions.PriorityPorts says
+// otherwise
+var DefaultPriorityPorts = []int{
+	1313, 3000, 3001, 3002, 3003, 4000, 4200, 4321, 5000, 5001, 5173, 5174,
+	5500, 6006, 8000, 8001, 8008, 8080, 8081, 8088, 8443, 8888, 9000, 9090,
+	19006, 24678,
+}
+
+// Default sweep settings used when the ScanOptions field is zero
+const (
+	DefaultConcurrency   = 256
+	DefaultDialTimeout   = 300 * time.Millisecond
+	DefaultSlowThreshold = time.Second
+)
+
+// ScanOptions configures a range scan. Probe.Limiter, when set, throttles
+// the connect sweep as well as the deep probes.
+type ScanOptions struct {
+	Exclude       []int              // Ports never dialed
+	Concurrency   int                // Max simultaneous dials in the connect sweep
+	DialTimeout   time.Duration      // Per-port connect timeout for the sweep
+	IncludeClosed bool               // Also report closed ports in the findings
+	Probe         probe.ProbeOptions // Options for the deep probe of open ports, hooks included
+	QUICPorts     []int              // UDP ports to try a QUIC handshake on
+	// UDPPorts maps the UDP ports to probe, when scanned, to the probe to
+	// send. Nil means DefaultUDPPorts; an empty map probes none.
+	UDPPorts map[int]probe.UDPKind
+	// PriorityPorts are swept and probed before the other ports, so the
+	// usual dev servers turn up first in a long scan. Nil means
+	// DefaultPriorityPorts; an empty slice scans everything in one pass.
+	PriorityPorts []int
+	// OnTier, if set, is called with each pass's findings, sorted by port,
+	// as soon as the pass is done: first TierPriority's, if any of its
+	// ports were asked for, then TierRest's. QUIC results are only on the
+	// findings returned at the end.
+	OnTier func(tier Tier, findings []Finding)
+	// ExtraAddrs are loopback addresses scanned besides host, such as
+	// 127.0.0.2, for services bound to one of them alone. They are only
+	// scanned when host is this machine.
+	ExtraAddrs []string
+	// DiscoverAddrs adds the loopback addresses local listeners are bound
+	// to, as procmap reads them, to ExtraAddrs
+	DiscoverAddrs bool
+	// SlowThreshold is the time to first byte from which a finding is
+	// flagged Slow
+	SlowThreshold time.Duration
+}
+
+// DefaultUDPPorts are the UDP ports probed unless ScanOptions.UDPPorts
+// says otherwise: a local DNS resolver and an mDNS responder
+var DefaultUDPPorts = map[int]probe.UDPKind{
+	53:   probe.UDPDNS,
+	5353: probe.UDPMDNS,
+}
+
+// Finding is the scan result for a single port. The embedded ProbeResult is
+// only populated for open ports, Process only after AttachProcesses and
+// Container only after AttachContainers. Its Address is the one the port
+// answered on, e.g. "127.0.0.1" or "127.0.0.2".
+type Finding struct {
+	State PortState `json:"state"`
+	probe.ProbeResult
+	Process   *procmap.Process  `json:"process,omitempty"`
+	Container *docker.Container `json:"container,omitempty"`
+	// Parent is the port of the service an auxiliary finding belongs to,
+	// set by LinkAuxiliary
+	Parent int `json:"parent,omitempty"`
+	// Scope is who can reach the listener, from the addresses it is bound
+	// to; set by AttachProcesses
+	Scope procmap.Scope `json:"scope,omitempty"`
+	Tier  Tier          `json:"tier,omitempty"` // Which pass found the port
+	// Slow is set when the service took longer than
+	// ScanOptions.SlowThreshold to send its first byte, as TTFB measured
+	// it on the attempt that answered, so without the backoff between
+	// retries
+	Slow bool `json:"slow,omitempty"`
+	// ServedPath is the directory a file server answering with a directory
+	// listing serves, worked out from its process's command line and
+	// working directory; set by AttachProcesses
+	ServedPath string `json:"served_path,omitempty"`
+	// CertIssues are what a browser would object to in the certificate of
+	// a TLS service reached by the name it is listed under, e.g. "cert
+	// expired 12 days ago"; set by CheckCert
+	CertIssues []string `json:"cert_issues,omitempty"`
+}
+
+// ScanRange scans host ports from..to (inclusive) in two phases: a cheap
+// TCP connect sweep over the whole range, then a full probe of only the
+// ports that accepted a connection. The priority ports in the range go
+// through both phases first, then the rest. Findings are sorted by port.
+// If ctx is cancelled the findings gathered so far are returned with
+// ctx.Err().
+func ScanRange(ctx context.Context, host string, from, to int, opts ScanOptions) ([]Finding, error) {
+	if from < 1 || to > 65535 || from > to {
+		return nil, fmt.Errorf("invalid port range %d-%d", from, to)
+	}
+	ports := make([]int, 0, to-from+1)
+	for port := from; port <= to; port++ {
+		ports = append(ports, port)
+	}
+	return ScanPorts(ctx, host, ports, opts)
+}
+
+// ScanPorts is ScanRange for an arbitrary list of ports, such as the few
+// a watcher wants to re-check
+func ScanPorts(ctx context.Context, host string, ports []int, opts ScanOptions) ([]Finding, error) {
+	opts = opts.withDefaults()
+	extra, err := extraAddrs(ctx, host, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	excluded := make(map[int]bool, len(opts.Exclude))
+	for _, port := range opts.Exclude {
+		excluded[port] = true
+	}
+	wanted := make([]int, 0, len(ports))
+	for _, port := range ports {
+		if port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %d", port)
+		}
+		if !excluded[port] {
+			wanted = append(wanted, port)
+		}
+	}
+	ports = wanted
+
+	var findings []Finding
+	for _, pass := range passes(ports, opts.PriorityPorts) {
+		if ctx.Err() != nil {
+			break
+		}
+		found := scanPass(ctx, host, pass.ports, opts)
+		if len(extra.addrs) > 0 && ctx.Err() == nil {
+			found = extra.scan(ctx, found, pass.ports, opts)
+		}
+		for i := range found {
+			found[i].Tier = pass.tier
+		}
+		if opts.OnTier != nil && ctx.Err() == nil {
+			sortByPort(found)
+			opts.OnTier(pass.tier, found)
+		}
+		findings = append(findings, found...)
+	}
+
+	// QUIC handshakes, attached to the TCP findings of either pass
+	if len(opts.QUICPorts) > 0 && ctx.Err() == nil {
+		findings = probeQUIC(ctx, host, findings, opts)
+	}
+
+	sortByPort(findings)
+	return findings, ctx.Err()
+}
+
+// pass is one round of a scan: the ports of a tier
+type pass struct {
+	tier  Tier
+	ports []int
+}
+
+// passes splits ports into the priority ports, if any, and the rest,
+// keeping their order
+func passes(ports, priority []int) []pass {
+	first := make(map[int]bool, len(priority))
+	for _, port := range priority {
+		first[port] = true
+	}
+	var prio, rest []int
+	for _, port := range ports {
+		if first[port] {
+			prio = append(prio, port)
+		} else {
+			rest = append(rest, port)
+		}
+	}
+	var out []pass
+	if len(prio) > 0 {
+		out = append(out, pass{TierPriority, prio})
+	}
+	if len(rest) > 0 {
+		out = append(out, pass{TierRest, rest})
+	}
+	return out
+}
+
+// scanPass sweeps ports, probes the open ones and sends the UDP probes
+func scanPass(ctx context.Context, host string, ports []int, opts ScanOptions) []Finding {
+	// Phase 1: connect sweep
+	states := sweep(ctx, host, ports, opts)
+
+	var findings []Finding
+	var open []int
+	for _, port := range ports {
+		state, ok := states[port]
+		if !ok {
+			continue // Not swept because the context was cancelled
+		}
+		switch state {
+		case StateOpen:
+			open = append(open, port)
+		case StateClosed:
+			if opts.IncludeClosed {
+				findings = append(findings, Finding{State: state, ProbeResult: probe.ProbeResult{Port: port}})
+			}
+		default:
+			findings = append(findings, Finding{State: state, ProbeResult: probe.ProbeResult{Port: port}})
+		}
+	}
+
+	// Phase 2: deep probe of open ports only
+	if len(open) > 0 && ctx.Err() == nil {
+		probeOpts := opts.Probe
+		if probeOpts.Concurrency == 0 {
+			probeOpts.Concurrency = opts.Concurrency
+		}
+		for _, result := range probe.ProbeMany(ctx, host, open, probeOpts) {
+			findings = append(findings, Finding{State: StateOpen, ProbeResult: result, Slow: result.TTFB > opts.SlowThreshold})
+		}
+	}
+
+	// Phase 3: UDP probes
+	if ctx.Err() == nil {
+		findings = append(findings, probeUDP(ctx, host, ports, opts)...)
+	}
+	return findings
+}
+
+// sortByPort sorts findings by port, then address
+func sortByPort(findings []Finding) {
+	sort.Slice(findings, func(i, j int) bool {
+		if findings[i].Port != findings[j].Port {
+			return findings[i].Port < findings[j].Port
+		}
+		return findings[i].Address < findings[j].Address
+	})
+}
+
+// extraScan is what scanning the extra loopback addresses needs: the
+// addresses, and the ones each port has a listener bound to
+type extraScan struct {
+	addrs []string
+	bound map[int]map[string]bool // key = port
+}
+
+// extraAddrs validates opts.ExtraAddrs and adds the discovered ones. There
+// are none unless host is this machine.
+func extraAddrs(ctx context.Context, host string, opts ScanOptions) (extraScan, error) {
+	var extra extraScan
+	for _, addr := range opts.ExtraAddrs {
+		if ip := net.ParseIP(addr); ip == nil || !ip.IsLoopback() {
+			return extraScan{}, fmt.Errorf("invalid scan address %q: not a loopback IP address", addr)
+		}
+	}
+	if (len(opts.ExtraAddrs) == 0 && !opts.DiscoverAddrs) || probe.CheckLoopback(ctx, host) != nil {
+		return extra, nil
+	}
+
+	addrs := opts.ExtraAddrs
+	if procs, err := procmap.All(); err == nil {
+		if opts.DiscoverAddrs {
+			addrs = append(append([]string(nil), addrs...), procmap.LoopbackAddrs(procs)...)
+		}
+		extra.bound = make(map[int]map[string]bool)
+		for _, p := range procs {
+			if extra.bound[p.Port] == nil {
+				extra.bound[p.Port] = make(map[string]bool)
+			}
+			for _, addr := range p.Addrs {
+				extra.bound[p.Port][addr] = true
+			}
+		}
+	}
+	primary := make(map[string]bool)
+	for _, h := range probe.DialHosts(ctx, host, opts.Probe.AddressFamily) {
+		primary[h] = true
+	}
+	for _, addr := range addrs {
+		addr = net.ParseIP(addr).String()
+		if !primary[addr] {
+			primary[addr] = true
+			extra.addrs = append(extra.addrs, addr)
+		}
+	}
+	return extra, nil
+}
+
+// scan scans ports on each extra address and adds what it finds to the
+// primary host's findings. An open port on an extra address is kept if
+// the primary host had nothing on it, or if a listener is bound to that
+// address specifically; otherwise it is the same listener, e.g. one bound
+// to 0.0.0.0, answering again. The primary host's closed and filtered
+// findings for ports found open elsewhere are dropped.
+func (e extraScan) scan(ctx context.Context, findings []Finding, ports []int, opts ScanOptions) []Finding {
+	opts.IncludeClosed = false
+	key := func(f Finding) string { return strconv.Itoa(f.Port) + "/" + f.Transport }
+	open := make(map[string]bool)
+	for _, f := range findings {
+		if f.State == StateOpen {
+			open[key(f)] = true
+		}
+	}
+
+	var found []Finding
+	openElsewhere := make(map[int]bool)
+	for _, addr := range e.addrs {
+		for _, f := range scanPass(ctx, addr, ports, opts) {
+			if f.State != StateOpen || (open[key(f)] && !e.bound[f.Port][addr]) {
+				continue
+			}
+			f.Address = addr
+			found = append(found, f)
+			openElsewhere[f.Port] = true
+		}
+	}
+
+	kept := findings[:0]
+	for _, f := range findings {
+		if f.State == StateOpen || !openElsewhere[f.Port] {
+			kept = append(kept, f)
+		}
+	}
+	return append(kept, found...)
+}
+
+// probeUDP sends the UDP probe for each scanned port in opts.UDPPorts and
+// returns a finding for each port that answered. A silent UDP port may be
+// open or filtered, so only answers are worth reporting.
+func probeUDP(ctx context.Context, host string, ports []int, opts ScanOptions) []Finding {
+	udpPorts := opts.UDPPorts
+	if udpPorts == nil {
+		udpPorts = DefaultUDPPorts
+	}
+	var wanted []int
+	for _, port := range ports {
+		if _, ok := udpPorts[port]; ok {
+			wanted = append(wanted, port)
+		}
+	}
+
+	results := make([]probe.ProbeResult, len(wanted))
+	var wg sync.WaitGroup
+	for i, port := range wanted {
+		wg.Add(1)
+		go func(i, port int) {
+			defer wg.Done()
+			results[i] = probe.ProbeUDPWithOptions(ctx, host, port, udpPorts[port], opts.Probe)
+		}(i, port)
+	}
+	wg.Wait()
+
+	var findings []Finding
+	for _, result := range results {
+		if result.UDP == probe.UDPResponded {
+			findings = append(findings, Finding{State: StateOpen, ProbeResult: result})
+		}
+	}
+	return findings
+}
+
+// probeQUIC tries a QUIC handshake on each of opts.QUICPorts. The result is
+// attached to the TCP finding for the same port when there is one, and is
+// otherwise a finding of its own if a QUIC server answered.
+func probeQUIC(ctx context.Context, host string, findings []Finding, opts ScanOptions) []Finding {
+	results := make([]probe.ProbeResult, len(opts.QUICPorts))
+	var wg sync.WaitGroup
+	for i, port := range opts.QUICPorts {
+		wg.Add(1)
+		go func(i, port int) {
+			defer wg.Done()
+			results[i] = probe.ProbeQUIC(ctx, host, port, opts.Probe)
+		}(i, port)
+	}
+	wg.Wait()
+
+	byPort := make(map[int]int, len(findings))
+	for i, f := range findings {
+		if f.State == StateOpen {
+			byPort[f.Port] = i
+		}
+	}
+	for i := range results {
+		result := results[i]
+		if j, ok := byPort[result.Port]; ok {
+			findings[j].QUIC = &result
+		} else if result.Kind == probe.ServiceQUIC {
+			findings = append(findings, Finding{State: StateOpen, ProbeResult: result})
+		}
+	}
+	return findings
+}
+
+// withDefaults returns a copy of the options with zero fields filled in
+func (o ScanOptions) withDefaults() ScanOptions {
+	if o.Concurrency <= 0 {
+		o.Concurrency = DefaultConcurrency
+	}
+	if o.DialTimeout <= 0 {
+		o.DialTimeout = DefaultDialTimeout
+	}
+	if o.PriorityPorts == nil {
+		o.PriorityPorts = DefaultPriorityPorts
+	}
+	if o.SlowThreshold <= 0 {
+		o.SlowThreshold = DefaultSlowThreshold
+	}
+	return o
+}
+
+// sweep dials every port once and records whether it is open, closed or
+// filtered. Ports skipped because ctx was cancelled are absent from the map.
+func sweep(ctx context.Context, host string, ports []int, opts ScanOptions) map[int]PortState {
+	states := make(map[int]PortState, len(ports))
+	var mu sync.Mutex
+
+	// Resolve once so "localhost" covers both 127.0.0.1 and ::1
+	dialHosts := probe.DialHosts(ctx, host, opts.Probe.AddressFamily)
+	limiter := opts.Probe.Limiter
+	dialer := probe.DialerWithTimeout(opts.Probe.Dialer, opts.DialTimeout)
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < opts.Concurrency && w < len(ports); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for port := range jobs {
+				state, ok := dialState(ctx, limiter, dialer, dialHosts, port)
+				if !ok {
+					continue
+				}
+				mu.Lock()
+				states[port] = state
+				mu.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for _, port := range ports {
+		select {
+		case jobs <- port:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	return states
+}
+
+// dialState classifies a single port with a bare TCP connect to each of
+// hosts in turn. The port is open if any address accepts, and closed only
+// if every address refused. ok is false when the dial was interrupted by
+// ctx and says nothing about the port.
+func dialState(ctx context.Context, limiter *probe.Limiter, dialer probe.Dialer, hosts []string, port int) (PortState, bool) {
+	state := StateClosed
+	for _, host := range hosts {
+		conn, err := limiter.Dial(ctx, dialer, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err == nil {
+			conn.Close()
+			return StateOpen, true
+		}
+		if ctx.Err() != nil {
+			return "", false
+		}
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			state = StateFiltered
+		}
+	}
+	return state, true
+}
+
+// findingJSON is the wire form of a Finding. The probe result is nested
+// so its own "state" doesn't collide with the sweep state.
+type findingJSON struct {
+	Port       int                `json:"port"`
+	Address    string             `json:"address,omitempty"`
+	State      PortState          `json:"state"`
+	Probe      *probe.ProbeResult `json:"probe,omitempty"`
+	Process    *procmap.Process   `json:"process,omitempty"`
+	Container  *docker.Container  `json:"container,omitempty"`
+	Parent     int                `json:"parent,omitempty"`
+	Scope      procmap.Scope      `json:"scope,omitempty"`
+	Tier       Tier               `json:"tier,omitempty"`
+	Slow       bool               `json:"slow,omitempty"`
+	ServedPath string             `json:"served_path,omitempty"`
+	CertIssues []string           `json:"cert_issues,omitempty"`
+}
+
+// MarshalJSON encodes the finding as its port, sweep state and, for open
+// ports, the probe result under "probe"
+func (f Finding) MarshalJSON() ([]byte, error) {
+	out := findingJSON{Port: f.Port, Address: f.Address, State: f.State, Process: f.Process, Container: f.Container, Parent: f.Parent, Scope: f.Scope, Tier: f.Tier, Slow: f.Slow, ServedPath: f.ServedPath, CertIssues: f.CertIssues}
+	if f.State == StateOpen {
+		out.Probe = &f.ProbeResult
+	}
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON decodes the format written by MarshalJSON
+func (f *Finding) UnmarshalJSON(data []byte) error {
+	var in findingJSON
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	*f = Finding{State: in.State, Process: in.Process, Container: in.Container, Parent: in.Parent, Scope: in.Scope, Tier: in.Tier, Slow: in.Slow, ServedPath: in.ServedPath, CertIssues: in.CertIssues}
+	if in.Probe != nil {
+		f.ProbeResult = *in.Probe
+	}
+	f.Port = in.Port
+	if f.Address == "" {
+		f.Address = in.Address
+	}
+	return nil
+}
+
+// String returns a one-line summary of the finding
+func (f Finding) String() string {
+	s := fmt.Sprintf("%d/tcp %s", f.Port, f.State)
+	if f.State == StateOpen {
+		s = f.ProbeResult.String()
+	}
+	if f.Process != nil {
+		s += " (" + f.Process.String() + ")"
+	}
+	if f.Container != nil {
+		s += " container " + f.Container.String()
+	}
+	return s
+}
+
+// Identity fingerprints the service behind the finding, so it can be
+// recognised after a restart or a move to another port: its Compose
+// service or container, else its executable, working directory and
+// arguments, else just its port, with the address if it isn't 127.0.0.1
+// or ::1. A UDP finding's ends in "/udp", apart from the TCP service of
+// the same process. Attach processes and containers first.
+func (f Finding) Identity() string {
+	var id string
+	switch {
+	case f.Container != nil && f.Container.Project != "" && f.Container.Service != "":
+		id = "compose:" + f.Container.Project + "/" + f.Container.Service
+	case f.Container != nil && f.Container.Name != "":
+		id = "container:" + f.Container.Name
+	case f.Process != nil && f.Process.Exe != "":
+		// The working directory tells apart the same command run in two
+		// projects, e.g. two "python3 -m http.server"
+		args := append([]string{f.Process.Cwd}, f.Process.Args...)
+		id = "process:" + naming.ComputeIdentityHash(f.Process.Exe, args)
+	case f.Address != "" && !procmap.IsDefaultLoopback(f.Address):
+		id = "port:" + net.JoinHostPort(f.Address, strconv.Itoa(f.Port))
+	default:
+		id = "port:" + strconv.Itoa(f.Port)
+	}
+	if f.Transport != "" {
+		id += "/" + f.Transport
+	}
+	return id
+}
+
+// CheckCert sets CertIssues to the problems of the certificate of an open
+// TLS finding reached as name, e.g. "myapp.localhost"
+func (f *Finding) CheckCert(name string) {
+	f.CertIssues = nil
+	if f.State == StateOpen && f.IsTLS && f.Cert != nil {
+		f.CertIssues = f.Cert.Issues(name, time.Now())
+	}
+}
+
+// AttachProcesses sets Process and Scope on the open findings whose port
+// has a local listener accepting connections on the finding's address,
+// and ServedPath on those answering with a directory listing. It only
+// makes sense for scans of this machine. Owners that can't be fully
+// inspected are attached with Process.Partial set. UDP findings get the
+// owners of bound UDP ports, where the platform lists them.
+func AttachProcesses(findings []Finding) error {
+	procs, err := procmap.All()
+	if err != nil {
+		return err
+	}
+	byPort := map[string][]procmap.Process{}
+	for _, p := range procs {
+		byPort[strconv.Itoa(p.Port)] = append(byPort[strconv.Itoa(p.Port)], p)
+	}
+	for _, f := range findings {
+		if f.Transport == "udp" {
+			// Not knowing a UDP port's owner leaves its finding as it was
+			if udp, err := procmap.AllUDP(); err == nil {
+				for _, p := range udp {
+					key := strconv.Itoa(p.Port) + "/udp"
+					byPort[key] = append(byPort[key], p)
+				}
+			}
+			break
+		}
+	}
+	for i := range findings {
+		if findings[i].State != StateOpen {
+			continue
+		}
+		key := strconv.Itoa(findings[i].Port)
+		if findings[i].Transport != "" {
+			key += "/" + findings[i].Transport
+		}
+		for _, p := range byPort[key] {
+			if findings[i].Address == "" || p.Accepts(findings[i].Address) {
+				findings[i].Process = &p
+				findings[i].Scope = p.Scope
+				if findings[i].DirListing != nil {
+					findings[i].ServedPath = p.ServedDir()
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// AttachContainers sets Container on the open findings whose port is
+// published by a Docker container, using a single query for the whole
+// scan. Docker being absent or its socket unreadable isn't an error: the
+// findings are left as they are.
+func AttachContainers(ctx context.Context, findings []Finding, client *docker.Client) error {
+	published, err := client.Published(ctx)
+	if errors.Is(err, docker.ErrUnavailable) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for i := range findings {
+		if c, ok := published[findings[i].Port]; ok && findings[i].State == StateOpen {
+			findings[i].Container = &c
+		}
+	}
+	return nil
+}
+
+// LinkAuxiliary sets Parent on each auxiliary finding, such as a dev
+// server's HMR port, to the port of the regular HTTP service run by the
+// same process, or failing that from the same working directory. Attach
+// processes first; findings without a match keep Parent zero.
+func LinkAuxiliary(findings []Finding) {
+	for i := range findings {
+		aux := &findings[i]
+		if aux.Auxiliary == probe.AuxiliaryNone || aux.Process == nil {
+			continue
+		}
+		sameDir := 0
+		for _, f := range findings {
+			if f.Auxiliary != probe.AuxiliaryNone || !f.IsHTTP || f.Process == nil {
+				continue
+			}
+			if f.Process.PID != 0 && f.Process.PID == aux.Process.PID {
+				aux.Parent = f.Port
+				break
+			}
+			if sameDir == 0 && f.Process.Cwd != "" && f.Process.Cwd == aux.Process.Cwd {
+				sameDir = f.Port
+			}
+		}
+		if aux.Parent == 0 {
+			aux.Parent = sameDir
+		}
+	}
+}
+
+// Silent returns the open findings whose service accepted the connection
+// but never identified itself: either it said nothing at all, or it spoke
+// a protocol the probe doesn't know. These are worth listing apart from
+// HTTP services, e.g. a forgotten debugger port.
+func Silent(findings []Finding) []Finding {
+	var silent []Finding
+	for _, f := range findings {
+		if f.State != StateOpen {
+			continue
+		}
+		if f.ProbeResult.State == probe.StateOpenSilent ||
+			(f.ProbeResult.State == probe.StateOpenNonHTTP && f.Kind == probe.ServiceUnknown) {
+			silent = append(silent, f)
+		}
+	}
+	return silent
+}
@@ -0,0 +1,70 @@
+package scan
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"localhost-magic/internal/procmap"
+	"localhost-magic/probe"
+)
+
+func TestFindingJSONRoundTrip(t *testing.T) {
+	tests := map[string]Finding{
+		"open": {
+			State:       StateOpen,
+			ProbeResult: probe.ProbeResult{Port: 5173, Address: "127.0.0.1", State: probe.StateHTTP, IsHTTP: true, StatusCode: 200, Protocol: probe.ProtocolHTTP1, Title: "Vite App"},
+			Process:     &procmap.Process{Port: 5173, PID: 4242, Exe: "/usr/bin/node", Cwd: "/home/dev/shop"},
+			Scope:       procmap.ScopeLoopback, Tier: TierPriority, Slow: true, CertIssues: []string{"expired"},
+		},
+		"closed": {State: StateClosed, ProbeResult: probe.ProbeResult{Port: 3000, Address: "127.0.0.1"}},
+	}
+	for name, f := range tests {
+		t.Run(name, func(t *testing.T) {
+			data, err := json.Marshal(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got Finding
+			if err := json.Unmarshal(data, &got); err != nil {
+				t.Fatalf("Unmarshal(%s): %v", data, err)
+			}
+			if !reflect.DeepEqual(got, f) {
+				t.Errorf("round trip of %s:\n got %+v\nwant %+v", data, got, f)
+			}
+		})
+	}
+}
+
+func TestFindingJSONNestsProbe(t *testing.T) {
+	f := Finding{State: StateOpen, ProbeResult: probe.ProbeResult{Port: 8080, State: probe.StateOpenNonHTTP}}
+	data, err := json.Marshal(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wire map[string]json.RawMessage
+	json.Unmarshal(data, &wire)
+	if string(wire["state"]) != `"open"` || !strings.Contains(string(wire["probe"]), `"state":"open-non-http"`) {
+		t.Errorf("encoded %s, want the sweep state at the top and the probe's under \"probe\"", data)
+	}
+	data, _ = json.Marshal(Finding{State: StateClosed, ProbeResult: probe.ProbeResult{Port: 8080}})
+	if strings.Contains(string(data), `"probe"`) {
+		t.Errorf("closed port encoded %s, want no probe result", data)
+	}
+}
+
+func TestIdentityApartByTransport(t *testing.T) {
+	process := &procmap.Process{Exe: "/usr/sbin/dnsmasq", Args: []string{"dnsmasq"}}
+	tcp := Finding{ProbeResult: probe.ProbeResult{Port: 53}, Process: process}
+	udp := Finding{ProbeResult: probe.ProbeResult{Port: 53, Transport: "udp"}, Process: process}
+	if !strings.HasSuffix(udp.Identity(), "/udp") {
+		t.Errorf("UDP identity %q, want it to end in /udp", udp.Identity())
+	}
+	if udp.Identity() == tcp.Identity() {
+		t.Errorf("TCP and UDP of one process share identity %q", tcp.Identity())
+	}
+	if got := (Finding{ProbeResult: probe.ProbeResult{Port: 5353, Address: "127.0.0.2", Transport: "udp"}}).Identity(); got != "port:127.0.0.2:5353/udp" {
+		t.Errorf("identity of an unowned UDP port = %q", got)
+	}
+}
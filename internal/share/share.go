@@ -0,0 +1,346 @@
+// Package share makes chosen services reachable from other devices on the
+// LAN through a listener of their own, while the main proxy stays for this
+// machine. Nothing is reachable through it by default: a service must be
+// shared explicitly, a client needs the share's link to get in, and the
+// share is revoked once nobody has used it for a while.
+//
+// Clients on the LAN address the daemon by IP, so the Host header can't
+// say which service they want. Instead a share's link carries a parameter
+// that is swapped for a session cookie on the first visit, and the cookie
+// routes the requests that follow:
+//
+//	http://192.168.1.20:7080/?lm_token=9f86d0...   one-time token
+//	http://192.168.1.20:7080/?lm_share=web.localhost   shares without one
+package share
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"localhost-magic/internal/proxy"
+)
+
+// DefaultAddr is where the LAN listener binds: every interface, on a port
+// of its own
+const DefaultAddr = ":7080"
+
+// DefaultIdle is how long a share lasts without requests when its Options
+// don't say
+const DefaultIdle = 30 * time.Minute
+
+// expiryCheck is how often Run looks for idle shares
+const expiryCheck = 5 * time.Second
+
+// Link parameters and the session cookie
+const (
+	tokenParam    = "lm_token"
+	shareParam    = "lm_share"
+	sessionCookie = "lm_session"
+)
+
+// ErrNotShared is returned for a service that has no share
+var ErrNotShared = errors.New("service not shared")
+
+// Options says who may use a share
+type Options struct {
+	// Token makes the share's links one-time: each gets one browser in,
+	// as a session, and is spent after that
+	Token bool
+	// User and Password, if set, are asked for with HTTP basic auth on
+	// every request. The password is never encoded; output.Share is what
+	// is shown of a share.
+	User     string
+	Password string `json:"-"`
+	// Idle is how long the share lasts without requests: DefaultIdle if
+	// zero, forever if negative
+	Idle time.Duration
+}
+
+// Share is a service made reachable from the LAN
+type Share struct {
+	Name     string // Service name, e.g. "web.localhost"
+	Options  Options
+	Created  time.Time
+	LastUsed time.Time // When a request last went through, or Created
+}
+
+// Expires returns when the share is revoked if it stays unused, the zero
+// time if never
+func (s Share) Expires() time.Time {
+	if s.Options.Idle < 0 {
+		return time.Time{}
+	}
+	return s.LastUsed.Add(s.Options.Idle)
+}
+
+// Manager holds the shares and serves the LAN listener. It is safe for
+// concurrent use.
+type Manager struct {
+	routes  proxy.Routes
+	handler *proxy.Handler
+
+	mu       sync.Mutex
+	shares   map[string]*Share // key = service name
+	tokens   map[string]string // Unspent one-time token -> service name
+	sessions map[string]string // Session ID -> service name
+}
+
+// New returns a manager with no shares, passing the requests it lets
+// through to handler along routes
+func New(routes proxy.Routes, handler *proxy.Handler) *Manager {
+	return &Manager{
+		routes:   routes,
+		handler:  handler,
+		shares:   make(map[string]*Share),
+		tokens:   make(map[string]string),
+		sessions: make(map[string]string),
+	}
+}
+
+// Add shares the service name, replacing any share it had along with its
+// links and sessions
+func (m *Manager) Add(name string, opts Options) Share {
+	if opts.Idle == 0 {
+		opts.Idle = DefaultIdle
+	}
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.revoke(name)
+	s := &Share{Name: name, Options: opts, Created: now, LastUsed: now}
+	m.shares[name] = s
+	return *s
+}
+
+// Remove revokes the share of name, reporting whether there was one.
+// Clients with a session are turned away from their next request on.
+func (m *Manager) Remove(name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.shares[name]
+	m.revoke(name)
+	return ok
+}
+
+// revoke drops the share of name with its tokens and sessions. Must hold
+// m.mu.
+func (m *Manager) revoke(name string) {
+	delete(m.shares, name)
+	for token, shared := range m.tokens {
+		if shared == name {
+			delete(m.tokens, token)
+		}
+	}
+	for id, shared := range m.sessions {
+		if shared == name {
+			delete(m.sessions, id)
+		}
+	}
+}
+
+// Get returns the share of name
+func (m *Manager) Get(name string) (Share, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.shares[name]
+	if !ok {
+		return Share{}, false
+	}
+	return *s, true
+}
+
+// List returns the shares, sorted by name
+func (m *Manager) List() []Share {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	shares := make([]Share, 0, len(m.shares))
+	for _, s := range m.shares {
+		shares = append(shares, *s)
+	}
+	sort.Slice(shares, func(i, j int) bool { return shares[i].Name < shares[j].Name })
+	return shares
+}
+
+// Link returns the query that gets a browser into the share of name, to
+// put after the LAN listener's root URL. A share with Token gets a new
+// one-time token on every call.
+func (m *Manager) Link(name string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.shares[name]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrNotShared, name)
+	}
+	if !s.Options.Token {
+		return "?" + shareParam + "=" + name, nil
+	}
+	token, err := randomID()
+	if err != nil {
+		return "", err
+	}
+	m.tokens[token] = name
+	return "?" + tokenParam + "=" + token, nil
+}
+
+// Run revokes shares once they have been idle too long, until ctx is done
+func (m *Manager) Run(ctx context.Context) {
+	ticker := time.NewTicker(expiryCheck)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			m.expire(now)
+		}
+	}
+}
+
+// expire revokes the shares idle at now
+func (m *Manager) expire(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name, s := range m.shares {
+		if expires := s.Expires(); !expires.IsZero() && now.After(expires) {
+			m.revoke(name)
+			log.Printf("Share: %s revoked after %s without requests", name, s.Options.Idle)
+		}
+	}
+}
+
+// ServeHTTP serves the LAN listener: a link starts a session, a session
+// reaches its service, and anything else is refused
+func (m *Manager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Has(tokenParam) || query.Has(shareParam) {
+		m.startSession(w, r)
+		return
+	}
+
+	var name string
+	var s Share
+	var ok bool
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		m.mu.Lock()
+		name = m.sessions[cookie.Value]
+		if shared, found := m.shares[name]; found {
+			s, ok = *shared, true
+		}
+		m.mu.Unlock()
+	}
+	if !ok {
+		refuse(w, r, "no session for a shared service")
+		return
+	}
+	if !s.Options.authorized(r) {
+		log.Printf("Share: %s %s from %s to %s: wrong or missing credentials", r.Method, r.URL.Path, r.RemoteAddr, name)
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", name))
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	route, ok := m.routes.Lookup(name)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Service %s unavailable", name), http.StatusBadGateway)
+		return
+	}
+
+	m.mu.Lock()
+	if shared, found := m.shares[name]; found {
+		shared.LastUsed = time.Now()
+	}
+	m.mu.Unlock()
+	dropSessionCookie(r)
+	m.handler.ServeRoute(w, r, route)
+}
+
+// startSession swaps a link's parameter for a session cookie and sends the
+// browser back to the same URL without it
+func (m *Manager) startSession(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	m.mu.Lock()
+	var name string
+	if token := query.Get(tokenParam); token != "" {
+		name = m.tokens[token]
+		delete(m.tokens, token) // Spent, whatever happens next
+	} else if s, ok := m.shares[query.Get(shareParam)]; ok && !s.Options.Token {
+		name = s.Name
+	}
+	var id string
+	var err error
+	if _, ok := m.shares[name]; ok {
+		if id, err = randomID(); err == nil {
+			m.sessions[id] = name
+		}
+	}
+	m.mu.Unlock()
+	switch {
+	case err != nil:
+		log.Printf("Share: failed to start a session: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	case id == "":
+		refuse(w, r, "link unknown, spent or revoked")
+		return
+	}
+
+	log.Printf("Share: %s opened %s", r.RemoteAddr, name)
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: id, Path: "/", HttpOnly: true, SameSite: http.SameSiteLaxMode})
+	query.Del(tokenParam)
+	query.Del(shareParam)
+	target := *r.URL
+	target.RawQuery = query.Encode()
+	http.Redirect(w, r, target.RequestURI(), http.StatusSeeOther)
+}
+
+// authorized reports whether r carries the basic auth credentials the
+// options ask for, if any
+func (o Options) authorized(r *http.Request) bool {
+	if o.User == "" {
+		return true
+	}
+	user, password, ok := r.BasicAuth()
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(o.User)) == 1
+	passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(o.Password)) == 1
+	return ok && userOK && passwordOK
+}
+
+// refuse logs and answers 403 Forbidden
+func refuse(w http.ResponseWriter, r *http.Request, reason string) {
+	log.Printf("Share: refused %s %s%s from %s: %s", r.Method, r.Host, r.URL.Path, r.RemoteAddr, reason)
+	http.Error(w, "Forbidden: this address only serves services shared with localhost-magic share", http.StatusForbidden)
+}
+
+// dropSessionCookie removes the session cookie from r, which is none of
+// the backend's business, keeping the backend's own cookies
+func dropSessionCookie(r *http.Request) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	var kept []string
+	for _, c := range cookies {
+		if c.Name != sessionCookie {
+			kept = append(kept, c.Name+"="+c.Value)
+		}
+	}
+	if len(kept) > 0 {
+		r.Header.Set("Cookie", strings.Join(kept, "; "))
+	}
+}
+
+// randomID returns 16 random bytes in hex, for tokens and session IDs
+func randomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate a token: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -10,7 +10,7 @@ import (
 
 // ServiceRecord represents a persisted service mapping
 type ServiceRecord struct {
-	ID          string    `json:"id"`                    // Hash of exe+args
+	ID          string    `json:"id"`                    // See scan.Finding.Identity; a hash of exe+args in older records
 	Name        string    `json:"name"`                  // Assigned DNS name
 	Port        int       `json:"port"`                  // Current port
 	TargetHost  string    `json:"target_host,omitempty"` // Target IP/host (default: 127.0.0.1)
@@ -111,6 +111,19 @@ func (s *Store) UpdateName(id string, newName string) error {
 	return s.persist()
 }
 
+// Delete removes the record with the given ID, if there is one
+func (s *Store) Delete(id string) error {
+	record, ok := s.records[id]
+	if !ok {
+		return nil
+	}
+	if s.names[record.Name] == id {
+		delete(s.names, record.Name)
+	}
+	delete(s.records, id)
+	return s.persist()
+}
+
 // List returns all records
 func (s *Store) List() []*ServiceRecord {
 	result := make([]*ServiceRecord, 0, len(s.records))
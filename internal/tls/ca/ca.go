@@ -0,0 +1,408 @@
+// Package ca manages the local two-tier certificate authority: a long-lived
+// root that the OS trusts, and an intermediate that signs leaf certificates
+// and is rotated automatically. The root is name-constrained to localhost
+// and loopback addresses, so even a leaked key can't vouch for real sites.
+package ca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Validity periods
+const (
+	RootValidity         = 10 * 365 * 24 * time.Hour
+	IntermediateValidity = 365 * 24 * time.Hour
+	// IntermediateRenewBefore is how long before expiry the intermediate is
+	// replaced
+	IntermediateRenewBefore = 30 * 24 * time.Hour
+)
+
+const (
+	rootCertFile         = "root_ca.pem"
+	rootKeyFile          = "root_ca.key"
+	intermediateCertFile = "intermediate.pem"
+	intermediateKeyFile  = "intermediate.key"
+
+	organization = "localhost-magic development CA"
+
+	// clockSkew backdates NotBefore so slightly slow clocks accept new certs
+	clockSkew = time.Hour
+)
+
+// CA is a loaded certificate authority
+type CA struct {
+	dir  string
+	root *x509.Certificate
+
+	rotateMu        sync.Mutex // Serialises rotations
+	mu              sync.RWMutex
+	intermediate    *x509.Certificate
+	intermediateKey crypto.Signer
+}
+
+// DefaultDir returns the default CA directory, next to the service store
+func DefaultDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = "."
+	}
+	return filepath.Join(home, ".config", "localhost-magic", "tls")
+}
+
+// Load opens the CA in dir. The error matches fs.ErrNotExist if there is
+// no CA yet. An intermediate that is missing or close to expiry is
+// replaced.
+func Load(dir string) (*CA, error) {
+	root, err := readCert(filepath.Join(dir, rootCertFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load root CA: %w", err)
+	}
+	c := &CA{dir: dir, root: root}
+
+	cert, certErr := readCert(filepath.Join(dir, intermediateCertFile))
+	key, keyErr := readKey(filepath.Join(dir, intermediateKeyFile))
+	if certErr != nil || keyErr != nil || expiring(cert) {
+		if err := c.Rotate(); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	c.intermediate, c.intermediateKey = cert, key
+	return c, nil
+}
+
+// LoadRoot reads the root certificate of the CA in dir without loading the
+// rest, for checking certificates against. The error matches
+// fs.ErrNotExist if there is no CA yet.
+func LoadRoot(dir string) (*x509.Certificate, error) {
+	root, err := readCert(filepath.Join(dir, rootCertFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load root CA: %w", err)
+	}
+	return root, nil
+}
+
+// LoadOrCreate opens the CA in dir, creating it on first run. created
+// reports whether a new root was generated and so still needs trusting.
+func LoadOrCreate(dir string) (c *CA, created bool, err error) {
+	c, err = Load(dir)
+	if err == nil {
+		return c, false, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, false, err
+	}
+	c, err = Create(dir)
+	return c, err == nil, err
+}
+
+// Create generates a new root and intermediate in dir, replacing any
+// existing CA there
+func Create(dir string) (*CA, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create CA directory: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate root key: %w", err)
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{organization}, CommonName: rootCommonName()},
+		NotBefore:             now.Add(-clockSkew),
+		NotAfter:              now.Add(RootValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            1,
+		SubjectKeyId:          keyID(&key.PublicKey),
+
+		// Only ever valid for localhost names and loopback addresses
+		PermittedDNSDomainsCritical: true,
+		PermittedDNSDomains:         []string{"localhost"},
+		PermittedIPRanges: []*net.IPNet{
+			{IP: net.IPv4(127, 0, 0, 0).To4(), Mask: net.CIDRMask(8, 32)},
+			{IP: net.IPv6loopback, Mask: net.CIDRMask(128, 128)},
+		},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create root certificate: %w", err)
+	}
+	root, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse root certificate: %w", err)
+	}
+
+	if err := writeKey(filepath.Join(dir, rootKeyFile), key); err != nil {
+		return nil, err
+	}
+	if err := writeCert(filepath.Join(dir, rootCertFile), der); err != nil {
+		return nil, err
+	}
+
+	c := &CA{dir: dir, root: root}
+	if err := c.Rotate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Rotate replaces the intermediate with a freshly signed one. Leaf
+// certificates signed by the old intermediate stay valid until they expire.
+func (c *CA) Rotate() error {
+	c.rotateMu.Lock()
+	defer c.rotateMu.Unlock()
+	return c.rotate()
+}
+
+// rotate does the work of Rotate. c.rotateMu must be held.
+func (c *CA) rotate() error {
+	rootKey, err := readKey(filepath.Join(c.dir, rootKeyFile))
+	if err != nil {
+		return fmt.Errorf("failed to load root key: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate intermediate key: %w", err)
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{organization}, CommonName: "localhost-magic intermediate " + now.Format("2006-01-02")},
+		NotBefore:             now.Add(-clockSkew),
+		NotAfter:              minTime(now.Add(IntermediateValidity), c.root.NotAfter),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+		SubjectKeyId:          keyID(&key.PublicKey),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, c.root, &key.PublicKey, rootKey)
+	if err != nil {
+		return fmt.Errorf("failed to create intermediate certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return fmt.Errorf("failed to parse intermediate certificate: %w", err)
+	}
+
+	if err := writeKey(filepath.Join(c.dir, intermediateKeyFile), key); err != nil {
+		return err
+	}
+	if err := writeCert(filepath.Join(c.dir, intermediateCertFile), der); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.intermediate, c.intermediateKey = cert, key
+	c.mu.Unlock()
+	return nil
+}
+
+// Sign issues a certificate from template for pub. NotAfter is clamped to
+// the intermediate's, which is rotated first if it is close to expiry. It
+// returns the certificate and the intermediate that signed it, both DER.
+func (c *CA) Sign(template *x509.Certificate, pub crypto.PublicKey) (cert, intermediate []byte, err error) {
+	if err := c.rotateIfExpiring(); err != nil {
+		return nil, nil, err
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	template.NotAfter = minTime(template.NotAfter, c.intermediate.NotAfter)
+	der, err := x509.CreateCertificate(rand.Reader, template, c.intermediate, pub, c.intermediateKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to sign certificate: %w", err)
+	}
+	return der, c.intermediate.Raw, nil
+}
+
+// rotateIfExpiring rotates the intermediate unless another caller already did
+func (c *CA) rotateIfExpiring() error {
+	c.mu.RLock()
+	stale := expiring(c.intermediate)
+	c.mu.RUnlock()
+	if !stale {
+		return nil
+	}
+
+	c.rotateMu.Lock()
+	defer c.rotateMu.Unlock()
+	c.mu.RLock()
+	stale = expiring(c.intermediate)
+	c.mu.RUnlock()
+	if !stale {
+		return nil
+	}
+	return c.rotate()
+}
+
+// Root returns the root certificate
+func (c *CA) Root() *x509.Certificate {
+	return c.root
+}
+
+// RootPath returns the path of the root certificate PEM, the file to add
+// to trust stores
+func (c *CA) RootPath() string {
+	return filepath.Join(c.dir, rootCertFile)
+}
+
+// Dir returns the CA directory
+func (c *CA) Dir() string {
+	return c.dir
+}
+
+// WriteFileAtomic writes data to a temporary file and renames it over path,
+// so readers never see a partial certificate or key
+func WriteFileAtomic(path string, data []byte, perm fs.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+// EncodeKey returns key as a PKCS #8 PEM block
+func EncodeKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode key: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// writeKey saves a private key readable only by the owner
+func writeKey(path string, key crypto.Signer) error {
+	data, err := EncodeKey(key)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, data, 0600)
+}
+
+// writeCert saves a DER certificate as PEM
+func writeCert(path string, der []byte) error {
+	return WriteFileAtomic(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// readCert loads the first certificate in a PEM file
+func readCert(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s: no certificate found", path)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// readKey loads a PKCS #8 private key from a PEM file
+func readKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no key found", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported key type", path)
+	}
+	return signer, nil
+}
+
+// expiring reports whether an intermediate is due for rotation
+func expiring(cert *x509.Certificate) bool {
+	return time.Until(cert.NotAfter) < IntermediateRenewBefore
+}
+
+// newSerial returns a random 128-bit serial number
+func newSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+	return serial, nil
+}
+
+// keyID is the SHA-1 of the public key, as RFC 5280 suggests
+func keyID(pub *ecdsa.PublicKey) []byte {
+	der, _ := x509.MarshalPKIXPublicKey(pub)
+	sum := sha1.Sum(der)
+	return sum[:]
+}
+
+// rootCommonName identifies whose machine the root belongs to, which helps
+// when it shows up in a keychain
+func rootCommonName() string {
+	name := "localhost-magic"
+	if u, err := user.Current(); err == nil {
+		name += " " + u.Username
+	}
+	if host, err := os.Hostname(); err == nil {
+		name += "@" + host
+	}
+	return name
+}
+
+// minTime returns the earlier of a and b
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,304 @@
+// Package issuer mints short-lived leaf certificates from the local CA on
+// demand, caching them in memory and under the CA directory's certs/
+package issuer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"localhost-magic/internal/tls/ca"
+	"localhost-magic/internal/tls/policy"
+)
+
+// DefaultValidity is the lifetime of a leaf certificate. Issuance is local
+// and fast, so certificates are kept short and renewed lazily.
+const DefaultValidity = 24 * time.Hour
+
+// IssueRequest names the subject alternative names of a new certificate
+type IssueRequest struct {
+	DNSNames []string
+	IPs      []net.IP
+	ValidFor time.Duration // Zero uses DefaultValidity
+}
+
+// Certificate is an issued leaf certificate
+type Certificate struct {
+	CertPEM   []byte // Leaf followed by the intermediate
+	KeyPEM    []byte
+	Serial    string
+	DNSNames  []string
+	NotBefore time.Time
+	NotAfter  time.Time
+	CertPath  string
+	KeyPath   string
+
+	tls *tls.Certificate
+}
+
+// NeedsRenewal reports whether less than a third of the certificate's
+// lifetime remains
+func (c *Certificate) NeedsRenewal() bool {
+	lifetime := c.NotAfter.Sub(c.NotBefore)
+	return time.Now().After(c.NotAfter.Add(-lifetime / 3))
+}
+
+// Issuer issues and caches leaf certificates
+type Issuer struct {
+	ca  *ca.CA
+	dir string
+
+	mu    sync.Mutex
+	cache map[string]*Certificate // key = requested name
+	calls map[string]*call        // in-flight Ensure calls
+}
+
+// call is an Ensure in progress that later callers for the same name wait on
+type call struct {
+	done chan struct{}
+	cert *Certificate
+	err  error
+}
+
+// New returns an issuer signing with authority
+func New(authority *ca.CA) *Issuer {
+	return &Issuer{
+		ca:    authority,
+		dir:   filepath.Join(authority.Dir(), "certs"),
+		cache: make(map[string]*Certificate),
+		calls: make(map[string]*call),
+	}
+}
+
+// Issue mints a new certificate. Every DNS name must pass the policy and
+// IPs must be loopback. A wildcard also covers its base name, so
+// *.myapp.localhost includes myapp.localhost.
+func (i *Issuer) Issue(req IssueRequest) (*Certificate, error) {
+	var names []string
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for _, name := range req.DNSNames {
+		name = policy.Normalize(name)
+		if err := policy.Check(name); err != nil {
+			return nil, err
+		}
+		add(name)
+		if policy.IsWildcard(name) {
+			add(strings.TrimPrefix(name, "*."))
+		}
+	}
+	for _, ip := range req.IPs {
+		if !ip.IsLoopback() {
+			return nil, fmt.Errorf("%w: %s is not a loopback address", policy.ErrNotAllowed, ip)
+		}
+	}
+	if len(names) == 0 && len(req.IPs) == 0 {
+		return nil, errors.New("certificate request has no names")
+	}
+
+	validity := req.ValidFor
+	if validity <= 0 {
+		validity = DefaultValidity
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+
+	primary := "localhost"
+	if len(names) > 0 {
+		primary = names[0]
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		// CN is for display only; clients match on the SANs
+		Subject:     pkix.Name{CommonName: primary},
+		NotBefore:   now.Add(-time.Minute),
+		NotAfter:    now.Add(validity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:    names,
+		IPAddresses: req.IPs,
+	}
+	der, intermediate, err := i.ca.Sign(template, &key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := ca.EncodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	certPEM := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: intermediate})...)
+
+	cert, err := parse(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	cert.CertPath, cert.KeyPath = i.paths(primary)
+	if err := os.MkdirAll(i.dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create certificate directory: %w", err)
+	}
+	if err := ca.WriteFileAtomic(cert.KeyPath, keyPEM, 0600); err != nil {
+		return nil, err
+	}
+	if err := ca.WriteFileAtomic(cert.CertPath, certPEM, 0644); err != nil {
+		return nil, err
+	}
+
+	i.mu.Lock()
+	i.cache[primary] = cert
+	i.mu.Unlock()
+	return cert, nil
+}
+
+// Get returns a cached certificate for name that isn't due for renewal,
+// from memory or from a previous run's files
+func (i *Issuer) Get(name string) (*Certificate, bool) {
+	name = policy.Normalize(name)
+	i.mu.Lock()
+	cert, ok := i.cache[name]
+	i.mu.Unlock()
+	if ok && !cert.NeedsRenewal() {
+		return cert, true
+	}
+
+	cert, err := i.load(name)
+	if err != nil || cert.NeedsRenewal() {
+		return nil, false
+	}
+	i.mu.Lock()
+	i.cache[name] = cert
+	i.mu.Unlock()
+	return cert, true
+}
+
+// Ensure returns a valid certificate for name, issuing one if there is none
+// or the cached one is close to expiry. Concurrent calls for the same name
+// share one issuance.
+func (i *Issuer) Ensure(name string) (*Certificate, error) {
+	name = policy.Normalize(name)
+	if err := policy.Check(name); err != nil {
+		return nil, err
+	}
+	if cert, ok := i.Get(name); ok {
+		return cert, nil
+	}
+
+	i.mu.Lock()
+	if c, ok := i.calls[name]; ok {
+		i.mu.Unlock()
+		<-c.done
+		return c.cert, c.err
+	}
+	c := &call{done: make(chan struct{})}
+	i.calls[name] = c
+	i.mu.Unlock()
+
+	c.cert, c.err = i.Issue(IssueRequest{DNSNames: []string{name}})
+
+	i.mu.Lock()
+	delete(i.calls, name)
+	i.mu.Unlock()
+	close(c.done)
+	return c.cert, c.err
+}
+
+// GetCertificate is a tls.Config.GetCertificate callback issuing a
+// certificate for the requested server name. Clients that send no SNI,
+// such as those connecting by IP, get one for localhost.
+func (i *Issuer) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := hello.ServerName
+	if name == "" {
+		name = "localhost"
+	}
+	cert, err := i.Ensure(name)
+	if err != nil {
+		return nil, err
+	}
+	return cert.tls, nil
+}
+
+// load reads a certificate written by an earlier Issue, accepting it only
+// if it still chains to the current root
+func (i *Issuer) load(name string) (*Certificate, error) {
+	certPath, keyPath := i.paths(name)
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := parse(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(i.ca.Root())
+	intermediates := x509.NewCertPool()
+	for _, der := range cert.tls.Certificate[1:] {
+		if c, err := x509.ParseCertificate(der); err == nil {
+			intermediates.AddCert(c)
+		}
+	}
+	if _, err := cert.tls.Leaf.Verify(x509.VerifyOptions{DNSName: name, Roots: roots, Intermediates: intermediates}); err != nil {
+		return nil, fmt.Errorf("%s: %w", certPath, err)
+	}
+
+	cert.CertPath, cert.KeyPath = certPath, keyPath
+	return cert, nil
+}
+
+// paths returns where the certificate for name is stored
+func (i *Issuer) paths(name string) (certPath, keyPath string) {
+	base := strings.Replace(name, "*", "_wildcard", 1)
+	return filepath.Join(i.dir, base+".pem"), filepath.Join(i.dir, base+".key")
+}
+
+// parse builds a Certificate from its PEM encoding
+func parse(certPEM, keyPEM []byte) (*Certificate, error) {
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	pair.Leaf = leaf
+	return &Certificate{
+		CertPEM:   certPEM,
+		KeyPEM:    keyPEM,
+		Serial:    fmt.Sprintf("%X", leaf.SerialNumber),
+		DNSNames:  leaf.DNSNames,
+		NotBefore: leaf.NotBefore,
+		NotAfter:  leaf.NotAfter,
+		tls:       &pair,
+	}, nil
+}
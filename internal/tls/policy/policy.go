@@ -0,0 +1,64 @@
+// Package policy decides which names the local CA may issue certificates
+// for. Only localhost and names under .localhost qualify, so a certificate
+// from the development CA can never be mistaken for one of a real domain.
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Zone is the only domain certificates are issued under
+const Zone = "localhost"
+
+// ErrNotAllowed is returned for names outside the policy
+var ErrNotAllowed = errors.New("name not allowed by local CA policy")
+
+// Normalize lowercases name and removes a trailing dot
+func Normalize(name string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+}
+
+// Check returns an error matching ErrNotAllowed unless name may appear in a
+// certificate. Wildcards are allowed only as the whole left-most label and
+// at least two labels above the zone: *.myapp.localhost, not *.localhost.
+func Check(name string) error {
+	name = Normalize(name)
+	if name != Zone && !strings.HasSuffix(name, "."+Zone) {
+		return fmt.Errorf("%w: %q is not under .%s", ErrNotAllowed, name, Zone)
+	}
+
+	labels := strings.Split(name, ".")
+	for i, label := range labels {
+		if label == "*" && i == 0 {
+			continue
+		}
+		if !validLabel(label) {
+			return fmt.Errorf("%w: %q has an invalid label %q", ErrNotAllowed, name, label)
+		}
+	}
+	if labels[0] == "*" && len(labels) < 3 {
+		return fmt.Errorf("%w: wildcard %q is too broad", ErrNotAllowed, name)
+	}
+	return nil
+}
+
+// IsWildcard reports whether name is a wildcard pattern
+func IsWildcard(name string) bool {
+	return strings.HasPrefix(name, "*.")
+}
+
+// validLabel accepts letters, digits, hyphens and underscores, not starting
+// or ending with a hyphen
+func validLabel(label string) bool {
+	if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+		return false
+	}
+	for _, c := range label {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' && c != '_' {
+			return false
+		}
+	}
+	return true
+}
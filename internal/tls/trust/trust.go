@@ -0,0 +1,50 @@
+// Package trust adds the local CA's root certificate to the operating
+// system trust store, or explains how to when it can't do it itself
+package trust
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// IsTrusted reports whether the system already accepts root as a trust
+// anchor
+func IsTrusted(root *x509.Certificate) bool {
+	_, err := root.Verify(x509.VerifyOptions{})
+	return err == nil
+}
+
+// Install adds the root certificate at rootPath to the system trust store.
+// It usually needs root privileges and does nothing if the root is already
+// trusted.
+func Install(root *x509.Certificate, rootPath string) error {
+	if IsTrusted(root) {
+		return nil
+	}
+	return install(root, rootPath)
+}
+
+// Uninstall removes the root certificate from the system trust store
+func Uninstall(root *x509.Certificate) error {
+	return uninstall(root)
+}
+
+// Instructions describes how to trust the root certificate by hand,
+// including for browsers that keep their own store
+func Instructions(rootPath string) string {
+	var b strings.Builder
+	b.WriteString(instructions(rootPath))
+	fmt.Fprintf(&b, "\nFirefox uses its own store: Settings > Privacy & Security > Certificates > View Certificates > Authorities > Import, then choose %s.\n", rootPath)
+	return b.String()
+}
+
+// run executes a command, including its output in any error
+func run(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %w: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package trust
+
+import (
+	"crypto/sha1"
+	"crypto/x509"
+	"fmt"
+)
+
+const systemKeychain = "/Library/Keychains/System.keychain"
+
+func install(root *x509.Certificate, rootPath string) error {
+	return run("/usr/bin/security", "add-trusted-cert", "-d", "-r", "trustRoot", "-k", systemKeychain, rootPath)
+}
+
+func uninstall(root *x509.Certificate) error {
+	// Removing the certificate drops its trust settings with it
+	return run("/usr/bin/security", "delete-certificate", "-Z", fmt.Sprintf("%X", sha1.Sum(root.Raw)), systemKeychain)
+}
+
+func instructions(rootPath string) string {
+	return fmt.Sprintf("To trust the local CA, run:\n\n  sudo security add-trusted-cert -d -r trustRoot -k %s %s\n", systemKeychain, rootPath)
+}
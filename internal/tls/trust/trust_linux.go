@@ -0,0 +1,78 @@
+package trust
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"localhost-magic/internal/tls/ca"
+)
+
+// anchorStore is a distribution's directory of extra trust anchors and the
+// command that rebuilds the bundle from it
+type anchorStore struct {
+	path    string
+	command string
+}
+
+var anchorStores = []anchorStore{
+	{"/usr/local/share/ca-certificates/localhost-magic.crt", "update-ca-certificates"},   // Debian, Ubuntu
+	{"/etc/pki/ca-trust/source/anchors/localhost-magic.pem", "update-ca-trust"},          // Fedora, RHEL
+	{"/etc/ca-certificates/trust-source/anchors/localhost-magic.pem", "update-ca-trust"}, // Arch
+}
+
+// detectStore returns the first anchor store whose directory and command
+// both exist
+func detectStore() (anchorStore, bool) {
+	for _, store := range anchorStores {
+		if _, err := exec.LookPath(store.command); err != nil {
+			continue
+		}
+		if _, err := os.Stat(filepath.Dir(store.path)); err == nil {
+			return store, true
+		}
+	}
+	return anchorStore{}, false
+}
+
+func install(root *x509.Certificate, rootPath string) error {
+	store, ok := detectStore()
+	if !ok {
+		return errors.New("no supported trust store found\n" + instructions(rootPath))
+	}
+	data, err := os.ReadFile(rootPath)
+	if err != nil {
+		return fmt.Errorf("failed to read root certificate: %w", err)
+	}
+	if err := ca.WriteFileAtomic(store.path, data, 0644); err != nil {
+		return err
+	}
+	return run(store.command)
+}
+
+func uninstall(root *x509.Certificate) error {
+	store, ok := detectStore()
+	if !ok {
+		return errors.New("no supported trust store found")
+	}
+	if err := os.Remove(store.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove %s: %w", store.path, err)
+	}
+	if store.command == "update-ca-certificates" {
+		// Prune the symlink left in /etc/ssl/certs
+		return run(store.command, "--fresh")
+	}
+	return run(store.command)
+}
+
+func instructions(rootPath string) string {
+	if store, ok := detectStore(); ok {
+		return fmt.Sprintf("To trust the local CA, run:\n\n  sudo cp %s %s\n  sudo %s\n", rootPath, store.path, store.command)
+	}
+	return fmt.Sprintf("Add %s to your distribution's trusted CA certificates.\n", rootPath) +
+		"Chrome and other NSS-based apps also read ~/.pki/nssdb:\n\n" +
+		fmt.Sprintf("  certutil -d sql:$HOME/.pki/nssdb -A -t C,, -n localhost-magic -i %s\n", rootPath)
+}
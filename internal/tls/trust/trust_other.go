@@ -0,0 +1,23 @@
+//go:build !darwin && !linux
+
+package trust
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+var errUnsupported = errors.New("installing trust is not supported on this platform")
+
+func install(root *x509.Certificate, rootPath string) error {
+	return errUnsupported
+}
+
+func uninstall(root *x509.Certificate) error {
+	return errUnsupported
+}
+
+func instructions(rootPath string) string {
+	return fmt.Sprintf("Add %s to your system's trusted root certificates.\n", rootPath)
+}
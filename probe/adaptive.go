@@ -0,0 +1,76 @@
+package probe
+
+import (
+	"sync"
+	"time"
+)
+
+// Bounds of an adaptive read timeout, used when the corresponding
+// ProbeOptions field is zero
+const (
+	DefaultAdaptiveFloor   = 100 * time.Millisecond
+	DefaultAdaptiveCeiling = 5 * time.Second
+)
+
+// adaptiveFactor is how many times its average time to first byte a port
+// is given to answer
+const adaptiveFactor = 3
+
+// latencyWeight is the weight of the newest sample in a moving average
+const latencyWeight = 0.3
+
+// latencies keeps moving averages of the time to first byte, per address
+// and across all of them. It is safe for concurrent use.
+type latencies struct {
+	mu     sync.Mutex
+	byAddr map[string]time.Duration // key = host:port
+	global time.Duration
+}
+
+// readTimeout returns the read timeout for a probe of addr: adaptiveFactor
+// times its average, within the floor and ceiling. An address that never
+// answered gets the static timeout, or more when the average across
+// addresses says the machine is slow.
+func (l *latencies) readTimeout(addr string, opts ProbeOptions) time.Duration {
+	l.mu.Lock()
+	avg, seen := l.byAddr[addr]
+	global := l.global
+	l.mu.Unlock()
+
+	if !seen {
+		if adaptiveFactor*global <= opts.ReadTimeout {
+			return opts.ReadTimeout
+		}
+		avg = global
+	}
+	return min(max(adaptiveFactor*avg, opts.AdaptiveFloor), opts.AdaptiveCeiling)
+}
+
+// record updates the averages with the outcome of a probe of addr that
+// had timeout to answer. A port that answered before and now timed out,
+// say a dev server recompiling, has its average raised to the timeout so
+// the next probe waits adaptiveFactor times longer.
+func (l *latencies) record(addr string, result ProbeResult, timeout time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.byAddr == nil {
+		l.byAddr = make(map[string]time.Duration)
+	}
+	switch {
+	case result.TTFB > 0:
+		l.byAddr[addr] = movingAverage(l.byAddr[addr], result.TTFB)
+		l.global = movingAverage(l.global, result.TTFB)
+	case result.State == StateOpenSilent:
+		if avg, seen := l.byAddr[addr]; seen {
+			l.byAddr[addr] = max(avg, timeout)
+		}
+	}
+}
+
+// movingAverage adds sample to avg, zero meaning no samples yet
+func movingAverage(avg, sample time.Duration) time.Duration {
+	if avg == 0 {
+		return sample
+	}
+	return avg + time.Duration(latencyWeight*float64(sample-avg))
+}
@@ -0,0 +1,130 @@
+package probe
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadTimeout(t *testing.T) {
+	opts := ProbeOptions{ReadTimeout: time.Second}.withDefaults()
+	answered := func(ttfb time.Duration) ProbeResult {
+		return ProbeResult{State: StateHTTP, IsHTTP: true, TTFB: ttfb}
+	}
+	tests := []struct {
+		name    string
+		samples []time.Duration
+		floor   time.Duration
+		want    time.Duration
+	}{
+		{"never answered", nil, 0, time.Second},
+		{"fast port", []time.Duration{20 * time.Millisecond}, 0, DefaultAdaptiveFloor},
+		{"fast port, lower floor", []time.Duration{20 * time.Millisecond}, 10 * time.Millisecond, 60 * time.Millisecond},
+		{"slow port", []time.Duration{800 * time.Millisecond}, 0, 2400 * time.Millisecond},
+		{"very slow port", []time.Duration{2 * time.Second}, 0, DefaultAdaptiveCeiling},
+		{"moving average", []time.Duration{100 * time.Millisecond, 200 * time.Millisecond}, 0, 390 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var l latencies
+			for _, ttfb := range tt.samples {
+				l.record("127.0.0.1:3000", answered(ttfb), opts.ReadTimeout)
+			}
+			o := opts
+			if tt.floor > 0 {
+				o.AdaptiveFloor = tt.floor
+			}
+			if got := l.readTimeout("127.0.0.1:3000", o); got != tt.want {
+				t.Errorf("readTimeout = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadTimeoutOfNewPortFollowsMachine(t *testing.T) {
+	opts := ProbeOptions{ReadTimeout: time.Second}.withDefaults()
+	var l latencies
+	l.record("127.0.0.1:3000", ProbeResult{TTFB: 20 * time.Millisecond}, opts.ReadTimeout)
+	if got := l.readTimeout("127.0.0.1:4000", opts); got != time.Second {
+		t.Errorf("new port on a fast machine gets %v, want the static %v", got, time.Second)
+	}
+	l.record("127.0.0.1:5000", ProbeResult{TTFB: 3 * time.Second}, opts.ReadTimeout)
+	if got := l.readTimeout("127.0.0.1:4000", opts); got <= time.Second || got > DefaultAdaptiveCeiling {
+		t.Errorf("new port on a slow machine gets %v, want more than the static %v within the ceiling", got, time.Second)
+	}
+}
+
+func TestRecordTimeoutRaisesAverage(t *testing.T) {
+	opts := ProbeOptions{}.withDefaults()
+	var l latencies
+	l.record("127.0.0.1:3000", ProbeResult{TTFB: 20 * time.Millisecond}, opts.ReadTimeout)
+	l.record("127.0.0.1:3000", ProbeResult{State: StateOpenSilent}, 400*time.Millisecond)
+	if got := l.readTimeout("127.0.0.1:3000", opts); got != 1200*time.Millisecond {
+		t.Errorf("after a timeout readTimeout = %v, want three times the 400ms it had", got)
+	}
+	// A port that never answered keeps the static timeout
+	l.record("127.0.0.1:4000", ProbeResult{State: StateOpenSilent}, opts.ReadTimeout)
+	if got := l.readTimeout("127.0.0.1:4000", opts); got != opts.ReadTimeout {
+		t.Errorf("silent new port gets %v, want the static %v", got, opts.ReadTimeout)
+	}
+}
+
+// delayServer answers after the delay it is set to
+func delayServer(t *testing.T, delay time.Duration) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+	var d atomic.Int64
+	d.Store(int64(delay))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Duration(d.Load()))
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &d
+}
+
+func TestCacheAdaptsReadTimeoutPerPort(t *testing.T) {
+	fast, fastDelay := delayServer(t, 20*time.Millisecond)
+	slow, _ := delayServer(t, 2*time.Second)
+	c := NewCache(CacheOptions{TTL: time.Nanosecond, Probe: ProbeOptions{Adaptive: true, ReadTimeout: 3 * time.Second}})
+	opts := c.opts.Probe.withDefaults()
+	addr := func(srv *httptest.Server) string {
+		return net.JoinHostPort("127.0.0.1", strconv.Itoa(serverPort(t, srv)))
+	}
+
+	var wg sync.WaitGroup
+	for _, srv := range []*httptest.Server{fast, slow} {
+		wg.Add(1)
+		go func(srv *httptest.Server) {
+			defer wg.Done()
+			if result := c.Probe(context.Background(), "127.0.0.1", serverPort(t, srv)); !result.IsHTTP {
+				t.Errorf("first probe of port %d: %+v, want HTTP", serverPort(t, srv), result)
+			}
+		}(srv)
+	}
+	wg.Wait()
+
+	if got := c.latencies.readTimeout(addr(fast), opts); got != DefaultAdaptiveFloor {
+		t.Errorf("20ms port gets %v, want the floor %v", got, DefaultAdaptiveFloor)
+	}
+	if got := c.latencies.readTimeout(addr(slow), opts); got != DefaultAdaptiveCeiling {
+		t.Errorf("2s port gets %v, want the ceiling %v", got, DefaultAdaptiveCeiling)
+	}
+
+	// Held to its tight deadline, the fast port is given up on quickly
+	// once it stalls, well before the static 3s
+	fastDelay.Store(int64(time.Second))
+	start := time.Now()
+	result := c.Probe(context.Background(), "127.0.0.1", serverPort(t, fast))
+	if elapsed := time.Since(start); result.IsHTTP || elapsed > 900*time.Millisecond {
+		t.Errorf("stalled fast port: %+v after %v, want a timeout near %v", result, elapsed, DefaultAdaptiveFloor)
+	}
+	if got := c.latencies.readTimeout(addr(fast), opts); got != 3*DefaultAdaptiveFloor {
+		t.Errorf("after timing out the fast port gets %v, want %v", got, 3*DefaultAdaptiveFloor)
+	}
+}
@@ -0,0 +1,58 @@
+package probe
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// AddressFamily restricts which IP versions a probe dials
+type AddressFamily int
+
+const (
+	AddressAny  AddressFamily = iota // Try IPv4 first, then IPv6
+	AddressIPv4                      // IPv4 only
+	AddressIPv6                      // IPv6 only
+)
+
+// Loopback addresses tried for "localhost", so a server bound only to ::1
+// is found even when the resolver maps localhost to 127.0.0.1 alone
+const (
+	loopbackIPv4 = "127.0.0.1"
+	loopbackIPv6 = "::1"
+)
+
+// DialHosts returns the hosts a probe of host should dial, in order.
+// "localhost" expands to the loopback address of each allowed family;
+// other names are resolved only when a single family is requested.
+// IP literals are returned unchanged.
+func DialHosts(ctx context.Context, host string, family AddressFamily) []string {
+	if strings.EqualFold(host, "localhost") {
+		switch family {
+		case AddressIPv4:
+			return []string{loopbackIPv4}
+		case AddressIPv6:
+			return []string{loopbackIPv6}
+		default:
+			return []string{loopbackIPv4, loopbackIPv6}
+		}
+	}
+	if family == AddressAny || net.ParseIP(host) != nil {
+		return []string{host}
+	}
+
+	network := "ip4"
+	if family == AddressIPv6 {
+		network = "ip6"
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, network, host)
+	if err != nil || len(ips) == 0 {
+		// Let the dial report the resolution failure
+		return []string{host}
+	}
+	hosts := make([]string, len(ips))
+	for i, ip := range ips {
+		hosts[i] = ip.String()
+	}
+	return hosts
+}
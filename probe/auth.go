@@ -0,0 +1,208 @@
+package probe
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// authPathMarkers are path fragments that make a redirect look like a
+// bounce to a login page
+var authPathMarkers = []string{"login", "signin", "sign-in", "sign_in", "oauth", "sso"}
+
+// authSchemes maps lowercased WWW-Authenticate schemes to their usual
+// spelling
+var authSchemes = map[string]string{
+	"basic":     "Basic",
+	"bearer":    "Bearer",
+	"digest":    "Digest",
+	"negotiate": "Negotiate",
+	"ntlm":      "NTLM",
+}
+
+// identifyAuth sets the auth fields from the first response and, when
+// redirects were followed, from the last hop
+func identifyAuth(result ProbeResult) ProbeResult {
+	for _, r := range []*ProbeResult{&result, result.Final} {
+		if r == nil {
+			continue
+		}
+		if r.StatusCode == 401 || r.StatusCode == 403 {
+			result.RequiresAuth = true
+			if scheme := authScheme(r.Headers.Values("WWW-Authenticate")); scheme != "" && result.AuthScheme == "" {
+				result.AuthScheme = scheme
+			}
+		}
+		if isRedirect(*r) && isLoginLocation(r.Headers.Get("Location")) {
+			result.LoginRedirect = true
+		}
+	}
+	return result
+}
+
+// authScheme returns the scheme of the first challenge, e.g. "Basic" for
+// `Basic realm="dev"`
+func authScheme(challenges []string) string {
+	for _, challenge := range challenges {
+		token := strings.TrimSpace(challenge)
+		if i := strings.IndexAny(token, " ,"); i >= 0 {
+			token = token[:i]
+		}
+		if token == "" {
+			continue
+		}
+		if canonical, ok := authSchemes[strings.ToLower(token)]; ok {
+			return canonical
+		}
+		return token
+	}
+	return ""
+}
+
+// isLoginLocation reports whether a redirect target's path looks like a
+// login, sign-in or OAuth page
+func isLoginLocation(location string) bool {
+	u, err := url.Parse(location)
+	if err != nil {
+		return false
+	}
+	path := strings.ToLower(u.Path)
+	for _, marker := range authPathMarkers {
+		if strings.Contains(path, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// Credentials authenticate the probe to a service that answers anonymous
+// requests with a login page: a bearer token, a username and password for
+// basic auth, and session cookies, sent on every HTTP/1 request to the
+// service. They never show in a ProbeResult, and format as a summary
+// without the secrets, e.g. "basic alice, 2 cookies", so logging them
+// by mistake doesn't leak them.
+type Credentials struct {
+	BearerToken string
+	Username    string // Basic auth, when set
+	Password    string
+	Cookies     []*http.Cookie // Sent in one Cookie header
+}
+
+// ErrInvalidCredentials is returned for credentials that can't be sent in
+// a header
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Validate checks that the credentials fit in request headers: no CR, LF
+// or NUL anywhere, no colon in the username, and valid cookie names
+func (c *Credentials) Validate() error {
+	if c == nil {
+		return nil
+	}
+	if strings.ContainsAny(c.BearerToken+c.Username+c.Password, "\r\n\x00") {
+		return fmt.Errorf("%w: contains CR, LF or NUL", ErrInvalidCredentials)
+	}
+	if strings.Contains(c.Username, ":") {
+		return fmt.Errorf("%w: username contains a colon", ErrInvalidCredentials)
+	}
+	for _, cookie := range c.Cookies {
+		if err := cookie.Valid(); err != nil || cookie.Name == "" {
+			return fmt.Errorf("%w: cookie %q", ErrInvalidCredentials, cookie.Name)
+		}
+	}
+	return nil
+}
+
+// IsZero reports whether the credentials have nothing to send
+func (c *Credentials) IsZero() bool {
+	return c == nil || c.BearerToken == "" && c.Username == "" && len(c.Cookies) == 0
+}
+
+// String names the kinds of credentials without their secrets
+func (c Credentials) String() string {
+	if c.IsZero() {
+		return "none"
+	}
+	var kinds []string
+	if c.BearerToken != "" {
+		kinds = append(kinds, "bearer")
+	}
+	if c.Username != "" {
+		kinds = append(kinds, "basic "+c.Username)
+	}
+	switch n := len(c.Cookies); {
+	case n == 1:
+		kinds = append(kinds, "1 cookie")
+	case n > 1:
+		kinds = append(kinds, strconv.Itoa(n)+" cookies")
+	}
+	return strings.Join(kinds, ", ")
+}
+
+// GoString is String, so %#v doesn't print the secrets either
+func (c Credentials) GoString() string {
+	return c.String()
+}
+
+// fields returns the header fields carrying the credentials. Basic auth
+// wins over a bearer token when both are set, there being one
+// Authorization header.
+func (c *Credentials) fields() [][2]string {
+	if c.IsZero() {
+		return nil
+	}
+	var fields [][2]string
+	switch {
+	case c.Username != "":
+		fields = append(fields, [2]string{"Authorization", "Basic " + base64.StdEncoding.EncodeToString([]byte(c.Username+":"+c.Password))})
+	case c.BearerToken != "":
+		fields = append(fields, [2]string{"Authorization", "Bearer " + c.BearerToken})
+	}
+	if len(c.Cookies) > 0 {
+		pairs := make([]string, len(c.Cookies))
+		for i, cookie := range c.Cookies {
+			pairs[i] = (&http.Cookie{Name: cookie.Name, Value: cookie.Value}).String()
+		}
+		fields = append(fields, [2]string{"Cookie", strings.Join(pairs, "; ")})
+	}
+	return fields
+}
+
+// authenticated marks an answer to a request the credentials in opts
+// were sent with, and drops the cookies the service set in it, which may
+// renew the very session the credentials hold. The answers to the other
+// paths are treated the same; the last redirect hop, which may be
+// another service's, only loses its cookies.
+func (o ProbeOptions) authenticated(r ProbeResult) ProbeResult {
+	if o.Credentials.IsZero() {
+		return r
+	}
+	r.Authenticated = r.IsHTTP
+	r.Headers = withoutCookies(r.Headers)
+	if r.Final != nil {
+		final := *r.Final
+		final.Headers = withoutCookies(final.Headers)
+		r.Final = &final
+	}
+	if r.PathResults != nil {
+		paths := make(map[string]ProbeResult, len(r.PathResults))
+		for path, answer := range r.PathResults {
+			paths[path] = o.authenticated(answer)
+		}
+		r.PathResults = paths
+	}
+	return r
+}
+
+// withoutCookies returns a copy of h without Set-Cookie
+func withoutCookies(h http.Header) http.Header {
+	if h.Get("Set-Cookie") == "" {
+		return h
+	}
+	h = h.Clone()
+	h.Del("Set-Cookie")
+	return h
+}
@@ -0,0 +1,55 @@
+package probe
+
+import (
+	"context"
+	"sync"
+)
+
+// ProbeMany probes each port on host using a pool of opts.Concurrency
+// workers. Results are returned in the same order as ports and each carries
+// its Port. A failure on one port never aborts the batch; when ctx is
+// cancelled, ports that were not probed yet come back with Err set to the
+// context error.
+func ProbeMany(ctx context.Context, host string, ports []int, opts ProbeOptions) []ProbeResult {
+	opts = opts.withDefaults()
+	results := make([]ProbeResult, len(ports))
+
+	workers := opts.Concurrency
+	if workers > len(ports) {
+		workers = len(ports)
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if ctx.Err() != nil {
+					results[i] = ProbeResult{Port: ports[i], Err: ctx.Err()}
+					continue
+				}
+				results[i] = probeWithOptions(ctx, host, ports[i], opts)
+			}
+		}()
+	}
+
+	next := 0
+feed:
+	for ; next < len(ports); next++ {
+		select {
+		case jobs <- next:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	// Ports never handed to a worker because the context was cancelled
+	for ; next < len(ports); next++ {
+		results[next] = ProbeResult{Port: ports[next], Err: ctx.Err()}
+	}
+	return results
+}
@@ -0,0 +1,91 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// farm starts n HTTP servers that answer after latency, and returns their
+// ports followed by the given number of closed ones
+func farm(tb testing.TB, n, closed int, latency time.Duration) []int {
+	tb.Helper()
+	var ports []int
+	for i := 0; i < n; i++ {
+		ports = append(ports, serverPort(tb, slowServer(tb, latency)))
+	}
+	for i := 0; i < closed; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			tb.Fatal(err)
+		}
+		ports = append(ports, ln.Addr().(*net.TCPAddr).Port)
+		ln.Close()
+	}
+	return ports
+}
+
+func TestProbeManyKeepsOrder(t *testing.T) {
+	ports := farm(t, 6, 3, 0)
+	// Closed ports first, so faster results can't simply arrive in order
+	ports = append(ports[6:], ports[:6]...)
+	results := ProbeMany(context.Background(), "127.0.0.1", ports, ProbeOptions{Concurrency: 4})
+	if len(results) != len(ports) {
+		t.Fatalf("%d results for %d ports", len(results), len(ports))
+	}
+	for i, r := range results {
+		if r.Port != ports[i] {
+			t.Errorf("result %d is for port %d, want %d", i, r.Port, ports[i])
+		}
+		if wantHTTP := i >= 3; r.IsHTTP != wantHTTP {
+			t.Errorf("port %d: IsHTTP %v, State %q, Err %v", r.Port, r.IsHTTP, r.State, r.Err)
+		}
+	}
+}
+
+func TestProbeManyCancel(t *testing.T) {
+	ports := farm(t, 8, 0, 2*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	results := ProbeMany(ctx, "127.0.0.1", ports, ProbeOptions{Concurrency: 2, ReadTimeout: 5 * time.Second})
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("cancelled batch took %v", elapsed)
+	}
+	for i, r := range results {
+		if r.Port != ports[i] || r.IsHTTP || !errors.Is(r.Err, context.DeadlineExceeded) {
+			t.Errorf("result %d: Port %d, IsHTTP %v, Err %v; want its port and the context error", i, r.Port, r.IsHTTP, r.Err)
+		}
+	}
+}
+
+func TestProbeManyEmpty(t *testing.T) {
+	if results := ProbeMany(context.Background(), "127.0.0.1", nil, ProbeOptions{}); len(results) != 0 {
+		t.Errorf("got %d results for no ports", len(results))
+	}
+}
+
+// BenchmarkProbeMany scans a farm of dev servers that take 5ms to answer,
+// among closed ports, one port at a time and with pools of workers
+func BenchmarkProbeMany(b *testing.B) {
+	ports := farm(b, 32, 32, 5*time.Millisecond)
+	for _, workers := range []int{1, 8, DefaultConcurrency} {
+		name := fmt.Sprintf("pooled-%d", workers)
+		if workers == 1 {
+			name = "serial"
+		}
+		b.Run(name, func(b *testing.B) {
+			opts := ProbeOptions{Concurrency: workers, BannerTimeout: -1}
+			for i := 0; i < b.N; i++ {
+				for _, r := range ProbeMany(context.Background(), "127.0.0.1", ports, opts) {
+					if r.Err != nil && r.State != StateClosed {
+						b.Fatalf("port %d: %v", r.Port, r.Err)
+					}
+				}
+			}
+		})
+	}
+}
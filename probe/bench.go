@@ -0,0 +1,294 @@
+package probe
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults for the BenchOptions fields left zero
+const (
+	DefaultBenchRequests    = 50
+	DefaultBenchConcurrency = 4
+)
+
+// ErrNotLoopback is returned by Bench for a host that isn't this machine,
+// unless BenchOptions.AllowRemote is set
+var ErrNotLoopback = errors.New("not a loopback address")
+
+// BenchOptions configures Bench
+type BenchOptions struct {
+	Requests    int    // Number of requests, default DefaultBenchRequests
+	Concurrency int    // Requests in flight at once, default DefaultBenchConcurrency
+	Path        string // Request path, default "/"
+	TLS         bool   // Use HTTPS, certificates unchecked
+
+	// Probe supplies the timeouts, Dialer, Host, Headers and ClientCert.
+	// Each request must be answered within the dial, write and read
+	// timeouts together.
+	Probe ProbeOptions
+
+	// AllowRemote lets Bench run against hosts other than this machine.
+	// It is a check for a dev server, not a load test.
+	AllowRemote bool
+}
+
+// BenchResult sums up the requests of a Bench
+type BenchResult struct {
+	URL         string
+	Requests    int         // Requests sent
+	Errors      int         // Requests that failed or got a 5xx
+	Statuses    map[int]int // Responses by status code
+	Connections int         // Connections opened
+	// KeepAlive is set when connections were reused, which telling
+	// clients Connection: close or HTTP/1.0 without keep-alive prevents
+	KeepAlive bool
+	// Latencies of the requests answered, from sending the request to the
+	// end of the body
+	Min, Mean, Max time.Duration
+	P50, P90, P99  time.Duration
+	Duration       time.Duration // Wall time of the whole run
+	Err            error         // The first request error, if any
+}
+
+// ErrorRate is the fraction of requests that failed, from 0 to 1
+func (r BenchResult) ErrorRate() float64 {
+	if r.Requests == 0 {
+		return 0
+	}
+	return float64(r.Errors) / float64(r.Requests)
+}
+
+// benchResultJSON is the wire form of a BenchResult, with durations in
+// fractional milliseconds
+type benchResultJSON struct {
+	URL         string         `json:"url"`
+	Requests    int            `json:"requests"`
+	Errors      int            `json:"errors"`
+	ErrorRate   float64        `json:"error_rate"`
+	Statuses    map[string]int `json:"statuses,omitempty"`
+	Connections int            `json:"connections"`
+	KeepAlive   bool           `json:"keep_alive"`
+	MinMS       float64        `json:"min_ms"`
+	MeanMS      float64        `json:"mean_ms"`
+	MaxMS       float64        `json:"max_ms"`
+	P50MS       float64        `json:"p50_ms"`
+	P90MS       float64        `json:"p90_ms"`
+	P99MS       float64        `json:"p99_ms"`
+	DurationMS  float64        `json:"duration_ms"`
+	Error       string         `json:"error,omitempty"`
+}
+
+// MarshalJSON encodes the result with durations as milliseconds, like
+// ProbeResult
+func (r BenchResult) MarshalJSON() ([]byte, error) {
+	out := benchResultJSON{
+		URL: r.URL, Requests: r.Requests, Errors: r.Errors, ErrorRate: r.ErrorRate(),
+		Connections: r.Connections, KeepAlive: r.KeepAlive,
+		MinMS: durationMS(r.Min), MeanMS: durationMS(r.Mean), MaxMS: durationMS(r.Max),
+		P50MS: durationMS(r.P50), P90MS: durationMS(r.P90), P99MS: durationMS(r.P99),
+		DurationMS: durationMS(r.Duration), Error: errorString(r.Err),
+	}
+	if len(r.Statuses) > 0 {
+		out.Statuses = make(map[string]int, len(r.Statuses))
+		for code, n := range r.Statuses {
+			out.Statuses[strconv.Itoa(code)] = n
+		}
+	}
+	return json.Marshal(out)
+}
+
+// Bench sends opts.Requests requests for opts.Path to host:port, at most
+// opts.Concurrency at a time, over connections kept alive when the
+// service allows it, and sums up how they went. It returns an error only
+// for options it can't run with; failed requests are counted in the
+// result.
+func Bench(ctx context.Context, host string, port int, opts BenchOptions) (BenchResult, error) {
+	if opts.Requests <= 0 {
+		opts.Requests = DefaultBenchRequests
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = DefaultBenchConcurrency
+	}
+	opts.Concurrency = min(opts.Concurrency, opts.Requests)
+	if opts.Path == "" {
+		opts.Path = "/"
+	}
+	probeOpts := opts.Probe.withDefaults().forPort(port)
+	if err := ValidateHeaders(probeOpts.Headers); err != nil {
+		return BenchResult{}, err
+	}
+	if err := probeOpts.Credentials.Validate(); err != nil {
+		return BenchResult{}, err
+	}
+	if !opts.AllowRemote {
+		if err := CheckLoopback(ctx, host); err != nil {
+			return BenchResult{}, err
+		}
+	}
+
+	scheme := "http"
+	if opts.TLS {
+		scheme = "https"
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	result := BenchResult{URL: scheme + "://" + addr + opts.Path, Statuses: make(map[int]int)}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, result.URL, nil)
+	if err != nil {
+		return BenchResult{}, fmt.Errorf("invalid path %q: %w", opts.Path, err)
+	}
+	switch {
+	case probeOpts.Host != "":
+		req.Host = probeOpts.Host
+	case CheckLoopback(ctx, host) == nil:
+		req.Host = "localhost" // As the probe sends it
+	}
+	for _, field := range probeOpts.extraHeaders() {
+		req.Header.Set(field[0], field[1])
+	}
+
+	var dials atomic.Int64
+	dialer := probeOpts.dialer()
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, address)
+			if err == nil {
+				dials.Add(1)
+			}
+			return conn, err
+		},
+		TLSClientConfig:       benchTLSConfig(probeOpts.ClientCert),
+		MaxIdleConnsPerHost:   opts.Concurrency,
+		ResponseHeaderTimeout: probeOpts.ReadTimeout,
+		DisableCompression:    true,
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   probeOpts.DialTimeout + probeOpts.WriteTimeout + probeOpts.ReadTimeout,
+		// The redirect's own latency is what is measured
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	var mu sync.Mutex
+	var latencies []time.Duration
+	record := func(status int, latency time.Duration, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			result.Errors++
+			if result.Err == nil {
+				result.Err = err
+			}
+			return
+		}
+		result.Statuses[status]++
+		latencies = append(latencies, latency)
+		if status >= 500 {
+			result.Errors++
+		}
+	}
+
+	start := time.Now()
+	next := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range next {
+				sent := time.Now()
+				resp, err := client.Do(req.Clone(ctx))
+				if err == nil {
+					// Read to the end so the connection can be reused
+					_, err = io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}
+				status := 0
+				if resp != nil {
+					status = resp.StatusCode
+				}
+				record(status, time.Since(sent), err)
+			}
+		}()
+	}
+	for i := 0; i < opts.Requests && ctx.Err() == nil; i++ {
+		next <- struct{}{}
+		result.Requests++
+	}
+	close(next)
+	wg.Wait()
+	result.Duration = time.Since(start)
+	result.Connections = int(dials.Load())
+	result.KeepAlive = len(latencies) > 0 && result.Connections < len(latencies)
+	summarize(&result, latencies)
+	return result, nil
+}
+
+// summarize fills in the latency statistics of result
+func summarize(result *BenchResult, latencies []time.Duration) {
+	if len(latencies) == 0 {
+		return
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	var total time.Duration
+	for _, d := range latencies {
+		total += d
+	}
+	result.Min, result.Max = latencies[0], latencies[len(latencies)-1]
+	result.Mean = total / time.Duration(len(latencies))
+	result.P50 = percentile(latencies, 50)
+	result.P90 = percentile(latencies, 90)
+	result.P99 = percentile(latencies, 99)
+}
+
+// percentile returns the p-th percentile of sorted latencies, by the
+// nearest-rank method
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	return sorted[max(rank-1, 0)]
+}
+
+// benchTLSConfig accepts any server certificate, as the probe does, and
+// presents cert to servers that ask for one
+func benchTLSConfig(cert *tls.Certificate) *tls.Config {
+	config := &tls.Config{InsecureSkipVerify: true}
+	if cert != nil {
+		config.Certificates = []tls.Certificate{*cert}
+	}
+	return config
+}
+
+// CheckLoopback returns ErrNotLoopback unless every address host stands
+// for is a loopback one
+func CheckLoopback(ctx context.Context, host string) error {
+	if ip := net.ParseIP(host); ip != nil {
+		if !ip.IsLoopback() {
+			return fmt.Errorf("%w: %s", ErrNotLoopback, host)
+		}
+		return nil
+	}
+	if host == "localhost" {
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", host, err)
+	}
+	for _, addr := range addrs {
+		if !addr.IP.IsLoopback() {
+			return fmt.Errorf("%w: %s is %s", ErrNotLoopback, host, addr.IP)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package probe
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+)
+
+// maxDecodedBody caps what a body snippet may decode to, so a small
+// compressed body can't expand without bound
+const maxDecodedBody = 1 << 20
+
+// readBody reads the start of the response body following the headers. It
+// stops at Content-Length, the end of a chunked body, limit bytes (0 means
+// DefaultMaxBody) or the first read error (typically the read deadline),
+// and returns whatever it got, with truncated set unless that was all of
+// the body.
+func readBody(r *bufio.Reader, code int, headers http.Header, limit int) (data []byte, truncated bool) {
+	// These responses never carry a body
+	if code < 200 || code == 204 || code == 304 {
+		return nil, false
+	}
+
+	if limit <= 0 {
+		limit = DefaultMaxBody
+	}
+	if strings.EqualFold(headers.Get("Transfer-Encoding"), "chunked") {
+		return readUntilEnd(httputil.NewChunkedReader(r), limit)
+	}
+	n, err := strconv.ParseInt(headers.Get("Content-Length"), 10, 64)
+	if err != nil || n < 0 {
+		// The body ends when the server closes the connection
+		return readUntilEnd(r, limit)
+	}
+	// Never read past the body, the connection may carry another response
+	data, _ = io.ReadAll(io.LimitReader(r, min(n, int64(limit))))
+	return data, int64(len(data)) < n
+}
+
+// readUntilEnd reads up to limit bytes of a body whose length isn't known
+// in advance; one byte more tells whether there was more to it
+func readUntilEnd(r io.Reader, limit int) ([]byte, bool) {
+	data, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if len(data) > limit {
+		return data[:limit], true
+	}
+	return data, err != nil
+}
+
+// decodeBody undoes a gzip or deflate Content-Encoding on a body snippet,
+// up to maxDecodedBody bytes. A truncated snippet decodes to whatever comes
+// before the stream ends. truncated is set when the stream is cut short or
+// broken, or when its encoding is unknown and nothing is given back: br
+// among them, as the standard library has no Brotli decoder (the probe
+// never sends Accept-Encoding, so only a server ignoring that uses it).
+func decodeBody(body []byte, headers http.Header) (decoded []byte, truncated bool) {
+	var r io.Reader
+	switch strings.ToLower(strings.TrimSpace(headers.Get("Content-Encoding"))) {
+	case "", "identity":
+		return body, false
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, len(body) > 0
+		}
+		r = gz
+	case "deflate":
+		// Servers disagree on whether deflate means zlib or raw DEFLATE
+		if zr, err := zlib.NewReader(bytes.NewReader(body)); err == nil {
+			r = zr
+		} else {
+			r = flate.NewReader(bytes.NewReader(body))
+		}
+	default:
+		return nil, len(body) > 0
+	}
+
+	decoded, err := io.ReadAll(io.LimitReader(r, maxDecodedBody+1))
+	if len(decoded) > maxDecodedBody {
+		return decoded[:maxDecodedBody], true
+	}
+	return decoded, err != nil
+}
@@ -0,0 +1,201 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Defaults used when the corresponding CacheOptions field is zero
+const (
+	DefaultCacheTTL         = 30 * time.Second
+	DefaultCacheNegativeTTL = 5 * time.Second
+	DefaultCacheMaxEntries  = 1024
+)
+
+// CacheOptions configures a Cache
+type CacheOptions struct {
+	TTL         time.Duration // Lifetime of results for ports that answered
+	NegativeTTL time.Duration // Lifetime of results for closed ports
+	MaxEntries  int           // Entries kept before the oldest are evicted
+	Probe       ProbeOptions  // Options for the probes the cache runs
+}
+
+// Cache memoizes probe results per host, port and path. It is safe for
+// concurrent use, and concurrent lookups of the same uncached key share a
+// single network probe. With ProbeOptions.Adaptive it also remembers how
+// fast each port answered, past the results' expiry, to time the next
+// probe by.
+type Cache struct {
+	opts      CacheOptions
+	latencies latencies
+
+	mu       sync.Mutex
+	entries  map[cacheKey]cacheEntry
+	inflight map[cacheKey]*cacheCall
+	// generations counts the Invalidate calls per host:port, so a probe
+	// started before one doesn't store or share what it found
+	generations map[string]uint64
+}
+
+type cacheKey struct {
+	addr string // host:port
+	path string
+}
+
+type cacheEntry struct {
+	result  ProbeResult
+	expires time.Time
+}
+
+// cacheCall is a probe in progress that other callers can wait on
+type cacheCall struct {
+	done       chan struct{}
+	result     ProbeResult
+	generation uint64 // Of the port when the probe started
+}
+
+// NewCache creates an empty probe cache
+func NewCache(opts CacheOptions) *Cache {
+	if opts.TTL <= 0 {
+		opts.TTL = DefaultCacheTTL
+	}
+	if opts.NegativeTTL <= 0 {
+		opts.NegativeTTL = DefaultCacheNegativeTTL
+	}
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = DefaultCacheMaxEntries
+	}
+	return &Cache{
+		opts:        opts,
+		entries:     make(map[cacheKey]cacheEntry),
+		inflight:    make(map[cacheKey]*cacheCall),
+		generations: make(map[string]uint64),
+	}
+}
+
+// Probe returns the cached result for host:port, probing it if needed
+func (c *Cache) Probe(ctx context.Context, host string, port int) ProbeResult {
+	return c.ProbePath(ctx, host, port, "")
+}
+
+// ProbePath is like Probe but for a specific request path ("" means the
+// path in the cache's probe options)
+func (c *Cache) ProbePath(ctx context.Context, host string, port int, path string) ProbeResult {
+	key := cacheKey{addr: net.JoinHostPort(host, strconv.Itoa(port)), path: path}
+
+	c.mu.Lock()
+	for {
+		if entry, ok := c.entries[key]; ok && time.Now().Before(entry.expires) {
+			c.mu.Unlock()
+			return entry.result
+		}
+		// A probe started before the port was invalidated may have seen
+		// what is no longer there
+		call, ok := c.inflight[key]
+		if !ok || call.generation != c.generations[key.addr] {
+			break
+		}
+		c.mu.Unlock()
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return ProbeResult{Port: port, Err: ctx.Err()}
+		}
+		// Only share a result that wasn't cut short by the other caller's
+		// context; otherwise look again and probe ourselves if needed
+		if !isContextError(call.result.Err) {
+			return call.result
+		}
+		c.mu.Lock()
+	}
+	call := &cacheCall{done: make(chan struct{}), generation: c.generations[key.addr]}
+	c.inflight[key] = call
+	c.mu.Unlock()
+
+	opts := c.opts.Probe.withDefaults()
+	if path != "" {
+		opts.Path, opts.Paths = path, nil
+	}
+	if opts.Adaptive {
+		opts.ReadTimeout = c.latencies.readTimeout(key.addr, opts)
+	}
+	call.result = probeWithOptions(ctx, host, port, opts)
+	if opts.Adaptive && !isContextError(call.result.Err) {
+		c.latencies.record(key.addr, call.result, opts.ReadTimeout)
+	}
+
+	c.mu.Lock()
+	if c.inflight[key] == call {
+		delete(c.inflight, key)
+	}
+	// A probe cut short by its caller's context says nothing about the
+	// port, nor does one overtaken by Invalidate about what it holds now
+	if !isContextError(call.result.Err) && call.generation == c.generations[key.addr] {
+		c.store(key, call.result)
+	}
+	c.mu.Unlock()
+	close(call.done)
+
+	return call.result
+}
+
+// isContextError reports whether err came from a cancelled or expired context
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// Invalidate drops every cached result for host:port, whatever the path.
+// Probes of it in progress still answer their callers, but later callers
+// don't wait on them and their results aren't cached.
+func (c *Cache) Invalidate(host string, port int) {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generations[addr]++
+	for key := range c.entries {
+		if key.addr == addr {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// Len returns the number of cached results, including expired ones not
+// evicted yet
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// store caches result under key, evicting expired entries and then the
+// ones closest to expiry when the cache is full. Must hold c.mu.
+func (c *Cache) store(key cacheKey, result ProbeResult) {
+	ttl := c.opts.TTL
+	if result.Status() == StatusClosed {
+		ttl = c.opts.NegativeTTL
+	}
+
+	now := time.Now()
+	if _, exists := c.entries[key]; !exists && len(c.entries) >= c.opts.MaxEntries {
+		for k, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		for len(c.entries) >= c.opts.MaxEntries {
+			var oldest cacheKey
+			var oldestExpiry time.Time
+			for k, entry := range c.entries {
+				if oldestExpiry.IsZero() || entry.expires.Before(oldestExpiry) {
+					oldest, oldestExpiry = k, entry.expires
+				}
+			}
+			delete(c.entries, oldest)
+		}
+	}
+	c.entries[key] = cacheEntry{result: result, expires: now.Add(ttl)}
+}
@@ -0,0 +1,88 @@
+package probe
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheServesCachedResult(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	port := serverPort(t, srv)
+
+	c := NewCache(CacheOptions{})
+	for i := 0; i < 3; i++ {
+		if result := c.Probe(context.Background(), "127.0.0.1", port); !result.IsHTTP {
+			t.Fatalf("probe %d: %+v, want HTTP", i+1, result)
+		}
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("3 probes reached the server %d times, want once", n)
+	}
+	c.Invalidate("127.0.0.1", port)
+	if c.Len() != 0 {
+		t.Errorf("Len after Invalidate = %d, want 0", c.Len())
+	}
+	c.Probe(context.Background(), "127.0.0.1", port)
+	if n := hits.Load(); n != 2 {
+		t.Errorf("probe after Invalidate reached the server %d times in all, want twice", n)
+	}
+}
+
+func TestCacheInvalidateDuringProbe(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	started, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code := int(status.Load())
+		if code == http.StatusOK {
+			once.Do(func() { close(started) })
+			<-release
+		}
+		w.WriteHeader(code)
+	}))
+	defer srv.Close()
+	// Before the server closes, which waits on its handlers
+	unblock := sync.OnceFunc(func() { close(release) })
+	defer unblock()
+	port := serverPort(t, srv)
+
+	c := NewCache(CacheOptions{Probe: ProbeOptions{ReadTimeout: 5 * time.Second}})
+	first := make(chan ProbeResult, 1)
+	go func() { first <- c.Probe(context.Background(), "127.0.0.1", port) }()
+	<-started
+
+	// The service changes while the first probe waits on its answer
+	status.Store(http.StatusTeapot)
+	c.Invalidate("127.0.0.1", port)
+
+	// A probe after Invalidate doesn't wait on the stale one
+	second := make(chan ProbeResult, 1)
+	go func() { second <- c.Probe(context.Background(), "127.0.0.1", port) }()
+	select {
+	case result := <-second:
+		if result.StatusCode != http.StatusTeapot {
+			t.Errorf("probe after Invalidate: status %d, want %d", result.StatusCode, http.StatusTeapot)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("probe after Invalidate waited on the one in progress")
+	}
+
+	unblock()
+	if result := <-first; result.StatusCode != http.StatusOK {
+		t.Errorf("probe in progress: status %d, want its own answer %d", result.StatusCode, http.StatusOK)
+	}
+	if result := c.Probe(context.Background(), "127.0.0.1", port); result.StatusCode != http.StatusTeapot {
+		t.Errorf("cached status %d after the stale probe finished, want %d", result.StatusCode, http.StatusTeapot)
+	}
+}
@@ -0,0 +1,241 @@
+package probe
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// CertInfo summarizes the leaf certificate presented during a TLS probe
+type CertInfo struct {
+	Subject     string    `json:"subject"`                // Subject common name
+	DNSNames    []string  `json:"dns_names,omitempty"`    // Subject alternative DNS names
+	IPAddresses []string  `json:"ip_addresses,omitempty"` // Subject alternative IP addresses
+	Issuer      string    `json:"issuer"`                 // Issuer common name (or full DN when CN is empty)
+	NotBefore   time.Time `json:"not_before"`             // Start of validity
+	NotAfter    time.Time `json:"not_after"`              // End of validity
+	SelfSigned  bool      `json:"self_signed"`            // Whether the certificate is signed by its own key
+	Fingerprint string    `json:"fingerprint"`            // Hex SHA-256 of the DER certificate
+
+	// Trusted is set when the chain the server sent leads to a root of the
+	// system or of ProbeOptions.Roots, leaving aside validity dates and
+	// names; Issues reports those
+	Trusted bool `json:"trusted"`
+	// KeyType and KeyBits describe the public key, e.g. "RSA" and 2048,
+	// and SignatureAlgorithm how the issuer signed it, e.g. "SHA256-RSA"
+	KeyType            string `json:"key_type,omitempty"`
+	KeyBits            int    `json:"key_bits,omitempty"`
+	SignatureAlgorithm string `json:"signature_algorithm,omitempty"`
+
+	// ServerName is the SNI value sent during the handshake. When the
+	// server refused to present a certificate without SNI and the probe had
+	// to retry with a name, ServerNameRequired is set.
+	ServerName         string `json:"server_name,omitempty"`
+	ServerNameRequired bool   `json:"server_name_required,omitempty"`
+
+	// ClientCertRequested is set when the server asked for a client
+	// certificate, with the distinguished names of the CAs it said it
+	// accepts them from, if any
+	ClientCertRequested bool     `json:"client_cert_requested,omitempty"`
+	AcceptableCAs       []string `json:"acceptable_cas,omitempty"`
+}
+
+// ExpiresIn returns the time left until the certificate expires (negative if expired)
+func (c *CertInfo) ExpiresIn() time.Duration {
+	return time.Until(c.NotAfter)
+}
+
+// Weakest keys a browser accepts
+const (
+	minRSABits   = 2048
+	minECDSABits = 256
+)
+
+// Issues are what a browser would object to in the certificate when
+// reaching the service as name at now, e.g. "cert expired 12 days ago" or
+// "cert not valid for myapp.localhost". An empty name skips the name check.
+func (c *CertInfo) Issues(name string, now time.Time) []string {
+	var issues []string
+	switch {
+	case now.After(c.NotAfter):
+		issues = append(issues, "cert expired "+about(now.Sub(c.NotAfter))+" ago")
+	case now.Before(c.NotBefore):
+		issues = append(issues, "cert not valid for another "+about(c.NotBefore.Sub(now)))
+	}
+	if name != "" && !c.Covers(name) {
+		issues = append(issues, "cert not valid for "+name)
+	}
+	switch {
+	case c.Trusted:
+	case c.SelfSigned:
+		issues = append(issues, "cert self-signed")
+	default:
+		issues = append(issues, "cert issued by unknown CA "+c.Issuer)
+	}
+	switch {
+	case !weakKey(c.KeyType, c.KeyBits):
+	case c.KeyBits == 0:
+		issues = append(issues, "weak "+c.KeyType+" key")
+	default:
+		issues = append(issues, fmt.Sprintf("weak %s key (%d bits)", c.KeyType, c.KeyBits))
+	}
+	if weakSignature(c.SignatureAlgorithm) {
+		issues = append(issues, "weak signature ("+c.SignatureAlgorithm+")")
+	}
+	return issues
+}
+
+// Covers reports whether the certificate is valid for host, a name or an
+// IP address, by its subject alternative names as browsers match them: a
+// wildcard stands for exactly one leftmost label
+func (c *CertInfo) Covers(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if ip := net.ParseIP(host); ip != nil {
+		for _, s := range c.IPAddresses {
+			if ip.Equal(net.ParseIP(s)) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, pattern := range c.DNSNames {
+		pattern = strings.TrimSuffix(strings.ToLower(pattern), ".")
+		if pattern == host {
+			return true
+		}
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			if label, rest, found := strings.Cut(host, "."); found && label != "" && rest == suffix {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// weakKey reports whether a key of the type and size is too weak for
+// browsers: RSA below 2048 bits, ECDSA below 256, and DSA at all
+func weakKey(keyType string, bits int) bool {
+	switch keyType {
+	case "RSA":
+		return bits < minRSABits
+	case "ECDSA":
+		return bits < minECDSABits
+	case "DSA":
+		return true
+	}
+	return false
+}
+
+// weakSignature reports whether a signature algorithm relies on a broken
+// hash, MD2, MD5 or SHA-1
+func weakSignature(algorithm string) bool {
+	for _, hash := range []string{"MD2", "MD5", "SHA1"} {
+		if strings.Contains(algorithm, hash) {
+			return true
+		}
+	}
+	return false
+}
+
+// about rounds d for people, e.g. "12 days", "3 hours" or "5 minutes"
+func about(d time.Duration) string {
+	n, unit := int(d.Minutes()), "minute"
+	switch {
+	case d >= 48*time.Hour:
+		n, unit = int(d.Hours()/24), "day"
+	case d >= 2*time.Hour:
+		n, unit = int(d.Hours()), "hour"
+	case d < time.Minute:
+		return "less than a minute"
+	}
+	if n == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
+
+// newCertInfo extracts the interesting parts of the leaf certificate of
+// chain, as the server sent it, checking the chain against the system's
+// roots and roots
+func newCertInfo(chain []*x509.Certificate, roots *x509.CertPool) *CertInfo {
+	cert := chain[0]
+	info := &CertInfo{
+		Subject:            cert.Subject.CommonName,
+		DNSNames:           cert.DNSNames,
+		Issuer:             cert.Issuer.CommonName,
+		NotBefore:          cert.NotBefore,
+		NotAfter:           cert.NotAfter,
+		SignatureAlgorithm: cert.SignatureAlgorithm.String(),
+	}
+	info.KeyType, info.KeyBits = keyInfo(cert)
+	info.Trusted = trusted(chain, roots)
+	if info.Issuer == "" {
+		info.Issuer = cert.Issuer.String()
+	}
+	for _, ip := range cert.IPAddresses {
+		info.IPAddresses = append(info.IPAddresses, ip.String())
+	}
+
+	// Self-signed: issuer and subject match and the cert verifies against
+	// its own public key, so no chain could be built to another CA
+	if bytes.Equal(cert.RawIssuer, cert.RawSubject) {
+		info.SelfSigned = cert.CheckSignatureFrom(cert) == nil
+	}
+
+	sum := sha256.Sum256(cert.Raw)
+	info.Fingerprint = hex.EncodeToString(sum[:])
+	return info
+}
+
+// keyInfo names the type of a certificate's public key and its size in
+// bits, left zero for DSA
+func keyInfo(cert *x509.Certificate) (string, int) {
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return "RSA", key.N.BitLen()
+	case *ecdsa.PublicKey:
+		return "ECDSA", key.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		return "Ed25519", 256
+	}
+	if cert.PublicKeyAlgorithm == x509.DSA {
+		return "DSA", 0
+	}
+	return "", 0
+}
+
+// trusted reports whether chain leads to a root of the system or of roots.
+// It is checked as of a time the leaf is valid at, so that an expired
+// certificate still tells who issued it.
+func trusted(chain []*x509.Certificate, roots *x509.CertPool) bool {
+	leaf := chain[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	at := time.Now()
+	if at.After(leaf.NotAfter) {
+		at = leaf.NotAfter
+	}
+	if at.Before(leaf.NotBefore) {
+		at = leaf.NotBefore
+	}
+	opts := x509.VerifyOptions{Intermediates: intermediates, CurrentTime: at, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}
+	if _, err := leaf.Verify(opts); err == nil {
+		return true
+	}
+	if roots == nil {
+		return false
+	}
+	opts.Roots = roots
+	_, err := leaf.Verify(opts)
+	return err == nil
+}
@@ -0,0 +1,94 @@
+package probe
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// ContentClass is a coarse label for what a service serves at its root
+type ContentClass string
+
+const (
+	ContentUnknown ContentClass = "unknown"
+	ContentHTMLApp ContentClass = "html-app" // HTML page that boots a script bundle
+	ContentJSONAPI ContentClass = "json-api" // JSON responses
+	ContentStatic  ContentClass = "static"   // Plain files
+	// ContentStaticListing is a file server's directory listing, with what
+	// it shows in ProbeResult.DirListing
+	ContentStaticListing ContentClass = "static-listing"
+)
+
+// directoryListingMarkers identify autoindex pages: nginx and Apache
+// ("Index of /"), Python's http.server, and Go's http.FileServer (a bare
+// <pre> list of links)
+var directoryListingMarkers = [][]byte{
+	[]byte("<title>index of /"),
+	[]byte("<h1>index of /"),
+	[]byte("<title>directory listing for /"),
+	[]byte("<pre>\n<a href=\""),
+}
+
+// appMarkers are signs that an HTML page is a JavaScript application shell
+var appMarkers = [][]byte{
+	[]byte("<script"),
+	[]byte(`id="root"`),
+	[]byte(`id="app"`),
+	[]byte(`id="__next"`),
+	[]byte(`id="__nuxt"`),
+}
+
+// classifyContent labels a response from its Content-Type and the decoded
+// start of its body
+func classifyContent(headers http.Header, body []byte) ContentClass {
+	mediaType, _, _ := mime.ParseMediaType(headers.Get("Content-Type"))
+	trimmed := bytes.TrimSpace(body)
+	lower := bytes.ToLower(body)
+
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		return ContentJSONAPI
+	case mediaType == "text/event-stream":
+		return ContentUnknown // Not read, see isEventStream
+	case isDirectoryListing(lower):
+		return ContentStaticListing
+	case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+		for _, marker := range appMarkers {
+			if bytes.Contains(lower, marker) {
+				return ContentHTMLApp
+			}
+		}
+		return ContentStatic
+	case mediaType == "" || mediaType == "text/plain":
+		// Untyped or mislabelled JSON is common from quick dev servers
+		if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+			return ContentJSONAPI
+		}
+		if mediaType == "" {
+			return ContentUnknown
+		}
+		return ContentStatic
+	case strings.HasPrefix(mediaType, "text/"), strings.HasPrefix(mediaType, "image/"),
+		mediaType == "application/javascript", mediaType == "application/octet-stream":
+		return ContentStatic
+	}
+	return ContentUnknown
+}
+
+// isEventStream reports whether a response is a Server-Sent Events stream
+func isEventStream(headers http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(headers.Get("Content-Type"))
+	return err == nil && mediaType == "text/event-stream"
+}
+
+// isDirectoryListing reports whether a lowercased body looks like an
+// autoindex page
+func isDirectoryListing(lower []byte) bool {
+	for _, marker := range directoryListingMarkers {
+		if bytes.Contains(lower, marker) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package probe
+
+import (
+	"context"
+	"strings"
+)
+
+// DefaultCORSOrigin is the Origin sent by the CORS check when
+// ProbeOptions.CORSOrigin is empty: a typical local frontend
+const DefaultCORSOrigin = "http://localhost:3000"
+
+// CORSPolicy summarises how a service answered a preflight
+type CORSPolicy string
+
+const (
+	CORSNone     CORSPolicy = "none"     // No Access-Control-Allow-Origin at all
+	CORSWildcard CORSPolicy = "wildcard" // Access-Control-Allow-Origin: *
+	CORSEcho     CORSPolicy = "echo"     // Our Origin was reflected back
+	CORSOther    CORSPolicy = "other"    // Some other fixed origin is allowed
+)
+
+// CORSInfo is the service's answer to a CORS preflight request
+type CORSInfo struct {
+	Origin           string     `json:"origin"` // Origin the preflight was sent with
+	Policy           CORSPolicy `json:"policy"`
+	AllowOrigin      string     `json:"allow_origin,omitempty"`
+	AllowMethods     []string   `json:"allow_methods,omitempty"`
+	AllowHeaders     []string   `json:"allow_headers,omitempty"`
+	AllowCredentials bool       `json:"allow_credentials,omitempty"`
+	StatusCode       int        `json:"status_code"` // Status of the preflight response
+}
+
+// probeCORS sends an OPTIONS preflight for opts.Path from opts.CORSOrigin
+// asking to use GET, and records the Access-Control-* response headers
+func probeCORS(ctx context.Context, result ProbeResult, host, addr string, opts ProbeOptions) ProbeResult {
+	if ctx.Err() != nil {
+		return result
+	}
+
+	origin := opts.CORSOrigin
+	if origin == "" {
+		origin = DefaultCORSOrigin
+	}
+	req := opts.request(opts.Path).method("OPTIONS").
+		with("Origin", origin).
+		with("Access-Control-Request-Method", "GET")
+
+	resp := fetch(ctx, addr, host, result.IsTLS, req, opts)
+	if !resp.IsHTTP {
+		return result
+	}
+
+	allowOrigin := strings.TrimSpace(resp.Headers.Get("Access-Control-Allow-Origin"))
+	info := &CORSInfo{
+		Origin:           origin,
+		AllowOrigin:      allowOrigin,
+		AllowMethods:     splitHeaderList(resp.Headers.Values("Access-Control-Allow-Methods"), true),
+		AllowHeaders:     splitHeaderList(resp.Headers.Values("Access-Control-Allow-Headers"), false),
+		AllowCredentials: strings.EqualFold(strings.TrimSpace(resp.Headers.Get("Access-Control-Allow-Credentials")), "true"),
+		StatusCode:       resp.StatusCode,
+	}
+	switch {
+	case allowOrigin == "":
+		info.Policy = CORSNone
+	case allowOrigin == "*":
+		info.Policy = CORSWildcard
+	case strings.EqualFold(allowOrigin, origin):
+		info.Policy = CORSEcho
+	default:
+		info.Policy = CORSOther
+	}
+	result.CORS = info
+	return result
+}
+
+// splitHeaderList splits comma-separated header values, optionally
+// upper-casing them (method names are case-sensitive but conventionally
+// upper-case)
+func splitHeaderList(values []string, upper bool) []string {
+	var items []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			if upper {
+				item = strings.ToUpper(item)
+			}
+			items = append(items, item)
+		}
+	}
+	return items
+}
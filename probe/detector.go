@@ -0,0 +1,136 @@
+package probe
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// Detection is what a Detector recognised: the service kind, which may be
+// one of the ServiceKind constants or any name of the detector's own, and
+// a banner or version string if the protocol offered one
+type Detection struct {
+	Kind   ServiceKind
+	Banner string
+}
+
+// Detector recognises one protocol on an established connection.
+//
+// A detector whose protocol speaks first (SpeaksFirst true) is called with
+// the greeting the server sent on connect in firstBytes, and conn is the
+// connection it arrived on. The greeting is read once and offered to each
+// such detector in turn over the same connection, so a detector should
+// decide from firstBytes and only read or write more once the greeting is
+// clearly its own.
+//
+// Any other detector is called with firstBytes nil on a fresh connection
+// of its own, to write its handshake and read the reply.
+//
+// Either way conn carries the probe's deadline and is closed by the
+// caller. Detect returns nil, nil when the protocol isn't the detector's;
+// an error is treated the same way and the next detector is tried.
+type Detector interface {
+	Name() string
+	SpeaksFirst() bool
+	Detect(ctx context.Context, conn net.Conn, firstBytes []byte) (*Detection, error)
+}
+
+var (
+	detectorsMu sync.RWMutex
+	registered  []Detector
+)
+
+// RegisterDetector adds a detector for a protocol the probe doesn't know,
+// such as an in-house service's handshake. It is safe to call at any time
+// but usually done from an init function.
+//
+// Detection runs in this order and stops at the first match:
+//
+//  1. When the server greets on connect, the registered speaks-first
+//     detectors in registration order, then the built-in ones (SSH, FTP,
+//     SMTP, MySQL). A greeting none of them claims is kept as a banner.
+//  2. When it doesn't, the HTTP request is sent and, depending on the
+//     answer, TLS, HTTP/2 and gRPC are tried. A service that answers any
+//     of them is identified as such.
+//  3. If none did, the registered detectors that don't speak first are
+//     run in registration order, one connection each.
+//
+// The built-in detectors that write first (Redis, Postgres, MongoDB,
+// memcached) cost a connection each and only run in ProbeService, after
+// the registered ones.
+func RegisterDetector(d Detector) {
+	detectorsMu.Lock()
+	defer detectorsMu.Unlock()
+	registered = append(registered, d)
+}
+
+// registeredDetectors returns the registered detectors that do or don't
+// speak first
+func registeredDetectors(speaksFirst bool) []Detector {
+	detectorsMu.RLock()
+	defer detectorsMu.RUnlock()
+	var ds []Detector
+	for _, d := range registered {
+		if d.SpeaksFirst() == speaksFirst {
+			ds = append(ds, d)
+		}
+	}
+	return ds
+}
+
+// detectGreeting offers a greeting to the speaks-first detectors:
+// registered ones first, then the built-in fingerprints
+func detectGreeting(ctx context.Context, conn net.Conn, greeting []byte) *Detection {
+	ds := registeredDetectors(true)
+	for _, fp := range fingerprints {
+		if fp.Greeting {
+			ds = append(ds, fp)
+		}
+	}
+	for _, d := range ds {
+		if ctx.Err() != nil {
+			break
+		}
+		if det, err := d.Detect(ctx, conn, greeting); err == nil && det != nil {
+			return det
+		}
+	}
+	return nil
+}
+
+// detectWriteFirst runs detectors that write first against addr, each
+// over a connection of its own, until one matches
+func detectWriteFirst(ctx context.Context, addr string, ds []Detector, opts ProbeOptions) *Detection {
+	for _, d := range ds {
+		if ctx.Err() != nil {
+			break
+		}
+		if det := runDetector(ctx, addr, d, opts); det != nil {
+			return det
+		}
+	}
+	return nil
+}
+
+// runDetector dials addr and hands the connection to d, with the write
+// and read timeouts as its deadline
+func runDetector(ctx context.Context, addr string, d Detector, opts ProbeOptions) *Detection {
+	conn, err := opts.dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+	conn.SetDeadline(phaseDeadline(ctx, opts.WriteTimeout+opts.ReadTimeout))
+
+	det, err := d.Detect(ctx, conn, nil)
+	if err != nil {
+		return nil
+	}
+	return det
+}
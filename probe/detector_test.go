@@ -0,0 +1,159 @@
+package probe
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// register adds d for the length of the test
+func register(t *testing.T, d Detector) {
+	t.Helper()
+	detectorsMu.Lock()
+	saved := registered
+	detectorsMu.Unlock()
+	t.Cleanup(func() {
+		detectorsMu.Lock()
+		registered = saved
+		detectorsMu.Unlock()
+	})
+	RegisterDetector(d)
+}
+
+// greetingDetector claims servers whose greeting starts with prefix
+type greetingDetector struct {
+	prefix string
+	kind   ServiceKind
+	calls  atomic.Int32
+}
+
+func (d *greetingDetector) Name() string      { return string(d.kind) }
+func (d *greetingDetector) SpeaksFirst() bool { return true }
+
+func (d *greetingDetector) Detect(ctx context.Context, conn net.Conn, firstBytes []byte) (*Detection, error) {
+	d.calls.Add(1)
+	if !bytes.HasPrefix(firstBytes, []byte(d.prefix)) {
+		return nil, nil
+	}
+	return &Detection{Kind: d.kind, Banner: strings.TrimSpace(string(firstBytes))}, nil
+}
+
+// pingDetector writes "PING" and claims servers that answer "PONG"
+type pingDetector struct {
+	calls atomic.Int32
+	fresh atomic.Bool // Every call had a connection of its own
+}
+
+func (d *pingDetector) Name() string      { return "acme" }
+func (d *pingDetector) SpeaksFirst() bool { return false }
+
+func (d *pingDetector) Detect(ctx context.Context, conn net.Conn, firstBytes []byte) (*Detection, error) {
+	d.calls.Add(1)
+	d.fresh.Store(firstBytes == nil)
+	if _, err := conn.Write([]byte("PING\n")); err != nil {
+		return nil, err
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	version, ok := strings.CutPrefix(strings.TrimSpace(line), "PONG ")
+	if !ok {
+		return nil, nil
+	}
+	return &Detection{Kind: "acme", Banner: version}, nil
+}
+
+// pingServer answers "PING" with "PONG acme/3" and hangs up on anything
+// else, like an in-house RPC service
+func pingServer(t *testing.T) int {
+	return listen(t, tcpListener(t), func(conn net.Conn) {
+		defer conn.Close()
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err == nil && line == "PING\n" {
+			conn.Write([]byte("PONG acme/3\n"))
+		}
+	})
+}
+
+// greeter sends greeting on connect and then waits for the client to go
+func greeter(t *testing.T, greeting string) int {
+	return listen(t, tcpListener(t), func(conn net.Conn) {
+		defer conn.Close()
+		conn.Write([]byte(greeting))
+		conn.Read(make([]byte, 512))
+	})
+}
+
+func TestRegisteredGreetingDetector(t *testing.T) {
+	other := &greetingDetector{prefix: "BEEP", kind: "beep"}
+	acme := &greetingDetector{prefix: "ACME-RPC", kind: "acme-rpc"}
+	register(t, other)
+	register(t, acme)
+
+	result := ProbeContext(context.Background(), "127.0.0.1", greeter(t, "ACME-RPC 2.1 ready\r\n"))
+	if result.Kind != "acme-rpc" || result.Banner != "ACME-RPC 2.1 ready" {
+		t.Errorf("Kind %q, Banner %q; want the registered detector's", result.Kind, result.Banner)
+	}
+	if result.IsHTTP || result.State != StateOpenNonHTTP {
+		t.Errorf("State %q, want %q", result.State, StateOpenNonHTTP)
+	}
+	if other.calls.Load() != 1 || acme.calls.Load() != 1 {
+		t.Errorf("detectors called %d and %d times, want once each in registration order", other.calls.Load(), acme.calls.Load())
+	}
+}
+
+func TestRegisteredDetectorRunsBeforeBuiltIn(t *testing.T) {
+	register(t, &greetingDetector{prefix: "SSH-2.0-acme", kind: "acme-tunnel"})
+
+	port := greeter(t, "SSH-2.0-acme_1.4\r\n")
+	if result := Probe("127.0.0.1", port); result.Kind != "acme-tunnel" {
+		t.Errorf("Kind %q, want the registered detector's over SSH", result.Kind)
+	}
+	port = greeter(t, "SSH-2.0-OpenSSH_9.6\r\n")
+	if result := Probe("127.0.0.1", port); result.Kind != ServiceSSH {
+		t.Errorf("Kind %q for a greeting no registered detector claims, want %q", result.Kind, ServiceSSH)
+	}
+}
+
+func TestRegisteredWriteFirstDetector(t *testing.T) {
+	d := &pingDetector{}
+	register(t, d)
+
+	result := Probe("127.0.0.1", pingServer(t))
+	if result.Kind != "acme" || result.Banner != "acme/3" {
+		t.Errorf("Kind %q, Banner %q; want the registered detector's", result.Kind, result.Banner)
+	}
+	if result.IsHTTP {
+		t.Error("identified as HTTP")
+	}
+	if d.calls.Load() != 1 || !d.fresh.Load() {
+		t.Errorf("detector called %d times, fresh connection %v; want once on a connection of its own", d.calls.Load(), d.fresh.Load())
+	}
+
+	// Through ProbeService too, ahead of the built-in write-first ones
+	if result := ProbeService("127.0.0.1", pingServer(t)); result.Kind != "acme" {
+		t.Errorf("ProbeService Kind %q, want acme", result.Kind)
+	}
+}
+
+func TestRegisteredDetectorSkippedForHTTP(t *testing.T) {
+	d := &pingDetector{}
+	register(t, d)
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	result := Probe("127.0.0.1", serverPort(t, srv))
+	if !result.IsHTTP || result.Kind == "acme" {
+		t.Errorf("got %+v, want the HTTP answer", result)
+	}
+	if n := d.calls.Load(); n != 0 {
+		t.Errorf("write-first detector called %d times on an HTTP server", n)
+	}
+}
@@ -0,0 +1,49 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+// Dialer opens the connections of a probe. *net.Dialer implements it; a
+// fake one lets tests script a server's behaviour, see package probetest.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// timeoutDialer bounds a caller-supplied Dialer by the dial timeout, the
+// way net.Dialer's Timeout bounds the default one
+type timeoutDialer struct {
+	dialer  Dialer
+	timeout time.Duration
+}
+
+// DialContext dials with ctx cut short by the timeout. Running out of time
+// is reported as a network timeout rather than as ctx's own error, which
+// would make the probe look cancelled.
+func (d timeoutDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialCtx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	conn, err := d.dialer.DialContext(dialCtx, network, address)
+	if err != nil && ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+		err = &net.OpError{Op: "dial", Net: network, Err: os.ErrDeadlineExceeded}
+	}
+	return conn, err
+}
+
+// DialerWithTimeout returns d with each dial bounded by timeout, or a
+// net.Dialer with that timeout if d is nil
+func DialerWithTimeout(d Dialer, timeout time.Duration) Dialer {
+	if d != nil {
+		return timeoutDialer{dialer: d, timeout: timeout}
+	}
+	return &net.Dialer{Timeout: timeout}
+}
+
+// dialer returns the Dialer a probe connects with
+func (o ProbeOptions) dialer() Dialer {
+	return DialerWithTimeout(o.Dialer, o.DialTimeout)
+}
@@ -0,0 +1,164 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"localhost-magic/probe/probetest"
+)
+
+const okResponse = "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"
+
+func TestProbeScripted(t *testing.T) {
+	fast := ProbeOptions{DialTimeout: 100 * time.Millisecond, ReadTimeout: 100 * time.Millisecond, BannerTimeout: 50 * time.Millisecond}
+	tests := []struct {
+		name    string
+		setup   func(d *probetest.Dialer)
+		banner  time.Duration // Replaces the short BannerTimeout if set
+		state   State
+		kind    ServiceKind
+		address string
+		err     error // Matched with errors.Is; nil wants no error
+	}{
+		{
+			name: "HTTP",
+			setup: func(d *probetest.Dialer) {
+				d.Handle("127.0.0.1:3000", probetest.Script{probetest.Expect(), probetest.Send(okResponse), probetest.Close()})
+			},
+			state: StateHTTP, kind: ServiceHTTP, address: "127.0.0.1",
+		},
+		{
+			name: "IPv6 only",
+			setup: func(d *probetest.Dialer) {
+				d.Handle("[::1]:3000", probetest.Script{probetest.Expect(), probetest.Send(okResponse), probetest.Close()})
+			},
+			state: StateHTTP, kind: ServiceHTTP, address: "::1",
+		},
+		{
+			name:  "refused",
+			setup: func(d *probetest.Dialer) {},
+			state: StateClosed, err: ErrRefused,
+		},
+		{
+			name: "host unreachable",
+			setup: func(d *probetest.Dialer) {
+				d.Fail("127.0.0.1:3000", syscall.EHOSTUNREACH)
+				d.Fail("[::1]:3000", syscall.EHOSTUNREACH)
+			},
+			state: StateFiltered, err: syscall.EHOSTUNREACH,
+		},
+		{
+			name: "packets dropped",
+			setup: func(d *probetest.Dialer) {
+				d.Fail("127.0.0.1:3000", nil)
+				d.Fail("[::1]:3000", nil)
+			},
+			state: StateFiltered, err: ErrTimeout,
+		},
+		{
+			name: "reset mid-handshake",
+			setup: func(d *probetest.Dialer) {
+				// Every attempt is reset once it sent its first bytes,
+				// whether an HTTP request or a TLS ClientHello
+				d.Handle("127.0.0.1:3000", probetest.Script{probetest.Expect(), probetest.Reset()})
+			},
+			state: StateOpenNonHTTP, address: "127.0.0.1", err: syscall.ECONNRESET,
+		},
+		{
+			name: "reset before the request",
+			setup: func(d *probetest.Dialer) {
+				d.Handle("127.0.0.1:3000", probetest.Script{probetest.Reset()})
+			},
+			state: StateOpenNonHTTP, address: "127.0.0.1", err: ErrReset,
+		},
+		{
+			name: "silent",
+			setup: func(d *probetest.Dialer) {
+				d.Handle("127.0.0.1:3000", probetest.Script{})
+			},
+			state: StateOpenSilent, address: "127.0.0.1", err: ErrTimeout,
+		},
+		{
+			name: "greeting",
+			setup: func(d *probetest.Dialer) {
+				d.Handle("127.0.0.1:3000", probetest.Script{probetest.Send("SSH-2.0-OpenSSH_9.6\r\n")})
+			},
+			state: StateOpenNonHTTP, kind: ServiceSSH, address: "127.0.0.1",
+		},
+		{
+			name: "late greeting",
+			setup: func(d *probetest.Dialer) {
+				// Arrives after the HTTP request was sent, as the answer
+				d.Handle("127.0.0.1:3000", probetest.Script{probetest.Sleep(80 * time.Millisecond), probetest.Send("SSH-2.0-OpenSSH_9.6\r\n")})
+			},
+			state: StateOpenNonHTTP, address: "127.0.0.1",
+		},
+		{
+			name: "late greeting within a longer banner timeout",
+			setup: func(d *probetest.Dialer) {
+				d.Handle("127.0.0.1:3000", probetest.Script{probetest.Sleep(80 * time.Millisecond), probetest.Send("SSH-2.0-OpenSSH_9.6\r\n")})
+			},
+			banner: 300 * time.Millisecond,
+			state:  StateOpenNonHTTP, kind: ServiceSSH, address: "127.0.0.1",
+		},
+		{
+			name: "garbage",
+			setup: func(d *probetest.Dialer) {
+				d.Handle("127.0.0.1:3000", probetest.Script{probetest.Expect(), probetest.Send("\x00\x01\x02 not http\r\n"), probetest.Close()})
+			},
+			state: StateOpenNonHTTP, address: "127.0.0.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := probetest.NewDialer()
+			tt.setup(d)
+			opts := fast
+			if tt.banner != 0 {
+				opts.BannerTimeout = tt.banner
+			}
+			opts.Dialer = d
+			result := ProbeContextWithOptions(context.Background(), "localhost", 3000, opts)
+			if result.State != tt.state {
+				t.Errorf("State %q, want %q", result.State, tt.state)
+			}
+			if result.Kind != tt.kind {
+				t.Errorf("Kind %q, want %q", result.Kind, tt.kind)
+			}
+			if result.Address != tt.address {
+				t.Errorf("Address %q, want %q", result.Address, tt.address)
+			}
+			switch {
+			case tt.err == nil && result.Err != nil:
+				t.Errorf("Err %v, want none", result.Err)
+			case tt.err != nil && !errors.Is(result.Err, tt.err):
+				t.Errorf("Err %v, want %v", result.Err, tt.err)
+			}
+			if result.Port != 3000 {
+				t.Errorf("Port %d, want 3000", result.Port)
+			}
+		})
+	}
+}
+
+func TestProbeScriptedRequest(t *testing.T) {
+	d := probetest.NewDialer()
+	d.Handle("127.0.0.1:3000", probetest.Script{probetest.Expect(), probetest.Send(okResponse), probetest.Close()})
+	ProbeContextWithOptions(context.Background(), "127.0.0.1", 3000, ProbeOptions{
+		Dialer: d, BannerTimeout: -1, Host: "shop.localhost", Headers: map[string]string{"X-Api-Key": "k"},
+	})
+	conns := d.Conns()
+	if len(conns) == 0 {
+		t.Fatal("nothing dialed")
+	}
+	got := string(conns[0].Received())
+	for _, want := range []string{"GET / HTTP/1.1\r\n", "Host: shop.localhost\r\n", "X-Api-Key: k\r\n"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("request %q lacks %q", got, want)
+		}
+	}
+}
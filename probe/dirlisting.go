@@ -0,0 +1,76 @@
+package probe
+
+import (
+	"bytes"
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// DirListingPreview is how many entries of a directory listing are kept
+const DirListingPreview = 20
+
+// Autoindex formats parseDirListing recognises
+const (
+	ListingPython = "python" // python -m http.server
+	ListingNginx  = "nginx"  // nginx autoindex
+	ListingApache = "apache" // Apache mod_autoindex
+	ListingGo     = "go"     // Go's http.FileServer
+)
+
+// DirListing is what an autoindex page shows of the directory it lists
+type DirListing struct {
+	Server string `json:"server"`         // One of the Listing formats
+	Path   string `json:"path,omitempty"` // The URL path listed, when the page names it
+	// Entries are the first DirListingPreview names listed, directories
+	// with a trailing "/", and More is set when the page, or the part of
+	// it that was read, has others
+	Entries []string `json:"entries,omitempty"`
+	More    bool     `json:"more,omitempty"`
+}
+
+// listingLink matches the target of a link on an autoindex page
+var listingLink = regexp.MustCompile(`(?i)<a\s+href\s*=\s*"([^"]*)"`)
+
+// parseDirListing reads the format, path and first entries of an
+// autoindex page from its title and the start of its body. Entries come
+// from the links' targets rather than their text, which nginx shortens;
+// links up, to sort orders and off the directory are skipped.
+func parseDirListing(title string, body []byte, truncated bool) *DirListing {
+	lower := bytes.ToLower(body)
+	lowerTitle := strings.ToLower(title)
+	listing := &DirListing{}
+	switch {
+	case strings.HasPrefix(lowerTitle, "directory listing for "):
+		listing.Server = ListingPython
+		listing.Path = title[len("directory listing for "):]
+	case strings.HasPrefix(lowerTitle, "index of "):
+		listing.Server = ListingNginx
+		if bytes.Contains(lower, []byte("parent directory</a>")) || bytes.Contains(lower, []byte(`href="?c=n;o=d"`)) {
+			listing.Server = ListingApache
+		}
+		listing.Path = title[len("index of "):]
+	case bytes.Contains(lower, []byte("<pre>\n<a href=\"")):
+		listing.Server = ListingGo
+	default:
+		return nil
+	}
+
+	for _, m := range listingLink.FindAllSubmatch(body, -1) {
+		name, err := url.PathUnescape(html.UnescapeString(string(m[1])))
+		// Go's FileServer writes "./a:b" for names that look like a scheme
+		name = strings.TrimPrefix(name, "./")
+		if err != nil || name == "" || name == "../" ||
+			strings.ContainsAny(name[:1], "?#/") || strings.Contains(name, "://") {
+			continue
+		}
+		if len(listing.Entries) == DirListingPreview {
+			listing.More = true
+			break
+		}
+		listing.Entries = append(listing.Entries, name)
+	}
+	listing.More = listing.More || truncated
+	return listing
+}
@@ -0,0 +1,47 @@
+// Package probe identifies what is listening on a local port.
+//
+// A probe connects to host:port, listens briefly for a greeting, then sends
+// a minimal HTTP request and classifies whatever comes back. Depending on
+// the answer it falls back to TLS, HTTP/2 with prior knowledge and gRPC, or
+// recognises common non-HTTP services (Redis, Postgres, MySQL, SSH...).
+//
+// The main entry point is ProbeContextWithOptions; Probe, ProbeContext and
+// ProbeWithOptions are shorthands for it with a background context and/or
+// default options. Every probe is bounded by the per-phase timeouts in
+// ProbeOptions and by the context deadline, and never blocks past either.
+//
+// The outcome is a ProbeResult. Its State is the primary classification:
+//
+//	result := probe.ProbeContextWithOptions(ctx, "localhost", 3000, probe.ProbeOptions{})
+//	switch result.State {
+//	case probe.StateHTTP, probe.StateTLS:
+//		fmt.Println(result.Response, result.Framework)
+//	case probe.StateClosed:
+//		fmt.Println("nothing listening")
+//	}
+//
+// IsHTTP remains available as a shortcut for "answered an HTTP/1.x
+// request". Network failures in ProbeResult.Err wrap ErrRefused, ErrTimeout
+// or ErrReset, and a probe cut short by its context wraps ctx.Err().
+//
+// ProbeMany, ProbeVirtualHosts, Watch and Cache build on the single-port
+// probe for batches, virtual hosts, monitoring and repeated lookups, and
+// RouteFinder finds the apps a reverse proxy serves on one port.
+//
+// Every connection is opened through ProbeOptions.Dialer, a net.Dialer by
+// default. Package probetest provides a fake one that plays scripted
+// servers, for testing code built on probes without real sockets.
+//
+// Protocols the probe doesn't know can be added with RegisterDetector. A
+// Detector either matches the greeting a server sends on connect, which
+// is read once and offered to each detector, or writes a handshake of its
+// own on a fresh connection; see RegisterDetector for the order detectors
+// run in. The built-in non-HTTP protocols are detectors too, which
+// ProbeService runs all of.
+//
+// UDP ports are probed separately. ProbeQUIC tries a QUIC handshake
+// offering HTTP/3; set ProbeOptions.DetectQUIC to run it wherever an HTTPS
+// service advertises h3 in its Alt-Svc header. ProbeUDP sends one datagram
+// of a given protocol (DNS, mDNS, statsd) and reports in ProbeResult.UDP
+// whether it was answered, met silence or was refused.
+package probe
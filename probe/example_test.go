@@ -0,0 +1,91 @@
+package probe_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"time"
+
+	"localhost-magic/probe"
+	"localhost-magic/probe/probetest"
+)
+
+// port returns the port of an httptest server
+func port(srv *httptest.Server) int {
+	_, p, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	n, _ := strconv.Atoi(p)
+	return n
+}
+
+func ExampleProbeContextWithOptions() {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<title>Storefront</title>")
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result := probe.ProbeContextWithOptions(ctx, "127.0.0.1", port(srv), probe.ProbeOptions{
+		ReadTimeout: 2 * time.Second, // For dev servers that compile on the first request
+	})
+	switch result.State {
+	case probe.StateHTTP, probe.StateTLS:
+		fmt.Println(result.StatusCode, result.Title)
+	case probe.StateClosed:
+		fmt.Println("nothing listening")
+	}
+	// Output: 200 Storefront
+}
+
+func ExampleProbeResult_Err() {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := ln.Addr().(*net.TCPAddr)
+	ln.Close() // Nothing listens there any more
+
+	result := probe.ProbeWithOptions("127.0.0.1", addr.Port, probe.ProbeOptions{})
+	fmt.Println(result.State, errors.Is(result.Err, probe.ErrRefused))
+	// Output: closed true
+}
+
+func ExampleProbeMany() {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	results := probe.ProbeMany(context.Background(), "127.0.0.1", []int{port(srv), closed}, probe.ProbeOptions{Concurrency: 2})
+	for _, r := range results {
+		fmt.Println(r.State, r.StatusCode)
+	}
+	// Output:
+	// http 404
+	// closed 0
+}
+
+func Example_probetest() {
+	d := probetest.NewDialer()
+	d.Handle("127.0.0.1:6379", probetest.Script{
+		probetest.Expect(),
+		probetest.Send("+PONG\r\n"),
+		probetest.Close(),
+	})
+	result := probe.ProbeServiceContext(context.Background(), "127.0.0.1", 6379, probe.ProbeOptions{Dialer: d})
+	fmt.Println(result.Kind, result.Banner)
+	// Output: redis +PONG
+}
+
+func ExampleParseHeader() {
+	name, value, err := probe.ParseHeader("X-Api-Key: dev-secret")
+	fmt.Println(name, value, err)
+	_, _, err = probe.ParseHeader("X-Api-Key: dev\r\nHost: evil")
+	fmt.Println(errors.Is(err, probe.ErrInvalidHeader))
+	// Output:
+	// X-Api-Key dev-secret <nil>
+	// true
+}
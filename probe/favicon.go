@@ -0,0 +1,132 @@
+package probe
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"math/bits"
+	"net/http"
+	"strings"
+)
+
+// maxFaviconBytes caps the favicon download; anything larger is not hashed
+const maxFaviconBytes = 100 << 10
+
+// FaviconFingerprint maps a favicon hash to the service that ships it
+type FaviconFingerprint struct {
+	Hash      int32
+	Framework string
+}
+
+// FaviconFingerprints lists known favicon hashes. Hashes use the same
+// scheme as Shodan's http.favicon.hash (MurmurHash3 of the base64-encoded
+// icon), so values from public favicon databases can be added directly;
+// ProbeResult.FaviconHash reports the hash of any icon that was fetched.
+var FaviconFingerprints = []FaviconFingerprint{
+	{Hash: 81586312, Framework: "Jenkins"},
+	{Hash: 116323821, Framework: "Spring Boot"},
+}
+
+// identifyFavicon fetches /favicon.ico and, when it is a real image,
+// records its hash and uses a table match to fill in Framework
+func identifyFavicon(ctx context.Context, result ProbeResult, host, addr string, opts ProbeOptions) ProbeResult {
+	if ctx.Err() != nil {
+		return result
+	}
+
+	req := opts.request("/favicon.ico")
+	req.MaxBody = maxFaviconBytes
+	resp := fetch(ctx, addr, host, result.IsTLS, req, opts)
+	if !isFavicon(resp) {
+		return result
+	}
+
+	result.FaviconHash = FaviconHash(resp.BodySnippet)
+	if result.FrameworkConfidence == ConfidenceHigh {
+		return result
+	}
+	for _, fp := range FaviconFingerprints {
+		if fp.Hash == result.FaviconHash {
+			result.Framework = fp.Framework
+			result.FrameworkConfidence = ConfidenceHigh
+			break
+		}
+	}
+	return result
+}
+
+// isFavicon accepts only a complete 200 response whose content sniffs as
+// an image, so 404 pages and HTML error pages can never produce a match
+func isFavicon(resp ProbeResult) bool {
+	if resp.StatusCode != 200 || len(resp.BodySnippet) == 0 {
+		return false
+	}
+	if resp.BodyTruncated {
+		return false // Too large, or cut short by the deadline; the hash would be wrong
+	}
+	if strings.HasPrefix(http.DetectContentType(resp.BodySnippet), "image/") {
+		return true
+	}
+	// SVG sniffs as XML or text
+	head := bytes.ToLower(resp.BodySnippet[:min(len(resp.BodySnippet), 512)])
+	return bytes.Contains(head, []byte("<svg")) && !bytes.Contains(head, []byte("<html"))
+}
+
+// FaviconHash computes the Shodan-compatible favicon hash: MurmurHash3
+// (x86, 32-bit, seed 0) of the icon encoded as MIME base64, with a newline
+// after every 76 characters and at the end
+func FaviconHash(icon []byte) int32 {
+	encoded := base64.StdEncoding.EncodeToString(icon)
+	var b strings.Builder
+	for len(encoded) > 76 {
+		b.WriteString(encoded[:76])
+		b.WriteByte('\n')
+		encoded = encoded[76:]
+	}
+	b.WriteString(encoded)
+	b.WriteByte('\n')
+	return int32(murmur3(b.String()))
+}
+
+// murmur3 is MurmurHash3_x86_32 with a zero seed
+func murmur3(data string) uint32 {
+	const c1, c2 = 0xcc9e2d51, 0x1b873593
+
+	var h uint32
+	n := len(data)
+	for len(data) >= 4 {
+		k := binary.LittleEndian.Uint32([]byte(data[:4]))
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+		h ^= k
+		h = bits.RotateLeft32(h, 13)
+		h = h*5 + 0xe6546b64
+		data = data[4:]
+	}
+
+	var k uint32
+	switch len(data) {
+	case 3:
+		k ^= uint32(data[2]) << 16
+		fallthrough
+	case 2:
+		k ^= uint32(data[1]) << 8
+		fallthrough
+	case 1:
+		k ^= uint32(data[0])
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+		h ^= k
+	}
+
+	h ^= uint32(n)
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
@@ -0,0 +1,185 @@
+package probe
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// Confidence rates how strongly a fingerprint identifies a framework
+type Confidence string
+
+const (
+	ConfidenceNone   Confidence = ""
+	ConfidenceLow    Confidence = "low"    // Generic server header or common marker
+	ConfidenceMedium Confidence = "medium" // Strong hint shared by a few frameworks
+	ConfidenceHigh   Confidence = "high"   // Marker only this framework emits
+)
+
+// rank orders confidence levels so the best match can be picked
+func (c Confidence) rank() int {
+	switch c {
+	case ConfidenceHigh:
+		return 3
+	case ConfidenceMedium:
+		return 2
+	case ConfidenceLow:
+		return 1
+	}
+	return 0
+}
+
+// FrameworkFingerprint describes one way of recognising a framework. Every
+// non-empty matcher must hold for the fingerprint to match:
+//
+//   - Header names a response header; a trailing "*" matches any header
+//     with that prefix. Value is a case-insensitive substring of it, or
+//     empty to only require the header to be present.
+//   - Body is a substring of the start of the response body.
+//   - Path is requested separately (only with ProbeOptions.FrameworkPaths)
+//     and must answer 2xx; Header and Body then apply to that response.
+type FrameworkFingerprint struct {
+	Framework  string
+	Confidence Confidence
+	Header     string
+	Value      string
+	Body       string
+	Path       string
+}
+
+// FrameworkFingerprints is the table consulted after every HTTP probe. The
+// highest-confidence match wins; ties go to the earlier entry.
+var FrameworkFingerprints = []FrameworkFingerprint{
+	// Headers
+	{Framework: "Express", Confidence: ConfidenceHigh, Header: "X-Powered-By", Value: "Express"},
+	{Framework: "Next.js", Confidence: ConfidenceHigh, Header: "X-Powered-By", Value: "Next.js"},
+	{Framework: "Next.js", Confidence: ConfidenceHigh, Header: "X-Nextjs-*"},
+	{Framework: "Nuxt", Confidence: ConfidenceHigh, Header: "X-Powered-By", Value: "Nuxt"},
+	{Framework: "ASP.NET", Confidence: ConfidenceHigh, Header: "X-Powered-By", Value: "ASP.NET"},
+	{Framework: "PHP", Confidence: ConfidenceMedium, Header: "X-Powered-By", Value: "PHP"},
+	{Framework: "Spring Boot", Confidence: ConfidenceHigh, Header: "X-Application-Context"},
+	{Framework: "Laravel", Confidence: ConfidenceHigh, Header: "Set-Cookie", Value: "laravel_session"},
+	{Framework: "Django", Confidence: ConfidenceMedium, Header: "Server", Value: "WSGIServer"},
+	{Framework: "Django", Confidence: ConfidenceLow, Header: "Set-Cookie", Value: "csrftoken"},
+	{Framework: "Flask", Confidence: ConfidenceMedium, Header: "Server", Value: "Werkzeug"},
+	{Framework: "Rails", Confidence: ConfidenceMedium, Header: "X-Runtime"},
+	{Framework: "WEBrick", Confidence: ConfidenceMedium, Header: "Server", Value: "WEBrick"},
+	{Framework: "Puma", Confidence: ConfidenceLow, Header: "Server", Value: "Puma"},
+	{Framework: "Uvicorn", Confidence: ConfidenceLow, Header: "Server", Value: "uvicorn"},
+	{Framework: "Gunicorn", Confidence: ConfidenceLow, Header: "Server", Value: "gunicorn"},
+	{Framework: "Kestrel", Confidence: ConfidenceLow, Header: "Server", Value: "Kestrel"},
+	{Framework: "Jetty", Confidence: ConfidenceLow, Header: "Server", Value: "Jetty"},
+	{Framework: "Caddy", Confidence: ConfidenceLow, Header: "Server", Value: "Caddy"},
+	{Framework: "nginx", Confidence: ConfidenceLow, Header: "Server", Value: "nginx"},
+	{Framework: "Apache", Confidence: ConfidenceLow, Header: "Server", Value: "Apache"},
+
+	// Body markers
+	{Framework: "Vite", Confidence: ConfidenceHigh, Body: "/@vite/client"},
+	{Framework: "Next.js", Confidence: ConfidenceHigh, Body: "__NEXT_DATA__"},
+	{Framework: "Next.js", Confidence: ConfidenceMedium, Body: "/_next/static/"},
+	{Framework: "Nuxt", Confidence: ConfidenceHigh, Body: "window.__NUXT__"},
+	{Framework: "SvelteKit", Confidence: ConfidenceHigh, Body: "__sveltekit_"},
+	{Framework: "Astro", Confidence: ConfidenceHigh, Body: `content="Astro`},
+	{Framework: "Angular", Confidence: ConfidenceHigh, Body: "ng-version="},
+	{Framework: "Create React App", Confidence: ConfidenceMedium, Body: "/static/js/bundle.js"},
+	{Framework: "webpack-dev-server", Confidence: ConfidenceMedium, Body: "webpack-dev-server"},
+	{Framework: "Django", Confidence: ConfidenceHigh, Body: "<code>DEBUG = True</code>"},
+	{Framework: "Django", Confidence: ConfidenceHigh, Body: "The install worked successfully! Congratulations!"},
+	{Framework: "Rails", Confidence: ConfidenceHigh, Body: "<title>Ruby on Rails"},
+	{Framework: "Spring Boot", Confidence: ConfidenceHigh, Body: "Whitelabel Error Page"},
+	{Framework: "Laravel", Confidence: ConfidenceMedium, Body: "laravel"},
+
+	// Well-known paths
+	{Framework: "Vite", Confidence: ConfidenceHigh, Path: "/@vite/client", Body: "import.meta.hot"},
+	{Framework: "Rails", Confidence: ConfidenceHigh, Path: "/rails/info/properties", Body: "Rails version"},
+	{Framework: "Django", Confidence: ConfidenceMedium, Path: "/admin/login/", Body: "Django"},
+	{Framework: "Spring Boot", Confidence: ConfidenceMedium, Path: "/actuator/health", Body: `"status"`},
+}
+
+// identifyFramework fills in Framework from the probe response, falling
+// back to the redirect target and then to the well-known paths
+func identifyFramework(ctx context.Context, result ProbeResult, host, addr string, opts ProbeOptions) ProbeResult {
+	best := matchFramework(result.Headers, result.BodySnippet)
+	if best.Confidence == ConfidenceNone && result.Final != nil {
+		best = matchFramework(result.Final.Headers, result.Final.BodySnippet)
+	}
+	if best.Confidence != ConfidenceHigh && opts.FrameworkPaths {
+		if fp := matchFrameworkPaths(ctx, result.IsTLS, host, addr, opts); fp.Confidence.rank() > best.Confidence.rank() {
+			best = fp
+		}
+	}
+	result.Framework = best.Framework
+	result.FrameworkConfidence = best.Confidence
+	return result
+}
+
+// matchFramework returns the best header/body fingerprint match, ignoring
+// entries that need a separate request
+func matchFramework(headers http.Header, body []byte) FrameworkFingerprint {
+	var best FrameworkFingerprint
+	for _, fp := range FrameworkFingerprints {
+		if fp.Path != "" || fp.Confidence.rank() <= best.Confidence.rank() {
+			continue
+		}
+		if fp.matches(headers, body) {
+			best = fp
+		}
+	}
+	return best
+}
+
+// matchFrameworkPaths requests each fingerprinted path once and returns
+// the best match among the responses
+func matchFrameworkPaths(ctx context.Context, useTLS bool, host, addr string, opts ProbeOptions) FrameworkFingerprint {
+	var best FrameworkFingerprint
+	responses := make(map[string]ProbeResult)
+	for _, fp := range FrameworkFingerprints {
+		if fp.Path == "" || fp.Confidence.rank() <= best.Confidence.rank() || ctx.Err() != nil {
+			continue
+		}
+		resp, ok := responses[fp.Path]
+		if !ok {
+			resp = fetch(ctx, addr, host, useTLS, opts.request(fp.Path), opts)
+			responses[fp.Path] = resp
+		}
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 && fp.matches(resp.Headers, resp.BodySnippet) {
+			best = fp
+		}
+	}
+	return best
+}
+
+// matches checks the fingerprint's header and body matchers
+func (fp FrameworkFingerprint) matches(headers http.Header, body []byte) bool {
+	if fp.Header != "" && !matchHeader(headers, fp.Header, fp.Value) {
+		return false
+	}
+	if fp.Body != "" && !strings.Contains(string(body), fp.Body) {
+		return false
+	}
+	return fp.Header != "" || fp.Body != ""
+}
+
+// matchHeader reports whether a header named name (or, with a trailing
+// "*", any header with that prefix) contains value
+func matchHeader(headers http.Header, name, value string) bool {
+	prefix, wildcard := strings.CutSuffix(name, "*")
+	for key, values := range headers {
+		if wildcard {
+			if !strings.HasPrefix(strings.ToLower(key), strings.ToLower(prefix)) {
+				continue
+			}
+		} else if !strings.EqualFold(key, name) {
+			continue
+		}
+		if value == "" {
+			return true
+		}
+		for _, v := range values {
+			if strings.Contains(strings.ToLower(v), strings.ToLower(value)) {
+				return true
+			}
+		}
+	}
+	return false
+}
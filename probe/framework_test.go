@@ -0,0 +1,143 @@
+package probe
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// frameworkFixture is a response the fingerprint in the same place in
+// FrameworkFingerprints should recognise, as framework at confidence. It
+// is served at path, or at / for fingerprints without one.
+type frameworkFixture struct {
+	framework  string
+	confidence Confidence
+	header     http.Header
+	body       string
+	path       string
+}
+
+// frameworkFixtures has one fixture for each entry of FrameworkFingerprints,
+// in the same order
+var frameworkFixtures = []frameworkFixture{
+	// Headers
+	{"Express", ConfidenceHigh, http.Header{"X-Powered-By": {"Express"}}, "", ""},
+	{"Next.js", ConfidenceHigh, http.Header{"X-Powered-By": {"Next.js"}}, "", ""},
+	{"Next.js", ConfidenceHigh, http.Header{"X-Nextjs-Cache": {"HIT"}}, "", ""},
+	{"Nuxt", ConfidenceHigh, http.Header{"X-Powered-By": {"Nuxt"}}, "", ""},
+	{"ASP.NET", ConfidenceHigh, http.Header{"X-Powered-By": {"ASP.NET"}}, "", ""},
+	{"PHP", ConfidenceMedium, http.Header{"X-Powered-By": {"PHP/8.3.4"}}, "", ""},
+	{"Spring Boot", ConfidenceHigh, http.Header{"X-Application-Context": {"application:8080"}}, "", ""},
+	{"Laravel", ConfidenceHigh, http.Header{"Set-Cookie": {"XSRF-TOKEN=abc; path=/", "laravel_session=def; path=/; httponly"}}, "", ""},
+	{"Django", ConfidenceMedium, http.Header{"Server": {"WSGIServer/0.2 CPython/3.12.2"}}, "", ""},
+	{"Django", ConfidenceLow, http.Header{"Set-Cookie": {"csrftoken=abc; Path=/; SameSite=Lax"}}, "", ""},
+	{"Flask", ConfidenceMedium, http.Header{"Server": {"Werkzeug/3.0.1 Python/3.12.2"}}, "", ""},
+	{"Rails", ConfidenceMedium, http.Header{"X-Runtime": {"0.012345"}}, "", ""},
+	{"WEBrick", ConfidenceMedium, http.Header{"Server": {"WEBrick/1.8.1 (Ruby/3.3.0/2023-12-25)"}}, "", ""},
+	{"Puma", ConfidenceLow, http.Header{"Server": {"Puma 6.4.2"}}, "", ""},
+	{"Uvicorn", ConfidenceLow, http.Header{"Server": {"uvicorn"}}, "", ""},
+	{"Gunicorn", ConfidenceLow, http.Header{"Server": {"gunicorn"}}, "", ""},
+	{"Kestrel", ConfidenceLow, http.Header{"Server": {"Kestrel"}}, "", ""},
+	{"Jetty", ConfidenceLow, http.Header{"Server": {"Jetty(11.0.20)"}}, "", ""},
+	{"Caddy", ConfidenceLow, http.Header{"Server": {"Caddy"}}, "", ""},
+	{"nginx", ConfidenceLow, http.Header{"Server": {"nginx/1.25.4"}}, "", ""},
+	{"Apache", ConfidenceLow, http.Header{"Server": {"Apache/2.4.58 (Unix)"}}, "", ""},
+
+	// Body markers
+	{"Vite", ConfidenceHigh, nil, `<script type="module" src="/@vite/client"></script>`, ""},
+	{"Next.js", ConfidenceHigh, nil, `<script id="__NEXT_DATA__" type="application/json">{"page":"/"}</script>`, ""},
+	{"Next.js", ConfidenceMedium, nil, `<script src="/_next/static/chunks/main.js"></script>`, ""},
+	{"Nuxt", ConfidenceHigh, nil, `<script>window.__NUXT__={}</script>`, ""},
+	{"SvelteKit", ConfidenceHigh, nil, `<script>__sveltekit_1x2y3z = {base: ""}</script>`, ""},
+	{"Astro", ConfidenceHigh, nil, `<meta name="generator" content="Astro v4.5.0">`, ""},
+	{"Angular", ConfidenceHigh, nil, `<app-root ng-version="17.3.0"></app-root>`, ""},
+	{"Create React App", ConfidenceMedium, nil, `<script src="/static/js/bundle.js"></script>`, ""},
+	{"webpack-dev-server", ConfidenceMedium, nil, `<script src="/webpack-dev-server.js"></script>`, ""},
+	{"Django", ConfidenceHigh, nil, `<p>You're seeing this error because you have <code>DEBUG = True</code> in your settings file.</p>`, ""},
+	{"Django", ConfidenceHigh, nil, `<h1>The install worked successfully! Congratulations!</h1>`, ""},
+	{"Rails", ConfidenceHigh, nil, `<title>Ruby on Rails 7.1.3</title>`, ""},
+	{"Spring Boot", ConfidenceHigh, nil, `<h1>Whitelabel Error Page</h1>`, ""},
+	{"Laravel", ConfidenceMedium, nil, `<link href="https://laravel.com/docs" rel="help">`, ""},
+
+	// Well-known paths
+	{"Vite", ConfidenceHigh, http.Header{"Content-Type": {"text/javascript"}}, `import.meta.hot.accept()`, "/@vite/client"},
+	{"Rails", ConfidenceHigh, nil, `<td>Rails version</td><td>7.1.3</td>`, "/rails/info/properties"},
+	{"Django", ConfidenceMedium, nil, `<title>Log in | Django site admin</title>`, "/admin/login/"},
+	{"Spring Boot", ConfidenceMedium, http.Header{"Content-Type": {"application/json"}}, `{"status":"UP"}`, "/actuator/health"},
+}
+
+// serve answers with the fixture's response at its path, / answering
+// with nothing to go by when that is another
+func (f frameworkFixture) serve(w http.ResponseWriter, r *http.Request) {
+	if want := f.path; r.URL.Path != want && (want != "" || r.URL.Path != "/") {
+		http.NotFound(w, r)
+		return
+	}
+	for key, values := range f.header {
+		w.Header()[key] = values
+	}
+	w.Write([]byte(f.body))
+}
+
+// Each fixture is recognised by its own fingerprint, at its confidence,
+// both by the table lookup and through a probe of a server answering with
+// it
+func TestFrameworkFingerprints(t *testing.T) {
+	if len(frameworkFixtures) != len(FrameworkFingerprints) {
+		t.Fatalf("%d fixtures for %d fingerprints; add one for each new fingerprint", len(frameworkFixtures), len(FrameworkFingerprints))
+	}
+	for i, f := range frameworkFixtures {
+		i, f := i, f
+		fp := FrameworkFingerprints[i]
+		t.Run(f.framework+" "+string(f.confidence), func(t *testing.T) {
+			t.Parallel()
+			if fp.Framework != f.framework || fp.Confidence != f.confidence || fp.Path != f.path {
+				t.Fatalf("fingerprint %d is %q at %q for %q, its fixture %q at %q for %q",
+					i, fp.Framework, fp.Confidence, fp.Path, f.framework, f.confidence, f.path)
+			}
+			if fp.Path == "" {
+				if got := matchFramework(f.header, []byte(f.body)); !reflect.DeepEqual(got, fp) {
+					t.Errorf("matched %+v, want %+v", got, fp)
+				}
+			} else if !fp.matches(f.header, []byte(f.body)) {
+				t.Errorf("%+v doesn't match", fp)
+			}
+
+			srv := httptest.NewServer(http.HandlerFunc(f.serve))
+			defer srv.Close()
+			result := ProbeWithOptions("127.0.0.1", srv.Listener.Addr().(*net.TCPAddr).Port, ProbeOptions{FrameworkPaths: true})
+			if result.Framework != f.framework || result.FrameworkConfidence != f.confidence {
+				t.Errorf("probe found %q at %q, want %q at %q", result.Framework, result.FrameworkConfidence, f.framework, f.confidence)
+			}
+		})
+	}
+}
+
+func TestMatchFramework(t *testing.T) {
+	tests := []struct {
+		name       string
+		header     http.Header
+		body       string
+		framework  string
+		confidence Confidence
+	}{
+		{"nothing to go by", http.Header{"Content-Type": {"text/html"}}, "<title>Blog</title>", "", ConfidenceNone},
+		{"header value in another case", http.Header{"X-Powered-By": {"express"}}, "", "Express", ConfidenceHigh},
+		{"header prefix in another case", http.Header{"x-nextjs-matched-path": {"/"}}, "", "Next.js", ConfidenceHigh},
+		{"value in another header", http.Header{"Via": {"1.1 Caddy"}}, "", "", ConfidenceNone},
+		{"higher confidence wins", http.Header{"Server": {"Puma 6.4.2"}, "X-Runtime": {"0.01"}}, "", "Rails", ConfidenceMedium},
+		{"body outranks a server header", http.Header{"Server": {"nginx"}}, `<script src="/@vite/client">`, "Vite", ConfidenceHigh},
+		{"tie goes to the earlier entry", http.Header{"X-Powered-By": {"Express"}}, `<script src="/@vite/client">`, "Express", ConfidenceHigh},
+		{"path marker in the root page", nil, "Rails version", "", ConfidenceNone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := matchFramework(tt.header, []byte(tt.body))
+			if got.Framework != tt.framework || got.Confidence != tt.confidence {
+				t.Errorf("matched %q at %q, want %q at %q", got.Framework, got.Confidence, tt.framework, tt.confidence)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package probe
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"regexp"
+)
+
+// GraphQLPaths are where detectGraphQL looks for an endpoint, in order
+var GraphQLPaths = []string{
+	"/graphql",
+	"/api/graphql",
+	"/query",
+}
+
+// graphQLQuery is the smallest query every GraphQL server must answer
+const graphQLQuery = `{__typename}`
+
+// graphQLAnswer matches the answer to graphQLQuery: {"data":{"__typename":...
+var graphQLAnswer = regexp.MustCompile(`"data"\s*:\s*\{\s*"__typename"`)
+
+// detectGraphQL sends graphQLQuery to each of GraphQLPaths, as a JSON
+// POST and, for servers that refuse it, as a GET with a query parameter.
+// An answer with data.__typename identifies the endpoint with high
+// confidence and ends the search; a 400 that talks about the query is a
+// low-confidence match, kept unless a later path does better. The
+// requests share a budget like detectAPISpec's.
+func detectGraphQL(ctx context.Context, result ProbeResult, host, addr string, opts ProbeOptions) ProbeResult {
+	if isFileServer(result) || result.Auxiliary != AuxiliaryNone {
+		return result
+	}
+	ctx, cancel := context.WithTimeout(ctx, 2*(opts.DialTimeout+opts.ReadTimeout))
+	defer cancel()
+
+	post := func(path string) request {
+		return opts.request(path).method(http.MethodPost).
+			with("Accept", "application/json").
+			withBody("application/json", []byte(`{"query":"`+graphQLQuery+`"}`))
+	}
+	get := func(path string) request {
+		return opts.request(path+"?query=%7B__typename%7D").with("Accept", "application/json")
+	}
+
+	for _, path := range GraphQLPaths {
+		for _, req := range []func(string) request{post, get} {
+			if ctx.Err() != nil {
+				return result
+			}
+			resp := fetch(ctx, addr, host, result.IsTLS, req(path), opts)
+			confidence := graphQLConfidence(resp)
+			if confidence.rank() > result.GraphQLConfidence.rank() {
+				result.GraphQL = true
+				result.GraphQLPath = path
+				result.GraphQLConfidence = confidence
+			}
+			if confidence == ConfidenceHigh {
+				return result
+			}
+			// Only a server that turned the POST away gets the GET
+			if resp.StatusCode != http.StatusMethodNotAllowed &&
+				resp.StatusCode != http.StatusUnsupportedMediaType &&
+				resp.StatusCode != http.StatusBadRequest {
+				break
+			}
+		}
+	}
+	return result
+}
+
+// graphQLConfidence rates a response to graphQLQuery
+func graphQLConfidence(resp ProbeResult) Confidence {
+	switch {
+	case !resp.IsHTTP:
+		return ConfidenceNone
+	case graphQLAnswer.Match(resp.BodySnippet):
+		return ConfidenceHigh
+	case resp.StatusCode == http.StatusBadRequest && bytes.Contains(bytes.ToLower(resp.BodySnippet), []byte("query")):
+		return ConfidenceLow
+	}
+	return ConfidenceNone
+}
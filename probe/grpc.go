@@ -0,0 +1,239 @@
+package probe
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+	"strings"
+	"time"
+)
+
+// grpcProbePath is a method no real service implements; any gRPC server
+// answers it with grpc-status UNIMPLEMENTED
+const grpcProbePath = "/localhost_magic.Probe/Detect"
+
+// h2MaxResponseData caps the DATA bytes collected from an HTTP/2 response
+const h2MaxResponseData = 64 << 10
+
+// h2Response collects what came back on the probe stream
+type h2Response struct {
+	Headers  []hpackField
+	Trailers []hpackField
+	Data     []byte
+}
+
+// h2Session is an HTTP/2 connection that has completed startH2, carrying
+// requests one after another
+type h2Session struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	decoder *hpackDecoder // The dynamic table spans the connection
+	stream  uint32        // Last stream ID used
+}
+
+// newH2Session wraps a connection and the reader startH2 returned
+func newH2Session(conn net.Conn, reader *bufio.Reader) *h2Session {
+	return &h2Session{conn: conn, reader: reader, decoder: newHPACKDecoder()}
+}
+
+// roundTrip sends a request on the next stream and reads the response
+// until the stream ends, the server resets it, the read deadline passes
+// or h2MaxResponseData bytes of DATA have arrived
+func (s *h2Session) roundTrip(ctx context.Context, fields []hpackField, body []byte, opts ProbeOptions) (h2Response, error) {
+	if s.stream == 0 {
+		s.stream = 1
+	} else {
+		s.stream += 2
+	}
+	streamID, conn, reader, decoder := s.stream, s.conn, s.reader, s.decoder
+
+	conn.SetWriteDeadline(phaseDeadline(ctx, opts.WriteTimeout))
+	flags := byte(h2FlagEndHeaders)
+	if body == nil {
+		flags |= h2FlagEndStream
+	}
+	if err := writeH2Frame(conn, h2FrameHeaders, flags, streamID, hpackEncode(fields)); err != nil {
+		return h2Response{}, err
+	}
+	if body != nil {
+		if err := writeH2Frame(conn, h2FrameData, h2FlagEndStream, streamID, body); err != nil {
+			return h2Response{}, err
+		}
+	}
+
+	conn.SetReadDeadline(phaseDeadline(ctx, opts.ReadTimeout))
+	var resp h2Response
+	var block []byte
+	for {
+		frame, err := readH2Frame(reader)
+		if err != nil {
+			return resp, err
+		}
+
+		switch frame.Type {
+		case h2FrameSettings:
+			if frame.Flags&h2FlagAck == 0 {
+				writeH2Frame(conn, h2FrameSettings, h2FlagAck, 0, nil)
+			}
+			continue
+		case h2FramePing:
+			if frame.Flags&h2FlagAck == 0 {
+				writeH2Frame(conn, h2FramePing, h2FlagAck, 0, frame.Payload)
+			}
+			continue
+		case h2FrameGoAway:
+			return resp, errHTTP2GoAway
+		}
+		if frame.StreamID != streamID {
+			continue
+		}
+
+		switch frame.Type {
+		case h2FrameHeaders, h2FrameContinuation:
+			payload := frame.Payload
+			if frame.Type == h2FrameHeaders {
+				payload = stripHeadersPadding(frame)
+			}
+			block = append(block, payload...)
+			if frame.Flags&h2FlagEndHeaders == 0 {
+				continue
+			}
+			decoded, err := decoder.decode(block)
+			block = nil
+			if err != nil {
+				return resp, err
+			}
+			if resp.Headers == nil {
+				resp.Headers = decoded
+			} else {
+				resp.Trailers = decoded
+			}
+		case h2FrameData:
+			if room := h2MaxResponseData - len(resp.Data); room > 0 {
+				data := stripPadding(frame)
+				if len(data) > room {
+					data = data[:room]
+				}
+				resp.Data = append(resp.Data, data...)
+			}
+			if len(resp.Data) >= h2MaxResponseData {
+				return resp, nil
+			}
+			// Give the flow-control window back, or a response larger than
+			// the default window would stall
+			if len(frame.Payload) > 0 {
+				increment := binary.BigEndian.AppendUint32(nil, uint32(len(frame.Payload)))
+				writeH2Frame(conn, h2FrameWindowUpdate, 0, 0, increment)
+				writeH2Frame(conn, h2FrameWindowUpdate, 0, streamID, increment)
+			}
+		case h2FrameRSTStream:
+			return resp, nil
+		}
+
+		if frame.Flags&h2FlagEndStream != 0 && frame.Type != h2FrameContinuation {
+			return resp, nil
+		}
+	}
+}
+
+// stripPadding removes the pad length byte and padding from a padded frame
+func stripPadding(frame h2Frame) []byte {
+	payload := frame.Payload
+	if frame.Flags&h2FlagPadded == 0 || len(payload) == 0 {
+		return payload
+	}
+	padLen := int(payload[0])
+	if padLen >= len(payload) {
+		return nil
+	}
+	return payload[1 : len(payload)-padLen]
+}
+
+// stripHeadersPadding removes padding and priority fields from a HEADERS frame
+func stripHeadersPadding(frame h2Frame) []byte {
+	payload := stripPadding(frame)
+	if frame.Flags&h2FlagPriority != 0 {
+		if len(payload) < 5 {
+			return nil
+		}
+		payload = payload[5:]
+	}
+	return payload
+}
+
+// grpcRequestFields returns the request headers for a unary gRPC call
+func grpcRequestFields(scheme, path string) []hpackField {
+	return []hpackField{
+		{":method", "POST"},
+		{":scheme", scheme},
+		{":path", path},
+		{":authority", "localhost"},
+		{"content-type", "application/grpc"},
+		{"te", "trailers"},
+	}
+}
+
+// grpcFrame wraps a protobuf message in the gRPC length-prefixed framing
+func grpcFrame(message []byte) []byte {
+	n := len(message)
+	return append([]byte{0, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}, message...)
+}
+
+// isGRPC sends a unary call to a nonexistent method and reports whether the
+// response carries gRPC headers or trailers
+func isGRPC(ctx context.Context, session *h2Session, scheme string, opts ProbeOptions) bool {
+	resp, _ := session.roundTrip(ctx, grpcRequestFields(scheme, grpcProbePath), grpcFrame(nil), opts)
+	for _, fields := range [][]hpackField{resp.Headers, resp.Trailers} {
+		for _, field := range fields {
+			if field.Name == "grpc-status" {
+				return true
+			}
+			if field.Name == "content-type" && strings.HasPrefix(field.Value, "application/grpc") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// probeH2TLS connects with ALPN h2 only, for servers that refuse HTTP/1.1
+// over TLS. IsTLS is set in the result only if h2 was negotiated.
+func probeH2TLS(ctx context.Context, addr, host string, opts ProbeOptions) ProbeResult {
+	conn, cert, err := connectTLS(ctx, addr, host, alpnH2, opts)
+	if err != nil {
+		return ProbeResult{Err: contextError(ctx, err)}
+	}
+	defer conn.Close()
+
+	state := conn.ConnectionState()
+	if state.NegotiatedProtocol != "h2" {
+		return ProbeResult{}
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+
+	result := ProbeResult{
+		Protocol:           ProtocolH2,
+		SupportedVersions:  []string{VersionH2},
+		IsTLS:              true,
+		TLSVersion:         tls.VersionName(state.Version),
+		NegotiatedProtocol: state.NegotiatedProtocol,
+		Cert:               cert,
+	}
+	reader, err := startH2(ctx, conn, opts)
+	if err != nil {
+		result.Err = contextError(ctx, err)
+		return result
+	}
+	session := newH2Session(conn, reader)
+	if isGRPC(ctx, session, "https", opts) {
+		result.Protocol = ProtocolGRPC
+		result.GRPCServices = grpcServices(ctx, session, "https", opts)
+	}
+	return result
+}
@@ -0,0 +1,176 @@
+package probe
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// http2Preface is the client connection preface sent by HTTP/2 clients
+// with prior knowledge (RFC 9113 section 3.4)
+const http2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// HTTP/2 frame types and flags used by the probe
+const (
+	h2FrameData         = 0x0
+	h2FrameHeaders      = 0x1
+	h2FrameRSTStream    = 0x3
+	h2FrameSettings     = 0x4
+	h2FramePing         = 0x6
+	h2FrameGoAway       = 0x7
+	h2FrameWindowUpdate = 0x8
+	h2FrameContinuation = 0x9
+
+	h2FlagAck        = 0x1
+	h2FlagEndStream  = 0x1
+	h2FlagEndHeaders = 0x4
+	h2FlagPadded     = 0x8
+	h2FlagPriority   = 0x20
+)
+
+// h2FrameHeaderLen is the fixed size of an HTTP/2 frame header
+const h2FrameHeaderLen = 9
+
+// h2MaxFrameSize caps the payload we are willing to read for a single frame
+const h2MaxFrameSize = 1 << 14
+
+// h2Frame is a decoded HTTP/2 frame
+type h2Frame struct {
+	Type     byte
+	Flags    byte
+	StreamID uint32
+	Payload  []byte
+}
+
+// writeH2Frame writes a single HTTP/2 frame
+func writeH2Frame(w io.Writer, typ, flags byte, streamID uint32, payload []byte) error {
+	header := make([]byte, h2FrameHeaderLen, h2FrameHeaderLen+len(payload))
+	header[0] = byte(len(payload) >> 16)
+	header[1] = byte(len(payload) >> 8)
+	header[2] = byte(len(payload))
+	header[3] = typ
+	header[4] = flags
+	binary.BigEndian.PutUint32(header[5:], streamID&0x7fffffff)
+	_, err := w.Write(append(header, payload...))
+	return err
+}
+
+// readH2Frame reads a single HTTP/2 frame, refusing oversized payloads
+func readH2Frame(r io.Reader) (h2Frame, error) {
+	var header [h2FrameHeaderLen]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return h2Frame{}, err
+	}
+
+	length := int(header[0])<<16 | int(header[1])<<8 | int(header[2])
+	if length > h2MaxFrameSize {
+		return h2Frame{}, fmt.Errorf("http2: frame too large (%d bytes)", length)
+	}
+
+	frame := h2Frame{
+		Type:     header[3],
+		Flags:    header[4],
+		StreamID: binary.BigEndian.Uint32(header[5:]) & 0x7fffffff,
+		Payload:  make([]byte, length),
+	}
+	if _, err := io.ReadFull(r, frame.Payload); err != nil {
+		return h2Frame{}, err
+	}
+	return frame, nil
+}
+
+// looksLikeH2Frame reports whether data starts with what could be a server
+// SETTINGS frame on stream 0. Some HTTP/2 servers send their preface as
+// soon as the connection opens, which shows up as garbage to an HTTP/1 read.
+func looksLikeH2Frame(data []byte) bool {
+	if len(data) < h2FrameHeaderLen {
+		return false
+	}
+	length := int(data[0])<<16 | int(data[1])<<8 | int(data[2])
+	return data[3] == h2FrameSettings && length%6 == 0 &&
+		binary.BigEndian.Uint32(data[5:9]) == 0
+}
+
+// errHTTP2GoAway is returned when the server closes the connection with GOAWAY
+var errHTTP2GoAway = errors.New("http2: server sent GOAWAY")
+
+// errNoH2Settings is returned when the peer did not answer the HTTP/2
+// preface with a SETTINGS frame
+var errNoH2Settings = errors.New("http2: no SETTINGS frame in response to preface")
+
+// startH2 sends the client preface and an empty SETTINGS frame, then waits
+// for the server's SETTINGS frame. The returned reader must be used for any
+// further frames on the connection.
+func startH2(ctx context.Context, conn net.Conn, opts ProbeOptions) (*bufio.Reader, error) {
+	conn.SetWriteDeadline(phaseDeadline(ctx, opts.WriteTimeout))
+	if _, err := conn.Write([]byte(http2Preface)); err != nil {
+		return nil, err
+	}
+	if err := writeH2Frame(conn, h2FrameSettings, 0, 0, nil); err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(phaseDeadline(ctx, opts.ReadTimeout))
+	reader := bufio.NewReader(conn)
+	frame, err := readH2Frame(reader)
+	if err != nil {
+		return nil, err
+	}
+	// The server connection preface must be a non-ACK SETTINGS frame
+	if frame.Type != h2FrameSettings || frame.Flags&h2FlagAck != 0 || frame.StreamID != 0 {
+		return nil, errNoH2Settings
+	}
+
+	// Acknowledge the server settings so it will process our requests
+	conn.SetWriteDeadline(phaseDeadline(ctx, opts.WriteTimeout))
+	if err := writeH2Frame(conn, h2FrameSettings, h2FlagAck, 0, nil); err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+// probeH2C checks whether addr speaks cleartext HTTP/2 with prior knowledge
+func probeH2C(ctx context.Context, addr string, opts ProbeOptions) ProbeResult {
+	conn, err := opts.dial(ctx, "tcp", addr)
+	if err != nil {
+		return ProbeResult{IsHTTP: false, Err: contextError(ctx, err)}
+	}
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+
+	reader, err := startH2(ctx, conn, opts)
+	if err != nil {
+		return ProbeResult{IsHTTP: false, Err: contextError(ctx, err)}
+	}
+
+	result := ProbeResult{Protocol: ProtocolH2C, SupportedVersions: []string{VersionH2C}}
+	session := newH2Session(conn, reader)
+	if isGRPC(ctx, session, "http", opts) {
+		result.Protocol = ProtocolGRPC
+		result.GRPCServices = grpcServices(ctx, session, "http", opts)
+	}
+	return result
+}
+
+// shouldTryH2C decides whether a failed HTTP/1.0 attempt is worth retrying
+// with the HTTP/2 preface: the server went quiet, hung up, or sent what
+// looks like an HTTP/2 SETTINGS frame
+func shouldTryH2C(ctx context.Context, result ProbeResult) bool {
+	if ctx.Err() != nil || result.IsHTTP {
+		return false
+	}
+	if result.Response != "" {
+		// Whatever answered, it only looks like HTTP/2 if it sent SETTINGS
+		return looksLikeH2Frame([]byte(result.Response))
+	}
+	return true
+}
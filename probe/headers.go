@@ -0,0 +1,88 @@
+package probe
+
+import (
+	"bufio"
+	"errors"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// maxHeaderBytes caps how much of the header block a probe will read, so a
+// server that streams forever can't make a probe buffer unbounded data
+const maxHeaderBytes = 64 << 10
+
+// maxStatusLineBytes caps the status line; anything longer is not HTTP
+const maxStatusLineBytes = 8 << 10
+
+// maxResponseLen caps how much of a non-HTTP first line is kept in
+// ProbeResult.Response
+const maxResponseLen = 256
+
+// errLineTooLong is returned when a line exceeds the remaining read budget
+var errLineTooLong = errors.New("probe: line exceeds read limit")
+
+// readLimitedLine reads a single line (including the trailing '\n') but
+// gives up once more than limit bytes have been consumed without a newline
+func readLimitedLine(r *bufio.Reader, limit int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > limit {
+			return string(line[:limit]), errLineTooLong
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		return string(line), err
+	}
+}
+
+// truncateResponse trims a first line for ProbeResult.Response, keeping at
+// most maxResponseLen bytes of it
+func truncateResponse(line string) string {
+	line = strings.TrimSpace(line)
+	if len(line) > maxResponseLen {
+		line = strings.ToValidUTF8(line[:maxResponseLen], "")
+	}
+	return line
+}
+
+// readHeaders reads the header block following the status line. It stops
+// at the blank line, after maxHeaderBytes, or at the first read error
+// (typically the deadline), returning whatever headers were parsed so far.
+func readHeaders(r *bufio.Reader) http.Header {
+	headers := make(http.Header)
+	budget := maxHeaderBytes
+	lastKey := ""
+
+	for budget > 0 {
+		line, err := readLimitedLine(r, budget)
+		budget -= len(line)
+
+		trimmed := strings.TrimRight(line, "\r\n")
+		if err == nil && trimmed == "" {
+			break // End of header block
+		}
+
+		// Only parse complete lines; a partial line means we ran out of time
+		// or bytes mid-header
+		if err == nil || strings.HasSuffix(line, "\n") {
+			if (trimmed[0] == ' ' || trimmed[0] == '\t') && lastKey != "" {
+				// Obsolete line folding: continuation of the previous value
+				values := headers[lastKey]
+				values[len(values)-1] += " " + strings.TrimSpace(trimmed)
+			} else if key, value, ok := strings.Cut(trimmed, ":"); ok {
+				lastKey = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(key))
+				headers.Add(lastKey, strings.TrimSpace(value))
+			}
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	return headers
+}
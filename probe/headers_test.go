@@ -0,0 +1,214 @@
+package probe
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+// countingDialer dials the network and counts what each connection reads
+type countingDialer struct {
+	mu    sync.Mutex
+	conns []*countingConn
+}
+
+type countingConn struct {
+	net.Conn
+	mu sync.Mutex
+	n  int
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.mu.Lock()
+	c.n += n
+	c.mu.Unlock()
+	return n, err
+}
+
+func (d *countingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	c := &countingConn{Conn: conn}
+	d.mu.Lock()
+	d.conns = append(d.conns, c)
+	d.mu.Unlock()
+	return c, nil
+}
+
+// most returns the most any one connection read
+func (d *countingDialer) most() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	most := 0
+	for _, c := range d.conns {
+		c.mu.Lock()
+		most = max(most, c.n)
+		c.mu.Unlock()
+	}
+	return most
+}
+
+// streamer writes data on every connection and hangs up, or stalls
+// after it if stall is set
+func streamer(t *testing.T, data string, stall bool) int {
+	t.Helper()
+	return listen(t, tcpListener(t), func(conn net.Conn) {
+		defer conn.Close()
+		go io.Copy(io.Discard, conn)
+		io.WriteString(conn, data)
+		if stall {
+			time.Sleep(5 * time.Second)
+		}
+	})
+}
+
+func TestReadLimitedLine(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		limit int
+		want  string
+		err   error
+	}{
+		{"line", "HTTP/1.1 200 OK\r\nServer: x\r\n", 64, "HTTP/1.1 200 OK\r\n", nil},
+		{"exactly the limit", "ab\n", 3, "ab\n", nil},
+		{"over the limit", "abcd\n", 3, "abc", errLineTooLong},
+		{"no newline", "HTT", 64, "HTT", io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readLimitedLine(bufio.NewReader(strings.NewReader(tt.input)), tt.limit)
+			if got != tt.want || err != tt.err {
+				t.Errorf("readLimitedLine = %q, %v; want %q, %v", got, err, tt.want, tt.err)
+			}
+		})
+	}
+}
+
+func TestReadLimitedLineStopsReading(t *testing.T) {
+	src := &countingReader{r: strings.NewReader(strings.Repeat("A", 10<<20))}
+	r := bufio.NewReader(src)
+	line, err := readLimitedLine(r, maxStatusLineBytes)
+	if err != errLineTooLong || len(line) != maxStatusLineBytes {
+		t.Errorf("got %d bytes, %v; want %d and errLineTooLong", len(line), err, maxStatusLineBytes)
+	}
+	if src.n > maxStatusLineBytes+r.Size() {
+		t.Errorf("read %d bytes for a %d byte limit", src.n, maxStatusLineBytes)
+	}
+}
+
+func TestReadHeaders(t *testing.T) {
+	input := "Content-Type: text/html\r\n" +
+		"X-Folded: first\r\n\tsecond\r\n" +
+		"set-cookie: a=1\r\nSet-Cookie: b=2\r\n" +
+		"Not a header\r\n" +
+		"\r\n" +
+		"<html>"
+	r := bufio.NewReader(strings.NewReader(input))
+	h := readHeaders(r)
+	if h.Get("Content-Type") != "text/html" || h.Get("X-Folded") != "first second" || len(h.Values("Set-Cookie")) != 2 {
+		t.Errorf("headers %v", h)
+	}
+	if rest, _ := io.ReadAll(r); string(rest) != "<html>" {
+		t.Errorf("body %q left after the headers", rest)
+	}
+
+	// A partial last line, cut off by the deadline, is dropped
+	h = readHeaders(bufio.NewReader(strings.NewReader("Server: x\r\nX-Cut: ha")))
+	if h.Get("Server") != "x" || h.Get("X-Cut") != "" {
+		t.Errorf("headers %v, want only the complete line", h)
+	}
+}
+
+func TestReadHeadersCapsBytes(t *testing.T) {
+	endless := strings.NewReader(strings.Repeat("X-Junk: "+strings.Repeat("A", 100)+"\r\n", 100000)) // 11MB
+	src := &countingReader{r: endless}
+	r := bufio.NewReader(src)
+	h := readHeaders(r)
+	if n := len(h.Values("X-Junk")); n == 0 || n > maxHeaderBytes/100 {
+		t.Errorf("kept %d header lines of ~110 bytes for a %d byte budget", n, maxHeaderBytes)
+	}
+	if src.n > maxHeaderBytes+r.Size() {
+		t.Errorf("read %d bytes for a %d byte budget", src.n, maxHeaderBytes)
+	}
+}
+
+// TestProbeEndlessLine sends 10MB of 'A' with no newline: the probe takes
+// it for something that isn't HTTP, reading no more than its caps
+func TestProbeEndlessLine(t *testing.T) {
+	port := streamer(t, strings.Repeat("A", 10<<20), false)
+	d := &countingDialer{}
+	start := time.Now()
+	result := ProbeWithOptions("127.0.0.1", port, ProbeOptions{Dialer: d, BannerTimeout: -1, ReadTimeout: time.Second})
+	if result.IsHTTP || result.State != StateOpenNonHTTP {
+		t.Errorf("IsHTTP %v, State %q; want open but not HTTP", result.IsHTTP, result.State)
+	}
+	if len(result.Response) != maxResponseLen || strings.Trim(result.Response, "A") != "" {
+		t.Errorf("Response has %d bytes, want %d of the stream", len(result.Response), maxResponseLen)
+	}
+	// The status line cap plus what bufio and a TLS record header pull in
+	if most := d.most(); most > maxStatusLineBytes+64<<10 {
+		t.Errorf("a connection read %d bytes", most)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("took %v", elapsed)
+	}
+}
+
+// TestProbeStalledLine sends "HTT" and stalls: the probe gives up at its
+// read deadline, keeping the partial line
+func TestProbeStalledLine(t *testing.T) {
+	port := streamer(t, "HTT", true)
+	readTimeout := 200 * time.Millisecond
+	start := time.Now()
+	result := ProbeWithOptions("127.0.0.1", port, ProbeOptions{BannerTimeout: -1, ReadTimeout: readTimeout})
+	elapsed := time.Since(start)
+	if result.IsHTTP || result.State != StateOpenNonHTTP || result.Response != "HTT" {
+		t.Errorf("IsHTTP %v, State %q, Response %q; want the partial line, not HTTP", result.IsHTTP, result.State, result.Response)
+	}
+	// Each follow-up attempt (TLS, h2c) is bounded by the same deadlines
+	if elapsed > 10*readTimeout {
+		t.Errorf("took %v with a %v read timeout", elapsed, readTimeout)
+	}
+}
+
+// TestProbeManyNotStalled checks stalling servers don't hold up a batch
+// beyond their own deadlines
+func TestProbeManyNotStalled(t *testing.T) {
+	var ports []int
+	for i := 0; i < 4; i++ {
+		ports = append(ports, streamer(t, "HTT", true))
+	}
+	ports = append(ports, streamer(t, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n", false))
+	readTimeout := 200 * time.Millisecond
+	start := time.Now()
+	results := ProbeMany(context.Background(), "127.0.0.1", ports, ProbeOptions{BannerTimeout: -1, ReadTimeout: readTimeout})
+	if elapsed := time.Since(start); elapsed > 10*readTimeout {
+		t.Errorf("batch took %v with a %v read timeout", elapsed, readTimeout)
+	}
+	for _, r := range results {
+		if want := r.Port == ports[len(ports)-1]; r.IsHTTP != want {
+			t.Errorf("port %d: IsHTTP %v, State %q", r.Port, r.IsHTTP, r.State)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package probe
+
+// portHints are best-effort guesses for well-known ports whose services
+// don't answer the probe in a way it can identify
+var portHints = map[int]string{
+	1099:  "Java RMI registry",
+	1883:  "MQTT broker",
+	2181:  "ZooKeeper",
+	2345:  "Delve (Go debugger)",
+	4222:  "NATS",
+	5005:  "JVM debug port (JDWP)",
+	5037:  "Android adb server",
+	5555:  "Android adb (TCP)",
+	5672:  "AMQP broker (RabbitMQ)",
+	5678:  "Python debugpy",
+	5900:  "VNC",
+	9003:  "Xdebug",
+	9042:  "Cassandra",
+	9092:  "Kafka",
+	9229:  "Node.js inspector",
+	26257: "CockroachDB",
+}
+
+// PortHint returns a guess at what usually listens on port, or "" if the
+// port isn't a well-known one
+func PortHint(port int) string {
+	return portHints[port]
+}
@@ -0,0 +1,74 @@
+package probe
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Auxiliary labels an endpoint that only exists to support another
+// service, so listings can group it under that service
+type Auxiliary string
+
+const (
+	AuxiliaryNone Auxiliary = ""
+	AuxiliaryHMR  Auxiliary = "hmr" // A dev server's hot-module-reload channel
+)
+
+// viteHMRProtocol is the WebSocket subprotocol Vite's HMR client asks for
+const viteHMRProtocol = "vite-hmr"
+
+// hmrMarker is a path only a hot-module-reload server answers the way
+// match expects
+type hmrMarker struct {
+	Framework string
+	Path      string
+	Match     func(resp ProbeResult) bool
+}
+
+// hmrMarkers are requested on services whose root had nothing to show:
+// a 404 or an empty body
+var hmrMarkers = []hmrMarker{
+	// webpack-dev-server 3 puts its SockJS endpoint under /sockjs-node
+	{Framework: "webpack-dev-server", Path: "/sockjs-node/info", Match: func(resp ProbeResult) bool {
+		return resp.StatusCode == http.StatusOK && strings.Contains(string(resp.BodySnippet), `"websocket"`)
+	}},
+	// webpack-hot-middleware streams its events from /__webpack_hmr
+	{Framework: "webpack-hot-middleware", Path: "/__webpack_hmr", Match: func(resp ProbeResult) bool {
+		mediaType, _, _ := mime.ParseMediaType(resp.Headers.Get("Content-Type"))
+		return resp.StatusCode == http.StatusOK && mediaType == "text/event-stream"
+	}},
+}
+
+// identifyHMR recognises a port that is only a dev server's HMR channel,
+// which otherwise looks like an HTTP service with nothing to say. Vite's
+// separate HMR port answers plain requests with 426 Upgrade Required and
+// accepts WebSockets speaking vite-hmr; webpack's endpoints are found
+// through hmrMarkers.
+func identifyHMR(ctx context.Context, result ProbeResult, host, addr string, opts ProbeOptions) ProbeResult {
+	if result.StatusCode == http.StatusUpgradeRequired {
+		ok, protocol := websocketUpgrade(ctx, addr, host, result.IsTLS, "/", viteHMRProtocol, opts)
+		if ok && protocol == viteHMRProtocol {
+			result.Auxiliary = AuxiliaryHMR
+			result.Framework, result.FrameworkConfidence = "Vite", ConfidenceHigh
+			return result
+		}
+	}
+
+	if len(result.BodySnippet) > 0 && result.StatusCode != http.StatusNotFound {
+		return result
+	}
+	for _, marker := range hmrMarkers {
+		if ctx.Err() != nil {
+			break
+		}
+		resp := fetch(ctx, addr, host, result.IsTLS, opts.request(marker.Path), opts)
+		if marker.Match(resp) {
+			result.Auxiliary = AuxiliaryHMR
+			result.Framework, result.FrameworkConfidence = marker.Framework, ConfidenceHigh
+			break
+		}
+	}
+	return result
+}
@@ -0,0 +1,153 @@
+package probe
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Hooks are called as a probe runs, for callers that want to watch what it
+// does: each dial, each HTTP request written and its first byte, and the
+// result of every probe. They are called synchronously from the probing
+// goroutine, concurrently when probes run in parallel as in ProbeMany, so
+// they must be safe for concurrent use and must not block. Nil hooks are
+// skipped. Being part of ProbeOptions, they reach every probe a batch or a
+// scan runs with those options.
+type Hooks struct {
+	// OnDialStart is called before each connection is dialed, after any
+	// wait for ProbeOptions.Limiter, and OnDialDone after, with the time
+	// the dial took
+	OnDialStart func(network, addr string)
+	OnDialDone  func(network, addr string, err error, d time.Duration)
+	// OnRequestWritten is called once an HTTP/1 request was sent to addr
+	OnRequestWritten func(addr, method, path string)
+	// OnFirstByte is called when the first byte of the answer to that
+	// request arrives, with the time since it was written
+	OnFirstByte func(addr string, ttfb time.Duration)
+	// OnResult is called with the result of each probe, as returned by the
+	// probe functions: one call per port of ProbeMany, and one for a
+	// Recheck, whether it reused a connection or probed in full
+	OnResult func(ProbeResult)
+}
+
+func (h Hooks) dialStart(network, addr string) {
+	if h.OnDialStart != nil {
+		h.OnDialStart(network, addr)
+	}
+}
+
+func (h Hooks) dialDone(network, addr string, err error, d time.Duration) {
+	if h.OnDialDone != nil {
+		h.OnDialDone(network, addr, err, d)
+	}
+}
+
+func (h Hooks) requestWritten(addr string, req request) {
+	if h.OnRequestWritten != nil {
+		h.OnRequestWritten(addr, req.Method, req.Path)
+	}
+}
+
+func (h Hooks) firstByte(addr string, ttfb time.Duration) {
+	if h.OnFirstByte != nil {
+		h.OnFirstByte(addr, ttfb)
+	}
+}
+
+func (h Hooks) result(r ProbeResult) ProbeResult {
+	if h.OnResult != nil {
+		h.OnResult(r)
+	}
+	return r
+}
+
+// Stats counts what the probes it is hooked into do, through the Hooks it
+// returns. A Stats is an expvar.Var, so it can be published with
+// expvar.Publish; Snapshot reads it for other metrics systems. It is safe
+// for concurrent use.
+type Stats struct {
+	dials, dialErrors     atomic.Int64
+	dialTime              atomic.Int64 // Nanoseconds, summed
+	requests, firstBytes  atomic.Int64
+	firstByteTime         atomic.Int64 // Nanoseconds, summed
+	results, resultErrors atomic.Int64
+
+	mu      sync.Mutex
+	byState map[State]int64
+}
+
+// StatsSnapshot is what a Stats counted, since it was created
+type StatsSnapshot struct {
+	Dials         int64           `json:"dials"`
+	DialErrors    int64           `json:"dial_errors"`
+	DialTime      time.Duration   `json:"dial_time_ns"` // Summed over the dials
+	Requests      int64           `json:"requests"`
+	FirstBytes    int64           `json:"first_bytes"`
+	FirstByteTime time.Duration   `json:"first_byte_time_ns"` // Summed over the first bytes
+	Results       int64           `json:"results"`
+	ResultErrors  int64           `json:"result_errors"` // Results with Err set
+	ByState       map[State]int64 `json:"by_state,omitempty"`
+}
+
+// Hooks returns the hooks that record into s
+func (s *Stats) Hooks() Hooks {
+	return Hooks{
+		OnDialStart: func(string, string) { s.dials.Add(1) },
+		OnDialDone: func(_, _ string, err error, d time.Duration) {
+			s.dialTime.Add(int64(d))
+			if err != nil {
+				s.dialErrors.Add(1)
+			}
+		},
+		OnRequestWritten: func(string, string, string) { s.requests.Add(1) },
+		OnFirstByte: func(_ string, ttfb time.Duration) {
+			s.firstBytes.Add(1)
+			s.firstByteTime.Add(int64(ttfb))
+		},
+		OnResult: func(r ProbeResult) {
+			s.results.Add(1)
+			if r.Err != nil {
+				s.resultErrors.Add(1)
+			}
+			if r.State == StateUnknown {
+				return
+			}
+			s.mu.Lock()
+			if s.byState == nil {
+				s.byState = make(map[State]int64)
+			}
+			s.byState[r.State]++
+			s.mu.Unlock()
+		},
+	}
+}
+
+// Snapshot returns the counts so far
+func (s *Stats) Snapshot() StatsSnapshot {
+	snap := StatsSnapshot{
+		Dials:         s.dials.Load(),
+		DialErrors:    s.dialErrors.Load(),
+		DialTime:      time.Duration(s.dialTime.Load()),
+		Requests:      s.requests.Load(),
+		FirstBytes:    s.firstBytes.Load(),
+		FirstByteTime: time.Duration(s.firstByteTime.Load()),
+		Results:       s.results.Load(),
+		ResultErrors:  s.resultErrors.Load(),
+	}
+	s.mu.Lock()
+	if len(s.byState) > 0 {
+		snap.ByState = make(map[State]int64, len(s.byState))
+		for state, n := range s.byState {
+			snap.ByState[state] = n
+		}
+	}
+	s.mu.Unlock()
+	return snap
+}
+
+// String returns the snapshot as JSON, as expvar.Var asks
+func (s *Stats) String() string {
+	data, _ := json.Marshal(s.Snapshot())
+	return string(data)
+}
@@ -0,0 +1,265 @@
+package probe
+
+import (
+	"errors"
+	"strings"
+)
+
+// A minimal HPACK (RFC 7541) codec: enough to send a few request headers
+// and to read the response headers of an HTTP/2 probe. Requests are encoded
+// as literals without indexing, so only the decoder keeps table state.
+
+// hpackField is a single decoded header field
+type hpackField struct {
+	Name  string
+	Value string
+}
+
+// hpackDefaultTableSize is the initial dynamic table size (SETTINGS default)
+const hpackDefaultTableSize = 4096
+
+// errHPACK is returned for malformed header blocks
+var errHPACK = errors.New("hpack: malformed header block")
+
+// hpackDecoder decodes header blocks, tracking the dynamic table
+type hpackDecoder struct {
+	dynamic []hpackField // Newest entry first
+	size    int
+	maxSize int
+}
+
+// newHPACKDecoder returns a decoder with the default dynamic table size
+func newHPACKDecoder() *hpackDecoder {
+	return &hpackDecoder{maxSize: hpackDefaultTableSize}
+}
+
+// decode parses a complete header block
+func (d *hpackDecoder) decode(block []byte) ([]hpackField, error) {
+	var fields []hpackField
+	for len(block) > 0 {
+		b := block[0]
+		switch {
+		case b&0x80 != 0: // Indexed header field
+			idx, rest, err := hpackReadInt(block, 7)
+			if err != nil {
+				return nil, err
+			}
+			field, err := d.lookup(idx)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, field)
+			block = rest
+
+		case b&0xc0 == 0x40: // Literal with incremental indexing
+			field, rest, err := d.readLiteral(block, 6)
+			if err != nil {
+				return nil, err
+			}
+			d.add(field)
+			fields = append(fields, field)
+			block = rest
+
+		case b&0xe0 == 0x20: // Dynamic table size update
+			size, rest, err := hpackReadInt(block, 5)
+			if err != nil {
+				return nil, err
+			}
+			d.maxSize = int(size)
+			d.evict()
+			block = rest
+
+		default: // Literal without indexing / never indexed
+			field, rest, err := d.readLiteral(block, 4)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, field)
+			block = rest
+		}
+	}
+	return fields, nil
+}
+
+// readLiteral reads a literal field whose name index uses prefix bits
+func (d *hpackDecoder) readLiteral(block []byte, prefix uint) (hpackField, []byte, error) {
+	idx, rest, err := hpackReadInt(block, prefix)
+	if err != nil {
+		return hpackField{}, nil, err
+	}
+
+	var field hpackField
+	if idx == 0 {
+		field.Name, rest, err = hpackReadString(rest)
+		if err != nil {
+			return hpackField{}, nil, err
+		}
+	} else {
+		named, err := d.lookup(idx)
+		if err != nil {
+			return hpackField{}, nil, err
+		}
+		field.Name = named.Name
+	}
+
+	field.Value, rest, err = hpackReadString(rest)
+	if err != nil {
+		return hpackField{}, nil, err
+	}
+	return field, rest, nil
+}
+
+// lookup resolves an index into the static or dynamic table
+func (d *hpackDecoder) lookup(idx uint64) (hpackField, error) {
+	if idx == 0 {
+		return hpackField{}, errHPACK
+	}
+	if idx <= uint64(len(hpackStaticTable)) {
+		return hpackStaticTable[idx-1], nil
+	}
+	idx -= uint64(len(hpackStaticTable)) + 1
+	if idx >= uint64(len(d.dynamic)) {
+		return hpackField{}, errHPACK
+	}
+	return d.dynamic[idx], nil
+}
+
+// add inserts a field at the front of the dynamic table
+func (d *hpackDecoder) add(field hpackField) {
+	d.dynamic = append([]hpackField{field}, d.dynamic...)
+	d.size += hpackEntrySize(field)
+	d.evict()
+}
+
+// evict drops the oldest entries until the table fits maxSize
+func (d *hpackDecoder) evict() {
+	for d.size > d.maxSize && len(d.dynamic) > 0 {
+		last := d.dynamic[len(d.dynamic)-1]
+		d.dynamic = d.dynamic[:len(d.dynamic)-1]
+		d.size -= hpackEntrySize(last)
+	}
+}
+
+// hpackEntrySize is the size an entry occupies in the dynamic table
+func hpackEntrySize(field hpackField) int {
+	return len(field.Name) + len(field.Value) + 32
+}
+
+// hpackReadInt decodes an integer with an N-bit prefix
+func hpackReadInt(block []byte, prefix uint) (uint64, []byte, error) {
+	if len(block) == 0 {
+		return 0, nil, errHPACK
+	}
+	max := uint64(1)<<prefix - 1
+	value := uint64(block[0]) & max
+	block = block[1:]
+	if value < max {
+		return value, block, nil
+	}
+
+	var shift uint
+	for len(block) > 0 {
+		b := block[0]
+		block = block[1:]
+		value += uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return value, block, nil
+		}
+		shift += 7
+		if shift > 56 {
+			break
+		}
+	}
+	return 0, nil, errHPACK
+}
+
+// hpackReadString decodes a length-prefixed, optionally Huffman-coded string
+func hpackReadString(block []byte) (string, []byte, error) {
+	if len(block) == 0 {
+		return "", nil, errHPACK
+	}
+	huffman := block[0]&0x80 != 0
+	length, rest, err := hpackReadInt(block, 7)
+	if err != nil || uint64(len(rest)) < length {
+		return "", nil, errHPACK
+	}
+
+	raw := rest[:length]
+	rest = rest[length:]
+	if !huffman {
+		return string(raw), rest, nil
+	}
+	decoded, err := huffmanDecode(raw)
+	if err != nil {
+		return "", nil, err
+	}
+	return decoded, rest, nil
+}
+
+// huffmanLookup maps (code length, code) to the byte it encodes
+var huffmanLookup = func() map[uint64]byte {
+	m := make(map[uint64]byte, len(huffmanCodes))
+	for sym, code := range huffmanCodes {
+		m[uint64(huffmanCodeLen[sym])<<32|uint64(code)] = byte(sym)
+	}
+	return m
+}()
+
+// huffmanDecode decodes an HPACK Huffman-coded string bit by bit
+func huffmanDecode(data []byte) (string, error) {
+	var out strings.Builder
+	var code uint64
+	var length uint64
+
+	for _, b := range data {
+		for bit := 7; bit >= 0; bit-- {
+			code = code<<1 | uint64(b>>uint(bit)&1)
+			length++
+			if sym, ok := huffmanLookup[length<<32|code]; ok {
+				out.WriteByte(sym)
+				code, length = 0, 0
+			} else if length >= 30 {
+				return "", errHPACK
+			}
+		}
+	}
+
+	// Padding must be fewer than 8 bits, all set (a prefix of EOS)
+	if length > 7 || code != uint64(1)<<length-1 {
+		return "", errHPACK
+	}
+	return out.String(), nil
+}
+
+// hpackEncode encodes fields as literals without indexing and without
+// Huffman coding, which every decoder must accept
+func hpackEncode(fields []hpackField) []byte {
+	var block []byte
+	for _, field := range fields {
+		block = append(block, 0x00)
+		block = hpackAppendString(block, field.Name)
+		block = hpackAppendString(block, field.Value)
+	}
+	return block
+}
+
+// hpackAppendString appends a raw (non-Huffman) string literal
+func hpackAppendString(block []byte, s string) []byte {
+	block = hpackAppendInt(block, 7, 0, uint64(len(s)))
+	return append(block, s...)
+}
+
+// hpackAppendInt appends an integer with an N-bit prefix and high flag bits
+func hpackAppendInt(block []byte, prefix uint, flags byte, value uint64) []byte {
+	max := uint64(1)<<prefix - 1
+	if value < max {
+		return append(block, flags|byte(value))
+	}
+	block = append(block, flags|byte(max))
+	value -= max
+	for value >= 0x80 {
+		block = append(block, byte(value&0x7f)|0x80)
+		value >>= 7
+	}
+	return append(block, byte(value))
+}
@@ -0,0 +1,555 @@
+package probe
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// IsHTTP checks if the service on the given host:port speaks HTTP
+// Sends a simple GET request and checks for HTTP response
+func IsHTTP(host string, port int) bool {
+	return IsHTTPContext(context.Background(), host, port)
+}
+
+// IsHTTPContext is like IsHTTP but aborts the probe when ctx is cancelled
+func IsHTTPContext(ctx context.Context, host string, port int) bool {
+	return ProbeContext(ctx, host, port).IsHTTP
+}
+
+// Protocol identifies the application protocol a probe detected
+type Protocol string
+
+const (
+	ProtocolUnknown Protocol = ""
+	ProtocolHTTP1   Protocol = "http/1" // HTTP/1.x, with or without TLS
+	ProtocolH2C     Protocol = "h2c"    // Cleartext HTTP/2 with prior knowledge
+	ProtocolH2      Protocol = "h2"     // HTTP/2 over TLS negotiated via ALPN
+	ProtocolGRPC    Protocol = "grpc"   // gRPC over h2c or h2 (see IsTLS)
+	ProtocolH3      Protocol = "h3"     // HTTP/3 over QUIC negotiated via ALPN
+)
+
+// ProbeResult contains detailed information about an HTTP probe. It
+// encodes to JSON with snake_case keys; see MarshalJSON for the format.
+type ProbeResult struct {
+	// Port is the port that was probed
+	Port int `json:"port"`
+	// Transport is "udp" for ProbeQUIC and ProbeUDP results and empty for
+	// TCP. UDP is what a UDP probe observed, since a silent UDP port may
+	// be open as well as filtered.
+	Transport string   `json:"transport,omitempty"`
+	UDP       UDPState `json:"udp_state,omitempty"`
+	// State classifies the port: closed, filtered, open but silent, open
+	// with a non-HTTP protocol, HTTP or TLS
+	State State `json:"state"`
+	// Hint is a guess from the port number at what a silent or
+	// unidentified service might be, e.g. "JVM debug port (JDWP)"
+	Hint string `json:"hint,omitempty"`
+	// Address is the host that answered, e.g. "::1" when a probe of
+	// localhost only got through over IPv6
+	Address string `json:"address,omitempty"`
+	// IsHTTP reports whether the service answered an HTTP/1.x request
+	IsHTTP bool `json:"is_http"`
+	// Response is the raw status line, kept for backward compatibility
+	Response string `json:"response,omitempty"`
+	// HTTPVersion, StatusCode and StatusText are parsed from the status
+	// line when IsHTTP is true (e.g. "HTTP/1.1", 404, "Not Found")
+	HTTPVersion string `json:"http_version,omitempty"`
+	// Method is the request method that got the answer, which is GET when
+	// a HEAD probe had to fall back
+	Method     string `json:"method,omitempty"`
+	StatusCode int    `json:"status_code,omitempty"`
+	StatusText string `json:"status_text,omitempty"`
+	// Headers holds the response headers read within the probe's byte and
+	// time limits. It may be partial if the server stalled mid-header.
+	Headers http.Header `json:"headers,omitempty"`
+	// Redirects lists each redirect hop as "<status line> -> <location>"
+	// when redirect following is enabled. Final is the probe result of the
+	// last hop that was followed.
+	Redirects []string     `json:"redirects,omitempty"`
+	Final     *ProbeResult `json:"final,omitempty"`
+	// SupportsWebSocket is set when the probe's upgrade request was answered
+	// with a valid 101 Switching Protocols
+	SupportsWebSocket bool `json:"supports_websocket,omitempty"`
+	// Protocol is the application protocol that was detected
+	Protocol Protocol `json:"protocol,omitempty"`
+	// SupportedVersions lists the HTTP versions the service speaks, by ALPN
+	// name ("http/1.1", "h2"), and KeepAlive whether it keeps HTTP/1.1
+	// connections open between requests; set when version detection is
+	// enabled, or by the HTTP/2 probes of servers that refuse HTTP/1
+	SupportedVersions []string `json:"supported_versions,omitempty"`
+	KeepAlive         bool     `json:"keep_alive,omitempty"`
+	// GRPCServices are the fully-qualified services a gRPC server lists
+	// through server reflection, e.g. "helloworld.Greeter"; empty when it
+	// doesn't offer reflection
+	GRPCServices []string `json:"grpc_services,omitempty"`
+	// Kind is the service type identified by a protocol fingerprint, and
+	// Banner any greeting or version string it sent
+	Kind   ServiceKind `json:"kind,omitempty"`
+	Banner string      `json:"banner,omitempty"`
+	// IsTLS is set when the response was obtained over a TLS connection
+	IsTLS bool `json:"is_tls,omitempty"`
+	// TLSVersion and NegotiatedProtocol describe the TLS session (ALPN
+	// protocol, empty when the server didn't pick one)
+	TLSVersion         string `json:"tls_version,omitempty"`
+	NegotiatedProtocol string `json:"negotiated_protocol,omitempty"`
+	// Cert describes the leaf certificate presented during a TLS probe
+	Cert *CertInfo `json:"cert,omitempty"`
+	// ClientCertRequired is set when a TLS server asked for a client
+	// certificate and, with none in ProbeOptions, refused the probe; Cert
+	// lists the CAs it accepts
+	ClientCertRequired bool `json:"client_cert_required,omitempty"`
+	// ConnectTime is how long the TCP connect took and TTFB the time from
+	// sending the request (or connecting, for servers that greet first) to
+	// the first response byte. Duration is the wall time of the whole
+	// probe including follow-up requests and retries.
+	ConnectTime time.Duration `json:"-"`
+	TTFB        time.Duration `json:"-"`
+	Duration    time.Duration `json:"-"`
+	// Attempts is how many times the probe ran, more than one only when a
+	// retry policy is set in ProbeOptions
+	Attempts int `json:"attempts,omitempty"`
+	// Reused is set when Recheck sent the request over a connection kept
+	// alive from an earlier one
+	Reused bool `json:"reused,omitempty"`
+	// Err is the error that ended the probe, if any. Network failures wrap
+	// ErrRefused, ErrTimeout or ErrReset. When the probe was aborted by its
+	// context, Err wraps ctx.Err() so callers can tell a cancelled probe
+	// apart from a closed port with errors.Is.
+	Err error `json:"-"`
+	// RequiresAuth is set for a 401 or 403 answer, with AuthScheme taken
+	// from WWW-Authenticate (Basic, Bearer, Digest, Negotiate). The weaker
+	// LoginRedirect means a redirect pointed at a login/signin/oauth path.
+	RequiresAuth  bool   `json:"requires_auth,omitempty"`
+	AuthScheme    string `json:"auth_scheme,omitempty"`
+	LoginRedirect bool   `json:"login_redirect,omitempty"`
+	// AllowedMethods lists the methods from the Allow header of an OPTIONS
+	// request, when method detection is enabled ("*" if any is allowed)
+	AllowedMethods []string `json:"allowed_methods,omitempty"`
+	// CORS is the answer to a CORS preflight, when the check is enabled
+	CORS *CORSInfo `json:"cors,omitempty"`
+	// DefaultVHost is set by ProbeVirtualHosts when the name got the same
+	// answer as an unknown name, i.e. the server's catch-all
+	DefaultVHost bool `json:"default_vhost,omitempty"`
+	// Title is the text of the <title> element when the response is HTML
+	Title string `json:"title,omitempty"`
+	// ContentClass labels what the response body looks like: an HTML app,
+	// a JSON API, static files or a directory listing
+	ContentClass ContentClass `json:"content_class,omitempty"`
+	// DirListing is what a directory listing shows, for ContentStaticListing
+	DirListing *DirListing `json:"dir_listing,omitempty"`
+	// Path is the request path the result answers, and PathResults the
+	// answer to each path tried, when ProbeOptions.Paths lists several.
+	// The follow-up checks ran on Path only.
+	Path        string                 `json:"path,omitempty"`
+	PathResults map[string]ProbeResult `json:"path_results,omitempty"`
+	// Authenticated is set when ProbeOptions.Credentials were sent with
+	// the request that got this HTTP answer. The cookies such an answer
+	// sets are left out of Headers.
+	Authenticated bool `json:"authenticated,omitempty"`
+	// SSE is set when the answer is a Server-Sent Events stream
+	// (text/event-stream). Such a body never ends, so it isn't read.
+	SSE bool `json:"sse,omitempty"`
+	// Framework is the web framework or server identified from headers,
+	// body markers or well-known paths, with how sure the match is
+	Framework           string     `json:"framework,omitempty"`
+	FrameworkConfidence Confidence `json:"framework_confidence,omitempty"`
+	// Auxiliary is set for an endpoint that only serves another one, such
+	// as a dev server's separate hot-module-reload port; Framework then
+	// names the dev server
+	Auxiliary Auxiliary `json:"auxiliary,omitempty"`
+
+	// FaviconHash is the Shodan-style hash of /favicon.ico, set when
+	// favicon detection is enabled and the server returned an image
+	FaviconHash int32 `json:"favicon_hash,omitempty"`
+
+	// QUIC is the result of the QUIC probe of the UDP port an Alt-Svc
+	// header advertised HTTP/3 on, when QUIC detection is enabled
+	QUIC *ProbeResult `json:"quic,omitempty"`
+
+	// APISpec is the OpenAPI or Swagger document the service publishes,
+	// when API spec detection is enabled and one was found
+	APISpec *APISpecInfo `json:"api_spec,omitempty"`
+	// GraphQL is set when one of GraphQLPaths, GraphQLPath, answered a
+	// GraphQL query (high confidence) or complained about the query (low)
+	GraphQL           bool       `json:"graphql,omitempty"`
+	GraphQLPath       string     `json:"graphql_path,omitempty"`
+	GraphQLConfidence Confidence `json:"graphql_confidence,omitempty"`
+
+	// BodySnippet is the start of the response body, at most
+	// ProbeOptions.MaxBody bytes of it read within the read deadline, with
+	// its Content-Encoding undone; every check on the body works from it.
+	// BodyTruncated is set when it doesn't hold the whole body.
+	BodySnippet   []byte `json:"-"`
+	BodyTruncated bool   `json:"body_truncated,omitempty"`
+}
+
+// Probe performs a detailed HTTP probe and returns the response status line
+func Probe(host string, port int) ProbeResult {
+	return ProbeContext(context.Background(), host, port)
+}
+
+// ProbeContext performs a detailed HTTP probe that is aborted as soon as ctx
+// is cancelled. Each phase is bounded by the earlier of the ctx deadline and
+// the default probe timeouts.
+func ProbeContext(ctx context.Context, host string, port int) ProbeResult {
+	return probeWithOptions(ctx, host, port, ProbeOptions{})
+}
+
+// ProbeWithOptions performs a detailed HTTP probe using the given timeouts
+func ProbeWithOptions(host string, port int, opts ProbeOptions) ProbeResult {
+	return probeWithOptions(context.Background(), host, port, opts)
+}
+
+// ProbeContextWithOptions probes host:port with the given options and stops
+// as soon as ctx is cancelled. The other probe functions are shorthands for
+// it.
+func ProbeContextWithOptions(ctx context.Context, host string, port int, opts ProbeOptions) ProbeResult {
+	return probeWithOptions(ctx, host, port, opts)
+}
+
+// probeWithOptions is the implementation shared by all probe entry points.
+// It tries plaintext HTTP first and falls back to HTTP over TLS when the
+// plaintext attempt looks like it hit a TLS listener. Transient failures
+// are retried according to opts.Retry. Invalid opts.Headers and
+// credentials are reported in Err without connecting.
+func probeWithOptions(ctx context.Context, host string, port int, opts ProbeOptions) ProbeResult {
+	opts = opts.withDefaults().forPort(port)
+	if err := ValidateHeaders(opts.Headers); err != nil {
+		return ProbeResult{Port: port, Err: err}
+	}
+	if err := opts.Credentials.Validate(); err != nil {
+		return ProbeResult{Port: port, Err: err}
+	}
+	if err := ValidatePaths(opts.Paths); err != nil {
+		return ProbeResult{Port: port, Err: err}
+	}
+
+	start := time.Now()
+	result := withRetry(ctx, opts.Retry, func() ProbeResult {
+		return probeAddresses(ctx, host, port, opts)
+	})
+	result.Port = port
+	result.Duration = time.Since(start)
+	if isTimeout(result.Err) {
+		// Timed out on a deadline ctx set
+		result.Err = contextError(ctx, result.Err)
+	}
+	result.Err = classifyError(result.Err)
+	result.State = classifyState(result, result.Address != "")
+	if (result.State == StateOpenSilent || result.State == StateOpenNonHTTP) && result.Kind == ServiceUnknown {
+		result.Hint = PortHint(port)
+	}
+	for path, attempt := range result.PathResults {
+		attempt.Port, attempt.Address = port, result.Address
+		attempt.Err = classifyError(attempt.Err)
+		attempt.State = classifyState(attempt, true)
+		result.PathResults[path] = attempt
+	}
+	return opts.Hooks.result(opts.authenticated(result))
+}
+
+// probeAddresses tries each address host expands to in turn until one
+// accepts the connection
+func probeAddresses(ctx context.Context, host string, port int, opts ProbeOptions) ProbeResult {
+	var result ProbeResult
+	for _, dialHost := range DialHosts(ctx, host, opts.AddressFamily) {
+		var connected bool
+		result, connected = detect(ctx, host, dialHost, port, opts)
+		if connected {
+			result.Address = dialHost
+			break
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return result
+}
+
+// detect runs the protocol detection sequence against dialHost:port. host
+// is the name the caller asked for and is used for SNI and Host headers.
+// The boolean reports whether the first connection was established.
+func detect(ctx context.Context, host, dialHost string, port int, opts ProbeOptions) (ProbeResult, bool) {
+	addr := net.JoinHostPort(dialHost, strconv.Itoa(port))
+	// A HEAD probe that has to be retried as GET shares this budget
+	deadline := time.Now().Add(opts.DialTimeout + opts.BannerTimeout + opts.WriteTimeout + opts.ReadTimeout)
+
+	first, connected := probeFirstContact(ctx, addr, port, opts)
+	if !connected {
+		return first, false
+	}
+
+	// A custom Host header is also the name to send as SNI
+	if opts.Host != "" {
+		host = hostOnly(opts.Host)
+	}
+
+	// Timings always describe the first contact, whichever follow-up
+	// probe ended up producing the result
+	result := classify(ctx, first, host, addr, deadline, opts)
+	result.ConnectTime = first.ConnectTime
+	result.TTFB = first.TTFB
+	return result, true
+}
+
+// classify picks the follow-up probes worth running after the first
+// contact and returns the most specific result
+func classify(ctx context.Context, result ProbeResult, host, addr string, deadline time.Time, opts ProbeOptions) ProbeResult {
+	// A greeting already identified the service
+	if result.Banner != "" || (result.Kind != ServiceUnknown && result.Kind != ServiceHTTP) {
+		return result
+	}
+
+	result = headFallback(ctx, result, deadline, opts, func(ctx context.Context, req request) ProbeResult {
+		fallback, _ := probePlain(ctx, addr, req, opts)
+		return fallback
+	})
+
+	if shouldTryTLS(ctx, result) {
+		tlsResult := probeTLS(ctx, addr, host, opts.probeRequest(), opts)
+		tlsResult = headFallback(ctx, tlsResult, deadline, opts, func(ctx context.Context, req request) ProbeResult {
+			return probeTLS(ctx, addr, host, req, opts)
+		})
+		if tlsResult.IsTLS && tlsResult.IsHTTP {
+			return followUp(ctx, tlsResult, host, addr, opts)
+		}
+		if tlsResult.ClientCertRequired {
+			return tlsResult
+		}
+		// gRPC and other HTTP/2-only TLS servers refuse HTTP/1.1
+		if h2Result := probeH2TLS(ctx, addr, host, opts); h2Result.IsTLS {
+			return h2Result
+		}
+		if tlsResult.IsTLS {
+			return tlsResult
+		}
+	}
+
+	// Only pay for the HTTP/2 attempt when HTTP/1.0 got nowhere
+	if shouldTryH2C(ctx, result) {
+		if h2Result := probeH2C(ctx, addr, opts); h2Result.Protocol != ProtocolUnknown {
+			return h2Result
+		}
+	}
+	if !result.IsHTTP && ctx.Err() == nil {
+		if ds := registeredDetectors(false); len(ds) > 0 {
+			if det := detectWriteFirst(ctx, addr, ds, opts); det != nil {
+				result.Kind, result.Banner = det.Kind, det.Banner
+				return result
+			}
+		}
+	}
+	return followUp(ctx, result, host, addr, opts)
+}
+
+// followUp picks the best of opts.Paths and runs the optional extra
+// requests enabled in opts against a service that answered the initial
+// probe
+func followUp(ctx context.Context, result ProbeResult, host, addr string, opts ProbeOptions) ProbeResult {
+	if !result.IsHTTP {
+		return result
+	}
+	result, opts = probePaths(ctx, result, host, addr, opts)
+
+	scheme := "http"
+	if result.IsTLS {
+		scheme = "https"
+	}
+	if opts.DetectWebSocket {
+		result.SupportsWebSocket = probeWebSocket(ctx, addr, host, result.IsTLS, opts)
+	}
+	result = followRedirects(ctx, result, scheme, addr, opts)
+	result = identifyAuth(result)
+	if opts.DetectMethods {
+		result = probeMethods(ctx, result, host, addr, opts)
+	}
+	if opts.DetectCORS {
+		result = probeCORS(ctx, result, host, addr, opts)
+	}
+	if opts.DetectVersions {
+		result = detectVersions(ctx, result, host, addr, opts)
+	}
+	result = identifyFramework(ctx, result, host, addr, opts)
+	result = identifyHMR(ctx, result, host, addr, opts)
+	if opts.DetectFavicon {
+		result = identifyFavicon(ctx, result, host, addr, opts)
+	}
+	if opts.DetectAPISpec {
+		result = detectAPISpec(ctx, result, host, addr, opts)
+		result = detectGraphQL(ctx, result, host, addr, opts)
+	}
+	if opts.DetectQUIC && result.IsTLS {
+		if port, ok := altSvcH3Port(result.Headers); ok {
+			dialHost, _, _ := net.SplitHostPort(addr)
+			// Part of this probe, whose result is reported on its own
+			quicOpts := opts
+			quicOpts.Hooks.OnResult = nil
+			quic := ProbeQUIC(ctx, dialHost, port, quicOpts)
+			result.QUIC = &quic
+		}
+	}
+	return result
+}
+
+// probeFirstContact opens the initial plaintext connection. It first
+// listens for a greeting so protocols that speak first (SSH, SMTP, FTP,
+// MySQL) are classified from their banner without being sent an HTTP
+// request; if the server stays quiet it sends the HTTP probe request.
+func probeFirstContact(ctx context.Context, addr string, port int, opts ProbeOptions) (ProbeResult, bool) {
+	conn, connectTime, err := opts.dialTimed(ctx, "tcp", addr)
+	if err != nil {
+		return ProbeResult{IsHTTP: false, Err: contextError(ctx, err)}, false
+	}
+	defer conn.Close()
+
+	result := firstContact(ctx, conn, port, opts)
+	result.ConnectTime = connectTime
+	return result, true
+}
+
+// firstContact runs the banner read and HTTP request on an established
+// connection, whatever transport it was dialed over
+func firstContact(ctx context.Context, conn net.Conn, port int, opts ProbeOptions) ProbeResult {
+	if opts.BannerTimeout > 0 {
+		start := time.Now()
+		greeting, err := readBanner(ctx, conn, opts.BannerTimeout)
+		if len(greeting) > 0 {
+			// For a greeting the first byte is the banner itself
+			conn.SetDeadline(phaseDeadline(ctx, opts.ReadTimeout))
+			result := classifyGreeting(ctx, conn, greeting, port)
+			result.TTFB = time.Since(start)
+			return result
+		}
+		if err != nil && !isTimeout(err) {
+			return ProbeResult{IsHTTP: false, Err: contextError(ctx, err)}
+		}
+	}
+
+	return exchange(ctx, conn, opts.probeRequest(), opts)
+}
+
+// fetch sends an extra request to a service the probe already identified,
+// over TLS when the service speaks it
+func fetch(ctx context.Context, addr, host string, useTLS bool, req request, opts ProbeOptions) ProbeResult {
+	if useTLS {
+		return probeTLS(ctx, addr, host, req, opts)
+	}
+	result, _ := probePlain(ctx, addr, req, opts)
+	return result
+}
+
+// probePlain sends the HTTP request over a plain TCP connection.
+// The boolean reports whether the connection was established at all.
+func probePlain(ctx context.Context, addr string, req request, opts ProbeOptions) (ProbeResult, bool) {
+	conn, err := opts.dial(ctx, "tcp", addr)
+	if err != nil {
+		return ProbeResult{IsHTTP: false, Err: contextError(ctx, err)}, false
+	}
+	defer conn.Close()
+
+	return exchange(ctx, conn, req, opts), true
+}
+
+// exchange writes the probe request to an established connection and
+// classifies the response
+func exchange(ctx context.Context, conn net.Conn, req request, opts ProbeOptions) ProbeResult {
+	return exchangeOn(ctx, conn, bufio.NewReader(conn), req, opts)
+}
+
+// exchangeOn is exchange reading the response through reader, which
+// wraps conn, so a connection kept alive can read its next response
+// through the same one
+func exchangeOn(ctx context.Context, conn net.Conn, reader *bufio.Reader, req request, opts ProbeOptions) ProbeResult {
+	// Unblock any pending read/write when the context is cancelled
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+
+	conn.SetWriteDeadline(phaseDeadline(ctx, opts.WriteTimeout))
+	start := time.Now()
+	_, err := conn.Write(req.bytes())
+	if err != nil {
+		return ProbeResult{IsHTTP: false, Err: contextError(ctx, err)}
+	}
+	addr := ""
+	if opts.Hooks.OnRequestWritten != nil || opts.Hooks.OnFirstByte != nil {
+		addr = conn.RemoteAddr().String()
+	}
+	opts.Hooks.requestWritten(addr, req)
+
+	conn.SetReadDeadline(phaseDeadline(ctx, opts.ReadTimeout))
+	var ttfb time.Duration
+	if _, err := reader.Peek(1); err == nil {
+		ttfb = time.Since(start)
+		opts.Hooks.firstByte(addr, ttfb)
+	}
+	line, err := readLimitedLine(reader, maxStatusLineBytes)
+	if errors.Is(err, errLineTooLong) {
+		// Streaming without a newline: something is there, but not HTTP
+		return ProbeResult{IsHTTP: false, Response: truncateResponse(line), TTFB: ttfb}
+	}
+	if err != nil {
+		// Keep any partial line so a server that stalls mid-line still
+		// counts as having answered
+		return ProbeResult{IsHTTP: false, Response: truncateResponse(line), TTFB: ttfb, Err: contextError(ctx, err)}
+	}
+
+	response := strings.TrimSpace(line)
+	result := ProbeResult{Response: response, TTFB: ttfb}
+
+	version, code, text, ok := parseStatusLine(response)
+	if ok {
+		result.Method = req.Method
+		result.IsHTTP = true
+		result.Protocol = ProtocolHTTP1
+		result.Kind = ServiceHTTP
+		result.HTTPVersion = version
+		result.StatusCode = code
+		result.StatusText = text
+		result.Headers = readHeaders(reader)
+		result.SSE = isEventStream(result.Headers)
+		if req.Method != "HEAD" && !result.SSE {
+			raw, cut := readBody(reader, code, result.Headers, req.MaxBody)
+			body, broken := decodeBody(raw, result.Headers)
+			result.BodySnippet, result.BodyTruncated = body, cut || broken
+		}
+		if isHTML(result.Headers) {
+			result.Title = extractTitle(result.BodySnippet)
+		}
+		result.ContentClass = classifyContent(result.Headers, result.BodySnippet)
+		if result.ContentClass == ContentStaticListing {
+			result.DirListing = parseDirListing(result.Title, result.BodySnippet, result.BodyTruncated)
+		}
+	}
+	return result
+}
+
+// phaseDeadline returns now+timeout, capped by the context deadline
+func phaseDeadline(ctx context.Context, timeout time.Duration) time.Time {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	return deadline
+}
+
+// contextError prefers the context's error over the network error it caused,
+// so a cancelled probe doesn't look like a timeout or a refused connection.
+// A deadline taken from ctx can expire before ctx notices, so a timeout
+// past ctx's deadline counts as ctx's too.
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) && isTimeout(err) {
+		return context.DeadlineExceeded
+	}
+	return err
+}
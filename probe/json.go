@@ -0,0 +1,124 @@
+package probe
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// probeResultJSON carries the fields of ProbeResult whose default encoding
+// isn't useful: durations become fractional milliseconds and Err its
+// message
+type probeResultJSON struct {
+	ConnectMS  float64 `json:"connect_ms,omitempty"`
+	TTFBMS     float64 `json:"ttfb_ms,omitempty"`
+	DurationMS float64 `json:"duration_ms,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// plainProbeResult has ProbeResult's fields without its methods, so the
+// JSON methods below don't recurse
+type plainProbeResult ProbeResult
+
+// MarshalJSON encodes the result with snake_case field names. Durations are
+// rendered as milliseconds (connect_ms, ttfb_ms, duration_ms, with
+// microsecond precision), enums as their lowercase string values, and Err
+// as its message in "error". Empty optional fields are omitted.
+func (r ProbeResult) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		plainProbeResult
+		probeResultJSON
+	}{
+		plainProbeResult: plainProbeResult(r),
+		probeResultJSON: probeResultJSON{
+			ConnectMS:  durationMS(r.ConnectTime),
+			TTFBMS:     durationMS(r.TTFB),
+			DurationMS: durationMS(r.Duration),
+			Error:      errorString(r.Err),
+		},
+	})
+}
+
+// UnmarshalJSON decodes the format written by MarshalJSON. The error
+// message is restored as a plain error; its type does not survive, so
+// use State rather than errors.Is on decoded results.
+func (r *ProbeResult) UnmarshalJSON(data []byte) error {
+	var decoded struct {
+		plainProbeResult
+		probeResultJSON
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	*r = ProbeResult(decoded.plainProbeResult)
+	r.ConnectTime = msDuration(decoded.ConnectMS)
+	r.TTFB = msDuration(decoded.TTFBMS)
+	r.Duration = msDuration(decoded.DurationMS)
+	if decoded.Error != "" {
+		r.Err = errors.New(decoded.Error)
+	}
+	return nil
+}
+
+// String returns a one-line summary such as
+// "3000/tcp http 200 OK Vite 12ms"
+func (r ProbeResult) String() string {
+	transport := r.Transport
+	if transport == "" {
+		transport = "tcp"
+	}
+	parts := []string{fmt.Sprintf("%d/%s", r.Port, transport)}
+	if r.Port == 0 && r.Address != "" {
+		parts[0] = r.Address // Unix socket
+	}
+
+	state := string(r.State)
+	if state == "" {
+		state = "unknown"
+	}
+	parts = append(parts, state)
+
+	switch {
+	case r.StatusCode != 0:
+		parts = append(parts, strings.TrimSpace(fmt.Sprintf("%d %s", r.StatusCode, r.StatusText)))
+	case r.ClientCertRequired:
+		parts = append(parts, "client-cert-required")
+	case r.Protocol != ProtocolUnknown && r.Protocol != ProtocolHTTP1:
+		parts = append(parts, string(r.Protocol))
+	case r.Kind != ServiceUnknown && r.Kind != ServiceHTTP:
+		parts = append(parts, string(r.Kind))
+	}
+	if r.Framework != "" {
+		parts = append(parts, r.Framework)
+	}
+	if r.Hint != "" {
+		parts = append(parts, "["+r.Hint+"?]")
+	}
+	if r.Duration >= time.Millisecond {
+		parts = append(parts, r.Duration.Round(time.Millisecond).String())
+	} else if r.Duration > 0 {
+		parts = append(parts, r.Duration.Round(time.Microsecond).String())
+	}
+	return strings.Join(parts, " ")
+}
+
+// durationMS converts d to milliseconds, rounded to the microsecond
+func durationMS(d time.Duration) float64 {
+	return math.Round(float64(d)/float64(time.Microsecond)) / 1000
+}
+
+// msDuration converts milliseconds back to a duration
+func msDuration(ms float64) time.Duration {
+	return time.Duration(math.Round(ms * float64(time.Millisecond)))
+}
+
+// errorString returns err's message, or "" for nil
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,142 @@
+package probe
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sampleResult is an HTTPS answer with most optional fields set
+func sampleResult() ProbeResult {
+	final := ProbeResult{Port: 3000, State: StateHTTP, IsHTTP: true, StatusCode: 200, StatusText: "OK", Protocol: ProtocolHTTP1, Kind: ServiceHTTP}
+	return ProbeResult{
+		Port: 5173, State: StateTLS, Address: "127.0.0.1", IsHTTP: true, IsTLS: true,
+		Response: "HTTP/1.1 302 Found", HTTPVersion: "HTTP/1.1", Method: "GET",
+		StatusCode: 302, StatusText: "Found",
+		Headers:   http.Header{"Location": {"http://localhost:3000/"}, "Server": {"vite"}},
+		Redirects: []string{"http://localhost:3000/"}, Final: &final,
+		Protocol: ProtocolHTTP1, SupportedVersions: []string{"http/1.1", "h2"}, KeepAlive: true,
+		Kind: ServiceHTTP, TLSVersion: "TLS 1.3", NegotiatedProtocol: "http/1.1",
+		Cert: &CertInfo{
+			Subject: "localhost", DNSNames: []string{"localhost"}, Issuer: "mkcert",
+			NotBefore: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), NotAfter: time.Date(2028, 1, 1, 0, 0, 0, 0, time.UTC),
+			Fingerprint: "ab12", Trusted: true,
+		},
+		ConnectTime: 150 * time.Microsecond, TTFB: 12345 * time.Microsecond, Duration: 20 * time.Millisecond,
+		Attempts: 2, Title: "Vite App", Framework: "vite", FrameworkConfidence: ConfidenceHigh,
+		FaviconHash: 1790006171, Path: "/",
+		PathResults: map[string]ProbeResult{"/health": {Port: 5173, State: StateHTTP, IsHTTP: true, StatusCode: 204, Duration: time.Millisecond}},
+		Err:         errors.New("something went wrong"),
+	}
+}
+
+func TestProbeResultJSONRoundTrip(t *testing.T) {
+	tests := map[string]ProbeResult{
+		"zero":   {},
+		"closed": {Port: 3000, State: StateClosed, Err: fmt.Errorf("%w: dial tcp: connect: connection refused", ErrRefused), Duration: 300 * time.Microsecond},
+		"banner": {Port: 22, State: StateOpenNonHTTP, Address: "::1", Kind: ServiceSSH, Banner: "SSH-2.0-OpenSSH_9.6", TTFB: time.Millisecond},
+		"HTTPS":  sampleResult(),
+	}
+	for name, want := range tests {
+		t.Run(name, func(t *testing.T) {
+			data, err := json.Marshal(want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got ProbeResult
+			if err := json.Unmarshal(data, &got); err != nil {
+				t.Fatalf("Unmarshal(%s): %v", data, err)
+			}
+			if again, _ := json.Marshal(got); string(again) != string(data) {
+				t.Errorf("encoded again as\n%s\nwant\n%s", again, data)
+			}
+			// Only the message of Err survives
+			if errorString(got.Err) != errorString(want.Err) {
+				t.Errorf("Err %v, want %v", got.Err, want.Err)
+			}
+			got.Err, want.Err = nil, nil
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("round trip of %s\ngot  %+v\nwant %+v", data, got, want)
+			}
+		})
+	}
+}
+
+func TestProbeResultJSONFields(t *testing.T) {
+	data, err := json.Marshal(sampleResult())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"port":        `5173`,
+		"state":       `"tls"`,
+		"protocol":    `"http/1"`,
+		"kind":        `"http"`,
+		"connect_ms":  `0.15`,
+		"ttfb_ms":     `12.345`,
+		"duration_ms": `20`,
+		"error":       `"something went wrong"`,
+		"is_http":     `true`,
+	}
+	for key, value := range want {
+		if got := string(fields[key]); got != value {
+			t.Errorf("%s = %s, want %s", key, got, value)
+		}
+	}
+	for _, key := range []string{"ConnectTime", "TTFB", "Duration", "Err", "BodySnippet"} {
+		if _, ok := fields[key]; ok {
+			t.Errorf("%s is encoded under its Go name", key)
+		}
+	}
+
+	// Optional fields are omitted, the classification isn't
+	data, _ = json.Marshal(ProbeResult{Port: 3000, State: StateClosed})
+	if string(data) != `{"port":3000,"state":"closed","is_http":false}` {
+		t.Errorf("closed port encoded as %s", data)
+	}
+}
+
+func TestStateJSON(t *testing.T) {
+	for _, state := range []State{StateUnknown, StateClosed, StateFiltered, StateOpenSilent, StateOpenNonHTTP, StateHTTP, StateTLS} {
+		data, err := json.Marshal(state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := `"` + string(state) + `"`; string(data) != want || strings.ToLower(want) != want {
+			t.Errorf("%q encoded as %s, want a lowercase string", state, data)
+		}
+		var got State
+		if err := json.Unmarshal(data, &got); err != nil || got != state {
+			t.Errorf("%s decoded as %q, %v", data, got, err)
+		}
+	}
+}
+
+func TestProbeResultString(t *testing.T) {
+	tests := []struct {
+		result ProbeResult
+		want   string
+	}{
+		{ProbeResult{Port: 3000, State: StateHTTP, StatusCode: 200, StatusText: "OK", Framework: "vite", Duration: 12 * time.Millisecond}, "3000/tcp http 200 OK vite 12ms"},
+		{ProbeResult{Port: 22, State: StateOpenNonHTTP, Kind: ServiceSSH, Duration: 450 * time.Microsecond}, "22/tcp open-non-http ssh 450µs"},
+		{ProbeResult{Port: 50051, State: StateHTTP, Protocol: ProtocolGRPC}, "50051/tcp http grpc"},
+		{ProbeResult{Port: 9229, State: StateOpenSilent, Hint: "Node.js inspector"}, "9229/tcp open-silent [Node.js inspector?]"},
+		{ProbeResult{Port: 443, State: StateTLS, ClientCertRequired: true}, "443/tcp tls client-cert-required"},
+		{ProbeResult{Port: 5353, Transport: "udp"}, "5353/udp unknown"},
+		{ProbeResult{Address: "/run/app.sock", State: StateHTTP, StatusCode: 404}, "/run/app.sock http 404"},
+	}
+	for _, tt := range tests {
+		if got := tt.result.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+}
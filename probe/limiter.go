@@ -0,0 +1,185 @@
+package probe
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Limiter throttles the connections made by probes and scans. It combines
+// a token bucket bounding new dials per second with a cap on connections
+// open at the same time. One Limiter is meant to be shared by every worker
+// of a batch, through ProbeOptions.Limiter. It is safe for concurrent use.
+type Limiter struct {
+	rate  float64       // Tokens added per second; 0 means unlimited
+	burst float64       // Bucket capacity
+	slots chan struct{} // In-flight connection slots; nil means unlimited
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+
+	dials     atomic.Int64
+	throttled atomic.Int64 // Nanoseconds spent waiting
+}
+
+// LimiterStats are the counters a Limiter has accumulated
+type LimiterStats struct {
+	Dials     int64         // Dials attempted through the limiter
+	Throttled time.Duration // Total time dials spent waiting for the limiter
+}
+
+// NewLimiter returns a limiter allowing dialsPerSecond new connections per
+// second (bursting up to one second's worth) and at most maxInFlight open
+// connections. A value <= 0 leaves that dimension unlimited.
+func NewLimiter(dialsPerSecond float64, maxInFlight int) *Limiter {
+	l := &Limiter{rate: dialsPerSecond, last: time.Now()}
+	if dialsPerSecond > 0 {
+		l.burst = max(1, dialsPerSecond)
+		l.tokens = l.burst
+	}
+	if maxInFlight > 0 {
+		l.slots = make(chan struct{}, maxInFlight)
+	}
+	return l
+}
+
+// Stats returns the limiter's counters
+func (l *Limiter) Stats() LimiterStats {
+	return LimiterStats{
+		Dials:     l.dials.Load(),
+		Throttled: time.Duration(l.throttled.Load()),
+	}
+}
+
+// acquire waits for a dial token and an in-flight slot. The returned
+// release function frees the slot and must be called exactly once, when
+// the connection is closed or the dial failed. Waiting stops with the
+// context's error as soon as ctx is done.
+func (l *Limiter) acquire(ctx context.Context) (release func(), err error) {
+	start := time.Now()
+	defer func() {
+		l.throttled.Add(int64(time.Since(start)))
+	}()
+
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	release = func() {
+		if l.slots != nil {
+			<-l.slots
+		}
+	}
+
+	if err := l.waitToken(ctx); err != nil {
+		release()
+		return nil, err
+	}
+	l.dials.Add(1)
+	return release, nil
+}
+
+// waitToken takes one token from the bucket, sleeping until one is
+// available
+func (l *Limiter) waitToken(ctx context.Context) error {
+	if l.rate <= 0 {
+		return nil
+	}
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+		l.last = now
+		if l.tokens >= 1 {
+			l.tokens--
+			l.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+		l.mu.Unlock()
+
+		if !sleepContext(ctx, wait) {
+			return ctx.Err()
+		}
+	}
+}
+
+// limitedConn releases its limiter slot when closed
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// Dial connects to address on the named network, first waiting for the
+// limiter. The connection holds an in-flight slot until it is closed. A
+// nil Limiter dials immediately.
+func (l *Limiter) Dial(ctx context.Context, dialer Dialer, network, address string) (net.Conn, error) {
+	conn, _, err := l.dialTimed(ctx, dialer, network, address)
+	return conn, err
+}
+
+// dialTimed is Dial that also reports how long the dial itself took, not
+// counting time spent waiting for the limiter
+func (l *Limiter) dialTimed(ctx context.Context, dialer Dialer, network, address string) (net.Conn, time.Duration, error) {
+	release := func() {}
+	if l != nil {
+		var err error
+		if release, err = l.acquire(ctx); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	start := time.Now()
+	conn, err := dialer.DialContext(ctx, network, address)
+	elapsed := time.Since(start)
+	if err != nil {
+		release()
+		return nil, elapsed, err
+	}
+	if l == nil {
+		return conn, elapsed, nil
+	}
+	return &limitedConn{Conn: conn, release: release}, elapsed, nil
+}
+
+// dial opens a probe connection with opts.Dialer, honouring opts.Limiter
+func (o ProbeOptions) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, _, err := o.dialTimed(ctx, network, address)
+	return conn, err
+}
+
+// dialTimed is dial that also reports the duration of the connect itself
+func (o ProbeOptions) dialTimed(ctx context.Context, network, address string) (net.Conn, time.Duration, error) {
+	return o.Limiter.dialTimed(ctx, hookedDialer{o.dialer(), o.Hooks}, network, address)
+}
+
+// hookedDialer calls the dial hooks around each dial, so they see the
+// connect itself and not the wait for the limiter
+type hookedDialer struct {
+	dialer Dialer
+	hooks  Hooks
+}
+
+func (d hookedDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if d.hooks.OnDialStart == nil && d.hooks.OnDialDone == nil {
+		return d.dialer.DialContext(ctx, network, address)
+	}
+	d.hooks.dialStart(network, address)
+	start := time.Now()
+	conn, err := d.dialer.DialContext(ctx, network, address)
+	d.hooks.dialDone(network, address, err, time.Since(start))
+	return conn, err
+}
@@ -0,0 +1,44 @@
+package probe
+
+import (
+	"context"
+	"strings"
+)
+
+// probeMethods asks the service which methods opts.Path supports with an
+// OPTIONS request and records the Allow header. A 405 still counts when it
+// carries Allow, since RFC 9110 requires it there; "Allow: *" is kept as
+// the single entry "*".
+func probeMethods(ctx context.Context, result ProbeResult, host, addr string, opts ProbeOptions) ProbeResult {
+	if ctx.Err() != nil {
+		return result
+	}
+
+	resp := fetch(ctx, addr, host, result.IsTLS, opts.request(opts.Path).method("OPTIONS"), opts)
+	if !resp.IsHTTP {
+		return result
+	}
+	result.AllowedMethods = parseAllow(resp.Headers.Values("Allow"))
+	return result
+}
+
+// parseAllow splits Allow header values into upper-case method names,
+// dropping duplicates and empty entries
+func parseAllow(values []string) []string {
+	var methods []string
+	seen := make(map[string]bool)
+	for _, value := range values {
+		for _, method := range strings.Split(value, ",") {
+			method = strings.ToUpper(strings.TrimSpace(method))
+			if method == "" || seen[method] {
+				continue
+			}
+			if method == "*" {
+				return []string{"*"}
+			}
+			seen[method] = true
+			methods = append(methods, method)
+		}
+	}
+	return methods
+}
@@ -0,0 +1,188 @@
+package probe
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// APISpecInfo describes an OpenAPI or Swagger document a service publishes
+type APISpecInfo struct {
+	URL  string `json:"url"`  // Where the document was fetched
+	Path string `json:"path"` // URL's path, for building links through a proxy
+	// UIPath is the Swagger UI or ReDoc page that pointed at the document,
+	// when it was found that way
+	UIPath string `json:"ui_path,omitempty"`
+	// SpecVersion is the "openapi" or "swagger" field, e.g. "3.1.0" or
+	// "2.0"; Title and Version come from "info"
+	SpecVersion string `json:"spec_version"`
+	Title       string `json:"title,omitempty"`
+	Version     string `json:"version,omitempty"`
+}
+
+// APISpecPaths are requested, in order, until one holds an API document.
+// JSON documents come first; the UI pages are read for the document URL
+// they load.
+var APISpecPaths = []string{
+	"/openapi.json",
+	"/swagger.json",
+	"/v3/api-docs",
+	"/docs",
+	"/swagger-ui",
+}
+
+// maxAPISpecBytes caps a document download. Only the top-level fields at
+// its start are read, so a truncated document is still useful.
+const maxAPISpecBytes = 64 << 10
+
+// specURLPattern finds the document a Swagger UI (url: "...") or ReDoc
+// (spec-url="...") page loads
+var specURLPattern = regexp.MustCompile(`(?:\burl\s*:\s*|spec-url\s*=\s*)["']([^"']+)["']`)
+
+// detectAPISpec requests APISpecPaths and records the first API document
+// found. The requests share one budget, room for two full requests, so a
+// slow server costs little more than a fast one.
+func detectAPISpec(ctx context.Context, result ProbeResult, host, addr string, opts ProbeOptions) ProbeResult {
+	if isFileServer(result) || result.Auxiliary != AuxiliaryNone {
+		return result
+	}
+	ctx, cancel := context.WithTimeout(ctx, 2*(opts.DialTimeout+opts.ReadTimeout))
+	defer cancel()
+
+	tried := make(map[string]bool, len(APISpecPaths))
+	for _, path := range APISpecPaths {
+		if ctx.Err() != nil {
+			break
+		}
+		tried[path] = true
+		resp := fetchAPISpec(ctx, result, host, addr, path, opts)
+		if resp.StatusCode != http.StatusOK {
+			continue
+		}
+		if info, ok := parseAPISpec(resp.BodySnippet); ok {
+			result.APISpec = apiSpecInfo(info, result.IsTLS, host, addr, path)
+			break
+		}
+
+		// A documentation page: follow it to the document it loads
+		m := specURLPattern.FindSubmatch(resp.BodySnippet)
+		if m == nil {
+			continue
+		}
+		specPath, ok := localPath(string(m[1]), path)
+		if !ok || tried[specPath] {
+			continue
+		}
+		tried[specPath] = true
+		spec := fetchAPISpec(ctx, result, host, addr, specPath, opts)
+		if info, ok := parseAPISpec(spec.BodySnippet); ok && spec.StatusCode == http.StatusOK {
+			result.APISpec = apiSpecInfo(info, result.IsTLS, host, addr, specPath)
+			result.APISpec.UIPath = path
+			break
+		}
+	}
+	return result
+}
+
+// isFileServer reports whether the root is a directory listing, whose
+// server has no API to look for
+func isFileServer(result ProbeResult) bool {
+	return result.StatusCode == http.StatusOK && isDirectoryListing(bytes.ToLower(result.BodySnippet))
+}
+
+// fetchAPISpec requests path with room for the start of a document
+func fetchAPISpec(ctx context.Context, result ProbeResult, host, addr, path string, opts ProbeOptions) ProbeResult {
+	req := opts.request(path).with("Accept", "application/json, text/html;q=0.9")
+	req.MaxBody = maxAPISpecBytes
+	return fetch(ctx, addr, host, result.IsTLS, req, opts)
+}
+
+// apiSpecInfo completes info with the document's location on host, at the
+// port of addr
+func apiSpecInfo(info APISpecInfo, useTLS bool, host, addr, path string) *APISpecInfo {
+	scheme := "http"
+	if useTLS {
+		scheme = "https"
+	}
+	_, port, _ := net.SplitHostPort(addr)
+	info.Path = path
+	info.URL = scheme + "://" + net.JoinHostPort(host, port) + path
+	return &info
+}
+
+// parseAPISpec reads the top-level "openapi" or "swagger" and "info"
+// fields of a JSON document, stopping as soon as it has them so the rest,
+// possibly truncated, is never decoded. Anything without one of the two
+// version fields isn't an API document.
+func parseAPISpec(body []byte) (APISpecInfo, bool) {
+	var info APISpecInfo
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 || body[0] != '{' {
+		return info, false
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if _, err := dec.Token(); err != nil {
+		return info, false
+	}
+	seenInfo := false
+	for dec.More() && (info.SpecVersion == "" || !seenInfo) {
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+		key, _ := tok.(string)
+		switch key {
+		case "openapi", "swagger":
+			var version string
+			if err := dec.Decode(&version); err != nil {
+				return info, false
+			}
+			info.SpecVersion = version
+		case "info":
+			var fields struct {
+				Title   string `json:"title"`
+				Version string `json:"version"`
+			}
+			if err := dec.Decode(&fields); err != nil {
+				return info, info.SpecVersion != ""
+			}
+			info.Title, info.Version = fields.Title, fields.Version
+			seenInfo = true
+		default:
+			var skipped json.RawMessage
+			if err := dec.Decode(&skipped); err != nil {
+				return info, info.SpecVersion != ""
+			}
+		}
+	}
+	return info, info.SpecVersion != ""
+}
+
+// localPath resolves a document URL found in a page at base to a path on
+// the same server. Absolute URLs are accepted only for loopback hosts.
+func localPath(ref, base string) (string, bool) {
+	switch {
+	case strings.HasPrefix(ref, "/") && !strings.HasPrefix(ref, "//"):
+		return ref, true
+	case strings.HasPrefix(ref, "http://"), strings.HasPrefix(ref, "https://"):
+		_, rest, _ := strings.Cut(ref, "://")
+		hostPort, path, _ := strings.Cut(rest, "/")
+		hostname := hostPort
+		if h, _, err := net.SplitHostPort(hostPort); err == nil {
+			hostname = h
+		}
+		if !isLoopbackHost(strings.Trim(hostname, "[]")) {
+			return "", false
+		}
+		return "/" + path, true
+	case strings.Contains(ref, ":") || strings.HasPrefix(ref, "//"):
+		return "", false
+	}
+	// Relative to the page, e.g. "./swagger.json" from /swagger-ui/
+	dir := base[:strings.LastIndex(base, "/")+1]
+	return dir + strings.TrimPrefix(ref, "./"), true
+}
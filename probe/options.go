@@ -0,0 +1,206 @@
+package probe
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"time"
+)
+
+// Default timeouts used when the corresponding ProbeOptions field is zero
+const (
+	DefaultDialTimeout  = 500 * time.Millisecond
+	DefaultReadTimeout  = 500 * time.Millisecond
+	DefaultWriteTimeout = 500 * time.Millisecond
+	DefaultMaxRedirects = 3
+	DefaultConcurrency  = 64
+	DefaultMaxBody      = 32 << 10
+
+	// DefaultBannerTimeout is how long the probe listens for a server
+	// greeting (SSH, SMTP, FTP, MySQL) before sending its HTTP request
+	DefaultBannerTimeout = 200 * time.Millisecond
+)
+
+// ProbeOptions tunes how a probe is performed.
+// The zero value matches the behavior of Probe.
+type ProbeOptions struct {
+	DialTimeout  time.Duration // Time allowed to establish the TCP connection
+	ReadTimeout  time.Duration // Time allowed to read the response after the request is sent
+	WriteTimeout time.Duration // Time allowed to send the request
+
+	// Path is the request path of the probe (default "/"). Host replaces
+	// the default "localhost" Host header and switches the request to
+	// HTTP/1.1 with Connection: close, for virtual-host routed services.
+	Path string
+	Host string
+
+	// Paths, when set, replaces Path with candidate paths tried in order,
+	// e.g. "/", "/health", "/api", for services with nothing at the root.
+	// The probe returns the best answer, 2xx before 3xx before 4xx before
+	// 5xx and a titled HTML page before an empty body, runs its follow-up
+	// checks on it, and keeps every answer in ProbeResult.PathResults.
+	// See ValidatePaths for what is refused.
+	Paths []string
+
+	// Headers are added to every HTTP/1 request of the probe, after Host
+	// and in name order, for services that turn away requests without an
+	// API key or X-Forwarded-Proto. See ValidateHeaders for what is refused.
+	Headers map[string]string
+
+	// Credentials are sent with every HTTP/1 request of the probe, for
+	// services that bounce anonymous requests to a login page; they
+	// replace any Authorization or Cookie in Headers, and are not sent
+	// when a redirect leads to another port. CredentialsFor, when set,
+	// picks them for each port instead, for batches such as ProbeMany.
+	// Answers to them are marked ProbeResult.Authenticated.
+	Credentials    *Credentials
+	CredentialsFor func(port int) *Credentials
+
+	// MaxBody is how many bytes of a response body the probe reads for the
+	// title and fingerprinting, default DefaultMaxBody. Compressed bodies
+	// count as sent and are decoded after.
+	MaxBody int
+
+	// Method is the method of the main probe request: GET (the default) or
+	// HEAD to skip the body. A HEAD answered with 405/501, or with a closed
+	// connection, is retried as GET within the same time budget.
+	Method string
+
+	// BannerTimeout is the passive-read window before the HTTP request is
+	// written. Zero uses DefaultBannerTimeout; negative skips the phase.
+	BannerTimeout time.Duration
+
+	// AddressFamily limits the probe to IPv4 or IPv6. With the default
+	// AddressAny, "localhost" is tried as 127.0.0.1 and then ::1.
+	AddressFamily AddressFamily
+
+	// Retry re-runs the probe while the service looks like it is still
+	// starting up. The zero value makes a single attempt.
+	Retry RetryPolicy
+
+	// Limiter, when set, throttles every connection the probe opens. Share
+	// one Limiter across a batch to bound its dial rate and open sockets.
+	Limiter *Limiter
+
+	// Dialer opens every connection of the probe; nil uses a net.Dialer.
+	// DialTimeout still applies to each dial.
+	Dialer Dialer
+
+	// ClientCert is presented to TLS servers that ask for a client
+	// certificate, so the probe gets through to HTTP on mTLS services.
+	// Without it such servers are reported with ClientCertRequired.
+	ClientCert *tls.Certificate
+
+	// Roots are trusted besides the system's roots when checking who
+	// issued a TLS service's certificate, such as the local CA's root;
+	// see CertInfo.Trusted
+	Roots *x509.CertPool
+
+	// Adaptive, for probes run by a Cache, gives each port a read timeout
+	// of three times its average time to first byte in the probes the
+	// cache ran before, kept between AdaptiveFloor and AdaptiveCeiling
+	// (default DefaultAdaptiveFloor and DefaultAdaptiveCeiling). A port
+	// with no answer on record gets ReadTimeout, or more if the ports
+	// seen so far are slow.
+	Adaptive        bool
+	AdaptiveFloor   time.Duration
+	AdaptiveCeiling time.Duration
+
+	// Hooks are called as the probe dials, sends requests and returns
+	// results; see Hooks
+	Hooks Hooks
+
+	// Concurrency bounds the number of simultaneous probes run by ProbeMany
+	Concurrency int
+
+	// FollowRedirects makes the probe follow 3xx responses to other
+	// loopback addresses, up to MaxRedirects hops (default 3).
+	FollowRedirects bool
+	MaxRedirects    int
+
+	// FrameworkPaths requests the well-known paths in the framework
+	// fingerprint table when headers and body were not conclusive
+	FrameworkPaths bool
+
+	// DetectFavicon fetches /favicon.ico after a successful HTTP probe and
+	// matches its hash against FaviconFingerprints
+	DetectFavicon bool
+
+	// DetectMethods sends an OPTIONS request for Path and records the
+	// Allow header. It costs one extra request per HTTP service.
+	DetectMethods bool
+
+	// DetectVersions records the HTTP versions a service supports and
+	// whether it allows keep-alive, for choosing how to talk to it. It
+	// costs one extra request, and a TLS handshake for HTTPS services.
+	DetectVersions bool
+
+	// DetectCORS sends a CORS preflight for Path from CORSOrigin (default
+	// DefaultCORSOrigin) and records the result in ProbeResult.CORS
+	DetectCORS bool
+	CORSOrigin string
+
+	// DetectWebSocket sends a second request asking to upgrade to a
+	// WebSocket on WebSocketPath (default "/")
+	DetectWebSocket bool
+	WebSocketPath   string
+
+	// DetectQUIC runs ProbeQUIC against the UDP port an HTTPS answer's
+	// Alt-Svc header advertises HTTP/3 on, recording it in ProbeResult.QUIC
+	DetectQUIC bool
+
+	// DetectAPISpec requests APISpecPaths after a successful HTTP probe and
+	// records the first OpenAPI or Swagger document in ProbeResult.APISpec,
+	// then queries GraphQLPaths for a GraphQL endpoint. It costs up to a
+	// dozen requests per service.
+	DetectAPISpec bool
+}
+
+// withDefaults returns a copy of the options with zero fields filled in
+func (o ProbeOptions) withDefaults() ProbeOptions {
+	if o.DialTimeout <= 0 {
+		o.DialTimeout = DefaultDialTimeout
+	}
+	if o.ReadTimeout <= 0 {
+		o.ReadTimeout = DefaultReadTimeout
+	}
+	if o.WriteTimeout <= 0 {
+		o.WriteTimeout = DefaultWriteTimeout
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = DefaultConcurrency
+	}
+	if o.BannerTimeout == 0 {
+		o.BannerTimeout = DefaultBannerTimeout
+	}
+	if len(o.Paths) > 0 {
+		o.Path = o.Paths[0]
+	}
+	if o.Path == "" {
+		o.Path = "/"
+	}
+	if o.WebSocketPath == "" {
+		o.WebSocketPath = "/"
+	}
+	if o.MaxBody <= 0 {
+		o.MaxBody = DefaultMaxBody
+	}
+	if o.MaxRedirects <= 0 {
+		o.MaxRedirects = DefaultMaxRedirects
+	}
+	if o.AdaptiveFloor <= 0 {
+		o.AdaptiveFloor = DefaultAdaptiveFloor
+	}
+	if o.AdaptiveCeiling <= 0 {
+		o.AdaptiveCeiling = DefaultAdaptiveCeiling
+	}
+	return o
+}
+
+// forPort returns the options for probing port, with the credentials
+// CredentialsFor picks for it
+func (o ProbeOptions) forPort(port int) ProbeOptions {
+	if o.CredentialsFor != nil {
+		o.Credentials, o.CredentialsFor = o.CredentialsFor(port), nil
+	}
+	return o
+}
@@ -0,0 +1,75 @@
+package probe
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// serverPort returns the port an httptest server listens on
+func serverPort(t testing.TB, srv *httptest.Server) int {
+	t.Helper()
+	_, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+// slowServer answers every request after delay, like a dev server
+// compiling on its first request
+func slowServer(t testing.TB, delay time.Duration) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		w.Write([]byte("<title>compiled</title>"))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestWithDefaults(t *testing.T) {
+	o := ProbeOptions{}.withDefaults()
+	if o.DialTimeout != DefaultDialTimeout || o.ReadTimeout != DefaultReadTimeout || o.WriteTimeout != DefaultWriteTimeout {
+		t.Errorf("timeouts %v, %v, %v; want the defaults", o.DialTimeout, o.ReadTimeout, o.WriteTimeout)
+	}
+	if o.BannerTimeout != DefaultBannerTimeout || o.Path != "/" || o.MaxBody != DefaultMaxBody || o.Concurrency != DefaultConcurrency {
+		t.Errorf("defaults %+v", o)
+	}
+
+	o = ProbeOptions{DialTimeout: time.Second, ReadTimeout: 2 * time.Second, WriteTimeout: 3 * time.Second, BannerTimeout: -1}.withDefaults()
+	if o.DialTimeout != time.Second || o.ReadTimeout != 2*time.Second || o.WriteTimeout != 3*time.Second {
+		t.Errorf("timeouts %v, %v, %v; want those given", o.DialTimeout, o.ReadTimeout, o.WriteTimeout)
+	}
+	if o.BannerTimeout != -1 {
+		t.Errorf("BannerTimeout %v, want the banner phase skipped", o.BannerTimeout)
+	}
+	if o = (ProbeOptions{Paths: []string{"/health", "/"}}).withDefaults(); o.Path != "/health" {
+		t.Errorf("Path %q, want the first of Paths", o.Path)
+	}
+}
+
+func TestSlowServerNeedsLargerReadTimeout(t *testing.T) {
+	srv := slowServer(t, 800*time.Millisecond)
+	port := serverPort(t, srv)
+
+	result := ProbeWithOptions("127.0.0.1", port, ProbeOptions{})
+	if result.IsHTTP {
+		t.Fatalf("answered within the default %v read timeout: %+v", DefaultReadTimeout, result)
+	}
+	if result.State != StateOpenSilent {
+		t.Errorf("State %q with the default timeout, want %q", result.State, StateOpenSilent)
+	}
+
+	result = ProbeWithOptions("127.0.0.1", port, ProbeOptions{ReadTimeout: 2 * time.Second})
+	if !result.IsHTTP || result.StatusCode != http.StatusOK || result.State != StateHTTP {
+		t.Errorf("with a 2s read timeout got %+v, want HTTP 200", result)
+	}
+	if result.Title != "compiled" {
+		t.Errorf("Title %q, want the slow page's", result.Title)
+	}
+}
@@ -0,0 +1,101 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrInvalidPath is returned for a probe path that isn't an absolute
+// request target
+var ErrInvalidPath = errors.New("invalid path")
+
+// ValidatePaths checks candidate probe paths: each must start with "/"
+// and contain no spaces or control characters, which would break or
+// inject into the request line.
+func ValidatePaths(paths []string) error {
+	for _, path := range paths {
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("%w %q: must start with /", ErrInvalidPath, path)
+		}
+		if strings.IndexFunc(path, func(r rune) bool { return r <= ' ' || r == 0x7f }) >= 0 {
+			return fmt.Errorf("%w %q: contains a space or control character", ErrInvalidPath, path)
+		}
+	}
+	return nil
+}
+
+// probePaths requests the rest of opts.Paths from a service that answered
+// the first, and returns the best answer, with every answer in its
+// PathResults, and opts with Path set to the winning path for the
+// follow-up requests. The extra requests share one budget of a dial,
+// write and read timeout per path; the paths it doesn't leave time for
+// are skipped. With fewer than two paths it returns result and opts as
+// they are.
+func probePaths(ctx context.Context, result ProbeResult, host, addr string, opts ProbeOptions) (ProbeResult, ProbeOptions) {
+	if len(opts.Paths) < 2 {
+		return result, opts
+	}
+	result.Path = opts.Paths[0]
+	results := map[string]ProbeResult{result.Path: result}
+	best := result
+
+	perPath := opts.DialTimeout + opts.WriteTimeout + opts.ReadTimeout
+	budget, cancel := context.WithTimeout(ctx, time.Duration(len(opts.Paths)-1)*perPath)
+	defer cancel()
+	for _, path := range opts.Paths[1:] {
+		if _, done := results[path]; done {
+			continue
+		}
+		if budget.Err() != nil {
+			break
+		}
+		pathOpts := opts
+		pathOpts.Path = path
+		answer := fetch(budget, addr, host, result.IsTLS, pathOpts.probeRequest(), pathOpts)
+		answer = headFallback(budget, answer, time.Now().Add(perPath), pathOpts, func(ctx context.Context, req request) ProbeResult {
+			return fetch(ctx, addr, host, result.IsTLS, req, pathOpts)
+		})
+		answer.Path = path
+		results[path] = answer
+		if pathRank(answer) > pathRank(best) {
+			best = answer
+		}
+	}
+
+	best.PathResults = results
+	opts.Path = best.Path
+	return best, opts
+}
+
+// pathRank orders the answers to different paths, higher first: by status
+// class, 2xx before 3xx before 4xx before 5xx, then within a class an
+// HTML page with a title before any other body, and any body before an
+// empty one. A path that got no HTTP answer ranks last. Of equal answers
+// the path listed first wins.
+func pathRank(r ProbeResult) int {
+	if !r.IsHTTP {
+		return 0
+	}
+	class := 0
+	switch {
+	case r.StatusCode >= 200 && r.StatusCode < 300:
+		class = 4
+	case r.StatusCode >= 300 && r.StatusCode < 400:
+		class = 3
+	case r.StatusCode >= 400 && r.StatusCode < 500:
+		class = 2
+	case r.StatusCode >= 500:
+		class = 1
+	}
+	content := 1
+	switch {
+	case r.Title != "":
+		content = 3
+	case len(r.BodySnippet) > 0:
+		content = 2
+	}
+	return class*3 + content
+}
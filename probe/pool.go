@@ -0,0 +1,259 @@
+package probe
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults for a ConnPool
+const (
+	DefaultPoolSize = 32
+	DefaultPoolIdle = 10 * time.Second
+)
+
+// aliveCheck is how long ConnPool waits for a pooled connection to show
+// it was closed by the server before reusing it
+const aliveCheck = time.Millisecond
+
+// ConnPool keeps one idle connection per address to HTTP/1.1 services
+// that allow keep-alive, so a service probed over and over isn't sent a
+// new connection every time. It is only for rechecking a service already
+// identified: first contact always dials fresh, as banners and protocol
+// detection need a connection of their own. Connections dialed through a
+// ProbeOptions.Limiter aren't kept, as they would hold their in-flight
+// slot while idle. It is safe for concurrent use.
+type ConnPool struct {
+	size int           // Connections kept at most, across all addresses
+	idle time.Duration // How long a connection may sit unused
+
+	mu    sync.Mutex
+	conns map[string]*pooledConn // key = "host:port"
+}
+
+// pooledConn is an idle connection with the reader its last response was
+// read through, which may hold nothing unread
+type pooledConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	since  time.Time // When it went idle
+}
+
+// NewConnPool returns a pool keeping at most size connections, each for
+// at most idle. Values <= 0 use DefaultPoolSize and DefaultPoolIdle.
+func NewConnPool(size int, idle time.Duration) *ConnPool {
+	if size <= 0 {
+		size = DefaultPoolSize
+	}
+	if idle <= 0 {
+		idle = DefaultPoolIdle
+	}
+	return &ConnPool{size: size, idle: idle, conns: make(map[string]*pooledConn)}
+}
+
+// Close closes the idle connections. The pool stays usable.
+func (p *ConnPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for addr, pc := range p.conns {
+		pc.conn.Close()
+		delete(p.conns, addr)
+	}
+}
+
+// Len returns the number of idle connections
+func (p *ConnPool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.conns)
+}
+
+// take removes the idle connection to addr from the pool and returns it,
+// if there is one still worth using
+func (p *ConnPool) take(addr string) *pooledConn {
+	p.mu.Lock()
+	pc, ok := p.conns[addr]
+	delete(p.conns, addr)
+	p.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	if time.Since(pc.since) > p.idle || !pc.alive() {
+		pc.conn.Close()
+		return nil
+	}
+	return pc
+}
+
+// put makes pc the idle connection to addr, closing the one it replaces
+// and, past the pool's size, the one idle the longest
+func (p *ConnPool) put(addr string, pc *pooledConn) {
+	pc.conn.SetDeadline(time.Time{})
+	pc.since = time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if old, ok := p.conns[addr]; ok {
+		old.conn.Close()
+	}
+	p.conns[addr] = pc
+	for key, c := range p.conns {
+		if time.Since(c.since) > p.idle {
+			c.conn.Close()
+			delete(p.conns, key)
+		}
+	}
+	for len(p.conns) > p.size {
+		oldest := ""
+		for key, c := range p.conns {
+			if oldest == "" || c.since.Before(p.conns[oldest].since) {
+				oldest = key
+			}
+		}
+		p.conns[oldest].conn.Close()
+		delete(p.conns, oldest)
+	}
+}
+
+// alive reports whether the server has neither closed the connection nor
+// sent anything unasked on it while it was idle
+func (pc *pooledConn) alive() bool {
+	return heldOpen(pc.conn, pc.reader, aliveCheck)
+}
+
+// exchange sends req to addr over the idle connection to it, or over a new
+// one when there is none or the server dropped it in the meantime. The
+// connection goes back to the pool if the response left it reusable.
+// ok is false when the request couldn't be sent at all.
+func (p *ConnPool) exchange(ctx context.Context, addr string, req request, opts ProbeOptions) (result ProbeResult, reused, ok bool) {
+	if pc := p.take(addr); pc != nil {
+		result = exchangeOn(ctx, pc.conn, pc.reader, req, opts)
+		if result.IsHTTP {
+			p.keep(ctx, addr, pc, req, result, opts)
+			return result, true, true
+		}
+		pc.conn.Close()
+		// A server may close an idle connection just as it is reused;
+		// only a response cut short says something about the service
+		if ctx.Err() != nil || result.Response != "" {
+			return result, true, true
+		}
+	}
+
+	conn, connectTime, err := opts.dialTimed(ctx, "tcp", addr)
+	if err != nil {
+		return ProbeResult{Err: contextError(ctx, err)}, false, false
+	}
+	pc := &pooledConn{conn: conn, reader: bufio.NewReader(conn)}
+	result = exchangeOn(ctx, conn, pc.reader, req, opts)
+	result.ConnectTime = connectTime
+	p.keep(ctx, addr, pc, req, result, opts)
+	return result, false, true
+}
+
+// keep pools pc if the response to req was read to its end and the server
+// agreed to keep the connection open, and closes it otherwise
+func (p *ConnPool) keep(ctx context.Context, addr string, pc *pooledConn, req request, result ProbeResult, opts ProbeOptions) {
+	if ctx.Err() != nil || opts.Limiter != nil || !complete(req, result) || pc.reader.Buffered() > 0 {
+		pc.conn.Close()
+		return
+	}
+	p.put(addr, pc)
+}
+
+// complete reports whether the whole response to req was read and the
+// connection it came over may carry another request
+func complete(req request, r ProbeResult) bool {
+	if !r.IsHTTP || r.HTTPVersion != "HTTP/1.1" || r.SSE || r.StatusCode < 200 {
+		return false
+	}
+	for _, value := range r.Headers.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "close") {
+				return false
+			}
+		}
+	}
+	// Reading a chunked body leaves its trailer on the connection
+	if r.Headers.Get("Transfer-Encoding") != "" {
+		return false
+	}
+	if req.Method == "HEAD" || r.StatusCode == 204 || r.StatusCode == 304 {
+		return true
+	}
+	_, err := strconv.Atoi(r.Headers.Get("Content-Length"))
+	return err == nil && !r.BodyTruncated
+}
+
+// keepAliveRequest is the main probe request sent as HTTP/1.1 without
+// Connection: close
+func (o ProbeOptions) keepAliveRequest() request {
+	req := o.probeRequest()
+	req.Version = "HTTP/1.1"
+	header := make([][2]string, 0, len(req.Header))
+	for _, field := range req.Header {
+		if !strings.EqualFold(field[0], "Connection") {
+			header = append(header, field)
+		}
+	}
+	req.Header = header
+	return req
+}
+
+// reusable reports whether a service's last probe result may be rechecked
+// with a single request: plain HTTP/1.x, nothing that streams. The first
+// probe is sent as HTTP/1.0, so whether the service keeps connections
+// alive only shows in the answer to the recheck.
+func reusable(r ProbeResult) bool {
+	return r.IsHTTP && !r.IsTLS && r.Protocol == ProtocolHTTP1 && !r.SSE
+}
+
+// Recheck probes a service already identified by previous with the main
+// probe request alone, sent over a connection from pool when the service
+// allows keep-alive. When the answer matches previous in status and
+// title, the result is previous with the new response, timings and Reused
+// set; the follow-up probes aren't run again. Anything else, from a nil
+// pool or a service that isn't plain HTTP/1.x to a changed response or a
+// failed request, falls back to a full probe, so the result always
+// describes the service as it is now.
+func Recheck(ctx context.Context, host string, port int, previous ProbeResult, pool *ConnPool, opts ProbeOptions) ProbeResult {
+	opts = opts.withDefaults().forPort(port)
+	// Credentials given or taken away change the answer
+	if pool == nil || !reusable(previous) || ValidateHeaders(opts.Headers) != nil || opts.Credentials.Validate() != nil ||
+		previous.Authenticated == opts.Credentials.IsZero() {
+		return probeWithOptions(ctx, host, port, opts)
+	}
+	dialHost := previous.Address
+	if dialHost == "" {
+		dialHost = host
+	}
+	addr := net.JoinHostPort(dialHost, strconv.Itoa(port))
+	// Of several candidate paths, the one that won is asked again
+	checkOpts := opts
+	if previous.Path != "" {
+		checkOpts.Path = previous.Path
+	}
+
+	start := time.Now()
+	result, reused, ok := pool.exchange(ctx, addr, checkOpts.keepAliveRequest(), checkOpts)
+	if !ok || !result.IsHTTP || result.StatusCode != previous.StatusCode || result.Title != previous.Title {
+		if ctx.Err() != nil {
+			return opts.Hooks.result(ProbeResult{Port: port, Err: ctx.Err()})
+		}
+		return probeWithOptions(ctx, host, port, opts)
+	}
+
+	out := previous
+	out.Response, out.HTTPVersion, out.Method, out.StatusText = result.Response, result.HTTPVersion, result.Method, result.StatusText
+	out.Headers, out.SSE, out.ContentClass, out.DirListing = result.Headers, result.SSE, result.ContentClass, result.DirListing
+	out.BodySnippet, out.BodyTruncated = result.BodySnippet, result.BodyTruncated
+	out.ConnectTime, out.TTFB = result.ConnectTime, result.TTFB
+	out.Duration = time.Since(start)
+	out.Attempts = 1
+	out.Reused = reused
+	out.Err = nil
+	return opts.Hooks.result(opts.authenticated(out))
+}
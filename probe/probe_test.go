@@ -0,0 +1,241 @@
+package probe_test
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"localhost-magic/probe"
+)
+
+// closedPort returns a loopback port nothing listens on
+func closedPort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestProbeHTTP(t *testing.T) {
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		tls      bool
+		state    probe.State
+		status   int
+		title    string
+		protocol probe.Protocol
+	}{
+		{
+			name: "page",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				w.Write([]byte("<html><head><title>Blog</title></head></html>"))
+			},
+			state: probe.StateHTTP, status: 200, title: "Blog", protocol: probe.ProtocolHTTP1,
+		},
+		{
+			name:    "not found",
+			handler: http.NotFound,
+			state:   probe.StateHTTP, status: 404, protocol: probe.ProtocolHTTP1,
+		},
+		{
+			name: "server error",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "boom", http.StatusInternalServerError)
+			},
+			state: probe.StateHTTP, status: 500, protocol: probe.ProtocolHTTP1,
+		},
+		{
+			name: "HTTPS",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+				w.Write([]byte("<title>Secure</title>"))
+			},
+			tls:   true,
+			state: probe.StateTLS, status: 200, title: "Secure",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var srv *httptest.Server
+			if tt.tls {
+				srv = httptest.NewUnstartedServer(tt.handler)
+				srv.Config.ErrorLog = log.New(io.Discard, "", 0) // Plaintext attempts before TLS
+				srv.StartTLS()
+			} else {
+				srv = httptest.NewServer(tt.handler)
+			}
+			defer srv.Close()
+
+			result := probe.ProbeWithOptions("127.0.0.1", port(srv), probe.ProbeOptions{})
+			if !result.IsHTTP || result.State != tt.state || result.IsTLS != tt.tls {
+				t.Fatalf("got IsHTTP %v, State %q, IsTLS %v; want HTTP, %q, %v", result.IsHTTP, result.State, result.IsTLS, tt.state, tt.tls)
+			}
+			if result.StatusCode != tt.status || result.Title != tt.title {
+				t.Errorf("got %d %q, want %d %q", result.StatusCode, result.Title, tt.status, tt.title)
+			}
+			if tt.protocol != "" && result.Protocol != tt.protocol {
+				t.Errorf("Protocol %q, want %q", result.Protocol, tt.protocol)
+			}
+			if result.Err != nil || result.Address != "127.0.0.1" || result.Port != port(srv) {
+				t.Errorf("Err %v, Address %q, Port %d", result.Err, result.Address, result.Port)
+			}
+			if result.Status() != probe.StatusHTTP {
+				t.Errorf("Status() %q, want %q", result.Status(), probe.StatusHTTP)
+			}
+			if !probe.IsHTTP("127.0.0.1", port(srv)) {
+				t.Error("IsHTTP is false")
+			}
+		})
+	}
+}
+
+func TestProbeClosed(t *testing.T) {
+	p := closedPort(t)
+	for name, result := range map[string]probe.ProbeResult{
+		"Probe":            probe.Probe("127.0.0.1", p),
+		"ProbeWithOptions": probe.ProbeWithOptions("127.0.0.1", p, probe.ProbeOptions{DialTimeout: time.Second}),
+	} {
+		if result.IsHTTP || result.State != probe.StateClosed || !errors.Is(result.Err, probe.ErrRefused) {
+			t.Errorf("%s: IsHTTP %v, State %q, Err %v; want closed and refused", name, result.IsHTTP, result.State, result.Err)
+		}
+		if result.Status() != probe.StatusClosed || result.Port != p {
+			t.Errorf("%s: Status() %q, Port %d", name, result.Status(), result.Port)
+		}
+	}
+	if probe.IsHTTP("127.0.0.1", p) {
+		t.Error("IsHTTP is true for a closed port")
+	}
+}
+
+func TestProbeRefusesInvalidOptions(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	tests := []struct {
+		name string
+		opts probe.ProbeOptions
+		want error
+	}{
+		{"header injection", probe.ProbeOptions{Headers: map[string]string{"X-A": "1\r\nX-B: 2"}}, probe.ErrInvalidHeader},
+		{"reserved header", probe.ProbeOptions{Headers: map[string]string{"Host": "evil"}}, probe.ErrInvalidHeader},
+		{"relative path", probe.ProbeOptions{Paths: []string{"health"}}, probe.ErrInvalidPath},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := probe.ProbeWithOptions("127.0.0.1", port(srv), tt.opts)
+			if !errors.Is(result.Err, tt.want) || result.IsHTTP || result.State != probe.StateUnknown {
+				t.Errorf("got Err %v, State %q; want %v without probing", result.Err, result.State, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateHeaders(t *testing.T) {
+	tests := []struct {
+		headers map[string]string
+		ok      bool
+	}{
+		{nil, true},
+		{map[string]string{"X-Api-Key": "secret", "X-Forwarded-Proto": "https"}, true},
+		{map[string]string{"Authorization": "Bearer t"}, true},
+		{map[string]string{"": "x"}, false},
+		{map[string]string{"X Api": "x"}, false},
+		{map[string]string{"X-Api:": "x"}, false},
+		{map[string]string{"Host": "x"}, false},
+		{map[string]string{"content-length": "1"}, false},
+		{map[string]string{"Transfer-Encoding": "chunked"}, false},
+		{map[string]string{"Connection": "keep-alive"}, false},
+		{map[string]string{"X-A": "a\nb"}, false},
+		{map[string]string{"X-A": "a\x00"}, false},
+	}
+	for _, tt := range tests {
+		err := probe.ValidateHeaders(tt.headers)
+		if tt.ok && err != nil || !tt.ok && !errors.Is(err, probe.ErrInvalidHeader) {
+			t.Errorf("ValidateHeaders(%q) = %v, want ok %v", tt.headers, err, tt.ok)
+		}
+	}
+}
+
+func TestParseHeader(t *testing.T) {
+	tests := []struct {
+		in          string
+		name, value string
+		ok          bool
+	}{
+		{"X-Api-Key: secret", "X-Api-Key", "secret", true},
+		{" X-Forwarded-Proto :https ", "X-Forwarded-Proto", "https", true},
+		{"X-Empty:", "X-Empty", "", true},
+		{"Cookie: a=1; b=2:3", "Cookie", "a=1; b=2:3", true},
+		{"X-Api-Key secret", "", "", false},
+		{"Host: evil", "", "", false},
+		{": value", "", "", false},
+	}
+	for _, tt := range tests {
+		name, value, err := probe.ParseHeader(tt.in)
+		if !tt.ok {
+			if !errors.Is(err, probe.ErrInvalidHeader) {
+				t.Errorf("ParseHeader(%q) = %v, want ErrInvalidHeader", tt.in, err)
+			}
+			continue
+		}
+		if err != nil || name != tt.name || value != tt.value {
+			t.Errorf("ParseHeader(%q) = %q, %q, %v; want %q, %q", tt.in, name, value, err, tt.name, tt.value)
+		}
+	}
+}
+
+func TestValidatePaths(t *testing.T) {
+	tests := []struct {
+		paths []string
+		ok    bool
+	}{
+		{nil, true},
+		{[]string{"/", "/health", "/api/v1?verbose=1"}, true},
+		{[]string{"health"}, false},
+		{[]string{"/", ""}, false},
+		{[]string{"/a b"}, false},
+		{[]string{"/a\r\nHost: evil"}, false},
+		{[]string{"/\x7f"}, false},
+	}
+	for _, tt := range tests {
+		err := probe.ValidatePaths(tt.paths)
+		if tt.ok && err != nil || !tt.ok && !errors.Is(err, probe.ErrInvalidPath) {
+			t.Errorf("ValidatePaths(%q) = %v, want ok %v", tt.paths, err, tt.ok)
+		}
+	}
+}
+
+func TestStatus(t *testing.T) {
+	tests := []struct {
+		result probe.ProbeResult
+		want   probe.PortStatus
+	}{
+		{probe.ProbeResult{}, probe.StatusClosed},
+		{probe.ProbeResult{Address: "127.0.0.1"}, probe.StatusOpen},
+		{probe.ProbeResult{Address: "127.0.0.1", IsHTTP: true}, probe.StatusHTTP},
+		{probe.ProbeResult{Address: "127.0.0.1", Protocol: probe.ProtocolGRPC}, probe.StatusHTTP},
+	}
+	for _, tt := range tests {
+		if got := tt.result.Status(); got != tt.want {
+			t.Errorf("%+v.Status() = %q, want %q", tt.result, got, tt.want)
+		}
+	}
+}
+
+func TestPortHint(t *testing.T) {
+	if got := probe.PortHint(9229); got != "Node.js inspector" {
+		t.Errorf("PortHint(9229) = %q", got)
+	}
+	if got := probe.PortHint(3000); got != "" {
+		t.Errorf("PortHint(3000) = %q, want none", got)
+	}
+}
@@ -0,0 +1,254 @@
+// Package probetest fakes the network under a probe, so tests can script
+// how a server behaves, including failures that are hard to provoke with
+// a real listener: a reset in the middle of a handshake, an unreachable
+// host, a greeting that arrives late. It is a probe.Dialer:
+//
+//	d := probetest.NewDialer()
+//	d.Handle("127.0.0.1:3000", probetest.Script{
+//		probetest.Expect(),
+//		probetest.Send("HTTP/1.1 200 OK\r\n\r\n"),
+//		probetest.Close(),
+//	})
+//	d.Fail("[::1]:3000", syscall.EHOSTUNREACH)
+//	result := probe.ProbeContextWithOptions(ctx, "localhost", 3000, probe.ProbeOptions{Dialer: d})
+package probetest
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Step is one thing the fake server does
+type Step struct {
+	expect bool
+	sleep  time.Duration
+	send   []byte
+	reset  bool
+	close  bool
+}
+
+// Script is what the fake server does on each connection, step by step.
+// Once the steps run out the server stays connected and silent until the
+// client hangs up.
+type Script []Step
+
+// Expect waits for the client to send something it hadn't sent by the
+// previous Expect
+func Expect() Step { return Step{expect: true} }
+
+// Sleep waits for d
+func Sleep(d time.Duration) Step { return Step{sleep: d} }
+
+// Send writes data to the client
+func Send(data string) Step { return Step{send: []byte(data)} }
+
+// Reset ends the connection with a reset: the client's pending and later
+// reads and writes fail with ECONNRESET
+func Reset() Step { return Step{reset: true} }
+
+// Close ends the connection cleanly: the client reads EOF
+func Close() Step { return Step{close: true} }
+
+// Dialer is a probe.Dialer whose connections go to scripts instead of the
+// network. An address with neither a script nor an error refuses the
+// connection. It is safe for concurrent use.
+type Dialer struct {
+	mu      sync.Mutex
+	scripts map[string]Script // key = network address, e.g. "127.0.0.1:3000"
+	errs    map[string]error
+	dials   []string
+	conns   []*Conn
+}
+
+// NewDialer returns a Dialer with nothing to connect to
+func NewDialer() *Dialer {
+	return &Dialer{scripts: make(map[string]Script), errs: make(map[string]error)}
+}
+
+// Handle makes every connection to address, over TCP or UDP, run script
+func (d *Dialer) Handle(address string, script Script) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.scripts[address] = script
+	delete(d.errs, address)
+}
+
+// Fail makes every dial to address fail with err, such as
+// syscall.EHOSTUNREACH or os.ErrDeadlineExceeded, wrapped the way the net
+// package wraps it. A nil err leaves the dial hanging until its context
+// is done, like a host that drops packets.
+func (d *Dialer) Fail(address string, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.errs[address] = err
+	delete(d.scripts, address)
+}
+
+// Dials returns the addresses dialed so far, in order
+func (d *Dialer) Dials() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.dials...)
+}
+
+// Conns returns the server side of every connection made so far, in order
+func (d *Dialer) Conns() []*Conn {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]*Conn(nil), d.conns...)
+}
+
+// DialContext implements probe.Dialer
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.mu.Lock()
+	d.dials = append(d.dials, address)
+	script, scripted := d.scripts[address]
+	err, failing := d.errs[address]
+	d.mu.Unlock()
+
+	switch {
+	case failing && err == nil:
+		<-ctx.Done()
+		return nil, &net.OpError{Op: "dial", Net: network, Err: ctx.Err()}
+	case failing:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: os.NewSyscallError("connect", err)}
+	case !scripted:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	client, server := net.Pipe()
+	c := &Conn{server: server, received: make(chan struct{}, 1), hungUp: make(chan struct{})}
+	d.mu.Lock()
+	d.conns = append(d.conns, c)
+	d.mu.Unlock()
+	go c.drain()
+	go c.run(script)
+	return &clientConn{Conn: client, server: c}, nil
+}
+
+// Conn is the server side of a scripted connection
+type Conn struct {
+	server   net.Conn
+	received chan struct{} // Signalled when data arrives
+	hungUp   chan struct{} // Closed when the client closes its end
+
+	mu       sync.Mutex
+	data     []byte
+	expected int // Bytes of data the last Expect saw
+	reset    bool
+}
+
+// Received returns everything the client has sent so far
+func (c *Conn) Received() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte(nil), c.data...)
+}
+
+// drain reads whatever the client writes, as a kernel buffer would, so a
+// client write never waits for the script
+func (c *Conn) drain() {
+	defer close(c.hungUp)
+	buf := make([]byte, 4096)
+	for {
+		n, err := c.server.Read(buf)
+		if n > 0 {
+			c.mu.Lock()
+			c.data = append(c.data, buf[:n]...)
+			c.mu.Unlock()
+			select {
+			case c.received <- struct{}{}:
+			default:
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// run plays the script. Closing the pipe is what ends it early, when the
+// client hangs up.
+func (c *Conn) run(script Script) {
+	for _, step := range script {
+		switch {
+		case step.expect:
+			if !c.waitForData() {
+				return
+			}
+		case step.sleep > 0:
+			time.Sleep(step.sleep)
+		case step.send != nil:
+			if _, err := c.server.Write(step.send); err != nil {
+				return
+			}
+		case step.reset:
+			c.mu.Lock()
+			c.reset = true
+			c.mu.Unlock()
+			c.server.Close()
+			return
+		case step.close:
+			c.server.Close()
+			return
+		}
+	}
+}
+
+// waitForData blocks until the client has sent something new, reporting
+// false if it hung up first
+func (c *Conn) waitForData() bool {
+	for {
+		c.mu.Lock()
+		n := len(c.data)
+		fresh := n > c.expected
+		c.expected = n
+		c.mu.Unlock()
+		if fresh {
+			return true
+		}
+		select {
+		case <-c.received:
+		case <-c.hungUp:
+			return false
+		}
+	}
+}
+
+// clientConn is the probe's end, which turns a scripted reset into the
+// error a real socket would return
+type clientConn struct {
+	net.Conn
+	server *Conn
+}
+
+func (c *clientConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	return n, c.resetError("read", err)
+}
+
+func (c *clientConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	return n, c.resetError("write", err)
+}
+
+// resetError replaces the pipe's EOF with ECONNRESET after a reset
+func (c *clientConn) resetError(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	c.server.mu.Lock()
+	reset := c.server.reset
+	c.server.mu.Unlock()
+	if !reset {
+		return err
+	}
+	return &net.OpError{Op: op, Net: "tcp", Err: os.NewSyscallError(op, syscall.ECONNRESET)}
+}
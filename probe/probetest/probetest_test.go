@@ -0,0 +1,86 @@
+package probetest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestScript(t *testing.T) {
+	d := NewDialer()
+	d.Handle("127.0.0.1:3000", Script{Send("hello\n"), Expect(), Send("bye\n"), Close()})
+	conn, err := d.DialContext(context.Background(), "tcp", "127.0.0.1:3000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 6)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello\n" {
+		t.Fatalf("read %q, %v; want the greeting", buf, err)
+	}
+	conn.Write([]byte("ping"))
+	rest, err := io.ReadAll(conn)
+	if err != nil || string(rest) != "bye\n" {
+		t.Errorf("read %q, %v; want the answer, then EOF", rest, err)
+	}
+	if got := string(d.Conns()[0].Received()); got != "ping" {
+		t.Errorf("server received %q", got)
+	}
+}
+
+func TestReset(t *testing.T) {
+	d := NewDialer()
+	d.Handle("127.0.0.1:3000", Script{Expect(), Sleep(10 * time.Millisecond), Reset()})
+	conn, err := d.DialContext(context.Background(), "tcp", "127.0.0.1:3000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	_, err = conn.Read(make([]byte, 1))
+	var opErr *net.OpError
+	if !errors.Is(err, syscall.ECONNRESET) || !errors.As(err, &opErr) {
+		t.Errorf("read error %v, want ECONNRESET as a *net.OpError", err)
+	}
+}
+
+func TestDialFailures(t *testing.T) {
+	d := NewDialer()
+	d.Fail("127.0.0.1:3001", syscall.EHOSTUNREACH)
+	d.Fail("127.0.0.1:3002", nil)
+	tests := []struct {
+		addr string
+		want error
+	}{
+		{"127.0.0.1:3000", syscall.ECONNREFUSED}, // Nothing scripted
+		{"127.0.0.1:3001", syscall.EHOSTUNREACH},
+		{"127.0.0.1:3002", context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		conn, err := d.DialContext(ctx, "tcp", tt.addr)
+		cancel()
+		if conn != nil || !errors.Is(err, tt.want) {
+			t.Errorf("dial %s: %v, want %v", tt.addr, err, tt.want)
+		}
+	}
+	want := []string{"127.0.0.1:3000", "127.0.0.1:3001", "127.0.0.1:3002"}
+	if got := d.Dials(); len(got) != len(want) || got[0] != want[0] || got[2] != want[2] {
+		t.Errorf("Dials() = %v, want %v", got, want)
+	}
+}
+
+func TestHandleReplacesFail(t *testing.T) {
+	d := NewDialer()
+	d.Fail("127.0.0.1:3000", syscall.EHOSTUNREACH)
+	d.Handle("127.0.0.1:3000", Script{Close()})
+	conn, err := d.DialContext(context.Background(), "tcp", "127.0.0.1:3000")
+	if err != nil {
+		t.Fatalf("dial: %v, want the script", err)
+	}
+	conn.Close()
+}
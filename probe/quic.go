@@ -0,0 +1,794 @@
+package probe
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The QUIC probe is a minimal QUIC version 1 client (RFC 9000, 9001): it
+// sends an Initial packet carrying a TLS ClientHello that offers ALPN h3,
+// and decrypts the server's Initial and Handshake packets until crypto/tls
+// reports the handshake done. No streams are opened and no HTTP/3 request
+// is sent; the handshake alone tells whether the port serves HTTP/3 and
+// with which certificate.
+
+const (
+	quicVersion1 = 0x00000001
+
+	// quicMinDatagram is the size every datagram carrying a client Initial
+	// must be padded to
+	quicMinDatagram = 1200
+
+	quicConnIDLen = 8
+)
+
+// quicV1Salt is the salt Initial secrets are derived with (RFC 9001 5.2)
+var quicV1Salt = []byte{
+	0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17,
+	0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a,
+}
+
+// Long header packet types
+const (
+	quicPacketInitial   = 0x0
+	quicPacketZeroRTT   = 0x1
+	quicPacketHandshake = 0x2
+	quicPacketRetry     = 0x3
+)
+
+// Frame types the handshake can carry
+const (
+	quicFramePadding         = 0x00
+	quicFramePing            = 0x01
+	quicFrameAck             = 0x02
+	quicFrameAckECN          = 0x03
+	quicFrameCrypto          = 0x06
+	quicFrameConnectionClose = 0x1c
+	quicFrameAppClose        = 0x1d
+)
+
+// errQUICUnsupportedSuite is set when the server picked a cipher suite the
+// probe can't decrypt (only AES-GCM is implemented)
+var errQUICUnsupportedSuite = errors.New("quic: server chose a cipher suite the probe can't decrypt")
+
+// ProbeQUIC attempts a QUIC handshake offering HTTP/3 on UDP host:port.
+// A server that answers gets Kind ServiceQUIC; if it completed the
+// handshake, IsTLS, TLSVersion, NegotiatedProtocol and Cert are set too,
+// and Protocol is ProtocolH3 when it agreed to h3. UDP has no connection,
+// so a port that never answers is reported as StateFiltered.
+func ProbeQUIC(ctx context.Context, host string, port int, opts ProbeOptions) ProbeResult {
+	opts = opts.withDefaults()
+
+	start := time.Now()
+	var result ProbeResult
+	for _, dialHost := range DialHosts(ctx, host, opts.AddressFamily) {
+		attempt, answered := quicHandshake(ctx, host, dialHost, port, opts)
+		if answered {
+			result = attempt
+			result.Address = dialHost
+			break
+		}
+		// The port is closed only if every address refused
+		if result.Err == nil || errors.Is(classifyError(result.Err), ErrRefused) {
+			result = attempt
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	result.Port = port
+	result.Transport = "udp"
+	result.Duration = time.Since(start)
+	result.Err = classifyError(result.Err)
+	switch {
+	case result.Kind != ServiceUnknown:
+		result.UDP = UDPResponded
+		result.State = classifyState(result, true)
+	case errors.Is(result.Err, ErrRefused):
+		result.UDP = UDPUnreachable
+		result.State = StateClosed
+	case ctx.Err() == nil:
+		result.UDP = UDPNoResponse
+		result.State = StateFiltered
+	}
+	return opts.Hooks.result(result)
+}
+
+// quicHandshake runs one handshake attempt. The boolean reports whether
+// the server answered at all.
+func quicHandshake(ctx context.Context, host, dialHost string, port int, opts ProbeOptions) (ProbeResult, bool) {
+	addr := net.JoinHostPort(dialHost, strconv.Itoa(port))
+	conn, err := opts.dial(ctx, "udp", addr)
+	if err != nil {
+		return ProbeResult{Err: contextError(ctx, err)}, false
+	}
+	defer conn.Close()
+
+	c, err := newQUICClient(host)
+	if err != nil {
+		return ProbeResult{Err: err}, false
+	}
+	defer c.tls.Close()
+
+	deadline := phaseDeadline(ctx, opts.DialTimeout+opts.ReadTimeout)
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	start := time.Now()
+	if _, err := conn.Write(c.initialDatagram()); err != nil {
+		return ProbeResult{Err: contextError(ctx, err)}, false
+	}
+
+	result := ProbeResult{}
+	answered := false
+	buf := make([]byte, 64*1024)
+	for !c.done && c.err == nil {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if !answered {
+				return ProbeResult{Err: contextError(ctx, err)}, false
+			}
+			c.err = contextError(ctx, err)
+			break
+		}
+		if !answered {
+			answered = true
+			result.TTFB = time.Since(start)
+		}
+		c.handleDatagram(buf[:n])
+		if c.resend {
+			c.resend = false
+			conn.Write(c.initialDatagram())
+		} else if !c.done && c.err == nil {
+			// Acknowledging lifts the server's anti-amplification limit,
+			// which a large certificate chain can run into
+			if ack := c.ackDatagram(); ack != nil {
+				conn.Write(ack)
+			}
+		}
+	}
+	if c.done {
+		// Be polite: the server would otherwise wait out its idle timeout
+		if closing := c.closeDatagram(); closing != nil {
+			conn.Write(closing)
+		}
+	}
+
+	result.Kind = ServiceQUIC
+	result.Err = c.err
+	result.Banner = c.banner
+	if c.done {
+		state := c.tls.ConnectionState()
+		result.IsTLS = true
+		result.TLSVersion = tls.VersionName(state.Version)
+		result.NegotiatedProtocol = state.NegotiatedProtocol
+		if state.NegotiatedProtocol == "h3" {
+			result.Protocol = ProtocolH3
+		}
+		if len(state.PeerCertificates) > 0 {
+			result.Cert = newCertInfo(state.PeerCertificates, opts.Roots)
+			result.Cert.ServerName = c.serverName
+		}
+	}
+	return result, true
+}
+
+// quicClient is the state of one handshake
+type quicClient struct {
+	tls        *tls.QUICConn
+	serverName string
+
+	dcid, scid []byte
+	token      []byte // From a Retry
+	retried    bool
+
+	// Per packet number space: Initial, Handshake
+	spaces [2]quicSpace
+
+	clientHello []byte
+	done        bool
+	resend      bool   // A Retry asked for the Initial again
+	banner      string // What a server that wouldn't do the handshake said
+	err         error
+}
+
+// quicSpace is one packet number space
+type quicSpace struct {
+	read, write *quicKeys
+	nextPN      uint64
+	largestRecv int64 // -1 until a packet arrives
+	crypto      quicCryptoStream
+}
+
+// quicCryptoStream reassembles CRYPTO frames that may arrive out of order
+type quicCryptoStream struct {
+	offset  uint64            // Bytes delivered so far
+	pending map[uint64][]byte // Data beyond offset, by its offset
+}
+
+func newQUICClient(host string) (*quicClient, error) {
+	c := &quicClient{dcid: make([]byte, quicConnIDLen), scid: make([]byte, quicConnIDLen)}
+	if _, err := rand.Read(c.dcid); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(c.scid); err != nil {
+		return nil, err
+	}
+	for i := range c.spaces {
+		c.spaces[i].largestRecv = -1
+	}
+	c.deriveInitialKeys()
+
+	// SNI must be a hostname, never an IP literal
+	c.serverName = host
+	if net.ParseIP(host) != nil {
+		c.serverName = sniFallbackName
+	}
+	c.tls = tls.QUICClient(&tls.QUICConfig{TLSConfig: &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         c.serverName,
+		NextProtos:         []string{"h3"},
+		MinVersion:         tls.VersionTLS13,
+	}})
+	c.tls.SetTransportParameters(c.transportParameters())
+	if err := c.tls.Start(context.Background()); err != nil {
+		return nil, fmt.Errorf("quic: %w", err)
+	}
+	c.drainEvents()
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c, nil
+}
+
+// transportParameters are the QUIC transport parameters sent in the
+// ClientHello: just enough for servers to accept the handshake
+func (c *quicClient) transportParameters() []byte {
+	var p []byte
+	param := func(id uint64, value []byte) {
+		p = appendVarint(p, id)
+		p = appendVarint(p, uint64(len(value)))
+		p = append(p, value...)
+	}
+	varintParam := func(id, v uint64) { param(id, appendVarint(nil, v)) }
+	varintParam(0x01, 5000)  // max_idle_timeout, ms
+	varintParam(0x03, 1452)  // max_udp_payload_size
+	varintParam(0x04, 65536) // initial_max_data
+	param(0x0f, c.scid)      // initial_source_connection_id
+	return p
+}
+
+// deriveInitialKeys computes the Initial keys, which depend only on the
+// destination connection ID the client picked (RFC 9001 5.2)
+func (c *quicClient) deriveInitialKeys() {
+	initial := hkdfExtract(sha256.New, quicV1Salt, c.dcid)
+	client := hkdfExpandLabel(sha256.New, initial, "client in", sha256.Size)
+	server := hkdfExpandLabel(sha256.New, initial, "server in", sha256.Size)
+	c.spaces[0].write, _ = newQUICKeys(tls.TLS_AES_128_GCM_SHA256, client)
+	c.spaces[0].read, _ = newQUICKeys(tls.TLS_AES_128_GCM_SHA256, server)
+}
+
+// drainEvents applies the events crypto/tls has queued: new keys, data
+// to send, completion
+func (c *quicClient) drainEvents() {
+	for {
+		e := c.tls.NextEvent()
+		switch e.Kind {
+		case tls.QUICNoEvent:
+			return
+		case tls.QUICSetReadSecret, tls.QUICSetWriteSecret:
+			if e.Level != tls.QUICEncryptionLevelHandshake {
+				continue // 0-RTT and 1-RTT keys aren't needed
+			}
+			keys, err := newQUICKeys(e.Suite, e.Data)
+			if err != nil {
+				c.err = err
+				return
+			}
+			if e.Kind == tls.QUICSetReadSecret {
+				c.spaces[1].read = keys
+			} else {
+				c.spaces[1].write = keys
+			}
+		case tls.QUICWriteData:
+			if e.Level == tls.QUICEncryptionLevelInitial {
+				c.clientHello = append(c.clientHello, e.Data...)
+			}
+			// The client's Finished isn't sent: the probe doesn't need a
+			// connection, only what the server presented
+		case tls.QUICHandshakeDone:
+			c.done = true
+		}
+	}
+}
+
+// initialDatagram builds the padded Initial packet carrying the ClientHello
+func (c *quicClient) initialDatagram() []byte {
+	frames := appendCryptoFrame(nil, 0, c.clientHello)
+	return c.sealPacket(nil, quicPacketInitial, frames, quicMinDatagram)
+}
+
+// ackDatagram acknowledges what arrived in each packet number space, or
+// returns nil if nothing did
+func (c *quicClient) ackDatagram() []byte {
+	var handshake []byte
+	if hs := &c.spaces[1]; hs.write != nil && hs.largestRecv >= 0 {
+		handshake = c.sealPacket(nil, quicPacketHandshake, appendAckFrame(nil, uint64(hs.largestRecv)), 0)
+	}
+	var datagram []byte
+	if c.spaces[0].largestRecv >= 0 {
+		datagram = c.sealPacket(nil, quicPacketInitial, appendAckFrame(nil, uint64(c.spaces[0].largestRecv)), quicMinDatagram-len(handshake))
+	}
+	if datagram == nil && handshake == nil {
+		return nil
+	}
+	return append(datagram, handshake...)
+}
+
+// closeDatagram tells the server the probe is done, at the Handshake level
+func (c *quicClient) closeDatagram() []byte {
+	if c.spaces[1].write == nil {
+		return nil
+	}
+	frame := []byte{quicFrameConnectionClose}
+	frame = appendVarint(frame, 0) // NO_ERROR
+	frame = appendVarint(frame, 0) // Frame type
+	frame = appendVarint(frame, 0) // Reason length
+	return c.sealPacket(nil, quicPacketHandshake, frame, 0)
+}
+
+// sealPacket appends a protected long header packet to b. An Initial is
+// padded so the datagram it ends is at least padTo bytes.
+func (c *quicClient) sealPacket(b []byte, typ byte, payload []byte, padTo int) []byte {
+	space := &c.spaces[0]
+	if typ == quicPacketHandshake {
+		space = &c.spaces[1]
+	}
+	keys := space.write
+	pn := space.nextPN
+	space.nextPN++
+
+	const pnLen = 4
+	start := len(b)
+	b = append(b, 0xc0|typ<<4|(pnLen-1))
+	b = binary.BigEndian.AppendUint32(b, quicVersion1)
+	b = append(b, byte(len(c.dcid)))
+	b = append(b, c.dcid...)
+	b = append(b, byte(len(c.scid)))
+	b = append(b, c.scid...)
+	if typ == quicPacketInitial {
+		b = appendVarint(b, uint64(len(c.token)))
+		b = append(b, c.token...)
+	}
+	// The length field is always two bytes, so the size is known here
+	overhead := len(b) + 2 + pnLen + keys.aead.Overhead()
+	if need := padTo - overhead - len(payload); need > 0 {
+		payload = append(payload, make([]byte, need)...) // PADDING frames
+	}
+	length := pnLen + len(payload) + keys.aead.Overhead()
+	b = append(b, 0x40|byte(length>>8), byte(length))
+	pnOffset := len(b)
+	b = binary.BigEndian.AppendUint32(b, uint32(pn))
+
+	header := append([]byte(nil), b[start:]...)
+	b = keys.aead.Seal(b, keys.nonce(pn), payload, header)
+
+	mask := keys.mask(b[pnOffset+4 : pnOffset+4+16])
+	b[start] ^= mask[0] & 0x0f
+	for i := 0; i < pnLen; i++ {
+		b[pnOffset+i] ^= mask[1+i]
+	}
+	return b
+}
+
+// handleDatagram processes every packet coalesced in a datagram
+func (c *quicClient) handleDatagram(b []byte) {
+	for len(b) > 0 && !c.done && c.err == nil && !c.resend {
+		n := c.handlePacket(b)
+		if n <= 0 {
+			return
+		}
+		b = b[n:]
+	}
+}
+
+// handlePacket processes the packet at the start of b and returns its
+// length, or 0 if the rest of the datagram can't be parsed
+func (c *quicClient) handlePacket(b []byte) int {
+	if b[0]&0x80 == 0 {
+		return 0 // Short header (1-RTT): nothing the probe can read
+	}
+	if len(b) < 7 {
+		return 0
+	}
+	version := binary.BigEndian.Uint32(b[1:5])
+	pos := 5
+	dcidLen := int(b[pos])
+	pos += 1 + dcidLen
+	if pos >= len(b) {
+		return 0
+	}
+	scidLen := int(b[pos])
+	if pos+1+scidLen > len(b) {
+		return 0
+	}
+	scid := b[pos+1 : pos+1+scidLen]
+	pos += 1 + scidLen
+
+	if version == 0 {
+		c.versionNegotiation(b[pos:])
+		return len(b)
+	}
+	if version != quicVersion1 {
+		return 0
+	}
+
+	typ := (b[0] >> 4) & 0x3
+	switch typ {
+	case quicPacketRetry:
+		// The token runs up to the 16-byte integrity tag
+		if !c.retried && len(b)-pos > 16 {
+			c.retried = true
+			c.token = append([]byte(nil), b[pos:len(b)-16]...)
+			c.dcid = append([]byte(nil), scid...)
+			c.deriveInitialKeys()
+			c.resend = true
+		}
+		return len(b)
+	case quicPacketInitial:
+		tokenLen, n := readVarint(b[pos:])
+		if n == 0 || pos+n+int(tokenLen) > len(b) {
+			return 0
+		}
+		pos += n + int(tokenLen)
+	case quicPacketZeroRTT:
+		return 0
+	}
+
+	length, n := readVarint(b[pos:])
+	if n == 0 || pos+n+int(length) > len(b) {
+		return 0
+	}
+	pos += n
+	end := pos + int(length)
+
+	space := &c.spaces[0]
+	level := tls.QUICEncryptionLevelInitial
+	if typ == quicPacketHandshake {
+		space = &c.spaces[1]
+		level = tls.QUICEncryptionLevelHandshake
+	}
+	if space.read == nil {
+		return end // Arrived ahead of the ServerHello that carries its keys
+	}
+	payload, pn, ok := space.read.open(b[:end], pos)
+	if !ok {
+		return end // Corrupt or not for us; ignore like any QUIC endpoint would
+	}
+	// Later packets go to the connection ID the server picked
+	c.dcid = append(c.dcid[:0], scid...)
+	if int64(pn) > space.largestRecv {
+		space.largestRecv = int64(pn)
+	}
+	c.handleFrames(level, space, payload)
+	return end
+}
+
+// versionNegotiation records the versions a server offered instead of v1
+func (c *quicClient) versionNegotiation(b []byte) {
+	var versions []string
+	for ; len(b) >= 4; b = b[4:] {
+		versions = append(versions, fmt.Sprintf("0x%08x", binary.BigEndian.Uint32(b)))
+	}
+	c.banner = "QUIC versions " + strings.Join(versions, ", ")
+	c.err = errors.New("quic: server doesn't support version 1")
+}
+
+// handleFrames processes the frames of one decrypted packet
+func (c *quicClient) handleFrames(level tls.QUICEncryptionLevel, space *quicSpace, b []byte) {
+	for len(b) > 0 {
+		typ := b[0]
+		b = b[1:]
+		switch typ {
+		case quicFramePadding, quicFramePing:
+		case quicFrameAck, quicFrameAckECN:
+			// Largest acknowledged, delay, range count, first range
+			var fields [4]uint64
+			for i := range fields {
+				v, n := readVarint(b)
+				if n == 0 {
+					return
+				}
+				fields[i], b = v, b[n:]
+			}
+			// Each further range is a gap and a length; ECN adds 3 counts
+			extra := 2 * fields[2]
+			if typ == quicFrameAckECN {
+				extra += 3
+			}
+			for i := uint64(0); i < extra; i++ {
+				_, n := readVarint(b)
+				if n == 0 {
+					return
+				}
+				b = b[n:]
+			}
+		case quicFrameCrypto:
+			offset, n := readVarint(b)
+			if n == 0 {
+				return
+			}
+			b = b[n:]
+			length, n := readVarint(b)
+			if n == 0 || uint64(len(b)-n) < length {
+				return
+			}
+			data := b[n : n+int(length)]
+			b = b[n+int(length):]
+			for _, chunk := range space.crypto.push(offset, data) {
+				if err := c.tls.HandleData(level, chunk); err != nil {
+					c.err = fmt.Errorf("quic: %w", err)
+					return
+				}
+				c.drainEvents()
+				if c.err != nil {
+					return
+				}
+			}
+		case quicFrameConnectionClose, quicFrameAppClose:
+			code, n := readVarint(b)
+			if n == 0 {
+				return
+			}
+			b = b[n:]
+			if typ == quicFrameConnectionClose {
+				if _, n = readVarint(b); n == 0 {
+					return
+				}
+				b = b[n:]
+			}
+			reasonLen, n := readVarint(b)
+			reason := ""
+			if n > 0 && uint64(len(b)-n) >= reasonLen {
+				reason = string(b[n : n+int(reasonLen)])
+			}
+			c.err = quicCloseError(code, reason)
+			return
+		default:
+			return // Not allowed during the handshake
+		}
+	}
+}
+
+// quicCloseError describes a CONNECTION_CLOSE from the server
+func quicCloseError(code uint64, reason string) error {
+	what := fmt.Sprintf("error 0x%x", code)
+	if code >= 0x100 && code <= 0x1ff {
+		// A TLS alert; 120 means the server had no protocol in common
+		alert := code - 0x100
+		what = fmt.Sprintf("TLS alert %d", alert)
+		if alert == 120 {
+			what = "no application protocol in common (the server doesn't offer h3)"
+		}
+	}
+	if reason != "" {
+		what += ": " + reason
+	}
+	return fmt.Errorf("quic: connection closed by server, %s", what)
+}
+
+// push adds a CRYPTO frame's data and returns whatever is now contiguous
+// with what was delivered before
+func (s *quicCryptoStream) push(offset uint64, data []byte) [][]byte {
+	end := offset + uint64(len(data))
+	if end <= s.offset {
+		return nil // Retransmission
+	}
+	if offset < s.offset {
+		data = data[s.offset-offset:]
+		offset = s.offset
+	}
+	if s.pending == nil {
+		s.pending = make(map[uint64][]byte)
+	}
+	s.pending[offset] = append([]byte(nil), data...)
+
+	var ready [][]byte
+	for {
+		chunk, ok := s.pending[s.offset]
+		if !ok {
+			break
+		}
+		delete(s.pending, s.offset)
+		ready = append(ready, chunk)
+		s.offset += uint64(len(chunk))
+	}
+	return ready
+}
+
+// quicKeys protects packets in one direction of one packet number space
+type quicKeys struct {
+	aead cipher.AEAD
+	iv   []byte
+	hp   cipher.Block
+}
+
+// newQUICKeys derives the packet protection keys from a TLS secret
+func newQUICKeys(suite uint16, secret []byte) (*quicKeys, error) {
+	var h func() hash.Hash
+	var keyLen int
+	switch suite {
+	case tls.TLS_AES_128_GCM_SHA256:
+		h, keyLen = sha256.New, 16
+	case tls.TLS_AES_256_GCM_SHA384:
+		h, keyLen = sha512.New384, 32
+	default:
+		return nil, fmt.Errorf("%w (%s)", errQUICUnsupportedSuite, tls.CipherSuiteName(suite))
+	}
+	block, err := aes.NewCipher(hkdfExpandLabel(h, secret, "quic key", keyLen))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	hp, err := aes.NewCipher(hkdfExpandLabel(h, secret, "quic hp", keyLen))
+	if err != nil {
+		return nil, err
+	}
+	return &quicKeys{aead: aead, iv: hkdfExpandLabel(h, secret, "quic iv", 12), hp: hp}, nil
+}
+
+// nonce is the IV combined with the packet number
+func (k *quicKeys) nonce(pn uint64) []byte {
+	nonce := append([]byte(nil), k.iv...)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	return nonce
+}
+
+// mask is the header protection mask for a ciphertext sample
+func (k *quicKeys) mask(sample []byte) []byte {
+	mask := make([]byte, aes.BlockSize)
+	k.hp.Encrypt(mask, sample)
+	return mask
+}
+
+// open removes header protection from the long header packet p, whose
+// packet number starts at pnOffset, and decrypts its payload
+func (k *quicKeys) open(p []byte, pnOffset int) ([]byte, uint64, bool) {
+	if len(p) < pnOffset+4+aes.BlockSize {
+		return nil, 0, false
+	}
+	header := append([]byte(nil), p[:pnOffset+4]...)
+	mask := k.mask(p[pnOffset+4 : pnOffset+4+aes.BlockSize])
+	header[0] ^= mask[0] & 0x0f
+	pnLen := int(header[0]&0x03) + 1
+	var pn uint64
+	for i := 0; i < pnLen; i++ {
+		header[pnOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(header[pnOffset+i])
+	}
+	header = header[:pnOffset+pnLen]
+	// The handshake is a handful of packets, so the truncated packet
+	// number is the full one
+	payload, err := k.aead.Open(nil, k.nonce(pn), p[pnOffset+pnLen:], header)
+	if err != nil {
+		return nil, 0, false
+	}
+	return payload, pn, true
+}
+
+// appendCryptoFrame appends a CRYPTO frame
+func appendCryptoFrame(b []byte, offset uint64, data []byte) []byte {
+	b = append(b, quicFrameCrypto)
+	b = appendVarint(b, offset)
+	b = appendVarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// appendAckFrame appends an ACK frame for packet numbers 0..largest
+func appendAckFrame(b []byte, largest uint64) []byte {
+	b = append(b, quicFrameAck)
+	b = appendVarint(b, largest)
+	b = appendVarint(b, 0)          // ACK delay
+	b = appendVarint(b, 0)          // No further ranges
+	return appendVarint(b, largest) // First range: everything up to largest
+}
+
+// appendVarint appends v in QUIC's variable-length integer encoding
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return append(b, 0x40|byte(v>>8), byte(v))
+	case v < 1<<30:
+		return binary.BigEndian.AppendUint32(b, 0x80<<24|uint32(v))
+	default:
+		return binary.BigEndian.AppendUint64(b, 0xc0<<56|v)
+	}
+}
+
+// readVarint decodes a variable-length integer, returning its size or 0
+// if b is too short
+func readVarint(b []byte) (uint64, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	size := 1 << (b[0] >> 6)
+	if len(b) < size {
+		return 0, 0
+	}
+	v := uint64(b[0] & 0x3f)
+	for _, c := range b[1:size] {
+		v = v<<8 | uint64(c)
+	}
+	return v, size
+}
+
+// hkdfExtract is HKDF-Extract (RFC 5869)
+func hkdfExtract(h func() hash.Hash, salt, ikm []byte) []byte {
+	mac := hmac.New(h, salt)
+	mac.Write(ikm)
+	return mac.Sum(nil)
+}
+
+// hkdfExpandLabel is TLS 1.3's HKDF-Expand-Label with an empty context
+func hkdfExpandLabel(h func() hash.Hash, secret []byte, label string, length int) []byte {
+	full := "tls13 " + label
+	info := []byte{byte(length >> 8), byte(length), byte(len(full))}
+	info = append(info, full...)
+	info = append(info, 0)
+
+	var out, prev []byte
+	for i := byte(1); len(out) < length; i++ {
+		mac := hmac.New(h, secret)
+		mac.Write(prev)
+		mac.Write(info)
+		mac.Write([]byte{i})
+		prev = mac.Sum(nil)
+		out = append(out, prev...)
+	}
+	return out[:length]
+}
+
+// altSvcH3Port returns the UDP port an Alt-Svc header advertises HTTP/3
+// on, when it is on the same host (h3=":443")
+func altSvcH3Port(headers map[string][]string) (int, bool) {
+	for _, value := range headers["Alt-Svc"] {
+		for _, service := range strings.Split(value, ",") {
+			proto, rest, ok := strings.Cut(strings.TrimSpace(service), "=")
+			if !ok || proto != "h3" {
+				continue
+			}
+			authority, _, _ := strings.Cut(rest, ";")
+			authority = strings.Trim(strings.TrimSpace(authority), `"`)
+			host, portStr, err := net.SplitHostPort(authority)
+			if err != nil || host != "" {
+				continue
+			}
+			if port, err := strconv.Atoi(portStr); err == nil && port > 0 && port <= 65535 {
+				return port, true
+			}
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,310 @@
+package probe
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// fromHex decodes a fixture, ignoring the spaces it is laid out with
+func fromHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// rfc9001Client is a client with the destination connection ID of RFC
+// 9001's Appendix A examples, and so their Initial keys
+func rfc9001Client(t *testing.T) *quicClient {
+	t.Helper()
+	c := &quicClient{dcid: fromHex(t, "8394c8f03e515708")}
+	for i := range c.spaces {
+		c.spaces[i].largestRecv = -1
+	}
+	c.deriveInitialKeys()
+	return c
+}
+
+// The Initial keys and header protection masks of RFC 9001 A.1-A.3
+func TestQUICInitialKeys(t *testing.T) {
+	c := rfc9001Client(t)
+	tests := []struct {
+		name         string
+		keys         *quicKeys
+		key, iv, hp  string
+		sample, mask string
+	}{
+		{"client", c.spaces[0].write,
+			"1f369613dd76d5467730efcbe3b1a22d", "fa044b2f42a3fd3b46fb255c", "9f50449e04a0e810283a1e9933adedd2",
+			"d1b1c98dd7689fb8ec11d242b123dc9b", "437b9aec36"},
+		{"server", c.spaces[0].read,
+			"cf3a5331653c364c88f0f379b6067e37", "0ac1493ca1905853b0bba03e", "c206b8d9b9f0f37644430b490eeaa314",
+			"2cd0991cd25b0aac406a5816b6394100", "2ec0d8356a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hex.EncodeToString(tt.keys.iv); got != tt.iv {
+				t.Errorf("iv %s, want %s", got, tt.iv)
+			}
+			// The keys themselves are inside the ciphers, so compare what
+			// they produce with ciphers keyed from the fixtures
+			block, _ := aes.NewCipher(fromHex(t, tt.key))
+			aead, _ := cipher.NewGCM(block)
+			nonce := tt.keys.nonce(0)
+			if want, got := aead.Seal(nil, nonce, []byte("payload"), nil), tt.keys.aead.Seal(nil, nonce, []byte("payload"), nil); !bytes.Equal(got, want) {
+				t.Errorf("packet key doesn't match %s", tt.key)
+			}
+			hp, _ := aes.NewCipher(fromHex(t, tt.hp))
+			sample := fromHex(t, tt.sample)
+			want := make([]byte, aes.BlockSize)
+			hp.Encrypt(want, sample)
+			mask := tt.keys.mask(sample)
+			if !bytes.Equal(mask, want) {
+				t.Errorf("header protection key doesn't match %s", tt.hp)
+			}
+			if got := hex.EncodeToString(mask[:5]); got != tt.mask {
+				t.Errorf("mask %s, want %s", got, tt.mask)
+			}
+		})
+	}
+}
+
+// The server's Initial of RFC 9001 A.3, carrying its ServerHello
+const rfc9001ServerInitial = `
+cf000000010008f067a5502a4262b5004075c0d95a482cd0991cd25b0aac406a
+5816b6394100f37a1c69797554780bb38cc5a99f5ede4cf73c3ec2493a1839b3
+dbcba3f6ea46c5b7684df3548e7ddeb9c3bf9c73cc3f3bded74b562bfb19fb84
+022f8ef4cdd93795d77d06edbb7aaf2f58891850abbdca3d20398c276456cbc4
+2158407dd074ee`
+
+func TestQUICOpenServerInitial(t *testing.T) {
+	c := rfc9001Client(t)
+	packet := fromHex(t, rfc9001ServerInitial)
+	// Flags, version, DCID length 0, SCID length and SCID, token length
+	// and the 2-byte length
+	pnOffset := 1 + 4 + 1 + 1 + 8 + 1 + 2
+	payload, pn, ok := c.spaces[0].read.open(packet, pnOffset)
+	if !ok {
+		t.Fatal("open failed")
+	}
+	want := fromHex(t, `
+02000000000600405a020000560303eefce7f7b37ba1d1632e96677825ddf739
+88cfc79825df566dc5430b9a045a1200130100002e00330024001d00209d3c94
+0d89690b84d08a60993c144eca684d1081287c834d5311bcf32bb9da1a002b00
+020304`)
+	if pn != 1 || !bytes.Equal(payload, want) {
+		t.Errorf("packet number %d, payload %x; want 1, %x", pn, payload, want)
+	}
+}
+
+func TestQUICHandleServerInitial(t *testing.T) {
+	c, err := newQUICClient("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.dcid = fromHex(t, "8394c8f03e515708")
+	c.deriveInitialKeys()
+
+	packet := fromHex(t, rfc9001ServerInitial)
+	if n := c.handlePacket(packet); n != len(packet) {
+		t.Fatalf("handled %d bytes of %d", n, len(packet))
+	}
+	if c.err != nil {
+		t.Fatal(c.err)
+	}
+	if got := hex.EncodeToString(c.dcid); got != "f067a5502a4262b5" {
+		t.Errorf("later packets go to %s, want the server's f067a5502a4262b5", got)
+	}
+	if c.spaces[0].largestRecv != 1 {
+		t.Errorf("largest Initial received %d, want 1", c.spaces[0].largestRecv)
+	}
+	// The ServerHello gives the Handshake keys
+	if c.spaces[1].read == nil || c.spaces[1].write == nil {
+		t.Error("no Handshake keys after the ServerHello")
+	}
+	// The ACK of packet 1 goes in a padded Initial, to the new ID
+	ack := c.ackDatagram()
+	if len(ack) != quicMinDatagram || !bytes.Equal(ack[6:14], c.dcid) {
+		t.Fatalf("ACK datagram of %d bytes to %x, want %d to %x", len(ack), ack[6:14], quicMinDatagram, c.dcid)
+	}
+	// Flags, version, both connection IDs, token length, length
+	payload, _, ok := c.spaces[0].write.open(ack, 1+4+1+8+1+8+1+2)
+	if !ok || !bytes.HasPrefix(payload, fromHex(t, "0201000001")) {
+		t.Errorf("ACK payload %x (ok %v), want it to start with 0201000001", payload, ok)
+	}
+}
+
+// The Retry of RFC 9001 A.4, whose token is "token"
+func TestQUICHandleRetry(t *testing.T) {
+	c := rfc9001Client(t)
+	before := c.spaces[0].write
+	packet := fromHex(t, "ff000000010008f067a5502a4262b5746f6b656e04a265ba2eff4d829058fb3f0f2496ba")
+	if n := c.handlePacket(packet); n != len(packet) {
+		t.Fatalf("handled %d bytes of %d", n, len(packet))
+	}
+	if !c.resend || string(c.token) != "token" || hex.EncodeToString(c.dcid) != "f067a5502a4262b5" {
+		t.Errorf("resend %v with token %q to %x, want token to f067a5502a4262b5", c.resend, c.token, c.dcid)
+	}
+	if c.spaces[0].write == before {
+		t.Error("Initial keys not derived again for the new connection ID")
+	}
+	// Only the first Retry counts
+	c.resend = false
+	c.handlePacket(fromHex(t, "ff000000010008aaaaaaaaaaaaaaaa6f74686572000000000000000000000000000000000000"))
+	if c.resend || string(c.token) != "token" {
+		t.Errorf("a second Retry was followed, token %q", c.token)
+	}
+}
+
+func TestQUICVersionNegotiation(t *testing.T) {
+	c := rfc9001Client(t)
+	// Unused bits, version 0, DCID, SCID, then the versions offered
+	packet := fromHex(t, "c5 00000000 00 08 f067a5502a4262b5 6b3343cf ff00001d")
+	if n := c.handlePacket(packet); n != len(packet) {
+		t.Fatalf("handled %d bytes of %d", n, len(packet))
+	}
+	if c.banner != "QUIC versions 0x6b3343cf, 0xff00001d" || c.err == nil {
+		t.Errorf("banner %q, err %v", c.banner, c.err)
+	}
+}
+
+func TestQUICIgnoresWhatItCantRead(t *testing.T) {
+	packet := fromHex(t, rfc9001ServerInitial)
+	corrupt := append([]byte(nil), packet...)
+	corrupt[len(corrupt)-1] ^= 1
+	tests := []struct {
+		name   string
+		packet []byte
+		want   int
+	}{
+		{"short header", fromHex(t, "4f f067a5502a4262b5 00112233"), 0},
+		{"truncated", packet[:12], 0},
+		{"other version", fromHex(t, "c0 ff00001d 00 00 00 00"), 0},
+		{"corrupt", corrupt, len(corrupt)}, // Skipped whole, as it says how long it is
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := rfc9001Client(t)
+			if n := c.handlePacket(tt.packet); n != tt.want {
+				t.Errorf("handled %d bytes, want %d", n, tt.want)
+			}
+			if c.spaces[0].largestRecv != -1 || c.err != nil {
+				t.Errorf("largest received %d, err %v; want nothing received", c.spaces[0].largestRecv, c.err)
+			}
+		})
+	}
+}
+
+// The client's Initial header of RFC 9001 A.2, packet number 2, padded
+// to 1200 bytes
+func TestQUICSealInitial(t *testing.T) {
+	c := rfc9001Client(t)
+	c.spaces[0].nextPN = 2
+	frames := appendCryptoFrame(nil, 0, []byte("client hello"))
+	datagram := c.sealPacket(nil, quicPacketInitial, frames, quicMinDatagram)
+	if len(datagram) != quicMinDatagram {
+		t.Fatalf("%d bytes, want %d", len(datagram), quicMinDatagram)
+	}
+	// Open it with the keys it was sealed with, as the server would
+	header := fromHex(t, "c300000001088394c8f03e5157080000449e00000002")
+	payload, pn, ok := c.spaces[0].write.open(datagram, len(header)-4)
+	if !ok || pn != 2 {
+		t.Fatalf("open: ok %v, packet number %d", ok, pn)
+	}
+	unprotected := append([]byte(nil), datagram[:len(header)]...)
+	mask := c.spaces[0].write.mask(datagram[len(header) : len(header)+16])
+	unprotected[0] ^= mask[0] & 0x0f
+	for i := 0; i < 4; i++ {
+		unprotected[len(header)-4+i] ^= mask[1+i]
+	}
+	if !bytes.Equal(unprotected, header) {
+		t.Errorf("header %x, want %x", unprotected, header)
+	}
+	if !bytes.HasPrefix(payload, frames) || len(bytes.Trim(payload[len(frames):], "\x00")) != 0 {
+		t.Errorf("payload %x, want the CRYPTO frame and PADDING", payload)
+	}
+	if c.spaces[0].nextPN != 3 {
+		t.Errorf("next packet number %d, want 3", c.spaces[0].nextPN)
+	}
+}
+
+func TestQUICFrames(t *testing.T) {
+	if got := hex.EncodeToString(appendAckFrame(nil, 1)); got != "0201000001" {
+		t.Errorf("ACK of 0-1: %s", got)
+	}
+	if got := hex.EncodeToString(appendCryptoFrame(nil, 64, []byte{0xaa})); got != "06404001aa" {
+		t.Errorf("CRYPTO at 64: %s", got)
+	}
+	tests := []struct {
+		name   string
+		frames string
+		want   string
+	}{
+		{"no protocol in common", "1c 4178 06 00", "quic: connection closed by server, no application protocol in common (the server doesn't offer h3)"},
+		{"other alert", "1c 4128 06 00", "quic: connection closed by server, TLS alert 40"},
+		{"transport error with a reason", "00 01 1c 0a 00 04 6e6f7065", "quic: connection closed by server, error 0xa: nope"},
+		{"application close", "1d 05 00", "quic: connection closed by server, error 0x5"},
+		{"ACK then close", "02 01 00 00 01 1c 01 00 00", "quic: connection closed by server, error 0x1"},
+		{"ACK with ECN counts", "03 01 00 01 00 00 00 01 02 03 1c 01 00 00", "quic: connection closed by server, error 0x1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := rfc9001Client(t)
+			c.handleFrames(0, &c.spaces[0], fromHex(t, tt.frames))
+			if c.err == nil || c.err.Error() != tt.want {
+				t.Errorf("err %v, want %s", c.err, tt.want)
+			}
+		})
+	}
+}
+
+func TestQUICCryptoStream(t *testing.T) {
+	var s quicCryptoStream
+	if got := s.push(5, []byte("world")); got != nil {
+		t.Errorf("data past a gap delivered: %q", got)
+	}
+	if got := s.push(0, []byte("hello")); len(got) != 2 || string(got[0])+string(got[1]) != "helloworld" {
+		t.Errorf("after the gap is filled: %q", got)
+	}
+	if got := s.push(0, []byte("hello")); got != nil {
+		t.Errorf("retransmission delivered: %q", got)
+	}
+	if got := s.push(8, []byte("ld!")); len(got) != 1 || string(got[0]) != "!" {
+		t.Errorf("overlapping data: %q, want the new byte", got)
+	}
+}
+
+// The examples of RFC 9000 A.1
+func TestQUICVarint(t *testing.T) {
+	tests := []struct {
+		encoded string
+		v       uint64
+	}{
+		{"c2197c5eff14e88c", 151288809941952652},
+		{"9d7f3e7d", 494878333},
+		{"7bbd", 15293},
+		{"25", 37},
+	}
+	for _, tt := range tests {
+		b := fromHex(t, tt.encoded)
+		if v, n := readVarint(b); v != tt.v || n != len(b) {
+			t.Errorf("readVarint(%s) = %d, %d; want %d, %d", tt.encoded, v, n, tt.v, len(b))
+		}
+		if got := hex.EncodeToString(appendVarint(nil, tt.v)); got != tt.encoded {
+			t.Errorf("appendVarint(%d) = %s, want %s", tt.v, got, tt.encoded)
+		}
+	}
+	// 37 in two bytes reads the same
+	if v, n := readVarint(fromHex(t, "4025")); v != 37 || n != 2 {
+		t.Errorf("readVarint(4025) = %d, %d", v, n)
+	}
+	if _, n := readVarint(fromHex(t, "9d7f")); n != 0 {
+		t.Error("a truncated varint was read")
+	}
+}
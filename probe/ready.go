@@ -0,0 +1,103 @@
+package probe
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Readiness is whether a service is ready to take requests
+type Readiness string
+
+const (
+	ReadinessDown     Readiness = "down"      // Not answering HTTP at all
+	ReadinessNotReady Readiness = "not-ready" // Answers HTTP, but not with 2xx
+	ReadinessReady    Readiness = "ready"     // Health path answered 2xx
+)
+
+// waitReadyInterval is the polling interval used by WaitReady when the
+// service doesn't ask for a specific delay with Retry-After
+const waitReadyInterval = 500 * time.Millisecond
+
+// ReadyResult is the outcome of a readiness probe
+type ReadyResult struct {
+	Readiness Readiness
+	// RetryAfter is the delay the service asked for with a Retry-After
+	// header, typically alongside 503 Service Unavailable
+	RetryAfter time.Duration
+	Result     ProbeResult
+}
+
+// ProbeReady probes path on host:port (default "/") and reports whether
+// the service is down, up but not ready, or ready. Only a 2xx answer counts
+// as ready; redirects are not followed.
+func ProbeReady(ctx context.Context, host string, port int, path string, opts ProbeOptions) ReadyResult {
+	if path != "" {
+		opts.Path, opts.Paths = path, nil
+	}
+	opts.FollowRedirects = false
+
+	result := probeWithOptions(ctx, host, port, opts)
+	ready := ReadyResult{Readiness: ReadinessDown, Result: result}
+	if result.StatusCode == 0 {
+		return ready
+	}
+
+	ready.Readiness = ReadinessNotReady
+	if result.StatusCode >= 200 && result.StatusCode < 300 {
+		ready.Readiness = ReadinessReady
+	}
+	ready.RetryAfter = parseRetryAfter(result.Headers.Get("Retry-After"), time.Now())
+	return ready
+}
+
+// WaitReady polls path on host:port until it is ready or ctx is done,
+// honouring any Retry-After the service sends. It returns the last result
+// and ctx.Err() if the service never became ready.
+func WaitReady(ctx context.Context, host string, port int, path string) (ReadyResult, error) {
+	return WaitReadyWithOptions(ctx, host, port, path, ProbeOptions{})
+}
+
+// WaitReadyWithOptions is WaitReady with the given probe options, such as
+// the headers a service needs before it answers 2xx. Invalid options are
+// returned as an error at once.
+func WaitReadyWithOptions(ctx context.Context, host string, port int, path string, opts ProbeOptions) (ReadyResult, error) {
+	if err := ValidateHeaders(opts.Headers); err != nil {
+		return ReadyResult{Readiness: ReadinessDown}, err
+	}
+	for {
+		ready := ProbeReady(ctx, host, port, path, opts)
+		if ready.Readiness == ReadinessReady {
+			return ready, nil
+		}
+		if ctx.Err() != nil {
+			return ready, ctx.Err()
+		}
+
+		wait := waitReadyInterval
+		if ready.RetryAfter > wait {
+			wait = ready.RetryAfter
+		}
+		if !sleepContext(ctx, wait) {
+			return ready, ctx.Err()
+		}
+	}
+}
+
+// parseRetryAfter reads a Retry-After value given either as seconds or as
+// an HTTP date
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
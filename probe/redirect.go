@@ -0,0 +1,100 @@
+package probe
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// followRedirects follows 3xx responses starting from result, which was
+// obtained for opts.Path on addr using scheme. Redirects to loopback targets
+// are followed (including other ports), redirects elsewhere are recorded but
+// not followed. A revisited URL ends the chain immediately.
+func followRedirects(ctx context.Context, result ProbeResult, scheme, addr string, opts ProbeOptions) ProbeResult {
+	if !opts.FollowRedirects || !isRedirect(result) {
+		return result
+	}
+
+	current, err := url.Parse(scheme + "://" + addr + opts.Path)
+	if err != nil {
+		return result
+	}
+	visited := map[string]bool{current.String(): true}
+	hop := result
+
+	for i := 0; i < opts.MaxRedirects && isRedirect(hop) && ctx.Err() == nil; i++ {
+		location := hop.Headers.Get("Location")
+		next, err := current.Parse(location)
+		if err != nil || (next.Scheme != "http" && next.Scheme != "https") {
+			result.Redirects = append(result.Redirects, hop.Response+" -> "+location+" (invalid)")
+			break
+		}
+
+		entry := hop.Response + " -> " + next.String()
+		if !isLoopbackHost(next.Hostname()) {
+			result.Redirects = append(result.Redirects, entry+" (external, not followed)")
+			break
+		}
+		if visited[next.String()] {
+			result.Redirects = append(result.Redirects, entry+" (loop)")
+			break
+		}
+		result.Redirects = append(result.Redirects, entry)
+		visited[next.String()] = true
+
+		hopOpts := opts
+		if urlPort(next) != urlPort(current) {
+			hopOpts.Credentials = nil
+		}
+		hop = probeURL(ctx, next, hopOpts)
+		final := hop
+		result.Final = &final
+		current = next
+	}
+
+	return result
+}
+
+// isRedirect reports whether a result is a redirect with a Location to follow
+func isRedirect(result ProbeResult) bool {
+	switch result.StatusCode {
+	case 301, 302, 303, 307, 308:
+		return result.Headers.Get("Location") != ""
+	}
+	return false
+}
+
+// probeURL probes a single absolute http(s) URL without any fallbacks
+func probeURL(ctx context.Context, u *url.URL, opts ProbeOptions) ProbeResult {
+	addr := net.JoinHostPort(u.Hostname(), urlPort(u))
+
+	req := opts.request(u.RequestURI())
+	if u.Scheme == "https" {
+		return probeTLS(ctx, addr, u.Hostname(), req, opts)
+	}
+	result, _ := probePlain(ctx, addr, req, opts)
+	return result
+}
+
+// urlPort returns the port of an http(s) URL, the scheme's default when it
+// has none
+func urlPort(u *url.URL) string {
+	switch {
+	case u.Port() != "":
+		return u.Port()
+	case u.Scheme == "https":
+		return "443"
+	}
+	return "80"
+}
+
+// isLoopbackHost reports whether host names this machine
+func isLoopbackHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,120 @@
+package probe
+
+import (
+	"context"
+	"encoding/binary"
+	"strings"
+)
+
+// grpcReflectionPaths are the reflection methods tried in order: v1, then
+// v1alpha for servers built before it was released
+var grpcReflectionPaths = []string{
+	"/grpc.reflection.v1.ServerReflection/ServerReflectionInfo",
+	"/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo",
+}
+
+// maxGRPCServices caps the names kept from a reflection answer
+const maxGRPCServices = 100
+
+// grpcListServices is a ServerReflectionRequest with list_services (field
+// 7) set to "*"
+var grpcListServices = []byte{7<<3 | 2, 1, '*'}
+
+// grpcServices asks the server's reflection service for the services it
+// offers, over a session on which isGRPC already succeeded. The
+// reflection service itself is left out of the list. A server without
+// reflection answers UNIMPLEMENTED and gets nil.
+func grpcServices(ctx context.Context, session *h2Session, scheme string, opts ProbeOptions) []string {
+	for _, path := range grpcReflectionPaths {
+		if ctx.Err() != nil {
+			return nil
+		}
+		resp, err := session.roundTrip(ctx, grpcRequestFields(scheme, path), grpcFrame(grpcListServices), opts)
+		if names, ok := parseListServices(resp.Data); ok {
+			return names
+		}
+		if err != nil {
+			return nil
+		}
+	}
+	return nil
+}
+
+// parseListServices reads the service names out of gRPC-framed
+// ServerReflectionResponse messages, reporting whether one held a
+// list_services_response (field 6). A list cut short by the response cap
+// gives the names that arrived whole.
+func parseListServices(data []byte) ([]string, bool) {
+	var names []string
+	found := false
+	for len(data) >= 5 && data[0] == 0 { // Not compressed
+		n := int(binary.BigEndian.Uint32(data[1:5]))
+		var msg []byte
+		if n > len(data)-5 {
+			msg, data = data[5:], nil
+		} else {
+			msg, data = data[5:5+n], data[5+n:]
+		}
+		for _, list := range protoBytesFields(msg, 6, true) {
+			found = true
+			for _, service := range protoBytesFields(list, 1, false) {
+				for _, name := range protoBytesFields(service, 1, false) {
+					if s := string(name); !strings.HasPrefix(s, "grpc.reflection.") && len(names) < maxGRPCServices {
+						names = append(names, s)
+					}
+				}
+			}
+		}
+	}
+	return names, found
+}
+
+// protoBytesFields returns the values of the length-delimited fields
+// numbered num in a protobuf message, stopping at the first malformed one.
+// With partial, a last field that runs past the end of msg is returned as
+// far as it goes.
+func protoBytesFields(msg []byte, num uint64, partial bool) [][]byte {
+	var values [][]byte
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			break
+		}
+		msg = msg[n:]
+		var size int
+		switch key & 7 {
+		case 0: // varint
+			_, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return values
+			}
+			size = n
+		case 1: // fixed64
+			size = 8
+		case 2: // length-delimited
+			length, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return values
+			}
+			if length > uint64(len(msg)-n) {
+				if partial && key>>3 == num {
+					values = append(values, msg[n:])
+				}
+				return values
+			}
+			if key>>3 == num {
+				values = append(values, msg[n:n+int(length)])
+			}
+			size = n + int(length)
+		case 5: // fixed32
+			size = 4
+		default:
+			return values
+		}
+		if size > len(msg) {
+			return values
+		}
+		msg = msg[size:]
+	}
+	return values
+}
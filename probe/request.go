@@ -0,0 +1,195 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// request describes an HTTP/1.x request written by the probe
+type request struct {
+	Method  string
+	Path    string
+	Version string      // "HTTP/1.0" or "HTTP/1.1"
+	Header  [][2]string // Header fields in the order they are written
+	MaxBody int         // Body bytes to read; 0 uses DefaultMaxBody
+	Body    []byte      // Sent with a Content-Length when not nil
+}
+
+// newRequest returns the default probe request for path: an HTTP/1.0 GET
+// with a localhost Host header
+func newRequest(path string) request {
+	return request{
+		Method:  "GET",
+		Path:    path,
+		Version: "HTTP/1.0",
+		Header:  [][2]string{{"Host", "localhost"}},
+	}
+}
+
+// request builds the probe request for path. With a custom Host the
+// request is sent as HTTP/1.1 with Connection: close, since virtual-host
+// routers may reject HTTP/1.0; otherwise it is the default HTTP/1.0 GET.
+func (o ProbeOptions) request(path string) request {
+	req := newRequest(path)
+	req.MaxBody = o.MaxBody
+	if o.Host != "" {
+		req.Version = "HTTP/1.1"
+		req.Header = [][2]string{{"Host", o.Host}, {"Connection", "close"}}
+	}
+	req.Header = append(req.Header, o.extraHeaders()...)
+	return req
+}
+
+// extraHeaders returns opts.Headers as header fields, sorted by name so
+// every request carries them in the same order, followed by the
+// credentials
+func (o ProbeOptions) extraHeaders() [][2]string {
+	creds := o.Credentials.fields()
+	fields := make([][2]string, 0, len(o.Headers)+len(creds))
+	for name, value := range o.Headers {
+		if len(creds) > 0 && (strings.EqualFold(name, "Authorization") || strings.EqualFold(name, "Cookie")) {
+			continue
+		}
+		fields = append(fields, [2]string{name, value})
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i][0] < fields[j][0] })
+	return append(fields, creds...)
+}
+
+// ErrInvalidHeader is returned for a custom header that would corrupt the
+// probe request
+var ErrInvalidHeader = errors.New("invalid header")
+
+// reservedHeaders are set by the probe itself: Host through
+// ProbeOptions.Host, the others because they change how the request and
+// response are framed
+var reservedHeaders = []string{"Host", "Connection", "Content-Length", "Transfer-Encoding"}
+
+// ValidateHeaders checks custom probe headers. A name must be an HTTP
+// token and not one of the headers the probe sets itself; a value may not
+// contain CR, LF or NUL, which would let it inject headers or a request
+// of its own.
+func ValidateHeaders(headers map[string]string) error {
+	for name, value := range headers {
+		if name == "" || strings.IndexFunc(name, func(r rune) bool { return !isTokenChar(r) }) >= 0 {
+			return fmt.Errorf("%w: name %q", ErrInvalidHeader, name)
+		}
+		for _, reserved := range reservedHeaders {
+			if strings.EqualFold(name, reserved) {
+				return fmt.Errorf("%w: %s is set by the probe", ErrInvalidHeader, reserved)
+			}
+		}
+		if strings.ContainsAny(value, "\r\n\x00") {
+			return fmt.Errorf("%w: value of %s contains CR, LF or NUL", ErrInvalidHeader, name)
+		}
+	}
+	return nil
+}
+
+// ParseHeader splits a "Name: value" header, as given on a command line or
+// in a settings file, and validates it like ValidateHeaders
+func ParseHeader(s string) (name, value string, err error) {
+	name, value, ok := strings.Cut(s, ":")
+	if !ok {
+		return "", "", fmt.Errorf("%w: %q is not \"Name: value\"", ErrInvalidHeader, s)
+	}
+	name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+	if err := ValidateHeaders(map[string]string{name: value}); err != nil {
+		return "", "", err
+	}
+	return name, value, nil
+}
+
+// isTokenChar reports whether r may appear in a header name (RFC 9110
+// section 5.6.2)
+func isTokenChar(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' ||
+		strings.ContainsRune("!#$%&'*+-.^_`|~", r)
+}
+
+// probeRequest builds the main probe request for opts.Path using
+// opts.Method
+func (o ProbeOptions) probeRequest() request {
+	req := o.request(o.Path)
+	if o.Method != "" {
+		req.Method = strings.ToUpper(o.Method)
+	}
+	return req
+}
+
+// method returns a copy of the request using a different method, sent as
+// HTTP/1.1 with Connection: close since HTTP/1.0 predates most methods
+func (r request) method(method string) request {
+	r.Method = method
+	if r.Version != "HTTP/1.1" {
+		r.Version = "HTTP/1.1"
+		r = r.with("Connection", "close")
+	}
+	return r
+}
+
+// with returns a copy of the request with an extra header field
+func (r request) with(key, value string) request {
+	header := make([][2]string, len(r.Header), len(r.Header)+1)
+	copy(header, r.Header)
+	r.Header = append(header, [2]string{key, value})
+	return r
+}
+
+// withBody returns a copy of the request carrying body as contentType
+func (r request) withBody(contentType string, body []byte) request {
+	r = r.with("Content-Type", contentType)
+	r.Body = body
+	return r
+}
+
+// bytes serializes the request head and body
+func (r request) bytes() []byte {
+	var b strings.Builder
+	b.WriteString(r.Method + " " + r.Path + " " + r.Version + "\r\n")
+	for _, field := range r.Header {
+		b.WriteString(field[0] + ": " + field[1] + "\r\n")
+	}
+	if r.Body != nil {
+		b.WriteString("Content-Length: " + strconv.Itoa(len(r.Body)) + "\r\n")
+	}
+	b.WriteString("\r\n")
+	b.Write(r.Body)
+	return []byte(b.String())
+}
+
+// headFallback retries a failed HEAD probe as GET using send. The retry
+// runs under deadline, the budget of the original probe, so falling back
+// never makes a probe slower than its configured limits.
+func headFallback(ctx context.Context, result ProbeResult, deadline time.Time, opts ProbeOptions, send func(context.Context, request) ProbeResult) ProbeResult {
+	if !strings.EqualFold(opts.Method, "HEAD") || !headFailed(result) || ctx.Err() != nil {
+		return result
+	}
+
+	budget, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	fallback := send(budget, opts.request(opts.Path))
+	if fallback.IsHTTP {
+		return fallback
+	}
+	return result
+}
+
+// headFailed reports whether a HEAD request was refused by the server:
+// 405 Method Not Allowed, 501 Not Implemented, or a connection closed
+// before any status line
+func headFailed(result ProbeResult) bool {
+	if result.IsHTTP {
+		return result.StatusCode == 405 || result.StatusCode == 501
+	}
+	return result.Response == "" && (errors.Is(result.Err, io.EOF) ||
+		errors.Is(result.Err, io.ErrUnexpectedEOF) ||
+		errors.Is(result.Err, syscall.ECONNRESET))
+}
@@ -0,0 +1,73 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"io"
+	"syscall"
+	"time"
+)
+
+// Defaults applied to a RetryPolicy with Attempts > 1
+const (
+	DefaultRetryBackoff    = 100 * time.Millisecond
+	DefaultRetryMultiplier = 2.0
+)
+
+// RetryPolicy controls retries for services that accept connections before
+// they are ready to answer. Only refused or reset connections and empty
+// reads are retried; once a server has sent a valid HTTP status line, or
+// anything else the probe could classify, the result is final.
+type RetryPolicy struct {
+	Attempts       int           // Total attempts including the first; <= 1 disables retries
+	InitialBackoff time.Duration // Wait before the second attempt (default 100ms)
+	Multiplier     float64       // Backoff growth per attempt (default 2)
+	MaxElapsed     time.Duration // Give up once this much time has passed; 0 means no limit
+}
+
+// withRetry runs attempt until it returns a final result, the policy is
+// exhausted or ctx is cancelled, and records the number of attempts made
+func withRetry(ctx context.Context, policy RetryPolicy, attempt func() ProbeResult) ProbeResult {
+	backoff := policy.InitialBackoff
+	if backoff <= 0 {
+		backoff = DefaultRetryBackoff
+	}
+	multiplier := policy.Multiplier
+	if multiplier < 1 {
+		multiplier = DefaultRetryMultiplier
+	}
+
+	start := time.Now()
+	var result ProbeResult
+	for n := 1; ; n++ {
+		result = attempt()
+		result.Attempts = n
+
+		if n >= policy.Attempts || !isRetryable(result) || ctx.Err() != nil {
+			return result
+		}
+		if policy.MaxElapsed > 0 && time.Since(start)+backoff > policy.MaxElapsed {
+			return result
+		}
+
+		if !sleepContext(ctx, backoff) {
+			return result
+		}
+		backoff = time.Duration(float64(backoff) * multiplier)
+	}
+}
+
+// isRetryable reports whether a result looks like a server that is still
+// starting: nothing was recognised and the connection was refused, reset
+// or closed without a single byte
+func isRetryable(result ProbeResult) bool {
+	if result.IsHTTP || result.Response != "" || result.Protocol != ProtocolUnknown ||
+		result.Kind != ServiceUnknown || result.Banner != "" || result.IsTLS {
+		return false
+	}
+	err := result.Err
+	return errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,521 @@
+package probe
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ReverseProxy names a reverse proxy that serves several apps on one port
+type ReverseProxy string
+
+const (
+	ProxyNone    ReverseProxy = ""
+	ProxyTraefik ReverseProxy = "traefik"
+	ProxyCaddy   ReverseProxy = "caddy"
+	ProxyNginx   ReverseProxy = "nginx"
+	ProxyApache  ReverseProxy = "apache"
+	ProxyEnvoy   ReverseProxy = "envoy"
+)
+
+// Where the admin APIs listen by default
+const (
+	DefaultTraefikAPI = "127.0.0.1:8080"
+	DefaultCaddyAPI   = "127.0.0.1:2019"
+)
+
+// RouteSource says how a route was found
+type RouteSource string
+
+const (
+	RouteTraefik RouteSource = "traefik-api" // Traefik's /api/http/routers
+	RouteCaddy   RouteSource = "caddy-api"   // Caddy's /config/
+	RouteVHost   RouteSource = "vhost"       // A candidate name that reached a virtual host of its own
+)
+
+// Route is one app a reverse proxy serves: the requests with its Host, or
+// under its path prefix, or both
+type Route struct {
+	Host    string      `json:"host,omitempty"`    // e.g. "shop.test"; empty for any
+	Path    string      `json:"path,omitempty"`    // e.g. "/api"; empty for every path
+	Backend string      `json:"backend,omitempty"` // Where the proxy sends them, e.g. "http://127.0.0.1:3000"
+	Router  string      `json:"router,omitempty"`  // The proxy's name for the route
+	Source  RouteSource `json:"source"`
+}
+
+// Key identifies the route among those of its proxy
+func (r Route) Key() string {
+	return strings.ToLower(r.Host) + r.Path
+}
+
+// String is how the proxy picks the route's requests, e.g. "shop.test/api"
+func (r Route) String() string {
+	if r.Host == "" {
+		return r.Path
+	}
+	return r.Host + r.Path
+}
+
+// RouteOptions say where the admin APIs are and which names to try as
+// virtual hosts
+type RouteOptions struct {
+	// TraefikAPI and CaddyAPI are the host:port of the admin APIs,
+	// default DefaultTraefikAPI and DefaultCaddyAPI
+	TraefikAPI string
+	CaddyAPI   string
+	// Candidates are the names tried as virtual hosts of a proxy without
+	// an admin API, besides those in its certificate
+	Candidates []string
+	// Probe are the options the APIs and virtual hosts are probed with;
+	// the follow-up checks are left out
+	Probe ProbeOptions
+}
+
+// maxProxyAPIBytes caps an admin API answer, which holds every route
+const maxProxyAPIBytes = 1 << 20
+
+// RouteFinder finds the apps reverse proxies serve. The admin APIs are
+// read once, on first use, so make one per scan.
+type RouteFinder struct {
+	opts RouteOptions
+
+	once sync.Once
+	apis map[int]apiRoutes // By the port the proxy serves them on
+}
+
+// apiRoutes are what an admin API reports on one port
+type apiRoutes struct {
+	proxy  ReverseProxy
+	routes []Route
+}
+
+// NewRouteFinder returns a finder reading the admin APIs opts names
+func NewRouteFinder(opts RouteOptions) *RouteFinder {
+	if opts.TraefikAPI == "" {
+		opts.TraefikAPI = DefaultTraefikAPI
+	}
+	if opts.CaddyAPI == "" {
+		opts.CaddyAPI = DefaultCaddyAPI
+	}
+	opts.Probe = opts.Probe.withDefaults()
+	opts.Probe.Paths, opts.Probe.Path, opts.Probe.Method = nil, "/", ""
+	opts.Probe.Retry = RetryPolicy{}
+	opts.Probe.FollowRedirects, opts.Probe.FrameworkPaths, opts.Probe.DetectFavicon = false, false, false
+	opts.Probe.DetectMethods, opts.Probe.DetectVersions, opts.Probe.DetectCORS = false, false, false
+	opts.Probe.DetectWebSocket, opts.Probe.DetectQUIC, opts.Probe.DetectAPISpec = false, false, false
+	return &RouteFinder{opts: opts}
+}
+
+// Find returns the reverse proxy that answered result on host:port and the
+// apps it serves there: those its admin API reports or, for a proxy known
+// by its Server header that offers none, the candidate names that reach a
+// virtual host other than its catch-all. It returns ProxyNone for anything
+// else.
+func (f *RouteFinder) Find(ctx context.Context, host string, port int, result ProbeResult) (ReverseProxy, []Route) {
+	if !result.IsHTTP {
+		return ProxyNone, nil
+	}
+	f.once.Do(func() { f.apis = f.readAPIs(ctx) })
+	if api, ok := f.apis[port]; ok {
+		return api.proxy, api.routes
+	}
+	proxy := DetectReverseProxy(result)
+	if proxy == ProxyNone {
+		return ProxyNone, nil
+	}
+	return proxy, f.virtualHosts(ctx, host, port, result)
+}
+
+// DetectReverseProxy names the reverse proxy a probe's Server header gives
+// away. Traefik sends none, and is only known through its API.
+func DetectReverseProxy(result ProbeResult) ReverseProxy {
+	server := strings.ToLower(result.Headers.Get("Server"))
+	switch {
+	case strings.HasPrefix(server, "caddy"):
+		return ProxyCaddy
+	case strings.HasPrefix(server, "nginx"), strings.HasPrefix(server, "openresty"):
+		return ProxyNginx
+	case strings.HasPrefix(server, "apache"):
+		return ProxyApache
+	case strings.HasPrefix(server, "envoy"):
+		return ProxyEnvoy
+	}
+	return ProxyNone
+}
+
+// virtualHosts tries the candidate names and those in the certificate on
+// host:port. The catch-all name is tried too: unless it gets the same
+// answer twice, the answers can't be told apart and none is taken. Sites
+// on one server often share a status line and Server header, so a page
+// title other than the catch-all's counts as a site of its own as well.
+func (f *RouteFinder) virtualHosts(ctx context.Context, host string, port int, result ProbeResult) []Route {
+	var names []string
+	for _, name := range f.opts.Candidates {
+		names = append(names, strings.ToLower(name))
+	}
+	if result.Cert != nil {
+		for _, name := range result.Cert.DNSNames {
+			names = append(names, strings.ToLower(name))
+		}
+	}
+	names = slices.DeleteFunc(names, func(name string) bool { return strings.Contains(name, "*") || name == "localhost" })
+	if len(names) == 0 {
+		return nil
+	}
+	results := ProbeVirtualHosts(ctx, host, port, append(names, catchAllName), f.opts.Probe)
+	catchAll := results[catchAllName]
+	if !catchAll.DefaultVHost {
+		return nil
+	}
+	var routes []Route
+	seen := make(map[string]bool)
+	for _, name := range names {
+		r := results[name]
+		if seen[name] || r.Err != nil || !r.IsHTTP || r.DefaultVHost && r.Title == catchAll.Title {
+			continue
+		}
+		seen[name] = true
+		routes = append(routes, Route{Host: name, Source: RouteVHost})
+	}
+	return routes
+}
+
+// readAPIs asks Traefik's and Caddy's admin APIs for their routes, by
+// port. A proxy whose API doesn't answer has none.
+func (f *RouteFinder) readAPIs(ctx context.Context) map[int]apiRoutes {
+	apis := make(map[int]apiRoutes)
+	for port, routes := range f.traefikRoutes(ctx) {
+		apis[port] = apiRoutes{proxy: ProxyTraefik, routes: routes}
+	}
+	for port, routes := range f.caddyRoutes(ctx) {
+		if _, ok := apis[port]; !ok {
+			apis[port] = apiRoutes{proxy: ProxyCaddy, routes: routes}
+		}
+	}
+	return apis
+}
+
+// getJSON decodes the answer to a GET of path from the admin API at addr
+// into v, reporting whether it got one
+func (f *RouteFinder) getJSON(ctx context.Context, addr, path string, v any) bool {
+	opts := f.opts.Probe
+	// Caddy only answers requests for its own address
+	opts.Host = addr
+	req := opts.request(path).with("Accept", "application/json")
+	req.MaxBody = maxProxyAPIBytes
+	resp := fetch(ctx, addr, "", false, req, opts)
+	if resp.StatusCode != http.StatusOK || resp.BodyTruncated {
+		return false
+	}
+	return json.Unmarshal(resp.BodySnippet, v) == nil
+}
+
+// Traefik's API documents, as far as they are read
+type (
+	traefikEntryPoint struct {
+		Name    string `json:"name"`
+		Address string `json:"address"` // e.g. ":80"
+	}
+	traefikRouter struct {
+		Name        string   `json:"name"` // e.g. "whoami@docker"
+		Provider    string   `json:"provider"`
+		Rule        string   `json:"rule"`
+		Service     string   `json:"service"`
+		EntryPoints []string `json:"entryPoints"`
+		Using       []string `json:"using"`
+		Status      string   `json:"status"`
+	}
+	traefikService struct {
+		Name         string `json:"name"`
+		LoadBalancer *struct {
+			Servers []struct {
+				URL string `json:"url"`
+			} `json:"servers"`
+		} `json:"loadBalancer"`
+	}
+)
+
+// traefikRoutes reads the HTTP routers of Traefik's API, by the port of
+// the entry points they are on. Its own routers, such as its dashboard's,
+// are left out.
+func (f *RouteFinder) traefikRoutes(ctx context.Context) map[int][]Route {
+	addr := f.opts.TraefikAPI
+	var entryPoints []traefikEntryPoint
+	if !f.getJSON(ctx, addr, "/api/entrypoints", &entryPoints) {
+		return nil
+	}
+	var routers []traefikRouter
+	if !f.getJSON(ctx, addr, "/api/http/routers?per_page=1000", &routers) {
+		return nil
+	}
+	var services []traefikService
+	f.getJSON(ctx, addr, "/api/http/services?per_page=1000", &services)
+	backends := make(map[string]string)
+	for _, s := range services {
+		if s.LoadBalancer != nil && len(s.LoadBalancer.Servers) > 0 {
+			backends[s.Name] = s.LoadBalancer.Servers[0].URL
+		}
+	}
+
+	ports := make(map[string]int)
+	for _, ep := range entryPoints {
+		if port, ok := listenPort(ep.Address); ok {
+			ports[ep.Name] = port
+		}
+	}
+	byPort := make(map[int][]Route)
+	for _, router := range routers {
+		if router.Provider == "internal" || router.Status == "disabled" {
+			continue
+		}
+		service := router.Service
+		if _, provider, ok := strings.Cut(router.Name, "@"); ok && !strings.Contains(service, "@") {
+			service += "@" + provider
+		}
+		on := router.Using
+		if len(on) == 0 {
+			on = router.EntryPoints
+		}
+		if len(on) == 0 {
+			// Every entry point but the API's own
+			for name := range ports {
+				if name != "traefik" {
+					on = append(on, name)
+				}
+			}
+		}
+		for _, route := range traefikRule(router.Rule) {
+			route.Backend, route.Router, route.Source = backends[service], router.Name, RouteTraefik
+			for _, ep := range on {
+				if port, ok := ports[ep]; ok {
+					byPort[port] = appendRoute(byPort[port], route)
+				}
+			}
+		}
+	}
+	return byPort
+}
+
+// Traefik rule matchers: Host(`a`, `b`) and PathPrefix(`/api`) or Path
+var (
+	traefikHost = regexp.MustCompile(`\bHost\(([^)]*)\)`)
+	traefikPath = regexp.MustCompile(`\b(?:PathPrefix|Path)\(([^)]*)\)`)
+)
+
+// traefikRule returns a route for each host a router rule matches, with
+// its path prefix. Rules matching neither, such as HostRegexp ones, give
+// none.
+func traefikRule(rule string) []Route {
+	path := ""
+	if m := traefikPath.FindStringSubmatch(rule); m != nil {
+		if args := ruleArgs(m[1]); len(args) > 0 {
+			path = routePath(args[0])
+		}
+	}
+	var hosts []string
+	for _, m := range traefikHost.FindAllStringSubmatch(rule, -1) {
+		hosts = append(hosts, ruleArgs(m[1])...)
+	}
+	if len(hosts) == 0 {
+		if path == "" {
+			return nil
+		}
+		hosts = []string{""}
+	}
+	routes := make([]Route, 0, len(hosts))
+	for _, host := range hosts {
+		routes = append(routes, Route{Host: strings.ToLower(host), Path: path})
+	}
+	return routes
+}
+
+// ruleArgs splits the quoted arguments of a rule matcher
+func ruleArgs(s string) []string {
+	var args []string
+	for _, arg := range strings.Split(s, ",") {
+		if arg = strings.Trim(strings.TrimSpace(arg), "`\"'"); arg != "" {
+			args = append(args, arg)
+		}
+	}
+	return args
+}
+
+// Caddy's JSON config, as far as routes go
+type (
+	caddyConfig struct {
+		Apps struct {
+			HTTP struct {
+				Servers map[string]caddyServer `json:"servers"`
+			} `json:"http"`
+		} `json:"apps"`
+	}
+	caddyServer struct {
+		Listen []string     `json:"listen"`
+		Routes []caddyRoute `json:"routes"`
+	}
+	caddyRoute struct {
+		Match  []caddyMatch   `json:"match"`
+		Handle []caddyHandler `json:"handle"`
+	}
+	caddyMatch struct {
+		Host []string `json:"host"`
+		Path []string `json:"path"`
+	}
+	caddyHandler struct {
+		Handler   string       `json:"handler"`
+		Routes    []caddyRoute `json:"routes"` // Of a subroute
+		Upstreams []struct {
+			Dial string `json:"dial"`
+		} `json:"upstreams"`
+	}
+)
+
+// caddyRoutes reads the HTTP servers of Caddy's config, by the ports they
+// listen on
+func (f *RouteFinder) caddyRoutes(ctx context.Context) map[int][]Route {
+	var cfg caddyConfig
+	if !f.getJSON(ctx, f.opts.CaddyAPI, "/config/", &cfg) {
+		return nil
+	}
+	byPort := make(map[int][]Route)
+	names := make([]string, 0, len(cfg.Apps.HTTP.Servers))
+	for name := range cfg.Apps.HTTP.Servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		server := cfg.Apps.HTTP.Servers[name]
+		var routes []Route
+		for _, route := range caddyWalk(server.Routes, "", "") {
+			route.Router, route.Source = name, RouteCaddy
+			routes = appendRoute(routes, route)
+		}
+		for _, addr := range server.Listen {
+			for _, port := range listenPorts(addr) {
+				for _, route := range routes {
+					byPort[port] = appendRoute(byPort[port], route)
+				}
+			}
+		}
+	}
+	return byPort
+}
+
+// caddyWalk returns the routes matching a host or path, with the matchers
+// of enclosing subroutes applied to those within
+func caddyWalk(routes []caddyRoute, host, path string) []Route {
+	var out []Route
+	for _, route := range routes {
+		matches := route.Match
+		if len(matches) == 0 {
+			matches = []caddyMatch{{}}
+		}
+		for _, m := range matches {
+			hosts := m.Host
+			if len(hosts) == 0 {
+				hosts = []string{host}
+			}
+			p := path
+			if len(m.Path) > 0 {
+				p = routePath(m.Path[0])
+			}
+			for _, h := range hosts {
+				if strings.Contains(h, "*") {
+					continue
+				}
+				out = append(out, caddyHandlers(route.Handle, strings.ToLower(h), p)...)
+			}
+		}
+	}
+	return out
+}
+
+// caddyHandlers returns the route a list of handlers makes for host and
+// path, pointing at its first reverse_proxy upstream, and those of its
+// subroutes
+func caddyHandlers(handlers []caddyHandler, host, path string) []Route {
+	var out []Route
+	serves := false
+	backend := ""
+	for _, h := range handlers {
+		switch h.Handler {
+		case "subroute":
+			out = append(out, caddyWalk(h.Routes, host, path)...)
+		case "reverse_proxy":
+			if backend == "" && len(h.Upstreams) > 0 {
+				backend = h.Upstreams[0].Dial
+			}
+			serves = true
+		case "file_server", "static_response", "php_fastcgi":
+			serves = true
+		}
+	}
+	if serves && (host != "" || path != "") {
+		out = append([]Route{{Host: host, Path: path, Backend: backend}}, out...)
+	}
+	return out
+}
+
+// routePath turns a path matcher into a prefix: "/api/*" and "/api/" are
+// "/api", and "/" or "*" match every path
+func routePath(path string) string {
+	return strings.TrimRight(strings.TrimSuffix(path, "*"), "/")
+}
+
+// appendRoute appends route unless one for the same host and path is there
+func appendRoute(routes []Route, route Route) []Route {
+	for _, r := range routes {
+		if r.Key() == route.Key() {
+			return routes
+		}
+	}
+	return append(routes, route)
+}
+
+// listenPort returns the port of a listen address such as ":80" or
+// "127.0.0.1:8443"
+func listenPort(addr string) (int, bool) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0, false
+	}
+	n, err := strconv.Atoi(port)
+	return n, err == nil && n > 0 && n <= 65535
+}
+
+// listenPorts returns the ports of a Caddy listen address, which may name
+// a network or a range, e.g. "tcp/:8080" or ":8080-8082"; Unix sockets
+// have none
+func listenPorts(addr string) []int {
+	if network, rest, ok := strings.Cut(addr, "/"); ok {
+		if !strings.HasPrefix(network, "tcp") {
+			return nil
+		}
+		addr = rest
+	}
+	i := strings.LastIndex(addr, ":")
+	if i < 0 {
+		return nil
+	}
+	from, to, isRange := strings.Cut(addr[i+1:], "-")
+	if !isRange {
+		to = from
+	}
+	first, err1 := strconv.Atoi(from)
+	last, err2 := strconv.Atoi(to)
+	if err1 != nil || err2 != nil || first <= 0 || last > 65535 || last < first || last-first > 100 {
+		return nil
+	}
+	var ports []int
+	for port := first; port <= last; port++ {
+		ports = append(ports, port)
+	}
+	return ports
+}
@@ -0,0 +1,345 @@
+package probe
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServiceKind identifies a well-known (mostly non-HTTP) service type
+type ServiceKind string
+
+const (
+	ServiceUnknown   ServiceKind = ""
+	ServiceHTTP      ServiceKind = "http"
+	ServiceRedis     ServiceKind = "redis"
+	ServicePostgres  ServiceKind = "postgres"
+	ServiceMySQL     ServiceKind = "mysql"
+	ServiceMongoDB   ServiceKind = "mongodb"
+	ServiceMemcached ServiceKind = "memcached"
+	ServiceSSH       ServiceKind = "ssh"
+	ServiceSMTP      ServiceKind = "smtp"
+	ServiceFTP       ServiceKind = "ftp"
+	ServiceQUIC      ServiceKind = "quic" // QUIC on a UDP port, see ProbeQUIC
+	ServiceDNS       ServiceKind = "dns"  // UDP, see ProbeUDP
+	ServiceMDNS      ServiceKind = "mdns" // UDP, see ProbeUDP
+)
+
+// greetingTimeout is how long ProbeService waits for a server that talks
+// first before it starts sending fingerprint payloads
+const greetingTimeout = 300 * time.Millisecond
+
+// maxFingerprintRead caps the bytes read in response to a fingerprint
+const maxFingerprintRead = 4096
+
+// fingerprint describes how to recognize one protocol. It is the Detector
+// of the built-in protocols.
+type fingerprint struct {
+	Kind ServiceKind
+	// Port is the protocol's conventional port, tried first when it matches
+	Port int
+	// Greeting protocols send a greeting on connect; Payload is ignored
+	Greeting bool
+	// Payload is written before reading the response
+	Payload []byte
+	// Match inspects the response and returns whether it belongs to this
+	// protocol, plus any banner or version string it carries
+	Match func(resp []byte) (ok bool, banner string)
+}
+
+// fingerprints is the table of built-in protocols. Greeting entries are
+// matched against the greeting; the others are tried one per connection
+// so their payloads can't confuse each other.
+var fingerprints = []fingerprint{
+	{
+		Kind:     ServiceSSH,
+		Port:     22,
+		Greeting: true,
+		Match: func(resp []byte) (bool, string) {
+			line := firstLine(resp)
+			return strings.HasPrefix(line, "SSH-"), line
+		},
+	},
+	{
+		Kind:     ServiceFTP,
+		Port:     21,
+		Greeting: true,
+		Match: func(resp []byte) (bool, string) {
+			line := firstLine(resp)
+			return strings.HasPrefix(line, "220") && strings.Contains(strings.ToUpper(line), "FTP"), line
+		},
+	},
+	{
+		Kind:     ServiceSMTP,
+		Port:     25,
+		Greeting: true,
+		Match: func(resp []byte) (bool, string) {
+			line := firstLine(resp)
+			upper := strings.ToUpper(line)
+			return strings.HasPrefix(line, "220") &&
+				(strings.Contains(upper, "SMTP") || strings.Contains(upper, "MAIL")), line
+		},
+	},
+	{
+		Kind:     ServiceMySQL,
+		Port:     3306,
+		Greeting: true,
+		Match:    matchMySQLGreeting,
+	},
+	{
+		Kind:    ServiceRedis,
+		Port:    6379,
+		Payload: []byte("PING\r\n"),
+		Match: func(resp []byte) (bool, string) {
+			line := firstLine(resp)
+			// -NOAUTH and -ERR replies still come from Redis
+			ok := line == "+PONG" || strings.HasPrefix(line, "-NOAUTH") || strings.HasPrefix(line, "-ERR")
+			return ok, line
+		},
+	},
+	{
+		Kind: ServicePostgres,
+		Port: 5432,
+		// SSLRequest: length 8, code 80877103
+		Payload: []byte{0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x2f},
+		Match: func(resp []byte) (bool, string) {
+			if len(resp) == 0 {
+				return false, ""
+			}
+			switch resp[0] {
+			case 'S', 'N':
+				return len(resp) == 1, ""
+			case 'E':
+				// ErrorResponse: 'E', int32 length, then typed fields
+				if len(resp) < 6 {
+					return false, ""
+				}
+				length := binary.BigEndian.Uint32(resp[1:5])
+				return length >= 5 && length < maxFingerprintRead && resp[5] == 'S', ""
+			}
+			return false, ""
+		},
+	},
+	{
+		Kind:    ServiceMongoDB,
+		Port:    27017,
+		Payload: mongoIsMaster(),
+		Match: func(resp []byte) (bool, string) {
+			if len(resp) < 16 {
+				return false, ""
+			}
+			// Reply opcode: OP_MSG (2013) or legacy OP_REPLY (1)
+			opCode := binary.LittleEndian.Uint32(resp[12:16])
+			return opCode == 2013 || opCode == 1, ""
+		},
+	},
+	{
+		Kind:    ServiceMemcached,
+		Port:    11211,
+		Payload: []byte("version\r\n"),
+		Match: func(resp []byte) (bool, string) {
+			line := firstLine(resp)
+			if strings.HasPrefix(line, "VERSION ") {
+				return true, strings.TrimPrefix(line, "VERSION ")
+			}
+			return false, ""
+		},
+	},
+}
+
+// Name implements Detector
+func (fp fingerprint) Name() string {
+	return string(fp.Kind)
+}
+
+// SpeaksFirst implements Detector
+func (fp fingerprint) SpeaksFirst() bool {
+	return fp.Greeting
+}
+
+// Detect implements Detector: greetings are matched as they are, other
+// protocols get Payload and their reply is matched
+func (fp fingerprint) Detect(ctx context.Context, conn net.Conn, firstBytes []byte) (*Detection, error) {
+	resp := firstBytes
+	if !fp.Greeting {
+		if _, err := conn.Write(fp.Payload); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, maxFingerprintRead)
+		n, err := conn.Read(buf)
+		if err != nil && n == 0 {
+			return nil, err
+		}
+		resp = buf[:n]
+	}
+	if ok, banner := fp.Match(resp); ok {
+		return &Detection{Kind: fp.Kind, Banner: banner}, nil
+	}
+	return nil, nil
+}
+
+// ProbeService identifies common non-HTTP services on host:port by their
+// wire protocol, using the built-in and registered detectors (see
+// RegisterDetector). Result.Kind is ServiceUnknown if nothing matched.
+func ProbeService(host string, port int) ProbeResult {
+	return ProbeServiceContext(context.Background(), host, port, ProbeOptions{})
+}
+
+// ProbeServiceContext is like ProbeService but stops as soon as ctx is
+// cancelled, and dials and reads with the timeouts and Dialer of opts
+func ProbeServiceContext(ctx context.Context, host string, port int, opts ProbeOptions) ProbeResult {
+	result := probeService(ctx, host, port, opts.withDefaults())
+	result.Port = port
+	return result
+}
+
+// probeService runs every detector against host:port
+func probeService(ctx context.Context, host string, port int, opts ProbeOptions) ProbeResult {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+
+	// Listen first so we don't talk over a server that greets immediately
+	conn, err := opts.dial(ctx, "tcp", addr)
+	if err != nil {
+		return ProbeResult{Err: contextError(ctx, err)}
+	}
+	greeting, err := readBanner(ctx, conn, greetingTimeout)
+	if err != nil && len(greeting) == 0 && !isTimeout(err) {
+		conn.Close()
+		return ProbeResult{Err: contextError(ctx, err)}
+	}
+	if len(greeting) > 0 {
+		defer conn.Close()
+		conn.SetDeadline(phaseDeadline(ctx, opts.ReadTimeout))
+		return classifyGreeting(ctx, conn, greeting, port)
+	}
+	conn.Close()
+
+	ds := registeredDetectors(false)
+	for _, fp := range orderedFingerprints(port) {
+		ds = append(ds, fp)
+	}
+	if det := detectWriteFirst(ctx, addr, ds, opts); det != nil {
+		return ProbeResult{Kind: det.Kind, Banner: det.Banner}
+	}
+	if ctx.Err() != nil {
+		return ProbeResult{Err: ctx.Err()}
+	}
+	return ProbeResult{}
+}
+
+// classifyGreeting runs the speaks-first detectors on data a server sent,
+// over conn, before we wrote anything. A bare "220" greeting that names
+// neither FTP nor SMTP is classified by its conventional port.
+func classifyGreeting(ctx context.Context, conn net.Conn, greeting []byte, port int) ProbeResult {
+	if det := detectGreeting(ctx, conn, greeting); det != nil {
+		return ProbeResult{Kind: det.Kind, Banner: det.Banner}
+	}
+
+	banner := printableBanner(greeting)
+	if strings.HasPrefix(banner, "220") {
+		switch port {
+		case 21, 2121:
+			return ProbeResult{Kind: ServiceFTP, Banner: banner}
+		case 25, 465, 587, 1025, 2525:
+			return ProbeResult{Kind: ServiceSMTP, Banner: banner}
+		}
+	}
+	return ProbeResult{Banner: banner}
+}
+
+// orderedFingerprints returns the write-first fingerprints, moving the one
+// whose conventional port matches to the front
+func orderedFingerprints(port int) []fingerprint {
+	var first, rest []fingerprint
+	for _, fp := range fingerprints {
+		if fp.Greeting {
+			continue
+		}
+		if fp.Port == port {
+			first = append(first, fp)
+		} else {
+			rest = append(rest, fp)
+		}
+	}
+	return append(first, rest...)
+}
+
+// readBanner waits up to timeout for the server to send something
+func readBanner(ctx context.Context, conn net.Conn, timeout time.Duration) ([]byte, error) {
+	conn.SetReadDeadline(phaseDeadline(ctx, timeout))
+	buf := make([]byte, maxFingerprintRead)
+	n, err := conn.Read(buf)
+	return buf[:n], err
+}
+
+// matchMySQLGreeting recognizes the MySQL/MariaDB initial handshake packet:
+// a 3-byte length, sequence id 0, protocol version 10, then a
+// NUL-terminated server version string
+func matchMySQLGreeting(resp []byte) (bool, string) {
+	if len(resp) < 6 || resp[3] != 0 || resp[4] != 10 {
+		return false, ""
+	}
+	version := resp[5:]
+	end := bytes.IndexByte(version, 0)
+	if end <= 0 {
+		return false, ""
+	}
+	return true, string(version[:end])
+}
+
+// mongoIsMaster builds an OP_MSG carrying {isMaster: 1, $db: "admin"}
+func mongoIsMaster() []byte {
+	// BSON document
+	var doc []byte
+	doc = append(doc, 0x10) // int32 element
+	doc = append(doc, "isMaster\x00"...)
+	doc = binary.LittleEndian.AppendUint32(doc, 1)
+	doc = append(doc, 0x02) // string element
+	doc = append(doc, "$db\x00"...)
+	doc = binary.LittleEndian.AppendUint32(doc, uint32(len("admin")+1))
+	doc = append(doc, "admin\x00"...)
+	doc = append(doc, 0x00)
+	doc = append(binary.LittleEndian.AppendUint32(nil, uint32(len(doc)+4)), doc...)
+
+	// flagBits, section kind 0 (body), document
+	body := binary.LittleEndian.AppendUint32(nil, 0)
+	body = append(body, 0x00)
+	body = append(body, doc...)
+
+	// Header: messageLength, requestID, responseTo, opCode (OP_MSG)
+	msg := binary.LittleEndian.AppendUint32(nil, uint32(16+len(body)))
+	msg = binary.LittleEndian.AppendUint32(msg, 1)
+	msg = binary.LittleEndian.AppendUint32(msg, 0)
+	msg = binary.LittleEndian.AppendUint32(msg, 2013)
+	return append(msg, body...)
+}
+
+// firstLine returns the first line of resp without its line terminator
+func firstLine(resp []byte) string {
+	if i := bytes.IndexByte(resp, '\n'); i >= 0 {
+		resp = resp[:i]
+	}
+	return strings.TrimRight(string(resp), "\r")
+}
+
+// printableBanner returns the first line of a greeting if it is printable text
+func printableBanner(greeting []byte) string {
+	line := firstLine(greeting)
+	for _, r := range line {
+		if r < 0x20 && r != '\t' || r == 0x7f {
+			return ""
+		}
+	}
+	return line
+}
+
+// isTimeout reports whether err is a network timeout
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,70 @@
+package probe
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"syscall"
+)
+
+// State is the overall classification of a probed port
+type State string
+
+const (
+	StateUnknown     State = ""              // Probe was cancelled before it could tell
+	StateClosed      State = "closed"        // Connection refused: nothing is listening
+	StateFiltered    State = "filtered"      // Connect timed out or was blocked
+	StateOpenSilent  State = "open-silent"   // Accepted the connection but never answered
+	StateOpenNonHTTP State = "open-non-http" // Answered with something other than HTTP
+	StateHTTP        State = "http"          // Plaintext HTTP (HTTP/1.x, h2c or gRPC)
+	StateTLS         State = "tls"           // Completed a TLS handshake; IsHTTP says if HTTPS
+)
+
+// Typed errors set in ProbeResult.Err. They wrap the underlying network
+// error, so errors.Is matches both the typed error and e.g. the errno.
+var (
+	ErrRefused = errors.New("connection refused")
+	ErrTimeout = errors.New("timed out")
+	ErrReset   = errors.New("connection reset")
+)
+
+// classifyError wraps err in the matching typed error, if any
+func classifyError(err error) error {
+	switch {
+	case err == nil || isContextError(err):
+		return err
+	case errors.Is(err, ErrRefused) || errors.Is(err, ErrTimeout) || errors.Is(err, ErrReset):
+		return err // Already classified
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return fmt.Errorf("%w: %w", ErrRefused, err)
+	case errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE):
+		return fmt.Errorf("%w: %w", ErrReset, err)
+	case isTimeout(err):
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	}
+	return err
+}
+
+// classifyState derives the State of a finished probe. connected reports
+// whether any connection to the service was established.
+func classifyState(result ProbeResult, connected bool) State {
+	switch {
+	case result.IsTLS:
+		return StateTLS
+	case result.IsHTTP || result.Protocol != ProtocolUnknown:
+		return StateHTTP
+	case result.Kind != ServiceUnknown || result.Banner != "" || result.Response != "":
+		return StateOpenNonHTTP
+	case errors.Is(result.Err, ErrReset):
+		// Reset before any reply, as TLS-only and picky servers do; one
+		// that resets as it accepts fails the dial itself
+		return StateOpenNonHTTP
+	case connected:
+		return StateOpenSilent
+	case isContextError(result.Err):
+		return StateUnknown
+	case errors.Is(result.Err, ErrRefused), errors.Is(result.Err, fs.ErrNotExist), errors.Is(result.Err, ErrNotSocket):
+		return StateClosed
+	}
+	return StateFiltered
+}
@@ -0,0 +1,254 @@
+package probe
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// listen serves every connection to a loopback port with handle, and
+// returns the port
+func listen(t *testing.T, ln net.Listener, handle func(net.Conn)) int {
+	t.Helper()
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func tcpListener(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ln
+}
+
+// tlsListener is a TLS listener with httptest's certificate
+func tlsListener(t *testing.T) net.Listener {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	srv.StartTLS()
+	config := srv.TLS.Clone()
+	srv.Close()
+	return tls.NewListener(tcpListener(t), config)
+}
+
+// quietTLSServer is an httptest TLS server that doesn't log the
+// plaintext requests probes send it before trying TLS
+func quietTLSServer(handler http.Handler) *httptest.Server {
+	srv := httptest.NewUnstartedServer(handler)
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	return srv
+}
+
+func TestStateWithRealListeners(t *testing.T) {
+	tests := []struct {
+		name   string
+		listen func(t *testing.T) int
+		state  State
+		err    error // Matched with errors.Is; nil wants no error
+		http   bool
+	}{
+		{
+			name: "nothing listening",
+			listen: func(t *testing.T) int {
+				ln := tcpListener(t)
+				ln.Close()
+				return ln.Addr().(*net.TCPAddr).Port
+			},
+			state: StateClosed, err: ErrRefused,
+		},
+		{
+			name: "silent",
+			listen: func(t *testing.T) int {
+				return listen(t, tcpListener(t), func(conn net.Conn) {
+					io.Copy(io.Discard, conn) // Reads the request, never answers
+				})
+			},
+			state: StateOpenSilent, err: ErrTimeout,
+		},
+		{
+			name: "garbage",
+			listen: func(t *testing.T) int {
+				return listen(t, tcpListener(t), func(conn net.Conn) {
+					defer conn.Close()
+					conn.Read(make([]byte, 512))
+					conn.Write([]byte("\x00\x00\x00\x01what is this\r\n"))
+				})
+			},
+			state: StateOpenNonHTTP,
+		},
+		{
+			name: "reset on connect",
+			listen: func(t *testing.T) int {
+				return listen(t, tcpListener(t), func(conn net.Conn) {
+					conn.(*net.TCPConn).SetLinger(0)
+					conn.Close()
+				})
+			},
+			state: StateOpenNonHTTP, err: ErrReset,
+		},
+		{
+			name: "HTTP",
+			listen: func(t *testing.T) int {
+				return listen(t, tcpListener(t), func(conn net.Conn) {
+					defer conn.Close()
+					conn.Read(make([]byte, 512))
+					fmt.Fprint(conn, "HTTP/1.1 204 No Content\r\nConnection: close\r\n\r\n")
+				})
+			},
+			state: StateHTTP, http: true,
+		},
+		{
+			name: "HTTPS",
+			listen: func(t *testing.T) int {
+				srv := quietTLSServer(http.NotFoundHandler())
+				t.Cleanup(srv.Close)
+				return srv.Listener.Addr().(*net.TCPAddr).Port
+			},
+			state: StateTLS, http: true,
+		},
+		{
+			name: "TLS, not HTTP",
+			listen: func(t *testing.T) int {
+				return listen(t, tlsListener(t), func(conn net.Conn) {
+					defer conn.Close()
+					conn.(*tls.Conn).Handshake()
+					conn.Read(make([]byte, 512))
+					conn.Write([]byte("* OK IMAP4rev1 ready\r\n"))
+				})
+			},
+			state: StateTLS,
+		},
+	}
+	opts := ProbeOptions{DialTimeout: 200 * time.Millisecond, ReadTimeout: 200 * time.Millisecond, BannerTimeout: 50 * time.Millisecond}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port := tt.listen(t)
+			result := ProbeWithOptions("127.0.0.1", port, opts)
+			if result.State != tt.state {
+				t.Errorf("State %q, want %q (Err %v)", result.State, tt.state, result.Err)
+			}
+			if result.IsHTTP != tt.http {
+				t.Errorf("IsHTTP %v, want %v", result.IsHTTP, tt.http)
+			}
+			switch {
+			case tt.err == nil && result.Err != nil && tt.state == StateHTTP:
+				t.Errorf("Err %v, want none", result.Err)
+			case tt.err != nil && !errors.Is(result.Err, tt.err):
+				t.Errorf("Err %v, want %v", result.Err, tt.err)
+			}
+		})
+	}
+}
+
+func TestStateCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	port := listen(t, tcpListener(t), func(conn net.Conn) { io.Copy(io.Discard, conn) })
+	result := ProbeContext(ctx, "127.0.0.1", port)
+	if result.State != StateUnknown || !errors.Is(result.Err, context.Canceled) {
+		t.Errorf("State %q, Err %v; want unknown and cancelled", result.State, result.Err)
+	}
+}
+
+// timeoutError is a net.Error that timed out, as a deadline produces
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassifyError(t *testing.T) {
+	opErr := func(err error) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", err)}
+	}
+	tests := []struct {
+		name string
+		err  error
+		want error // nil wants err returned as is
+	}{
+		{"refused", opErr(syscall.ECONNREFUSED), ErrRefused},
+		{"reset", opErr(syscall.ECONNRESET), ErrReset},
+		{"broken pipe", opErr(syscall.EPIPE), ErrReset},
+		{"deadline", &net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}, ErrTimeout},
+		{"unreachable", opErr(syscall.EHOSTUNREACH), nil},
+		{"cancelled", fmt.Errorf("dial: %w", context.Canceled), nil},
+		{"EOF", io.EOF, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := classifyError(tt.err)
+			if !errors.Is(got, tt.err) {
+				t.Errorf("%v no longer matches the error it wraps", got)
+			}
+			if tt.want == nil {
+				if got != tt.err {
+					t.Errorf("classifyError = %v, want it unchanged", got)
+				}
+				return
+			}
+			if !errors.Is(got, tt.want) {
+				t.Errorf("classifyError = %v, want %v", got, tt.want)
+			}
+			if again := classifyError(got); again != got {
+				t.Errorf("classifying twice gave %v", again)
+			}
+		})
+	}
+	if classifyError(nil) != nil {
+		t.Error("classifyError(nil) isn't nil")
+	}
+}
+
+func TestClassifyState(t *testing.T) {
+	refused := classifyError(&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)})
+	timedOut := classifyError(&net.OpError{Op: "dial", Err: timeoutError{}})
+	reset := classifyError(&net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)})
+	tests := []struct {
+		name      string
+		result    ProbeResult
+		connected bool
+		want      State
+	}{
+		{"refused", ProbeResult{Err: refused}, false, StateClosed},
+		{"dial timed out", ProbeResult{Err: timedOut}, false, StateFiltered},
+		{"unreachable", ProbeResult{Err: os.NewSyscallError("connect", syscall.EHOSTUNREACH)}, false, StateFiltered},
+		{"cancelled", ProbeResult{Err: context.Canceled}, false, StateUnknown},
+		{"stale socket file", ProbeResult{Err: os.ErrNotExist}, false, StateClosed},
+		{"connected, silent", ProbeResult{Err: timedOut}, true, StateOpenSilent},
+		{"connected, reset", ProbeResult{Err: reset}, true, StateOpenNonHTTP},
+		{"reset while connecting", ProbeResult{Err: reset}, false, StateOpenNonHTTP},
+		{"banner", ProbeResult{Banner: "SSH-2.0-OpenSSH_9.6", Kind: ServiceSSH}, true, StateOpenNonHTTP},
+		{"garbage", ProbeResult{Response: "\x00\x01"}, true, StateOpenNonHTTP},
+		{"HTTP", ProbeResult{IsHTTP: true, Protocol: ProtocolHTTP1}, true, StateHTTP},
+		{"gRPC", ProbeResult{Protocol: ProtocolGRPC}, true, StateHTTP},
+		{"TLS", ProbeResult{IsTLS: true}, true, StateTLS},
+		{"HTTPS", ProbeResult{IsTLS: true, IsHTTP: true}, true, StateTLS},
+	}
+	for _, tt := range tests {
+		if got := classifyState(tt.result, tt.connected); got != tt.want {
+			t.Errorf("%s: classifyState = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package probe
+
+import (
+	"strconv"
+	"strings"
+)
+
+// parseStatusLine splits an HTTP status line such as "HTTP/1.1 404 Not Found"
+// into its version, code and reason phrase. It tolerates a lowercase
+// protocol name, runs of whitespace and a missing reason phrase. ok is false
+// if the line is not a recognizable status line.
+func parseStatusLine(line string) (version string, code int, text string, ok bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return "", 0, "", false
+	}
+
+	version = strings.ToUpper(fields[0])
+	if !strings.HasPrefix(version, "HTTP/") || len(version) == len("HTTP/") {
+		return "", 0, "", false
+	}
+
+	if len(fields[1]) != 3 {
+		return "", 0, "", false
+	}
+	code, err := strconv.Atoi(fields[1])
+	if err != nil || code < 100 {
+		return "", 0, "", false
+	}
+
+	text = strings.Join(fields[2:], " ")
+	return version, code, text, true
+}
@@ -0,0 +1,56 @@
+package probe
+
+import (
+	"bytes"
+	"html"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// maxTitleLen caps the extracted title so a broken page can't fill the UI
+const maxTitleLen = 200
+
+// isHTML reports whether the response declares an HTML content type
+func isHTML(headers http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(headers.Get("Content-Type"))
+	return err == nil && (mediaType == "text/html" || mediaType == "application/xhtml+xml")
+}
+
+// extractTitle returns the text of the first <title> element in body. The
+// search is case-insensitive, tolerates attributes on the tag and stops at
+// </head>, so a title in the page body is never picked up.
+func extractTitle(body []byte) string {
+	lower := bytes.ToLower(body)
+
+	start := bytes.Index(lower, []byte("<title"))
+	if start < 0 {
+		return ""
+	}
+	if end := bytes.Index(lower, []byte("</head")); end >= 0 && end < start {
+		return ""
+	}
+	// Skip past the tag itself, making sure this isn't e.g. <titlebar>
+	rest := lower[start+len("<title"):]
+	if len(rest) == 0 || !(rest[0] == '>' || rest[0] == ' ' || rest[0] == '\t' || rest[0] == '\n' || rest[0] == '\r' || rest[0] == '/') {
+		return ""
+	}
+	open := bytes.IndexByte(rest, '>')
+	if open < 0 {
+		return ""
+	}
+	textStart := start + len("<title") + open + 1
+
+	// A truncated snippet may end before </title>; use what we have
+	textEnd := len(body)
+	if end := bytes.Index(lower[textStart:], []byte("</title")); end >= 0 {
+		textEnd = textStart + end
+	}
+
+	title := html.UnescapeString(string(body[textStart:textEnd]))
+	title = strings.Join(strings.Fields(title), " ")
+	if len(title) > maxTitleLen {
+		title = strings.ToValidUTF8(title[:maxTitleLen], "")
+	}
+	return title
+}
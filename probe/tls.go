@@ -0,0 +1,214 @@
+package probe
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"net"
+)
+
+// shouldTryTLS decides whether a plaintext result looks like we were
+// talking to a TLS listener. TLS servers typically reset the connection,
+// close it without a reply, answer with alert bytes, or (Go, nginx) return
+// a 400 explaining that an HTTP request was sent to an HTTPS port.
+func shouldTryTLS(ctx context.Context, result ProbeResult) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if result.IsHTTP {
+		return result.StatusCode == 400
+	}
+	if result.Err == nil {
+		// Connected and got a line back, but it wasn't HTTP
+		return true
+	}
+
+	// A silent server will stay silent for the handshake too
+	return !isTimeout(result.Err)
+}
+
+// sniFallbackName is the ServerName used to retry handshakes with servers
+// that won't present a certificate unless SNI is sent
+const sniFallbackName = "localhost"
+
+// probeTLS performs the HTTP probe over a TLS connection. Certificates are
+// not verified: the goal is to learn whether the port speaks TLS at all.
+// The returned result has IsTLS set only if the handshake succeeded.
+func probeTLS(ctx context.Context, addr string, host string, req request, opts ProbeOptions) ProbeResult {
+	conn, cert, err := connectTLS(ctx, addr, host, alpnHTTP1, opts)
+	var certErr *clientCertError
+	if errors.As(err, &certErr) {
+		return certErr.result()
+	}
+	if err != nil {
+		return ProbeResult{IsHTTP: false, Err: contextError(ctx, err)}
+	}
+	defer conn.Close()
+
+	state := conn.ConnectionState()
+	result := exchange(ctx, conn, req, opts)
+	result.IsTLS = true
+	result.TLSVersion = tls.VersionName(state.Version)
+	result.NegotiatedProtocol = state.NegotiatedProtocol
+	result.Cert = cert
+	// In TLS 1.3 the client is done with the handshake before the server
+	// has checked its certificate, so a missing one is refused with an
+	// alert in place of the answer
+	if !result.IsHTTP && result.Response == "" && cert.ClientCertRequested && opts.ClientCert == nil && isRemoteAlert(result.Err) {
+		result.ClientCertRequired = true
+	}
+	return result
+}
+
+// ALPN protocol lists offered during TLS probes
+var (
+	alpnHTTP1 = []string{"http/1.1"}
+	alpnH2    = []string{"h2"}
+	alpnAny   = []string{"h2", "http/1.1"}
+)
+
+// connectTLS dials addr and completes a TLS handshake offering the given
+// ALPN protocols, retrying with a fallback ServerName when the server
+// insists on SNI and host is an IP
+func connectTLS(ctx context.Context, addr string, host string, alpn []string, opts ProbeOptions) (*tls.Conn, *CertInfo, error) {
+	// SNI must be a hostname, never an IP literal
+	serverName := ""
+	if net.ParseIP(host) == nil {
+		serverName = host
+	}
+
+	conn, requested, err := dialTLS(ctx, addr, serverName, alpn, opts)
+	sniRequired := false
+	var certErr *clientCertError
+	if err != nil && serverName == "" && ctx.Err() == nil && !errors.As(err, &certErr) {
+		// Some servers (SNI-routed proxies) abort the handshake or send
+		// no certificate when no ServerName is given
+		serverName = sniFallbackName
+		conn, requested, err = dialTLS(ctx, addr, serverName, alpn, opts)
+		sniRequired = err == nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cert := newCertInfo(conn.ConnectionState().PeerCertificates, opts.Roots)
+	cert.ServerName = serverName
+	cert.ServerNameRequired = sniRequired
+	if requested != nil {
+		cert.ClientCertRequested = true
+		cert.AcceptableCAs = acceptableCAs(requested)
+	}
+	return conn, cert, nil
+}
+
+// errNoCertificate is returned when a handshake completes without the
+// server presenting any certificate
+var errNoCertificate = errors.New("tls: server presented no certificate")
+
+// dialTLS connects to addr and completes a TLS handshake with the given
+// SNI. It also returns the server's request for a client certificate, if
+// it made one.
+func dialTLS(ctx context.Context, addr string, serverName string, alpn []string, opts ProbeOptions) (*tls.Conn, *tls.CertificateRequestInfo, error) {
+	rawConn, err := opts.dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// A server asking for a client certificate gets opts.ClientCert, or
+	// an empty certificate message
+	var requested *tls.CertificateRequestInfo
+	config := &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         serverName,
+		NextProtos:         alpn,
+		GetClientCertificate: func(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			requested = info
+			if opts.ClientCert != nil {
+				return opts.ClientCert, nil
+			}
+			return &tls.Certificate{}, nil
+		},
+	}
+
+	conn := tls.Client(rawConn, config)
+	conn.SetDeadline(phaseDeadline(ctx, opts.DialTimeout+opts.ReadTimeout))
+	if err := conn.HandshakeContext(ctx); err != nil {
+		state := conn.ConnectionState()
+		rawConn.Close()
+		if requested != nil && opts.ClientCert == nil && isRemoteAlert(err) {
+			return nil, nil, newClientCertError(state, requested, err, opts.Roots)
+		}
+		return nil, nil, err
+	}
+	if len(conn.ConnectionState().PeerCertificates) == 0 {
+		conn.Close()
+		return nil, nil, errNoCertificate
+	}
+	return conn, requested, nil
+}
+
+// clientCertError is returned by dialTLS when the server asked for a
+// client certificate and failed the handshake without one (TLS 1.2)
+type clientCertError struct {
+	version       uint16
+	cert          *CertInfo // Nil if the server's certificate wasn't seen
+	acceptableCAs []string
+	err           error
+}
+
+func newClientCertError(state tls.ConnectionState, info *tls.CertificateRequestInfo, err error, roots *x509.CertPool) *clientCertError {
+	e := &clientCertError{version: state.Version, acceptableCAs: acceptableCAs(info), err: err}
+	if len(state.PeerCertificates) > 0 {
+		e.cert = newCertInfo(state.PeerCertificates, roots)
+		e.cert.ClientCertRequested = true
+		e.cert.AcceptableCAs = e.acceptableCAs
+	}
+	return e
+}
+
+func (e *clientCertError) Error() string {
+	return "tls: server requires a client certificate: " + e.err.Error()
+}
+
+func (e *clientCertError) Unwrap() error { return e.err }
+
+// result is the probe result of a handshake that failed for want of a
+// client certificate: TLS, but not through to HTTP
+func (e *clientCertError) result() ProbeResult {
+	result := ProbeResult{
+		IsTLS:              true,
+		ClientCertRequired: true,
+		Cert:               e.cert,
+		Err:                e,
+	}
+	if e.version != 0 {
+		result.TLSVersion = tls.VersionName(e.version)
+	}
+	return result
+}
+
+// isRemoteAlert reports whether err is a TLS alert sent by the server,
+// such as certificate_required or handshake_failure
+func isRemoteAlert(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "remote error"
+}
+
+// acceptableCAs decodes the distinguished names of the CAs a server said
+// it accepts client certificates from, e.g. "CN=Vault CA,O=Example"
+func acceptableCAs(info *tls.CertificateRequestInfo) []string {
+	var names []string
+	for _, der := range info.AcceptableCAs {
+		var rdns pkix.RDNSequence
+		if rest, err := asn1.Unmarshal(der, &rdns); err != nil || len(rest) > 0 {
+			continue
+		}
+		var name pkix.Name
+		name.FillFromRDNSequence(&rdns)
+		names = append(names, name.String())
+	}
+	return names
+}
@@ -0,0 +1,214 @@
+package probe
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"localhost-magic/internal/dnsmsg"
+)
+
+// UDPKind selects the datagram ProbeUDP sends
+type UDPKind string
+
+const (
+	UDPDNS    UDPKind = "dns"    // A query for localhost., expecting a DNS answer
+	UDPMDNS   UDPKind = "mdns"   // A legacy unicast mDNS query for the DNS-SD services list
+	UDPStatsd UDPKind = "statsd" // A zero counter; statsd never answers
+)
+
+// UDPState is what a UDP probe could observe. UDP has no handshake, so a
+// port that stays quiet may be open or filtered; only an ICMP port
+// unreachable, which the OS reports as a refusal on the socket, proves it
+// closed.
+type UDPState string
+
+const (
+	UDPResponded   UDPState = "responded"
+	UDPNoResponse  UDPState = "no-response"
+	UDPUnreachable UDPState = "unreachable"
+)
+
+// maxUDPReply is the largest reply read; anything beyond it is dropped
+const maxUDPReply = 9000
+
+// statsdProbe adds nothing to any counter, though statsd may still list
+// the metric name
+const statsdProbe = "localhost_magic.probe:0|c"
+
+// errUDPUnexpectedReply is set when a port answered with something other
+// than the protocol the probe asked for
+var errUDPUnexpectedReply = errors.New("unexpected reply")
+
+// ProbeUDP sends the datagram for kind to UDP host:port with the default
+// timeouts. See ProbeUDPWithOptions.
+func ProbeUDP(ctx context.Context, host string, port int, kind UDPKind) ProbeResult {
+	return ProbeUDPWithOptions(ctx, host, port, kind, ProbeOptions{})
+}
+
+// ProbeUDPWithOptions sends the datagram for kind to UDP host:port and
+// waits up to opts.ReadTimeout for an answer. UDP records what was seen:
+// a valid answer sets Kind to the protocol and State to StateOpenNonHTTP;
+// silence gives StateFiltered, which for statsd is the best there is and
+// means the datagram was accepted; an ICMP unreachable gives StateClosed.
+func ProbeUDPWithOptions(ctx context.Context, host string, port int, kind UDPKind, opts ProbeOptions) ProbeResult {
+	opts = opts.withDefaults()
+
+	start := time.Now()
+	var result ProbeResult
+	for _, dialHost := range DialHosts(ctx, host, opts.AddressFamily) {
+		attempt := udpExchange(ctx, dialHost, port, kind, opts)
+		if attempt.UDP == UDPResponded {
+			result = attempt
+			result.Address = dialHost
+			break
+		}
+		// The port is unreachable only if every address said so
+		if result.UDP == "" || result.UDP == UDPUnreachable {
+			result = attempt
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	result.Port = port
+	result.Transport = "udp"
+	result.Duration = time.Since(start)
+	result.Err = classifyError(result.Err)
+	switch {
+	case isContextError(result.Err):
+		result.UDP = ""
+		result.State = StateUnknown
+	case result.UDP == UDPResponded:
+		result.State = StateOpenNonHTTP
+	case result.UDP == UDPUnreachable:
+		result.State = StateClosed
+	default:
+		result.State = StateFiltered
+	}
+	return opts.Hooks.result(result)
+}
+
+// udpExchange sends one datagram to one address and classifies the reply
+func udpExchange(ctx context.Context, dialHost string, port int, kind UDPKind, opts ProbeOptions) ProbeResult {
+	payload, check, err := udpPayload(kind)
+	if err != nil {
+		return ProbeResult{Err: err}
+	}
+
+	addr := net.JoinHostPort(dialHost, strconv.Itoa(port))
+	conn, err := opts.dial(ctx, "udp", addr)
+	if err != nil {
+		return ProbeResult{Err: contextError(ctx, err)}
+	}
+	defer conn.Close()
+	conn.SetDeadline(phaseDeadline(ctx, opts.ReadTimeout))
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	start := time.Now()
+	if _, err := conn.Write(payload); err != nil {
+		return udpError(ctx, err)
+	}
+	buf := make([]byte, maxUDPReply)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return udpError(ctx, err)
+	}
+	result := ProbeResult{UDP: UDPResponded, TTFB: time.Since(start)}
+	if check != nil {
+		result.Kind, result.Banner = check(buf[:n])
+	}
+	if result.Kind == ServiceUnknown {
+		result.Err = errUDPUnexpectedReply
+	}
+	return result
+}
+
+// udpError classifies the error that ended a UDP exchange
+func udpError(ctx context.Context, err error) ProbeResult {
+	err = classifyError(contextError(ctx, err))
+	switch {
+	case errors.Is(err, ErrRefused):
+		return ProbeResult{UDP: UDPUnreachable, Err: err}
+	case errors.Is(err, ErrTimeout):
+		return ProbeResult{UDP: UDPNoResponse} // Silence is the expected outcome, not an error
+	}
+	return ProbeResult{Err: err}
+}
+
+// udpCheck identifies a reply, returning ServiceUnknown for anything but
+// the answer to the probe
+type udpCheck func(reply []byte) (kind ServiceKind, banner string)
+
+// udpPayload returns the datagram for kind and how to read the reply
+func udpPayload(kind UDPKind) ([]byte, udpCheck, error) {
+	switch kind {
+	case UDPDNS:
+		return dnsQuery("localhost.", dnsmsg.TypeA, ServiceDNS)
+	case UDPMDNS:
+		return dnsQuery("_services._dns-sd._udp.local.", dnsmsg.TypePTR, ServiceMDNS)
+	case UDPStatsd:
+		return []byte(statsdProbe), nil, nil
+	}
+	return nil, nil, fmt.Errorf("unknown UDP probe %q", kind)
+}
+
+// dnsQuery builds a query with a random ID and a check that accepts only
+// the response to it. Sent from an ephemeral port, the query is a legacy
+// unicast query to an mDNS responder, which answers it like a server.
+func dnsQuery(name string, qtype uint16, kind ServiceKind) ([]byte, udpCheck, error) {
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, nil, err
+	}
+	query := &dnsmsg.Message{
+		ID:        binary.BigEndian.Uint16(id[:]),
+		Questions: []dnsmsg.Question{{Name: name, Type: qtype, Class: dnsmsg.ClassIN}},
+	}
+	if kind == ServiceDNS {
+		query.Flags = dnsmsg.FlagRecursionDesired
+	}
+	check := func(reply []byte) (ServiceKind, string) {
+		m, err := dnsmsg.Parse(reply)
+		if err != nil || !m.IsResponse() || m.ID != query.ID {
+			return ServiceUnknown, ""
+		}
+		return kind, dnsSummary(m)
+	}
+	return query.Pack(), check, nil
+}
+
+// dnsRcodes names the response codes a local server is likely to send
+var dnsRcodes = map[uint16]string{
+	0: "NOERROR",
+	1: "FORMERR",
+	2: "SERVFAIL",
+	3: "NXDOMAIN",
+	4: "NOTIMP",
+	5: "REFUSED",
+}
+
+// dnsSummary describes a response, e.g. "NOERROR, 1 answer"
+func dnsSummary(m *dnsmsg.Message) string {
+	rcode := m.Flags & 0xF
+	name, ok := dnsRcodes[rcode]
+	if !ok {
+		name = "rcode " + strconv.Itoa(int(rcode))
+	}
+	parts := []string{name}
+	switch n := len(m.Answers); n {
+	case 0:
+	case 1:
+		parts = append(parts, "1 answer")
+	default:
+		parts = append(parts, strconv.Itoa(n)+" answers")
+	}
+	return strings.Join(parts, ", ")
+}
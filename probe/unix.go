@@ -0,0 +1,112 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// Errors returned in ProbeResult.Err by ProbeUnix. A socket the caller may
+// not connect to is reported with an error matching fs.ErrPermission.
+var (
+	// ErrNotSocket means the path exists but is not a Unix domain socket
+	ErrNotSocket = errors.New("not a unix socket")
+	// ErrStaleSocket means the socket file exists but nothing is listening
+	// on it, usually left behind by a process that exited uncleanly
+	ErrStaleSocket = errors.New("stale unix socket: connection refused")
+)
+
+// ProbeUnix probes an HTTP service listening on a Unix domain socket. It
+// sends the same request as a TCP probe and classifies the response the
+// same way; Address is set to socketPath and Port is zero.
+func ProbeUnix(ctx context.Context, socketPath string, opts ProbeOptions) ProbeResult {
+	opts = opts.withDefaults()
+	if err := ValidateHeaders(opts.Headers); err != nil {
+		return ProbeResult{Address: socketPath, Err: err}
+	}
+	start := time.Now()
+	result, connected := probeUnix(ctx, socketPath, opts)
+	result.Address = socketPath
+	result.Duration = time.Since(start)
+	result.Err = classifyError(result.Err)
+	result.State = classifyState(result, connected)
+	return opts.Hooks.result(result)
+}
+
+// probeUnix checks the socket file so the common failure modes come back
+// as distinct errors, then runs the first-contact probe over it
+func probeUnix(ctx context.Context, socketPath string, opts ProbeOptions) (ProbeResult, bool) {
+	info, err := os.Stat(socketPath)
+	if err != nil {
+		return ProbeResult{Err: err}, false
+	}
+	if info.Mode()&fs.ModeSocket == 0 {
+		return ProbeResult{Err: fmt.Errorf("%s: %w", socketPath, ErrNotSocket)}, false
+	}
+
+	conn, connectTime, err := opts.dialTimed(ctx, "unix", socketPath)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ProbeResult{Err: ctx.Err()}, false
+		}
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return ProbeResult{Err: fmt.Errorf("%s: %w: %w", socketPath, ErrStaleSocket, err)}, false
+		}
+		return ProbeResult{Err: err}, false
+	}
+	defer conn.Close()
+
+	result := firstContact(ctx, conn, 0, opts)
+	result.ConnectTime = connectTime
+	return result, true
+}
+
+// unixSocketPatterns are the usual places dev tools leave their sockets
+var unixSocketPatterns = []string{
+	"/tmp/*.sock",
+	"/tmp/*/*.sock",
+	"/var/run/*.sock",
+	"/run/*.sock",
+	"/run/php/*.sock",
+	"/var/run/php/*.sock",
+}
+
+// FindUnixSockets returns the Unix domain sockets found in common locations
+// (/tmp, /run, /var/run and $XDG_RUNTIME_DIR), sorted and deduplicated.
+// Entries that are not sockets are skipped.
+func FindUnixSockets() []string {
+	patterns := append([]string(nil), unixSocketPatterns...)
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		patterns = append(patterns,
+			filepath.Join(dir, "*.sock"),
+			filepath.Join(dir, "*", "*.sock"),
+		)
+	}
+
+	seen := make(map[string]bool)
+	var sockets []string
+	for _, pattern := range patterns {
+		matches, _ := filepath.Glob(pattern)
+		for _, path := range matches {
+			// Resolve symlinks such as /var/run -> /run before deduplicating
+			if resolved, err := filepath.EvalSymlinks(path); err == nil {
+				path = resolved
+			}
+			if seen[path] {
+				continue
+			}
+			seen[path] = true
+			if info, err := os.Stat(path); err == nil && info.Mode()&fs.ModeSocket != 0 {
+				sockets = append(sockets, path)
+			}
+		}
+	}
+	sort.Strings(sockets)
+	return sockets
+}
@@ -0,0 +1,98 @@
+package probe
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"time"
+)
+
+// keepAliveHold is how long a server must leave the connection open after
+// answering a keep-alive request to count as keeping connections alive
+const keepAliveHold = 50 * time.Millisecond
+
+// HTTP versions listed in ProbeResult.SupportedVersions, by their ALPN
+// protocol IDs
+const (
+	VersionHTTP10 = "http/1.0"
+	VersionHTTP11 = "http/1.1"
+	VersionH2     = "h2"
+	VersionH2C    = "h2c" // HTTP/2 over cleartext, with prior knowledge
+	VersionH3     = "h3"
+)
+
+// detectVersions fills in SupportedVersions and KeepAlive for a service
+// that answered the HTTP/1.0 probe: an HTTP/1.1 request without
+// Connection: close tells whether it speaks HTTP/1.1 and holds the
+// connection open after answering, a TLS handshake offering h2 whether it
+// negotiates HTTP/2, and the Alt-Svc header whether it advertises HTTP/3
+func detectVersions(ctx context.Context, result ProbeResult, host, addr string, opts ProbeOptions) ProbeResult {
+	versions := []string{VersionHTTP10}
+	if version, keepAlive := probeKeepAlive(ctx, addr, host, result.IsTLS, opts); version == "HTTP/1.1" {
+		versions = append(versions, VersionHTTP11)
+		result.KeepAlive = keepAlive
+	}
+	if result.IsTLS && negotiatesH2(ctx, addr, host, opts) {
+		versions = append(versions, VersionH2)
+	}
+	if _, ok := altSvcH3Port(result.Headers); ok {
+		versions = append(versions, VersionH3)
+	}
+	result.SupportedVersions = versions
+	return result
+}
+
+// probeKeepAlive sends the main probe request as HTTP/1.1 on a connection
+// of its own and returns the version of the answer, and whether the server
+// left the connection open for keepAliveHold after the whole response
+func probeKeepAlive(ctx context.Context, addr, host string, useTLS bool, opts ProbeOptions) (string, bool) {
+	var conn net.Conn
+	if useTLS {
+		tlsConn, _, err := connectTLS(ctx, addr, host, alpnHTTP1, opts)
+		if err != nil {
+			return "", false
+		}
+		conn = tlsConn
+	} else {
+		plain, err := opts.dial(ctx, "tcp", addr)
+		if err != nil {
+			return "", false
+		}
+		conn = plain
+	}
+	defer conn.Close()
+
+	req := opts.keepAliveRequest()
+	reader := bufio.NewReader(conn)
+	resp := exchangeOn(ctx, conn, reader, req, opts)
+	if !resp.IsHTTP {
+		return "", false
+	}
+	if !complete(req, resp) {
+		return resp.HTTPVersion, false
+	}
+	return resp.HTTPVersion, ctx.Err() == nil && heldOpen(conn, reader, keepAliveHold)
+}
+
+// heldOpen reports whether the server neither closes conn nor sends
+// anything unasked on it within d
+func heldOpen(conn net.Conn, reader *bufio.Reader, d time.Duration) bool {
+	if reader.Buffered() > 0 {
+		return false
+	}
+	conn.SetReadDeadline(time.Now().Add(d))
+	_, err := reader.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+	return isTimeout(err)
+}
+
+// negotiatesH2 reports whether a TLS server picks h2 from an ALPN offer of
+// h2 and http/1.1
+func negotiatesH2(ctx context.Context, addr, host string, opts ProbeOptions) bool {
+	conn, _, err := connectTLS(ctx, addr, host, alpnAny, opts)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	return conn.ConnectionState().NegotiatedProtocol == VersionH2
+}
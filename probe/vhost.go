@@ -0,0 +1,62 @@
+package probe
+
+import (
+	"context"
+	"net"
+	"strconv"
+)
+
+// catchAllName is a name no real virtual host will be configured for, used
+// to capture the server's default response
+const catchAllName = "default.localhost-magic.invalid"
+
+// ProbeVirtualHosts probes host:port once per candidate name, sending it
+// as both the Host header and the TLS ServerName. Each result has
+// DefaultVHost set when its status line, Server header and certificate are
+// the same as for an unknown name, i.e. the name only reached the server's
+// catch-all rather than a configured virtual host.
+func ProbeVirtualHosts(ctx context.Context, host string, port int, names []string, opts ProbeOptions) map[string]ProbeResult {
+	baselineOpts := opts
+	baselineOpts.Host = catchAllName
+	baseline := probeWithOptions(ctx, host, port, baselineOpts)
+	defaultSig := vhostSignature(baseline)
+
+	// The first probe already waited for any banner
+	opts.BannerTimeout = -1
+
+	results := make(map[string]ProbeResult, len(names))
+	for _, name := range names {
+		if _, done := results[name]; done {
+			continue
+		}
+		if ctx.Err() != nil {
+			results[name] = ProbeResult{Port: port, Err: ctx.Err()}
+			continue
+		}
+
+		nameOpts := opts
+		nameOpts.Host = name
+		result := probeWithOptions(ctx, host, port, nameOpts)
+		result.DefaultVHost = result.Err == nil && baseline.Err == nil && vhostSignature(result) == defaultSig
+		results[name] = result
+	}
+	return results
+}
+
+// vhostSignature summarises what distinguishes one virtual host's answer
+// from another's
+func vhostSignature(result ProbeResult) string {
+	sig := strconv.Itoa(result.StatusCode) + "\x00" + result.Response + "\x00" + result.Headers.Get("Server")
+	if result.Cert != nil {
+		sig += "\x00" + result.Cert.Fingerprint
+	}
+	return sig
+}
+
+// hostOnly strips an optional port from a Host header value
+func hostOnly(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		return host
+	}
+	return hostport
+}
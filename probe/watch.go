@@ -0,0 +1,113 @@
+package probe
+
+import (
+	"context"
+	"time"
+)
+
+// PortStatus is the coarse classification a watcher tracks for a port
+type PortStatus string
+
+const (
+	StatusUnknown PortStatus = ""       // Not probed yet
+	StatusClosed  PortStatus = "closed" // Nothing accepted the connection
+	StatusOpen    PortStatus = "open"   // Accepted the connection but isn't HTTP
+	StatusHTTP    PortStatus = "http"   // Speaks HTTP (HTTP/1.x, h2, h2c or gRPC)
+)
+
+// watchConfirmDelay is how long a watcher waits before re-probing to
+// confirm a change, so a server restarting during hot-reload doesn't
+// produce a down/up pair of events
+const watchConfirmDelay = time.Second
+
+// watchPool keeps the connections of routine Watch probes alive between
+// intervals
+var watchPool = NewConnPool(DefaultPoolSize, DefaultPoolIdle)
+
+// StateChange is emitted by Watch when a port moves between statuses
+type StateChange struct {
+	Old    PortStatus
+	New    PortStatus
+	Result ProbeResult // The probe that confirmed the new status
+	Time   time.Time
+}
+
+// Status classifies a probe result for watching
+func (r ProbeResult) Status() PortStatus {
+	switch {
+	case r.IsHTTP || r.Protocol != ProtocolUnknown:
+		return StatusHTTP
+	case r.Address != "":
+		return StatusOpen
+	default:
+		return StatusClosed
+	}
+}
+
+// Watch probes host:port every interval and sends a StateChange whenever
+// its status changes. The first probe is reported as a change from
+// StatusUnknown. A new status is only reported once a second probe made
+// shortly afterwards agrees, which filters out brief restarts. The channel
+// is closed when ctx is cancelled. Routine probes of an HTTP/1.1 service
+// reuse a kept-alive connection; the first probe and confirmations don't.
+func Watch(ctx context.Context, host string, port int, interval time.Duration) <-chan StateChange {
+	changes := make(chan StateChange, 1)
+
+	go func() {
+		defer close(changes)
+
+		current := StatusUnknown
+		var last ProbeResult
+		for {
+			var result ProbeResult
+			if current == StatusUnknown {
+				result = ProbeContext(ctx, host, port)
+			} else {
+				result = Recheck(ctx, host, port, last, watchPool, ProbeOptions{})
+			}
+			if ctx.Err() != nil {
+				return
+			}
+
+			if status := result.Status(); status != current {
+				// Confirm before reporting, except for the very first probe
+				if current != StatusUnknown {
+					if !sleepContext(ctx, min(watchConfirmDelay, interval)) {
+						return
+					}
+					result = ProbeContext(ctx, host, port)
+					if ctx.Err() != nil {
+						return
+					}
+				}
+				if result.Status() == status {
+					select {
+					case changes <- StateChange{Old: current, New: status, Result: result, Time: time.Now()}:
+					case <-ctx.Done():
+						return
+					}
+					current = status
+				}
+			}
+			last = result
+
+			if !sleepContext(ctx, interval) {
+				return
+			}
+		}
+	}()
+
+	return changes
+}
+
+// sleepContext waits for d, returning false if ctx was cancelled first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}